@@ -0,0 +1,293 @@
+/*
+Package mqtt implements a bridge between a broadcast_hub server and an MQTT broker.
+
+Relays published to a hub topic are published to the mapped MQTT topic, and messages published to a subscribed MQTT
+topic are published to the mapped hub topic, by a single client of the hub which the bridge connects to it in memory.
+Each mapping can bridge in one direction or both. Messages the bridge itself publishes aren't bridged back again.
+
+The bridge uses an MQTT client connected by the caller, so the broker's address, credentials and TLS are set up with
+paho's ClientOptions. Subscriptions are made once, when the bridge is created, so the client should either keep its
+session (with CleanSession false) or create a new bridge when it reconnects.
+
+Example, bridging the "alerts" topic both ways, and everything under "sensors/" into the hub's "sensors" topic:
+
+	opts := paho.NewClientOptions().AddBroker("tcp://localhost:1883")
+	broker := paho.NewClient(opts)
+	if tok := broker.Connect(); tok.Wait() && tok.Error() != nil {
+		log.Fatal(tok.Error())
+	}
+	br, err := mqtt.New(ser.AddClientByConnection, broker, mqtt.Config{Topics: []mqtt.TopicMapping{
+		{Hub: "alerts", QoS: 1},
+		{Hub: "sensors", MQTT: "sensors/#", Direction: mqtt.FromMQTT},
+	}})
+*/
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CiaranWoodward/broadcast_hub/client"
+	"github.com/CiaranWoodward/broadcast_hub/logging"
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Direction determines which way a TopicMapping bridges messages
+type Direction int
+
+const (
+	// Bridge messages both ways
+	Both Direction = iota
+	// Only publish relays from the hub to MQTT
+	ToMQTT
+	// Only publish messages from MQTT to the hub
+	FromMQTT
+)
+
+// Default values, used for any Config fields left as zero
+const (
+	defaultBrokerTimeout = 10 * time.Second
+	defaultInboundQueue  = 64
+)
+
+// Most messages published to MQTT remembered at once, so they aren't bridged back to the hub when the broker sends them
+// back. Messages the broker never sends back (as there's no matching subscription) are forgotten once there are this many.
+const maxEchoes = 1024
+
+// ErrWildcard is returned by New for a mapping that would publish to an MQTT topic filter containing wildcards
+var ErrWildcard = errors.New("cannot publish to an MQTT topic with wildcards")
+
+// TopicMapping maps a topic on the hub to a topic on the MQTT broker
+type TopicMapping struct {
+	// Topic on the hub
+	Hub string
+	// Topic on the MQTT broker. Empty uses the same name as the hub topic. Mappings from MQTT may use a topic filter with
+	// the '+' and '#' wildcards, publishing every matching message to the one hub topic.
+	MQTT string
+	// Which way messages are bridged
+	Direction Direction
+	// MQTT quality of service for publishing and subscribing: 0, 1 or 2
+	QoS byte
+	// Whether messages published to MQTT are retained by the broker
+	Retained bool
+}
+
+// Config holds the tunable parameters of a Bridge.
+// The zero value is valid, and any fields left as zero are replaced with their defaults.
+type Config struct {
+	// Topics to bridge
+	Topics []TopicMapping
+	// How long to wait for the broker to acknowledge each subscription or publish
+	BrokerTimeout time.Duration
+	// Messages from MQTT waiting to be published to the hub. Once it's full, the MQTT client is held up until there's space.
+	InboundQueue int
+	// Credentials the bridge's client authenticates with, if the hub requires them
+	Credentials msg.Credentials
+	// Configuration of the bridge's client
+	ClientConfig client.ClientConfig
+	// Where the bridge's logs are written. Nil writes Info and above to the standard library's default logger.
+	Logger logging.Logger
+}
+
+// Bridge bridges topics between a hub and an MQTT broker, created with 'New'
+type Bridge struct {
+	config  Config
+	cli     *client.Client
+	broker  paho.Client
+	inbound chan inboundMessage
+	// Subscribed MQTT topic filters, to unsubscribe from when the bridge is closed
+	filters []string
+	// Messages recently published to MQTT, as counts of each topic and payload, and a mutex protecting them
+	echoes       map[string]int
+	echoes_mutex sync.Mutex
+	done         chan struct{}
+	workers      sync.WaitGroup
+	closeOnce    sync.Once
+}
+
+// Message from MQTT, to be published to a hub topic
+type inboundMessage struct {
+	topic   string
+	payload []byte
+}
+
+// Replace any unset fields with their defaults
+func (cfg Config) withDefaults() Config {
+	if cfg.BrokerTimeout <= 0 {
+		cfg.BrokerTimeout = defaultBrokerTimeout
+	}
+	if cfg.InboundQueue <= 0 {
+		cfg.InboundQueue = defaultInboundQueue
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = logging.Default()
+	}
+	return cfg
+}
+
+// New creates a bridge between the MQTT broker that 'broker' is connected to, and the hub that 'accept' connects the
+// bridge's client to (For example 'Server.AddClientByConnection').
+func New(accept func(con net.Conn) bool, broker paho.Client, cfg Config) (*Bridge, error) {
+	cfg = cfg.withDefaults()
+	for i, m := range cfg.Topics {
+		if m.MQTT == "" {
+			cfg.Topics[i].MQTT = m.Hub
+		} else if m.Direction != FromMQTT && strings.ContainsAny(m.MQTT, "+#") {
+			return nil, fmt.Errorf("%w: %s", ErrWildcard, m.MQTT)
+		}
+	}
+
+	cli, ser := net.Pipe()
+	if !accept(ser) {
+		cli.Close()
+		return nil, msg.NewStatusError(msg.CONNECTION_ERROR, 0, nil)
+	}
+	b := &Bridge{
+		config:  cfg,
+		cli:     client.NewClientWithConfig(cli, cfg.ClientConfig),
+		broker:  broker,
+		inbound: make(chan inboundMessage, cfg.InboundQueue),
+		echoes:  make(map[string]int),
+		done:    make(chan struct{}),
+	}
+	// Anything not sent to a bridged topic isn't for MQTT, so discard it
+	b.cli.OnRelay(func(msg.RelayIndication) {})
+	if cfg.Credentials != (msg.Credentials{}) {
+		if err := b.cli.Authenticate(cfg.Credentials); err != nil {
+			b.cli.Close()
+			return nil, err
+		}
+	}
+
+	b.workers.Add(1)
+	go b.publishInbound()
+	for _, m := range cfg.Topics {
+		if err := b.bridge(m); err != nil {
+			b.Close()
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// Close stops bridging, unsubscribing from the MQTT topics and disconnecting the bridge's client from the hub.
+// The MQTT client is left connected.
+func (b *Bridge) Close() {
+	b.closeOnce.Do(func() {
+		if len(b.filters) > 0 {
+			b.broker.Unsubscribe(b.filters...).WaitTimeout(b.config.BrokerTimeout)
+		}
+		close(b.done)
+		b.cli.Close()
+		b.workers.Wait()
+	})
+}
+
+// Start bridging a topic mapping
+func (b *Bridge) bridge(m TopicMapping) error {
+	if m.Direction != FromMQTT {
+		relays, err := b.cli.Subscribe(m.Hub)
+		if err != nil {
+			return err
+		}
+		b.workers.Add(1)
+		go b.publishOutbound(m, relays)
+	}
+	if m.Direction != ToMQTT {
+		tok := b.broker.Subscribe(m.MQTT, m.QoS, func(_ paho.Client, mm paho.Message) {
+			b.receive(m.Hub, mm)
+		})
+		if err := b.wait(tok); err != nil {
+			return fmt.Errorf("failed to subscribe to MQTT topic %s: %w", m.MQTT, err)
+		}
+		b.filters = append(b.filters, m.MQTT)
+	}
+	return nil
+}
+
+// Publish relays from a hub topic to MQTT, until the subscription ends
+func (b *Bridge) publishOutbound(m TopicMapping, relays <-chan msg.RelayIndication) {
+	defer b.workers.Done()
+	for ind := range relays {
+		if m.Direction == Both {
+			b.addEcho(m.MQTT, ind.Msg)
+		}
+		if err := b.wait(b.broker.Publish(m.MQTT, m.QoS, m.Retained, ind.Msg)); err != nil {
+			b.config.Logger.Warn("Failed to publish to MQTT", logging.F("topic", m.MQTT), logging.F("err", err))
+		}
+	}
+}
+
+// Queue a message from MQTT to be published to the hub, unless it's one the bridge published itself
+func (b *Bridge) receive(topic string, mm paho.Message) {
+	if b.takeEcho(mm.Topic(), mm.Payload()) {
+		return
+	}
+	select {
+	case b.inbound <- inboundMessage{topic: topic, payload: mm.Payload()}:
+	case <-b.done:
+	}
+}
+
+// Publish messages from MQTT to the hub, until the bridge is closed
+func (b *Bridge) publishInbound() {
+	defer b.workers.Done()
+	for {
+		select {
+		case im := <-b.inbound:
+			ctx, cancel := context.WithTimeout(context.Background(), b.config.BrokerTimeout)
+			_, err := b.cli.PublishMessageCtx(ctx, im.topic, im.payload)
+			cancel()
+			if err != nil {
+				b.config.Logger.Warn("Failed to publish to the hub", logging.F("topic", im.topic), logging.F("err", err))
+			}
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// Wait for the broker to complete an operation
+func (b *Bridge) wait(tok paho.Token) error {
+	if !tok.WaitTimeout(b.config.BrokerTimeout) {
+		return msg.NewStatusError(msg.TIMEOUT, 0, nil)
+	}
+	return tok.Error()
+}
+
+// Remember a message published to MQTT, so it isn't bridged back again
+func (b *Bridge) addEcho(topic string, payload []byte) {
+	b.echoes_mutex.Lock()
+	defer b.echoes_mutex.Unlock()
+	if len(b.echoes) >= maxEchoes {
+		b.echoes = make(map[string]int)
+	}
+	b.echoes[echoKey(topic, payload)]++
+}
+
+// Check whether a message from MQTT is one the bridge published, forgetting it if so
+func (b *Bridge) takeEcho(topic string, payload []byte) bool {
+	b.echoes_mutex.Lock()
+	defer b.echoes_mutex.Unlock()
+	key := echoKey(topic, payload)
+	n, ok := b.echoes[key]
+	if !ok {
+		return false
+	}
+	if n <= 1 {
+		delete(b.echoes, key)
+	} else {
+		b.echoes[key] = n - 1
+	}
+	return true
+}
+
+func echoKey(topic string, payload []byte) string {
+	return topic + "\x00" + string(payload)
+}
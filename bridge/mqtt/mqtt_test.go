@@ -0,0 +1,159 @@
+package mqtt
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/CiaranWoodward/broadcast_hub/client"
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+	"github.com/CiaranWoodward/broadcast_hub/server"
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+)
+
+// Token of an operation that has already completed
+type doneToken struct{ err error }
+
+func (t doneToken) Wait() bool                     { return true }
+func (t doneToken) WaitTimeout(time.Duration) bool { return true }
+func (t doneToken) Error() error                   { return t.err }
+func (t doneToken) Done() <-chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}
+
+// Message published to the fake broker
+type fakeMessage struct {
+	topic   string
+	qos     byte
+	payload []byte
+}
+
+func (m fakeMessage) Duplicate() bool   { return false }
+func (m fakeMessage) Qos() byte         { return m.qos }
+func (m fakeMessage) Retained() bool    { return false }
+func (m fakeMessage) Topic() string     { return m.topic }
+func (m fakeMessage) MessageID() uint16 { return 0 }
+func (m fakeMessage) Payload() []byte   { return m.payload }
+func (m fakeMessage) Ack()              {}
+
+// MQTT client connected to an in-memory broker, which delivers each publish to the matching subscriptions (including
+// the client's own, as MQTT does), and records it
+type fakeBroker struct {
+	paho.Client
+	mutex     sync.Mutex
+	subs      map[string]paho.MessageHandler
+	published []fakeMessage
+}
+
+func (f *fakeBroker) Publish(topic string, qos byte, retained bool, payload interface{}) paho.Token {
+	m := fakeMessage{topic: topic, qos: qos, payload: payload.([]byte)}
+	f.mutex.Lock()
+	f.published = append(f.published, m)
+	var handlers []paho.MessageHandler
+	for filter, h := range f.subs {
+		if filter == topic || (strings.HasSuffix(filter, "#") && strings.HasPrefix(topic, strings.TrimSuffix(filter, "#"))) {
+			handlers = append(handlers, h)
+		}
+	}
+	f.mutex.Unlock()
+	for _, h := range handlers {
+		h(f, m)
+	}
+	return doneToken{}
+}
+
+func (f *fakeBroker) Subscribe(topic string, qos byte, callback paho.MessageHandler) paho.Token {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.subs[topic] = callback
+	return doneToken{}
+}
+
+func (f *fakeBroker) Unsubscribe(topics ...string) paho.Token {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, t := range topics {
+		delete(f.subs, t)
+	}
+	return doneToken{}
+}
+
+func (f *fakeBroker) publishedTo(topic string) (payloads []string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, m := range f.published {
+		if m.topic == topic {
+			payloads = append(payloads, string(m.payload))
+		}
+	}
+	return
+}
+
+func TestBridge(t *testing.T) {
+	// Test that topics are bridged in the configured directions, without echoing the bridge's own messages
+	defer goleak.VerifyNone(t)
+
+	hub := server.NewServer()
+	broker := &fakeBroker{subs: make(map[string]paho.MessageHandler)}
+	br, err := New(hub.AddClientByConnection, broker, Config{Topics: []TopicMapping{
+		{Hub: "alerts", QoS: 1},
+		{Hub: "sensors", MQTT: "sensors/#", Direction: FromMQTT},
+		{Hub: "logs", MQTT: "hub/logs", Direction: ToMQTT},
+	}})
+	assert.Nil(t, err)
+
+	cli, ser := net.Pipe()
+	hub.AddClientByConnection(ser)
+	native := client.NewClient(cli)
+	alerts, err := native.Subscribe("alerts")
+	assert.Nil(t, err)
+	sensors, err := native.Subscribe("sensors")
+	assert.Nil(t, err)
+
+	// From the hub to MQTT, once only
+	_, err = native.PublishMessage("alerts", []byte("fire"))
+	assert.Nil(t, err)
+	_, err = native.PublishMessage("logs", []byte("started"))
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool { return len(broker.publishedTo("hub/logs")) == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, []string{"fire"}, broker.publishedTo("alerts"))
+
+	// From MQTT to the hub, including wildcard subscriptions
+	broker.Publish("alerts", 1, false, []byte("flood"))
+	broker.Publish("sensors/kitchen", 0, false, []byte("21C"))
+	ind := <-alerts
+	assert.Equal(t, []byte("flood"), ind.Msg)
+	ind = <-sensors
+	assert.Equal(t, []byte("21C"), ind.Msg)
+	select {
+	case ind = <-alerts:
+		t.Errorf("Echoed relay: %s", ind.Msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Closing the bridge unsubscribes from MQTT
+	br.Close()
+	assert.Empty(t, broker.subs)
+	native.Close()
+}
+
+func TestBridgeWildcard(t *testing.T) {
+	// Test that mappings publishing to an MQTT topic filter are rejected
+	defer goleak.VerifyNone(t)
+
+	hub := server.NewServer()
+	broker := &fakeBroker{subs: make(map[string]paho.MessageHandler)}
+	_, err := New(hub.AddClientByConnection, broker, Config{Topics: []TopicMapping{{Hub: "sensors", MQTT: "sensors/+"}}})
+	assert.ErrorIs(t, err, ErrWildcard)
+
+	// And that the hub's client is cleaned up if the bridge can't be created
+	_, err = New(hub.AddClientByConnection, broker, Config{Topics: []TopicMapping{{Hub: ""}}})
+	assert.ErrorIs(t, err, msg.INVALID_ID)
+	assert.Empty(t, broker.subs)
+}
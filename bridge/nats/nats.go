@@ -0,0 +1,291 @@
+/*
+Package nats implements a bridge between a broadcast_hub server and NATS.
+
+Relays published to a hub topic are published to the mapped NATS subject, and messages published to a subscribed NATS
+subject are published to the mapped hub topic, by a single client of the hub which the bridge connects to it in memory.
+On the hub, everything from NATS comes from that client's ClientId. Each mapping can bridge in one direction or both.
+
+Messages published to NATS carry the ClientId of the relay's source in the Hub-Src header, and its content type in the
+Content-Type header if it has one. They also identify the bridge in the Hub-Bridge header, so messages the bridge
+itself publishes aren't bridged back again, but messages from bridges to other hubs are.
+
+The bridge uses a NATS connection made by the caller, and subscribes once when it's created, relying on the connection
+to resubscribe when it reconnects.
+
+Example, bridging the "alerts" topic both ways, and every subject under "sensors." into the hub's "sensors" topic:
+
+	nc, err := gonats.Connect(gonats.DefaultURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	br, err := nats.New(ser.AddClientByConnection, nc, nats.Config{Topics: []nats.TopicMapping{
+		{Hub: "alerts"},
+		{Hub: "sensors", Subject: "sensors.>", Direction: nats.FromNATS},
+	}})
+*/
+package nats
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CiaranWoodward/broadcast_hub/client"
+	"github.com/CiaranWoodward/broadcast_hub/logging"
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+	gonats "github.com/nats-io/nats.go"
+)
+
+// Direction determines which way a TopicMapping bridges messages
+type Direction int
+
+const (
+	// Bridge messages both ways
+	Both Direction = iota
+	// Only publish relays from the hub to NATS
+	ToNATS
+	// Only publish messages from NATS to the hub
+	FromNATS
+)
+
+// Headers set on messages published to NATS
+const (
+	HeaderSource      = "Hub-Src"
+	HeaderBridge      = "Hub-Bridge"
+	HeaderContentType = "Content-Type"
+)
+
+// Default values, used for any Config fields left as zero
+const (
+	defaultPublishTimeout = 5 * time.Second
+	defaultInboundQueue   = 64
+)
+
+// ErrWildcard is returned by New for a mapping that would publish to a NATS subject containing wildcards
+var ErrWildcard = errors.New("cannot publish to a NATS subject with wildcards")
+
+// Conn is the connection to NATS used by a Bridge, which is satisfied by *nats.Conn
+type Conn interface {
+	PublishMsg(m *gonats.Msg) error
+	Subscribe(subj string, cb gonats.MsgHandler) (*gonats.Subscription, error)
+}
+
+// TopicMapping maps a topic on the hub to a NATS subject
+type TopicMapping struct {
+	// Topic on the hub
+	Hub string
+	// NATS subject. Empty uses the same name as the hub topic. Mappings from NATS may use a subject with the '*' and '>'
+	// wildcards, publishing every matching message to the one hub topic.
+	Subject string
+	// Which way messages are bridged
+	Direction Direction
+}
+
+// Config holds the tunable parameters of a Bridge.
+// The zero value is valid, and any fields left as zero are replaced with their defaults.
+type Config struct {
+	// Topics to bridge
+	Topics []TopicMapping
+	// How long to wait for the hub to accept each message from NATS
+	PublishTimeout time.Duration
+	// Messages from NATS waiting to be published to the hub. Once it's full, the subscription is held up until there's
+	// space, and NATS may drop messages for it as a slow consumer.
+	InboundQueue int
+	// Credentials the bridge's client authenticates with, if the hub requires them
+	Credentials msg.Credentials
+	// Configuration of the bridge's client
+	ClientConfig client.ClientConfig
+	// Where the bridge's logs are written. Nil writes Info and above to the standard library's default logger.
+	Logger logging.Logger
+}
+
+// Bridge bridges topics between a hub and NATS, created with 'New'
+type Bridge struct {
+	config  Config
+	cli     *client.Client
+	conn    Conn
+	token   string
+	inbound chan inboundMessage
+	// Subscriptions to NATS, to unsubscribe from when the bridge is closed
+	subs      []*gonats.Subscription
+	done      chan struct{}
+	workers   sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// Message from NATS, to be published to a hub topic
+type inboundMessage struct {
+	topic string
+	data  []byte
+}
+
+// Replace any unset fields with their defaults
+func (cfg Config) withDefaults() Config {
+	if cfg.PublishTimeout <= 0 {
+		cfg.PublishTimeout = defaultPublishTimeout
+	}
+	if cfg.InboundQueue <= 0 {
+		cfg.InboundQueue = defaultInboundQueue
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = logging.Default()
+	}
+	return cfg
+}
+
+// New creates a bridge between NATS, through 'conn', and the hub that 'accept' connects the bridge's client to
+// (For example 'Server.AddClientByConnection').
+func New(accept func(con net.Conn) bool, conn Conn, cfg Config) (*Bridge, error) {
+	cfg = cfg.withDefaults()
+	for i, m := range cfg.Topics {
+		if m.Subject == "" {
+			cfg.Topics[i].Subject = m.Hub
+		} else if m.Direction != FromNATS && hasWildcard(m.Subject) {
+			return nil, fmt.Errorf("%w: %s", ErrWildcard, m.Subject)
+		}
+	}
+	token := make([]byte, 8)
+	if _, err := rand.Read(token); err != nil {
+		panic(err)
+	}
+
+	cli, ser := net.Pipe()
+	if !accept(ser) {
+		cli.Close()
+		return nil, msg.NewStatusError(msg.CONNECTION_ERROR, 0, nil)
+	}
+	b := &Bridge{
+		config:  cfg,
+		cli:     client.NewClientWithConfig(cli, cfg.ClientConfig),
+		conn:    conn,
+		token:   hex.EncodeToString(token),
+		inbound: make(chan inboundMessage, cfg.InboundQueue),
+		done:    make(chan struct{}),
+	}
+	// Anything not sent to a bridged topic isn't for NATS, so discard it
+	b.cli.OnRelay(func(msg.RelayIndication) {})
+	if cfg.Credentials != (msg.Credentials{}) {
+		if err := b.cli.Authenticate(cfg.Credentials); err != nil {
+			b.cli.Close()
+			return nil, err
+		}
+	}
+	if _, err := b.cli.GetClientId(); err != nil {
+		b.cli.Close()
+		return nil, err
+	}
+
+	b.workers.Add(1)
+	go b.publishInbound()
+	for _, m := range cfg.Topics {
+		if err := b.bridge(m); err != nil {
+			b.Close()
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// ID gets the ClientId of the bridge's client, which messages from NATS are relayed from on the hub
+func (b *Bridge) ID() msg.ClientId {
+	return b.cli.ID()
+}
+
+// Close stops bridging, unsubscribing from the NATS subjects and disconnecting the bridge's client from the hub.
+// The NATS connection is left open.
+func (b *Bridge) Close() {
+	b.closeOnce.Do(func() {
+		for _, sub := range b.subs {
+			sub.Unsubscribe()
+		}
+		close(b.done)
+		b.cli.Close()
+		b.workers.Wait()
+	})
+}
+
+// Start bridging a topic mapping
+func (b *Bridge) bridge(m TopicMapping) error {
+	if m.Direction != FromNATS {
+		relays, err := b.cli.Subscribe(m.Hub)
+		if err != nil {
+			return err
+		}
+		b.workers.Add(1)
+		go b.publishOutbound(m, relays)
+	}
+	if m.Direction != ToNATS {
+		hubTopic := m.Hub
+		sub, err := b.conn.Subscribe(m.Subject, func(nm *gonats.Msg) {
+			b.receive(hubTopic, nm)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to subscribe to NATS subject %s: %w", m.Subject, err)
+		}
+		b.subs = append(b.subs, sub)
+	}
+	return nil
+}
+
+// Publish relays from a hub topic to NATS, until the subscription ends
+func (b *Bridge) publishOutbound(m TopicMapping, relays <-chan msg.RelayIndication) {
+	defer b.workers.Done()
+	for ind := range relays {
+		nm := gonats.NewMsg(m.Subject)
+		nm.Data = ind.Msg
+		nm.Header.Set(HeaderSource, strconv.FormatUint(uint64(ind.Src), 10))
+		nm.Header.Set(HeaderBridge, b.token)
+		if ind.ContentType != "" {
+			nm.Header.Set(HeaderContentType, ind.ContentType)
+		}
+		if err := b.conn.PublishMsg(nm); err != nil {
+			b.config.Logger.Warn("Failed to publish to NATS", logging.F("subject", m.Subject), logging.F("err", err))
+		}
+	}
+}
+
+// Queue a message from NATS to be published to the hub, unless it's one the bridge published itself
+func (b *Bridge) receive(topic string, nm *gonats.Msg) {
+	if nm.Header != nil && nm.Header.Get(HeaderBridge) == b.token {
+		return
+	}
+	select {
+	case b.inbound <- inboundMessage{topic: topic, data: nm.Data}:
+	case <-b.done:
+	}
+}
+
+// Publish messages from NATS to the hub, until the bridge is closed
+func (b *Bridge) publishInbound() {
+	defer b.workers.Done()
+	for {
+		select {
+		case im := <-b.inbound:
+			ctx, cancel := context.WithTimeout(context.Background(), b.config.PublishTimeout)
+			_, err := b.cli.PublishMessageCtx(ctx, im.topic, im.data)
+			cancel()
+			if err != nil {
+				b.config.Logger.Warn("Failed to publish to the hub", logging.F("topic", im.topic), logging.F("err", err))
+			}
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// Check whether a NATS subject contains wildcard tokens
+func hasWildcard(subject string) bool {
+	for _, tok := range strings.Split(subject, ".") {
+		if tok == "*" || tok == ">" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,120 @@
+package nats
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/CiaranWoodward/broadcast_hub/client"
+	"github.com/CiaranWoodward/broadcast_hub/server"
+	gonats "github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+)
+
+// Connection to an in-memory NATS server, which delivers each publish to subscriptions of exactly the same subject
+// (including the connection's own, as NATS does by default), and records it
+type fakeConn struct {
+	mutex     sync.Mutex
+	subs      map[string]gonats.MsgHandler
+	published []*gonats.Msg
+}
+
+func (f *fakeConn) PublishMsg(m *gonats.Msg) error {
+	f.mutex.Lock()
+	f.published = append(f.published, m)
+	h := f.subs[m.Subject]
+	f.mutex.Unlock()
+	if h != nil {
+		h(m)
+	}
+	return nil
+}
+
+func (f *fakeConn) Subscribe(subj string, cb gonats.MsgHandler) (*gonats.Subscription, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.subs[subj] = cb
+	return &gonats.Subscription{Subject: subj}, nil
+}
+
+func (f *fakeConn) publishedTo(subject string) (msgs []*gonats.Msg) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, m := range f.published {
+		if m.Subject == subject {
+			msgs = append(msgs, m)
+		}
+	}
+	return
+}
+
+func TestBridge(t *testing.T) {
+	// Test that topics are bridged in the configured directions, without echoing the bridge's own messages
+	defer goleak.VerifyNone(t)
+
+	hub := server.NewServer()
+	conn := &fakeConn{subs: make(map[string]gonats.MsgHandler)}
+	br, err := New(hub.AddClientByConnection, conn, Config{Topics: []TopicMapping{
+		{Hub: "alerts"},
+		{Hub: "sensors", Subject: "sensors.kitchen", Direction: FromNATS},
+		{Hub: "logs", Subject: "hub.logs", Direction: ToNATS},
+	}})
+	assert.Nil(t, err)
+	assert.NotZero(t, br.ID())
+
+	cli, ser := net.Pipe()
+	hub.AddClientByConnection(ser)
+	native := client.NewClientWithConfig(cli, client.ClientConfig{IdentifyOnConnect: true})
+	alerts, err := native.Subscribe("alerts")
+	assert.Nil(t, err)
+	sensors, err := native.Subscribe("sensors")
+	assert.Nil(t, err)
+
+	// From the hub to NATS, once only, with the source in the headers
+	_, err = native.PublishMessage("alerts", []byte("fire"))
+	assert.Nil(t, err)
+	_, err = native.PublishMessage("logs", []byte("started"))
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool { return len(conn.publishedTo("hub.logs")) == 1 }, time.Second, time.Millisecond)
+	published := conn.publishedTo("alerts")
+	if assert.Len(t, published, 1) {
+		assert.Equal(t, []byte("fire"), published[0].Data)
+		assert.Equal(t, strconv.FormatUint(uint64(native.ID()), 10), published[0].Header.Get(HeaderSource))
+	}
+
+	// From NATS to the hub, from the bridge's ClientId, including messages from other bridges
+	conn.PublishMsg(&gonats.Msg{Subject: "alerts", Data: []byte("flood")})
+	other := gonats.NewMsg("sensors.kitchen")
+	other.Data = []byte("21C")
+	other.Header.Set(HeaderBridge, "another")
+	conn.PublishMsg(other)
+	ind := <-alerts
+	assert.Equal(t, []byte("flood"), ind.Msg)
+	assert.Equal(t, br.ID(), ind.Src)
+	ind = <-sensors
+	assert.Equal(t, []byte("21C"), ind.Msg)
+	select {
+	case ind = <-alerts:
+		t.Errorf("Echoed relay: %s", ind.Msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	br.Close()
+	native.Close()
+}
+
+func TestBridgeWildcard(t *testing.T) {
+	// Test that mappings publishing to a NATS subject with wildcards are rejected
+	defer goleak.VerifyNone(t)
+
+	hub := server.NewServer()
+	conn := &fakeConn{subs: make(map[string]gonats.MsgHandler)}
+	_, err := New(hub.AddClientByConnection, conn, Config{Topics: []TopicMapping{{Hub: "sensors", Subject: "sensors.*"}}})
+	assert.ErrorIs(t, err, ErrWildcard)
+	br, err := New(hub.AddClientByConnection, conn, Config{Topics: []TopicMapping{{Hub: "sensors", Subject: "sensors.>", Direction: FromNATS}}})
+	assert.Nil(t, err)
+	br.Close()
+}
@@ -0,0 +1,107 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+	"github.com/CiaranWoodward/broadcast_hub/tracing"
+)
+
+// RelayResult is the outcome of a relay sent with 'RelayMessageAsync'
+type RelayResult struct {
+	// Message ID of the relay, or zero if it was never sent
+	RelayId uint32
+	// Destinations the message couldn't be relayed to, as with 'RelayMessage'. Only valid if Err is nil.
+	StatusMap msg.ClientStatusMap
+	// Why the relay failed, as with 'RelayMessage'. TIMEOUT if there was no response within the RequestTimeout of the ClientConfig.
+	Err error
+}
+
+// A relay sent with 'RelayMessageAsync', waiting for its response
+type asyncRelay struct {
+	result chan RelayResult
+	timer  *time.Timer
+	span   tracing.Span
+	once   sync.Once
+}
+
+// Deliver the result of the relay, unless it already has one
+func (ar *asyncRelay) complete(res RelayResult) {
+	ar.once.Do(func() {
+		if ar.timer != nil {
+			ar.timer.Stop()
+		}
+		if ar.span != nil {
+			ar.span.RecordError(res.Err)
+			ar.span.End()
+		}
+		ar.result <- res
+		close(ar.result)
+	})
+}
+
+// RelayMessageAsync is RelayMessage, but returns straight after sending the relay instead of waiting for the response.
+// The result is delivered later on the returned channel, which receives exactly one RelayResult and is then closed.
+// No goroutine is kept waiting for the response, so it is suitable for sending many relays at a high rate.
+func (c *Client) RelayMessageAsync(message []byte, clients []msg.ClientId) <-chan RelayResult {
+	ar := &asyncRelay{result: make(chan RelayResult, 1)}
+	// Check protocol parameters
+	if len(message) > 1024 || len(clients) > 255 {
+		ar.complete(RelayResult{Err: msg.NewStatusError(msg.TOO_LONG, 0, nil)})
+		return ar.result
+	}
+
+	req := c.newMessage()
+	req.RelayReq = &msg.RelayRequest{Dest: clients, Msg: message}
+	_, ar.span = c.startRequestSpan(context.Background(), &req)
+	c.mid_map_mutex.Lock()
+	if err := c.checkMid(req.MessageId); err != nil {
+		c.mid_map_mutex.Unlock()
+		ar.complete(RelayResult{Err: err})
+		return ar.result
+	}
+	c.async_map[req.MessageId] = ar
+	ar.timer = time.AfterFunc(c.config.RequestTimeout, func() {
+		c.removeAsyncRelay(req.MessageId)
+		ar.complete(RelayResult{RelayId: req.MessageId, Err: msg.NewStatusError(msg.TIMEOUT, req.MessageId, nil)})
+	})
+	c.mid_map_mutex.Unlock()
+
+	if err := c.sendMessage(req); err != nil {
+		c.removeAsyncRelay(req.MessageId)
+		ar.complete(RelayResult{RelayId: req.MessageId, Err: err})
+	}
+	return ar.result
+}
+
+func (c *Client) removeAsyncRelay(mid uint32) {
+	c.mid_map_mutex.Lock()
+	delete(c.async_map, mid)
+	c.mid_map_mutex.Unlock()
+}
+
+// Deliver the response to a relay sent with 'RelayMessageAsync'. Returns false if the message isn't one.
+// Only to be called by dispatcher
+func (c *Client) completeAsyncRelay(m msg.Message) bool {
+	c.mid_map_mutex.Lock()
+	ar, ok := c.async_map[m.MessageId]
+	delete(c.async_map, m.MessageId)
+	c.mid_map_mutex.Unlock()
+	if !ok {
+		return false
+	}
+	res := RelayResult{RelayId: m.MessageId}
+	req := msg.Message{MessageId: m.MessageId, RelayReq: &msg.RelayRequest{}}
+	if res.Err = rejectionError(req, m); res.Err == nil {
+		if m.RelayRes == nil {
+			res.Err = errMissingResponse(req)
+		} else {
+			res.StatusMap = m.RelayRes.StatusMap
+			res.Err = msg.NewStatusError(m.RelayRes.Status, m.MessageId, nil)
+		}
+	}
+	ar.complete(res)
+	return true
+}
@@ -0,0 +1,42 @@
+package client
+
+import (
+	"context"
+
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// Authenticate presents credentials to the server. Servers that require authentication only allow
+// GetClientId, Hello, Ping and Authenticate until it succeeds; every other request returns an UNAUTHENTICATED error.
+// Servers that don't require authentication always succeed.
+//
+// Servers may give each identity a ClientId of its own, which the client moves onto once it has authenticated, as if
+// it had resumed a session with that ID. 'ID' then returns the new ID.
+//
+// Returns an UNAUTHENTICATED error if the server rejects the credentials.
+// Times out after the RequestTimeout of the ClientConfig (5 seconds by default); use AuthenticateCtx for control over cancellation and deadlines.
+func (c *Client) Authenticate(creds msg.Credentials) (err error) {
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	return c.AuthenticateCtx(ctx, creds)
+}
+
+// AuthenticateCtx is Authenticate, but waits for the response until the context is done instead of a fixed timeout.
+// Returns a TIMEOUT error if the context deadline expires, or CANCELLED if the context is cancelled.
+func (c *Client) AuthenticateCtx(ctx context.Context, creds msg.Credentials) (err error) {
+	// Form the message
+	req := c.newMessage()
+	req.AuthReq = &msg.AuthRequest{Credentials: creds}
+
+	rsp, err := c.transact(ctx, req)
+	if err != nil {
+		return
+	}
+	if rsp.AuthRes == nil {
+		return errMissingResponse(req)
+	}
+	if rsp.AuthRes.Id != 0 {
+		c.setID(rsp.AuthRes.Id)
+	}
+	return msg.NewStatusError(rsp.AuthRes.Status, req.MessageId, nil)
+}
@@ -0,0 +1,111 @@
+package client
+
+import (
+	"context"
+
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// Most bytes of message the relays in a batch can have between them, so the batch fits within the largest message
+// servers accept by default
+const maxBatchBytes = msg.DefaultMaxMessageSize / 2
+
+// Relay is one of the relays sent together by 'RelayBatch'
+type Relay struct {
+	// Message to relay. Maximum length is 1024 bytes.
+	Message []byte
+	// Clients to relay the message to, as with 'RelayMessage'
+	Dest []msg.ClientId
+	// Publishes the message to the topic instead of relaying it to Dest, as with 'PublishMessage'
+	Topic string
+	// Optional settings, as with 'RelayMessageWithOptions'. The Timeout is ignored, as the batch is answered as a whole.
+	Options RelayOptions
+}
+
+// RelayBatch sends several relays to the server in one message, and waits for the response to all of them, saving a
+// round trip for each. This suits senders producing many small messages. The server handles the relays in order, each
+// just as if it had been sent on its own.
+//
+// The result of each relay is returned in the same order, with its own RelayId (the RelayId of its
+// DeliveryIndications and RelayFailureIndications), and its own status map or error. 'err' is only set if the batch as
+// a whole failed, such as if it has more than msg.MaxBatchRelays relays, or more than 32KiB of messages between them
+// (TOO_LONG). Then none of the relays were sent.
+// Times out after the RequestTimeout of the ClientConfig (5 seconds by default); use RelayBatchCtx for control over cancellation and deadlines.
+func (c *Client) RelayBatch(relays []Relay) (results []RelayResult, err error) {
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	return c.RelayBatchCtx(ctx, relays)
+}
+
+// RelayBatchCtx is RelayBatch, but waits for the response until the context is done instead of a fixed timeout.
+// Returns a TIMEOUT error if the context deadline expires, or CANCELLED if the context is cancelled.
+func (c *Client) RelayBatchCtx(ctx context.Context, relays []Relay) (results []RelayResult, err error) {
+	if len(relays) == 0 {
+		return nil, nil
+	}
+	// Check protocol parameters
+	if len(relays) > msg.MaxBatchRelays {
+		return nil, msg.NewStatusError(msg.TOO_LONG, 0, nil)
+	}
+	batch := &msg.RelayBatchRequest{Relays: make([]msg.RelayRequest, len(relays))}
+	total := 0
+	for i, r := range relays {
+		if r.Topic != "" {
+			if err = checkTopic(r.Topic); err != nil {
+				return
+			}
+		}
+		if err = checkRelay(r.Message, r.Dest, r.Options); err != nil {
+			return
+		}
+		batch.Relays[i] = *relayRequest(r.Message, r.Dest, r.Options)
+		batch.Relays[i].Topic = r.Topic
+		total += len(r.Message)
+	}
+	if total > maxBatchBytes {
+		return nil, msg.NewStatusError(msg.TOO_LONG, 0, nil)
+	}
+
+	// Form the message, giving each relay after the first an ID of its own, which isn't given to anything else until
+	// the batch is answered
+	req := c.newMessage()
+	batch.RelayIds = make([]uint32, len(relays))
+	batch.RelayIds[0] = req.MessageId
+	c.mid_map_mutex.Lock()
+	for i := 1; i < len(relays); i++ {
+		batch.RelayIds[i] = c.nextMid()
+		c.batch_mids[batch.RelayIds[i]] = struct{}{}
+	}
+	c.mid_map_mutex.Unlock()
+	defer func() {
+		c.mid_map_mutex.Lock()
+		for _, mid := range batch.RelayIds[1:] {
+			delete(c.batch_mids, mid)
+		}
+		c.mid_map_mutex.Unlock()
+	}()
+	req.RelayBatReq = batch
+
+	rsp, err := c.transact(ctx, req)
+	if err != nil {
+		return
+	}
+	if rsp.RelayBatRes == nil {
+		return nil, errMissingResponse(req)
+	}
+	if err = msg.NewStatusError(rsp.RelayBatRes.Status, req.MessageId, nil); err != nil {
+		return nil, err
+	}
+	if len(rsp.RelayBatRes.Results) != len(relays) {
+		return nil, errMissingResponse(req)
+	}
+	results = make([]RelayResult, len(relays))
+	for i, res := range rsp.RelayBatRes.Results {
+		results[i] = RelayResult{
+			RelayId:   batch.RelayIds[i],
+			StatusMap: res.StatusMap,
+			Err:       msg.NewStatusError(res.Status, batch.RelayIds[i], nil),
+		}
+	}
+	return results, nil
+}
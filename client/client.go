@@ -4,122 +4,412 @@ Package client implements the user-facing API of a broadcast_hub client.
 package client
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math"
 	"net"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/CiaranWoodward/broadcast_hub/logging"
 	"github.com/CiaranWoodward/broadcast_hub/msg"
+	"github.com/CiaranWoodward/broadcast_hub/transport/pipe"
 )
 
 // Length of the buffered channel for holding incoming relays
 const internalMessageBufferSize = 10
 
+// Maximum length of a relay's content type, in bytes
+const maxContentTypeLength = 255
+
+// Maximum length of a relay's MsgUUID, in bytes
+const maxMsgUUIDLength = 64
+
 // Client struct - instatiated with the 'NewClient' Function.
 type Client struct {
 	// Channel to receive incoming relay indications
 	Relays chan msg.RelayIndication
+	// Channel to receive delivery acknowledgements, for relays sent with 'RelayMessageWithAck'
+	Acks chan msg.DeliveryIndication
+	// Channel to receive presence indications, after calling 'SubscribePresence'
+	Presence chan msg.PresenceIndication
+	// Channel to receive failures of relays sent with the Reliable option, or expiry of relays sent with a TTL
+	Failures chan msg.RelayFailureIndication
+	// Channel to receive changes to the client's State, which is closed once it's Disconnected.
+	// It never fills, so doesn't need to be serviced if the application isn't interested.
+	Events chan StateEvent
+	// Tunable parameters
+	config ClientConfig
 	// Message transcoders
 	tc msg.Transcoder
 	dc msg.StreamDecoder
-	// Internal message ID counter (for unique IDs)
+	// Internal message ID counter (for unique IDs, guarded by mid_map_mutex)
 	mid uint32
+	// Protocol version agreed with the server, used for every message sent
+	version int32
+	// ID of the client, from the last Identify Response or successful Resume, or zero if it isn't known yet
+	cid uint64
+	// Token needed to resume the client's session, from the last Identify Response or successful Resume, and a mutex
+	// protecting it
+	session       string
+	session_mutex sync.Mutex
+	// Makes a new connection to the same server, for 'Reconnect'. Nil unless the client was dialled.
+	redial func() (net.Conn, error)
+	// Called when a server reached by 'redial' refuses the client, so it can try another. Nil unless from 'DialMulti'.
+	redial_failed func()
+	// Closed once the client has finished reconnecting automatically after its connection ended, with 'next' set to
+	// the new client if it succeeded. Nil unless the ReconnectPolicy is enabled and the client was dialled.
+	reconnected chan struct{}
+	next        *Client
 	// Internal connection state
 	con net.Conn
 	// Map of message IDs to the channel waiting for the response, and a mutex protecting it
 	mid_map       map[uint32]chan msg.Message
 	mid_map_mutex sync.Mutex
+	// Map of message IDs to relays sent with 'RelayMessageAsync', waiting for their response (guarded by mid_map_mutex)
+	async_map map[uint32]*asyncRelay
+	// Message IDs given to the relays of batches still waiting for their response, after the first (guarded by mid_map_mutex)
+	batch_mids map[uint32]struct{}
+	// Map of subscribed topics to their relay channels, and a mutex protecting it
+	topic_map        map[string]*topicSubscription
+	topic_map_mutex  sync.Mutex
+	topic_map_closed bool
+	// End-to-end encryption state, once enabled, and a mutex protecting it
+	e2e       *e2eState
+	e2e_mutex sync.Mutex
+	// Relay handler registered with 'OnRelay', and the number of relays dropped by it or the RelayOverflowPolicy
+	relay_handler      *relayHandler
+	relay_handler_once sync.Once
+	dropped_relays     uint64
+	// Number of keepalive pings sent since anything was last received from the server
+	pings_missed int32
+	// Relays received since the client last granted the server credits for them (only used by the dispatcher)
+	flow_received uint32
+	// Round trip times measured by pings
+	latency latencyEstimator
+	// Reason for disconnection (SUCCESS while still connected)
+	disconnect_reason int32
+	// Current state of the connection, and a mutex protecting it
+	state       State
+	state_mutex sync.Mutex
+	// Context the client was created with, which closes the client when it's done
+	ctx context.Context
+	// Closed when the dispatcher exits
+	done chan struct{}
 }
 
 // NewClient creates a new client, for use with the methods in this package.
 // Returns pointer to the instantiated client.
 //
-// The application should be sure to continually process items in the 'Relays' channel,
-// so as not to fill the internal buffer.
+// The application should be sure to continually process items in the 'Relays' channel (or register a handler
+// for them with 'OnRelay'), so as not to fill the internal buffer. The same applies to the 'Acks' channel, if delivery
+// acknowledgements are requested, the 'Presence' channel if presence is subscribed, and the 'Failures'
+// channel if Reliable relays are sent.
 //
 // When work with the client is complete, the 'Close' Method should be called, which will
 // handle releasing of all resources, including the 'con' argument.
+//
+// The client uses the default configuration, see 'NewClientWithConfig' to tune it.
 func NewClient(con net.Conn) *Client {
-	tc := &msg.CborTranscoder{}
+	return NewClientWithConfig(con, DefaultClientConfig())
+}
+
+// NewClientWithConfig creates a new client, as with 'NewClient', using the provided configuration.
+// Any fields of the configuration left as zero will use their default values.
+// If the configuration has IdentifyOnConnect set, this waits for the client's ID, but failing to get it is only logged.
+func NewClientWithConfig(con net.Conn, cfg ClientConfig) *Client {
+	return NewClientWithConfigContext(context.Background(), con, cfg)
+}
+
+// NewClientWithContext creates a new client, as with 'NewClient', which is closed once the context is done.
+// Closing it this way closes the connection and the client's channels, and fails any outstanding requests with
+// CANCELLED, so the client can be shut down along with the rest of the application.
+func NewClientWithContext(ctx context.Context, con net.Conn) *Client {
+	return NewClientWithConfigContext(ctx, con, DefaultClientConfig())
+}
+
+// NewClientWithConfigContext creates a new client, as with 'NewClientWithContext', using the provided configuration.
+func NewClientWithConfigContext(ctx context.Context, con net.Conn, cfg ClientConfig) *Client {
+	c, err := newClient(ctx, con, cfg)
+	if err != nil {
+		c.config.Logger.Warn("Failed to identify client", logging.F("err", err))
+	}
+	return c
+}
+
+// Create a new client, getting its ID if the configuration has IdentifyOnConnect set.
+// The client is returned even if that fails, along with the error.
+func newClient(ctx context.Context, con net.Conn, cfg ClientConfig) (*Client, error) {
+	tc := cfg.Codec.Transcoder()
 	c := Client{
-		Relays:  make(chan msg.RelayIndication, internalMessageBufferSize),
-		tc:      tc,
-		dc:      tc.NewStreamDecoder(con),
-		mid:     0,
-		con:     con,
-		mid_map: make(map[uint32]chan msg.Message),
+		Relays:     make(chan msg.RelayIndication, internalMessageBufferSize),
+		Acks:       make(chan msg.DeliveryIndication, internalMessageBufferSize),
+		Presence:   make(chan msg.PresenceIndication, internalMessageBufferSize),
+		Failures:   make(chan msg.RelayFailureIndication, internalMessageBufferSize),
+		Events:     make(chan StateEvent, maxStateEvents),
+		config:     cfg.withDefaults(),
+		tc:         tc,
+		dc:         tc.NewStreamDecoder(con),
+		mid:        0,
+		version:    int32(msg.MyVersion),
+		con:        con,
+		mid_map:    make(map[uint32]chan msg.Message),
+		async_map:  make(map[uint32]*asyncRelay),
+		batch_mids: make(map[uint32]struct{}),
+		topic_map:  make(map[string]*topicSubscription),
+		ctx:        ctx,
+		done:       make(chan struct{}),
 	}
 	c.startDispatcher()
-	return &c
+	if ctx.Done() != nil {
+		go c.closeWhenDone()
+	}
+	if c.config.PingInterval > 0 {
+		c.startPinger()
+	}
+	if c.config.FlowCredits > 0 {
+		if err := c.GrantCredits(c.config.FlowCredits); err != nil {
+			return &c, err
+		}
+	}
+	if c.config.IdentifyOnConnect {
+		if _, err := c.GetClientId(); err != nil {
+			return &c, err
+		}
+	}
+	return &c, nil
 }
 
-// GetClientId gets the ID of the client from the server. This is the 'Identity Message'.
-// Returns a channel that will have this client's ID sent into it
-func (c *Client) GetClientId() (clientid msg.ClientId, status msg.Status) {
-	// Form the message
-	req := c.newMessage()
-	req.IdReq = &msg.IdentifyRequest{}
+// Create a new client for a connection that has just been dialled, closing it if the client can't be identified
+func newDialedClient(ctx context.Context, con net.Conn, cfg ClientConfig) (*Client, error) {
+	c, err := newClient(ctx, con, cfg)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
 
-	// Create a channel for receiving the response. Defer cleaning it up.
-	rsp_chan := c.addResponseChannel(req.MessageId)
-	defer c.removeResponseChannel(req.MessageId)
+// Dial a connection and create a new client using it, which remembers how to dial again for 'Reconnect'
+func dialClient(dial func() (net.Conn, error), cfg ClientConfig) (*Client, error) {
+	con, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	c, err := newDialedClient(context.Background(), con, cfg)
+	if err != nil {
+		return nil, err
+	}
+	c.setRedial(dial, nil)
+	return c, nil
+}
 
-	//Encode the request and send it over the connection
-	status = c.sendMessage(req)
-	if status != msg.SUCCESS {
-		return 0, status
+// Dial connects to a broadcast_hub server at the given TCP address (host:port), and creates a new client using the connection.
+// The connection is made with the configuration's Dialer, if it has one.
+// With IdentifyOnConnect, the connection is closed and an error returned if the client's ID can't be got.
+func Dial(address string, cfg ClientConfig) (*Client, error) {
+	return dialClient(func() (net.Conn, error) {
+		return cfg.dial("tcp", address)
+	}, cfg)
+}
+
+// DialUnix connects to a broadcast_hub server listening on the Unix domain socket at 'path', and creates a new client using the connection.
+func DialUnix(path string, cfg ClientConfig) (*Client, error) {
+	return dialClient(func() (net.Conn, error) {
+		return net.Dial("unix", path)
+	}, cfg)
+}
+
+// DialPipe connects to a broadcast_hub server listening on the Windows named pipe 'name' (see the transport/pipe
+// package), and creates a new client using the connection. Fails with pipe.ErrUnsupported on other platforms.
+func DialPipe(name string, cfg ClientConfig) (*Client, error) {
+	return dialClient(func() (net.Conn, error) {
+		return pipe.Dial(name)
+	}, cfg)
+}
+
+// DialTLS connects to a broadcast_hub server at the given TCP address (host:port) using TLS, and creates a new client using the connection.
+// A nil tlsCfg uses the default TLS configuration, verifying the server certificate against the system roots.
+// The connection is made with the configuration's Dialer, if it has one, and TLS is negotiated over it.
+func DialTLS(address string, tlsCfg *tls.Config, cfg ClientConfig) (*Client, error) {
+	return dialClient(func() (net.Conn, error) {
+		return cfg.dialTLS(address, tlsCfg)
+	}, cfg)
+}
+
+// Connect to the server using TLS, over a connection from the configuration's Dialer if it has one
+func (cfg ClientConfig) dialTLS(address string, tlsCfg *tls.Config) (net.Conn, error) {
+	if cfg.Dialer == nil {
+		return tls.Dial("tcp", address, tlsCfg)
 	}
 
-	// Wait for response, or time out
-	select {
-	case rsp, ok := <-rsp_chan:
-		if !ok {
-			return 0, msg.CONNECTION_ERROR
-		}
-		if rsp.IdRes == nil {
-			return 0, msg.ENCODING_ERROR
+	// As tls.Dial, verify the certificate against the host being dialled unless told otherwise
+	if tlsCfg == nil {
+		tlsCfg = &tls.Config{}
+	}
+	if tlsCfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
 		}
-		return rsp.IdRes.Id, msg.SUCCESS
+		tlsCfg = tlsCfg.Clone()
+		tlsCfg.ServerName = host
+	}
+	raw, err := cfg.Dialer.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	con := tls.Client(raw, tlsCfg)
+	if err = con.Handshake(); err != nil {
+		raw.Close()
+		return nil, err
+	}
+	return con, nil
+}
 
-	case <-time.After(5 * time.Second):
-		return 0, msg.TIMEOUT
+// Connect to the server with the configuration's Dialer, or directly if it doesn't have one
+func (cfg ClientConfig) dial(network, address string) (net.Conn, error) {
+	if cfg.Dialer == nil {
+		return net.Dial(network, address)
 	}
+	return cfg.Dialer.Dial(network, address)
+}
+
+// ID gets the ID of the client without asking the server, as last got by GetClientId, GetSession or Resume.
+// With ClientConfig.IdentifyOnConnect, it's known as soon as the client is created. Returns zero if it isn't known yet.
+func (c *Client) ID() msg.ClientId {
+	return msg.ClientId(atomic.LoadUint64(&c.cid))
+}
+
+// Remember the ID of the client, for 'ID'
+func (c *Client) setID(cid msg.ClientId) {
+	atomic.StoreUint64(&c.cid, uint64(cid))
+}
+
+// GetClientId gets the ID of the client from the server, refreshing the one returned by 'ID'. This is the 'Identity Message'.
+// Times out after the RequestTimeout of the ClientConfig (5 seconds by default); use GetClientIdCtx for control over cancellation and deadlines.
+func (c *Client) GetClientId() (clientid msg.ClientId, err error) {
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	return c.GetClientIdCtx(ctx)
+}
+
+// GetClientIdCtx is GetClientId, but waits for the response until the context is done instead of a fixed timeout.
+// Returns a TIMEOUT error if the context deadline expires, or CANCELLED if the context is cancelled.
+func (c *Client) GetClientIdCtx(ctx context.Context) (clientid msg.ClientId, err error) {
+	// Form the message
+	req := c.newMessage()
+	req.IdReq = &msg.IdentifyRequest{}
+
+	rsp, err := c.transactRetry(ctx, &req)
+	if err != nil {
+		return 0, err
+	}
+	if rsp.IdRes == nil {
+		return 0, errMissingResponse(req)
+	}
+	c.setID(rsp.IdRes.Id)
+	c.setSession(rsp.IdRes.Session)
+	return rsp.IdRes.Id, nil
 }
 
 // ListOtherClients gets a list of all other nodes connected to the server. This is the 'List Message'.
-// Returns a channel that will have the other client IDs individually streamed into it
-func (c *Client) ListOtherClients() (clientid []msg.ClientId, status msg.Status) {
+// Times out after the RequestTimeout of the ClientConfig (5 seconds by default); use ListOtherClientsCtx for control over cancellation and deadlines.
+func (c *Client) ListOtherClients() (clientid []msg.ClientId, err error) {
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	return c.ListOtherClientsCtx(ctx)
+}
+
+// ListOtherClientsCtx is ListOtherClients, but waits for the response until the context is done instead of a fixed timeout.
+// Returns a TIMEOUT error if the context deadline expires, or CANCELLED if the context is cancelled.
+func (c *Client) ListOtherClientsCtx(ctx context.Context) (clientid []msg.ClientId, err error) {
 	// Form the message
 	req := c.newMessage()
 	req.ListReq = &msg.ListRequest{}
 
-	// Create a channel for receiving the response. Defer cleaning it up.
-	rsp_chan := c.addResponseChannel(req.MessageId)
-	defer c.removeResponseChannel(req.MessageId)
-
-	//Encode the request and send it over the connection
-	status = c.sendMessage(req)
-	if status != msg.SUCCESS {
+	rsp, err := c.transactRetry(ctx, &req)
+	if err != nil {
+		return
+	}
+	if rsp.ListRes == nil {
+		err = errMissingResponse(req)
+		return
+	}
+	if rsp.ListRes.Status != msg.SUCCESS {
+		err = msg.NewStatusError(rsp.ListRes.Status, req.MessageId, nil)
 		return
 	}
+	return rsp.ListRes.Others, nil
+}
 
-	// Wait for response, or time out
-	select {
-	case rsp, ok := <-rsp_chan:
-		if !ok {
-			status = msg.CONNECTION_ERROR
-			return
-		}
-		if rsp.ListRes == nil {
-			status = msg.ENCODING_ERROR
-			return
-		}
-		return rsp.ListRes.Others, msg.SUCCESS
+// ListOptions selects a page of other clients, for 'ListOtherClientsPage'
+type ListOptions struct {
+	// Number of matching clients to skip. Use the Next cursor of the previous page to get the following page.
+	Offset uint32
+	// Maximum number of clients in the page. Zero lists every matching client.
+	Limit uint32
+	// Only list clients with a registered name starting with this prefix
+	Filter string
+	// Request the name, connection time and address category of each client, if the server shares them
+	Metadata bool
+}
+
+// ClientPage is a page of other clients, returned by 'ListOtherClientsPage'. Clients are listed in order of ID.
+type ClientPage struct {
+	// IDs of the clients in the page
+	Ids []msg.ClientId
+	// Metadata for each client in Ids, or nil if it wasn't requested or the server doesn't share it
+	Metadata []msg.ClientMetadata
+	// Cursor to use as the Offset of the next page, or zero if this is the last page
+	Next uint32
+}
 
-	case <-time.After(5 * time.Second):
-		status = msg.TIMEOUT
+// ListOtherClientsPage gets a page of the other clients connected to the server, optionally with their metadata.
+// This avoids fetching every client at once when many are connected:
+//
+//	for opts := (client.ListOptions{Limit: 100}); ; {
+//		page, err := c.ListOtherClientsPage(opts)
+//		...
+//		if page.Next == 0 {
+//			break
+//		}
+//		opts.Offset = page.Next
+//	}
+//
+// Clients connecting or disconnecting between pages may cause others to be skipped or listed twice.
+// Times out after the RequestTimeout of the ClientConfig (5 seconds by default); use ListOtherClientsPageCtx for control over cancellation and deadlines.
+func (c *Client) ListOtherClientsPage(opts ListOptions) (page ClientPage, err error) {
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	return c.ListOtherClientsPageCtx(ctx, opts)
+}
+
+// ListOtherClientsPageCtx is ListOtherClientsPage, but waits for the response until the context is done instead of a fixed timeout.
+// Returns a TIMEOUT error if the context deadline expires, or CANCELLED if the context is cancelled.
+func (c *Client) ListOtherClientsPageCtx(ctx context.Context, opts ListOptions) (page ClientPage, err error) {
+	// Form the message
+	req := c.newMessage()
+	req.ListReq = &msg.ListRequest{Offset: opts.Offset, Limit: opts.Limit, Filter: opts.Filter, Metadata: opts.Metadata}
+
+	rsp, err := c.transactRetry(ctx, &req)
+	if err != nil {
 		return
 	}
+	if rsp.ListRes == nil {
+		err = errMissingResponse(req)
+		return
+	}
+	if rsp.ListRes.Status != msg.SUCCESS {
+		err = msg.NewStatusError(rsp.ListRes.Status, req.MessageId, nil)
+		return
+	}
+	return ClientPage{Ids: rsp.ListRes.Others, Metadata: rsp.ListRes.Metadata, Next: rsp.ListRes.Next}, nil
 }
 
 // RelayMessage sends a message to be relayed to other clients by the server. This is the 'Relay Message'.
@@ -127,66 +417,372 @@ func (c *Client) ListOtherClients() (clientid []msg.ClientId, status msg.Status)
 // Maximum length of the message is 1024 bytes.
 // Maximum length of clients is 255.
 //
-// The returned clientStatusMap is only valid if status == SUCCESS
+// The returned clientStatusMap is only valid if err is nil
 // The returned clientStatusMap does not include the client IDs of successfully relayed messages - they are omitted for efficiency
-func (c *Client) RelayMessage(message []byte, clients []msg.ClientId) (relayStatus msg.ClientStatusMap, status msg.Status) {
+// Times out after the RequestTimeout of the ClientConfig (5 seconds by default); use RelayMessageCtx for control over cancellation and deadlines.
+func (c *Client) RelayMessage(message []byte, clients []msg.ClientId) (relayStatus msg.ClientStatusMap, err error) {
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	return c.RelayMessageCtx(ctx, message, clients)
+}
+
+// RelayMessageCtx is RelayMessage, but waits for the response until the context is done instead of a fixed timeout.
+// Returns a TIMEOUT error if the context deadline expires, or CANCELLED if the context is cancelled.
+func (c *Client) RelayMessageCtx(ctx context.Context, message []byte, clients []msg.ClientId) (relayStatus msg.ClientStatusMap, err error) {
 	// Check protocol parameters
 	if len(message) > 1024 || len(clients) > 255 {
-		status = msg.TOO_LONG
+		err = msg.NewStatusError(msg.TOO_LONG, 0, nil)
+		return
+	}
+	return c.relay(ctx, &msg.RelayRequest{Dest: clients, Msg: message})
+}
+
+// RelayMessageWithAck is RelayMessage, but also requests each destination to acknowledge delivery.
+// Returns the message ID of the relay, which is the RelayId of the DeliveryIndications that will be received
+// on the 'Acks' channel. Destinations acknowledge once the relay has been delivered into their 'Relays' channel.
+// Times out after the RequestTimeout of the ClientConfig (5 seconds by default); use RelayMessageWithAckCtx for control over cancellation and deadlines.
+func (c *Client) RelayMessageWithAck(message []byte, clients []msg.ClientId) (relayId uint32, relayStatus msg.ClientStatusMap, err error) {
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	return c.RelayMessageWithAckCtx(ctx, message, clients)
+}
+
+// RelayMessageWithAckCtx is RelayMessageWithAck, but waits for the response until the context is done instead of a fixed timeout.
+// Returns a TIMEOUT error if the context deadline expires, or CANCELLED if the context is cancelled.
+func (c *Client) RelayMessageWithAckCtx(ctx context.Context, message []byte, clients []msg.ClientId) (relayId uint32, relayStatus msg.ClientStatusMap, err error) {
+	return c.RelayMessageWithOptionsCtx(ctx, message, clients, RelayOptions{AckRequested: true})
+}
+
+// RelayOptions holds the optional settings of a relay, for 'RelayMessageWithOptions'
+type RelayOptions struct {
+	// Describes how destinations should interpret the message, such as a MIME type. Maximum length is 255 bytes.
+	ContentType string
+	// Requests each destination to acknowledge delivery, as with 'RelayMessageWithAck'
+	AckRequested bool
+	// Groups whose members also receive the message, as well as the listed clients. The sender is never included.
+	DestGroups []string
+	// Asks the server to retry destinations whose buffers are full, instead of failing them with NO_BUFFER.
+	// Destinations that still can't be reached are reported later on the 'Failures' channel, with the relay's ID.
+	Reliable bool
+	// Allows this client to be one of the destinations, so it receives its own message.
+	// Otherwise, the server rejects this client as a destination with SELF_RELAY, unless it allows loopback anyway.
+	Loopback bool
+	// Identifies the relay to the server, such as with 'NewMsgUUID'. If the relay is sent again with the same MsgUUID
+	// (such as a retry after a timeout), within the server's dedup window, it isn't relayed a second time, but gets
+	// the same response as the first. Maximum length is 64 bytes.
+	MsgUUID string
+	// Relays of a higher priority are sent to each destination ahead of any lower priority relays waiting for it,
+	// so urgent messages aren't held up behind bulk traffic. Normal priority if not set.
+	Priority msg.Priority
+	// How long 'RelayMessageWithOptions' waits for the response, instead of the RequestTimeout of the ClientConfig.
+	// Not used by 'RelayMessageWithOptionsCtx', which waits until its context is done.
+	Timeout time.Duration
+	// With msg.VerbosityAll, the returned status map lists every destination, including those the server confirmed it
+	// buffered the relay for with SUCCESS, which can be picked out with 'ClientStatusMap.Succeeded'.
+	// Otherwise only failures are listed.
+	Verbosity msg.Verbosity
+	// How long the relay stays useful. The server discards it for any destination it hasn't been sent to in time, such
+	// as a slow consumer, rather than delivering stale data. With AckRequested, each destination it was discarded for
+	// is reported on the 'Failures' channel, with EXPIRED. Rounded up to whole milliseconds, up to 'MaxTTL'. Zero never
+	// expires.
+	TTL time.Duration
+}
+
+// Longest TTL a relay can be sent with, in 'RelayOptions.TTL'
+const MaxTTL = math.MaxUint32 * time.Millisecond
+
+// Get a TTL in whole milliseconds, rounding up so a short TTL doesn't become no TTL at all
+func ttlMillis(ttl time.Duration) uint32 {
+	if ttl <= 0 {
+		return 0
+	}
+	return uint32((ttl + time.Millisecond - 1) / time.Millisecond)
+}
+
+// NewMsgUUID generates a random (version 4) UUID, to identify a relay with 'RelayOptions.MsgUUID'
+func NewMsgUUID() string {
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		panic(err)
+	}
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+// RelayMessageWithOptions is RelayMessage, with optional settings such as the content type of the message.
+// Returns the message ID of the relay, which is the RelayId of any DeliveryIndications if AckRequested is set.
+// Times out after the RequestTimeout of the ClientConfig (5 seconds by default); use RelayMessageWithOptionsCtx for control over cancellation and deadlines.
+func (c *Client) RelayMessageWithOptions(message []byte, clients []msg.ClientId, opts RelayOptions) (relayId uint32, relayStatus msg.ClientStatusMap, err error) {
+	timeout := c.config.RequestTimeout
+	if opts.Timeout > 0 {
+		timeout = opts.Timeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return c.RelayMessageWithOptionsCtx(ctx, message, clients, opts)
+}
+
+// RelayMessageWithOptionsCtx is RelayMessageWithOptions, but waits for the response until the context is done instead of a fixed timeout.
+// Returns a TIMEOUT error if the context deadline expires, or CANCELLED if the context is cancelled.
+func (c *Client) RelayMessageWithOptionsCtx(ctx context.Context, message []byte, clients []msg.ClientId, opts RelayOptions) (relayId uint32, relayStatus msg.ClientStatusMap, err error) {
+	// Check protocol parameters
+	if err = checkRelay(message, clients, opts); err != nil {
 		return
 	}
 	// Form the message
 	req := c.newMessage()
-	req.RelayReq = &msg.RelayRequest{Dest: clients, Msg: message}
+	req.RelayReq = relayRequest(message, clients, opts)
+
+	var rsp msg.Message
+	if opts.MsgUUID != "" && !opts.AckRequested && c.config.Retry.Relays {
+		// The server won't deliver a repeated MsgUUID twice, so the relay can be safely retried
+		rsp, err = c.transactRetry(ctx, &req)
+	} else {
+		rsp, err = c.transact(ctx, req)
+	}
+	if err != nil {
+		return
+	}
+	if rsp.RelayRes == nil {
+		err = errMissingResponse(req)
+		return
+	}
+	return req.MessageId, rsp.RelayRes.StatusMap, msg.NewStatusError(rsp.RelayRes.Status, req.MessageId, nil)
+}
+
+// Check that a relay with the given options is valid for use in the protocol
+func checkRelay(message []byte, clients []msg.ClientId, opts RelayOptions) error {
+	if len(message) > 1024 || len(clients) > 255 || len(opts.ContentType) > maxContentTypeLength || len(opts.DestGroups) > 255 ||
+		len(opts.MsgUUID) > maxMsgUUIDLength || opts.TTL > MaxTTL {
+		return msg.NewStatusError(msg.TOO_LONG, 0, nil)
+	}
+	for _, group := range opts.DestGroups {
+		if err := checkGroup(group); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Form the Relay Request for a relay with the given options
+func relayRequest(message []byte, clients []msg.ClientId, opts RelayOptions) *msg.RelayRequest {
+	return &msg.RelayRequest{Dest: clients, Msg: message, AckRequested: opts.AckRequested, ContentType: opts.ContentType,
+		DestGroups: opts.DestGroups, Reliable: opts.Reliable, Loopback: opts.Loopback, MsgUUID: opts.MsgUUID,
+		Priority: opts.Priority, Verbosity: opts.Verbosity, TTL: ttlMillis(opts.TTL)}
+}
+
+// BroadcastMessage sends a message to be relayed by the server to every other connected client.
+//
+// Maximum length of the message is 1024 bytes.
+//
+// The returned clientStatusMap is only valid if err is nil
+// The returned clientStatusMap does not include the client IDs of successfully relayed messages - they are omitted for efficiency
+// Times out after the RequestTimeout of the ClientConfig (5 seconds by default); use BroadcastMessageCtx for control over cancellation and deadlines.
+func (c *Client) BroadcastMessage(message []byte) (relayStatus msg.ClientStatusMap, err error) {
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	return c.BroadcastMessageCtx(ctx, message)
+}
+
+// BroadcastMessageCtx is BroadcastMessage, but waits for the response until the context is done instead of a fixed timeout.
+// Returns a TIMEOUT error if the context deadline expires, or CANCELLED if the context is cancelled.
+func (c *Client) BroadcastMessageCtx(ctx context.Context, message []byte) (relayStatus msg.ClientStatusMap, err error) {
+	// Check protocol parameters
+	if len(message) > 1024 {
+		err = msg.NewStatusError(msg.TOO_LONG, 0, nil)
+		return
+	}
+	return c.relay(ctx, &msg.RelayRequest{Msg: message, Broadcast: true})
+}
+
+// Ping sends a keepalive ping to the server, and measures the round trip time of the response.
+// The round trip time is added to the estimate returned by 'Latency'.
+// Times out after the RequestTimeout of the ClientConfig (5 seconds by default); use PingCtx for control over cancellation and deadlines.
+func (c *Client) Ping() (rtt time.Duration, err error) {
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	return c.PingCtx(ctx)
+}
+
+// PingCtx is Ping, but waits for the response until the context is done instead of a fixed timeout.
+// Returns a TIMEOUT error if the context deadline expires, or CANCELLED if the context is cancelled.
+func (c *Client) PingCtx(ctx context.Context) (rtt time.Duration, err error) {
+	// Form the message
+	req := c.newMessage()
+	req.PingReq = &msg.PingRequest{}
+
+	start := time.Now()
+	rsp, err := c.transact(ctx, req)
+	if err != nil {
+		return
+	}
+	if rsp.PingRes == nil {
+		err = errMissingResponse(req)
+		return
+	}
+	rtt = time.Since(start)
+	c.latency.record(rtt)
+	return rtt, nil
+}
+
+// DisconnectReason gets the reason the client was disconnected from the server.
+// Returns SUCCESS while the client is still connected, CANCELLED if 'Close' was called, INACTIVE if the server stopped
+// responding to keepalive pings, GOING_AWAY if the server is shutting down, SERVER_FULL (or DRAINING) if the server
+// refused the connection, ENCODING_ERROR if the server sent something that couldn't be decoded, the reason the server
+// gave if it disconnected the client (with 'Server.DisconnectClient'), or CONNECTION_ERROR if the connection was closed
+// for any other reason.
+// GOING_AWAY is reported as soon as the server announces it is shutting down, which is shortly before the connection closes.
+func (c *Client) DisconnectReason() msg.Status {
+	return msg.Status(atomic.LoadInt32(&c.disconnect_reason))
+}
+
+// Record the reason for disconnection, unless one has already been recorded
+func (c *Client) setDisconnectReason(reason msg.Status) {
+	atomic.CompareAndSwapInt32(&c.disconnect_reason, int32(msg.SUCCESS), int32(reason))
+}
+
+// Send a relay request, and wait for the response
+func (c *Client) relay(ctx context.Context, relayReq *msg.RelayRequest) (relayStatus msg.ClientStatusMap, err error) {
+	// Form the message
+	req := c.newMessage()
+	req.RelayReq = relayReq
+
+	rsp, err := c.transact(ctx, req)
+	if err != nil {
+		return
+	}
+	if rsp.RelayRes == nil {
+		err = errMissingResponse(req)
+		return
+	}
+	return rsp.RelayRes.StatusMap, msg.NewStatusError(rsp.RelayRes.Status, req.MessageId, nil)
+}
+
+// Get a context for a request made without one, which times out after the configured RequestTimeout
+func (c *Client) requestContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), c.config.RequestTimeout)
+}
+
+// Send a request message to the server, and wait for the response (or for the context to be done)
+func (c *Client) transact(ctx context.Context, req msg.Message) (rsp msg.Message, err error) {
+	ctx, span := c.startRequestSpan(ctx, &req)
+	defer func() {
+		span.RecordError(err)
+		span.End()
+	}()
+
+	// Don't bother sending anything if the caller has already given up
+	if ctx.Err() != nil {
+		err = contextError(ctx, req.MessageId)
+		return
+	}
 
 	// Create a channel for receiving the response. Defer cleaning it up.
-	rsp_chan := c.addResponseChannel(req.MessageId)
+	rsp_chan, err := c.addResponseChannel(req.MessageId)
+	if err != nil {
+		return
+	}
 	defer c.removeResponseChannel(req.MessageId)
 
 	//Encode the request and send it over the connection
-	status = c.sendMessage(req)
-	if status != msg.SUCCESS {
+	err = c.sendMessage(req)
+	if err != nil {
 		return
 	}
 
-	// Wait for response, or time out
+	// Wait for response, or for the caller to give up
 	select {
-	case rsp, ok := <-rsp_chan:
+	case r, ok := <-rsp_chan:
 		if !ok {
-			status = msg.CONNECTION_ERROR
+			err = c.connectionError(req.MessageId, nil)
 			return
 		}
-		if rsp.RelayRes == nil {
-			status = msg.ENCODING_ERROR
-			return
-		}
-		return rsp.RelayRes.StatusMap, rsp.RelayRes.Status
+		return r, rejectionError(req, r)
 
-	case <-time.After(5 * time.Second):
-		status = msg.TIMEOUT
+	case <-ctx.Done():
+		err = contextError(ctx, req.MessageId)
 		return
 	}
 }
 
-// Close closes a client, and its associated resources
+// Check whether the server refused to handle a request, rather than responding to it normally.
+// Rejections use an Error Response, or the Hello or Auth response, in place of the response to the original request.
+func rejectionError(req, rsp msg.Message) error {
+	if rsp.Error != nil {
+		return rsp.Error.Err(req.MessageId)
+	}
+	if req.HelloReq == nil && rsp.HelloRes != nil && rsp.HelloRes.Status != msg.SUCCESS {
+		return msg.NewStatusError(rsp.HelloRes.Status, req.MessageId, nil)
+	}
+	if req.AuthReq == nil && rsp.AuthRes != nil && rsp.AuthRes.Status != msg.SUCCESS {
+		return msg.NewStatusError(rsp.AuthRes.Status, req.MessageId, nil)
+	}
+	return nil
+}
+
+// Error for a response which doesn't contain the expected response type
+func errMissingResponse(req msg.Message) error {
+	return msg.NewStatusError(msg.ENCODING_ERROR, req.MessageId, nil)
+}
+
+// Convert the reason a context is done into an error with the matching protocol status
+func contextError(ctx context.Context, mid uint32) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return msg.NewStatusError(msg.TIMEOUT, mid, ctx.Err())
+	}
+	return msg.NewStatusError(msg.CANCELLED, mid, ctx.Err())
+}
+
+// Close closes a client, and its associated resources.
+// The client is Closing until the connection has ended, and is then Disconnected.
 func (c *Client) Close() {
+	c.setDisconnectReason(msg.CANCELLED)
+	c.setState(Closing, c.DisconnectReason(), nil)
 	c.con.Close()
 }
 
+// Close the client once its context is done, unless it has already disconnected
+func (c *Client) closeWhenDone() {
+	select {
+	case <-c.ctx.Done():
+		c.Close()
+	case <-c.done:
+	}
+}
+
+// Error for a request that failed because the connection has ended: CANCELLED if it was ended by the client's context,
+// otherwise CONNECTION_ERROR
+func (c *Client) connectionError(mid uint32, cause error) error {
+	if err := c.ctx.Err(); err != nil {
+		return msg.NewStatusError(msg.CANCELLED, mid, err)
+	}
+	return msg.NewStatusError(msg.CONNECTION_ERROR, mid, cause)
+}
+
 // Get a new base message with unique message ID. Can be safely accessed by different goroutines.
 func (c *Client) newMessage() msg.Message {
+	c.mid_map_mutex.Lock()
+	mid := c.nextMid()
+	c.mid_map_mutex.Unlock()
 	return msg.Message{
-		Version:   msg.MyVersion,
-		MessageId: atomic.AddUint32(&c.mid, 1),
+		Version:   c.Version(),
+		MessageId: mid,
 	}
 }
 
-func (c *Client) addResponseChannel(mid uint32) chan msg.Message {
-	ch := make(chan msg.Message)
+// Create the channel to receive the response to a request, unless the request can't be outstanding
+func (c *Client) addResponseChannel(mid uint32) (chan msg.Message, error) {
+	// Buffered, so the dispatcher never waits on a requester that has stopped listening.
+	// Removed by the requester once it stops waiting, so responses arriving after it gave up are discarded.
+	ch := make(chan msg.Message, 1)
 	c.mid_map_mutex.Lock()
+	defer c.mid_map_mutex.Unlock()
+	if err := c.checkMid(mid); err != nil {
+		return nil, err
+	}
 	c.mid_map[mid] = ch
-	c.mid_map_mutex.Unlock()
-	return ch
+	return ch, nil
 }
 
 func (c *Client) removeResponseChannel(mid uint32) {
@@ -197,11 +793,21 @@ func (c *Client) removeResponseChannel(mid uint32) {
 
 // Only to be called by dispatcher
 func (c *Client) sendToResponseChannel(m msg.Message) {
+	if c.completeAsyncRelay(m) {
+		return
+	}
 	c.mid_map_mutex.Lock()
 	ch, ok := c.mid_map[m.MessageId]
 	c.mid_map_mutex.Unlock()
 	if ok {
-		ch <- m
+		// Nonblocking, so duplicate responses are dropped rather than stalling the dispatcher
+		select {
+		case ch <- m:
+		default:
+		}
+	} else if m.Error != nil {
+		// Nothing is waiting to be told about it, such as for a message that couldn't be made out
+		c.config.Logger.Warn("Error from server", logging.F("mid", m.MessageId), logging.F("err", m.Error.Err(m.MessageId)))
 	}
 }
 
@@ -211,40 +817,155 @@ func (c *Client) closeAllResponseChannels() {
 	for _, ch := range c.mid_map {
 		close(ch)
 	}
+	async := c.async_map
+	c.async_map = make(map[uint32]*asyncRelay)
 	c.mid_map_mutex.Unlock()
+	for mid, ar := range async {
+		ar.complete(RelayResult{RelayId: mid, Err: c.connectionError(mid, nil)})
+	}
 }
 
-// Encode and transmit a message to the server
-func (c *Client) sendMessage(m msg.Message) msg.Status {
-	encoded_req, ok := c.tc.Encode(m)
-	if !ok {
-		return msg.ENCODING_ERROR
+// Encode and transmit a message to the server, using the agreed protocol version
+func (c *Client) sendMessage(m msg.Message) error {
+	m.Version = c.Version()
+	c.compressRelay(&m)
+	encoded_req, err := c.tc.Encode(m)
+	if err != nil {
+		return err
 	}
 	n, err := c.con.Write(encoded_req)
-	if (err != nil) || (n != len(encoded_req)) {
-		return msg.CONNECTION_ERROR
+	if err == nil && n != len(encoded_req) {
+		err = io.ErrShortWrite
+	}
+	if err != nil {
+		return c.connectionError(m.MessageId, err)
 	}
-	return msg.SUCCESS
+	return nil
 }
 
 func (c *Client) startDispatcher() {
 	go func() {
+		// Error which ended the connection
+		var cause error
 		// Read messages from the transport, and dispatch them to the relevant requester
 		for {
-			msgout, ok := c.dc.DecodeNext()
-			if ok {
+			msgout, err := c.dc.DecodeNext()
+			if msg.IsRecoverable(err) {
+				// Skip anything from the server that can't be understood, but carry on with the next message
+				c.config.Logger.Warn("Skipped malformed message from server", logging.F("err", err))
+				continue
+			}
+			if err == nil {
+				// Any message at all shows the server is still alive
+				atomic.StoreInt32(&c.pings_missed, 0)
 				if msgout.RelayInd != nil {
-					// Relay indication (This WILL block if the application isn't servicing the channel)
-					c.Relays <- *msgout.RelayInd
+					_, span := c.startReceiveSpan(msgout)
+					c.decompressRelay(msgout.RelayInd)
+					// Relay indication (This WILL block if the application isn't servicing the channel, with OverflowBlock)
+					// Key announcements and undecryptable relays are consumed when end-to-end encryption is enabled
+					if c.receiveE2E(msgout.RelayInd) && !c.sendToTopicChannel(*msgout.RelayInd) {
+						c.deliverRelay(c.Relays, *msgout.RelayInd, nil)
+					}
+					if msgout.RelayInd.AckRequested {
+						// Acknowledge asynchronously, so the dispatcher never blocks on the transport.
+						ack := c.newMessage()
+						ack.DelivReq = &msg.DeliveryRequest{
+							Dest:    msgout.RelayInd.Src,
+							RelayId: msgout.RelayInd.RelayId,
+						}
+						go c.sendMessage(ack)
+					}
+					c.replenishCredits()
+					span.End()
+				} else if msgout.DelivInd != nil {
+					// Delivery acknowledgement (This WILL block if the application isn't servicing the channel)
+					c.Acks <- *msgout.DelivInd
+				} else if msgout.PresInd != nil {
+					// Presence indication (This WILL block if the application isn't servicing the channel)
+					c.Presence <- *msgout.PresInd
+				} else if msgout.FailInd != nil {
+					// Reliable relay failure (This WILL block if the application isn't servicing the channel)
+					c.Failures <- *msgout.FailInd
+				} else if msgout.GoingAway != nil {
+					// The server is shutting down, and will close the connection once everything queued has been sent
+					c.config.Logger.Info("Server is going away")
+					c.setDisconnectReason(msg.GOING_AWAY)
+				} else if msgout.ServerFull != nil {
+					// The server refused the connection, and is about to close it
+					if msgout.ServerFull.Draining {
+						c.config.Logger.Warn("Server is draining")
+						c.setDisconnectReason(msg.DRAINING)
+					} else {
+						c.config.Logger.Warn("Server is full")
+						c.setDisconnectReason(msg.SERVER_FULL)
+					}
+				} else if msgout.Disconnect != nil {
+					// The server is disconnecting the client, and is about to close the connection
+					c.config.Logger.Warn("Disconnected by server", logging.F("reason", msgout.Disconnect.Reason))
+					c.setDisconnectReason(msgout.Disconnect.Reason)
+				} else if msgout.PingReq != nil {
+					// Keepalive from the server. Reply asynchronously, so the dispatcher never blocks on the transport.
+					go c.sendMessage(msg.Message{
+						Version:   msg.MyVersion,
+						MessageId: msgout.MessageId,
+						PingRes:   &msg.PingResponse{},
+					})
 				} else {
+					if msgout.PingRes != nil {
+						c.latency.pingAnswered(msgout.MessageId, time.Now())
+					}
 					// Response message
 					c.sendToResponseChannel(msgout)
 				}
 			} else {
 				c.closeAllResponseChannels()
+				var decodeErr *msg.DecodeError
+				if errors.As(err, &decodeErr) {
+					c.config.Logger.Warn("Failed to decode message from server", logging.F("err", err))
+					c.setDisconnectReason(msg.ENCODING_ERROR)
+				}
+				cause = err
 				break
 			}
 		}
+		c.setDisconnectReason(msg.CONNECTION_ERROR)
+		c.config.Logger.Info("Disconnected from server", logging.F("reason", c.DisconnectReason()))
+		c.closeAllTopicChannels()
 		close(c.Relays)
+		close(c.Acks)
+		close(c.Presence)
+		close(c.Failures)
+		if c.DisconnectReason() == msg.CANCELLED {
+			// The error is only from closing the connection
+			cause = nil
+		}
+		c.setState(Disconnected, c.DisconnectReason(), cause)
+		close(c.done)
+	}()
+}
+
+// Send keepalive pings to the server, and disconnect if it stops responding
+func (c *Client) startPinger() {
+	go func() {
+		ticker := time.NewTicker(c.config.PingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.done:
+				return
+			case <-ticker.C:
+			}
+			if atomic.AddInt32(&c.pings_missed, 1) > int32(c.config.PingMissThreshold) {
+				c.config.Logger.Warn("Server stopped responding to pings, disconnecting", logging.F("missed", c.config.PingMissThreshold))
+				c.setDisconnectReason(msg.INACTIVE)
+				c.con.Close()
+				return
+			}
+			// The response is not waited for, as receiving anything at all resets the missed count
+			req := c.newMessage()
+			req.PingReq = &msg.PingRequest{}
+			c.latency.keepaliveSent(req.MessageId, time.Now())
+			c.sendMessage(req)
+		}
 	}()
 }
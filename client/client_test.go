@@ -1,8 +1,19 @@
 package client
 
 import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/CiaranWoodward/broadcast_hub/msg"
 	"github.com/stretchr/testify/assert"
@@ -19,8 +30,8 @@ func TestClientIdReq(t *testing.T) {
 	go func() {
 		en := msg.CborTranscoder{}
 		sd := en.NewStreamDecoder(ser)
-		m, ok := sd.DecodeNext()
-		assert.True(t, ok)
+		m, err := sd.DecodeNext()
+		assert.Nil(t, err)
 		assert.Equal(t, msg.MyVersion, m.Version)
 		assert.NotNil(t, m.IdReq)
 		assert.Nil(t, m.IdRes)
@@ -34,20 +45,221 @@ func TestClientIdReq(t *testing.T) {
 			MessageId: m.MessageId,
 			IdRes:     &msg.IdentifyResponse{Id: 1234},
 		}
-		rspb, ok := en.Encode(rsp)
-		assert.True(t, ok)
+		rspb, err := en.Encode(rsp)
+		assert.Nil(t, err)
 		n, err := ser.Write(rspb)
 		assert.Equal(t, len(rspb), n)
 		assert.Nil(t, err)
 	}()
 
 	tc := NewClient(cli)
-	cid, status := tc.GetClientId()
-	assert.Equal(t, msg.SUCCESS, status)
+	assert.Equal(t, msg.ClientId(0), tc.ID())
+	cid, err := tc.GetClientId()
+	assert.Nil(t, err)
 	assert.Equal(t, msg.ClientId(1234), cid)
+	// The ID is remembered
+	assert.Equal(t, msg.ClientId(1234), tc.ID())
 	tc.Close()
 }
 
+func TestClientIdentifyOnConnect(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	cli, ser := net.Pipe()
+
+	// Fake server to answer the ID request sent as soon as the client is created
+	go func() {
+		en := msg.CborTranscoder{}
+		m, err := en.NewStreamDecoder(ser).DecodeNext()
+		if !assert.Nil(t, err) || !assert.NotNil(t, m.IdReq) {
+			return
+		}
+		rspb, _ := en.Encode(msg.Message{Version: msg.MyVersion, MessageId: m.MessageId, IdRes: &msg.IdentifyResponse{Id: 77}})
+		ser.Write(rspb)
+	}()
+
+	tc := NewClientWithConfig(cli, ClientConfig{IdentifyOnConnect: true})
+	assert.Equal(t, msg.ClientId(77), tc.ID())
+	tc.Close()
+
+	// Dialling fails if the server doesn't answer
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer l.Close()
+	go func() {
+		ser, err := l.Accept()
+		if err == nil {
+			ser.Close()
+		}
+	}()
+	tc, err = Dial(l.Addr().String(), ClientConfig{IdentifyOnConnect: true})
+	assert.ErrorIs(t, err, msg.CONNECTION_ERROR)
+	assert.Nil(t, tc)
+}
+
+// Dialer which records the addresses it's asked for, and connects directly
+type recordingDialer struct {
+	addresses []string
+}
+
+func (d *recordingDialer) Dial(network, address string) (net.Conn, error) {
+	d.addresses = append(d.addresses, network+" "+address)
+	return net.Dial(network, address)
+}
+
+func TestClientDialer(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer l.Close()
+
+	// Fake server to answer an ID request on the first connection
+	go func() {
+		ser, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer ser.Close()
+		en := msg.CborTranscoder{}
+		m, err := en.NewStreamDecoder(ser).DecodeNext()
+		if !assert.Nil(t, err) {
+			return
+		}
+		rspb, err := en.Encode(msg.Message{Version: msg.MyVersion, MessageId: m.MessageId, IdRes: &msg.IdentifyResponse{Id: 42}})
+		assert.Nil(t, err)
+		ser.Write(rspb)
+		// Wait for the client to hang up
+		io.Copy(io.Discard, ser)
+	}()
+
+	d := &recordingDialer{}
+	cfg := DefaultClientConfig()
+	cfg.Dialer = d
+	tc, err := Dial(l.Addr().String(), cfg)
+	if !assert.Nil(t, err) {
+		return
+	}
+	cid, err := tc.GetClientId()
+	assert.Nil(t, err)
+	assert.Equal(t, msg.ClientId(42), cid)
+	assert.Equal(t, []string{"tcp " + l.Addr().String()}, d.addresses)
+	tc.Close()
+}
+
+// Dialer connecting to fake servers over pipes: "down" can't be reached, "full" refuses clients, and any other address
+// answers ID requests with the number after the "up-"
+type fakeHubDialer struct {
+	mutex     sync.Mutex
+	addresses []string
+}
+
+func (d *fakeHubDialer) Dial(network, address string) (net.Conn, error) {
+	d.mutex.Lock()
+	d.addresses = append(d.addresses, address)
+	d.mutex.Unlock()
+	if address == "down" {
+		return nil, errors.New("connection refused")
+	}
+	cli, ser := net.Pipe()
+	go func() {
+		defer ser.Close()
+		en := msg.CborTranscoder{}
+		dec := en.NewStreamDecoder(ser)
+		for {
+			m, err := dec.DecodeNext()
+			if err != nil {
+				return
+			}
+			rsp := msg.Message{Version: msg.MyVersion, MessageId: m.MessageId}
+			if address == "full" {
+				rsp.ServerFull = &msg.ServerFullIndication{Draining: true}
+			} else {
+				id, _ := strconv.Atoi(strings.TrimPrefix(address, "up-"))
+				rsp.IdRes = &msg.IdentifyResponse{Id: msg.ClientId(id)}
+			}
+			rspb, _ := en.Encode(rsp)
+			ser.Write(rspb)
+			if address == "full" {
+				return
+			}
+		}
+	}()
+	return cli, nil
+}
+
+// Get the addresses dialled since last asked
+func (d *fakeHubDialer) dialled() []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	addresses := d.addresses
+	d.addresses = nil
+	return addresses
+}
+
+func TestClientDialMulti(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	d := &fakeHubDialer{}
+	cfg := ClientConfig{Dialer: d, IdentifyOnConnect: true}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := DialMulti(nil, DialFailover, cfg)
+	assert.Equal(t, ErrNoAddresses, err)
+	_, err = DialMulti([]string{"down", "down"}, DialFailover, cfg)
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{"down", "down"}, d.dialled())
+
+	// Failover always starts with the first server
+	tc, err := DialMulti([]string{"down", "up-1", "up-2"}, DialFailover, cfg)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, msg.ClientId(1), tc.ID())
+	tc, err = tc.Reconnect(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, msg.ClientId(1), tc.ID())
+	assert.Equal(t, []string{"down", "up-1", "down", "up-1"}, d.dialled())
+	tc.Close()
+
+	// A server refusing clients is passed over
+	tc, err = DialMulti([]string{"full", "up-2"}, DialFailover, cfg)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, msg.ClientId(2), tc.ID())
+	tc, err = tc.Reconnect(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, msg.ClientId(2), tc.ID())
+	assert.Equal(t, []string{"full", "up-2", "full", "up-2"}, d.dialled())
+	tc.Close()
+
+	// Round robin moves on to the next server with each reconnect
+	tc, err = DialMulti([]string{"up-0", "up-1", "down", "up-3"}, DialRoundRobin, cfg)
+	if !assert.Nil(t, err) {
+		return
+	}
+	ids := []msg.ClientId{tc.ID()}
+	for i := 0; i < 3; i++ {
+		tc, err = tc.Reconnect(ctx)
+		assert.Nil(t, err)
+		ids = append(ids, tc.ID())
+	}
+	tc.Close()
+	next := map[msg.ClientId]msg.ClientId{0: 1, 1: 3, 3: 0}
+	for i := 1; i < len(ids); i++ {
+		assert.Equal(t, next[ids[i-1]], ids[i], "%v", ids)
+	}
+
+	p, ok := ParseDialPolicy(DialRoundRobin.String())
+	assert.True(t, ok)
+	assert.Equal(t, DialRoundRobin, p)
+	_, ok = ParseDialPolicy("random")
+	assert.False(t, ok)
+}
+
 func TestClientListReq(t *testing.T) {
 	defer goleak.VerifyNone(t)
 	cli, ser := net.Pipe()
@@ -56,8 +268,8 @@ func TestClientListReq(t *testing.T) {
 	go func() {
 		en := msg.CborTranscoder{}
 		sd := en.NewStreamDecoder(ser)
-		m, ok := sd.DecodeNext()
-		assert.True(t, ok)
+		m, err := sd.DecodeNext()
+		assert.Nil(t, err)
 		assert.Equal(t, msg.MyVersion, m.Version)
 		assert.Nil(t, m.IdReq)
 		assert.Nil(t, m.IdRes)
@@ -71,16 +283,16 @@ func TestClientListReq(t *testing.T) {
 			MessageId: m.MessageId,
 			ListRes:   &msg.ListResponse{Others: []msg.ClientId{1, 2, 3, 4, 5}},
 		}
-		rspb, ok := en.Encode(rsp)
-		assert.True(t, ok)
+		rspb, err := en.Encode(rsp)
+		assert.Nil(t, err)
 		n, err := ser.Write(rspb)
 		assert.Equal(t, len(rspb), n)
 		assert.Nil(t, err)
 	}()
 
 	tc := NewClient(cli)
-	cids, status := tc.ListOtherClients()
-	assert.Equal(t, msg.SUCCESS, status)
+	cids, err := tc.ListOtherClients()
+	assert.Nil(t, err)
 	assert.Equal(t, []msg.ClientId{1, 2, 3, 4, 5}, cids)
 	tc.Close()
 }
@@ -93,8 +305,8 @@ func TestClientRelayReq(t *testing.T) {
 	go func() {
 		en := msg.CborTranscoder{}
 		sd := en.NewStreamDecoder(ser)
-		m, ok := sd.DecodeNext()
-		assert.True(t, ok)
+		m, err := sd.DecodeNext()
+		assert.Nil(t, err)
 		assert.Equal(t, msg.MyVersion, m.Version)
 		assert.Nil(t, m.IdReq)
 		assert.Nil(t, m.IdRes)
@@ -110,20 +322,324 @@ func TestClientRelayReq(t *testing.T) {
 			MessageId: m.MessageId,
 			RelayRes:  &msg.RelayResponse{Status: msg.SUCCESS, StatusMap: msg.ClientStatusMap{2: msg.INVALID_ID, 3: msg.CONNECTION_ERROR}},
 		}
-		rspb, ok := en.Encode(rsp)
-		assert.True(t, ok)
+		rspb, err := en.Encode(rsp)
+		assert.Nil(t, err)
 		n, err := ser.Write(rspb)
 		assert.Equal(t, len(rspb), n)
 		assert.Nil(t, err)
 	}()
 
 	tc := NewClient(cli)
-	csm, status := tc.RelayMessage([]byte{0x00, 0x11, 0x22, 0x33}, []msg.ClientId{1, 2, 3, 4, 5})
-	assert.Equal(t, msg.SUCCESS, status)
+	csm, err := tc.RelayMessage([]byte{0x00, 0x11, 0x22, 0x33}, []msg.ClientId{1, 2, 3, 4, 5})
+	assert.Nil(t, err)
 	assert.Equal(t, msg.ClientStatusMap{2: msg.INVALID_ID, 3: msg.CONNECTION_ERROR}, csm)
 	tc.Close()
 }
 
+func TestClientCompression(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	for _, compression := range []msg.Compression{msg.CompressionDeflate, msg.CompressionZstd} {
+		testClientCompression(t, compression)
+	}
+}
+
+func testClientCompression(t *testing.T, compression msg.Compression) {
+	cli, ser := net.Pipe()
+	long := bytes.Repeat([]byte("compress me "), 80)
+	short := []byte("too short")
+
+	// Fake server which checks that only the long relay is compressed, and relays it back compressed
+	go func() {
+		en := msg.CborTranscoder{}
+		sd := en.NewStreamDecoder(ser)
+		for _, expected := range [][]byte{long, short} {
+			m, err := sd.DecodeNext()
+			assert.Nil(t, err)
+			assert.NotNil(t, m.RelayReq)
+			if len(expected) == len(short) {
+				assert.Equal(t, msg.CompressionNone, m.RelayReq.Compression)
+				assert.Equal(t, short, m.RelayReq.Msg)
+			} else {
+				assert.Equal(t, compression, m.RelayReq.Compression)
+				assert.Less(t, len(m.RelayReq.Msg), len(long))
+			}
+			rspb, err := en.Encode(msg.Message{Version: msg.MyVersion, MessageId: m.MessageId, RelayRes: &msg.RelayResponse{Status: msg.SUCCESS}})
+			assert.Nil(t, err)
+			_, err = ser.Write(rspb)
+			assert.Nil(t, err)
+			indb, err := en.Encode(msg.Message{Version: msg.MyVersion, RelayInd: &msg.RelayIndication{Src: 5, Msg: m.RelayReq.Msg, Compression: m.RelayReq.Compression}})
+			assert.Nil(t, err)
+			_, err = ser.Write(indb)
+			assert.Nil(t, err)
+		}
+	}()
+
+	cfg := DefaultClientConfig()
+	cfg.Compression = compression
+	tc := NewClientWithConfig(cli, cfg)
+	for _, data := range [][]byte{long, short} {
+		_, err := tc.RelayMessage(data, []msg.ClientId{5})
+		assert.Nil(t, err)
+		ind := <-tc.Relays
+		assert.Equal(t, data, ind.Msg)
+		assert.Equal(t, msg.CompressionNone, ind.Compression)
+	}
+	tc.Close()
+}
+
+func TestClientRelayAsync(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	cli, ser := net.Pipe()
+
+	// Fake server to receive three Relay requests, and respond to the first two in reverse order
+	go func() {
+		en := msg.CborTranscoder{}
+		sd := en.NewStreamDecoder(ser)
+		reqs := make([]msg.Message, 3)
+		for i := range reqs {
+			var err error
+			reqs[i], err = sd.DecodeNext()
+			assert.Nil(t, err)
+			assert.NotNil(t, reqs[i].RelayReq)
+		}
+		for i, status := range []msg.Status{msg.NO_BUFFER, msg.SUCCESS} {
+			rsp := msg.Message{
+				Version:   msg.MyVersion,
+				MessageId: reqs[1-i].MessageId,
+				RelayRes:  &msg.RelayResponse{Status: status, StatusMap: msg.ClientStatusMap{2: msg.INVALID_ID}},
+			}
+			rspb, err := en.Encode(rsp)
+			assert.Nil(t, err)
+			ser.Write(rspb)
+		}
+		// The third never gets a response
+		ser.Close()
+	}()
+
+	tc := NewClient(cli)
+	first := tc.RelayMessageAsync([]byte{1}, []msg.ClientId{1, 2})
+	second := tc.RelayMessageAsync([]byte{2}, []msg.ClientId{1, 2})
+	third := tc.RelayMessageAsync([]byte{3}, []msg.ClientId{1, 2})
+	res := <-second
+	assert.NotZero(t, res.RelayId)
+	assert.ErrorIs(t, res.Err, msg.NO_BUFFER)
+	res = <-first
+	assert.Nil(t, res.Err)
+	assert.Equal(t, msg.ClientStatusMap{2: msg.INVALID_ID}, res.StatusMap)
+	res = <-third
+	assert.ErrorIs(t, res.Err, msg.CONNECTION_ERROR)
+	_, ok := <-third
+	assert.False(t, ok)
+
+	// Relays that are too long fail straight away, as do relays after the connection is lost
+	res = <-tc.RelayMessageAsync(make([]byte, 1025), []msg.ClientId{1})
+	assert.ErrorIs(t, res.Err, msg.TOO_LONG)
+	res = <-tc.RelayMessageAsync([]byte{4}, []msg.ClientId{1})
+	assert.ErrorIs(t, res.Err, msg.CONNECTION_ERROR)
+	tc.Close()
+}
+
+func TestClientMessageIds(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	cli, ser := net.Pipe()
+
+	// Fake server which responds to every Relay request, except those asking it to hold them
+	go func() {
+		en := msg.CborTranscoder{}
+		sd := en.NewStreamDecoder(ser)
+		for {
+			req, err := sd.DecodeNext()
+			if err != nil {
+				return
+			}
+			if string(req.RelayReq.Msg) == "hold" {
+				continue
+			}
+			rsp := msg.Message{Version: msg.MyVersion, MessageId: req.MessageId, RelayRes: &msg.RelayResponse{}}
+			rspb, err := en.Encode(rsp)
+			assert.Nil(t, err)
+			ser.Write(rspb)
+		}
+	}()
+
+	tc := NewClientWithConfig(cli, ClientConfig{MaxOutstanding: 2})
+	tc.SetNextMessageId(math.MaxUint32)
+	held := tc.RelayMessageAsync([]byte("hold"), []msg.ClientId{1})
+
+	// The counter wraps past zero
+	res := <-tc.RelayMessageAsync([]byte("ok"), []msg.ClientId{1})
+	assert.Nil(t, res.Err)
+	assert.Equal(t, uint32(1), res.RelayId)
+
+	// IDs still waiting for a response are skipped
+	tc.SetNextMessageId(math.MaxUint32)
+	res = <-tc.RelayMessageAsync([]byte("ok"), []msg.ClientId{1})
+	assert.Nil(t, res.Err)
+	assert.Equal(t, uint32(1), res.RelayId)
+
+	// Requests beyond MaxOutstanding are refused without being sent
+	heldToo := tc.RelayMessageAsync([]byte("hold"), []msg.ClientId{1})
+	assert.Eventually(t, func() bool { return tc.Outstanding() == 2 }, time.Second, time.Millisecond)
+	res = <-tc.RelayMessageAsync([]byte("ok"), []msg.ClientId{1})
+	assert.ErrorIs(t, res.Err, msg.BUSY)
+	assert.ErrorIs(t, res.Err, ErrTooManyOutstanding)
+	assert.Zero(t, res.RelayId)
+	_, err := tc.RelayMessage([]byte("ok"), []msg.ClientId{1})
+	assert.ErrorIs(t, err, ErrTooManyOutstanding)
+
+	tc.Close()
+	res = <-held
+	assert.ErrorIs(t, res.Err, msg.CONNECTION_ERROR)
+	assert.Equal(t, uint32(math.MaxUint32), res.RelayId)
+	res = <-heldToo
+	assert.ErrorIs(t, res.Err, msg.CONNECTION_ERROR)
+	assert.Equal(t, uint32(2), res.RelayId)
+	assert.Zero(t, tc.Outstanding())
+}
+
+func TestClientBroadcastReq(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	cli, ser := net.Pipe()
+
+	// Fake server to receive broadcast Relay request, verify it, and send a response
+	go func() {
+		en := msg.CborTranscoder{}
+		sd := en.NewStreamDecoder(ser)
+		m, err := sd.DecodeNext()
+		assert.Nil(t, err)
+		assert.NotNil(t, m.RelayReq)
+		assert.True(t, m.RelayReq.Broadcast)
+		assert.Empty(t, m.RelayReq.Dest)
+		assert.Equal(t, []byte{0x44, 0x55}, m.RelayReq.Msg)
+		rsp := msg.Message{
+			Version:   msg.MyVersion,
+			MessageId: m.MessageId,
+			RelayRes:  &msg.RelayResponse{Status: msg.SUCCESS, StatusMap: msg.ClientStatusMap{7: msg.NO_BUFFER}},
+		}
+		rspb, err := en.Encode(rsp)
+		assert.Nil(t, err)
+		n, err := ser.Write(rspb)
+		assert.Equal(t, len(rspb), n)
+		assert.Nil(t, err)
+	}()
+
+	tc := NewClient(cli)
+	csm, err := tc.BroadcastMessage([]byte{0x44, 0x55})
+	assert.Nil(t, err)
+	assert.Equal(t, msg.ClientStatusMap{7: msg.NO_BUFFER}, csm)
+
+	// Oversized broadcasts are rejected locally
+	_, err = tc.BroadcastMessage(make([]byte, 1025))
+	assert.ErrorIs(t, err, msg.TOO_LONG)
+	tc.Close()
+}
+
+func TestClientRelayBatch(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	cli, ser := net.Pipe()
+
+	// Fake server to receive a Relay Batch request, verify it, and answer each relay
+	go func() {
+		en := msg.CborTranscoder{}
+		sd := en.NewStreamDecoder(ser)
+		m, err := sd.DecodeNext()
+		assert.Nil(t, err)
+		if !assert.NotNil(t, m.RelayBatReq) || !assert.Len(t, m.RelayBatReq.Relays, 2) {
+			return
+		}
+		assert.Equal(t, []byte{1}, m.RelayBatReq.Relays[0].Msg)
+		assert.Equal(t, []msg.ClientId{3}, m.RelayBatReq.Relays[0].Dest)
+		assert.Equal(t, "news", m.RelayBatReq.Relays[1].Topic)
+		assert.True(t, m.RelayBatReq.Relays[1].AckRequested)
+		assert.Equal(t, []uint32{m.MessageId, m.MessageId + 1}, m.RelayBatReq.RelayIds)
+		rspb, _ := en.Encode(msg.Message{
+			Version:   msg.MyVersion,
+			MessageId: m.MessageId,
+			RelayBatRes: &msg.RelayBatchResponse{Status: msg.SUCCESS, Results: []msg.RelayResponse{
+				{Status: msg.SUCCESS, StatusMap: msg.ClientStatusMap{3: msg.NO_BUFFER}},
+				{Status: msg.FORBIDDEN},
+			}},
+		})
+		ser.Write(rspb)
+	}()
+
+	tc := NewClient(cli)
+	results, err := tc.RelayBatch([]Relay{
+		{Message: []byte{1}, Dest: []msg.ClientId{3}},
+		{Message: []byte{2}, Topic: "news", Options: RelayOptions{AckRequested: true}},
+	})
+	assert.Nil(t, err)
+	if assert.Len(t, results, 2) {
+		assert.Equal(t, msg.ClientStatusMap{3: msg.NO_BUFFER}, results[0].StatusMap)
+		assert.Nil(t, results[0].Err)
+		assert.Equal(t, results[0].RelayId+1, results[1].RelayId)
+		assert.ErrorIs(t, results[1].Err, msg.FORBIDDEN)
+	}
+
+	// Oversized batches are rejected locally
+	_, err = tc.RelayBatch(make([]Relay, msg.MaxBatchRelays+1))
+	assert.ErrorIs(t, err, msg.TOO_LONG)
+	large := make([]Relay, 40)
+	for i := range large {
+		large[i] = Relay{Message: make([]byte, 1024), Dest: []msg.ClientId{3}}
+	}
+	_, err = tc.RelayBatch(large)
+	assert.ErrorIs(t, err, msg.TOO_LONG)
+	_, err = tc.RelayBatch([]Relay{{Message: make([]byte, 1025)}})
+	assert.ErrorIs(t, err, msg.TOO_LONG)
+	tc.Close()
+}
+
+func TestClientRelayBatchIds(t *testing.T) {
+	// Test that the IDs of a batch's relays aren't given to other requests while the batch is waiting for its response
+	defer goleak.VerifyNone(t)
+	cli, ser := net.Pipe()
+	ids := make(chan []uint32, 1)
+
+	// Fake server to receive a Relay Batch request, then answer a Ping Request sent meanwhile before the batch
+	go func() {
+		en := msg.CborTranscoder{}
+		sd := en.NewStreamDecoder(ser)
+		batch, err := sd.DecodeNext()
+		if !assert.Nil(t, err) || !assert.NotNil(t, batch.RelayBatReq) {
+			return
+		}
+		ids <- batch.RelayBatReq.RelayIds
+		ping, err := sd.DecodeNext()
+		if !assert.Nil(t, err) || !assert.NotNil(t, ping.PingReq) {
+			return
+		}
+		assert.NotContains(t, batch.RelayBatReq.RelayIds, ping.MessageId)
+		rspb, _ := en.Encode(msg.Message{Version: msg.MyVersion, MessageId: ping.MessageId, PingRes: &msg.PingResponse{}})
+		ser.Write(rspb)
+		rspb, _ = en.Encode(msg.Message{
+			Version:   msg.MyVersion,
+			MessageId: batch.MessageId,
+			RelayBatRes: &msg.RelayBatchResponse{Status: msg.SUCCESS, Results: []msg.RelayResponse{
+				{Status: msg.SUCCESS}, {Status: msg.SUCCESS}, {Status: msg.SUCCESS},
+			}},
+		})
+		ser.Write(rspb)
+	}()
+
+	tc := NewClient(cli)
+	done := make(chan error)
+	go func() {
+		_, err := tc.RelayBatch([]Relay{
+			{Message: []byte{1}, Dest: []msg.ClientId{3}},
+			{Message: []byte{2}, Dest: []msg.ClientId{3}},
+			{Message: []byte{3}, Dest: []msg.ClientId{3}},
+		})
+		done <- err
+	}()
+	batch_ids := <-ids
+	tc.SetNextMessageId(batch_ids[1])
+	_, err := tc.Ping()
+	assert.Nil(t, err)
+	assert.Nil(t, <-done)
+	tc.Close()
+}
+
 func TestClientRelayInd(t *testing.T) {
 	defer goleak.VerifyNone(t)
 	cli, ser := net.Pipe()
@@ -139,8 +655,8 @@ func TestClientRelayInd(t *testing.T) {
 				Msg: []byte{11, 22, 33},
 			},
 		}
-		indb, ok := en.Encode(ind)
-		assert.True(t, ok)
+		indb, err := en.Encode(ind)
+		assert.Nil(t, err)
 		n, err := ser.Write(indb)
 		assert.Equal(t, len(indb), n)
 		assert.Nil(t, err)
@@ -154,6 +670,348 @@ func TestClientRelayInd(t *testing.T) {
 	tc.Close()
 }
 
+func TestClientOnRelay(t *testing.T) {
+	// Fake server sending several relay indications
+	sendRelays := func(ser net.Conn, count int) {
+		en := msg.CborTranscoder{}
+		for i := 1; i <= count; i++ {
+			indb, err := en.Encode(msg.Message{
+				Version:   msg.MyVersion,
+				MessageId: uint32(i),
+				RelayInd:  &msg.RelayIndication{Src: msg.ClientId(888), Msg: []byte{byte(i)}},
+			})
+			assert.Nil(t, err)
+			_, err = ser.Write(indb)
+			assert.Nil(t, err)
+		}
+	}
+
+	t.Run("Park", func(t *testing.T) {
+		defer goleak.VerifyNone(t)
+		cli, ser := net.Pipe()
+		go sendRelays(ser, 5)
+
+		// Every relay is handled, in order with a single handler
+		tc := NewClientWithConfig(cli, ClientConfig{RelayHandlerQueue: 1})
+		var mutex sync.Mutex
+		handled := []byte{}
+		tc.OnRelay(func(ind msg.RelayIndication) {
+			mutex.Lock()
+			handled = append(handled, ind.Msg...)
+			mutex.Unlock()
+		})
+		assert.Eventually(t, func() bool {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return len(handled) == 5
+		}, time.Second, time.Millisecond)
+		assert.Equal(t, []byte{1, 2, 3, 4, 5}, handled)
+		assert.Equal(t, uint64(0), tc.DroppedRelays())
+		tc.Close()
+	})
+
+	t.Run("Drop", func(t *testing.T) {
+		defer goleak.VerifyNone(t)
+		cli, ser := net.Pipe()
+		go sendRelays(ser, 5)
+
+		// While the only handler is stuck, relays beyond the queue are dropped
+		tc := NewClientWithConfig(cli, ClientConfig{RelayHandlerQueue: 1, RelayHandlerPolicy: HandlerDrop})
+		release := make(chan struct{})
+		handled := int32(0)
+		tc.OnRelay(func(ind msg.RelayIndication) {
+			<-release
+			atomic.AddInt32(&handled, 1)
+		})
+		assert.Eventually(t, func() bool { return tc.DroppedRelays() >= 3 }, time.Second, time.Millisecond)
+		close(release)
+		assert.Eventually(t, func() bool {
+			return uint64(atomic.LoadInt32(&handled))+tc.DroppedRelays() == 5
+		}, time.Second, time.Millisecond)
+		tc.Close()
+	})
+}
+
+func TestEchoResponder(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	cli, ser := net.Pipe()
+
+	// Fake server sending relays, and failing the second reply
+	go func() {
+		en := msg.CborTranscoder{}
+		sd := en.NewStreamDecoder(ser)
+		for i := 1; i <= 2; i++ {
+			indb, err := en.Encode(msg.Message{
+				Version:  msg.MyVersion,
+				RelayInd: &msg.RelayIndication{Src: msg.ClientId(887 + i), Msg: []byte{byte(i)}},
+			})
+			assert.Nil(t, err)
+			_, err = ser.Write(indb)
+			assert.Nil(t, err)
+
+			m, err := sd.DecodeNext()
+			assert.Nil(t, err)
+			assert.NotNil(t, m.RelayReq)
+			assert.Equal(t, []msg.ClientId{msg.ClientId(887 + i)}, m.RelayReq.Dest)
+			assert.Equal(t, []byte{byte(i), byte(i)}, m.RelayReq.Msg)
+			rsp := msg.Message{
+				Version:   msg.MyVersion,
+				MessageId: m.MessageId,
+				RelayRes:  &msg.RelayResponse{Status: msg.SUCCESS},
+			}
+			if i == 2 {
+				rsp.RelayRes.StatusMap = msg.ClientStatusMap{889: msg.INVALID_ID}
+			}
+			rspb, err := en.Encode(rsp)
+			assert.Nil(t, err)
+			_, err = ser.Write(rspb)
+			assert.Nil(t, err)
+		}
+	}()
+
+	r := NewEchoResponder(NewClient(cli), func(ind msg.RelayIndication) []byte {
+		return append(ind.Msg, ind.Msg...)
+	})
+	assert.Eventually(t, func() bool { return r.Err() != nil }, time.Second, time.Millisecond)
+	assert.ErrorIs(t, r.Err(), msg.INVALID_ID)
+	select {
+	case <-r.Done():
+		t.Error("Responder stopped early")
+	default:
+	}
+	assert.ErrorIs(t, r.Close(), msg.INVALID_ID)
+	<-r.Done()
+}
+
+func TestClientRelayOverflow(t *testing.T) {
+	// Fake server sending more relay indications than the 'Relays' channel holds, which the application doesn't read
+	sendRelays := func(ser net.Conn, count int) chan struct{} {
+		sent := make(chan struct{})
+		go func() {
+			en := msg.CborTranscoder{}
+			for i := 1; i <= count; i++ {
+				indb, _ := en.Encode(msg.Message{
+					Version:   msg.MyVersion,
+					MessageId: uint32(i),
+					RelayInd:  &msg.RelayIndication{Src: msg.ClientId(888), Msg: []byte{byte(i)}},
+				})
+				if _, err := ser.Write(indb); err != nil {
+					return
+				}
+			}
+			close(sent)
+		}()
+		return sent
+	}
+	received := func(tc *Client) []byte {
+		got := []byte{}
+		for len(tc.Relays) > 0 {
+			got = append(got, (<-tc.Relays).Msg...)
+		}
+		return got
+	}
+	count := internalMessageBufferSize + 5
+
+	for _, policy := range []OverflowPolicy{OverflowBlock, OverflowDropNewest, OverflowDropOldest} {
+		t.Run(policy.String(), func(t *testing.T) {
+			defer goleak.VerifyNone(t)
+			cli, ser := net.Pipe()
+			tc := NewClientWithConfig(cli, ClientConfig{RelayOverflowPolicy: policy})
+			sent := sendRelays(ser, count)
+
+			if policy == OverflowBlock {
+				// Nothing more is received until the application reads a relay
+				select {
+				case <-sent:
+					t.Error("Dispatcher didn't block")
+				case <-time.After(20 * time.Millisecond):
+				}
+				assert.Equal(t, byte(1), (<-tc.Relays).Msg[0])
+				tc.Close()
+				ser.Close()
+				return
+			}
+
+			// The dispatcher keeps receiving, and drops the relays that don't fit
+			select {
+			case <-sent:
+			case <-time.After(time.Second):
+				t.Fatal("Dispatcher blocked")
+			}
+			expected := []byte{}
+			first := 1
+			if policy == OverflowDropOldest {
+				first = count - internalMessageBufferSize + 1
+			}
+			for i := first; i < first+internalMessageBufferSize; i++ {
+				expected = append(expected, byte(i))
+			}
+			// The last relay may still be being handled once it has been read
+			assert.Eventually(t, func() bool {
+				return tc.DroppedRelays() == uint64(count-internalMessageBufferSize)
+			}, time.Second, time.Millisecond)
+			assert.Equal(t, expected, received(tc))
+			tc.Close()
+		})
+	}
+}
+
+func TestClientTopics(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	cli, ser := net.Pipe()
+
+	// Fake server to accept a subscription, publish to it, then accept the unsubscription
+	go func() {
+		en := msg.CborTranscoder{}
+		sd := en.NewStreamDecoder(ser)
+		m, err := sd.DecodeNext()
+		assert.Nil(t, err)
+		assert.NotNil(t, m.SubReq)
+		assert.Equal(t, "news", m.SubReq.Topic)
+		rspb, _ := en.Encode(msg.Message{Version: msg.MyVersion, MessageId: m.MessageId, SubRes: &msg.SubscribeResponse{Status: msg.SUCCESS}})
+		ser.Write(rspb)
+
+		// One relay on the topic, and one without
+		indb, _ := en.Encode(msg.Message{Version: msg.MyVersion, MessageId: 1, RelayInd: &msg.RelayIndication{Src: 5, Msg: []byte{1}, Topic: "news"}})
+		ser.Write(indb)
+		indb, _ = en.Encode(msg.Message{Version: msg.MyVersion, MessageId: 2, RelayInd: &msg.RelayIndication{Src: 6, Msg: []byte{2}}})
+		ser.Write(indb)
+
+		m, err = sd.DecodeNext()
+		assert.Nil(t, err)
+		assert.NotNil(t, m.UnsubReq)
+		assert.Equal(t, "news", m.UnsubReq.Topic)
+		rspb, _ = en.Encode(msg.Message{Version: msg.MyVersion, MessageId: m.MessageId, UnsubRes: &msg.UnsubscribeResponse{Status: msg.SUCCESS}})
+		ser.Write(rspb)
+	}()
+
+	tc := NewClient(cli)
+	relays, err := tc.Subscribe("news")
+	assert.Nil(t, err)
+
+	// Topic relays go to the topic channel, everything else to the main channel
+	ind := <-relays
+	assert.Equal(t, msg.ClientId(5), ind.Src)
+	assert.Equal(t, "news", ind.Topic)
+	ind = <-tc.Relays
+	assert.Equal(t, msg.ClientId(6), ind.Src)
+
+	// Unsubscribing closes the topic channel
+	assert.Nil(t, tc.Unsubscribe("news"))
+	_, ok := <-relays
+	assert.False(t, ok)
+
+	// Invalid topics are rejected locally
+	_, err = tc.Subscribe("")
+	assert.ErrorIs(t, err, msg.INVALID_ID)
+	_, err = tc.PublishMessage(string(make([]byte, 256)), []byte{1})
+	assert.ErrorIs(t, err, msg.TOO_LONG)
+	tc.Close()
+}
+
+func TestClientTopicConnBreak(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	cli, ser := net.Pipe()
+
+	// Fake server to accept a subscription, then terminate the connection
+	go func() {
+		en := msg.CborTranscoder{}
+		sd := en.NewStreamDecoder(ser)
+		m, _ := sd.DecodeNext()
+		rspb, _ := en.Encode(msg.Message{Version: msg.MyVersion, MessageId: m.MessageId, SubRes: &msg.SubscribeResponse{Status: msg.SUCCESS}})
+		ser.Write(rspb)
+		ser.Close()
+	}()
+
+	tc := NewClient(cli)
+	relays, err := tc.Subscribe("news")
+	assert.Nil(t, err)
+
+	// Topic channel should be closed along with the connection
+	_, ok := <-relays
+	assert.False(t, ok)
+	_, err = tc.Subscribe("news")
+	assert.ErrorIs(t, err, msg.CONNECTION_ERROR)
+	tc.Close()
+}
+
+func TestClientDeliveryAck(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	cli, ser := net.Pipe()
+
+	// Fake server which sends a relay requesting acknowledgement, then acknowledges the client's own relay
+	go func() {
+		en := msg.CborTranscoder{}
+		sd := en.NewStreamDecoder(ser)
+		indb, _ := en.Encode(msg.Message{Version: msg.MyVersion, MessageId: 1, RelayInd: &msg.RelayIndication{Src: 5, Msg: []byte{1}, AckRequested: true, RelayId: 42}})
+		ser.Write(indb)
+
+		// The acknowledgement is sent asynchronously, so it may arrive before or after the client's relay
+		var m msg.Message
+		for i := 0; i < 2; i++ {
+			rx, err := sd.DecodeNext()
+			assert.Nil(t, err)
+			if rx.DelivReq != nil {
+				assert.Equal(t, &msg.DeliveryRequest{Dest: 5, RelayId: 42}, rx.DelivReq)
+			} else {
+				m = rx
+			}
+		}
+		if !assert.NotNil(t, m.RelayReq) {
+			return
+		}
+		assert.True(t, m.RelayReq.AckRequested)
+		rspb, _ := en.Encode(msg.Message{Version: msg.MyVersion, MessageId: m.MessageId, RelayRes: &msg.RelayResponse{Status: msg.SUCCESS}})
+		ser.Write(rspb)
+		indb, _ = en.Encode(msg.Message{Version: msg.MyVersion, DelivInd: &msg.DeliveryIndication{Src: 5, RelayId: m.MessageId}})
+		ser.Write(indb)
+	}()
+
+	tc := NewClient(cli)
+	ind := <-tc.Relays
+	assert.True(t, ind.AckRequested)
+
+	relayId, csm, err := tc.RelayMessageWithAck([]byte{2}, []msg.ClientId{5})
+	assert.Nil(t, err)
+	assert.Len(t, csm, 0)
+	ack := <-tc.Acks
+	assert.Equal(t, msg.DeliveryIndication{Src: 5, RelayId: relayId}, ack)
+	tc.Close()
+}
+
+func TestClientFlowCredits(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	cli, ser := net.Pipe()
+
+	// Fake server which records the credits granted, sending relays while the client has some
+	granted := make(chan uint32, 8)
+	go func() {
+		en := msg.CborTranscoder{}
+		sd := en.NewStreamDecoder(ser)
+		for i := 0; i < 3; i++ {
+			rx, err := sd.DecodeNext()
+			if !assert.Nil(t, err) || !assert.NotNil(t, rx.FlowUpd) {
+				return
+			}
+			granted <- rx.FlowUpd.Credits
+			for j := uint32(0); j < rx.FlowUpd.Credits && i == 0; j++ {
+				indb, _ := en.Encode(msg.Message{Version: msg.MyVersion, RelayInd: &msg.RelayIndication{Src: 5, Msg: []byte{byte(j)}}})
+				ser.Write(indb)
+			}
+		}
+	}()
+
+	tc := NewClientWithConfig(cli, ClientConfig{FlowCredits: 4})
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, []byte{byte(i)}, (<-tc.Relays).Msg)
+	}
+	// The window is granted on connect, then topped up as each half of it is received
+	assert.Equal(t, uint32(4), <-granted)
+	assert.Equal(t, uint32(2), <-granted)
+	assert.Equal(t, uint32(2), <-granted)
+	tc.Close()
+}
+
 func TestClientIdConnBreak(t *testing.T) {
 	defer goleak.VerifyNone(t)
 	cli, ser := net.Pipe()
@@ -168,8 +1026,8 @@ func TestClientIdConnBreak(t *testing.T) {
 	}()
 
 	tc := NewClient(cli)
-	_, status := tc.GetClientId()
-	assert.Equal(t, msg.CONNECTION_ERROR, status)
+	_, err := tc.GetClientId()
+	assert.ErrorIs(t, err, msg.CONNECTION_ERROR)
 	tc.Close()
 }
 
@@ -185,8 +1043,344 @@ func TestClientIdTimeout(t *testing.T) {
 	}()
 
 	tc := NewClient(cli)
-	_, status := tc.GetClientId()
-	assert.Equal(t, msg.TIMEOUT, status)
+	_, err := tc.GetClientId()
+	assert.ErrorIs(t, err, msg.TIMEOUT)
+	tc.Close()
+}
+
+func TestClientIdCtxCancel(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	cli, ser := net.Pipe()
+
+	// Fake server to receive ID request, but not respond
+	go func() {
+		tc := msg.CborTranscoder{}
+		sd := tc.NewStreamDecoder(ser)
+		sd.DecodeNext()
+	}()
+
+	tc := NewClient(cli)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-time.After(50 * time.Millisecond)
+		cancel()
+	}()
+	_, err := tc.GetClientIdCtx(ctx)
+	assert.ErrorIs(t, err, msg.CANCELLED)
+
+	// Already-cancelled contexts fail without sending anything
+	_, err = tc.ListOtherClientsCtx(ctx)
+	assert.ErrorIs(t, err, msg.CANCELLED)
+	tc.Close()
+}
+
+func TestClientCtxLateResponse(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	cli, ser := net.Pipe()
+
+	// Fake server that responds to the first request too late, and the second one on time
+	go func() {
+		en := msg.CborTranscoder{}
+		sd := en.NewStreamDecoder(ser)
+		first, _ := sd.DecodeNext()
+		second, _ := sd.DecodeNext()
+		for _, m := range []msg.Message{first, second} {
+			rspb, _ := en.Encode(msg.Message{Version: msg.MyVersion, MessageId: m.MessageId, IdRes: &msg.IdentifyResponse{Id: 99}})
+			ser.Write(rspb)
+		}
+	}()
+
+	tc := NewClient(cli)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := tc.GetClientIdCtx(ctx)
+	assert.ErrorIs(t, err, msg.TIMEOUT)
+
+	// The dispatcher should have dropped the late response, and still be serving new requests
+	cid, err := tc.GetClientId()
+	assert.Nil(t, err)
+	assert.Equal(t, msg.ClientId(99), cid)
+	tc.Close()
+}
+
+func TestClientPing(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	cli, ser := net.Pipe()
+
+	// Fake server that pings the client, then responds to the client's ping
+	go func() {
+		en := msg.CborTranscoder{}
+		sd := en.NewStreamDecoder(ser)
+		pingb, _ := en.Encode(msg.Message{Version: msg.MyVersion, MessageId: 77, PingReq: &msg.PingRequest{}})
+		ser.Write(pingb)
+		m, err := sd.DecodeNext()
+		assert.Nil(t, err)
+		assert.NotNil(t, m.PingRes)
+		assert.Equal(t, uint32(77), m.MessageId)
+
+		m, err = sd.DecodeNext()
+		assert.Nil(t, err)
+		assert.NotNil(t, m.PingReq)
+		rspb, _ := en.Encode(msg.Message{Version: msg.MyVersion, MessageId: m.MessageId, PingRes: &msg.PingResponse{}})
+		ser.Write(rspb)
+	}()
+
+	tc := NewClient(cli)
+	// Give the client a chance to answer the server's ping first
+	<-time.After(20 * time.Millisecond)
+	rtt, err := tc.Ping()
+	assert.Nil(t, err)
+	assert.Greater(t, int64(rtt), int64(0))
+	assert.Equal(t, LatencyStats{Samples: 1, Last: rtt, Smoothed: rtt, Variation: rtt / 2, Min: rtt, Max: rtt}, tc.Latency())
+	assert.Equal(t, msg.SUCCESS, tc.DisconnectReason())
+	tc.Close()
+}
+
+func TestLatencyEstimator(t *testing.T) {
+	var e latencyEstimator
+	assert.Equal(t, LatencyStats{}, e.get())
+	e.record(80 * time.Millisecond)
+	e.record(40 * time.Millisecond)
+	assert.Equal(t, LatencyStats{
+		Samples:   2,
+		Last:      40 * time.Millisecond,
+		Smoothed:  75 * time.Millisecond,
+		Variation: 40 * time.Millisecond,
+		Min:       40 * time.Millisecond,
+		Max:       80 * time.Millisecond,
+	}, e.get())
+
+	// Only the response to the latest keepalive ping is timed, and only once
+	now := time.Now()
+	e.keepaliveSent(5, now)
+	e.keepaliveSent(6, now.Add(10*time.Millisecond))
+	e.pingAnswered(5, now.Add(20*time.Millisecond))
+	assert.Equal(t, uint64(2), e.get().Samples)
+	e.pingAnswered(6, now.Add(20*time.Millisecond))
+	e.pingAnswered(6, now.Add(30*time.Millisecond))
+	assert.Equal(t, uint64(3), e.get().Samples)
+	assert.Equal(t, 10*time.Millisecond, e.get().Last)
+}
+
+func TestClientKeepaliveInactive(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	cli, ser := net.Pipe()
+
+	// Fake server that reads everything, but never responds
+	go func() {
+		tc := msg.CborTranscoder{}
+		sd := tc.NewStreamDecoder(ser)
+		for {
+			if _, err := sd.DecodeNext(); err != nil {
+				break
+			}
+		}
+	}()
+
+	tc := NewClientWithConfig(cli, ClientConfig{PingInterval: 10 * time.Millisecond, PingMissThreshold: 2})
+	select {
+	case _, ok := <-tc.Relays:
+		assert.False(t, ok)
+	case <-time.After(time.Second):
+		t.Error("Client was not disconnected")
+	}
+	assert.Equal(t, msg.INACTIVE, tc.DisconnectReason())
+	tc.Close()
+}
+
+func TestClientGoingAway(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	cli, ser := net.Pipe()
+
+	// Fake server that flushes a final relay after announcing its shutdown
+	go func() {
+		en := msg.CborTranscoder{}
+		b, _ := en.Encode(msg.Message{Version: msg.MyVersion, GoingAway: &msg.GoingAwayIndication{}})
+		ser.Write(b)
+		b, _ = en.Encode(msg.Message{Version: msg.MyVersion, RelayInd: &msg.RelayIndication{Src: 3, Msg: []byte{1}}})
+		ser.Write(b)
+		ser.Close()
+	}()
+
+	tc := NewClient(cli)
+	ind, ok := <-tc.Relays
+	assert.True(t, ok)
+	assert.Equal(t, []byte{1}, ind.Msg)
+	_, ok = <-tc.Relays
+	assert.False(t, ok)
+	assert.Equal(t, msg.GOING_AWAY, tc.DisconnectReason())
+	tc.Close()
+}
+
+func TestClientState(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	// Closed locally
+	cli, ser := net.Pipe()
+	tc := NewClient(cli)
+	assert.Equal(t, Connected, tc.State())
+	tc.Close()
+	assert.Equal(t, StateEvent{State: Closing, Reason: msg.CANCELLED}, <-tc.Events)
+	assert.Equal(t, StateEvent{State: Disconnected, Reason: msg.CANCELLED}, <-tc.Events)
+	_, ok := <-tc.Events
+	assert.False(t, ok)
+	assert.Equal(t, Disconnected, tc.State())
+	tc.Close()
+	ser.Close()
+
+	// Closed by the server
+	cli, ser = net.Pipe()
+	tc = NewClient(cli)
+	ser.Close()
+	assert.Equal(t, StateEvent{State: Disconnected, Reason: msg.CONNECTION_ERROR, Err: io.EOF}, <-tc.Events)
+	assert.Equal(t, Disconnected, tc.State())
+	tc.Close()
+	_, ok = <-tc.Events
+	assert.False(t, ok)
+
+	// The server sends something that can't be decoded
+	cli, ser = net.Pipe()
+	tc = NewClient(cli)
+	go func() {
+		ser.Write([]byte{0xff, 0xff})
+		ser.Close()
+	}()
+	ev := <-tc.Events
+	assert.Equal(t, Disconnected, ev.State)
+	assert.Equal(t, msg.ENCODING_ERROR, ev.Reason)
+	assert.ErrorIs(t, ev.Err, msg.ENCODING_ERROR)
+	assert.Equal(t, msg.ENCODING_ERROR, tc.DisconnectReason())
+	tc.Close()
+}
+
+func TestClientHello(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	cli, ser := net.Pipe()
+
+	// Fake server, which first rejects and then accepts the client's versions
+	go func() {
+		en := msg.CborTranscoder{}
+		sd := en.NewStreamDecoder(ser)
+		m, err := sd.DecodeNext()
+		assert.Nil(t, err)
+		assert.Equal(t, &msg.HelloRequest{MinVersion: msg.MinVersion, MaxVersion: msg.MaxVersion}, m.HelloReq)
+		rspb, _ := en.Encode(msg.Message{Version: msg.MyVersion, MessageId: m.MessageId, HelloRes: &msg.HelloResponse{Status: msg.VERSION_MISMATCH, MinVersion: 7, MaxVersion: 9}})
+		ser.Write(rspb)
+
+		m, err = sd.DecodeNext()
+		assert.Nil(t, err)
+		rspb, _ = en.Encode(msg.Message{Version: msg.MyVersion, MessageId: m.MessageId, HelloRes: &msg.HelloResponse{Status: msg.SUCCESS, Version: 2, MinVersion: 1, MaxVersion: 9}})
+		ser.Write(rspb)
+
+		// Everything after negotiation uses the agreed version
+		m, err = sd.DecodeNext()
+		assert.Nil(t, err)
+		assert.Equal(t, msg.Version(2), m.Version)
+		rspb, _ = en.Encode(msg.Message{Version: 2, MessageId: m.MessageId, IdRes: &msg.IdentifyResponse{Id: 4}})
+		ser.Write(rspb)
+	}()
+
+	tc := NewClient(cli)
+	assert.Equal(t, msg.MyVersion, tc.Version())
+	_, err := tc.Hello()
+	assert.ErrorIs(t, err, msg.VERSION_MISMATCH)
+	assert.Equal(t, msg.MyVersion, tc.Version())
+
+	v, err := tc.Hello()
+	assert.Nil(t, err)
+	assert.Equal(t, msg.Version(2), v)
+	assert.Equal(t, msg.Version(2), tc.Version())
+	cid, err := tc.GetClientId()
+	assert.Nil(t, err)
+	assert.Equal(t, msg.ClientId(4), cid)
+	tc.Close()
+}
+
+func TestClientAuth(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	cli, ser := net.Pipe()
+
+	// Fake server, which rejects requests until the client authenticates
+	go func() {
+		en := msg.CborTranscoder{}
+		sd := en.NewStreamDecoder(ser)
+		m, err := sd.DecodeNext()
+		assert.Nil(t, err)
+		assert.NotNil(t, m.ListReq)
+		rspb, _ := en.Encode(msg.Message{Version: msg.MyVersion, MessageId: m.MessageId, AuthRes: &msg.AuthResponse{Status: msg.UNAUTHENTICATED}})
+		ser.Write(rspb)
+
+		m, err = sd.DecodeNext()
+		assert.Nil(t, err)
+		assert.Equal(t, &msg.AuthRequest{Credentials: msg.Credentials{Token: "secret"}}, m.AuthReq)
+		rspb, _ = en.Encode(msg.Message{Version: msg.MyVersion, MessageId: m.MessageId, AuthRes: &msg.AuthResponse{Status: msg.SUCCESS}})
+		ser.Write(rspb)
+	}()
+
+	tc := NewClient(cli)
+	_, err := tc.ListOtherClients()
+	assert.ErrorIs(t, err, msg.UNAUTHENTICATED)
+	assert.Nil(t, tc.Authenticate(msg.Credentials{Token: "secret"}))
+	tc.Close()
+}
+
+func TestClientErrorResponse(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	cli, ser := net.Pipe()
+
+	// Fake server, which doesn't understand the request
+	go func() {
+		en := msg.CborTranscoder{}
+		sd := en.NewStreamDecoder(ser)
+		m, err := sd.DecodeNext()
+		assert.Nil(t, err)
+		assert.NotNil(t, m.StatsReq)
+		rspb, _ := en.Encode(msg.Message{Version: msg.MyVersion, MessageId: m.MessageId,
+			Error: &msg.ErrorResponse{Status: msg.UNSUPPORTED, Text: "no supported request in message"}})
+		ser.Write(rspb)
+	}()
+
+	tc := NewClient(cli)
+	_, err := tc.Stats()
+	assert.ErrorIs(t, err, msg.UNSUPPORTED)
+	var se *msg.StatusError
+	if assert.True(t, errors.As(err, &se)) {
+		assert.NotEqual(t, uint32(0), se.MessageId)
+		assert.Equal(t, "no supported request in message", errors.Unwrap(se).Error())
+	}
+	tc.Close()
+}
+
+func TestClientSession(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	cli, ser := net.Pipe()
+
+	// Fake server, which hands out a session and then accepts the client resuming another
+	go func() {
+		en := msg.CborTranscoder{}
+		sd := en.NewStreamDecoder(ser)
+		m, err := sd.DecodeNext()
+		assert.Nil(t, err)
+		assert.NotNil(t, m.IdReq)
+		rspb, _ := en.Encode(msg.Message{Version: msg.MyVersion, MessageId: m.MessageId, IdRes: &msg.IdentifyResponse{Id: 8, Session: "abc"}})
+		ser.Write(rspb)
+
+		m, err = sd.DecodeNext()
+		assert.Nil(t, err)
+		assert.Equal(t, &msg.ResumeRequest{Id: 3, Session: "def"}, m.ResumeReq)
+		rspb, _ = en.Encode(msg.Message{Version: msg.MyVersion, MessageId: m.MessageId, ResumeRes: &msg.ResumeResponse{Status: msg.SUCCESS}})
+		ser.Write(rspb)
+		indb, _ := en.Encode(msg.Message{Version: msg.MyVersion, RelayInd: &msg.RelayIndication{Src: 5, Msg: []byte{1}}})
+		ser.Write(indb)
+	}()
+
+	tc := NewClient(cli)
+	cid, token, err := tc.GetSession()
+	assert.Nil(t, err)
+	assert.Equal(t, msg.ClientId(8), cid)
+	assert.Equal(t, "abc", token)
+	assert.Nil(t, tc.Resume(3, "def"))
+	assert.Equal(t, []byte{1}, (<-tc.Relays).Msg)
 	tc.Close()
 }
 
@@ -203,7 +1397,267 @@ func TestClientIdCloseMid(t *testing.T) {
 		assert.Equal(t, 1, n)
 		tc.Close()
 	}()
-	_, status := tc.GetClientId()
-	assert.Equal(t, msg.CONNECTION_ERROR, status)
+	_, err := tc.GetClientId()
+	assert.ErrorIs(t, err, msg.CONNECTION_ERROR)
 	tc.Close()
 }
+
+func TestClientContextCancel(t *testing.T) {
+	// Test that cancelling the client's context closes it, failing outstanding requests with CANCELLED
+	defer goleak.VerifyNone(t)
+	cli, ser := net.Pipe()
+	defer ser.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tc := NewClientWithContext(ctx, cli)
+	// Goroutine to cancel the context once the request has been received, without answering it
+	go func() {
+		rcbuf := make([]byte, 1)
+		ser.Read(rcbuf)
+		cancel()
+		io.Copy(io.Discard, ser)
+	}()
+	_, err := tc.GetClientId()
+	assert.ErrorIs(t, err, msg.CANCELLED)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// The client disconnects, and its channels are closed
+	for range tc.Events {
+	}
+	assert.Equal(t, Disconnected, tc.State())
+	assert.Equal(t, msg.CANCELLED, tc.DisconnectReason())
+	_, ok := <-tc.Relays
+	assert.False(t, ok)
+	_, err = tc.Subscribe("news")
+	assert.ErrorIs(t, err, msg.CANCELLED)
+	_, err = tc.RelayMessage([]byte{1}, []msg.ClientId{1})
+	assert.ErrorIs(t, err, msg.CANCELLED)
+}
+
+func TestClientNames(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	cli, ser := net.Pipe()
+
+	// Fake server, which has 'alice' already registered as client 7
+	go func() {
+		en := msg.CborTranscoder{}
+		sd := en.NewStreamDecoder(ser)
+		m, err := sd.DecodeNext()
+		assert.Nil(t, err)
+		assert.Equal(t, &msg.SetNameRequest{Name: "alice"}, m.NameReq)
+		rspb, _ := en.Encode(msg.Message{Version: msg.MyVersion, MessageId: m.MessageId, NameRes: &msg.SetNameResponse{Status: msg.NAME_IN_USE}})
+		ser.Write(rspb)
+
+		m, err = sd.DecodeNext()
+		assert.Nil(t, err)
+		assert.Equal(t, &msg.ResolveNameRequest{Name: "alice"}, m.ResolvReq)
+		rspb, _ = en.Encode(msg.Message{Version: msg.MyVersion, MessageId: m.MessageId, ResolvRes: &msg.ResolveNameResponse{Status: msg.SUCCESS, Id: 7}})
+		ser.Write(rspb)
+	}()
+
+	tc := NewClient(cli)
+	assert.ErrorIs(t, tc.SetName("alice"), msg.NAME_IN_USE)
+	cid, err := tc.ResolveName("alice")
+	assert.Nil(t, err)
+	assert.Equal(t, msg.ClientId(7), cid)
+
+	// Invalid names are rejected without contacting the server
+	assert.ErrorIs(t, tc.SetName(strings.Repeat("a", 65)), msg.TOO_LONG)
+	_, err = tc.ResolveName("")
+	assert.ErrorIs(t, err, msg.INVALID_ID)
+	tc.Close()
+}
+
+func TestClientPresence(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	cli, ser := net.Pipe()
+
+	// Fake server, which confirms the subscription and then announces a client leaving
+	go func() {
+		en := msg.CborTranscoder{}
+		sd := en.NewStreamDecoder(ser)
+		m, _ := sd.DecodeNext()
+		assert.NotNil(t, m.PresReq)
+		assert.True(t, m.PresReq.Subscribe)
+		b, _ := en.Encode(msg.Message{Version: msg.MyVersion, MessageId: m.MessageId, PresRes: &msg.PresenceResponse{Status: msg.SUCCESS}})
+		ser.Write(b)
+		b, _ = en.Encode(msg.Message{Version: msg.MyVersion, PresInd: &msg.PresenceIndication{Id: 4, Online: false}})
+		ser.Write(b)
+		ser.Close()
+	}()
+
+	tc := NewClient(cli)
+	assert.Nil(t, tc.SubscribePresence())
+	assert.Equal(t, msg.PresenceIndication{Id: 4, Online: false}, <-tc.Presence)
+	_, ok := <-tc.Presence
+	assert.False(t, ok)
+	tc.Close()
+}
+
+func TestClientRequestTimeout(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	cli, ser := net.Pipe()
+
+	// Fake server, which answers the first ping too late, and each ping after that straight away. Relays are ignored.
+	late := make(chan struct{})
+	go func() {
+		en := msg.CborTranscoder{}
+		sd := en.NewStreamDecoder(ser)
+		for first := true; ; first = false {
+			m, err := sd.DecodeNext()
+			if err != nil {
+				return
+			}
+			if m.PingReq == nil {
+				continue
+			}
+			if first {
+				<-late
+			}
+			b, _ := en.Encode(msg.Message{Version: msg.MyVersion, MessageId: m.MessageId, PingRes: &msg.PingResponse{}})
+			ser.Write(b)
+		}
+	}()
+
+	tc := NewClientWithConfig(cli, ClientConfig{RequestTimeout: 20 * time.Millisecond})
+	start := time.Now()
+	_, err := tc.Ping()
+	assert.ErrorIs(t, err, msg.TIMEOUT)
+	assert.Less(t, time.Since(start), time.Second)
+	close(late)
+
+	// The late response is discarded, and the request isn't left outstanding
+	_, err = tc.Ping()
+	assert.Nil(t, err)
+	tc.mid_map_mutex.Lock()
+	assert.Empty(t, tc.mid_map)
+	tc.mid_map_mutex.Unlock()
+
+	// A relay can wait longer than the configured timeout
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		ser.Close()
+	}()
+	_, _, err = tc.RelayMessageWithOptions([]byte("hi"), []msg.ClientId{2}, RelayOptions{Timeout: time.Second})
+	assert.ErrorIs(t, err, msg.CONNECTION_ERROR)
+	tc.Close()
+}
+
+func TestClientRetry(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	cli, ser := net.Pipe()
+
+	// Fake server, which ignores the first attempt at each request, and answers the second (except for "never")
+	mids := make(chan uint32, 16)
+	go func() {
+		en := msg.CborTranscoder{}
+		sd := en.NewStreamDecoder(ser)
+		seen := map[string]bool{}
+		for {
+			m, err := sd.DecodeNext()
+			if err != nil {
+				return
+			}
+			mids <- m.MessageId
+			rsp := msg.Message{Version: msg.MyVersion, MessageId: m.MessageId}
+			key := "id"
+			switch {
+			case m.IdReq != nil:
+				rsp.IdRes = &msg.IdentifyResponse{Id: 9}
+			case m.RelayReq != nil:
+				key = "relay " + m.RelayReq.MsgUUID
+				rsp.RelayRes = &msg.RelayResponse{Status: msg.SUCCESS}
+			}
+			if !seen[key] || key == "relay never" {
+				seen[key] = true
+				continue
+			}
+			b, _ := en.Encode(rsp)
+			ser.Write(b)
+		}
+	}()
+
+	cfg := DefaultClientConfig()
+	cfg.Retry.Attempts = 3
+	cfg.Retry.AttemptTimeout = 20 * time.Millisecond
+	cfg.Retry.Backoff = time.Millisecond
+	cfg.Retry.Relays = true
+	tc := NewClientWithConfig(cli, cfg)
+
+	// Retries are sent with a new message ID
+	cid, err := tc.GetClientId()
+	assert.Nil(t, err)
+	assert.Equal(t, msg.ClientId(9), cid)
+	assert.NotEqual(t, <-mids, <-mids)
+
+	// Relays are only retried with a MsgUUID
+	_, _, err = tc.RelayMessageWithOptions([]byte("hi"), []msg.ClientId{2}, RelayOptions{MsgUUID: "abc"})
+	assert.Nil(t, err)
+	<-mids
+	<-mids
+	_, _, err = tc.RelayMessageWithOptions([]byte("hi"), []msg.ClientId{2}, RelayOptions{Timeout: 100 * time.Millisecond})
+	assert.ErrorIs(t, err, msg.TIMEOUT)
+	<-mids
+	assert.Empty(t, mids)
+
+	// Retries stop once the caller gives up
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	tc.config.Retry.Attempts = 100
+	_, _, err = tc.RelayMessageWithOptionsCtx(ctx, []byte("hi"), []msg.ClientId{2}, RelayOptions{MsgUUID: "never"})
+	assert.ErrorIs(t, err, msg.TIMEOUT)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	tc.Close()
+}
+
+func TestClientRetryReconnect(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	// Fake servers, the first of which drops the connection when it gets an Identify Request, and the rest answer it
+	var dials int32
+	dial := func() (net.Conn, error) {
+		n := atomic.AddInt32(&dials, 1)
+		cli, ser := net.Pipe()
+		go func() {
+			defer ser.Close()
+			en := msg.CborTranscoder{}
+			sd := en.NewStreamDecoder(ser)
+			for {
+				m, err := sd.DecodeNext()
+				if err != nil || n == 1 {
+					return
+				}
+				b, _ := en.Encode(msg.Message{Version: msg.MyVersion, MessageId: m.MessageId, IdRes: &msg.IdentifyResponse{Id: 9}})
+				ser.Write(b)
+			}
+		}()
+		return cli, nil
+	}
+
+	reconnected := make(chan *Client, 1)
+	cfg := DefaultClientConfig()
+	cfg.Retry.Attempts = 3
+	cfg.Retry.Backoff = time.Millisecond
+	cfg.AutoReconnect = ReconnectPolicy{Enabled: true, OnReconnect: func(c *Client) { reconnected <- c }}
+	seed, _ := net.Pipe()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tc, err := NewClientWithConfig(seed, cfg).ReconnectWith(ctx, dial)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// The request is sent again on the new connection, once the client has reconnected
+	cid, err := tc.GetClientId()
+	assert.Nil(t, err)
+	assert.Equal(t, msg.ClientId(9), cid)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&dials))
+	assert.Equal(t, Disconnected, tc.State())
+	(<-reconnected).Close()
+}
+
+func TestHkdf(t *testing.T) {
+	// RFC 5869 test case 3, with an empty salt and info
+	okm := hkdf(bytes.Repeat([]byte{0x0b}, 22), nil, 42)
+	assert.Equal(t, "8da4e775a563c18f715f802a063c5a31b8a11f5c5ee1879ec3454e5f3c738d2d9d201395faa4b61a96c8", hex.EncodeToString(okm))
+}
@@ -0,0 +1,57 @@
+package client
+
+import (
+	"github.com/CiaranWoodward/broadcast_hub/logging"
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// Compress the message of each outgoing relay request, if it's long enough and the ClientConfig asks for compression.
+// The requests are copied rather than modified, as the caller may still be using them.
+func (c *Client) compressRelay(m *msg.Message) {
+	if m.RelayReq != nil {
+		m.RelayReq = c.compressRequest(m.RelayReq)
+	}
+	if m.RelayBatReq != nil {
+		batch := *m.RelayBatReq
+		batch.Relays = make([]msg.RelayRequest, len(m.RelayBatReq.Relays))
+		for i := range batch.Relays {
+			batch.Relays[i] = *c.compressRequest(&m.RelayBatReq.Relays[i])
+		}
+		m.RelayBatReq = &batch
+	}
+}
+
+// Get a compressed copy of a Relay Request, or the request itself if it isn't worth compressing
+func (c *Client) compressRequest(req *msg.RelayRequest) *msg.RelayRequest {
+	if req.Compression != msg.CompressionNone || c.config.Compression == msg.CompressionNone ||
+		len(req.Msg) < c.config.CompressionThreshold {
+		return req
+	}
+	compressed, err := c.config.Compression.Compress(req.Msg)
+	if err != nil {
+		c.config.Logger.Warn("Failed to compress relay", logging.F("compression", c.config.Compression), logging.F("err", err))
+		return req
+	}
+	if len(compressed) >= len(req.Msg) {
+		return req
+	}
+	copied := *req
+	copied.Msg = compressed
+	copied.Compression = c.config.Compression
+	return &copied
+}
+
+// Decompress the message of an incoming relay indication. Relays that can't be decompressed are delivered as they are,
+// with their Compression still set.
+func (c *Client) decompressRelay(ind *msg.RelayIndication) {
+	if ind.Compression == msg.CompressionNone {
+		return
+	}
+	decompressed, err := ind.Compression.Decompress(ind.Msg)
+	if err != nil {
+		c.config.Logger.Warn("Failed to decompress relay", logging.F("src", ind.Src), logging.F("compression", ind.Compression), logging.F("err", err))
+		return
+	}
+	ind.Msg = decompressed
+	ind.Compression = msg.CompressionNone
+}
@@ -0,0 +1,131 @@
+package client
+
+import (
+	"time"
+
+	"github.com/CiaranWoodward/broadcast_hub/logging"
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+	"github.com/CiaranWoodward/broadcast_hub/tracing"
+	"golang.org/x/net/proxy"
+)
+
+// Default values, used for any ClientConfig fields left as zero
+const (
+	defaultPingMissThreshold = 3
+	defaultRelayHandlers     = 1
+	defaultRelayHandlerQueue = 16
+	defaultMaxOutstanding    = 4096
+	defaultRequestTimeout    = 5 * time.Second
+	// Compressing shorter messages rarely saves enough to be worth it
+	defaultCompressionThreshold = 256
+	defaultRetryAttemptTimeout  = time.Second
+	defaultRetryBackoff         = 100 * time.Millisecond
+	defaultRetryMaxBackoff      = 2 * time.Second
+)
+
+// ClientConfig holds the tunable parameters of a Client.
+// The zero value is valid, and any fields left as zero are replaced with their defaults.
+type ClientConfig struct {
+	// Interval between keepalive pings sent to the server. Zero disables keepalive.
+	PingInterval time.Duration
+	// Number of consecutive ping intervals without hearing anything from the server, before disconnecting as INACTIVE
+	PingMissThreshold int
+	// Message encoding to use with the server. The server detects it automatically.
+	Codec msg.Codec
+	// Number of goroutines calling the 'OnRelay' handler at once. With more than one, relays may be handled out of order.
+	RelayHandlers int
+	// Maximum relays waiting for a free 'OnRelay' handler
+	RelayHandlerQueue int
+	// What to do with relays when every 'OnRelay' handler is busy, and the queue is full
+	RelayHandlerPolicy HandlerPolicy
+	// What to do with incoming relays when the 'Relays' channel, or a topic's channel, is full. The default blocks.
+	RelayOverflowPolicy OverflowPolicy
+	// Gets the client's ID from the server as soon as it's created, so it's available from 'Client.ID' straight away.
+	// 'Dial' and its variants fail if the ID can't be got.
+	IdentifyOnConnect bool
+	// Maximum requests waiting for a response at once, including relays sent with 'RelayMessageAsync'.
+	// Any more fail straight away with BUSY, rather than being sent.
+	MaxOutstanding int
+	// How long requests wait for a response before failing with TIMEOUT, for the methods without a context.
+	// A response that arrives later is discarded.
+	RequestTimeout time.Duration
+	// Where the client's logs are written. Nil discards them.
+	Logger logging.Logger
+	// Records spans around each request sent to the server, and each relay received, with the trace context carried
+	// in the messages so they join the spans recorded by the server. Nil records nothing.
+	Tracer tracing.Tracer
+	// Used by 'Dial' and 'DialTLS' to connect to the server, eg. through a SOCKS5 proxy from 'proxy.SOCKS5' or
+	// 'proxy.FromURL'. Nil connects directly.
+	Dialer proxy.Dialer
+	// Compresses the messages of relays at least CompressionThreshold bytes long, which helps over slow links.
+	// Messages are only sent compressed if that makes them shorter. Compressed relays that are received are always
+	// decompressed before they are delivered, whatever this is set to. The default sends them uncompressed.
+	Compression          msg.Compression
+	CompressionThreshold int
+	// Retries idempotent requests which time out or fail because of the connection. The default never retries.
+	Retry RetryPolicy
+	// Reconnects dialled clients automatically when their connection ends. The default leaves it to 'Reconnect'.
+	AutoReconnect ReconnectPolicy
+	// Turns on flow control, so the server only sends this many relays more than the client has received. The client
+	// grants the server more credits each time it has received half of them, so a client that stops servicing its
+	// relays stops being sent them, and their senders get NO_BUFFER instead. Zero leaves flow control off, unless
+	// the application calls 'GrantCredits' itself.
+	FlowCredits uint32
+}
+
+// Get a ClientConfig with all fields set to their default values
+func DefaultClientConfig() ClientConfig {
+	return ClientConfig{
+		PingMissThreshold:    defaultPingMissThreshold,
+		RelayHandlers:        defaultRelayHandlers,
+		RelayHandlerQueue:    defaultRelayHandlerQueue,
+		MaxOutstanding:       defaultMaxOutstanding,
+		RequestTimeout:       defaultRequestTimeout,
+		Logger:               logging.Discard,
+		Tracer:               tracing.Nop,
+		CompressionThreshold: defaultCompressionThreshold,
+		Retry: RetryPolicy{
+			AttemptTimeout: defaultRetryAttemptTimeout,
+			Backoff:        defaultRetryBackoff,
+			MaxBackoff:     defaultRetryMaxBackoff,
+		},
+	}
+}
+
+// Replace any unset fields with their defaults
+func (cfg ClientConfig) withDefaults() ClientConfig {
+	if cfg.PingMissThreshold <= 0 {
+		cfg.PingMissThreshold = defaultPingMissThreshold
+	}
+	if cfg.RelayHandlers <= 0 {
+		cfg.RelayHandlers = defaultRelayHandlers
+	}
+	if cfg.RelayHandlerQueue <= 0 {
+		cfg.RelayHandlerQueue = defaultRelayHandlerQueue
+	}
+	if cfg.MaxOutstanding <= 0 {
+		cfg.MaxOutstanding = defaultMaxOutstanding
+	}
+	if cfg.RequestTimeout <= 0 {
+		cfg.RequestTimeout = defaultRequestTimeout
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = logging.Discard
+	}
+	if cfg.Tracer == nil {
+		cfg.Tracer = tracing.Nop
+	}
+	if cfg.CompressionThreshold <= 0 {
+		cfg.CompressionThreshold = defaultCompressionThreshold
+	}
+	if cfg.Retry.AttemptTimeout <= 0 {
+		cfg.Retry.AttemptTimeout = defaultRetryAttemptTimeout
+	}
+	if cfg.Retry.Backoff <= 0 {
+		cfg.Retry.Backoff = defaultRetryBackoff
+	}
+	if cfg.Retry.MaxBackoff <= 0 {
+		cfg.Retry.MaxBackoff = defaultRetryMaxBackoff
+	}
+	return cfg
+}
@@ -0,0 +1,361 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// Content types of the relays used for end-to-end encryption
+const (
+	// A relay announcing the sender's X25519 public key
+	KeyAnnounceContentType = "application/x-bhub-key"
+	// A relay encrypted for its destination. Incoming relays keep this content type once decrypted.
+	EncryptedContentType = "application/x-bhub-e2e"
+)
+
+// Errors reported by end-to-end encryption
+var (
+	// No key is known for a peer, so relays can't be encrypted for it. Ask the peer to announce its key.
+	ErrUnknownPeerKey = errors.New("no key known for peer")
+	// A peer announced a different key to the one pinned for it, which may mean the hub is intercepting relays
+	ErrKeyMismatch = errors.New("peer key doesn't match pinned key")
+	// An encrypted relay couldn't be decrypted, or a key announcement couldn't be parsed
+	ErrDecrypt = errors.New("failed to decrypt relay")
+)
+
+// Layout of the relays used for end-to-end encryption.
+// A key announcement is a flags byte followed by the public key. An encrypted relay is a nonce followed by the
+// AES-256-GCM ciphertext, with a key derived from the X25519 shared secret of the two peers.
+const (
+	keyAnnounceReply = 0x01
+	e2eKeySize       = 32
+	e2eNonceSize     = 12
+	e2eOverhead      = e2eNonceSize + 16
+	e2eInfo          = "bhub e2e v1"
+)
+
+// EncryptionConfig holds the settings for end-to-end encryption, for 'EnableEncryption'
+type EncryptionConfig struct {
+	// X25519 key identifying this client to its peers. Nil generates a new key.
+	PrivateKey *ecdh.PrivateKey
+	// Called when a peer announces a key, and no key is pinned for it yet. Returning true pins the key.
+	// Nil trusts every new key the first time it is seen.
+	OnUnknownKey func(peer msg.ClientId, key *ecdh.PublicKey) bool
+	// Called when an incoming relay is rejected, with ErrKeyMismatch or ErrDecrypt
+	OnError func(peer msg.ClientId, err error)
+}
+
+// State of end-to-end encryption, once enabled
+type e2eState struct {
+	config EncryptionConfig
+	// Pinned public keys of peers, and the AEAD derived from each
+	mutex sync.Mutex
+	keys  map[msg.ClientId]*ecdh.PublicKey
+	aeads map[msg.ClientId]cipher.AEAD
+}
+
+// EnableEncryption turns on end-to-end encryption of relays, which the hub can't read.
+//
+// Peers exchange their X25519 public keys with 'AnnounceKey', after which 'RelayEncrypted' can send to them.
+// Once enabled, incoming key announcements are handled by the client instead of being sent to the 'Relays' channel,
+// and incoming encrypted relays are decrypted before they are. Relays that can't be decrypted are dropped.
+//
+// Each peer's key is pinned the first time it is trusted, and later announcements of a different key are rejected.
+// Keys can also be pinned up front with 'PinKey', if they are exchanged some other way.
+func (c *Client) EnableEncryption(cfg EncryptionConfig) (err error) {
+	if cfg.PrivateKey == nil {
+		if cfg.PrivateKey, err = ecdh.X25519().GenerateKey(rand.Reader); err != nil {
+			return
+		}
+	} else if cfg.PrivateKey.Curve() != ecdh.X25519() {
+		return errors.New("end-to-end encryption requires an X25519 key")
+	}
+	c.e2e_mutex.Lock()
+	defer c.e2e_mutex.Unlock()
+	if c.e2e != nil {
+		return errors.New("end-to-end encryption is already enabled")
+	}
+	c.e2e = &e2eState{
+		config: cfg,
+		keys:   make(map[msg.ClientId]*ecdh.PublicKey),
+		aeads:  make(map[msg.ClientId]cipher.AEAD),
+	}
+	return
+}
+
+// PublicKey gets the public key this client announces to its peers, or nil if encryption isn't enabled
+func (c *Client) PublicKey() *ecdh.PublicKey {
+	e := c.getE2E()
+	if e == nil {
+		return nil
+	}
+	return e.config.PrivateKey.PublicKey()
+}
+
+// PinKey sets the key of a peer, replacing any key already pinned for it. Does nothing if encryption isn't enabled.
+func (c *Client) PinKey(peer msg.ClientId, key *ecdh.PublicKey) {
+	if e := c.getE2E(); e != nil {
+		e.pin(peer, key)
+	}
+}
+
+// PeerKey gets the key pinned for a peer, if any
+func (c *Client) PeerKey(peer msg.ClientId) (key *ecdh.PublicKey, ok bool) {
+	e := c.getE2E()
+	if e == nil {
+		return nil, false
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	key, ok = e.keys[peer]
+	return
+}
+
+// AnnounceKey sends this client's public key to the listed peers, or to every other client if the list is empty.
+// Peers with encryption enabled reply with their own key, so after a short while both sides can encrypt for each other.
+// Times out after the RequestTimeout of the ClientConfig (5 seconds by default); use AnnounceKeyCtx for control over cancellation and deadlines.
+func (c *Client) AnnounceKey(clients []msg.ClientId) (relayStatus msg.ClientStatusMap, err error) {
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	return c.AnnounceKeyCtx(ctx, clients)
+}
+
+// AnnounceKeyCtx is AnnounceKey, but waits for the response until the context is done instead of a fixed timeout.
+// Returns a TIMEOUT error if the context deadline expires, or CANCELLED if the context is cancelled.
+func (c *Client) AnnounceKeyCtx(ctx context.Context, clients []msg.ClientId) (relayStatus msg.ClientStatusMap, err error) {
+	e := c.getE2E()
+	if e == nil {
+		err = errors.New("end-to-end encryption isn't enabled")
+		return
+	}
+	if len(clients) > 255 {
+		err = msg.NewStatusError(msg.TOO_LONG, 0, nil)
+		return
+	}
+	req := &msg.RelayRequest{Dest: clients, Msg: e.announcement(keyAnnounceReply), ContentType: KeyAnnounceContentType}
+	if len(clients) == 0 {
+		req.Broadcast = true
+	}
+	return c.relay(ctx, req)
+}
+
+// RelayEncrypted sends a message to other clients, encrypted so that only they can read it.
+// A key must have been pinned for every destination, or an INVALID_ID error wrapping ErrUnknownPeerKey is returned
+// before anything is sent. A separate relay is sent to each destination, and their statuses are combined.
+//
+// Maximum length of the message is 996 bytes, to leave room for the encryption overhead.
+// Maximum length of clients is 255.
+//
+// Times out after the RequestTimeout of the ClientConfig (5 seconds by default); use RelayEncryptedCtx for control over cancellation and deadlines.
+func (c *Client) RelayEncrypted(message []byte, clients []msg.ClientId) (relayStatus msg.ClientStatusMap, err error) {
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	return c.RelayEncryptedCtx(ctx, message, clients)
+}
+
+// RelayEncryptedCtx is RelayEncrypted, but waits for the response until the context is done instead of a fixed timeout.
+// Returns a TIMEOUT error if the context deadline expires, or CANCELLED if the context is cancelled.
+func (c *Client) RelayEncryptedCtx(ctx context.Context, message []byte, clients []msg.ClientId) (relayStatus msg.ClientStatusMap, err error) {
+	// Check protocol parameters
+	if len(message) > 1024-e2eOverhead || len(clients) > 255 {
+		err = msg.NewStatusError(msg.TOO_LONG, 0, nil)
+		return
+	}
+	e := c.getE2E()
+	if e == nil {
+		err = errors.New("end-to-end encryption isn't enabled")
+		return
+	}
+	// Encrypt for everybody first, so nothing is sent if any key is missing
+	sealed := make([][]byte, len(clients))
+	for i, cid := range clients {
+		if sealed[i], err = e.seal(cid, message); err != nil {
+			return
+		}
+	}
+	relayStatus = make(msg.ClientStatusMap)
+	for i, cid := range clients {
+		var csm msg.ClientStatusMap
+		csm, err = c.relay(ctx, &msg.RelayRequest{Dest: []msg.ClientId{cid}, Msg: sealed[i], ContentType: EncryptedContentType})
+		if err != nil {
+			return
+		}
+		for k, v := range csm {
+			relayStatus[k] = v
+		}
+	}
+	return
+}
+
+// Get the end-to-end encryption state, or nil if it isn't enabled
+func (c *Client) getE2E() *e2eState {
+	c.e2e_mutex.Lock()
+	defer c.e2e_mutex.Unlock()
+	return c.e2e
+}
+
+// Handle an incoming relay which may be part of end-to-end encryption, before it is given to the application.
+// Returns false if the relay has been consumed, and shouldn't be given to the application.
+func (c *Client) receiveE2E(ind *msg.RelayIndication) bool {
+	e := c.getE2E()
+	if e == nil {
+		return true
+	}
+	switch ind.ContentType {
+	case KeyAnnounceContentType:
+		if reply := e.receiveKey(ind.Src, ind.Msg); reply {
+			// Reply asynchronously, so the dispatcher never blocks on the transport
+			rsp := c.newMessage()
+			rsp.RelayReq = &msg.RelayRequest{Dest: []msg.ClientId{ind.Src}, Msg: e.announcement(0), ContentType: KeyAnnounceContentType}
+			go c.sendMessage(rsp)
+		}
+		return false
+	case EncryptedContentType:
+		plain, err := e.open(ind.Src, ind.Msg)
+		if err != nil {
+			e.reportError(ind.Src, err)
+			return false
+		}
+		ind.Msg = plain
+	}
+	return true
+}
+
+// Get a key announcement for this client
+func (e *e2eState) announcement(flags byte) []byte {
+	return append([]byte{flags}, e.config.PrivateKey.PublicKey().Bytes()...)
+}
+
+// Handle a key announced by a peer, pinning it if it's trusted.
+// Returns true if the peer asked for a reply, and its key is trusted.
+func (e *e2eState) receiveKey(peer msg.ClientId, announcement []byte) (reply bool) {
+	if len(announcement) != 1+e2eKeySize {
+		e.reportError(peer, ErrDecrypt)
+		return false
+	}
+	key, err := ecdh.X25519().NewPublicKey(announcement[1:])
+	if err != nil {
+		e.reportError(peer, fmt.Errorf("%w: %w", ErrDecrypt, err))
+		return false
+	}
+	e.mutex.Lock()
+	pinned, ok := e.keys[peer]
+	e.mutex.Unlock()
+	if ok && !bytes.Equal(pinned.Bytes(), key.Bytes()) {
+		e.reportError(peer, ErrKeyMismatch)
+		return false
+	}
+	if !ok {
+		if e.config.OnUnknownKey != nil && !e.config.OnUnknownKey(peer, key) {
+			return false
+		}
+		e.pin(peer, key)
+	}
+	return announcement[0]&keyAnnounceReply != 0
+}
+
+// Pin the key of a peer
+func (e *e2eState) pin(peer msg.ClientId, key *ecdh.PublicKey) {
+	e.mutex.Lock()
+	e.keys[peer] = key
+	delete(e.aeads, peer)
+	e.mutex.Unlock()
+}
+
+// Get the AEAD for relays to and from a peer, deriving it from the pinned key if needed
+func (e *e2eState) aead(peer msg.ClientId) (cipher.AEAD, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if aead, ok := e.aeads[peer]; ok {
+		return aead, nil
+	}
+	key, ok := e.keys[peer]
+	if !ok {
+		return nil, msg.NewStatusError(msg.INVALID_ID, 0, fmt.Errorf("%w: client %d", ErrUnknownPeerKey, peer))
+	}
+	shared, err := e.config.PrivateKey.ECDH(key)
+	if err != nil {
+		return nil, err
+	}
+	// Both peers must derive the same key, so the public keys are mixed in in a fixed order
+	mine, theirs := e.config.PrivateKey.PublicKey().Bytes(), key.Bytes()
+	if bytes.Compare(mine, theirs) > 0 {
+		mine, theirs = theirs, mine
+	}
+	info := append(append([]byte(e2eInfo), mine...), theirs...)
+	block, err := aes.NewCipher(hkdf(shared, info, 32))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	e.aeads[peer] = aead
+	return aead, nil
+}
+
+// Encrypt a message for a peer
+func (e *e2eState) seal(peer msg.ClientId, plain []byte) ([]byte, error) {
+	aead, err := e.aead(peer)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, e2eNonceSize, e2eNonceSize+len(plain)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, nil), nil
+}
+
+// Decrypt a message from a peer
+func (e *e2eState) open(peer msg.ClientId, sealed []byte) ([]byte, error) {
+	aead, err := e.aead(peer)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDecrypt, err)
+	}
+	if len(sealed) < e2eNonceSize {
+		return nil, ErrDecrypt
+	}
+	plain, err := aead.Open(nil, sealed[:e2eNonceSize], sealed[e2eNonceSize:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDecrypt, err)
+	}
+	return plain, nil
+}
+
+// Call the OnError callback, if set
+func (e *e2eState) reportError(peer msg.ClientId, err error) {
+	if e.config.OnError != nil {
+		e.config.OnError(peer, err)
+	}
+}
+
+// Derive a key of 'length' bytes from a shared secret with HKDF-SHA256 (RFC 5869), using an empty salt
+func hkdf(secret, info []byte, length int) []byte {
+	extract := hmac.New(sha256.New, make([]byte, sha256.Size))
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+
+	var out, block []byte
+	for counter := byte(1); len(out) < length; counter++ {
+		expand := hmac.New(sha256.New, prk)
+		expand.Write(block)
+		expand.Write(info)
+		expand.Write([]byte{counter})
+		block = expand.Sum(nil)
+		out = append(out, block...)
+	}
+	return out[:length]
+}
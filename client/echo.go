@@ -0,0 +1,98 @@
+package client
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// EchoResponder answers every relay a client receives with a relay back to its sender, so tests and demos can stand up
+// peers which respond to them without writing the goroutines themselves.
+type EchoResponder struct {
+	client *Client
+	format func(ind msg.RelayIndication) []byte
+	// Replies still being sent
+	replies sync.WaitGroup
+	// Closed once the client has disconnected, and every reply has been sent
+	done chan struct{}
+	// First error sending a reply
+	err       error
+	err_mutex sync.Mutex
+}
+
+// NewEchoResponder starts answering the relays received by the client. Each relay is answered with the message that
+// 'format' makes from it, or not at all if that is nil. A nil 'format' echoes each message back unchanged.
+//
+// The responder reads the client's 'Relays' channel, so the application must not read it too. It stops once the client
+// is closed or disconnected, or the responder is closed.
+func NewEchoResponder(c *Client, format func(ind msg.RelayIndication) []byte) *EchoResponder {
+	if format == nil {
+		format = func(ind msg.RelayIndication) []byte { return ind.Msg }
+	}
+	r := &EchoResponder{
+		client: c,
+		format: format,
+		done:   make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+// Answer relays until the client is closed
+func (r *EchoResponder) run() {
+	for ind := range r.client.Relays {
+		reply := r.format(ind)
+		if reply == nil {
+			continue
+		}
+		// Replies are sent concurrently, so a slow reply doesn't hold up the next relay
+		r.replies.Add(1)
+		go func(src msg.ClientId) {
+			defer r.replies.Done()
+			csm, err := r.client.RelayMessage(reply, []msg.ClientId{src})
+			if err == nil && csm[src] != msg.SUCCESS {
+				err = fmt.Errorf("reply to %d failed: %w", src, csm[src])
+			}
+			if err != nil {
+				r.setErr(err)
+			}
+		}(ind.Src)
+	}
+	r.replies.Wait()
+	close(r.done)
+}
+
+// Keep the first error sending a reply
+func (r *EchoResponder) setErr(err error) {
+	r.err_mutex.Lock()
+	if r.err == nil {
+		r.err = err
+	}
+	r.err_mutex.Unlock()
+}
+
+// Client gets the client the responder is answering relays for
+func (r *EchoResponder) Client() *Client {
+	return r.client
+}
+
+// Err gets the first error sending a reply, or nil if every reply so far has been relayed successfully
+func (r *EchoResponder) Err() error {
+	r.err_mutex.Lock()
+	defer r.err_mutex.Unlock()
+	return r.err
+}
+
+// Done gets a channel which is closed once the responder has stopped, after the client is closed or disconnected
+func (r *EchoResponder) Done() <-chan struct{} {
+	return r.done
+}
+
+// Close closes the client, and waits for the replies being sent to finish. Returns the first error sending a reply,
+// as with 'Err'.
+func (r *EchoResponder) Close() error {
+	r.client.Close()
+	<-r.done
+	return r.Err()
+}
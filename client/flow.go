@@ -0,0 +1,30 @@
+package client
+
+import (
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// GrantCredits allows the server to send the client that many more relays, with a Flow Update.
+// The first grant turns on flow control for the connection: from then on, the server only sends relays while the
+// client has credits left, and answers their senders with NO_BUFFER otherwise. There is no response.
+//
+// Clients with FlowCredits set in their ClientConfig grant credits automatically, so don't need to call this.
+func (c *Client) GrantCredits(credits uint32) error {
+	m := c.newMessage()
+	m.FlowUpd = &msg.FlowUpdate{Credits: credits}
+	return c.sendMessage(m)
+}
+
+// Count a relay received by the dispatcher, and grant the server more credits once half the window has been used.
+// Granted asynchronously, so the dispatcher never blocks on the transport.
+func (c *Client) replenishCredits() {
+	window := c.config.FlowCredits
+	if window == 0 {
+		return
+	}
+	c.flow_received++
+	if c.flow_received >= (window+1)/2 {
+		go c.GrantCredits(c.flow_received)
+		c.flow_received = 0
+	}
+}
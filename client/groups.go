@@ -0,0 +1,192 @@
+package client
+
+import (
+	"context"
+
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// Maximum length of a group name, in bytes
+const maxGroupLength = 255
+
+// CreateGroup creates a new named group on the server, and joins it.
+// Relays sent to the group with 'RelayToGroup' go to every other member, until the last member leaves or disconnects.
+// Returns a NAME_IN_USE error if the group already exists.
+// Times out after the RequestTimeout of the ClientConfig (5 seconds by default); use CreateGroupCtx for control over cancellation and deadlines.
+func (c *Client) CreateGroup(group string) (err error) {
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	return c.CreateGroupCtx(ctx, group)
+}
+
+// CreateGroupCtx is CreateGroup, but waits for the response until the context is done instead of a fixed timeout.
+// Returns a TIMEOUT error if the context deadline expires, or CANCELLED if the context is cancelled.
+func (c *Client) CreateGroupCtx(ctx context.Context, group string) (err error) {
+	if err = checkGroup(group); err != nil {
+		return
+	}
+	req := c.newMessage()
+	req.GrpCreateReq = &msg.GroupCreateRequest{Group: group}
+
+	rsp, err := c.transact(ctx, req)
+	if err != nil {
+		return
+	}
+	if rsp.GrpCreateRes == nil {
+		return errMissingResponse(req)
+	}
+	return msg.NewStatusError(rsp.GrpCreateRes.Status, req.MessageId, nil)
+}
+
+// JoinGroup joins a group created by another client, to receive relays sent to it.
+// Returns an INVALID_ID error if the group doesn't exist.
+// Times out after the RequestTimeout of the ClientConfig (5 seconds by default); use JoinGroupCtx for control over cancellation and deadlines.
+func (c *Client) JoinGroup(group string) (err error) {
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	return c.JoinGroupCtx(ctx, group)
+}
+
+// JoinGroupCtx is JoinGroup, but waits for the response until the context is done instead of a fixed timeout.
+// Returns a TIMEOUT error if the context deadline expires, or CANCELLED if the context is cancelled.
+func (c *Client) JoinGroupCtx(ctx context.Context, group string) (err error) {
+	if err = checkGroup(group); err != nil {
+		return
+	}
+	req := c.newMessage()
+	req.GrpJoinReq = &msg.GroupJoinRequest{Group: group}
+
+	rsp, err := c.transact(ctx, req)
+	if err != nil {
+		return
+	}
+	if rsp.GrpJoinRes == nil {
+		return errMissingResponse(req)
+	}
+	return msg.NewStatusError(rsp.GrpJoinRes.Status, req.MessageId, nil)
+}
+
+// LeaveGroup leaves a group. The server removes the group once its last member leaves.
+// Returns an INVALID_ID error if the client isn't a member of the group.
+// Times out after the RequestTimeout of the ClientConfig (5 seconds by default); use LeaveGroupCtx for control over cancellation and deadlines.
+func (c *Client) LeaveGroup(group string) (err error) {
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	return c.LeaveGroupCtx(ctx, group)
+}
+
+// LeaveGroupCtx is LeaveGroup, but waits for the response until the context is done instead of a fixed timeout.
+// Returns a TIMEOUT error if the context deadline expires, or CANCELLED if the context is cancelled.
+func (c *Client) LeaveGroupCtx(ctx context.Context, group string) (err error) {
+	if err = checkGroup(group); err != nil {
+		return
+	}
+	req := c.newMessage()
+	req.GrpLeaveReq = &msg.GroupLeaveRequest{Group: group}
+
+	rsp, err := c.transact(ctx, req)
+	if err != nil {
+		return
+	}
+	if rsp.GrpLeaveRes == nil {
+		return errMissingResponse(req)
+	}
+	return msg.NewStatusError(rsp.GrpLeaveRes.Status, req.MessageId, nil)
+}
+
+// ListGroups gets the names of every group on the server, in sorted order.
+// Times out after the RequestTimeout of the ClientConfig (5 seconds by default); use ListGroupsCtx for control over cancellation and deadlines.
+func (c *Client) ListGroups() (groups []string, err error) {
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	return c.ListGroupsCtx(ctx)
+}
+
+// ListGroupsCtx is ListGroups, but waits for the response until the context is done instead of a fixed timeout.
+// Returns a TIMEOUT error if the context deadline expires, or CANCELLED if the context is cancelled.
+func (c *Client) ListGroupsCtx(ctx context.Context) (groups []string, err error) {
+	rsp, err := c.listGroup(ctx, "")
+	if err != nil {
+		return
+	}
+	return rsp.Groups, nil
+}
+
+// ListGroupMembers gets the IDs of every member of a group, including this client if it is a member.
+// Returns an INVALID_ID error if the group doesn't exist.
+// Times out after the RequestTimeout of the ClientConfig (5 seconds by default); use ListGroupMembersCtx for control over cancellation and deadlines.
+func (c *Client) ListGroupMembers(group string) (members []msg.ClientId, err error) {
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	return c.ListGroupMembersCtx(ctx, group)
+}
+
+// ListGroupMembersCtx is ListGroupMembers, but waits for the response until the context is done instead of a fixed timeout.
+// Returns a TIMEOUT error if the context deadline expires, or CANCELLED if the context is cancelled.
+func (c *Client) ListGroupMembersCtx(ctx context.Context, group string) (members []msg.ClientId, err error) {
+	if err = checkGroup(group); err != nil {
+		return
+	}
+	rsp, err := c.listGroup(ctx, group)
+	if err != nil {
+		return
+	}
+	return rsp.Members, nil
+}
+
+// RelayToGroup sends a message to be relayed to every other member of a group.
+// The sender does not need to be a member of the group itself.
+// To relay to several groups, or to groups and individual clients, use 'RelayMessageWithOptions' with DestGroups.
+//
+// Maximum length of the message is 1024 bytes.
+// Maximum length of the group is 255 bytes.
+//
+// The returned clientStatusMap is only valid if err is nil
+// The returned clientStatusMap does not include the client IDs of successfully relayed messages - they are omitted for efficiency
+// Times out after the RequestTimeout of the ClientConfig (5 seconds by default); use RelayToGroupCtx for control over cancellation and deadlines.
+func (c *Client) RelayToGroup(group string, message []byte) (relayStatus msg.ClientStatusMap, err error) {
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	return c.RelayToGroupCtx(ctx, group, message)
+}
+
+// RelayToGroupCtx is RelayToGroup, but waits for the response until the context is done instead of a fixed timeout.
+// Returns a TIMEOUT error if the context deadline expires, or CANCELLED if the context is cancelled.
+func (c *Client) RelayToGroupCtx(ctx context.Context, group string, message []byte) (relayStatus msg.ClientStatusMap, err error) {
+	// Check protocol parameters
+	if err = checkGroup(group); err != nil {
+		return
+	}
+	if len(message) > 1024 {
+		err = msg.NewStatusError(msg.TOO_LONG, 0, nil)
+		return
+	}
+	return c.relay(ctx, &msg.RelayRequest{Msg: message, DestGroups: []string{group}})
+}
+
+// Send a group list request, and wait for the response
+func (c *Client) listGroup(ctx context.Context, group string) (list *msg.GroupListResponse, err error) {
+	req := c.newMessage()
+	req.GrpListReq = &msg.GroupListRequest{Group: group}
+
+	rsp, err := c.transact(ctx, req)
+	if err != nil {
+		return
+	}
+	if rsp.GrpListRes == nil {
+		err = errMissingResponse(req)
+		return
+	}
+	return rsp.GrpListRes, msg.NewStatusError(rsp.GrpListRes.Status, req.MessageId, nil)
+}
+
+// Check that a group name is valid for use in the protocol
+func checkGroup(group string) error {
+	if group == "" {
+		return msg.NewStatusError(msg.INVALID_ID, 0, nil)
+	}
+	if len(group) > maxGroupLength {
+		return msg.NewStatusError(msg.TOO_LONG, 0, nil)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package client
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// HandlerPolicy determines what happens to an incoming relay when every OnRelay handler is busy, and the queue is full
+type HandlerPolicy int
+
+const (
+	// Wait for room in the queue. Relays then back up into the 'Relays' channel, and once that is full,
+	// ClientConfig.RelayOverflowPolicy decides what happens to them.
+	HandlerPark HandlerPolicy = iota
+	// Drop the relay, counting it in 'DroppedRelays', so the handlers never hold up anything else
+	HandlerDrop
+)
+
+// State of the OnRelay handler, once one has been registered
+type relayHandler struct {
+	// Current handler, which can be replaced while relays are being handled
+	handler      func(msg.RelayIndication)
+	handler_lock sync.RWMutex
+	// Relays waiting for one of the handler goroutines
+	queue chan msg.RelayIndication
+}
+
+// OnRelay registers a function to be called with each relay received on the 'Relays' channel, as an alternative to
+// reading the channel. Relays are read from the channel by an internal goroutine, and passed to the handler by up to
+// ClientConfig.RelayHandlers goroutines at once. If they are all busy, up to ClientConfig.RelayHandlerQueue relays
+// wait for them, then ClientConfig.RelayHandlerPolicy decides whether to wait or drop the relay.
+//
+// Calling OnRelay again replaces the handler. Relays for subscribed topics still go to the topic's channel,
+// and the application must not read the 'Relays' channel itself once a handler is registered.
+func (c *Client) OnRelay(handler func(msg.RelayIndication)) {
+	c.relay_handler_once.Do(func() {
+		c.relay_handler = &relayHandler{queue: make(chan msg.RelayIndication, c.config.RelayHandlerQueue)}
+		c.startRelayHandlers()
+	})
+	c.relay_handler.handler_lock.Lock()
+	c.relay_handler.handler = handler
+	c.relay_handler.handler_lock.Unlock()
+}
+
+// DroppedRelays gets the number of relays dropped because the application didn't keep up with them: either the OnRelay
+// handlers were busy with the HandlerDrop policy, or a relay channel was full with ClientConfig.RelayOverflowPolicy.
+func (c *Client) DroppedRelays() uint64 {
+	return atomic.LoadUint64(&c.dropped_relays)
+}
+
+// Start the goroutines moving relays from the 'Relays' channel to the handler, until the client is closed
+func (c *Client) startRelayHandlers() {
+	rh := c.relay_handler
+	go func() {
+		defer close(rh.queue)
+		for ind := range c.Relays {
+			if c.config.RelayHandlerPolicy == HandlerPark {
+				rh.queue <- ind
+				continue
+			}
+			select {
+			case rh.queue <- ind:
+			default:
+				atomic.AddUint64(&c.dropped_relays, 1)
+			}
+		}
+	}()
+	for i := 0; i < c.config.RelayHandlers; i++ {
+		go func() {
+			for ind := range rh.queue {
+				rh.handler_lock.RLock()
+				handler := rh.handler
+				rh.handler_lock.RUnlock()
+				handler(ind)
+			}
+		}()
+	}
+}
+
+func (p HandlerPolicy) String() string {
+	switch p {
+	case HandlerPark:
+		return "park"
+	case HandlerDrop:
+		return "drop"
+	default:
+		return fmt.Sprintf("[Unknown HandlerPolicy: %d]", int(p))
+	}
+}
@@ -0,0 +1,57 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// HistoryOptions selects recent relays to fetch with 'History'
+type HistoryOptions struct {
+	// Topic to get the relays of. Empty gets the relays sent directly to this client (or its resumed session).
+	Topic string
+	// Maximum number of relays to get, keeping the newest. Zero gets every relay the server has kept.
+	Limit uint32
+	// Only get relays the server received after this time, such as the Time of the last relay seen before
+	// reconnecting. The zero time gets every relay the server has kept.
+	Since time.Time
+}
+
+// History gets recent relays from the server's history, oldest first, so a client that briefly disconnected can catch
+// up with what it missed. Relays from the history aren't delivered to the 'Relays' channel.
+// Returns a FORBIDDEN error if the server doesn't keep a history.
+// Times out after the RequestTimeout of the ClientConfig (5 seconds by default); use HistoryCtx for control over cancellation and deadlines.
+func (c *Client) History(opts HistoryOptions) (relays []msg.RelayIndication, err error) {
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	return c.HistoryCtx(ctx, opts)
+}
+
+// HistoryCtx is History, but waits for the response until the context is done instead of a fixed timeout.
+// Returns a TIMEOUT error if the context deadline expires, or CANCELLED if the context is cancelled.
+func (c *Client) HistoryCtx(ctx context.Context, opts HistoryOptions) (relays []msg.RelayIndication, err error) {
+	if opts.Topic != "" {
+		if err = checkTopic(opts.Topic); err != nil {
+			return
+		}
+	}
+	req := c.newMessage()
+	req.HistReq = &msg.HistoryRequest{Topic: opts.Topic, Limit: opts.Limit}
+	if !opts.Since.IsZero() {
+		req.HistReq.Since = msg.TimestampOf(opts.Since)
+	}
+
+	rsp, err := c.transact(ctx, req)
+	if err != nil {
+		return
+	}
+	if rsp.HistRes == nil {
+		err = errMissingResponse(req)
+		return
+	}
+	if err = msg.NewStatusError(rsp.HistRes.Status, req.MessageId, nil); err != nil {
+		return
+	}
+	return rsp.HistRes.Relays, nil
+}
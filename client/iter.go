@@ -0,0 +1,66 @@
+//go:build go1.23
+
+package client
+
+import (
+	"context"
+	"iter"
+
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// Number of clients fetched in each page by ListOtherClientsIter
+const iterPageSize = 500
+
+// ListOtherClientsIter gets an iterator over the other clients connected to the server. It fetches them a page at a
+// time with 'ListOtherClientsPage' as the loop goes, so they never all need to be held at once:
+//
+//	clients, errf := c.ListOtherClientsIter()
+//	for cid := range clients {
+//		...
+//	}
+//	if err := errf(); err != nil {
+//		...
+//	}
+//
+// The loop ends early if a page can't be fetched, and the returned function then gives the error (or nil otherwise).
+// As with ListOtherClientsPage, clients connecting or disconnecting during the loop may be skipped or listed twice.
+// Each page times out after the RequestTimeout of the ClientConfig (5 seconds by default); use ListOtherClientsIterCtx for control over cancellation and deadlines.
+func (c *Client) ListOtherClientsIter() (clients iter.Seq[msg.ClientId], errf func() error) {
+	return listIter(func(opts ListOptions) (ClientPage, error) {
+		return c.ListOtherClientsPage(opts)
+	})
+}
+
+// ListOtherClientsIterCtx is ListOtherClientsIter, but fetches every page until the context is done instead of with a fixed timeout.
+// The error is TIMEOUT if the context deadline expires, or CANCELLED if the context is cancelled.
+func (c *Client) ListOtherClientsIterCtx(ctx context.Context) (clients iter.Seq[msg.ClientId], errf func() error) {
+	return listIter(func(opts ListOptions) (ClientPage, error) {
+		return c.ListOtherClientsPageCtx(ctx, opts)
+	})
+}
+
+// Iterate over the pages got from 'fetch', recording the error which stopped the iteration, if any
+func listIter(fetch func(opts ListOptions) (ClientPage, error)) (iter.Seq[msg.ClientId], func() error) {
+	var err error
+	clients := func(yield func(msg.ClientId) bool) {
+		err = nil
+		opts := ListOptions{Limit: iterPageSize}
+		for {
+			var page ClientPage
+			if page, err = fetch(opts); err != nil {
+				return
+			}
+			for _, cid := range page.Ids {
+				if !yield(cid) {
+					return
+				}
+			}
+			if page.Next == 0 {
+				return
+			}
+			opts.Offset = page.Next
+		}
+	}
+	return clients, func() error { return err }
+}
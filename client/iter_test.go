@@ -0,0 +1,65 @@
+//go:build go1.23
+
+package client
+
+import (
+	"net"
+	"testing"
+
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+)
+
+func TestClientListIter(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	cli, ser := net.Pipe()
+
+	// Fake server, with clients 1 to 3 in pages of two (whatever the limit), then failing the third listing
+	go func() {
+		en := msg.CborTranscoder{}
+		sd := en.NewStreamDecoder(ser)
+		pages := []struct {
+			offset uint32
+			rsp    msg.ListResponse
+		}{
+			{0, msg.ListResponse{Others: []msg.ClientId{1, 2}, Next: 3}},
+			{3, msg.ListResponse{Others: []msg.ClientId{3}}},
+			{0, msg.ListResponse{Others: []msg.ClientId{1, 2}, Next: 3}},
+			{0, msg.ListResponse{Status: msg.FORBIDDEN}},
+		}
+		for _, p := range pages {
+			m, err := sd.DecodeNext()
+			assert.Nil(t, err)
+			assert.Equal(t, uint32(iterPageSize), m.ListReq.Limit)
+			assert.Equal(t, p.offset, m.ListReq.Offset)
+			rsp := p.rsp
+			rspb, _ := en.Encode(msg.Message{Version: msg.MyVersion, MessageId: m.MessageId, ListRes: &rsp})
+			ser.Write(rspb)
+		}
+	}()
+
+	tc := NewClient(cli)
+	clients, errf := tc.ListOtherClientsIter()
+	var cids []msg.ClientId
+	for cid := range clients {
+		cids = append(cids, cid)
+	}
+	assert.Nil(t, errf())
+	assert.Equal(t, []msg.ClientId{1, 2, 3}, cids)
+
+	// Stopping part way through a page doesn't fetch the next one
+	for cid := range clients {
+		assert.Equal(t, msg.ClientId(1), cid)
+		break
+	}
+	assert.Nil(t, errf())
+
+	cids = nil
+	for cid := range clients {
+		cids = append(cids, cid)
+	}
+	assert.ErrorIs(t, errf(), msg.FORBIDDEN)
+	assert.Nil(t, cids)
+	tc.Close()
+}
@@ -0,0 +1,88 @@
+package client
+
+import (
+	"sync"
+	"time"
+)
+
+// LatencyStats summarise the round trip times to the server, measured by 'Ping' and by keepalive pings
+type LatencyStats struct {
+	// Number of round trips measured. The other fields are zero until there has been at least one.
+	Samples uint64
+	// Most recent round trip time
+	Last time.Duration
+	// Moving average of the round trip time, weighted towards recent samples, as TCP estimates it (RFC 6298)
+	Smoothed time.Duration
+	// Moving average of how far each round trip time is from Smoothed, showing how much the latency varies
+	Variation time.Duration
+	// Shortest and longest round trip times measured
+	Min time.Duration
+	Max time.Duration
+}
+
+// Keeps the rolling estimate of the round trip time to the server
+type latencyEstimator struct {
+	mutex sync.Mutex
+	stats LatencyStats
+	// Message ID and send time of the latest keepalive ping, until it's answered
+	keepalive_mid  uint32
+	keepalive_sent time.Time
+}
+
+// Add a measured round trip time to the estimate
+func (e *latencyEstimator) record(rtt time.Duration) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	s := &e.stats
+	if s.Samples == 0 {
+		s.Smoothed = rtt
+		s.Variation = rtt / 2
+		s.Min = rtt
+		s.Max = rtt
+	} else {
+		diff := s.Smoothed - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		s.Variation = (3*s.Variation + diff) / 4
+		s.Smoothed = (7*s.Smoothed + rtt) / 8
+		s.Min = min(s.Min, rtt)
+		s.Max = max(s.Max, rtt)
+	}
+	s.Last = rtt
+	s.Samples++
+}
+
+// Note that a keepalive ping was sent, so its response can be timed
+func (e *latencyEstimator) keepaliveSent(mid uint32, now time.Time) {
+	e.mutex.Lock()
+	e.keepalive_mid = mid
+	e.keepalive_sent = now
+	e.mutex.Unlock()
+}
+
+// Time the response to a ping, if it's for the latest keepalive ping
+func (e *latencyEstimator) pingAnswered(mid uint32, now time.Time) {
+	e.mutex.Lock()
+	if e.keepalive_sent.IsZero() || mid != e.keepalive_mid {
+		e.mutex.Unlock()
+		return
+	}
+	rtt := now.Sub(e.keepalive_sent)
+	e.keepalive_sent = time.Time{}
+	e.mutex.Unlock()
+	e.record(rtt)
+}
+
+// Get the current estimate
+func (e *latencyEstimator) get() LatencyStats {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.stats
+}
+
+// Latency gets the round trip times to the server measured so far, by 'Ping' and by keepalive pings (if the
+// ClientConfig has a PingInterval). Unlike 'Stats', it doesn't ask the server anything.
+func (c *Client) Latency() LatencyStats {
+	return c.latency.get()
+}
@@ -0,0 +1,63 @@
+package client
+
+import (
+	"errors"
+
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+var (
+	// A request was refused because MaxOutstanding requests are already waiting for a response. Matches BUSY.
+	ErrTooManyOutstanding = errors.New("too many outstanding requests")
+	// A request was refused because its message ID still belongs to an earlier request waiting for a response.
+	// Only possible if the message ID counter wraps all the way round while that request is outstanding.
+	ErrMessageIdInUse = errors.New("message ID still in use")
+)
+
+// Get the next message ID from the counter, skipping zero (which means no message ID) and any IDs still waiting for a
+// response, so a long-running client never confuses the response to a new request with one to a request from before
+// the counter wrapped. Only to be called with mid_map_mutex held.
+func (c *Client) nextMid() uint32 {
+	for {
+		c.mid++
+		if c.mid != 0 && !c.midOutstanding(c.mid) {
+			return c.mid
+		}
+	}
+}
+
+// Check whether a message ID belongs to a request waiting for a response, or to a relay in a batch that is.
+// Only to be called with mid_map_mutex held.
+func (c *Client) midOutstanding(mid uint32) bool {
+	_, waiting := c.mid_map[mid]
+	_, async := c.async_map[mid]
+	_, batched := c.batch_mids[mid]
+	return waiting || async || batched
+}
+
+// Check whether another request can wait for a response with the message ID, with an error saying why not.
+// Only to be called with mid_map_mutex held.
+func (c *Client) checkMid(mid uint32) error {
+	if c.midOutstanding(mid) {
+		return msg.NewStatusError(msg.BUSY, mid, ErrMessageIdInUse)
+	}
+	if len(c.mid_map)+len(c.async_map) >= c.config.MaxOutstanding {
+		return msg.NewStatusError(msg.BUSY, mid, ErrTooManyOutstanding)
+	}
+	return nil
+}
+
+// Outstanding gets the number of requests waiting for a response from the server
+func (c *Client) Outstanding() int {
+	c.mid_map_mutex.Lock()
+	defer c.mid_map_mutex.Unlock()
+	return len(c.mid_map) + len(c.async_map)
+}
+
+// SetNextMessageId sets the message ID given to the next message sent by the client, as long as it isn't in use.
+// It's intended for tests, to exercise the message ID counter wrapping without sending billions of requests first.
+func (c *Client) SetNextMessageId(mid uint32) {
+	c.mid_map_mutex.Lock()
+	c.mid = mid - 1
+	c.mid_map_mutex.Unlock()
+}
@@ -0,0 +1,134 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+
+	"github.com/CiaranWoodward/broadcast_hub/logging"
+)
+
+// DialPolicy chooses which of several servers 'DialMulti' connects to
+type DialPolicy int
+
+const (
+	// Try the servers in the order given, so the first one that's up is always used, and the others are only for when
+	// it's down. A server that refuses the client (eg. because it's draining) is skipped by the next attempt.
+	DialFailover DialPolicy = iota
+	// Start each connection, including each 'Reconnect', with the server after the one last connected to, spreading
+	// clients across the servers. The first connection starts with a random server.
+	DialRoundRobin
+)
+
+func (p DialPolicy) String() string {
+	switch p {
+	case DialFailover:
+		return "failover"
+	case DialRoundRobin:
+		return "round-robin"
+	default:
+		return fmt.Sprintf("[Unknown DialPolicy: %d]", int(p))
+	}
+}
+
+// ParseDialPolicy gets the DialPolicy with the given name, as returned by 'DialPolicy.String'
+func ParseDialPolicy(name string) (p DialPolicy, ok bool) {
+	for _, p := range []DialPolicy{DialFailover, DialRoundRobin} {
+		if p.String() == name {
+			return p, true
+		}
+	}
+	return DialFailover, false
+}
+
+// ErrNoAddresses is returned by 'DialMulti' when it isn't given any addresses
+var ErrNoAddresses = errors.New("no server addresses to dial")
+
+// Dials one of several servers, following a DialPolicy
+type multiDialer struct {
+	addrs  []string
+	policy DialPolicy
+	dial1  func(address string) (net.Conn, error)
+	logger logging.Logger
+	// Index of the address to try first, and of the address last connected to
+	mutex sync.Mutex
+	next  int
+	last  int
+}
+
+// Connect to the first server that accepts the connection, starting with the one chosen by the policy.
+// Fails with the error from each server if none of them accept it.
+func (md *multiDialer) dial() (net.Conn, error) {
+	md.mutex.Lock()
+	start := md.next
+	md.mutex.Unlock()
+	errs := make([]error, 0, len(md.addrs))
+	for n := 0; n < len(md.addrs); n++ {
+		i := (start + n) % len(md.addrs)
+		con, err := md.dial1(md.addrs[i])
+		if err != nil {
+			md.logger.Warn("Failed to connect to server", logging.F("addr", md.addrs[i]), logging.F("err", err))
+			errs = append(errs, err)
+			continue
+		}
+		md.mutex.Lock()
+		md.last = i
+		if md.policy == DialRoundRobin {
+			md.next = (i + 1) % len(md.addrs)
+		} else {
+			md.next = 0
+		}
+		md.mutex.Unlock()
+		return con, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+// Record that the server last connected to refused the client, so the next attempt starts with the one after it
+func (md *multiDialer) failed() {
+	md.mutex.Lock()
+	md.next = (md.last + 1) % len(md.addrs)
+	md.mutex.Unlock()
+}
+
+// DialMulti connects to one of several broadcast_hub servers at the given TCP addresses (host:port), such as instances
+// sharing a Backplane, and creates a new client using the connection. 'policy' chooses which server is tried first,
+// and the others are tried in turn if it can't be reached. 'Reconnect' follows the same policy, so the client can
+// survive any one server going down.
+//
+// With IdentifyOnConnect, a server that accepts the connection but refuses the client (eg. because it's full or
+// draining) is passed over for the next one too. Fails if every server was tried without success.
+func DialMulti(addrs []string, policy DialPolicy, cfg ClientConfig) (*Client, error) {
+	if len(addrs) == 0 {
+		return nil, ErrNoAddresses
+	}
+	cfg = cfg.withDefaults()
+	md := &multiDialer{
+		addrs:  append([]string(nil), addrs...),
+		policy: policy,
+		logger: cfg.Logger,
+		dial1: func(address string) (net.Conn, error) {
+			return cfg.dial("tcp", address)
+		},
+	}
+	if policy == DialRoundRobin {
+		md.next = rand.Intn(len(addrs))
+	}
+	var err error
+	for range addrs {
+		var con net.Conn
+		if con, err = md.dial(); err != nil {
+			return nil, err
+		}
+		var c *Client
+		if c, err = newDialedClient(context.Background(), con, cfg); err == nil {
+			c.setRedial(md.dial, md.failed)
+			return c, nil
+		}
+		md.failed()
+	}
+	return nil, err
+}
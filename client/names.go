@@ -0,0 +1,77 @@
+package client
+
+import (
+	"context"
+
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// Maximum length of a client name, in bytes
+const maxNameLength = 64
+
+// SetName registers a human-readable name for this client with the server, so other clients can find it
+// with ResolveName. Names are unique; a NAME_IN_USE error is returned if another client already holds the name.
+// Setting a new name releases the previous one, and an empty name clears it.
+// The name is released automatically when the client disconnects.
+//
+// Maximum length of the name is 64 bytes.
+// Times out after the RequestTimeout of the ClientConfig (5 seconds by default); use SetNameCtx for control over cancellation and deadlines.
+func (c *Client) SetName(name string) (err error) {
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	return c.SetNameCtx(ctx, name)
+}
+
+// SetNameCtx is SetName, but waits for the response until the context is done instead of a fixed timeout.
+// Returns a TIMEOUT error if the context deadline expires, or CANCELLED if the context is cancelled.
+func (c *Client) SetNameCtx(ctx context.Context, name string) (err error) {
+	if len(name) > maxNameLength {
+		return msg.NewStatusError(msg.TOO_LONG, 0, nil)
+	}
+
+	// Form the message
+	req := c.newMessage()
+	req.NameReq = &msg.SetNameRequest{Name: name}
+
+	rsp, err := c.transact(ctx, req)
+	if err != nil {
+		return
+	}
+	if rsp.NameRes == nil {
+		return errMissingResponse(req)
+	}
+	return msg.NewStatusError(rsp.NameRes.Status, req.MessageId, nil)
+}
+
+// ResolveName looks up the ClientId of the client that registered 'name'.
+// Returns an INVALID_ID error if no connected client has that name.
+// Times out after the RequestTimeout of the ClientConfig (5 seconds by default); use ResolveNameCtx for control over cancellation and deadlines.
+func (c *Client) ResolveName(name string) (clientid msg.ClientId, err error) {
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	return c.ResolveNameCtx(ctx, name)
+}
+
+// ResolveNameCtx is ResolveName, but waits for the response until the context is done instead of a fixed timeout.
+// Returns a TIMEOUT error if the context deadline expires, or CANCELLED if the context is cancelled.
+func (c *Client) ResolveNameCtx(ctx context.Context, name string) (clientid msg.ClientId, err error) {
+	if name == "" {
+		return 0, msg.NewStatusError(msg.INVALID_ID, 0, nil)
+	}
+	if len(name) > maxNameLength {
+		return 0, msg.NewStatusError(msg.TOO_LONG, 0, nil)
+	}
+
+	// Form the message
+	req := c.newMessage()
+	req.ResolvReq = &msg.ResolveNameRequest{Name: name}
+
+	rsp, err := c.transact(ctx, req)
+	if err != nil {
+		return 0, err
+	}
+	if rsp.ResolvRes == nil {
+		return 0, errMissingResponse(req)
+	}
+	return rsp.ResolvRes.Id, msg.NewStatusError(rsp.ResolvRes.Status, req.MessageId, nil)
+}
@@ -0,0 +1,69 @@
+package client
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// OverflowPolicy determines what happens to an incoming relay when the channel it's received on is full, because the
+// application isn't keeping up with it
+type OverflowPolicy int
+
+const (
+	// Wait for room in the channel. Nothing else is received from the server in the meantime, including responses,
+	// so requests may time out until the application catches up.
+	OverflowBlock OverflowPolicy = iota
+	// Drop the incoming relay, counting it in 'DroppedRelays'
+	OverflowDropNewest
+	// Discard the oldest relay in the channel to make room for the incoming one, counting it in 'DroppedRelays'
+	OverflowDropOldest
+)
+
+// Deliver an incoming relay to one of the application's channels, following ClientConfig.RelayOverflowPolicy.
+// Blocking stops early if 'done' is closed, which may be nil.
+func (c *Client) deliverRelay(relays chan msg.RelayIndication, ind msg.RelayIndication, done <-chan struct{}) {
+	select {
+	case relays <- ind:
+		return
+	default:
+	}
+
+	switch c.config.RelayOverflowPolicy {
+	case OverflowDropNewest:
+		atomic.AddUint64(&c.dropped_relays, 1)
+	case OverflowDropOldest:
+		// The application may be draining the channel concurrently, so only discard a relay if there still isn't room
+		for {
+			select {
+			case relays <- ind:
+				return
+			default:
+			}
+			select {
+			case <-relays:
+				atomic.AddUint64(&c.dropped_relays, 1)
+			default:
+			}
+		}
+	default:
+		select {
+		case relays <- ind:
+		case <-done:
+		}
+	}
+}
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowBlock:
+		return "block"
+	case OverflowDropNewest:
+		return "drop-newest"
+	case OverflowDropOldest:
+		return "drop-oldest"
+	default:
+		return fmt.Sprintf("[Unknown OverflowPolicy: %d]", int(p))
+	}
+}
@@ -0,0 +1,62 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// Content types of relays sent with 'RelayString' and 'RelayJSON'
+const (
+	TextContentType = "text/plain; charset=utf-8"
+	JSONContentType = "application/json"
+)
+
+// RelayString is RelayMessage for a text message, which is sent with the TextContentType.
+// Destinations can get the text back with 'RelayIndication.Text'.
+//
+// Maximum length of the message is 1024 bytes.
+// Times out after the RequestTimeout of the ClientConfig (5 seconds by default); use RelayStringCtx for control over cancellation and deadlines.
+func (c *Client) RelayString(s string, clients []msg.ClientId) (relayStatus msg.ClientStatusMap, err error) {
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	return c.RelayStringCtx(ctx, s, clients)
+}
+
+// RelayStringCtx is RelayString, but waits for the response until the context is done instead of a fixed timeout.
+// Returns a TIMEOUT error if the context deadline expires, or CANCELLED if the context is cancelled.
+func (c *Client) RelayStringCtx(ctx context.Context, s string, clients []msg.ClientId) (relayStatus msg.ClientStatusMap, err error) {
+	return c.relayPayload(ctx, []byte(s), clients, TextContentType)
+}
+
+// RelayJSON is RelayMessage for a value marshalled to JSON with 'json.Marshal', which is sent with the JSONContentType.
+// Destinations can unmarshal it with 'RelayIndication.DecodeJSON'.
+// Returns an ENCODING_ERROR wrapping the marshalling error if the value can't be marshalled.
+//
+// Maximum length of the marshalled message is 1024 bytes.
+// Times out after the RequestTimeout of the ClientConfig (5 seconds by default); use RelayJSONCtx for control over cancellation and deadlines.
+func (c *Client) RelayJSON(v any, clients []msg.ClientId) (relayStatus msg.ClientStatusMap, err error) {
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	return c.RelayJSONCtx(ctx, v, clients)
+}
+
+// RelayJSONCtx is RelayJSON, but waits for the response until the context is done instead of a fixed timeout.
+// Returns a TIMEOUT error if the context deadline expires, or CANCELLED if the context is cancelled.
+func (c *Client) RelayJSONCtx(ctx context.Context, v any, clients []msg.ClientId) (relayStatus msg.ClientStatusMap, err error) {
+	message, err := json.Marshal(v)
+	if err != nil {
+		return nil, msg.NewStatusError(msg.ENCODING_ERROR, 0, err)
+	}
+	return c.relayPayload(ctx, message, clients, JSONContentType)
+}
+
+// Relay a message with the content type describing it
+func (c *Client) relayPayload(ctx context.Context, message []byte, clients []msg.ClientId, contentType string) (relayStatus msg.ClientStatusMap, err error) {
+	opts := RelayOptions{ContentType: contentType}
+	if err = checkRelay(message, clients, opts); err != nil {
+		return
+	}
+	return c.relay(ctx, relayRequest(message, clients, opts))
+}
@@ -0,0 +1,56 @@
+package client
+
+import (
+	"context"
+
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// SubscribePresence asks the server to send a presence indication to the 'Presence' channel whenever another client
+// connects or disconnects, so the application can keep track of who is connected without polling 'ListOtherClients'.
+// To build a complete roster, subscribe first and then list the clients already connected.
+//
+// Presence indications are best effort, and are dropped by the server if the client isn't keeping up.
+// Times out after the RequestTimeout of the ClientConfig (5 seconds by default); use SubscribePresenceCtx for control over cancellation and deadlines.
+func (c *Client) SubscribePresence() (err error) {
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	return c.SubscribePresenceCtx(ctx)
+}
+
+// SubscribePresenceCtx is SubscribePresence, but waits for the response until the context is done instead of a fixed timeout.
+// Returns a TIMEOUT error if the context deadline expires, or CANCELLED if the context is cancelled.
+func (c *Client) SubscribePresenceCtx(ctx context.Context) (err error) {
+	return c.presence(ctx, true)
+}
+
+// UnsubscribePresence stops the server sending presence indications.
+// Indications that were already in flight will still be delivered to the 'Presence' channel.
+// Times out after the RequestTimeout of the ClientConfig (5 seconds by default); use UnsubscribePresenceCtx for control over cancellation and deadlines.
+func (c *Client) UnsubscribePresence() (err error) {
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	return c.UnsubscribePresenceCtx(ctx)
+}
+
+// UnsubscribePresenceCtx is UnsubscribePresence, but waits for the response until the context is done instead of a fixed timeout.
+// Returns a TIMEOUT error if the context deadline expires, or CANCELLED if the context is cancelled.
+func (c *Client) UnsubscribePresenceCtx(ctx context.Context) (err error) {
+	return c.presence(ctx, false)
+}
+
+// Send a presence request, and wait for the response
+func (c *Client) presence(ctx context.Context, subscribe bool) (err error) {
+	// Form the message
+	req := c.newMessage()
+	req.PresReq = &msg.PresenceRequest{Subscribe: subscribe}
+
+	rsp, err := c.transact(ctx, req)
+	if err != nil {
+		return
+	}
+	if rsp.PresRes == nil {
+		return errMissingResponse(req)
+	}
+	return msg.NewStatusError(rsp.PresRes.Status, req.MessageId, nil)
+}
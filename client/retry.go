@@ -0,0 +1,104 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/CiaranWoodward/broadcast_hub/logging"
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// RetryPolicy retries idempotent requests which fail with TIMEOUT or CONNECTION_ERROR, so transient problems don't
+// have to be handled by every caller. Identify and List Requests are retried, and so are relays with a MsgUUID if
+// 'Relays' is set, since the server recognises a repeated MsgUUID and doesn't deliver the relay twice. Relays which
+// request acknowledgement aren't retried, as their RelayId depends on which attempt the server received.
+//
+// Each attempt waits up to 'AttemptTimeout' for its response, and all of the attempts together are still limited by
+// the context (or the RequestTimeout, for the methods without one).
+//
+// When the connection ends, a client with the ReconnectPolicy enabled waits for the new client to connect (within the
+// context, or the RequestTimeout) and sends the remaining attempts on that instead. Otherwise, CONNECTION_ERROR is only
+// retried while the client is still connected, and once the connection has ended, requests fail straight away.
+type RetryPolicy struct {
+	// Maximum attempts at each request, including the first. Zero or one never retries.
+	Attempts int
+	// How long each attempt waits for a response, before it is retried
+	AttemptTimeout time.Duration
+	// Wait before the first retry, which doubles for each retry after that, up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Also retry relays which have a MsgUUID
+	Relays bool
+}
+
+// Send a request, retrying it following the RetryPolicy if it fails with TIMEOUT or CONNECTION_ERROR.
+// Each retry is sent with a new message ID, which is left in 'req'.
+func (c *Client) transactRetry(ctx context.Context, req *msg.Message) (rsp msg.Message, err error) {
+	policy := c.config.Retry
+	if policy.Attempts <= 1 {
+		return c.transact(ctx, *req)
+	}
+	backoff := policy.Backoff
+	// Client the request is sent on, which moves on to the new client if the connection ends and is reconnected
+	cl := c
+	for attempt := 1; ; attempt++ {
+		attempt_ctx, cancel := context.WithTimeout(ctx, policy.AttemptTimeout)
+		rsp, err = cl.transact(attempt_ctx, *req)
+		cancel()
+		if err == nil || attempt >= policy.Attempts || ctx.Err() != nil || !cl.retryable(err) {
+			if ctx.Err() != nil && errors.Is(err, msg.TIMEOUT) {
+				// Report the caller's own context ending, rather than the last attempt's
+				err = contextError(ctx, req.MessageId)
+			}
+			return
+		}
+		c.config.Logger.Debug("Retrying request", logging.F("mid", req.MessageId), logging.F("err", err),
+			logging.F("attempt", attempt), logging.F("backoff", backoff))
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return rsp, contextError(ctx, req.MessageId)
+		}
+		backoff *= 2
+		if backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+		if msg.StatusOf(err) == msg.CONNECTION_ERROR && cl.reconnected != nil {
+			// The connection has ended (or is about to), so wait for the new one
+			next := cl.successor(ctx)
+			if next == nil {
+				if ctx.Err() != nil {
+					err = contextError(ctx, req.MessageId)
+				}
+				return
+			}
+			c.config.Logger.Debug("Retrying request on reconnected client", logging.F("mid", req.MessageId))
+			cl = next
+		}
+		req.MessageId = cl.newMessage().MessageId
+	}
+}
+
+// Check whether the client's connection has ended
+func (c *Client) isDisconnected() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Check whether a failed request is worth retrying
+func (c *Client) retryable(err error) bool {
+	switch msg.StatusOf(err) {
+	case msg.TIMEOUT:
+		return true
+	case msg.CONNECTION_ERROR:
+		// Once the connection has ended, every retry would fail too, unless it's sent on a new connection
+		return !c.isDisconnected() || c.reconnected != nil
+	default:
+		return false
+	}
+}
@@ -0,0 +1,245 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/CiaranWoodward/broadcast_hub/logging"
+
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// GetSession gets the ID of this client, along with the token needed to resume the session with 'Resume'
+// after reconnecting. The token is empty if the server doesn't store messages for disconnected clients.
+// Times out after the RequestTimeout of the ClientConfig (5 seconds by default); use GetSessionCtx for control over cancellation and deadlines.
+func (c *Client) GetSession() (clientid msg.ClientId, token string, err error) {
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	return c.GetSessionCtx(ctx)
+}
+
+// GetSessionCtx is GetSession, but waits for the response until the context is done instead of a fixed timeout.
+// Returns a TIMEOUT error if the context deadline expires, or CANCELLED if the context is cancelled.
+func (c *Client) GetSessionCtx(ctx context.Context) (clientid msg.ClientId, token string, err error) {
+	// Form the message
+	req := c.newMessage()
+	req.IdReq = &msg.IdentifyRequest{}
+
+	rsp, err := c.transact(ctx, req)
+	if err != nil {
+		return 0, "", err
+	}
+	if rsp.IdRes == nil {
+		return 0, "", errMissingResponse(req)
+	}
+	c.setID(rsp.IdRes.Id)
+	c.setSession(rsp.IdRes.Session)
+	return rsp.IdRes.Id, rsp.IdRes.Session, nil
+}
+
+// Resume reclaims the ClientId of a previous connection, using the token from 'GetSession'.
+// Relays sent to the client while it was disconnected are then delivered to the 'Relays' channel.
+// The client's current ClientId, topic subscriptions and name are abandoned, so this is best done straight after connecting.
+//
+// Returns an INVALID_ID error if the session doesn't exist, is still connected, or has expired.
+// Times out after the RequestTimeout of the ClientConfig (5 seconds by default); use ResumeCtx for control over cancellation and deadlines.
+func (c *Client) Resume(clientid msg.ClientId, token string) (err error) {
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	return c.ResumeCtx(ctx, clientid, token)
+}
+
+// ResumeCtx is Resume, but waits for the response until the context is done instead of a fixed timeout.
+// Returns a TIMEOUT error if the context deadline expires, or CANCELLED if the context is cancelled.
+func (c *Client) ResumeCtx(ctx context.Context, clientid msg.ClientId, token string) (err error) {
+	// Form the message
+	req := c.newMessage()
+	req.ResumeReq = &msg.ResumeRequest{Id: clientid, Session: token}
+
+	rsp, err := c.transact(ctx, req)
+	if err != nil {
+		return
+	}
+	if rsp.ResumeRes == nil {
+		return errMissingResponse(req)
+	}
+	if rsp.ResumeRes.Status == msg.SUCCESS {
+		c.setID(clientid)
+		c.setSession(token)
+	}
+	return msg.NewStatusError(rsp.ResumeRes.Status, req.MessageId, nil)
+}
+
+// Remember the token needed to resume the client's session, for 'Reconnect'
+func (c *Client) setSession(token string) {
+	c.session_mutex.Lock()
+	c.session = token
+	c.session_mutex.Unlock()
+}
+
+// Get the token needed to resume the client's session, or "" if it isn't known
+func (c *Client) sessionToken() string {
+	c.session_mutex.Lock()
+	defer c.session_mutex.Unlock()
+	return c.session
+}
+
+// Backoff between attempts to reconnect, which doubles after each failure up to the maximum
+const (
+	reconnectMinBackoff = 100 * time.Millisecond
+	reconnectMaxBackoff = 5 * time.Second
+)
+
+// ErrCannotRedial is returned by 'Reconnect' for clients that weren't created by 'Dial', 'DialUnix', 'DialPipe',
+// 'DialTLS' or 'DialMulti'
+var ErrCannotRedial = errors.New("client wasn't dialled, so can't redial")
+
+// Reconnect connects a new client to the same server as this one, which must have been created by 'Dial', 'DialUnix',
+// 'DialPipe' or 'DialTLS', using the same configuration. See 'ReconnectWith'. A client created by 'DialMulti' connects
+// to one of its servers, following its DialPolicy. To reconnect automatically whenever the connection ends, see
+// 'ReconnectPolicy'.
+func (c *Client) Reconnect(ctx context.Context) (*Client, error) {
+	if c.redial == nil {
+		return nil, ErrCannotRedial
+	}
+	return c.reconnectWith(ctx, c.redial, c.redial_failed)
+}
+
+// ReconnectWith closes this client, if it is still connected, and creates a new client with the same configuration
+// over a connection from 'dial'. Failed attempts are retried with an increasing backoff until the context is done.
+//
+// If this client's session token is known (from 'GetSession', 'GetClientId' or 'Resume'), the new client resumes the
+// session automatically, taking over this client's ID and receiving the relays sent to it while it was disconnected.
+// A session that has expired or can't be resumed isn't retried; the new client just keeps the ID it was given.
+//
+// Returns a TIMEOUT error if the context deadline expires, or CANCELLED if the context is cancelled.
+func (c *Client) ReconnectWith(ctx context.Context, dial func() (net.Conn, error)) (*Client, error) {
+	return c.reconnectWith(ctx, dial, nil)
+}
+
+// As 'ReconnectWith', calling 'failed' (if it's set) whenever a connection from 'dial' is made but can't be used
+func (c *Client) reconnectWith(ctx context.Context, dial func() (net.Conn, error), failed func()) (*Client, error) {
+	c.Close()
+	backoff := reconnectMinBackoff
+	for {
+		nc, err := c.reconnect(ctx, dial, failed)
+		if err == nil {
+			return nc, nil
+		}
+		c.config.Logger.Warn("Failed to reconnect", logging.F("err", err), logging.F("backoff", backoff))
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, contextError(ctx, 0)
+		}
+		backoff *= 2
+		if backoff > reconnectMaxBackoff {
+			backoff = reconnectMaxBackoff
+		}
+	}
+}
+
+// Make a single attempt to connect a new client, and resume this client's session on it
+func (c *Client) reconnect(ctx context.Context, dial func() (net.Conn, error), failed func()) (*Client, error) {
+	con, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	nc, err := newDialedClient(c.ctx, con, c.config)
+	if err != nil {
+		if failed != nil {
+			failed()
+		}
+		return nil, err
+	}
+	cid, token := c.ID(), c.sessionToken()
+	if token != "" {
+		err = nc.ResumeCtx(ctx, cid, token)
+		if errors.Is(err, msg.INVALID_ID) {
+			c.config.Logger.Warn("Session couldn't be resumed", logging.F("session", cid))
+		} else if err != nil {
+			nc.Close()
+			if failed != nil {
+				failed()
+			}
+			return nil, err
+		} else {
+			c.config.Logger.Info("Resumed session", logging.F("session", cid))
+		}
+	}
+	nc.setRedial(dial, failed)
+	return nc, nil
+}
+
+// ReconnectPolicy reconnects a client automatically once its connection ends, unless it was ended by 'Close' or the
+// client's context. Only clients created by 'Dial', 'DialUnix', 'DialPipe', 'DialTLS', 'DialMulti' or 'Reconnect' can
+// reconnect, as the others don't know how to.
+//
+// The new client is made by 'Reconnect', so it resumes the session, and has the same configuration, including this
+// policy. A client is bound to its connection, so the old one stays Disconnected, and the application should switch
+// over to the new one when it's given to OnReconnect. Requests on the old client that are being retried by the
+// RetryPolicy when the connection ends are sent again on the new one.
+type ReconnectPolicy struct {
+	// Turns automatic reconnection on
+	Enabled bool
+	// How long to keep trying to reconnect before giving up. Zero keeps trying until the client's context is done.
+	Timeout time.Duration
+	// Called with the new client once it has connected, and resumed the session if it could
+	OnReconnect func(c *Client)
+}
+
+// Remember how to dial the client's server again, for 'Reconnect', and start watching for the connection to end if the
+// client should then reconnect automatically
+func (c *Client) setRedial(dial func() (net.Conn, error), failed func()) {
+	c.redial = dial
+	c.redial_failed = failed
+	if c.config.AutoReconnect.Enabled {
+		c.reconnected = make(chan struct{})
+		go c.autoReconnect()
+	}
+}
+
+// Reconnect once the connection ends, following the ReconnectPolicy
+func (c *Client) autoReconnect() {
+	<-c.done
+	if c.DisconnectReason() == msg.CANCELLED {
+		// Closed on purpose, so there's nothing to reconnect for
+		close(c.reconnected)
+		return
+	}
+	policy := c.config.AutoReconnect
+	ctx := c.ctx
+	if policy.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, policy.Timeout)
+		defer cancel()
+	}
+	c.config.Logger.Info("Reconnecting automatically", logging.F("reason", c.DisconnectReason()))
+	nc, err := c.Reconnect(ctx)
+	if err != nil {
+		c.config.Logger.Warn("Gave up reconnecting", logging.F("err", err))
+		close(c.reconnected)
+		return
+	}
+	c.next = nc
+	close(c.reconnected)
+	if policy.OnReconnect != nil {
+		policy.OnReconnect(nc)
+	}
+}
+
+// Wait for the client which automatically replaced this one once its connection ended. Returns nil if the client
+// doesn't reconnect automatically, gave up reconnecting, or the context is done first.
+func (c *Client) successor(ctx context.Context) *Client {
+	if c.reconnected == nil {
+		return nil
+	}
+	select {
+	case <-c.reconnected:
+		return c.next
+	case <-ctx.Done():
+		return nil
+	}
+}
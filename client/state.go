@@ -0,0 +1,68 @@
+package client
+
+import (
+	"fmt"
+
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// State of a client's connection to the server. It only ever moves forwards, from Connected to Disconnected.
+type State int32
+
+const (
+	// Connected to the server, as far as the client knows
+	Connected State = iota
+	// 'Close' has been called, and the connection is being closed
+	Closing
+	// The connection has ended, and the client can't be used any more
+	Disconnected
+)
+
+func (s State) String() string {
+	switch s {
+	case Connected:
+		return "Connected"
+	case Closing:
+		return "Closing"
+	case Disconnected:
+		return "Disconnected"
+	default:
+		return fmt.Sprintf("[Unknown State: %d]", int(s))
+	}
+}
+
+// StateEvent is sent on the client's Events channel whenever its State changes
+type StateEvent struct {
+	// New state of the client
+	State State
+	// Why the state changed, as reported by 'DisconnectReason'. CANCELLED if 'Close' was called.
+	Reason msg.Status
+	// Error which ended the connection, if any. This is io.EOF if the server closed the connection, a *msg.DecodeError
+	// if the server sent something that couldn't be decoded, or the error from the transport.
+	Err error
+}
+
+// Number of state changes that can happen to a client, so the Events channel never fills
+const maxStateEvents = 2
+
+// State gets the current state of the client's connection
+func (c *Client) State() State {
+	c.state_mutex.Lock()
+	defer c.state_mutex.Unlock()
+	return c.state
+}
+
+// Move the client on to a new state, announcing it on the Events channel.
+// Does nothing if the client has already reached that state (or a later one).
+func (c *Client) setState(state State, reason msg.Status, err error) {
+	c.state_mutex.Lock()
+	defer c.state_mutex.Unlock()
+	if state <= c.state {
+		return
+	}
+	c.state = state
+	c.Events <- StateEvent{State: state, Reason: reason, Err: err}
+	if state == Disconnected {
+		close(c.Events)
+	}
+}
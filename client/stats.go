@@ -0,0 +1,62 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// HubStats are statistics about the hub, and this client's connection to it
+type HubStats struct {
+	// Number of clients connected to the hub, including this one
+	Clients int
+	// How long the hub has been running
+	Uptime time.Duration
+	// Relay requests the hub has handled per second from clients in this one's namespace, averaged over the last few seconds
+	RelayRate float64
+	// Bytes the hub has received from this client, and sent to it
+	BytesReceived uint64
+	BytesSent     uint64
+	// Relays the hub has discarded for a destination because their TTL elapsed before they could be sent, from any client
+	RelaysExpired uint64
+	// Round trip times to the hub measured by this client, as from 'Latency'
+	Latency LatencyStats
+}
+
+// Stats gets statistics about the hub, and this client's connection to it.
+// Returns a FORBIDDEN error if the hub only shares them with admin clients, and this client hasn't authenticated as one.
+// Times out after the RequestTimeout of the ClientConfig (5 seconds by default); use StatsCtx for control over cancellation and deadlines.
+func (c *Client) Stats() (stats HubStats, err error) {
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	return c.StatsCtx(ctx)
+}
+
+// StatsCtx is Stats, but waits for the response until the context is done instead of a fixed timeout.
+// Returns a TIMEOUT error if the context deadline expires, or CANCELLED if the context is cancelled.
+func (c *Client) StatsCtx(ctx context.Context) (stats HubStats, err error) {
+	req := c.newMessage()
+	req.StatsReq = &msg.StatsRequest{}
+
+	rsp, err := c.transact(ctx, req)
+	if err != nil {
+		return
+	}
+	if rsp.StatsRes == nil {
+		err = errMissingResponse(req)
+		return
+	}
+	if err = msg.NewStatusError(rsp.StatsRes.Status, req.MessageId, nil); err != nil {
+		return
+	}
+	return HubStats{
+		Clients:       int(rsp.StatsRes.Clients),
+		Uptime:        time.Duration(rsp.StatsRes.Uptime) * time.Millisecond,
+		RelayRate:     rsp.StatsRes.RelayRate,
+		BytesReceived: rsp.StatsRes.BytesReceived,
+		BytesSent:     rsp.StatsRes.BytesSent,
+		RelaysExpired: rsp.StatsRes.RelaysExpired,
+		Latency:       c.Latency(),
+	}, nil
+}
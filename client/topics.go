@@ -0,0 +1,207 @@
+package client
+
+import (
+	"context"
+	"sync"
+
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// Maximum length of a topic name, in bytes
+const maxTopicLength = 255
+
+// Client-side state of a single topic subscription
+type topicSubscription struct {
+	// Channel to receive relay indications published to the topic
+	relays chan msg.RelayIndication
+	// Closed when the subscription is removed, to unblock the dispatcher
+	done chan struct{}
+	// Tracks the dispatcher sending into 'relays', so it can be closed safely
+	senders sync.WaitGroup
+}
+
+// Subscribe subscribes the client to a topic on the server.
+// Returns a channel that will receive all relays published to the topic by other clients.
+//
+// As with the 'Relays' channel, the application should continually process items in the returned channel.
+// The channel is closed when the client is unsubscribed from the topic, or the connection is closed.
+// Subscribing to a topic that is already subscribed returns the existing channel.
+// Times out after the RequestTimeout of the ClientConfig (5 seconds by default); use SubscribeCtx for control over cancellation and deadlines.
+func (c *Client) Subscribe(topic string) (relays <-chan msg.RelayIndication, err error) {
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	return c.SubscribeCtx(ctx, topic)
+}
+
+// SubscribeCtx is Subscribe, but waits for the response until the context is done instead of a fixed timeout.
+// Returns a TIMEOUT error if the context deadline expires, or CANCELLED if the context is cancelled.
+func (c *Client) SubscribeCtx(ctx context.Context, topic string) (relays <-chan msg.RelayIndication, err error) {
+	if err = checkTopic(topic); err != nil {
+		return
+	}
+
+	// Register the channel before subscribing, so no early relays are missed
+	c.topic_map_mutex.Lock()
+	if c.topic_map_closed {
+		c.topic_map_mutex.Unlock()
+		err = c.connectionError(0, nil)
+		return
+	}
+	sub, existing := c.topic_map[topic]
+	if !existing {
+		sub = &topicSubscription{
+			relays: make(chan msg.RelayIndication, internalMessageBufferSize),
+			done:   make(chan struct{}),
+		}
+		c.topic_map[topic] = sub
+	}
+	c.topic_map_mutex.Unlock()
+
+	// Form the message
+	req := c.newMessage()
+	req.SubReq = &msg.SubscribeRequest{Topic: topic}
+
+	rsp, err := c.transact(ctx, req)
+	if err == nil {
+		if rsp.SubRes == nil {
+			err = errMissingResponse(req)
+		} else {
+			err = msg.NewStatusError(rsp.SubRes.Status, req.MessageId, nil)
+		}
+	}
+	if err != nil {
+		if !existing {
+			c.removeTopicChannel(topic, sub)
+		}
+		return
+	}
+	return sub.relays, nil
+}
+
+// Unsubscribe unsubscribes the client from a topic on the server, and closes the topic's relay channel.
+// Relays for the topic that were already in flight will be delivered to the 'Relays' channel instead.
+// Times out after the RequestTimeout of the ClientConfig (5 seconds by default); use UnsubscribeCtx for control over cancellation and deadlines.
+func (c *Client) Unsubscribe(topic string) (err error) {
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	return c.UnsubscribeCtx(ctx, topic)
+}
+
+// UnsubscribeCtx is Unsubscribe, but waits for the response until the context is done instead of a fixed timeout.
+// Returns a TIMEOUT error if the context deadline expires, or CANCELLED if the context is cancelled.
+func (c *Client) UnsubscribeCtx(ctx context.Context, topic string) (err error) {
+	if err = checkTopic(topic); err != nil {
+		return
+	}
+
+	// Form the message
+	req := c.newMessage()
+	req.UnsubReq = &msg.UnsubscribeRequest{Topic: topic}
+
+	rsp, err := c.transact(ctx, req)
+	if err != nil {
+		return
+	}
+	if rsp.UnsubRes == nil {
+		return errMissingResponse(req)
+	}
+	if rsp.UnsubRes.Status == msg.SUCCESS {
+		c.topic_map_mutex.Lock()
+		sub, ok := c.topic_map[topic]
+		c.topic_map_mutex.Unlock()
+		if ok {
+			c.removeTopicChannel(topic, sub)
+		}
+	}
+	return msg.NewStatusError(rsp.UnsubRes.Status, req.MessageId, nil)
+}
+
+// PublishMessage sends a message to be relayed to every other client subscribed to the topic.
+// The publisher does not need to be subscribed to the topic itself.
+//
+// Maximum length of the message is 1024 bytes.
+// Maximum length of the topic is 255 bytes.
+//
+// The returned clientStatusMap is only valid if err is nil
+// The returned clientStatusMap does not include the client IDs of successfully relayed messages - they are omitted for efficiency
+// Times out after the RequestTimeout of the ClientConfig (5 seconds by default); use PublishMessageCtx for control over cancellation and deadlines.
+func (c *Client) PublishMessage(topic string, message []byte) (relayStatus msg.ClientStatusMap, err error) {
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	return c.PublishMessageCtx(ctx, topic, message)
+}
+
+// PublishMessageCtx is PublishMessage, but waits for the response until the context is done instead of a fixed timeout.
+// Returns a TIMEOUT error if the context deadline expires, or CANCELLED if the context is cancelled.
+func (c *Client) PublishMessageCtx(ctx context.Context, topic string, message []byte) (relayStatus msg.ClientStatusMap, err error) {
+	// Check protocol parameters
+	if err = checkTopic(topic); err != nil {
+		return
+	}
+	if len(message) > 1024 {
+		err = msg.NewStatusError(msg.TOO_LONG, 0, nil)
+		return
+	}
+	return c.relay(ctx, &msg.RelayRequest{Msg: message, Topic: topic})
+}
+
+// Check that a topic name is valid for use in the protocol
+func checkTopic(topic string) error {
+	if topic == "" {
+		return msg.NewStatusError(msg.INVALID_ID, 0, nil)
+	}
+	if len(topic) > maxTopicLength {
+		return msg.NewStatusError(msg.TOO_LONG, 0, nil)
+	}
+	return nil
+}
+
+// Remove a topic subscription and close its channel, if it hasn't already been removed
+func (c *Client) removeTopicChannel(topic string, sub *topicSubscription) {
+	c.topic_map_mutex.Lock()
+	if c.topic_map[topic] != sub {
+		c.topic_map_mutex.Unlock()
+		return
+	}
+	delete(c.topic_map, topic)
+	close(sub.done)
+	c.topic_map_mutex.Unlock()
+
+	// Wait for the dispatcher to finish with the channel before closing it
+	sub.senders.Wait()
+	close(sub.relays)
+}
+
+// Only to be called by dispatcher
+// Returns false if the indication is not for a subscribed topic
+func (c *Client) sendToTopicChannel(ind msg.RelayIndication) bool {
+	if ind.Topic == "" {
+		return false
+	}
+	c.topic_map_mutex.Lock()
+	sub, ok := c.topic_map[ind.Topic]
+	if ok {
+		sub.senders.Add(1)
+	}
+	c.topic_map_mutex.Unlock()
+	if !ok {
+		return false
+	}
+
+	// This WILL block if the application isn't servicing the channel with OverflowBlock, unless it unsubscribes
+	c.deliverRelay(sub.relays, ind, sub.done)
+	sub.senders.Done()
+	return true
+}
+
+// Only to be called by dispatcher
+func (c *Client) closeAllTopicChannels() {
+	c.topic_map_mutex.Lock()
+	c.topic_map_closed = true
+	for topic, sub := range c.topic_map {
+		delete(c.topic_map, topic)
+		close(sub.done)
+		close(sub.relays)
+	}
+	c.topic_map_mutex.Unlock()
+}
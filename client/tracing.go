@@ -0,0 +1,69 @@
+package client
+
+import (
+	"context"
+
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+	"github.com/CiaranWoodward/broadcast_hub/tracing"
+)
+
+// Start a span around a request being sent to the server, and carry its trace context in the request's header so the
+// server's spans are its children
+func (c *Client) startRequestSpan(ctx context.Context, req *msg.Message) (context.Context, tracing.Span) {
+	ctx, span := c.config.Tracer.Start(ctx, "broadcast_hub.client."+requestName(*req), tracing.A("mid", req.MessageId))
+	req.Trace = c.config.Tracer.Inject(ctx)
+	return ctx, span
+}
+
+// Start a span around the delivery of a received relay, as a child of the trace context it was relayed with
+func (c *Client) startReceiveSpan(m msg.Message) (context.Context, tracing.Span) {
+	ctx := c.config.Tracer.Extract(context.Background(), m.Trace)
+	return c.config.Tracer.Start(ctx, "broadcast_hub.client.receive", tracing.A("src", m.RelayInd.Src),
+		tracing.A("topic", m.RelayInd.Topic))
+}
+
+// Name of the request a message carries, for naming its span
+func requestName(m msg.Message) string {
+	switch {
+	case m.RelayReq != nil:
+		return "relay"
+	case m.RelayBatReq != nil:
+		return "relay_batch"
+	case m.IdReq != nil:
+		return "identify"
+	case m.ListReq != nil:
+		return "list"
+	case m.PingReq != nil:
+		return "ping"
+	case m.SubReq != nil:
+		return "subscribe"
+	case m.UnsubReq != nil:
+		return "unsubscribe"
+	case m.NameReq != nil:
+		return "set_name"
+	case m.ResolvReq != nil:
+		return "resolve_name"
+	case m.PresReq != nil:
+		return "presence"
+	case m.GrpCreateReq != nil:
+		return "group_create"
+	case m.GrpJoinReq != nil:
+		return "group_join"
+	case m.GrpLeaveReq != nil:
+		return "group_leave"
+	case m.GrpListReq != nil:
+		return "group_list"
+	case m.HistReq != nil:
+		return "history"
+	case m.StatsReq != nil:
+		return "stats"
+	case m.HelloReq != nil:
+		return "hello"
+	case m.AuthReq != nil:
+		return "auth"
+	case m.ResumeReq != nil:
+		return "resume"
+	default:
+		return "request"
+	}
+}
@@ -0,0 +1,50 @@
+package client
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// Hello negotiates the protocol version with the server, agreeing on the newest version supported by both.
+// Until this is called, version 1 is used. It should be called before any other requests.
+//
+// Returns a VERSION_MISMATCH error if the server doesn't support any of our versions, in which case the connection
+// can't be used and should be closed.
+// Times out after the RequestTimeout of the ClientConfig (5 seconds by default); use HelloCtx for control over cancellation and deadlines.
+func (c *Client) Hello() (version msg.Version, err error) {
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	return c.HelloCtx(ctx)
+}
+
+// HelloCtx is Hello, but waits for the response until the context is done instead of a fixed timeout.
+// Returns a TIMEOUT error if the context deadline expires, or CANCELLED if the context is cancelled.
+func (c *Client) HelloCtx(ctx context.Context) (version msg.Version, err error) {
+	// Form the message
+	req := c.newMessage()
+	req.HelloReq = &msg.HelloRequest{MinVersion: msg.MinVersion, MaxVersion: msg.MaxVersion}
+
+	rsp, err := c.transact(ctx, req)
+	if err != nil {
+		return 0, err
+	}
+	if rsp.HelloRes == nil {
+		return 0, errMissingResponse(req)
+	}
+	if rsp.HelloRes.Status != msg.SUCCESS {
+		return 0, msg.NewStatusError(rsp.HelloRes.Status, req.MessageId, nil)
+	}
+	// Double check the server's choice, in case it is misbehaving
+	if !rsp.HelloRes.Version.Supported() {
+		return 0, msg.NewStatusError(msg.VERSION_MISMATCH, req.MessageId, nil)
+	}
+	atomic.StoreInt32(&c.version, int32(rsp.HelloRes.Version))
+	return rsp.HelloRes.Version, nil
+}
+
+// Version gets the protocol version currently in use with the server
+func (c *Client) Version() msg.Version {
+	return msg.Version(atomic.LoadInt32(&c.version))
+}
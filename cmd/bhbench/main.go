@@ -0,0 +1,319 @@
+/*
+Load generator for measuring the performance of a broadcast_hub server
+*/
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/CiaranWoodward/broadcast_hub/client"
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+	"github.com/urfave/cli/v2"
+)
+
+// Relay messages start with the time they were sent, in nanoseconds, so receivers can measure the latency
+const stampSize = 8
+
+func main() {
+	app := &cli.App{
+		Name:                   "bhbench",
+		Usage:                  "Generate relay traffic between many clients of a broadcast_hub server, and report its performance",
+		Action:                 runBench,
+		UseShortOptionHandling: true,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "server",
+				Aliases: []string{"s"},
+				Usage:   "Connect to the broadcast_hub server at the provided `HOSTNAME`. Required unless --unix is used.",
+			},
+			&cli.IntFlag{
+				Name:    "port",
+				Aliases: []string{"p"},
+				Usage:   "Connect to the given `PORT` of the broadcast_hub server. Required unless --unix is used.",
+			},
+			&cli.StringFlag{
+				Name:  "unix",
+				Usage: "Connect to a local broadcast_hub server on the Unix domain socket at `PATH`, instead of over TCP.",
+			},
+			&cli.StringFlag{
+				Name:  "token",
+				Usage: "Authenticate every client with the server using the given `TOKEN`.",
+			},
+			&cli.StringFlag{
+				Name:  "codec",
+				Usage: "Encode messages to the server with `CODEC`: cbor, json or cbor-framed. The server must accept it (See the server's --codec).",
+				Value: msg.CodecCBOR.String(),
+			},
+			&cli.IntFlag{
+				Name:    "clients",
+				Aliases: []string{"n"},
+				Usage:   "Connect `COUNT` clients, which all send and receive relays.",
+				Value:   10,
+			},
+			&cli.IntFlag{
+				Name:  "size",
+				Usage: "Send relay messages of `BYTES` bytes (at least 8, for the timestamp).",
+				Value: 64,
+			},
+			&cli.IntFlag{
+				Name:  "fanout",
+				Usage: "Send each relay to `COUNT` other clients, chosen at random.",
+				Value: 1,
+			},
+			&cli.Float64Flag{
+				Name:  "rate",
+				Usage: "Send `RATE` relays per second in total, shared between the clients. Zero sends as fast as the server responds.",
+			},
+			&cli.DurationFlag{
+				Name:    "duration",
+				Aliases: []string{"d"},
+				Usage:   "Send relays for `DURATION`, or until Ctl-C.",
+				Value:   10 * time.Second,
+			},
+			&cli.DurationFlag{
+				Name:  "drain",
+				Usage: "After sending, wait `DURATION` for relays still in flight to be received.",
+				Value: time.Second,
+			},
+		},
+	}
+
+	err := app.Run(os.Args)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Everything measured during a run, shared by all the clients
+type results struct {
+	mutex sync.Mutex
+	// Relays sent, and relay messages received by any client
+	sent     int
+	received int
+	// Time from sending each relay to its Relay Response, and from sending it to each destination receiving it
+	responseLatency []time.Duration
+	deliverLatency  []time.Duration
+	// Count of each failure, by status (or error, for failures without one)
+	failures map[string]int
+}
+
+// Record the outcome of sending a relay
+func (r *results) recordSent(took time.Duration, csm msg.ClientStatusMap, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err != nil {
+		var serr *msg.StatusError
+		if errors.As(err, &serr) {
+			r.failures[serr.Status.String()]++
+		} else {
+			r.failures[err.Error()]++
+		}
+		return
+	}
+	r.sent++
+	r.responseLatency = append(r.responseLatency, took)
+	for _, status := range csm {
+		r.failures[status.String()]++
+	}
+}
+
+// Record a relay message arriving
+func (r *results) recordReceived(latency time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.received++
+	r.deliverLatency = append(r.deliverLatency, latency)
+}
+
+// Handle the CLI arguments, connect the clients and run the benchmark
+func runBench(c *cli.Context) error {
+	port := c.Int("port")
+	servername := c.String("server")
+	unixPath := c.String("unix")
+	n := c.Int("clients")
+	size := c.Int("size")
+	fanout := c.Int("fanout")
+	rate := c.Float64("rate")
+
+	if unixPath == "" && servername == "" {
+		log.Fatal("--server or --unix must be provided")
+	}
+	if unixPath == "" && (port < 1 || port > 0xFFFF) {
+		log.Fatalf("PORT out of range: %d", port)
+	}
+	if n < 2 {
+		log.Fatal("--clients must be at least 2")
+	}
+	if fanout < 1 || fanout >= n {
+		log.Fatalf("--fanout must be between 1 and %d, with %d clients", n-1, n)
+	}
+	if size < stampSize {
+		log.Fatalf("--size must be at least %d", stampSize)
+	}
+
+	endpoint := net.JoinHostPort(servername, strconv.Itoa(port))
+	cfg := client.DefaultClientConfig()
+	codec, ok := msg.ParseCodec(c.String("codec"))
+	if !ok {
+		log.Fatalf("Unknown codec: %s", c.String("codec"))
+	}
+	cfg.Codec = codec
+	cfg.IdentifyOnConnect = true
+	dial := func() (*client.Client, error) {
+		if unixPath != "" {
+			return client.DialUnix(unixPath, cfg)
+		}
+		return client.Dial(endpoint, cfg)
+	}
+
+	// Connect every client, and learn their IDs
+	clients := make([]*client.Client, n)
+	cids := make([]msg.ClientId, n)
+	for i := range clients {
+		cli, err := dial()
+		if err != nil {
+			log.Fatalf("Failed to connect client %d: %v", i, err)
+		}
+		defer cli.Close()
+		if _, err = cli.Hello(); errors.Is(err, msg.VERSION_MISMATCH) {
+			log.Fatal("server version not supported")
+		}
+		if token := c.String("token"); token != "" {
+			if err = cli.Authenticate(msg.Credentials{Token: token}); err != nil {
+				log.Fatalf("Failed to authenticate client %d: %v", i, err)
+			}
+		}
+		cids[i] = cli.ID()
+		clients[i] = cli
+	}
+	log.Printf("Connected %d clients, sending %d byte relays to %d of them at a time.", n, size, fanout)
+
+	res := &results{failures: make(map[string]int)}
+	var receivers sync.WaitGroup
+	for _, cli := range clients {
+		receivers.Add(1)
+		go func(cli *client.Client) {
+			defer receivers.Done()
+			for rx := range cli.Relays {
+				if len(rx.Msg) < stampSize {
+					continue
+				}
+				sentAt := time.Unix(0, int64(binary.BigEndian.Uint64(rx.Msg)))
+				res.recordReceived(time.Since(sentAt))
+			}
+		}(cli)
+	}
+
+	// Send until the duration is up, or Ctl-C
+	ctx, cancel := context.WithTimeout(context.Background(), c.Duration("duration"))
+	defer cancel()
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+	start := time.Now()
+	var senders sync.WaitGroup
+	for i, cli := range clients {
+		senders.Add(1)
+		go func(i int, cli *client.Client) {
+			defer senders.Done()
+			sendRelays(ctx, cli, otherIds(cids, i), size, fanout, rate/float64(n), res)
+		}(i, cli)
+	}
+	senders.Wait()
+	elapsed := time.Since(start)
+
+	// Let the last relays arrive, then stop the receivers
+	time.Sleep(c.Duration("drain"))
+	for _, cli := range clients {
+		cli.Close()
+	}
+	receivers.Wait()
+
+	report(res, elapsed, size)
+	return nil
+}
+
+// Get the IDs of every client but the i'th
+func otherIds(cids []msg.ClientId, i int) []msg.ClientId {
+	others := make([]msg.ClientId, 0, len(cids)-1)
+	others = append(others, cids[:i]...)
+	return append(others, cids[i+1:]...)
+}
+
+// Send relays from one client to random others until the context is done, at up to 'rate' per second (if non-zero)
+func sendRelays(ctx context.Context, cli *client.Client, others []msg.ClientId, size, fanout int, rate float64, res *results) {
+	var tick <-chan time.Time
+	if rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	mesg := make([]byte, size)
+	for {
+		if tick != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick:
+			}
+		} else if ctx.Err() != nil {
+			return
+		}
+
+		rng.Shuffle(len(others), func(i, j int) { others[i], others[j] = others[j], others[i] })
+		now := time.Now()
+		binary.BigEndian.PutUint64(mesg, uint64(now.UnixNano()))
+		csm, err := cli.RelayMessage(mesg, others[:fanout])
+		res.recordSent(time.Since(now), csm, err)
+	}
+}
+
+// Print the results of a run
+func report(res *results, elapsed time.Duration, size int) {
+	res.mutex.Lock()
+	defer res.mutex.Unlock()
+	secs := elapsed.Seconds()
+	fmt.Printf("Ran for %v\n", elapsed.Round(time.Millisecond))
+	fmt.Printf("Sent:     %d relays (%.1f/s)\n", res.sent, float64(res.sent)/secs)
+	fmt.Printf("Received: %d messages (%.1f/s, %.1f KiB/s)\n", res.received, float64(res.received)/secs, float64(res.received*size)/secs/1024)
+	printLatency("Response latency", res.responseLatency)
+	printLatency("Delivery latency", res.deliverLatency)
+	if len(res.failures) == 0 {
+		fmt.Println("Failures: none")
+		return
+	}
+	fmt.Println("Failures:")
+	reasons := make([]string, 0, len(res.failures))
+	for reason := range res.failures {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Printf("  %-20s %d\n", reason, res.failures[reason])
+	}
+}
+
+// Print the percentiles of some latencies
+func printLatency(name string, latencies []time.Duration) {
+	if len(latencies) == 0 {
+		fmt.Printf("%s: no samples\n", name)
+		return
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) time.Duration {
+		return latencies[int(p*float64(len(latencies)-1))].Round(time.Microsecond)
+	}
+	fmt.Printf("%s: p50 %v, p90 %v, p99 %v, max %v\n", name, percentile(0.5), percentile(0.9), percentile(0.99), percentile(1))
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CiaranWoodward/broadcast_hub/client"
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// Usage of an interactive command, for the help
+type commandHelp struct {
+	name string
+	args string
+	// Description, starting with a summary line
+	lines []string
+}
+
+var commands = []commandHelp{
+	{"getid", "", []string{"Get the ID of this client"}},
+	{"list", "", []string{"Get the IDs of the other connected clients"}},
+	{"session", "", []string{"Get the ID and token needed to resume this client's session later"}},
+	{"resume", "<Client ID> <token>", []string{"Reclaim the ID of a previous session, receiving the messages sent to it while disconnected"}},
+	{"setname", "<name>", []string{"Register a name for this client, so others can relay to it by name."}},
+	{"resolve", "<name>", []string{"Get the ID of the client registered with the name"}},
+	{"relay", "<space seperated list of Client IDs or names> : <ASCII Message>", []string{
+		"Send a message to the list of other Clients, via the hub.",
+		"Eg: relay 1 2 alice :Hello there!"}},
+	{"relayack", "<space separated list of Client IDs or names> : <ASCII Message>", []string{"As relay, but each Client acknowledges delivery."}},
+	{"broadcast", "<ASCII Message>", []string{"Send a message to all other Clients, via the hub."}},
+	{"subscribe", "<topic>", []string{"Receive all messages published to the topic."}},
+	{"unsubscribe", "<topic>", []string{"Stop receiving messages published to the topic."}},
+	{"publish", "<topic> :<ASCII Message>", []string{
+		"Send a message to all other Clients subscribed to the topic, via the hub.",
+		"Eg: publish news :Hello there!"}},
+	{"presence", "<on|off>", []string{"Start or stop being told when other Clients connect and disconnect."}},
+	{"watch", "", []string{
+		"Show every Client connecting and disconnecting, and everything received, with timestamps and colorized Client IDs.",
+		"Shown even with --quiet, until unwatch."}},
+	{"unwatch", "", []string{"Stop watching, and stop being told when other Clients connect and disconnect."}},
+	{"group", "<create|join|leave> <group>", []string{"Create, join or leave a group of Clients on the hub."}},
+	{"groups", "[group]", []string{"Get the names of all groups, or the IDs of the members of a group"}},
+	{"grouprelay", "<group> :<ASCII Message>", []string{
+		"Send a message to all other members of the group, via the hub.",
+		"Eg: grouprelay team :Hello there!"}},
+	{"history", "[topic]", []string{"Get the recent messages sent to this Client, or published to the topic, that the hub has kept."}},
+	{"stats", "", []string{"Get statistics about the hub, and this Client's connection to it."}},
+	{"ping", "", []string{"Measure the round trip time to the hub, and show the average so far."}},
+	{"help", "[command]", []string{"Show the help for every command, or just the given command."}},
+	{"quit", "", nil},
+}
+
+func printHelp() {
+	log.Println("Interactive Help:")
+	for _, cmd := range commands {
+		printCommandHelp(cmd)
+	}
+}
+
+func printCommandHelp(cmd commandHelp) {
+	log.Println(strings.TrimRight(" "+cmd.name+" "+cmd.args, " "))
+	for i, line := range cmd.lines {
+		if i == 0 {
+			log.Println("\t- " + line)
+		} else {
+			log.Println("\t  " + line)
+		}
+	}
+}
+
+// Get the names of all the interactive commands
+func commandNames() []string {
+	names := make([]string, len(commands))
+	for i, cmd := range commands {
+		names[i] = cmd.name
+	}
+	return names
+}
+
+// Returned by 'runCommand' for the quit command
+var errQuit = errors.New("quit")
+
+// A command which couldn't be understood, so was never sent to the hub
+type parseError string
+
+func (e parseError) Error() string {
+	return string(e)
+}
+
+// A relay which the hub couldn't deliver to some of its destinations
+type partialError msg.ClientStatusMap
+
+func (e partialError) Error() string {
+	return fmt.Sprintf("relay failed for some clients: %v", msg.ClientStatusMap(e))
+}
+
+// Outcome of a command which reached the hub
+type commandResult struct {
+	// Summary for the interactive prompt
+	text string
+	// Result for the JSON output, or nil if there's nothing more to say than whether it succeeded
+	data interface{}
+}
+
+// Result of the relay commands, which failed for the clients in 'Status'
+type relayResult struct {
+	RelayId uint32                  `json:"relay_id,omitempty"`
+	Status  map[msg.ClientId]string `json:"status,omitempty"`
+}
+
+// Get the result of a relay command, which is a partial failure if any destination has a status
+func newRelayResult(relayId uint32, csm msg.ClientStatusMap) (commandResult, error) {
+	res := relayResult{RelayId: relayId}
+	text := "Success!"
+	if relayId != 0 {
+		text = fmt.Sprintf("Success! (Relay %d)", relayId)
+	}
+	if len(csm) == 0 {
+		if relayId == 0 {
+			return success, nil
+		}
+		return commandResult{text, res}, nil
+	}
+	res.Status = make(map[msg.ClientId]string, len(csm))
+	for cid, status := range csm {
+		res.Status[cid] = status.String()
+	}
+	text = fmt.Sprintf("Partial Error: %v", csm)
+	if relayId != 0 {
+		text = fmt.Sprintf("Partial Error (Relay %d): %v", relayId, csm)
+	}
+	return commandResult{text, res}, partialError(csm)
+}
+
+var success = commandResult{text: "Success!"}
+
+// Run a single command line against the hub.
+// Returns a parseError if the command wasn't understood, or errQuit if the client should stop.
+func runCommand(c *client.Client, comp *completer, p *printer, line string) (commandResult, error) {
+	split := strings.SplitN(strings.TrimSpace(line), " ", 2)
+	command := split[0]
+	args := ""
+	if len(split) == 2 {
+		args = split[1]
+	}
+
+	switch command {
+	case "getid":
+		cid, err := c.GetClientId()
+		if err != nil {
+			return commandResult{}, err
+		}
+		return commandResult{fmt.Sprintf("My ID: %d", cid), map[string]msg.ClientId{"id": cid}}, nil
+
+	case "list":
+		cids, err := c.ListOtherClients()
+		if err != nil {
+			return commandResult{}, err
+		}
+		comp.setIds(cids)
+		if cids == nil {
+			cids = []msg.ClientId{}
+		}
+		return commandResult{fmt.Sprintf("Other IDs: %v", cids), map[string][]msg.ClientId{"ids": cids}}, nil
+
+	case "session":
+		cid, token, err := c.GetSession()
+		if err != nil {
+			return commandResult{}, err
+		}
+		if token == "" {
+			return commandResult{text: "Server does not support resuming sessions"}, nil
+		}
+		return commandResult{fmt.Sprintf("Resume with: resume %d %s", cid, token), map[string]interface{}{"id": cid, "token": token}}, nil
+
+	case "resume":
+		split := strings.Fields(args)
+		if len(split) != 2 {
+			return commandResult{}, parseError("resume command invalid format")
+		}
+		cid, err := strconv.ParseUint(split[0], 10, 64)
+		if err != nil {
+			return commandResult{}, parseError(err.Error())
+		}
+		return success, c.Resume(msg.ClientId(cid), split[1])
+
+	case "setname":
+		return success, c.SetName(args)
+
+	case "resolve":
+		cid, err := c.ResolveName(args)
+		if err != nil {
+			return commandResult{}, err
+		}
+		return commandResult{fmt.Sprintf("%s has ID: %d", args, cid), map[string]msg.ClientId{"id": cid}}, nil
+
+	case "relay", "relayack":
+		cids, mesg, err := relayCommandParse(args, c.ResolveName)
+		if err != nil {
+			return commandResult{}, parseError(err.Error())
+		}
+		var relayId uint32
+		var csm msg.ClientStatusMap
+		if command == "relayack" {
+			relayId, csm, err = c.RelayMessageWithAck(mesg, cids)
+		} else {
+			csm, err = c.RelayMessage(mesg, cids)
+		}
+		if err != nil {
+			return commandResult{}, err
+		}
+		return newRelayResult(relayId, csm)
+
+	case "broadcast":
+		csm, err := c.BroadcastMessage([]byte(args))
+		if err != nil {
+			return commandResult{}, err
+		}
+		return newRelayResult(0, csm)
+
+	case "subscribe":
+		relays, err := c.Subscribe(args)
+		if err != nil {
+			return commandResult{}, err
+		}
+		p.startTopic(args, relays)
+		comp.setTopic(args, true)
+		return success, nil
+
+	case "unsubscribe":
+		if err := c.Unsubscribe(args); err != nil {
+			return commandResult{}, err
+		}
+		comp.setTopic(args, false)
+		return success, nil
+
+	case "publish":
+		split := strings.SplitN(args, ":", 2)
+		if len(split) != 2 {
+			return commandResult{}, parseError("publish command invalid format")
+		}
+		csm, err := c.PublishMessage(strings.TrimSpace(split[0]), []byte(split[1]))
+		if err != nil {
+			return commandResult{}, err
+		}
+		return newRelayResult(0, csm)
+
+	case "presence":
+		switch args {
+		case "on":
+			return success, c.SubscribePresence()
+		case "off":
+			return success, c.UnsubscribePresence()
+		}
+		return commandResult{}, parseError("presence command takes on or off")
+
+	case "watch":
+		if err := c.SubscribePresence(); err != nil {
+			return commandResult{}, err
+		}
+		p.setWatching(true)
+		return success, nil
+
+	case "unwatch":
+		p.setWatching(false)
+		return success, c.UnsubscribePresence()
+
+	case "group":
+		split := strings.Fields(args)
+		if len(split) != 2 {
+			return commandResult{}, parseError("group command invalid format")
+		}
+		switch split[0] {
+		case "create":
+			return success, c.CreateGroup(split[1])
+		case "join":
+			return success, c.JoinGroup(split[1])
+		case "leave":
+			return success, c.LeaveGroup(split[1])
+		}
+		return commandResult{}, parseError("group command takes create, join or leave")
+
+	case "groups":
+		if args == "" {
+			groups, err := c.ListGroups()
+			if err != nil {
+				return commandResult{}, err
+			}
+			if groups == nil {
+				groups = []string{}
+			}
+			return commandResult{fmt.Sprintf("Groups: %v", groups), map[string][]string{"groups": groups}}, nil
+		}
+		cids, err := c.ListGroupMembers(args)
+		if err != nil {
+			return commandResult{}, err
+		}
+		if cids == nil {
+			cids = []msg.ClientId{}
+		}
+		return commandResult{fmt.Sprintf("Members of %s: %v", args, cids), map[string][]msg.ClientId{"members": cids}}, nil
+
+	case "grouprelay":
+		split := strings.SplitN(args, ":", 2)
+		if len(split) != 2 {
+			return commandResult{}, parseError("grouprelay command invalid format")
+		}
+		csm, err := c.RelayToGroup(strings.TrimSpace(split[0]), []byte(split[1]))
+		if err != nil {
+			return commandResult{}, err
+		}
+		return newRelayResult(0, csm)
+
+	case "history":
+		relays, err := c.History(client.HistoryOptions{Topic: args})
+		if err != nil {
+			return commandResult{}, err
+		}
+		var text strings.Builder
+		out := make([]relayOutput, len(relays))
+		for i, rx := range relays {
+			fmt.Fprintf(&text, "History from %d at %s: %s\n", rx.Src, rx.Time().Format(time.TimeOnly), rx.Msg)
+			out[i] = newRelayOutput("", rx)
+		}
+		fmt.Fprintf(&text, "%d messages", len(relays))
+		return commandResult{text.String(), map[string][]relayOutput{"relays": out}}, nil
+
+	case "stats":
+		stats, err := c.Stats()
+		if err != nil {
+			return commandResult{}, err
+		}
+		text := fmt.Sprintf("Clients: %d, uptime: %s, relays per second: %.1f, bytes received by hub: %d, bytes sent by hub: %d, expired relays: %d",
+			stats.Clients, stats.Uptime.Round(time.Second), stats.RelayRate, stats.BytesReceived, stats.BytesSent, stats.RelaysExpired)
+		return commandResult{text, map[string]interface{}{
+			"clients":        stats.Clients,
+			"uptime_seconds": stats.Uptime.Seconds(),
+			"relay_rate":     stats.RelayRate,
+			"bytes_received": stats.BytesReceived,
+			"bytes_sent":     stats.BytesSent,
+			"relays_expired": stats.RelaysExpired,
+		}}, nil
+
+	case "ping":
+		rtt, err := c.Ping()
+		if err != nil {
+			return commandResult{}, err
+		}
+		lat := c.Latency()
+		text := fmt.Sprintf("Round trip: %s (average %s ± %s, min %s, max %s over %d pings)",
+			rtt, lat.Smoothed, lat.Variation, lat.Min, lat.Max, lat.Samples)
+		return commandResult{text, map[string]interface{}{
+			"rtt_seconds":       rtt.Seconds(),
+			"smoothed_seconds":  lat.Smoothed.Seconds(),
+			"variation_seconds": lat.Variation.Seconds(),
+			"min_seconds":       lat.Min.Seconds(),
+			"max_seconds":       lat.Max.Seconds(),
+			"samples":           lat.Samples,
+		}}, nil
+
+	case "help":
+		if args == "" {
+			printHelp()
+			return commandResult{}, nil
+		}
+		for _, cmd := range commands {
+			if cmd.name == args {
+				printCommandHelp(cmd)
+				return commandResult{}, nil
+			}
+		}
+		return commandResult{}, parseError(fmt.Sprintf("unrecognised command \"%s\"", args))
+
+	case "quit":
+		return commandResult{}, errQuit
+	case "":
+		return commandResult{}, nil
+	}
+	return commandResult{}, parseError(fmt.Sprintf("unrecognised command \"%s\"", command))
+}
+
+// Parse the destinations and message of a relay command.
+// Destinations that aren't numeric Client IDs are treated as names, and looked up with 'resolve'.
+func relayCommandParse(args string, resolve func(name string) (msg.ClientId, error)) (cids []msg.ClientId, mesg []byte, err error) {
+	split := strings.SplitN(args, ":", 2)
+	if len(split) == 2 {
+		mesg = []byte(split[1])
+	} else if len(split) == 0 {
+		err = fmt.Errorf("relay command invalid format")
+		return
+	}
+
+	// Convert the space seperate list into a ClientId Slice
+	cids_string := strings.Fields(split[0])
+	for _, cs := range cids_string {
+		i, e := strconv.ParseUint(cs, 10, 64)
+		if e == nil {
+			cids = append(cids, msg.ClientId(i))
+			continue
+		}
+		cid, e := resolve(cs)
+		if e != nil {
+			err = fmt.Errorf("can't resolve name \"%s\": %w", cs, e)
+			return
+		}
+		cids = append(cids, cid)
+	}
+	return
+}
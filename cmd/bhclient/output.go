@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/CiaranWoodward/broadcast_hub/client"
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// Prints what the client receives and the results of commands, either for a person at the prompt,
+// or as one JSON object per line for scripts
+type printer struct {
+	json  bool
+	mutex sync.Mutex
+	enc   *json.Encoder
+	// Whether to hide what the client receives, unless watching
+	quiet bool
+	// Whether source IDs can be colorized, because stdout is a terminal
+	color bool
+	// Set by the watch command, to show everything received with timestamps
+	watching atomic.Bool
+}
+
+func newPrinter(asJSON bool, quiet bool) *printer {
+	return &printer{json: asJSON, enc: json.NewEncoder(os.Stdout), quiet: quiet, color: !asJSON && isTerminal(os.Stdout)}
+}
+
+// Check whether a file is a terminal, rather than a pipe or regular file
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Start or stop watching, which shows everything received even if quiet, with timestamps and colorized source IDs
+func (p *printer) setWatching(watching bool) {
+	p.watching.Store(watching)
+}
+
+// Check whether something received by the client should be printed
+func (p *printer) showing() bool {
+	return !p.quiet || p.watching.Load()
+}
+
+// Print an event for a person at the prompt, prefixed with the time it arrived if watching
+func (p *printer) event(format string, args ...interface{}) {
+	if p.watching.Load() {
+		format = "[" + time.Now().Format("15:04:05.000") + "] " + format
+	}
+	fmt.Printf(format+"\n", args...)
+}
+
+// Format a client ID, in a color picked by the ID if watching, so each client's traffic is easy to follow
+func (p *printer) clientId(cid msg.ClientId) string {
+	if !p.color || !p.watching.Load() {
+		return fmt.Sprint(cid)
+	}
+	return fmt.Sprintf("\x1b[1;%dm%d\x1b[0m", 31+cid%6, cid)
+}
+
+// JSON form of a received relay
+type relayOutput struct {
+	Event       string       `json:"event,omitempty"`
+	Src         msg.ClientId `json:"src"`
+	Topic       string       `json:"topic,omitempty"`
+	ContentType string       `json:"content_type,omitempty"`
+	Time        string       `json:"time,omitempty"`
+	Msg         string       `json:"msg"`
+}
+
+func newRelayOutput(event string, rx msg.RelayIndication) relayOutput {
+	out := relayOutput{
+		Event:       event,
+		Src:         rx.Src,
+		Topic:       rx.Topic,
+		ContentType: rx.ContentType,
+		Msg:         string(rx.Msg),
+	}
+	if rx.Timestamp != 0 {
+		out.Time = rx.Time().Format(time.RFC3339Nano)
+	}
+	return out
+}
+
+// JSON form of a command's outcome
+type commandOutput struct {
+	Command string      `json:"command"`
+	Ok      bool        `json:"ok"`
+	Error   string      `json:"error,omitempty"`
+	Result  interface{} `json:"result,omitempty"`
+}
+
+// Write a JSON line, without interleaving with other goroutines
+func (p *printer) emit(v interface{}) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if err := p.enc.Encode(v); err != nil {
+		log.Printf("Failed to write output: %v", err)
+	}
+}
+
+// Print the outcome of a command
+func (p *printer) result(line string, res commandResult, err error) {
+	if p.json {
+		out := commandOutput{Command: line, Ok: err == nil, Result: res.data}
+		if err != nil {
+			out.Error = err.Error()
+		}
+		p.emit(out)
+		return
+	}
+	var perr parseError
+	var partial partialError
+	switch {
+	case errors.As(err, &perr):
+		log.Printf("Parse Error: %v", err)
+	case err != nil && !errors.As(err, &partial):
+		log.Printf("Error: %v", err)
+	case res.text != "":
+		log.Println(res.text)
+	}
+}
+
+// Start printing everything received by the client
+func (p *printer) start(c *client.Client) {
+	// Goroutine to print all incoming relays
+	go func() {
+		for {
+			rx, ok := <-c.Relays
+			if !ok {
+				break
+			}
+			if !p.showing() {
+				continue
+			}
+			if p.json {
+				p.emit(newRelayOutput("relay", rx))
+			} else {
+				p.event("Rx from %s%s: %s", p.clientId(rx.Src), relayDetails(rx), rx.Msg)
+			}
+		}
+	}()
+	// Goroutine to print all incoming delivery acknowledgements
+	go func() {
+		for ack := range c.Acks {
+			if !p.showing() {
+				continue
+			}
+			if p.json {
+				p.emit(map[string]interface{}{"event": "ack", "relay_id": ack.RelayId, "src": ack.Src})
+			} else {
+				p.event("Relay %d delivered to %s", ack.RelayId, p.clientId(ack.Src))
+			}
+		}
+	}()
+	// Goroutine to print all incoming presence indications
+	go func() {
+		for ind := range c.Presence {
+			if !p.showing() {
+				continue
+			}
+			if p.json {
+				p.emit(map[string]interface{}{"event": "presence", "id": ind.Id, "online": ind.Online})
+			} else if ind.Online {
+				p.event("Client %s connected", p.clientId(ind.Id))
+			} else {
+				p.event("Client %s disconnected", p.clientId(ind.Id))
+			}
+		}
+	}()
+}
+
+// Start printing all incoming relays on a topic, until unsubscribed
+func (p *printer) startTopic(topic string, relays <-chan msg.RelayIndication) {
+	go func() {
+		for rx := range relays {
+			if !p.showing() {
+				continue
+			}
+			if p.json {
+				p.emit(newRelayOutput("relay", rx))
+			} else {
+				p.event("Rx from %s on %s%s: %s", p.clientId(rx.Src), topic, relayDetails(rx), rx.Msg)
+			}
+		}
+	}()
+}
+
+// Describe the content type of a relay, and how long ago it passed through the hub
+func relayDetails(rx msg.RelayIndication) string {
+	details := ""
+	if rx.ContentType != "" {
+		details += fmt.Sprintf(" [%s]", rx.ContentType)
+	}
+	if rx.Timestamp != 0 {
+		details += fmt.Sprintf(" (latency %v)", time.Since(rx.Time()).Round(time.Millisecond))
+	}
+	return details
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Returned by 'lineReader.ReadLine' when the user presses Ctl-C on an empty line
+var errInterrupt = errors.New("interrupted")
+
+// Maximum number of lines kept in the history
+const maxHistory = 500
+
+// Interactive line editor for the REPL, with history and tab completion.
+// If stdin isn't a terminal, lines are read as-is without any editing.
+type lineReader struct {
+	in     *bufio.Reader
+	out    io.Writer
+	prompt string
+	// Gets the possible completions of the last word in the line, up to the cursor
+	complete func(line string) []string
+	// Previously entered lines, oldest first
+	history []string
+	// Restores the terminal to how it was found, or nil if it isn't in raw mode
+	restore func()
+	// Current line being edited, and the cursor position in it
+	line   []rune
+	cursor int
+}
+
+// Create a line reader on stdin, putting the terminal into raw mode if possible
+func newLineReader(prompt string, complete func(line string) []string) *lineReader {
+	r := &lineReader{
+		in:       bufio.NewReader(os.Stdin),
+		out:      os.Stdout,
+		prompt:   prompt,
+		complete: complete,
+	}
+	if restore, err := makeRaw(os.Stdin); err == nil {
+		r.restore = restore
+	}
+	return r
+}
+
+// Restore the terminal
+func (r *lineReader) Close() {
+	if r.restore != nil {
+		r.restore()
+		r.restore = nil
+	}
+}
+
+// Read a line, letting the user edit it if stdin is a terminal.
+// Returns io.EOF if stdin is closed (or Ctl-D is pressed on an empty line), or errInterrupt for Ctl-C on an empty line.
+func (r *lineReader) ReadLine() (string, error) {
+	fmt.Fprint(r.out, r.prompt)
+	if r.restore == nil {
+		line, err := r.in.ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	r.line = r.line[:0]
+	r.cursor = 0
+	// Position in the history while browsing it, and the line being edited before browsing started
+	hist := len(r.history)
+	editing := ""
+	for {
+		c, _, err := r.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		switch c {
+		case '\r', '\n':
+			fmt.Fprint(r.out, "\r\n")
+			line := string(r.line)
+			r.addHistory(line)
+			return line, nil
+		case 0x03: // Ctl-C
+			if len(r.line) == 0 {
+				fmt.Fprint(r.out, "\r\n")
+				return "", errInterrupt
+			}
+			// Abandon the line
+			fmt.Fprint(r.out, "^C\r\n")
+			r.line = r.line[:0]
+			r.cursor = 0
+			hist = len(r.history)
+			fmt.Fprint(r.out, r.prompt)
+			continue
+		case 0x04: // Ctl-D
+			if len(r.line) == 0 {
+				fmt.Fprint(r.out, "\r\n")
+				return "", io.EOF
+			}
+			r.deleteAt(r.cursor)
+		case 0x01: // Ctl-A
+			r.cursor = 0
+		case 0x05: // Ctl-E
+			r.cursor = len(r.line)
+		case 0x02: // Ctl-B
+			r.moveCursor(-1)
+		case 0x06: // Ctl-F
+			r.moveCursor(1)
+		case 0x0b: // Ctl-K
+			r.line = r.line[:r.cursor]
+		case 0x15: // Ctl-U
+			r.line = append(r.line[:0], r.line[r.cursor:]...)
+			r.cursor = 0
+		case 0x17: // Ctl-W
+			start := r.cursor
+			for start > 0 && unicode.IsSpace(r.line[start-1]) {
+				start--
+			}
+			for start > 0 && !unicode.IsSpace(r.line[start-1]) {
+				start--
+			}
+			r.line = append(r.line[:start], r.line[r.cursor:]...)
+			r.cursor = start
+		case 0x7f, 0x08: // Backspace
+			if r.cursor > 0 {
+				r.cursor--
+				r.deleteAt(r.cursor)
+			}
+		case '\t':
+			r.completeWord()
+		case 0x1b: // Escape sequence, for the arrow keys and others
+			switch r.readEscape() {
+			case "[A", "OA": // Up
+				if hist > 0 {
+					if hist == len(r.history) {
+						editing = string(r.line)
+					}
+					hist--
+					r.setLine(r.history[hist])
+				}
+			case "[B", "OB": // Down
+				if hist < len(r.history) {
+					hist++
+					if hist == len(r.history) {
+						r.setLine(editing)
+					} else {
+						r.setLine(r.history[hist])
+					}
+				}
+			case "[C", "OC": // Right
+				r.moveCursor(1)
+			case "[D", "OD": // Left
+				r.moveCursor(-1)
+			case "[H", "OH", "[1~": // Home
+				r.cursor = 0
+			case "[F", "OF", "[4~": // End
+				r.cursor = len(r.line)
+			case "[3~": // Delete
+				r.deleteAt(r.cursor)
+			}
+		default:
+			if unicode.IsPrint(c) {
+				r.line = append(r.line, 0)
+				copy(r.line[r.cursor+1:], r.line[r.cursor:])
+				r.line[r.cursor] = c
+				r.cursor++
+			}
+		}
+		r.redraw()
+	}
+}
+
+// Read the rest of an escape sequence, after the escape character
+func (r *lineReader) readEscape() string {
+	var seq strings.Builder
+	for {
+		c, _, err := r.in.ReadRune()
+		if err != nil {
+			return seq.String()
+		}
+		seq.WriteRune(c)
+		// Sequences end with a letter or '~', after the '[' or 'O' that starts them
+		if seq.Len() > 1 && (unicode.IsLetter(c) || c == '~') {
+			return seq.String()
+		}
+	}
+}
+
+// Redraw the line, leaving the terminal's cursor at the editing position
+func (r *lineReader) redraw() {
+	fmt.Fprintf(r.out, "\r%s%s\x1b[K", r.prompt, string(r.line))
+	if back := len(r.line) - r.cursor; back > 0 {
+		fmt.Fprintf(r.out, "\x1b[%dD", back)
+	}
+}
+
+// Replace the line being edited, with the cursor at the end
+func (r *lineReader) setLine(line string) {
+	r.line = append(r.line[:0], []rune(line)...)
+	r.cursor = len(r.line)
+}
+
+// Move the cursor, without leaving the line
+func (r *lineReader) moveCursor(by int) {
+	r.cursor += by
+	if r.cursor < 0 {
+		r.cursor = 0
+	} else if r.cursor > len(r.line) {
+		r.cursor = len(r.line)
+	}
+}
+
+// Delete the character at 'pos', if there is one
+func (r *lineReader) deleteAt(pos int) {
+	if pos < len(r.line) {
+		r.line = append(r.line[:pos], r.line[pos+1:]...)
+	}
+}
+
+// Remember a line in the history, unless it's empty or repeats the previous line
+func (r *lineReader) addHistory(line string) {
+	if strings.TrimSpace(line) == "" || (len(r.history) > 0 && r.history[len(r.history)-1] == line) {
+		return
+	}
+	r.history = append(r.history, line)
+	if len(r.history) > maxHistory {
+		r.history = r.history[len(r.history)-maxHistory:]
+	}
+}
+
+// Complete the word before the cursor. A single match is completed in full, otherwise as far as all the matches agree,
+// and if that doesn't add anything the matches are listed.
+func (r *lineReader) completeWord() {
+	if r.complete == nil {
+		return
+	}
+	before := string(r.line[:r.cursor])
+	word := before[strings.LastIndexAny(before, " :")+1:]
+	matches := r.complete(before)
+	if len(matches) == 0 {
+		return
+	}
+	insert := commonPrefix(matches)[len(word):]
+	if len(matches) == 1 {
+		insert += " "
+	} else if insert == "" {
+		sort.Strings(matches)
+		fmt.Fprintf(r.out, "\r\n%s\r\n", strings.Join(matches, "  "))
+	}
+	for _, c := range insert {
+		r.line = append(r.line, 0)
+		copy(r.line[r.cursor+1:], r.line[r.cursor:])
+		r.line[r.cursor] = c
+		r.cursor++
+	}
+}
+
+// Get the longest prefix shared by all the strings
+func commonPrefix(words []string) string {
+	prefix := words[0]
+	for _, w := range words[1:] {
+		for !strings.HasPrefix(w, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
+
+// Get the candidates starting with 'word'
+func matchPrefix(word string, candidates []string) []string {
+	var matches []string
+	for _, c := range candidates {
+		if strings.HasPrefix(c, word) {
+			matches = append(matches, c)
+		}
+	}
+	return matches
+}
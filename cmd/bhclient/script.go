@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/CiaranWoodward/broadcast_hub/client"
+)
+
+// Exit codes of a script
+const (
+	exitOk = 0
+	// A command reached the hub, but failed
+	exitFailed = 1
+	// A command couldn't be understood
+	exitInvalid = 2
+)
+
+// Run commands without prompting, stopping at the first one that fails. The commands are separated by ';',
+// or read from stdin one per line if 'script' is "-". Blank lines and lines starting with '#' are skipped.
+// Returns the exit code for the process.
+func runScript(c *client.Client, p *printer, script string) int {
+	defer c.Close()
+
+	comp := &completer{topics: make(map[string]bool)}
+	// Run a line, returning the exit code and whether to stop
+	run := func(line string) (int, bool) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			return exitOk, false
+		}
+		res, err := runCommand(c, comp, p, line)
+		if errors.Is(err, errQuit) {
+			return exitOk, true
+		}
+		p.result(line, res, err)
+		var perr parseError
+		if errors.As(err, &perr) {
+			return exitInvalid, true
+		} else if err != nil {
+			return exitFailed, true
+		}
+		return exitOk, false
+	}
+
+	if script != "-" {
+		for _, line := range strings.Split(script, ";") {
+			if code, stop := run(line); stop {
+				return code
+			}
+		}
+		return exitOk
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		if code, stop := run(scanner.Text()); stop {
+			return code
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("Failed to read commands: %v", err)
+		return exitFailed
+	}
+	return exitOk
+}
@@ -0,0 +1,13 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// Raw mode isn't supported on this platform, so lines are read without editing
+func makeRaw(f *os.File) (restore func(), err error) {
+	return nil, errors.New("raw terminal mode not supported")
+}
@@ -0,0 +1,128 @@
+/*
+Conformance checks for implementations of the broadcast_hub protocol, including those in other languages
+*/
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/CiaranWoodward/broadcast_hub/conformance"
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+	"github.com/urfave/cli/v2"
+)
+
+func main() {
+	app := &cli.App{
+		Name:  "bhconform",
+		Usage: "Check implementations of the broadcast_hub protocol are compatible with this one",
+		Commands: []*cli.Command{
+			{
+				Name:   "vectors",
+				Usage:  "Write the encoding test vectors and stream decoding cases as JSON, for testing other implementations",
+				Action: writeVectors,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "Write the vectors to `FILE` rather than stdout.",
+					},
+				},
+			},
+			{
+				Name:   "server",
+				Usage:  "Run every conformance scenario against a running broadcast_hub server, reporting any that fail",
+				Action: testServer,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "server",
+						Aliases: []string{"s"},
+						Usage:   "Connect to the broadcast_hub server at the provided `HOSTNAME`. Required unless --unix is used.",
+					},
+					&cli.IntFlag{
+						Name:    "port",
+						Aliases: []string{"p"},
+						Usage:   "Connect to the given `PORT` of the broadcast_hub server. Required unless --unix is used.",
+					},
+					&cli.StringFlag{
+						Name:  "unix",
+						Usage: "Connect to a local broadcast_hub server on the Unix domain socket at `PATH`, instead of over TCP.",
+					},
+					&cli.StringSliceFlag{
+						Name:  "codec",
+						Usage: "Run the scenarios with each `CODEC` the server accepts (cbor, json or cbor-framed).",
+						Value: cli.NewStringSlice(msg.CodecCBOR.String()),
+					},
+				},
+			},
+		},
+	}
+
+	err := app.Run(os.Args)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Write the vectors to a file, or stdout
+func writeVectors(c *cli.Context) error {
+	out := os.Stdout
+	if path := c.String("output"); path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	return conformance.WriteVectors(out)
+}
+
+// Run each scenario against the server, with each codec
+func testServer(c *cli.Context) error {
+	port := c.Int("port")
+	servername := c.String("server")
+	unixPath := c.String("unix")
+
+	if unixPath == "" && servername == "" {
+		log.Fatal("--server or --unix must be provided")
+	}
+	if unixPath == "" && (port < 1 || port > 0xFFFF) {
+		log.Fatalf("PORT out of range: %d", port)
+	}
+	var codecs []msg.Codec
+	for _, name := range c.StringSlice("codec") {
+		codec, ok := msg.ParseCodec(name)
+		if !ok {
+			log.Fatalf("Unknown codec: %s", name)
+		}
+		codecs = append(codecs, codec)
+	}
+
+	endpoint := net.JoinHostPort(servername, strconv.Itoa(port))
+	dial := func() (net.Conn, error) {
+		if unixPath != "" {
+			return net.Dial("unix", unixPath)
+		}
+		return net.Dial("tcp", endpoint)
+	}
+
+	failed := 0
+	for _, codec := range codecs {
+		for _, sc := range conformance.Scenarios {
+			if err := sc.Run(dial, codec); err != nil {
+				log.Printf("FAIL %s (%v): %v", sc.Name, codec, err)
+				failed++
+			} else {
+				log.Printf("PASS %s (%v)", sc.Name, codec)
+			}
+		}
+	}
+	if failed > 0 {
+		return cli.Exit("", 1)
+	}
+	log.Printf("All %d scenarios passed.", len(conformance.Scenarios)*len(codecs))
+	return nil
+}
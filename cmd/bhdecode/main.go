@@ -0,0 +1,154 @@
+/*
+Converts between hex dumps of broadcast_hub messages and readable JSON, for debugging packet captures
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+	"github.com/urfave/cli/v2"
+)
+
+func main() {
+	app := &cli.App{
+		Name:  "bhdecode",
+		Usage: "Convert between hex dumps of broadcast_hub messages and readable JSON",
+		Commands: []*cli.Command{
+			{
+				Name:      "decode",
+				Usage:     "Decode the messages in a hex dump, and print each as JSON",
+				ArgsUsage: "[HEX...]",
+				Description: "The hex is read from the arguments, or from stdin if there are none. Whitespace, colons and 0x " +
+					"prefixes are ignored, so dumps copied from packet captures can be pasted as they are. The dump may " +
+					"hold any number of messages, one after another, as sent over a connection.",
+				Action: decode,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "codec",
+						Usage: "Decode the messages with `CODEC` (cbor, json or cbor-framed), or detect it from the first byte with auto.",
+						Value: "auto",
+					},
+				},
+			},
+			{
+				Name:      "encode",
+				Usage:     "Encode messages written as JSON, and print each as hex",
+				ArgsUsage: "[JSON...]",
+				Description: "The JSON is read from the arguments, or from stdin if there are none, in the form printed by " +
+					"decode. Any number of messages can be given, one after another.",
+				Action: encode,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "codec",
+						Usage: "Encode the messages with `CODEC`: cbor, json or cbor-framed.",
+						Value: msg.CodecCBOR.String(),
+					},
+				},
+			},
+		},
+	}
+
+	err := app.Run(os.Args)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Get the input to a command, from its arguments or stdin
+func input(c *cli.Context) (string, error) {
+	if c.NArg() > 0 {
+		return strings.Join(c.Args().Slice(), " "), nil
+	}
+	b, err := io.ReadAll(os.Stdin)
+	return string(b), err
+}
+
+// Parse a hex dump, ignoring whitespace, colons and 0x prefixes
+func parseHex(dump string) ([]byte, error) {
+	var sb strings.Builder
+	for _, field := range strings.FieldsFunc(dump, func(r rune) bool {
+		return r == ':' || r == ' ' || r == '\t' || r == '\r' || r == '\n'
+	}) {
+		sb.WriteString(strings.TrimPrefix(strings.TrimPrefix(field, "0x"), "0X"))
+	}
+	return hex.DecodeString(sb.String())
+}
+
+// Decode each message in a hex dump, and print it as indented JSON
+func decode(c *cli.Context) error {
+	dump, err := input(c)
+	if err != nil {
+		return err
+	}
+	raw, err := parseHex(dump)
+	if err != nil {
+		return fmt.Errorf("invalid hex: %w", err)
+	}
+	var r io.Reader = bytes.NewReader(raw)
+	codec, ok := msg.ParseCodec(c.String("codec"))
+	if c.String("codec") == "auto" {
+		if codec, r, err = msg.DetectCodec(r); err != nil {
+			return err
+		}
+	} else if !ok {
+		return fmt.Errorf("unknown codec: %s", c.String("codec"))
+	}
+
+	dec := codec.Transcoder().NewStreamDecoder(r)
+	jt := msg.CodecJSON.Transcoder()
+	for i := 0; ; i++ {
+		m, err := dec.DecodeNext()
+		if errors.Is(err, io.EOF) && i > 0 {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("message %d isn't valid %s: %w", i+1, codec, err)
+		}
+		encoded, err := jt.Encode(m)
+		if err != nil {
+			return err
+		}
+		var out bytes.Buffer
+		if err = json.Indent(&out, bytes.TrimSpace(encoded), "", "  "); err != nil {
+			return err
+		}
+		fmt.Println(out.String())
+	}
+}
+
+// Encode each message written as JSON, and print it as hex
+func encode(c *cli.Context) error {
+	codec, ok := msg.ParseCodec(c.String("codec"))
+	if !ok {
+		return fmt.Errorf("unknown codec: %s", c.String("codec"))
+	}
+	text, err := input(c)
+	if err != nil {
+		return err
+	}
+	dec := msg.CodecJSON.Transcoder().NewStreamDecoder(strings.NewReader(text))
+	tc := codec.Transcoder()
+	for i := 0; ; i++ {
+		m, err := dec.DecodeNext()
+		if errors.Is(err, io.EOF) && i > 0 {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("message %d isn't valid JSON: %w", i+1, err)
+		}
+		encoded, err := tc.Encode(m)
+		if err != nil {
+			return err
+		}
+		fmt.Println(hex.EncodeToString(encoded))
+	}
+}
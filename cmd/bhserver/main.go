@@ -4,15 +4,36 @@ Basic CLI demonstrating the broadcast_hub server
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/CiaranWoodward/broadcast_hub/bridge/mqtt"
+	"github.com/CiaranWoodward/broadcast_hub/bridge/nats"
+	"github.com/CiaranWoodward/broadcast_hub/gateway/grpcgw"
+	"github.com/CiaranWoodward/broadcast_hub/gateway/httpgw"
+	"github.com/CiaranWoodward/broadcast_hub/gateway/hubpb"
+	"github.com/CiaranWoodward/broadcast_hub/logging"
+	"github.com/CiaranWoodward/broadcast_hub/msg"
 	"github.com/CiaranWoodward/broadcast_hub/server"
+	"github.com/CiaranWoodward/broadcast_hub/server/boltstore"
+	"github.com/CiaranWoodward/broadcast_hub/server/redisbackplane"
+	"github.com/CiaranWoodward/broadcast_hub/transport/pipe"
+	paho "github.com/eclipse/paho.mqtt.golang"
+	gonats "github.com/nats-io/nats.go"
+	"github.com/redis/go-redis/v9"
 	"github.com/urfave/cli/v2"
+	"google.golang.org/grpc"
 )
 
 func main() {
@@ -23,11 +44,287 @@ func main() {
 		Action:                 runServer,
 		UseShortOptionHandling: true,
 		Flags: []cli.Flag{
+			&cli.StringSliceFlag{
+				Name:    "port",
+				Aliases: []string{"p"},
+				Usage:   "Listen on the given `PORT` (or range of ports, like 3030-3033) for incoming TCP connections on every interface. May be repeated. Required unless --listen or --unix is used.",
+			},
+			&cli.StringSliceFlag{
+				Name:  "listen",
+				Usage: "Listen for incoming connections on `ADDRESS`: either HOST:PORT (eg. 127.0.0.1:3030 or [::1]:3030), unix:PATH for a Unix domain socket, or pipe:NAME for a Windows named pipe. May be repeated.",
+			},
+			&cli.StringFlag{
+				Name:  "unix",
+				Usage: "Also listen for connections from local clients on the Unix domain socket at `PATH`.",
+			},
+			&cli.StringFlag{
+				Name:  "pipe",
+				Usage: "Also listen for connections from local clients on the Windows named pipe `NAME` (eg. bhub, for \\\\.\\pipe\\bhub).",
+			},
+			&cli.IntFlag{
+				Name:  "ws-port",
+				Usage: "Also listen on the given `PORT` for incoming websocket connections (eg. from browsers).",
+			},
+			&cli.StringSliceFlag{
+				Name:  "codec",
+				Usage: "Accept clients encoding messages with `CODEC`: cbor, json or cbor-framed. May be repeated to accept several on the same ports, relaying between clients using each of them. Defaults to cbor.",
+			},
+			&cli.IntFlag{
+				Name:  "grpc-port",
+				Usage: "Also serve the gRPC gateway on the given `PORT`, for services that don't speak the broadcast_hub protocol.",
+			},
+			&cli.IntFlag{
+				Name:  "http-port",
+				Usage: "Also serve the HTTP gateway on the given `PORT`, so webhooks and scripts can send relays with a single request.",
+			},
+			&cli.StringSliceFlag{
+				Name:  "http-api-key",
+				Usage: "Require requests to the HTTP gateway to present `KEY`. May be repeated to accept several keys.",
+			},
+			&cli.StringFlag{
+				Name:  "mqtt-broker",
+				Usage: "Bridge the --mqtt-topic topics to the MQTT broker at `URL`, eg. tcp://localhost:1883.",
+			},
+			&cli.StringSliceFlag{
+				Name:  "mqtt-topic",
+				Usage: "Bridge the hub topic `TOPIC` to the MQTT topic of the same name, or to a different MQTT topic given as HUB=MQTT. May be repeated.",
+			},
+			&cli.IntFlag{
+				Name:  "mqtt-qos",
+				Usage: "Publish and subscribe to MQTT topics with quality of service `QOS`: 0, 1 or 2.",
+			},
+			&cli.StringFlag{
+				Name:  "nats-url",
+				Usage: "Bridge the --nats-topic topics to the NATS server at `URL`, eg. nats://localhost:4222.",
+			},
+			&cli.StringSliceFlag{
+				Name:  "nats-topic",
+				Usage: "Bridge the hub topic `TOPIC` to the NATS subject of the same name, or to a different subject given as HUB=SUBJECT. May be repeated.",
+			},
+			&cli.IntFlag{
+				Name:  "buffer-size",
+				Usage: "Buffer up to `COUNT` relayed messages per client.",
+				Value: server.DefaultServerConfig().RelayBufferSize,
+			},
+			&cli.StringFlag{
+				Name:  "overflow-policy",
+				Usage: "What to do with relays to a client with a full buffer: `POLICY` is one of reject, drop-oldest or block.",
+				Value: server.OverflowReject.String(),
+			},
+			&cli.StringFlag{
+				Name:  "log-level",
+				Usage: "Only log entries of at least `LEVEL`: one of debug, info, warn or error.",
+				Value: "info",
+			},
+			&cli.DurationFlag{
+				Name:  "block-timeout",
+				Usage: "With the block overflow policy, wait up to `DURATION` for buffer space.",
+				Value: server.DefaultServerConfig().BlockTimeout,
+			},
+			&cli.DurationFlag{
+				Name:  "relay-deadline",
+				Usage: "Discard relays still waiting in a client's buffer after `DURATION`, rather than sending stale data. Zero waits forever.",
+			},
+			&cli.IntFlag{
+				Name:  "retry-queue",
+				Usage: "Queue up to `COUNT` reliable relays per client to retry, once its buffer is full.",
+				Value: server.DefaultServerConfig().RetryQueueSize,
+			},
+			&cli.DurationFlag{
+				Name:  "retry-timeout",
+				Usage: "Retry reliable relays for up to `DURATION`, before reporting the failure to the sender.",
+				Value: server.DefaultServerConfig().RetryTimeout,
+			},
+			&cli.DurationFlag{
+				Name:  "ping-interval",
+				Usage: "Ping clients every `DURATION`, and disconnect them if they stop responding. Zero disables keepalive.",
+			},
+			&cli.IntFlag{
+				Name:  "ping-misses",
+				Usage: "Disconnect clients after `COUNT` consecutive ping intervals without response.",
+				Value: server.DefaultServerConfig().PingMissThreshold,
+			},
+			&cli.DurationFlag{
+				Name:  "idle-timeout",
+				Usage: "Disconnect clients that send nothing and receive no relays for `DURATION`. With --ping-interval, they are pinged first. Zero never does.",
+			},
+			&cli.DurationFlag{
+				Name:  "write-timeout",
+				Usage: "Give up on each write to a client after `DURATION`. Zero waits forever.",
+				Value: 10 * time.Second,
+			},
+			&cli.IntFlag{
+				Name:  "slow-writes",
+				Usage: "Disconnect clients after `COUNT` writes to them in a row have timed out.",
+				Value: server.DefaultServerConfig().SlowWriteLimit,
+			},
+			&cli.IntFlag{
+				Name:  "write-buffer",
+				Usage: "Buffer up to `BYTES` of messages to each client while more are waiting, writing them together. Zero writes each separately.",
+			},
+			&cli.IntFlag{
+				Name:  "flush-after",
+				Usage: "With --write-buffer, write buffered messages once there are `COUNT` of them.",
+				Value: server.DefaultServerConfig().FlushAfter,
+			},
+			&cli.BoolFlag{
+				Name:  "allow-loopback",
+				Usage: "Allow clients to include themselves as a destination of their own relays.",
+			},
+			&cli.IntFlag{
+				Name:  "history",
+				Usage: "Keep the last `COUNT` relays to each topic and client, for clients to fetch later. Zero disables the history.",
+			},
+			&cli.DurationFlag{
+				Name:  "dedup-window",
+				Usage: "Remember the MsgUUID of each relay for `DURATION`, dropping any duplicates sent within it.",
+				Value: time.Minute,
+			},
+			&cli.DurationFlag{
+				Name:  "history-ttl",
+				Usage: "With --history, forget relays after `DURATION`. Zero keeps them until they are replaced.",
+			},
+			&cli.IntFlag{
+				Name:  "workers",
+				Usage: "Handle up to `COUNT` requests from each client concurrently. One handles each client's requests in order.",
+				Value: server.DefaultServerConfig().RequestWorkers,
+			},
+			&cli.IntFlag{
+				Name:  "fanout-workers",
+				Usage: "Deliver each relay with many destinations using up to `COUNT` goroutines.",
+				Value: server.DefaultServerConfig().FanOutWorkers,
+			},
+			&cli.IntFlag{
+				Name:  "max-pending",
+				Usage: "With --workers, reject requests as BUSY once a client has `COUNT` outstanding.",
+				Value: server.DefaultServerConfig().MaxPendingRequests,
+			},
+			&cli.IntFlag{
+				Name:  "max-clients",
+				Usage: "Refuse new clients once `COUNT` are connected. Zero is unlimited.",
+			},
+			&cli.IntFlag{
+				Name:  "max-conns-per-ip",
+				Usage: "Refuse new clients once `COUNT` are connected from the same IP address. Zero is unlimited.",
+			},
+			&cli.StringFlag{
+				Name:  "tls-cert",
+				Usage: "Accept TLS connections, using the PEM certificate in `FILE`. Requires --tls-key. Reloaded on SIGHUP.",
+			},
+			&cli.StringFlag{
+				Name:  "tls-key",
+				Usage: "Accept TLS connections, using the PEM private key in `FILE`. Requires --tls-cert. Reloaded on SIGHUP.",
+			},
+			&cli.StringSliceFlag{
+				Name:  "token",
+				Usage: "Require clients to authenticate with the given `TOKEN`. May be repeated to accept several tokens.",
+			},
+			&cli.StringSliceFlag{
+				Name:  "admin-token",
+				Usage: "Only share statistics with clients that authenticate with the given `TOKEN`. May be repeated.",
+			},
+			&cli.StringSliceFlag{
+				Name:  "namespace",
+				Usage: "Put clients authenticating with a token into a namespace, given as `TOKEN=NAMESPACE`. Clients only see others in their namespace. May be repeated.",
+			},
+			&cli.DurationFlag{
+				Name:  "auth-timeout",
+				Usage: "With --token, disconnect clients that haven't authenticated within `DURATION`.",
+				Value: server.DefaultServerConfig().AuthTimeout,
+			},
+			&cli.StringFlag{
+				Name:  "client-ids",
+				Usage: "Allocate client IDs in `MODE` sequential, random or persistent (stable IDs for authenticated clients, with --client-id-key).",
+				Value: "sequential",
+			},
+			&cli.StringFlag{
+				Name:  "client-id-key",
+				Usage: "With --client-ids persistent, derive the IDs of authenticated clients with the secret `KEY`.",
+			},
+			&cli.StringFlag{
+				Name:  "redis-backplane",
+				Usage: "Share clients with the other servers using the Redis server at `URL` (eg. redis://localhost:6379/0), forwarding relays to clients connected to any of them. Client IDs are random unless --client-ids is set.",
+			},
+			&cli.StringFlag{
+				Name:  "redis-prefix",
+				Usage: "With --redis-backplane, name the Redis channels with `PREFIX`, which the servers must share.",
+				Value: "bh",
+			},
+			&cli.StringFlag{
+				Name:  "store",
+				Usage: "Store relays for disconnected clients until they resume, in `TYPE` none, memory or bolt (with --store-file).",
+				Value: "none",
+			},
+			&cli.StringFlag{
+				Name:  "store-file",
+				Usage: "With --store bolt, keep stored relays in the database `FILE`.",
+				Value: "bhub-relays.db",
+			},
+			&cli.IntFlag{
+				Name:  "store-limit",
+				Usage: "Store up to `COUNT` relays per disconnected client. Zero for no limit.",
+				Value: 100,
+			},
+			&cli.StringFlag{
+				Name:  "audit-log",
+				Usage: "Record every relay in the audit log at `PATH`, as lines of JSON, or write them to stdout with -.",
+			},
+			&cli.Int64Flag{
+				Name:  "audit-max-size",
+				Usage: "Rotate the --audit-log file once it reaches `BYTES`. Zero never rotates it.",
+				Value: 100 << 20,
+			},
+			&cli.IntFlag{
+				Name:  "audit-files",
+				Usage: "Keep `COUNT` rotated --audit-log files, removing older ones.",
+				Value: 10,
+			},
+			&cli.BoolFlag{
+				Name:  "audit-payloads",
+				Usage: "Also record the message of each relay in the --audit-log.",
+			},
+			&cli.DurationFlag{
+				Name:  "session-timeout",
+				Usage: "With --store, disconnected clients can resume their session within `DURATION`.",
+				Value: server.DefaultServerConfig().SessionTimeout,
+			},
+			&cli.Float64Flag{
+				Name:  "relay-rate",
+				Usage: "Slow down clients sending more than `RATE` relays per second. Zero for no limit.",
+			},
+			&cli.IntFlag{
+				Name:  "relay-burst",
+				Usage: "With --relay-rate, allow bursts of up to `COUNT` relays before slowing clients down.",
+				Value: server.DefaultServerConfig().RelayRateLimit.Burst,
+			},
+			&cli.Uint64Flag{
+				Name:  "byte-quota",
+				Usage: "Reject relays from clients once they have relayed `BYTES` in a day (or --quota-window), counting each destination. Unlimited by default.",
+			},
+			&cli.DurationFlag{
+				Name:  "quota-window",
+				Usage: "Count --byte-quota over a rolling window of `DURATION`, instead of each day (UTC).",
+			},
+			&cli.BoolFlag{
+				Name:  "share-metadata",
+				Usage: "Let clients listing other clients see their names, connection times and address categories.",
+			},
+			&cli.IntFlag{
+				Name:  "admin-port",
+				Usage: "Serve the HTTP admin API on localhost `PORT`, for inspecting clients and changing the limits.",
+			},
+			&cli.StringFlag{
+				Name:  "limits",
+				Usage: "Read limits from the JSON `FILE`, in the form used by the admin API's /config, overriding those given as options. Reloaded on SIGHUP.",
+			},
 			&cli.IntFlag{
-				Name:     "port",
-				Aliases:  []string{"p"},
-				Usage:    "Listen on the given `PORT` for incoming TCP connections.",
-				Required: true,
+				Name:  "health-port",
+				Usage: "Serve just the /healthz and /readyz checks of the admin API on `PORT`, on every interface, for orchestration platforms to probe.",
+			},
+			&cli.DurationFlag{
+				Name:  "shutdown-timeout",
+				Usage: "On exit, wait up to `DURATION` for queued messages to be delivered before closing connections.",
+				Value: 5 * time.Second,
 			},
 		},
 	}
@@ -40,28 +337,444 @@ func main() {
 
 // Handle the top-level CLI arguments, start the parser
 func runServer(c *cli.Context) error {
-	port := c.Int("port")
+	certFile := c.String("tls-cert")
+	keyFile := c.String("tls-key")
 
-	if port < 1 || port > 0xFFFF {
-		log.Fatalf("PORT out of range: %d", port)
+	specs, err := listenAddresses(c.StringSlice("port"), c.StringSlice("listen"))
+	if err != nil {
+		log.Fatal(err)
 	}
-
-	// TCP connect
-	endpoint := fmt.Sprintf(":%d", port)
-	ser := server.NewServer()
-	listener, err := net.Listen("tcp", endpoint)
+	if unixPath := c.String("unix"); unixPath != "" {
+		specs = append(specs, listenSpec{network: "unix", addr: unixPath})
+	}
+	if pipeName := c.String("pipe"); pipeName != "" {
+		specs = append(specs, listenSpec{network: pipe.Network, addr: pipeName})
+	}
+	activated, err := activatedListeners()
 	if err != nil {
-		log.Fatalf("Failed to listen on port %d", port)
+		log.Fatalf("Failed to use sockets from systemd: %v", err)
+	}
+	if len(specs) == 0 && len(activated) == 0 {
+		log.Fatal("--port, --listen, --unix or --pipe must be provided, unless started by systemd socket activation")
+	}
+	if (certFile == "") != (keyFile == "") {
+		log.Fatal("--tls-cert and --tls-key must be provided together")
+	}
+
+	cfg := server.DefaultServerConfig()
+	cfg.RelayBufferSize = c.Int("buffer-size")
+	cfg.BlockTimeout = c.Duration("block-timeout")
+	cfg.RetryQueueSize = c.Int("retry-queue")
+	cfg.RetryTimeout = c.Duration("retry-timeout")
+	cfg.RelayDeadline = c.Duration("relay-deadline")
+	cfg.ShareClientMetadata = c.Bool("share-metadata")
+	cfg.PingInterval = c.Duration("ping-interval")
+	cfg.PingMissThreshold = c.Int("ping-misses")
+	cfg.IdleTimeout = c.Duration("idle-timeout")
+	cfg.WriteTimeout = c.Duration("write-timeout")
+	cfg.SlowWriteLimit = c.Int("slow-writes")
+	cfg.WriteBufferSize = c.Int("write-buffer")
+	cfg.FlushAfter = c.Int("flush-after")
+	cfg.RequestWorkers = c.Int("workers")
+	cfg.HistorySize = c.Int("history")
+	cfg.AllowLoopback = c.Bool("allow-loopback")
+	cfg.HistoryTTL = c.Duration("history-ttl")
+	cfg.DedupWindow = c.Duration("dedup-window")
+	cfg.MaxPendingRequests = c.Int("max-pending")
+	cfg.FanOutWorkers = c.Int("fanout-workers")
+	cfg.MaxTotalClients = c.Int("max-clients")
+	cfg.MaxConnsPerIP = c.Int("max-conns-per-ip")
+	cfg.AuthTimeout = c.Duration("auth-timeout")
+	admin_tokens := c.StringSlice("admin-token")
+	if tokens := c.StringSlice("token"); len(tokens) > 0 {
+		// Admin clients must be able to authenticate too
+		cfg.Authenticator = server.NewTokenAuthenticator(append(tokens, admin_tokens...)...)
+	}
+	if len(admin_tokens) > 0 {
+		cfg.AdminAuthenticator = server.NewTokenAuthenticator(admin_tokens...)
+	}
+	if namespaces := c.StringSlice("namespace"); len(namespaces) > 0 {
+		nsmap := make(server.NamespaceMap)
+		for _, n := range namespaces {
+			token, ns, ok := strings.Cut(n, "=")
+			if !ok || token == "" {
+				log.Fatalf("Invalid namespace %q, expected TOKEN=NAMESPACE", n)
+			}
+			nsmap[token] = ns
+		}
+		cfg.Namespacer = nsmap
+	}
+	cfg.SessionTimeout = c.Duration("session-timeout")
+	cfg.RelayRateLimit = server.RateLimit{Rate: c.Float64("relay-rate"), Burst: c.Int("relay-burst")}
+	cfg.ByteQuota = server.ByteQuota{Bytes: c.Uint64("byte-quota"), Window: c.Duration("quota-window")}
+	switch c.String("client-ids") {
+	case "sequential":
+	case "random":
+		cfg.ClientIdAllocator = server.RandomAllocator{}
+	case "persistent":
+		if c.String("client-id-key") == "" {
+			log.Fatalf("--client-ids persistent requires --client-id-key")
+		}
+		cfg.ClientIdAllocator = server.NewPersistentAllocator([]byte(c.String("client-id-key")))
+	default:
+		log.Fatalf("Unknown client ID allocation: %s", c.String("client-ids"))
+	}
+	if redisURL := c.String("redis-backplane"); redisURL != "" {
+		opts, err := redis.ParseURL(redisURL)
+		if err != nil {
+			log.Fatalf("Invalid Redis URL: %v", err)
+		}
+		if !c.IsSet("client-ids") {
+			cfg.ClientIdAllocator = server.RandomAllocator{}
+		} else if c.String("client-ids") == "sequential" {
+			log.Fatalf("--redis-backplane needs client IDs unique across servers, so can't use --client-ids sequential")
+		}
+		rdb := redis.NewClient(opts)
+		defer rdb.Close()
+		bp := redisbackplane.New(rdb, c.String("redis-prefix"))
+		defer bp.Close()
+		cfg.Backplane = bp
+	}
+	switch c.String("store") {
+	case "none":
+	case "memory":
+		cfg.MessageStore = server.NewMemoryStore(c.Int("store-limit"))
+	case "bolt":
+		store, err := boltstore.Open(c.String("store-file"), c.Int("store-limit"))
+		if err != nil {
+			log.Fatalf("Failed to open message store: %v", err)
+		}
+		defer store.Close()
+		cfg.MessageStore = store
+	default:
+		log.Fatalf("Unknown message store: %s", c.String("store"))
+	}
+	switch auditLog := c.String("audit-log"); auditLog {
+	case "":
+	case "-":
+		cfg.Audit = server.NewJSONAuditSink(os.Stdout)
+	default:
+		audit, err := server.OpenFileAuditSink(auditLog, c.Int64("audit-max-size"), c.Int("audit-files"))
+		if err != nil {
+			log.Fatalf("Failed to open audit log: %v", err)
+		}
+		defer audit.Close()
+		cfg.Audit = audit
+	}
+	cfg.AuditPayloads = c.Bool("audit-payloads")
+	if codecs := c.StringSlice("codec"); len(codecs) > 0 {
+		cfg.AllowedCodecs = nil
+		for _, name := range codecs {
+			codec, ok := msg.ParseCodec(name)
+			if !ok {
+				log.Fatalf("Unknown codec: %s", name)
+			}
+			cfg.AllowedCodecs = append(cfg.AllowedCodecs, codec)
+		}
+	}
+	policy, ok := server.ParseOverflowPolicy(c.String("overflow-policy"))
+	if !ok {
+		log.Fatalf("Unknown overflow policy: %s", c.String("overflow-policy"))
+	}
+	cfg.OverflowPolicy = policy
+	level, ok := logging.ParseLevel(c.String("log-level"))
+	if !ok {
+		log.Fatalf("Unknown log level: %s", c.String("log-level"))
+	}
+	cfg.Logger = logging.NewStd(nil, level)
+	limitsFile := c.String("limits")
+	if limitsFile != "" {
+		if cfg, err = readLimits(limitsFile, cfg); err != nil {
+			log.Fatalf("Failed to read limits: %v", err)
+		}
+	}
+
+	ser := server.NewServerWithConfig(cfg)
+	var reloader *server.CertificateReloader
+	if certFile != "" {
+		reloader, err = server.NewCertificateReloader(certFile, keyFile)
+		if err != nil {
+			log.Fatalf("Failed to load TLS certificate: %v", err)
+		}
+	}
+	// Serve clients on a listener, optionally wrapping TCP listeners with TLS
+	serve := func(l net.Listener) {
+		if reloader != nil && l.Addr().Network() == "tcp" {
+			ser.AddTLSListener(l, &tls.Config{GetCertificate: reloader.GetCertificate})
+			log.Printf("Successfully listening for TLS on %s.", l.Addr())
+		} else {
+			ser.AddListener(l)
+			log.Printf("Successfully listening on %s.", l.Addr())
+		}
+	}
+	for _, l := range activated {
+		serve(l)
+	}
+	// Local clients can use Unix domain sockets or named pipes, which are removed when the server shuts down
+	opened := make([]net.Listener, len(specs))
+	for i, spec := range specs {
+		opened[i], err = spec.listen()
+		if err != nil {
+			log.Fatalf("Failed to listen on %s: %v", spec.addr, err)
+		}
+		serve(opened[i])
 	}
-	ser.AddListener(listener)
 
-	log.Printf("Successfully listening on port %d.", port)
+	// Optionally serve websocket clients too
+	if wsPort := c.Int("ws-port"); wsPort != 0 {
+		if wsPort < 1 || wsPort > 0xFFFF {
+			log.Fatalf("Websocket PORT out of range: %d", wsPort)
+		}
+		wsListener, err := net.Listen("tcp", fmt.Sprintf(":%d", wsPort))
+		if err != nil {
+			log.Fatalf("Failed to listen on port %d", wsPort)
+		}
+		go http.Serve(wsListener, ser.WebSocketHandler())
+		log.Printf("Successfully listening for websockets on port %d.", wsPort)
+	}
+
+	// Optionally serve the gRPC gateway, whose sessions join the hub as clients
+	if grpcPort := c.Int("grpc-port"); grpcPort != 0 {
+		if grpcPort < 1 || grpcPort > 0xFFFF {
+			log.Fatalf("gRPC PORT out of range: %d", grpcPort)
+		}
+		grpcListener, err := net.Listen("tcp", fmt.Sprintf(":%d", grpcPort))
+		if err != nil {
+			log.Fatalf("Failed to listen on port %d", grpcPort)
+		}
+		gw := grpcgw.NewService(ser.AddClientByConnection, grpcgw.Config{})
+		defer gw.Shutdown()
+		gs := grpc.NewServer()
+		hubpb.RegisterHubServer(gs, gw)
+		defer gs.Stop()
+		go gs.Serve(grpcListener)
+		log.Printf("Successfully serving the gRPC gateway on port %d.", grpcPort)
+	}
+
+	// Optionally serve the HTTP gateway, for sending relays without a persistent connection
+	if httpPort := c.Int("http-port"); httpPort != 0 {
+		if httpPort < 1 || httpPort > 0xFFFF {
+			log.Fatalf("HTTP PORT out of range: %d", httpPort)
+		}
+		httpListener, err := net.Listen("tcp", fmt.Sprintf(":%d", httpPort))
+		if err != nil {
+			log.Fatalf("Failed to listen on port %d", httpPort)
+		}
+		apiKeys := c.StringSlice("http-api-key")
+		if len(apiKeys) == 0 {
+			log.Printf("Warning: the HTTP gateway has no API keys, so accepts requests from anyone.")
+		}
+		gw := httpgw.NewHandler(ser.AddClientByConnection, httpgw.Config{APIKeys: apiKeys})
+		defer gw.Close()
+		go http.Serve(httpListener, gw)
+		log.Printf("Successfully serving the HTTP gateway on port %d.", httpPort)
+	}
+
+	// Optionally bridge topics to an MQTT broker
+	if broker := c.String("mqtt-broker"); broker != "" {
+		qos := c.Int("mqtt-qos")
+		if qos < 0 || qos > 2 {
+			log.Fatalf("MQTT QOS out of range: %d", qos)
+		}
+		var topics []mqtt.TopicMapping
+		for _, t := range c.StringSlice("mqtt-topic") {
+			hubTopic, mqttTopic, _ := strings.Cut(t, "=")
+			topics = append(topics, mqtt.TopicMapping{Hub: hubTopic, MQTT: mqttTopic, QoS: byte(qos)})
+		}
+		mc := paho.NewClient(paho.NewClientOptions().AddBroker(broker).SetCleanSession(false).SetClientID("broadcast_hub"))
+		if tok := mc.Connect(); tok.Wait() && tok.Error() != nil {
+			log.Fatalf("Failed to connect to MQTT broker %s: %v", broker, tok.Error())
+		}
+		defer mc.Disconnect(250)
+		br, err := mqtt.New(ser.AddClientByConnection, mc, mqtt.Config{Topics: topics, Logger: cfg.Logger})
+		if err != nil {
+			log.Fatalf("Failed to bridge to MQTT: %v", err)
+		}
+		defer br.Close()
+		log.Printf("Successfully bridging %d topics to MQTT broker %s.", len(topics), broker)
+	}
+
+	// Optionally bridge topics to NATS
+	if natsURL := c.String("nats-url"); natsURL != "" {
+		var topics []nats.TopicMapping
+		for _, t := range c.StringSlice("nats-topic") {
+			hubTopic, subject, _ := strings.Cut(t, "=")
+			topics = append(topics, nats.TopicMapping{Hub: hubTopic, Subject: subject})
+		}
+		nc, err := gonats.Connect(natsURL, gonats.Name("broadcast_hub"))
+		if err != nil {
+			log.Fatalf("Failed to connect to NATS server %s: %v", natsURL, err)
+		}
+		defer nc.Close()
+		br, err := nats.New(ser.AddClientByConnection, nc, nats.Config{Topics: topics, Logger: cfg.Logger})
+		if err != nil {
+			log.Fatalf("Failed to bridge to NATS: %v", err)
+		}
+		defer br.Close()
+		log.Printf("Successfully bridging %d topics to NATS server %s.", len(topics), natsURL)
+	}
+
+	// Optionally serve the admin API, only to the local machine as it has no authentication
+	if adminPort := c.Int("admin-port"); adminPort != 0 {
+		if adminPort < 1 || adminPort > 0xFFFF {
+			log.Fatalf("Admin PORT out of range: %d", adminPort)
+		}
+		adminListener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", adminPort))
+		if err != nil {
+			log.Fatalf("Failed to listen on port %d", adminPort)
+		}
+		go http.Serve(adminListener, ser.AdminHandler())
+		log.Printf("Successfully serving the admin API on localhost port %d.", adminPort)
+	}
+	// Optionally serve the health checks to orchestration platforms, which probe from outside the machine
+	if healthPort := c.Int("health-port"); healthPort != 0 {
+		if healthPort < 1 || healthPort > 0xFFFF {
+			log.Fatalf("Health PORT out of range: %d", healthPort)
+		}
+		healthListener, err := net.Listen("tcp", fmt.Sprintf(":%d", healthPort))
+		if err != nil {
+			log.Fatalf("Failed to listen on port %d", healthPort)
+		}
+		go http.Serve(healthListener, ser.HealthHandler())
+		log.Printf("Successfully serving health checks on port %d.", healthPort)
+	}
 	log.Println("Use Ctl-C to exit.")
 
-	// Run until ctl-c
+	// Run until ctl-c or SIGTERM, reloading the certificate and limits, and re-opening listeners on SIGHUP
 	quit := make(chan os.Signal, 2)
-	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
-	<-quit
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range quit {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		if reloader != nil {
+			if err := reloader.Reload(); err != nil {
+				log.Printf("Failed to reload TLS certificate: %v", err)
+			} else {
+				log.Println("Reloaded TLS certificate.")
+			}
+		}
+		if limitsFile != "" {
+			if cfg, err := readLimits(limitsFile, ser.Config()); err != nil {
+				log.Printf("Failed to reload limits: %v", err)
+			} else {
+				ser.UpdateConfig(cfg)
+				log.Println("Reloaded limits.")
+			}
+		}
+		reopenListeners(specs, opened, serve)
+	}
+
+	// Let clients know we're going, and deliver what's already queued
+	log.Println("Shutting down...")
+	ctx, cancel := context.WithTimeout(context.Background(), c.Duration("shutdown-timeout"))
+	defer cancel()
+	if err := ser.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown incomplete, connections closed: %v", err)
+	}
 
 	return nil
 }
+
+// Read limits from the JSON file, replacing those of the configuration. Limits missing from the file are unchanged.
+func readLimits(path string, cfg server.ServerConfig) (server.ServerConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	limits := cfg.Limits()
+	if err := json.Unmarshal(data, &limits); err != nil {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg.WithLimits(limits), nil
+}
+
+// Address to listen on for clients, from the command line
+type listenSpec struct {
+	// "tcp", "unix" or "pipe"
+	network string
+	addr    string
+}
+
+// Start listening on the address
+func (ls listenSpec) listen() (net.Listener, error) {
+	switch ls.network {
+	case "unix":
+		return server.ListenUnix(ls.addr)
+	case pipe.Network:
+		return pipe.Listen(ls.addr)
+	}
+	return net.Listen("tcp", ls.addr)
+}
+
+// Close each listener opened from the command line and listen on its address again, such as to recreate a Unix domain
+// socket that was deleted. Connected clients aren't affected. A listener that can't be re-opened is left closed (and
+// nil), but is tried again next time.
+func reopenListeners(specs []listenSpec, opened []net.Listener, serve func(net.Listener)) {
+	for i, spec := range specs {
+		if opened[i] != nil {
+			opened[i].Close()
+		}
+		l, err := spec.listen()
+		if err != nil {
+			log.Printf("Failed to re-open %s: %v", spec.addr, err)
+			opened[i] = nil
+			continue
+		}
+		opened[i] = l
+		serve(l)
+	}
+}
+
+// Get the addresses to listen on, from the --port and --listen flags.
+// Ports listen on every interface, and may be a range like 3030-3033. Listen addresses are HOST:PORT, unix:PATH or
+// pipe:NAME.
+func listenAddresses(ports, listens []string) (specs []listenSpec, err error) {
+	for _, spec := range ports {
+		first, last, ok := strings.Cut(spec, "-")
+		if !ok {
+			last = first
+		}
+		from, err := parsePort(first)
+		if err != nil {
+			return nil, err
+		}
+		to, err := parsePort(last)
+		if err != nil {
+			return nil, err
+		}
+		if to < from {
+			return nil, fmt.Errorf("PORT range backwards: %s", spec)
+		}
+		for port := from; port <= to; port++ {
+			specs = append(specs, listenSpec{network: "tcp", addr: fmt.Sprintf(":%d", port)})
+		}
+	}
+	for _, addr := range listens {
+		if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+			specs = append(specs, listenSpec{network: "unix", addr: path})
+			continue
+		}
+		if name, ok := strings.CutPrefix(addr, "pipe:"); ok {
+			specs = append(specs, listenSpec{network: pipe.Network, addr: name})
+			continue
+		}
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid listen address %s: %w", addr, err)
+		}
+		if _, err = parsePort(port); err != nil {
+			return nil, err
+		}
+		specs = append(specs, listenSpec{network: "tcp", addr: addr})
+	}
+	return
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 0xFFFF {
+		return 0, fmt.Errorf("PORT out of range: %s", s)
+	}
+	return port, nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+// Socket activation is only supported with systemd, so there are never any activated listeners
+func activatedListeners() ([]net.Listener, error) {
+	return nil, nil
+}
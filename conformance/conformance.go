@@ -0,0 +1,242 @@
+/*
+Package conformance checks that implementations of the broadcast_hub protocol are compatible with this one.
+
+Vectors hold the exact encoding of every message type, each Status, and fields at the edges of their allowed lengths.
+DecodeCases are streams of messages, including malformed and oversized ones, along with what a stream decoder should
+make of them. TestTranscoder checks any msg.Transcoder against both.
+
+Scenarios exercise a running hub over real connections, speaking the protocol directly. TestServer runs all of them
+against a server endpoint.
+
+Example, checking a transcoder and a hub:
+
+	err := conformance.TestTranscoder(msg.CodecCBOR, msg.CodecCBOR.TranscoderWithLimits)
+	err = conformance.TestServer(func() (net.Conn, error) { return net.Dial("tcp", "localhost:3030") })
+
+Implementations in other languages can use the same vectors, written as JSON by WriteVectors, and check their hub
+with the scenarios. The bhconform command does both.
+*/
+package conformance
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Vector is a message, and its encoding with CBOR
+type Vector struct {
+	Name    string
+	Message msg.Message
+	// Hex CBOR encoding of the message, or empty if it isn't fixed, as the message contains a map whose keys may be
+	// encoded in any order. Framed CBOR is the same, with the length prefix.
+	Cbor string
+}
+
+// DecodeCase is a stream of encoded messages, and what a stream decoder should make of it
+type DecodeCase struct {
+	Name   string
+	Codec  msg.Codec
+	Limits msg.DecodeLimits
+	Stream []byte
+	// Result of each call to DecodeNext, in order. Unless the last is an error which isn't Recoverable, the call after
+	// must give an error which isn't a DecodeError, for the end of the stream.
+	Results []DecodeResult
+}
+
+// DecodeResult is what a stream decoder should give for one message
+type DecodeResult struct {
+	// ID of the message returned, if it should have one
+	MessageId uint32
+	// Status of the DecodeError, or SUCCESS if the message should decode without error
+	Status msg.Status
+	// Whether the DecodeError should be Recoverable
+	Recoverable bool
+}
+
+// TestTranscoder checks a Transcoder for the codec against the Vectors and DecodeCases.
+// 'newTranscoder' gets a Transcoder whose stream decoders enforce the limits, such as 'msg.Codec.TranscoderWithLimits'.
+// Returns an error describing every check that failed, or nil if they all passed.
+func TestTranscoder(codec msg.Codec, newTranscoder func(msg.DecodeLimits) msg.Transcoder) error {
+	var errs []error
+	fail := func(name, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s: %s", name, fmt.Sprintf(format, args...)))
+	}
+
+	tc := newTranscoder(msg.DecodeLimits{})
+	var stream bytes.Buffer
+	for _, v := range Vectors {
+		encoded, err := tc.Encode(v.Message)
+		if err != nil {
+			fail(v.Name, "failed to encode: %v", err)
+			continue
+		}
+		stream.Write(encoded)
+		expected, fixed, err := expectedEncoding(codec, v)
+		if err != nil {
+			fail(v.Name, "%v", err)
+			continue
+		}
+		if fixed && !bytes.Equal(encoded, expected) {
+			fail(v.Name, "encoded as %x, expected %x", encoded, expected)
+		}
+		if decoded, err := tc.Decode(encoded); err != nil {
+			fail(v.Name, "failed to decode: %v", err)
+		} else if !reflect.DeepEqual(decoded, v.Message) {
+			fail(v.Name, "decoded as %+v, expected %+v", decoded, v.Message)
+		}
+		// Another implementation's encoding may differ, where it isn't fixed, so only check it decodes the same
+		var buf bytes.Buffer
+		if err := tc.EncodeTo(&buf, v.Message); err != nil {
+			fail(v.Name, "failed to encode to a writer: %v", err)
+		} else if decoded, err := tc.Decode(buf.Bytes()); err != nil {
+			fail(v.Name, "encoded to a writer, failed to decode: %v", err)
+		} else if !reflect.DeepEqual(decoded, v.Message) {
+			fail(v.Name, "encoded to a writer, decoded as %+v, expected %+v", decoded, v.Message)
+		}
+	}
+
+	// Every vector again, back to back in one stream
+	dec := tc.NewStreamDecoder(&stream)
+	for _, v := range Vectors {
+		decoded, err := dec.DecodeNext()
+		if err != nil || !reflect.DeepEqual(decoded, v.Message) {
+			fail(v.Name, "stream decoded as %+v (error %v), expected %+v", decoded, err, v.Message)
+		}
+	}
+	if _, err := dec.DecodeNext(); err != io.EOF {
+		fail("Stream of vectors", "expected the end of the stream, got %v", err)
+	}
+
+	for _, dc := range DecodeCases {
+		if dc.Codec != codec {
+			continue
+		}
+		if err := checkDecodeCase(newTranscoder(dc.Limits), dc); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", dc.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Get the exact encoding of a vector with the codec, if it's fixed
+func expectedEncoding(codec msg.Codec, v Vector) (encoded []byte, fixed bool, err error) {
+	if v.Cbor == "" || codec == msg.CodecJSON {
+		return nil, false, nil
+	}
+	encoded, err = hex.DecodeString(v.Cbor)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid vector: %w", err)
+	}
+	if codec == msg.CodecFramedCBOR {
+		encoded = append(binary.BigEndian.AppendUint32(nil, uint32(len(encoded))), encoded...)
+	}
+	return encoded, true, nil
+}
+
+// Check a stream decoder gives the results expected by a case
+func checkDecodeCase(tc msg.Transcoder, dc DecodeCase) error {
+	dec := tc.NewStreamDecoder(bytes.NewReader(dc.Stream))
+	for i, want := range dc.Results {
+		m, err := dec.DecodeNext()
+		if want.Status == msg.SUCCESS {
+			if err != nil {
+				return fmt.Errorf("message %d: expected to decode, got %v", i, err)
+			}
+		} else if !errors.Is(err, want.Status) || msg.IsRecoverable(err) != want.Recoverable {
+			return fmt.Errorf("message %d: expected %v (recoverable %t), got %v (recoverable %t)",
+				i, want.Status, want.Recoverable, err, msg.IsRecoverable(err))
+		}
+		if want.MessageId != 0 && m.MessageId != want.MessageId {
+			return fmt.Errorf("message %d: expected message ID %d, got %d", i, want.MessageId, m.MessageId)
+		}
+	}
+	if n := len(dc.Results); n == 0 || dc.Results[n-1].Status == msg.SUCCESS || dc.Results[n-1].Recoverable {
+		_, err := dec.DecodeNext()
+		var de *msg.DecodeError
+		if err == nil || errors.As(err, &de) {
+			return fmt.Errorf("expected the end of the stream, got %v", err)
+		}
+	}
+	return nil
+}
+
+// Encode any value with a codec, for data that can't be represented as a Message
+func encodeValue(codec msg.Codec, v interface{}) ([]byte, error) {
+	switch codec {
+	case msg.CodecJSON:
+		return json.Marshal(v)
+	case msg.CodecFramedCBOR:
+		encoded, err := cbor.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		return append(binary.BigEndian.AppendUint32(nil, uint32(len(encoded))), encoded...), nil
+	default:
+		return cbor.Marshal(v)
+	}
+}
+
+// Vector as written by WriteVectors, with the message itself in JSON
+type jsonVector struct {
+	Name    string          `json:"name"`
+	Message json.RawMessage `json:"message"`
+	Cbor    string          `json:"cbor,omitempty"`
+}
+
+// DecodeCase as written by WriteVectors
+type jsonDecodeCase struct {
+	Name    string             `json:"name"`
+	Codec   string             `json:"codec"`
+	Limits  msg.DecodeLimits   `json:"limits"`
+	Stream  string             `json:"stream"`
+	Results []jsonDecodeResult `json:"results"`
+}
+
+// DecodeResult as written by WriteVectors, with the Status by name
+type jsonDecodeResult struct {
+	MessageId   uint32 `json:"id,omitempty"`
+	Status      string `json:"status"`
+	Recoverable bool   `json:"recoverable,omitempty"`
+}
+
+// WriteVectors writes the Vectors and DecodeCases as a JSON document, for testing implementations in other languages.
+// Each vector's message is written in the JSON codec, and streams are hex encoded.
+func WriteVectors(w io.Writer) error {
+	var doc struct {
+		Vectors     []jsonVector     `json:"vectors"`
+		DecodeCases []jsonDecodeCase `json:"decode_cases"`
+	}
+	tc := msg.CodecJSON.Transcoder()
+	for _, v := range Vectors {
+		encoded, err := tc.Encode(v.Message)
+		if err != nil {
+			return fmt.Errorf("%s: %w", v.Name, err)
+		}
+		doc.Vectors = append(doc.Vectors, jsonVector{Name: v.Name, Message: encoded, Cbor: v.Cbor})
+	}
+	for _, dc := range DecodeCases {
+		jdc := jsonDecodeCase{
+			Name:    dc.Name,
+			Codec:   dc.Codec.String(),
+			Limits:  dc.Limits,
+			Stream:  hex.EncodeToString(dc.Stream),
+			Results: []jsonDecodeResult{},
+		}
+		for _, r := range dc.Results {
+			jdc.Results = append(jdc.Results, jsonDecodeResult{MessageId: r.MessageId, Status: r.Status.String(), Recoverable: r.Recoverable})
+		}
+		doc.DecodeCases = append(doc.DecodeCases, jdc)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
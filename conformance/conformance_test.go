@@ -0,0 +1,38 @@
+package conformance
+
+import (
+	"net"
+	"testing"
+
+	"github.com/CiaranWoodward/broadcast_hub/logging"
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+	"github.com/CiaranWoodward/broadcast_hub/server"
+	"go.uber.org/goleak"
+)
+
+func TestTranscoders(t *testing.T) {
+	for _, codec := range []msg.Codec{msg.CodecCBOR, msg.CodecJSON, msg.CodecFramedCBOR} {
+		if err := TestTranscoder(codec, codec.TranscoderWithLimits); err != nil {
+			t.Errorf("%v: %v", codec, err)
+		}
+	}
+}
+
+func TestServers(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	cfg := server.DefaultServerConfig()
+	cfg.AllowedCodecs = []msg.Codec{msg.CodecCBOR, msg.CodecJSON, msg.CodecFramedCBOR}
+	cfg.Logger = logging.Discard
+	ser := server.NewServerWithConfig(cfg)
+	defer ser.Close()
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ser.AddListener(listener)
+
+	dial := func() (net.Conn, error) { return net.Dial("tcp", listener.Addr().String()) }
+	if err := TestServer(dial, cfg.AllowedCodecs...); err != nil {
+		t.Error(err)
+	}
+}
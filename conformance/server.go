@@ -0,0 +1,618 @@
+package conformance
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"time"
+
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// How long to wait for each response or indication from the hub
+const responseTimeout = 5 * time.Second
+
+// A destination no hub will have given to a client
+const unusedId = msg.ClientId(0xFFFFFFFFFFFFFFFF)
+
+// Dialer connects a new client to the hub being tested
+type Dialer func() (net.Conn, error)
+
+// Scenario is an exchange of messages with a hub, checking it behaves as the protocol requires.
+// Scenarios expect the hub's default configuration, apart from the codecs it accepts.
+type Scenario struct {
+	Name string
+	// Run the scenario, connecting as many clients as it needs with 'dial', all using the codec
+	Run func(dial Dialer, codec msg.Codec) error
+}
+
+// Scenarios covering each request a hub handles with its default configuration
+var Scenarios = []Scenario{
+	{"Identify", scenarioIdentify},
+	{"Ping", scenarioPing},
+	{"Hello", scenarioHello},
+	{"Unsupported Version", scenarioUnsupportedVersion},
+	{"Malformed Message", scenarioMalformed},
+	{"Relay", scenarioRelay},
+	{"Relay Lengths", scenarioRelayLengths},
+	{"Relay To Invalid Destination", scenarioInvalidDest},
+	{"Self Relay", scenarioSelfRelay},
+	{"Delivery Acknowledgement", scenarioAck},
+	{"Topics", scenarioTopics},
+	{"Names", scenarioNames},
+	{"List", scenarioList},
+	{"Presence", scenarioPresence},
+}
+
+// TestServer runs every Scenario against a hub, with each of the codecs (or just CBOR if none are given).
+// Returns an error describing every scenario that failed, or nil if they all passed.
+func TestServer(dial Dialer, codecs ...msg.Codec) error {
+	if len(codecs) == 0 {
+		codecs = []msg.Codec{msg.CodecCBOR}
+	}
+	var errs []error
+	for _, codec := range codecs {
+		for _, sc := range Scenarios {
+			if err := sc.Run(dial, codec); err != nil {
+				errs = append(errs, fmt.Errorf("%s (%v): %w", sc.Name, codec, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// A client of the hub being tested, speaking the protocol directly, so nothing is smoothed over by the client package
+type wire struct {
+	con     net.Conn
+	tc      msg.Transcoder
+	dec     msg.StreamDecoder
+	version msg.Version
+	mid     uint32
+	// Messages received while waiting for a different one
+	pending []msg.Message
+}
+
+// Connect a client to the hub, and get its ID
+func connect(dial Dialer, codec msg.Codec) (*wire, msg.ClientId, error) {
+	con, err := dial()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to connect: %w", err)
+	}
+	tc := codec.Transcoder()
+	w := &wire{con: con, tc: tc, dec: tc.NewStreamDecoder(con), version: msg.MyVersion}
+	rsp, err := w.request(msg.Message{IdReq: &msg.IdentifyRequest{}})
+	if err != nil {
+		con.Close()
+		return nil, 0, err
+	}
+	if rsp.IdRes == nil || rsp.IdRes.Id == 0 {
+		con.Close()
+		return nil, 0, unexpected("an Identify Response with a client ID", rsp)
+	}
+	return w, rsp.IdRes.Id, nil
+}
+
+func (w *wire) close() {
+	w.con.Close()
+}
+
+// Send a message, stamped with the connection's version unless it already has one
+func (w *wire) send(m msg.Message) error {
+	if m.Version == 0 {
+		m.Version = w.version
+	}
+	return w.tc.EncodeTo(w.con, m)
+}
+
+// Send a request with the next message ID, and wait for the response to it
+func (w *wire) request(m msg.Message) (msg.Message, error) {
+	w.mid++
+	m.MessageId = w.mid
+	if err := w.send(m); err != nil {
+		return msg.Message{}, fmt.Errorf("failed to send: %w", err)
+	}
+	return w.expect(fmt.Sprintf("response to message %d", m.MessageId), func(rsp msg.Message) bool {
+		return rsp.MessageId == m.MessageId && !isIndication(rsp)
+	})
+}
+
+// Wait for a message from the hub matching 'match', keeping any others for later
+func (w *wire) expect(what string, match func(msg.Message) bool) (msg.Message, error) {
+	for i, m := range w.pending {
+		if match(m) {
+			w.pending = append(w.pending[:i], w.pending[i+1:]...)
+			return m, nil
+		}
+	}
+	w.con.SetReadDeadline(time.Now().Add(responseTimeout))
+	defer w.con.SetReadDeadline(time.Time{})
+	for {
+		m, err := w.dec.DecodeNext()
+		if err != nil {
+			return m, fmt.Errorf("no %s: %w", what, err)
+		}
+		if m.PingReq != nil {
+			// Stay alive, if the hub checks
+			w.send(msg.Message{MessageId: m.MessageId, PingRes: &msg.PingResponse{}})
+			continue
+		}
+		if match(m) {
+			return m, nil
+		}
+		w.pending = append(w.pending, m)
+	}
+}
+
+// Wait for a relay from a client
+func (w *wire) expectRelay(src msg.ClientId) (*msg.RelayIndication, error) {
+	m, err := w.expect(fmt.Sprintf("relay from %d", src), func(m msg.Message) bool {
+		return m.RelayInd != nil && m.RelayInd.Src == src
+	})
+	return m.RelayInd, err
+}
+
+// Relay a message, checking the hub accepted it
+func (w *wire) relay(req msg.RelayRequest) (msg.ClientStatusMap, error) {
+	rsp, err := w.request(msg.Message{RelayReq: &req})
+	if err != nil {
+		return nil, err
+	}
+	if rsp.RelayRes == nil || rsp.RelayRes.Status != msg.SUCCESS {
+		return nil, unexpected("a successful Relay Response", rsp)
+	}
+	return rsp.RelayRes.StatusMap, nil
+}
+
+// Check whether a message was sent by the hub unprompted, rather than in response to a request
+func isIndication(m msg.Message) bool {
+	return m.RelayInd != nil || m.DelivInd != nil || m.PresInd != nil || m.FailInd != nil || m.GoingAway != nil ||
+		m.ServerFull != nil || m.Disconnect != nil || m.PingReq != nil
+}
+
+// Get the error for a message that wasn't what was expected
+func unexpected(expected string, got msg.Message) error {
+	return fmt.Errorf("expected %s, got %s", expected, describe(got))
+}
+
+// Describe a message for an error, with the contents of each command it holds
+func describe(m msg.Message) string {
+	s := fmt.Sprintf("message %d (version %d)", m.MessageId, m.Version)
+	for _, c := range []interface{}{m.IdRes, m.ListRes, m.RelayRes, m.RelayInd, m.SubRes, m.UnsubRes, m.PingRes, m.DelivInd,
+		m.NameRes, m.ResolvRes, m.HelloRes, m.AuthRes, m.PresRes, m.PresInd} {
+		if !reflect.ValueOf(c).IsNil() {
+			s += fmt.Sprintf(" %T%+v", c, c)
+		}
+	}
+	return s
+}
+
+// Connect two clients, for scenarios between them
+func connectPair(dial Dialer, codec msg.Codec) (a, b *wire, ida, idb msg.ClientId, err error) {
+	a, ida, err = connect(dial, codec)
+	if err != nil {
+		return
+	}
+	b, idb, err = connect(dial, codec)
+	if err != nil {
+		a.close()
+		return
+	}
+	if ida == idb {
+		a.close()
+		b.close()
+		err = fmt.Errorf("both clients were given ID %d", ida)
+	}
+	return
+}
+
+func scenarioIdentify(dial Dialer, codec msg.Codec) error {
+	a, b, ida, _, err := connectPair(dial, codec)
+	if err != nil {
+		return err
+	}
+	defer a.close()
+	defer b.close()
+	// The ID doesn't change
+	rsp, err := a.request(msg.Message{IdReq: &msg.IdentifyRequest{}})
+	if err != nil {
+		return err
+	}
+	if rsp.IdRes == nil || rsp.IdRes.Id != ida {
+		return unexpected(fmt.Sprintf("the same client ID (%d)", ida), rsp)
+	}
+	return nil
+}
+
+func scenarioPing(dial Dialer, codec msg.Codec) error {
+	a, _, err := connect(dial, codec)
+	if err != nil {
+		return err
+	}
+	defer a.close()
+	rsp, err := a.request(msg.Message{PingReq: &msg.PingRequest{}})
+	if err != nil {
+		return err
+	}
+	if rsp.PingRes == nil {
+		return unexpected("a Ping Response", rsp)
+	}
+	return nil
+}
+
+func scenarioHello(dial Dialer, codec msg.Codec) error {
+	a, _, err := connect(dial, codec)
+	if err != nil {
+		return err
+	}
+	defer a.close()
+
+	// No versions in common
+	rsp, err := a.request(msg.Message{HelloReq: &msg.HelloRequest{MinVersion: 1000, MaxVersion: 1001}})
+	if err != nil {
+		return err
+	}
+	if rsp.HelloRes == nil || rsp.HelloRes.Status != msg.VERSION_MISMATCH {
+		return unexpected("a VERSION_MISMATCH Hello Response", rsp)
+	}
+
+	// The newest version in common is agreed, and used from then on
+	rsp, err = a.request(msg.Message{HelloReq: &msg.HelloRequest{MinVersion: msg.MinVersion, MaxVersion: msg.MaxVersion}})
+	if err != nil {
+		return err
+	}
+	res := rsp.HelloRes
+	if res == nil || res.Status != msg.SUCCESS || res.Version < res.MinVersion || res.Version > res.MaxVersion ||
+		res.Version != min(res.MaxVersion, msg.MaxVersion) || rsp.Version != res.Version {
+		return unexpected(fmt.Sprintf("a successful Hello Response, agreeing the newest version up to %d", msg.MaxVersion), rsp)
+	}
+	a.version = res.Version
+	rsp, err = a.request(msg.Message{PingReq: &msg.PingRequest{}})
+	if err != nil {
+		return err
+	}
+	if rsp.PingRes == nil || rsp.Version != res.Version {
+		return unexpected(fmt.Sprintf("a Ping Response with version %d", res.Version), rsp)
+	}
+	return nil
+}
+
+func scenarioUnsupportedVersion(dial Dialer, codec msg.Codec) error {
+	a, _, err := connect(dial, codec)
+	if err != nil {
+		return err
+	}
+	defer a.close()
+	rsp, err := a.request(msg.Message{Version: 1000, PingReq: &msg.PingRequest{}})
+	if err != nil {
+		return err
+	}
+	if rsp.HelloRes == nil || rsp.HelloRes.Status != msg.VERSION_MISMATCH || rsp.HelloRes.MinVersion > rsp.HelloRes.MaxVersion {
+		return unexpected("a VERSION_MISMATCH Hello Response, with the supported versions", rsp)
+	}
+	// The connection carries on
+	rsp, err = a.request(msg.Message{PingReq: &msg.PingRequest{}})
+	if err != nil {
+		return err
+	}
+	if rsp.PingRes == nil {
+		return unexpected("a Ping Response", rsp)
+	}
+	return nil
+}
+
+func scenarioMalformed(dial Dialer, codec msg.Codec) error {
+	a, _, err := connect(dial, codec)
+	if err != nil {
+		return err
+	}
+	defer a.close()
+	bad, err := encodeValue(codec, wrongType{Version: msg.MyVersion, MessageId: "one"})
+	if err != nil {
+		return err
+	}
+	if _, err = a.con.Write(bad); err != nil {
+		return err
+	}
+	// The message is skipped, and the connection carries on
+	rsp, err := a.request(msg.Message{PingReq: &msg.PingRequest{}})
+	if err != nil {
+		return err
+	}
+	if rsp.PingRes == nil {
+		return unexpected("a Ping Response", rsp)
+	}
+	return nil
+}
+
+func scenarioRelay(dial Dialer, codec msg.Codec) error {
+	a, b, ida, idb, err := connectPair(dial, codec)
+	if err != nil {
+		return err
+	}
+	defer a.close()
+	defer b.close()
+	statuses, err := a.relay(msg.RelayRequest{Dest: []msg.ClientId{idb}, Msg: []byte("Hello"), ContentType: "text/plain"})
+	if err != nil {
+		return err
+	}
+	if len(statuses) != 0 {
+		return fmt.Errorf("expected no failures in the status map, got %v", statuses)
+	}
+	ind, err := b.expectRelay(ida)
+	if err != nil {
+		return err
+	}
+	if string(ind.Msg) != "Hello" || ind.ContentType != "text/plain" || ind.Topic != "" || ind.AckRequested {
+		return fmt.Errorf("relayed as %+v", ind)
+	}
+	return nil
+}
+
+func scenarioRelayLengths(dial Dialer, codec msg.Codec) error {
+	a, b, ida, idb, err := connectPair(dial, codec)
+	if err != nil {
+		return err
+	}
+	defer a.close()
+	defer b.close()
+
+	// The shortest and longest messages are relayed
+	for _, n := range []int{0, msg.DefaultMaxMsgLength} {
+		mesg := bytes.Repeat([]byte{0x55}, n)
+		if _, err = a.relay(msg.RelayRequest{Dest: []msg.ClientId{idb}, Msg: mesg}); err != nil {
+			return fmt.Errorf("%d bytes: %w", n, err)
+		}
+		ind, err := b.expectRelay(ida)
+		if err != nil {
+			return fmt.Errorf("%d bytes: %w", n, err)
+		}
+		if !bytes.Equal(ind.Msg, mesg) {
+			return fmt.Errorf("%d bytes: relayed %d bytes", n, len(ind.Msg))
+		}
+	}
+
+	// Any longer, or to too many destinations, isn't
+	dests := make([]msg.ClientId, msg.DefaultMaxDests+1)
+	for i := range dests {
+		dests[i] = idb
+	}
+	for _, req := range []msg.RelayRequest{
+		{Dest: []msg.ClientId{idb}, Msg: make([]byte, msg.DefaultMaxMsgLength+1)},
+		{Dest: dests, Msg: []byte("hi")},
+	} {
+		rsp, err := a.request(msg.Message{RelayReq: &req})
+		if err != nil {
+			return err
+		}
+		if rsp.RelayRes == nil || rsp.RelayRes.Status != msg.TOO_LONG {
+			return unexpected(fmt.Sprintf("a TOO_LONG Relay Response to %d bytes for %d destinations", len(req.Msg), len(req.Dest)), rsp)
+		}
+	}
+	return nil
+}
+
+func scenarioInvalidDest(dial Dialer, codec msg.Codec) error {
+	a, _, err := connect(dial, codec)
+	if err != nil {
+		return err
+	}
+	defer a.close()
+	statuses, err := a.relay(msg.RelayRequest{Dest: []msg.ClientId{unusedId}, Msg: []byte("Hello?")})
+	if err != nil {
+		return err
+	}
+	if statuses[unusedId] != msg.INVALID_ID || len(statuses) != 1 {
+		return fmt.Errorf("expected INVALID_ID for %d in the status map, got %v", unusedId, statuses)
+	}
+	return nil
+}
+
+func scenarioSelfRelay(dial Dialer, codec msg.Codec) error {
+	a, ida, err := connect(dial, codec)
+	if err != nil {
+		return err
+	}
+	defer a.close()
+	statuses, err := a.relay(msg.RelayRequest{Dest: []msg.ClientId{ida}, Msg: []byte("Me?")})
+	if err != nil {
+		return err
+	}
+	if statuses[ida] != msg.SELF_RELAY {
+		return fmt.Errorf("expected SELF_RELAY for %d in the status map, got %v", ida, statuses)
+	}
+
+	// Unless Loopback is set
+	statuses, err = a.relay(msg.RelayRequest{Dest: []msg.ClientId{ida}, Msg: []byte("Me!"), Loopback: true})
+	if err != nil {
+		return err
+	}
+	if len(statuses) != 0 {
+		return fmt.Errorf("expected no failures in the status map with Loopback, got %v", statuses)
+	}
+	ind, err := a.expectRelay(ida)
+	if err != nil {
+		return err
+	}
+	if string(ind.Msg) != "Me!" {
+		return fmt.Errorf("relayed as %+v", ind)
+	}
+	return nil
+}
+
+func scenarioAck(dial Dialer, codec msg.Codec) error {
+	a, b, ida, idb, err := connectPair(dial, codec)
+	if err != nil {
+		return err
+	}
+	defer a.close()
+	defer b.close()
+	if _, err = a.relay(msg.RelayRequest{Dest: []msg.ClientId{idb}, Msg: []byte("Got it?"), AckRequested: true}); err != nil {
+		return err
+	}
+	relayId := a.mid
+	ind, err := b.expectRelay(ida)
+	if err != nil {
+		return err
+	}
+	if !ind.AckRequested || ind.RelayId != relayId {
+		return fmt.Errorf("expected acknowledgement of message %d to be requested, relayed as %+v", relayId, ind)
+	}
+	if err = b.send(msg.Message{DelivReq: &msg.DeliveryRequest{Dest: ida, RelayId: relayId}}); err != nil {
+		return err
+	}
+	_, err = a.expect("Delivery Indication", func(m msg.Message) bool {
+		return m.DelivInd != nil && m.DelivInd.Src == idb && m.DelivInd.RelayId == relayId
+	})
+	return err
+}
+
+func scenarioTopics(dial Dialer, codec msg.Codec) error {
+	a, b, ida, idb, err := connectPair(dial, codec)
+	if err != nil {
+		return err
+	}
+	defer a.close()
+	defer b.close()
+	topic := fmt.Sprintf("conformance-%d", idb)
+
+	subscribe := func(topic string, expected msg.Status) error {
+		rsp, err := b.request(msg.Message{SubReq: &msg.SubscribeRequest{Topic: topic}})
+		if err != nil {
+			return err
+		}
+		if rsp.SubRes == nil || rsp.SubRes.Status != expected {
+			return unexpected(fmt.Sprintf("a Subscribe Response to %q with %v", topic, expected), rsp)
+		}
+		return nil
+	}
+	if err = subscribe("", msg.INVALID_ID); err != nil {
+		return err
+	}
+	if err = subscribe(topic, msg.SUCCESS); err != nil {
+		return err
+	}
+	if _, err = a.relay(msg.RelayRequest{Msg: []byte("News"), Topic: topic}); err != nil {
+		return err
+	}
+	ind, err := b.expectRelay(ida)
+	if err != nil {
+		return err
+	}
+	if string(ind.Msg) != "News" || ind.Topic != topic {
+		return fmt.Errorf("relayed as %+v", ind)
+	}
+
+	rsp, err := b.request(msg.Message{UnsubReq: &msg.UnsubscribeRequest{Topic: topic}})
+	if err != nil {
+		return err
+	}
+	if rsp.UnsubRes == nil || rsp.UnsubRes.Status != msg.SUCCESS {
+		return unexpected("a successful Unsubscribe Response", rsp)
+	}
+	return nil
+}
+
+func scenarioNames(dial Dialer, codec msg.Codec) error {
+	a, b, ida, _, err := connectPair(dial, codec)
+	if err != nil {
+		return err
+	}
+	defer a.close()
+	defer b.close()
+	name := fmt.Sprintf("conformance-%d", ida)
+
+	setName := func(w *wire, name string, expected msg.Status) error {
+		rsp, err := w.request(msg.Message{NameReq: &msg.SetNameRequest{Name: name}})
+		if err != nil {
+			return err
+		}
+		if rsp.NameRes == nil || rsp.NameRes.Status != expected {
+			return unexpected(fmt.Sprintf("a Set Name Response to %q with %v", name, expected), rsp)
+		}
+		return nil
+	}
+	resolve := func(name string, expected msg.Status, id msg.ClientId) error {
+		rsp, err := b.request(msg.Message{ResolvReq: &msg.ResolveNameRequest{Name: name}})
+		if err != nil {
+			return err
+		}
+		if rsp.ResolvRes == nil || rsp.ResolvRes.Status != expected || (expected == msg.SUCCESS && rsp.ResolvRes.Id != id) {
+			return unexpected(fmt.Sprintf("a Resolve Name Response to %q with %v", name, expected), rsp)
+		}
+		return nil
+	}
+
+	for _, step := range []func() error{
+		func() error { return setName(a, name, msg.SUCCESS) },
+		func() error { return resolve(name, msg.SUCCESS, ida) },
+		func() error { return setName(b, name, msg.NAME_IN_USE) },
+		func() error { return resolve(name+"-missing", msg.INVALID_ID, 0) },
+		// An empty name clears it
+		func() error { return setName(a, "", msg.SUCCESS) },
+		func() error { return resolve(name, msg.INVALID_ID, 0) },
+	} {
+		if err := step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func scenarioList(dial Dialer, codec msg.Codec) error {
+	a, b, ida, idb, err := connectPair(dial, codec)
+	if err != nil {
+		return err
+	}
+	defer a.close()
+	defer b.close()
+	rsp, err := a.request(msg.Message{ListReq: &msg.ListRequest{}})
+	if err != nil {
+		return err
+	}
+	if rsp.ListRes == nil || rsp.ListRes.Status != msg.SUCCESS {
+		return unexpected("a List Response", rsp)
+	}
+	found := false
+	for _, cid := range rsp.ListRes.Others {
+		if cid == ida {
+			return fmt.Errorf("client %d was listed to itself", ida)
+		}
+		found = found || cid == idb
+	}
+	if !found {
+		return fmt.Errorf("client %d wasn't listed in %v", idb, rsp.ListRes.Others)
+	}
+	return nil
+}
+
+func scenarioPresence(dial Dialer, codec msg.Codec) error {
+	a, _, err := connect(dial, codec)
+	if err != nil {
+		return err
+	}
+	defer a.close()
+	rsp, err := a.request(msg.Message{PresReq: &msg.PresenceRequest{Subscribe: true}})
+	if err != nil {
+		return err
+	}
+	if rsp.PresRes == nil || rsp.PresRes.Status != msg.SUCCESS {
+		return unexpected("a successful Presence Response", rsp)
+	}
+
+	b, idb, err := connect(dial, codec)
+	if err != nil {
+		return err
+	}
+	b.close()
+	for _, online := range []bool{true, false} {
+		_, err = a.expect(fmt.Sprintf("Presence Indication for %d (online %t)", idb, online), func(m msg.Message) bool {
+			return m.PresInd != nil && m.PresInd.Id == idb && m.PresInd.Online == online
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
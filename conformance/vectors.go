@@ -0,0 +1,608 @@
+package conformance
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// Vectors of every message type, each protocol Status, and the lengths where the CBOR encoding of a field changes size
+var Vectors = append(append(messageVectors, statusVectors()...), edgeVectors()...)
+
+// One of each message type
+var messageVectors = []Vector{
+	{
+		"Identify Request",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x12, IdReq: &msg.IdentifyRequest{}},
+		"a367626875627665720162696412626972a0",
+	},
+	{
+		"Identify Response",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x34, IdRes: &msg.IdentifyResponse{Id: 1234}},
+		"a36762687562766572016269641834624952a16269641904d2",
+	},
+	{
+		"List Request",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x56, ListReq: &msg.ListRequest{}},
+		"a36762687562766572016269641856626c72a0",
+	},
+	{
+		"List Response",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x78, ListRes: &msg.ListResponse{Others: []msg.ClientId{1, 2, 3, 0xFFFFFFFFFFFFFFFF}}},
+		"a36762687562766572016269641878624c52a1616f840102031bffffffffffffffff",
+	},
+	{
+		"Relay Request",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x9A, RelayReq: &msg.RelayRequest{Dest: []msg.ClientId{1, 2, 3}, Msg: []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xAB}}},
+		"a3676268756276657201626964189a627272a26364737483010203636d7367460123456789ab",
+	},
+	{
+		"Broadcast Relay Request",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x9B, RelayReq: &msg.RelayRequest{Msg: []byte{0x01, 0x23}, Broadcast: true}},
+		"a3676268756276657201626964189b627272a363647374f6636d7367420123626263f5",
+	},
+	{
+		"Relay Response",
+		msg.Message{Version: msg.MyVersion, MessageId: 0xBC, RelayRes: &msg.RelayResponse{Status: msg.SUCCESS, StatusMap: msg.ClientStatusMap{2: msg.NO_BUFFER, 3: msg.INVALID_ID}}},
+		"", // No byte comparison, as the status map is unordered
+	},
+	{
+		"Relay Indication",
+		msg.Message{Version: msg.MyVersion, MessageId: 0xDE, RelayInd: &msg.RelayIndication{Src: 1234, Msg: []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xAB}}},
+		"a367626875627665720162696418de625249a2637372631904d2636d7367460123456789ab",
+	},
+	{
+		"Topic Relay Request",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x9C, RelayReq: &msg.RelayRequest{Msg: []byte{0x01}, Topic: "news"}},
+		"a3676268756276657201626964189c627272a363647374f6636d73674101627470646e657773",
+	},
+	{
+		"Topic Relay Indication",
+		msg.Message{Version: msg.MyVersion, MessageId: 0xDF, RelayInd: &msg.RelayIndication{Src: 1234, Msg: []byte{0x01}, Topic: "news"}},
+		"a367626875627665720162696418df625249a3637372631904d2636d73674101627470646e657773",
+	},
+	{
+		"Subscribe Request",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x13, SubReq: &msg.SubscribeRequest{Topic: "news"}},
+		"a367626875627665720162696413627372a1627470646e657773",
+	},
+	{
+		"Subscribe Response",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x13, SubRes: &msg.SubscribeResponse{Status: msg.SUCCESS}},
+		"a367626875627665720162696413625352a16373746100",
+	},
+	{
+		"Unsubscribe Request",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x14, UnsubReq: &msg.UnsubscribeRequest{Topic: "news"}},
+		"a367626875627665720162696414627572a1627470646e657773",
+	},
+	{
+		"Unsubscribe Response",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x14, UnsubRes: &msg.UnsubscribeResponse{Status: msg.TOO_LONG}},
+		"a367626875627665720162696414625552a16373746106",
+	},
+	{
+		"Ping Request",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x15, PingReq: &msg.PingRequest{}},
+		"a367626875627665720162696415627072a0",
+	},
+	{
+		"Ping Response",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x15, PingRes: &msg.PingResponse{}},
+		"a367626875627665720162696415625052a0",
+	},
+	{
+		"Typed Relay Request",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x9E, RelayReq: &msg.RelayRequest{Dest: []msg.ClientId{1}, Msg: []byte("{}"), ContentType: "application/json"}},
+		"a3676268756276657201626964189e627272a3636473748101636d7367427b7d626374706170706c69636174696f6e2f6a736f6e",
+	},
+	{
+		"Typed Relay Indication",
+		msg.Message{Version: msg.MyVersion, MessageId: 0xE0, RelayInd: &msg.RelayIndication{Src: 1234, Msg: []byte("{}"), ContentType: "application/json", Timestamp: 1617055283000}},
+		"a367626875627665720162696418e0625249a4637372631904d2636d7367427b7d626374706170706c69636174696f6e2f6a736f6e6274731b0000017880017738",
+	},
+	{
+		"Acked Relay Request",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x9D, RelayReq: &msg.RelayRequest{Dest: []msg.ClientId{1}, Msg: []byte{0x01}, AckRequested: true}},
+		"a3676268756276657201626964189d627272a3636473748101636d736741016361636bf5",
+	},
+	{
+		"Acked Relay Indication",
+		msg.Message{Version: msg.MyVersion, MessageId: 0xE0, RelayInd: &msg.RelayIndication{Src: 1234, Msg: []byte{0x01}, AckRequested: true, RelayId: 0x9D}},
+		"a367626875627665720162696418e0625249a4637372631904d2636d736741016361636bf563726964189d",
+	},
+	{
+		"Delivery Request",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x16, DelivReq: &msg.DeliveryRequest{Dest: 1234, RelayId: 0x9D}},
+		"a367626875627665720162696416626472a2636473741904d263726964189d",
+	},
+	{
+		"Delivery Indication",
+		msg.Message{Version: msg.MyVersion, MessageId: 0xE1, DelivInd: &msg.DeliveryIndication{Src: 1, RelayId: 0x9D}},
+		"a367626875627665720162696418e1624449a2637372630163726964189d",
+	},
+	{
+		"Set Name Request",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x17, NameReq: &msg.SetNameRequest{Name: "alice"}},
+		"a367626875627665720162696417626e72a1616e65616c696365",
+	},
+	{
+		"Set Name Response",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x17, NameRes: &msg.SetNameResponse{Status: msg.NAME_IN_USE}},
+		"a367626875627665720162696417624e52a16373746109",
+	},
+	{
+		"Resolve Name Request",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x18, ResolvReq: &msg.ResolveNameRequest{Name: "alice"}},
+		"a3676268756276657201626964181862726ea1616e65616c696365",
+	},
+	{
+		"Resolve Name Response",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x18, ResolvRes: &msg.ResolveNameResponse{Status: msg.SUCCESS, Id: 1234}},
+		"a3676268756276657201626964181862524ea263737461006269641904d2",
+	},
+	{
+		"Going Away Indication",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x19, GoingAway: &msg.GoingAwayIndication{}},
+		"a36762687562766572016269641819624749a0",
+	},
+	{
+		"Hello Request",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x1a, HelloReq: &msg.HelloRequest{MinVersion: 1, MaxVersion: 2}},
+		"a3676268756276657201626964181a626872a2636d696e01636d617802",
+	},
+	{
+		"Hello Response",
+		msg.Message{Version: 2, MessageId: 0x1a, HelloRes: &msg.HelloResponse{Status: msg.SUCCESS, Version: 2, MinVersion: 1, MaxVersion: 2}},
+		"a3676268756276657202626964181a624852a463737461006376657202636d696e01636d617802",
+	},
+	{
+		"Auth Request",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x1b, AuthReq: &msg.AuthRequest{Credentials: msg.Credentials{Username: "alice", Password: "hunter2"}}},
+		"a3676268756276657201626964181b626172a1626372a26375737265616c696365637077646768756e74657232",
+	},
+	{
+		"Auth Response",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x1b, AuthRes: &msg.AuthResponse{Status: msg.UNAUTHENTICATED}},
+		"a3676268756276657201626964181b624152a1637374610c",
+	},
+	{
+		"Identify Response With Session",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x1c, IdRes: &msg.IdentifyResponse{Id: 1234, Session: "0123abcd"}},
+		"a3676268756276657201626964181c624952a26269641904d263736573683031323361626364",
+	},
+	{
+		"Resume Request",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x1d, ResumeReq: &msg.ResumeRequest{Id: 1234, Session: "0123abcd"}},
+		"a3676268756276657201626964181d627273a26269641904d263736573683031323361626364",
+	},
+	{
+		"Resume Response",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x1d, ResumeRes: &msg.ResumeResponse{Status: msg.INVALID_ID}},
+		"a3676268756276657201626964181d625253a16373746101",
+	},
+	{
+		"Presence Request",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x1e, PresReq: &msg.PresenceRequest{Subscribe: true}},
+		"a3676268756276657201626964181e627073a163737562f5",
+	},
+	{
+		"Presence Response",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x1e, PresRes: &msg.PresenceResponse{Status: msg.SUCCESS}},
+		"a3676268756276657201626964181e625053a16373746100",
+	},
+	{
+		"Presence Indication",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x1f, PresInd: &msg.PresenceIndication{Id: 1234, Online: true}},
+		"a3676268756276657201626964181f625049a26269641904d2626f6ef5",
+	},
+	{
+		"Group Create Request",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x20, GrpCreateReq: &msg.GroupCreateRequest{Group: "team"}},
+		"a36762687562766572016269641820626763a163677270647465616d",
+	},
+	{
+		"Group Create Response",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x20, GrpCreateRes: &msg.GroupCreateResponse{Status: msg.NAME_IN_USE}},
+		"a36762687562766572016269641820624743a16373746109",
+	},
+	{
+		"Group Join Request",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x21, GrpJoinReq: &msg.GroupJoinRequest{Group: "team"}},
+		"a3676268756276657201626964182162676aa163677270647465616d",
+	},
+	{
+		"Group Join Response",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x21, GrpJoinRes: &msg.GroupJoinResponse{Status: msg.SUCCESS}},
+		"a3676268756276657201626964182162474aa16373746100",
+	},
+	{
+		"Group Leave Request",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x22, GrpLeaveReq: &msg.GroupLeaveRequest{Group: "team"}},
+		"a3676268756276657201626964182262676ca163677270647465616d",
+	},
+	{
+		"Group Leave Response",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x22, GrpLeaveRes: &msg.GroupLeaveResponse{Status: msg.INVALID_ID}},
+		"a3676268756276657201626964182262474ca16373746101",
+	},
+	{
+		"Group List Request",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x23, GrpListReq: &msg.GroupListRequest{Group: "team"}},
+		"a36762687562766572016269641823626773a163677270647465616d",
+	},
+	{
+		"Group List Response",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x23, GrpListRes: &msg.GroupListResponse{Status: msg.SUCCESS, Members: []msg.ClientId{1, 2}}},
+		"a36762687562766572016269641823624753a26373746100636d656d820102",
+	},
+	{
+		"Group Relay Request",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x24, RelayReq: &msg.RelayRequest{Dest: []msg.ClientId{5}, Msg: []byte("hi"), DestGroups: []string{"team"}}},
+		"a36762687562766572016269641824627272a3636473748105636d736742686962646781647465616d",
+	},
+	{
+		"Reliable Relay Request",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x25, RelayReq: &msg.RelayRequest{Dest: []msg.ClientId{5}, Msg: []byte("hi"), Reliable: true}},
+		"a36762687562766572016269641825627272a3636473748105636d73674268696372656cf5",
+	},
+	{
+		"Relay Failure Indication",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x26, FailInd: &msg.RelayFailureIndication{Dest: 5, RelayId: 0x25, Status: msg.TIMEOUT}},
+		"a36762687562766572016269641826624649a363647374056372696418256373746105",
+	},
+	{
+		"Paged List Request",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x27, ListReq: &msg.ListRequest{Offset: 10, Limit: 5, Filter: "bot-", Metadata: true}},
+		"a36762687562766572016269641827626c72a4636f66660a636c696d0563666c7464626f742d626d64f5",
+	},
+	{
+		"Paged List Response",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x27, ListRes: &msg.ListResponse{Others: []msg.ClientId{11}, Next: 15,
+			Metadata: []msg.ClientMetadata{{Id: 11, Name: "bot-1", Connected: 1617000000000, Address: "private"}}}},
+		"a36762687562766572016269641827624c52a3616f810b636e78740f626d6481a46269640b616e65626f742d316263741b000001787cb5ea006261646770726976617465",
+	},
+	{
+		"History Request",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x28, HistReq: &msg.HistoryRequest{Topic: "news", Limit: 10, Since: 1617000000000}},
+		"a36762687562766572016269641828626879a3627470646e657773636c696d0a63736e631b000001787cb5ea00",
+	},
+	{
+		"History Response",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x28, HistRes: &msg.HistoryResponse{Status: msg.SUCCESS,
+			Relays: []msg.RelayIndication{{Src: 3, Msg: []byte("hi"), Topic: "news", Timestamp: 1617000000001}}}},
+		"a36762687562766572016269641828624859a263737461006372656c81a46373726303636d7367426869627470646e6577736274731b000001787cb5ea01",
+	},
+	{
+		"Loopback Relay Request",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x29, RelayReq: &msg.RelayRequest{Dest: []msg.ClientId{5}, Msg: []byte("hi"), Loopback: true}},
+		"a36762687562766572016269641829627272a3636473748105636d7367426869626c62f5",
+	},
+	{
+		"Server Full Indication",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x2a, ServerFull: &msg.ServerFullIndication{}},
+		"a3676268756276657201626964182a625346a0",
+	},
+	{
+		"Deduplicated Relay Request",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x2b, RelayReq: &msg.RelayRequest{Dest: []msg.ClientId{5}, Msg: []byte("hi"), MsgUUID: "f47ac10b-58cc-4372-a567-0e02b2c3d479"}},
+		"a3676268756276657201626964182b627272a3636473748105636d736742686963756964782466343761633130622d353863632d343337322d613536372d306530326232633364343739",
+	},
+	{
+		"High Priority Relay Request",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x2c, RelayReq: &msg.RelayRequest{Dest: []msg.ClientId{5}, Msg: []byte("hi"), Priority: msg.PriorityHigh}},
+		"a3676268756276657201626964182c627272a3636473748105636d73674268696370726901",
+	},
+	{
+		"Low Priority Relay Indication",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x2d, RelayInd: &msg.RelayIndication{Src: 5, Msg: []byte("hi"), Priority: msg.PriorityLow}},
+		"a3676268756276657201626964182d625249a36373726305636d73674268696370726920",
+	},
+	{
+		"Stats Request",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x2e, StatsReq: &msg.StatsRequest{}},
+		"a3676268756276657201626964182e627374a0",
+	},
+	{
+		"Stats Response",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x2e, StatsRes: &msg.StatsResponse{Status: msg.SUCCESS, Clients: 3, Uptime: 90000, RelayRate: 2.5,
+			BytesReceived: 1024, BytesSent: 65536}},
+		"a3676268756276657201626964182e625354a6637374610062636c036275701a00015f9063727073fb400400000000000062626919040062626f1a00010000",
+	},
+	{
+		"Verbose Relay Request",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x2f, RelayReq: &msg.RelayRequest{Dest: []msg.ClientId{5, 6}, Msg: []byte("hi"), Verbosity: msg.VerbosityAll}},
+		"a3676268756276657201626964182f627272a363647374820506636d736742686962766201",
+	},
+	{
+		"Verbose Relay Response",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x2f, RelayRes: &msg.RelayResponse{Status: msg.SUCCESS, StatusMap: msg.ClientStatusMap{5: msg.SUCCESS}}},
+		"a3676268756276657201626964182f625252a263737461006363736da10500",
+	},
+	{
+		"Relay Request With TTL",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x30, RelayReq: &msg.RelayRequest{Dest: []msg.ClientId{5}, Msg: []byte("hi"), AckRequested: true, TTL: 250}},
+		"a36762687562766572016269641830627272a4636473748105636d73674268696361636bf56374746c18fa",
+	},
+	{
+		"Relay Indication With TTL",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x30, RelayInd: &msg.RelayIndication{Src: 1, Msg: []byte("hi"), Timestamp: 1600000000000, TTL: 250}},
+		"a36762687562766572016269641830625249a46373726301636d73674268696274731b00000174876e80006374746c18fa",
+	},
+	{
+		"Compressed Relay Request",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x33, RelayReq: &msg.RelayRequest{Dest: []msg.ClientId{5}, Msg: []byte{0xca, 0xc8, 0x54, 0x80, 0x21, 0xc0, 0x00}, Compression: msg.CompressionDeflate}},
+		"a36762687562766572016269641833627272a3636473748105636d736747cac8548021c00063636d7001",
+	},
+	{
+		"Compressed Relay Indication",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x33, RelayInd: &msg.RelayIndication{Src: 1, Msg: []byte{0xca, 0xc8, 0x54, 0x80, 0x21, 0xc0, 0x00}, Compression: msg.CompressionDeflate}},
+		"a36762687562766572016269641833625249a36373726301636d736747cac8548021c00063636d7001",
+	},
+	{
+		"Disconnect Indication",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x34, Disconnect: &msg.DisconnectIndication{Reason: msg.FORBIDDEN}},
+		"a36762687562766572016269641834624458a16372736e0d",
+	},
+	{
+		"Server Full Indication While Draining",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x35, ServerFull: &msg.ServerFullIndication{Draining: true}},
+		"a36762687562766572016269641835625346a16364726ef5",
+	},
+	{
+		"Relay Request With Trace Context",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x36, Trace: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", RelayReq: &msg.RelayRequest{Dest: []msg.ClientId{5}, Msg: []byte("hi")}},
+		"a46762687562766572016269641836627463783730302d34626639326633353737623334646136613363653932396430653065343733362d303066303637616130626139303262372d3031627272a2636473748105636d7367426869",
+	},
+	{
+		"Relay Indication With Trace Context",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x36, Trace: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", RelayInd: &msg.RelayIndication{Src: 1, Msg: []byte("hi")}},
+		"a46762687562766572016269641836627463783730302d34626639326633353737623334646136613363653932396430653065343733362d303066303637616130626139303262372d3031625249a26373726301636d7367426869",
+	},
+	{
+		"Flow Update",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x37, FlowUpd: &msg.FlowUpdate{Credits: 100}},
+		"a36762687562766572016269641837626675a1636372641864",
+	},
+	{
+		"Relay Batch Request",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x38, RelayBatReq: &msg.RelayBatchRequest{Relays: []msg.RelayRequest{{Dest: []msg.ClientId{5}, Msg: []byte("hi")}, {Topic: "t", Msg: []byte("yo")}}, RelayIds: []uint32{0x38, 0x39}}},
+		"a36762687562766572016269641838627262a263726c7982a2636473748105636d7367426869a363647374f6636d736742796f6274706174637269648218381839",
+	},
+	{
+		"Relay Batch Response",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x38, RelayBatRes: &msg.RelayBatchResponse{Status: msg.SUCCESS, Results: []msg.RelayResponse{{Status: msg.SUCCESS, StatusMap: msg.ClientStatusMap{}}, {Status: msg.SUCCESS, StatusMap: msg.ClientStatusMap{6: msg.NO_BUFFER}}}}},
+		"a36762687562766572016269641838625242a263737461006372657382a263737461006363736da0a263737461006363736da10602",
+	},
+	{
+		"Error Response",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x39, Error: &msg.ErrorResponse{Status: msg.UNSUPPORTED, Text: "no"}},
+		"a36762687562766572016269641839624552a2637374611663747874626e6f",
+	},
+}
+
+// A Relay Response with each Status in its status map
+func statusVectors() []Vector {
+	var vectors []Vector
+	for s := msg.SUCCESS; s <= msg.UNSUPPORTED; s++ {
+		mid := 0x40 + uint32(s)
+		vectors = append(vectors, Vector{
+			"Relay Response With " + s.String(),
+			msg.Message{Version: msg.MyVersion, MessageId: mid, RelayRes: &msg.RelayResponse{Status: msg.SUCCESS, StatusMap: msg.ClientStatusMap{2: s}}},
+			cborHeader(msg.MyVersion, mid, "RR") + "a2" + cborText("sta") + "00" + cborText("csm") + "a1" + "02" + cborUint(uint64(s)),
+		})
+	}
+	return vectors
+}
+
+// Messages with fields at the edges of their allowed (or encoded) lengths
+func edgeVectors() []Vector {
+	vectors := []Vector{
+		{
+			"Largest Message ID",
+			msg.Message{Version: msg.MyVersion, MessageId: 0xFFFFFFFF, PingReq: &msg.PingRequest{}},
+			cborHeader(msg.MyVersion, 0xFFFFFFFF, "pr") + "a0",
+		},
+		{
+			"Two Byte Message ID",
+			msg.Message{Version: msg.MyVersion, MessageId: 0x100, PingReq: &msg.PingRequest{}},
+			cborHeader(msg.MyVersion, 0x100, "pr") + "a0",
+		},
+		{
+			"Largest Client ID",
+			msg.Message{Version: msg.MyVersion, MessageId: 0x50, IdRes: &msg.IdentifyResponse{Id: 0xFFFFFFFFFFFFFFFF}},
+			cborHeader(msg.MyVersion, 0x50, "IR") + "a1" + cborText("id") + "1bffffffffffffffff",
+		},
+		{
+			"Empty Relay Message",
+			msg.Message{Version: msg.MyVersion, MessageId: 0x51, RelayReq: &msg.RelayRequest{Dest: []msg.ClientId{1}, Msg: []byte{}}},
+			cborHeader(msg.MyVersion, 0x51, "rr") + "a2" + cborText("dst") + "8101" + cborText("msg") + "40",
+		},
+		{
+			"Unicode Name",
+			msg.Message{Version: msg.MyVersion, MessageId: 0x52, NameReq: &msg.SetNameRequest{Name: "Zoë 🦊"}},
+			cborHeader(msg.MyVersion, 0x52, "nr") + "a1" + cborText("n") + cborText("Zoë 🦊"),
+		},
+	}
+
+	// Most destinations the server accepts in a relay
+	dests := make([]msg.ClientId, msg.DefaultMaxDests)
+	destsHex := cborHead(4, uint64(len(dests)))
+	for i := range dests {
+		dests[i] = msg.ClientId(i + 1)
+		destsHex += cborUint(uint64(i + 1))
+	}
+	vectors = append(vectors, Vector{
+		"Most Destinations",
+		msg.Message{Version: msg.MyVersion, MessageId: 0x53, RelayReq: &msg.RelayRequest{Dest: dests, Msg: []byte("hi")}},
+		cborHeader(msg.MyVersion, 0x53, "rr") + "a2" + cborText("dst") + destsHex + cborText("msg") + cborBytes([]byte("hi")),
+	})
+
+	// Relays on each side of the lengths where a byte string's length takes another byte to encode, up to the longest
+	// the server accepts
+	for i, n := range []int{23, 24, 255, 256, msg.DefaultMaxMsgLength} {
+		mid := 0x60 + uint32(i)
+		mesg := bytes.Repeat([]byte{'a'}, n)
+		vectors = append(vectors, Vector{
+			fmt.Sprintf("Relay Indication Of %d Bytes", n),
+			msg.Message{Version: msg.MyVersion, MessageId: mid, RelayInd: &msg.RelayIndication{Src: 1, Msg: mesg}},
+			cborHeader(msg.MyVersion, mid, "RI") + "a2" + cborText("src") + "01" + cborText("msg") + cborBytes(mesg),
+		})
+	}
+	return vectors
+}
+
+// Get the hex CBOR encoding of the head of a data item, with its major type and argument
+func cborHead(major byte, n uint64) string {
+	switch {
+	case n < 24:
+		return hex.EncodeToString([]byte{major<<5 | byte(n)})
+	case n <= 0xFF:
+		return hex.EncodeToString([]byte{major<<5 | 24, byte(n)})
+	case n <= 0xFFFF:
+		return hex.EncodeToString(binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n)))
+	case n <= 0xFFFFFFFF:
+		return hex.EncodeToString(binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(n)))
+	default:
+		return hex.EncodeToString(binary.BigEndian.AppendUint64([]byte{major<<5 | 27}, n))
+	}
+}
+
+// Get the hex CBOR encoding of an unsigned integer
+func cborUint(n uint64) string {
+	return cborHead(0, n)
+}
+
+// Get the hex CBOR encoding of a byte string
+func cborBytes(b []byte) string {
+	return cborHead(2, uint64(len(b))) + hex.EncodeToString(b)
+}
+
+// Get the hex CBOR encoding of a text string
+func cborText(s string) string {
+	return cborHead(3, uint64(len(s))) + hex.EncodeToString([]byte(s))
+}
+
+// Get the hex CBOR encoding of the start of a message: a map of its version, ID and one command, up to the command's contents
+func cborHeader(version msg.Version, mid uint32, command string) string {
+	return "a3" + cborText("bhubver") + cborUint(uint64(version)) + cborText("id") + cborUint(uint64(mid)) + cborText(command)
+}
+
+// Stream decoding cases for each codec
+var DecodeCases = decodeCases()
+
+// Message with a field of the wrong type, which is well-formed but can't be decoded as a Message
+type wrongType struct {
+	Version   msg.Version `json:"bhubver"`
+	MessageId string      `json:"id"`
+}
+
+func decodeCases() []DecodeCase {
+	ping := func(version msg.Version, mid uint32) msg.Message {
+		return msg.Message{Version: version, MessageId: mid, PingReq: &msg.PingRequest{}}
+	}
+	relay := func(mid uint32, dest []msg.ClientId, mesg string) msg.Message {
+		return msg.Message{Version: msg.MyVersion, MessageId: mid, RelayReq: &msg.RelayRequest{Dest: dest, Msg: []byte(mesg)}}
+	}
+	ok := func(mid uint32) DecodeResult {
+		return DecodeResult{MessageId: mid, Status: msg.SUCCESS}
+	}
+
+	var cases []DecodeCase
+	for _, codec := range []msg.Codec{msg.CodecCBOR, msg.CodecJSON, msg.CodecFramedCBOR} {
+		// Concatenate the encodings of messages (and any other values) into a stream
+		stream := func(values ...interface{}) []byte {
+			var buf bytes.Buffer
+			for _, v := range values {
+				switch v := v.(type) {
+				case msg.Message:
+					encoded, err := codec.Transcoder().Encode(v)
+					if err != nil {
+						panic(fmt.Sprintf("conformance: can't encode %+v: %v", v, err))
+					}
+					buf.Write(encoded)
+				case []byte:
+					buf.Write(v)
+				default:
+					encoded, err := encodeValue(codec, v)
+					if err != nil {
+						panic(err)
+					}
+					buf.Write(encoded)
+				}
+			}
+			return buf.Bytes()
+		}
+		name := func(s string) string {
+			return fmt.Sprintf("%s (%v)", s, codec)
+		}
+
+		truncated := bytes.TrimSpace(stream(ping(msg.MyVersion, 1)))
+		cases = append(cases,
+			DecodeCase{
+				Name:    name("Consecutive Messages"),
+				Codec:   codec,
+				Stream:  stream(ping(msg.MyVersion, 1), ping(msg.MyVersion, 2), ping(msg.MyVersion, 3)),
+				Results: []DecodeResult{ok(1), ok(2), ok(3)},
+			},
+			DecodeCase{
+				Name:    name("Wrong Field Type"),
+				Codec:   codec,
+				Stream:  stream(wrongType{Version: msg.MyVersion, MessageId: "one"}, ping(msg.MyVersion, 2)),
+				Results: []DecodeResult{{Status: msg.ENCODING_ERROR, Recoverable: true}, ok(2)},
+			},
+			DecodeCase{
+				Name:    name("Unsupported Version"),
+				Codec:   codec,
+				Stream:  stream(ping(99, 3), ping(msg.MyVersion, 4)),
+				Results: []DecodeResult{{MessageId: 3, Status: msg.VERSION_MISMATCH, Recoverable: true}, ok(4)},
+			},
+			DecodeCase{
+				Name:    name("Too Many Destinations"),
+				Codec:   codec,
+				Limits:  msg.DecodeLimits{MaxDests: 2},
+				Stream:  stream(relay(1, []msg.ClientId{1, 2, 3}, "hi"), relay(2, []msg.ClientId{1, 2}, "hi")),
+				Results: []DecodeResult{{MessageId: 1, Status: msg.TOO_LONG, Recoverable: true}, ok(2)},
+			},
+			DecodeCase{
+				Name:    name("Relay Message Too Long"),
+				Codec:   codec,
+				Limits:  msg.DecodeLimits{MaxMsgLength: 4},
+				Stream:  stream(relay(1, []msg.ClientId{1}, "hello"), relay(2, []msg.ClientId{1}, "hiya")),
+				Results: []DecodeResult{{MessageId: 1, Status: msg.TOO_LONG, Recoverable: true}, ok(2)},
+			},
+			DecodeCase{
+				Name:    name("Encoded Message Too Large"),
+				Codec:   codec,
+				Limits:  msg.DecodeLimits{MaxMessageSize: 32},
+				Stream:  stream(relay(1, []msg.ClientId{1}, strings.Repeat("a", 64)), ping(msg.MyVersion, 2)),
+				Results: []DecodeResult{{Status: msg.TOO_LONG}},
+			},
+			DecodeCase{
+				Name:   name("Truncated Message"),
+				Codec:  codec,
+				Stream: truncated[:len(truncated)-1],
+			},
+		)
+
+		// Data which isn't a message at all can only be skipped if it's framed
+		malformed := DecodeCase{Name: name("Malformed Data"), Codec: codec}
+		switch codec {
+		case msg.CodecJSON:
+			malformed.Stream = stream(ping(msg.MyVersion, 1), []byte("{bad"))
+			malformed.Results = []DecodeResult{ok(1), {Status: msg.ENCODING_ERROR}}
+		case msg.CodecFramedCBOR:
+			malformed.Stream = stream(ping(msg.MyVersion, 1), []byte{0, 0, 0, 3, 0xff, 0xff, 0xff}, ping(msg.MyVersion, 2))
+			malformed.Results = []DecodeResult{ok(1), {Status: msg.ENCODING_ERROR, Recoverable: true}, ok(2)}
+		default:
+			malformed.Stream = stream(ping(msg.MyVersion, 1), []byte{0xff, 0xff})
+			malformed.Results = []DecodeResult{ok(1), {Status: msg.ENCODING_ERROR}}
+		}
+		cases = append(cases, malformed)
+	}
+	return cases
+}
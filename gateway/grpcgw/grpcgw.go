@@ -0,0 +1,302 @@
+/*
+Package grpcgw implements the hubpb.Hub gRPC service, so services in other languages can use a broadcast_hub server
+without implementing the CBOR wire protocol.
+
+Each session started with the Identify RPC is an ordinary client of the hub, connected to it in memory, so gRPC
+sessions and other clients can relay to each other. Sessions end with the Close RPC, when their client is disconnected
+by the hub, or after going unused for the SessionTimeout.
+
+Example, serving the gateway on port 9090 alongside the TCP listener:
+
+	ser := server.NewServer()
+	gw := grpcgw.NewService(ser.AddClientByConnection, grpcgw.Config{})
+	defer gw.Shutdown()
+	gs := grpc.NewServer()
+	hubpb.RegisterHubServer(gs, gw)
+	l, _ := net.Listen("tcp", ":9090")
+	go gs.Serve(l)
+*/
+package grpcgw
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/CiaranWoodward/broadcast_hub/client"
+	"github.com/CiaranWoodward/broadcast_hub/gateway/hubpb"
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Default values, used for any Config fields left as zero
+const defaultSessionTimeout = time.Minute
+
+// Config holds the tunable parameters of a Service.
+// The zero value is valid, and any fields left as zero are replaced with their defaults.
+type Config struct {
+	// How long a session is kept without any RPCs using it, before its client is disconnected.
+	// Sessions streaming relays don't time out.
+	SessionTimeout time.Duration
+	// Configuration of each session's client
+	ClientConfig client.ClientConfig
+}
+
+// Service implements the hubpb.Hub gRPC service, as a client of a hub for each session.
+// Register it with a grpc.Server using 'hubpb.RegisterHubServer'.
+type Service struct {
+	hubpb.UnimplementedHubServer
+	accept func(con net.Conn) bool
+	config Config
+	// Sessions by token, and a mutex protecting them
+	sessions       map[string]*session
+	sessions_mutex sync.Mutex
+}
+
+// Session started by the Identify RPC
+type session struct {
+	token string
+	cli   *client.Client
+	// Closes the session once it hasn't been used for the SessionTimeout
+	timer *time.Timer
+	// Number of RPCs using the session (guarded by sessions_mutex)
+	active int
+}
+
+// NewService creates a gRPC service, which connects the client of each session with 'accept'
+// (For example 'Server.AddClientByConnection').
+func NewService(accept func(con net.Conn) bool, cfg Config) *Service {
+	if cfg.SessionTimeout <= 0 {
+		cfg.SessionTimeout = defaultSessionTimeout
+	}
+	return &Service{
+		accept:   accept,
+		config:   cfg,
+		sessions: make(map[string]*session),
+	}
+}
+
+// Shutdown ends every session, disconnecting their clients from the hub
+func (s *Service) Shutdown() {
+	s.sessions_mutex.Lock()
+	sessions := s.sessions
+	s.sessions = make(map[string]*session)
+	s.sessions_mutex.Unlock()
+	for _, sess := range sessions {
+		sess.timer.Stop()
+		sess.cli.Close()
+	}
+}
+
+// Identify starts a new session, connecting a new client to the hub, and authenticating it with any credentials given
+func (s *Service) Identify(ctx context.Context, req *hubpb.IdentifyRequest) (*hubpb.IdentifyResponse, error) {
+	cli, ser := net.Pipe()
+	if !s.accept(ser) {
+		cli.Close()
+		return nil, status.Error(codes.Unavailable, "hub is not accepting clients")
+	}
+	c := client.NewClientWithConfig(cli, s.config.ClientConfig)
+	creds := msg.Credentials{Token: req.Token, Username: req.Username, Password: req.Password}
+	if creds != (msg.Credentials{}) {
+		if err := c.AuthenticateCtx(ctx, creds); err != nil {
+			c.Close()
+			return nil, statusError(err)
+		}
+	}
+	cid, err := c.GetClientIdCtx(ctx)
+	if err != nil {
+		c.Close()
+		return nil, statusError(err)
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	sess := &session{token: hex.EncodeToString(b), cli: c}
+	s.sessions_mutex.Lock()
+	s.sessions[sess.token] = sess
+	sess.timer = time.AfterFunc(s.config.SessionTimeout, func() { s.expire(sess) })
+	s.sessions_mutex.Unlock()
+	go s.watch(sess)
+	return &hubpb.IdentifyResponse{Id: uint64(cid), Session: sess.token}, nil
+}
+
+// List gets the IDs of the other clients connected to the hub
+func (s *Service) List(ctx context.Context, req *hubpb.ListRequest) (*hubpb.ListResponse, error) {
+	sess, err := s.acquire(req.Session)
+	if err != nil {
+		return nil, err
+	}
+	defer s.release(sess)
+	others, err := sess.cli.ListOtherClientsCtx(ctx)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	rsp := &hubpb.ListResponse{Others: make([]uint64, len(others))}
+	for i, cid := range others {
+		rsp.Others[i] = uint64(cid)
+	}
+	return rsp, nil
+}
+
+// Relay relays a message to the destinations, or to every other client or topic subscriber
+func (s *Service) Relay(ctx context.Context, req *hubpb.RelayRequest) (*hubpb.RelayResponse, error) {
+	sess, err := s.acquire(req.Session)
+	if err != nil {
+		return nil, err
+	}
+	defer s.release(sess)
+	var csm msg.ClientStatusMap
+	switch {
+	case req.Topic != "":
+		csm, err = sess.cli.PublishMessageCtx(ctx, req.Topic, req.Message)
+	case req.Broadcast:
+		csm, err = sess.cli.BroadcastMessageCtx(ctx, req.Message)
+	default:
+		dests := make([]msg.ClientId, len(req.Dest))
+		for i, cid := range req.Dest {
+			dests[i] = msg.ClientId(cid)
+		}
+		_, csm, err = sess.cli.RelayMessageWithOptionsCtx(ctx, req.Message, dests, client.RelayOptions{ContentType: req.ContentType})
+	}
+	if err != nil {
+		return nil, statusError(err)
+	}
+	rsp := &hubpb.RelayResponse{Failures: make(map[uint64]hubpb.Status, len(csm))}
+	for cid, st := range csm {
+		rsp.Failures[uint64(cid)] = hubpb.Status(st)
+	}
+	return rsp, nil
+}
+
+// Relays streams the relays sent to the session's client, until it disconnects or the call is cancelled.
+// Relays received while nothing is streaming them wait in the client's buffer, which blocks the client once full.
+func (s *Service) Relays(req *hubpb.RelaysRequest, stream hubpb.Hub_RelaysServer) error {
+	sess, err := s.acquire(req.Session)
+	if err != nil {
+		return err
+	}
+	defer s.release(sess)
+	for {
+		select {
+		case ind, ok := <-sess.cli.Relays:
+			if !ok {
+				return status.Error(codes.Unavailable, "disconnected from hub")
+			}
+			err := stream.Send(&hubpb.RelayIndication{
+				Source:      uint64(ind.Src),
+				Message:     ind.Msg,
+				Topic:       ind.Topic,
+				ContentType: ind.ContentType,
+				Timestamp:   ind.Timestamp,
+			})
+			if err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// Close ends a session, disconnecting its client from the hub
+func (s *Service) Close(ctx context.Context, req *hubpb.CloseRequest) (*hubpb.CloseResponse, error) {
+	s.sessions_mutex.Lock()
+	sess, ok := s.sessions[req.Session]
+	s.sessions_mutex.Unlock()
+	if !ok {
+		return nil, errNoSession
+	}
+	s.end(sess)
+	return &hubpb.CloseResponse{}, nil
+}
+
+// Error for RPCs with a session token that doesn't match any session
+var errNoSession = status.Error(codes.NotFound, "no such session")
+
+// Get a session for an RPC, stopping it from expiring until it's released
+func (s *Service) acquire(token string) (*session, error) {
+	s.sessions_mutex.Lock()
+	defer s.sessions_mutex.Unlock()
+	sess, ok := s.sessions[token]
+	if !ok {
+		return nil, errNoSession
+	}
+	sess.active++
+	sess.timer.Stop()
+	return sess, nil
+}
+
+// Finish using a session, restarting its timeout once nothing else is using it
+func (s *Service) release(sess *session) {
+	s.sessions_mutex.Lock()
+	defer s.sessions_mutex.Unlock()
+	sess.active--
+	if sess.active == 0 {
+		sess.timer.Reset(s.config.SessionTimeout)
+	}
+}
+
+// End a session that has timed out, unless an RPC started using it in the meantime
+func (s *Service) expire(sess *session) {
+	s.sessions_mutex.Lock()
+	idle := sess.active == 0
+	s.sessions_mutex.Unlock()
+	if idle {
+		s.end(sess)
+	}
+}
+
+// End a session once its client has disconnected
+func (s *Service) watch(sess *session) {
+	for range sess.cli.Events {
+	}
+	s.end(sess)
+}
+
+// Forget a session, and disconnect its client
+func (s *Service) end(sess *session) {
+	s.sessions_mutex.Lock()
+	if s.sessions[sess.token] == sess {
+		delete(s.sessions, sess.token)
+	}
+	sess.timer.Stop()
+	s.sessions_mutex.Unlock()
+	sess.cli.Close()
+}
+
+// Convert an error from the client library into a gRPC status error
+func statusError(err error) error {
+	var se *msg.StatusError
+	if !errors.As(err, &se) {
+		return status.Error(codes.Unknown, err.Error())
+	}
+	var code codes.Code
+	switch se.Status {
+	case msg.TIMEOUT:
+		code = codes.DeadlineExceeded
+	case msg.CANCELLED:
+		code = codes.Canceled
+	case msg.INVALID_ID:
+		code = codes.NotFound
+	case msg.TOO_LONG, msg.SELF_RELAY:
+		code = codes.InvalidArgument
+	case msg.UNAUTHENTICATED:
+		code = codes.Unauthenticated
+	case msg.FORBIDDEN, msg.FILTERED:
+		code = codes.PermissionDenied
+	case msg.NO_BUFFER, msg.BUSY, msg.QUOTA_EXCEEDED:
+		code = codes.ResourceExhausted
+	case msg.CONNECTION_ERROR, msg.GOING_AWAY, msg.SERVER_FULL, msg.DRAINING, msg.INACTIVE, msg.SLOW_CONSUMER:
+		code = codes.Unavailable
+	default:
+		code = codes.Internal
+	}
+	return status.Error(code, se.Error())
+}
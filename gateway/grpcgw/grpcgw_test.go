@@ -0,0 +1,105 @@
+package grpcgw
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/CiaranWoodward/broadcast_hub/client"
+	"github.com/CiaranWoodward/broadcast_hub/gateway/hubpb"
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+	"github.com/CiaranWoodward/broadcast_hub/server"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func TestGateway(t *testing.T) {
+	// Test that gRPC sessions can relay to and from ordinary clients of the hub
+	defer goleak.VerifyNone(t)
+
+	hub := server.NewServer()
+	gw := NewService(hub.AddClientByConnection, Config{})
+	gs := grpc.NewServer()
+	hubpb.RegisterHubServer(gs, gw)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go gs.Serve(l)
+	con, err := grpc.Dial(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.Nil(t, err)
+	hc := hubpb.NewHubClient(con)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cli, ser := net.Pipe()
+	hub.AddClientByConnection(ser)
+	native := client.NewClientWithConfig(cli, client.ClientConfig{IdentifyOnConnect: true})
+
+	id, err := hc.Identify(ctx, &hubpb.IdentifyRequest{})
+	assert.Nil(t, err)
+	list, err := hc.List(ctx, &hubpb.ListRequest{Session: id.Session})
+	assert.Nil(t, err)
+	assert.Equal(t, []uint64{uint64(native.ID())}, list.Others)
+
+	// Relay from the gRPC session to the native client, reporting failed destinations
+	rsp, err := hc.Relay(ctx, &hubpb.RelayRequest{Session: id.Session, Dest: []uint64{uint64(native.ID()), 999}, Message: []byte("hi"),
+		ContentType: "text/plain"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[uint64]hubpb.Status{999: hubpb.Status_INVALID_ID}, rsp.Failures)
+	ind := <-native.Relays
+	assert.Equal(t, msg.ClientId(id.Id), ind.Src)
+	assert.Equal(t, []byte("hi"), ind.Msg)
+	assert.Equal(t, "text/plain", ind.ContentType)
+
+	// And back again, through the stream
+	stream, err := hc.Relays(ctx, &hubpb.RelaysRequest{Session: id.Session})
+	assert.Nil(t, err)
+	_, err = native.RelayMessage([]byte("hello"), []msg.ClientId{msg.ClientId(id.Id)})
+	assert.Nil(t, err)
+	relayed, err := stream.Recv()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(native.ID()), relayed.Source)
+	assert.Equal(t, []byte("hello"), relayed.Message)
+	assert.NotZero(t, relayed.Timestamp)
+
+	// Closing the session ends the stream, and the session can't be used any more
+	_, err = hc.Close(ctx, &hubpb.CloseRequest{Session: id.Session})
+	assert.Nil(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	_, err = hc.List(ctx, &hubpb.ListRequest{Session: id.Session})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	con.Close()
+	gs.Stop()
+	gw.Shutdown()
+	native.Close()
+	hub.Close()
+}
+
+func TestGatewaySessionTimeout(t *testing.T) {
+	// Test that unused sessions are ended, and that credentials are passed on to the hub
+	defer goleak.VerifyNone(t)
+
+	hub := server.NewServerWithConfig(server.ServerConfig{Authenticator: server.NewTokenAuthenticator("secret")})
+	gw := NewService(hub.AddClientByConnection, Config{SessionTimeout: 50 * time.Millisecond})
+	ctx := context.Background()
+
+	_, err := gw.Identify(ctx, &hubpb.IdentifyRequest{Token: "wrong"})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	id, err := gw.Identify(ctx, &hubpb.IdentifyRequest{Token: "secret"})
+	assert.Nil(t, err)
+	_, err = gw.List(ctx, &hubpb.ListRequest{Session: id.Session})
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		_, err := gw.List(ctx, &hubpb.ListRequest{Session: id.Session})
+		return status.Code(err) == codes.NotFound
+	}, time.Second, 100*time.Millisecond)
+
+	gw.Shutdown()
+	hub.Close()
+}
@@ -0,0 +1,266 @@
+/*
+Package httpgw implements an HTTP gateway to a broadcast_hub server, so webhooks, curl and serverless functions can
+send relays without keeping a connection to the hub open.
+
+Requests are made by a single client of the hub, connected to it in memory, which every request shares. It's only for
+sending, so any relays sent to it are discarded. The gateway provides:
+  - POST /relay relays a message, eg. {"dest": [2, 3], "message": "hello"}. The message may be given as text in
+    "message", or base64 encoded in "data". "broadcast": true relays to every other client instead, and "topic" to every
+    subscriber of the topic. The response lists the destinations it couldn't be relayed to, eg. {"failures": {"3": "NO_BUFFER"}}
+  - GET /clients lists the IDs of the clients connected to the hub, eg. {"clients": [2, 3]}
+
+Requests must present one of the API keys, as "Authorization: Bearer KEY" or "X-API-Key: KEY", unless there are none.
+
+Example, serving the gateway on port 8081 alongside the TCP listener:
+
+	ser := server.NewServer()
+	gw := httpgw.NewHandler(ser.AddClientByConnection, httpgw.Config{APIKeys: []string{"secret"}})
+	defer gw.Close()
+	go http.ListenAndServe(":8081", gw)
+*/
+package httpgw
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/CiaranWoodward/broadcast_hub/client"
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// Default values, used for any Config fields left as zero
+const defaultMaxBodySize = 4096
+
+// Config holds the tunable parameters of a Handler.
+// The zero value is valid, and any fields left as zero are replaced with their defaults.
+type Config struct {
+	// Keys which requests must present one of. Empty allows every request, so should only be used on trusted networks.
+	APIKeys []string
+	// Maximum size of a request body, in bytes. Larger requests are rejected with 413 Request Entity Too Large.
+	MaxBodySize int64
+	// Credentials the gateway's client authenticates with, if the hub requires them
+	Credentials msg.Credentials
+	// Configuration of the gateway's client
+	ClientConfig client.ClientConfig
+}
+
+// Handler is an http.Handler serving the HTTP gateway, created with 'NewHandler'
+type Handler struct {
+	accept func(con net.Conn) bool
+	config Config
+	mux    *http.ServeMux
+	// Client shared by every request, connected when it's first needed (and again if it disconnects), and a mutex
+	// protecting it
+	cli       *client.Client
+	cli_mutex sync.Mutex
+	closed    bool
+}
+
+// Relay to send, as the body of POST /relay
+type relayRequest struct {
+	Dest        []msg.ClientId `json:"dest"`
+	Message     string         `json:"message"`
+	Data        []byte         `json:"data"`
+	Broadcast   bool           `json:"broadcast"`
+	Topic       string         `json:"topic"`
+	ContentType string         `json:"content_type"`
+}
+
+// Response to POST /relay
+type relayResponse struct {
+	Failures map[string]string `json:"failures"`
+}
+
+// Response to GET /clients
+type clientsResponse struct {
+	Clients []msg.ClientId `json:"clients"`
+}
+
+// NewHandler creates an HTTP gateway, whose client is connected to the hub with 'accept'
+// (For example 'Server.AddClientByConnection').
+func NewHandler(accept func(con net.Conn) bool, cfg Config) *Handler {
+	if cfg.MaxBodySize <= 0 {
+		cfg.MaxBodySize = defaultMaxBodySize
+	}
+	h := &Handler{accept: accept, config: cfg, mux: http.NewServeMux()}
+	h.mux.HandleFunc("/relay", h.handleRelay)
+	h.mux.HandleFunc("/clients", h.handleClients)
+	return h
+}
+
+// ServeHTTP handles a request to the gateway, once it has presented an API key
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		replyError(w, http.StatusUnauthorized, "missing or invalid API key")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, h.config.MaxBodySize)
+	h.mux.ServeHTTP(w, r)
+}
+
+// Close disconnects the gateway's client from the hub. Any further requests fail with 503 Service Unavailable.
+func (h *Handler) Close() {
+	h.cli_mutex.Lock()
+	defer h.cli_mutex.Unlock()
+	h.closed = true
+	if h.cli != nil {
+		h.cli.Close()
+	}
+}
+
+// Check the request's API key against the list, in constant time
+func (h *Handler) authorized(r *http.Request) bool {
+	if len(h.config.APIKeys) == 0 {
+		return true
+	}
+	key := r.Header.Get("X-API-Key")
+	if auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		key = auth
+	}
+	ok := 0
+	for _, k := range h.config.APIKeys {
+		ok |= subtle.ConstantTimeCompare([]byte(k), []byte(key))
+	}
+	return ok == 1 && key != ""
+}
+
+// Get the gateway's client, connecting it to the hub if it isn't already
+func (h *Handler) client(ctx context.Context) (*client.Client, error) {
+	h.cli_mutex.Lock()
+	defer h.cli_mutex.Unlock()
+	if h.closed {
+		return nil, msg.NewStatusError(msg.GOING_AWAY, 0, nil)
+	}
+	if h.cli != nil && h.cli.State() == client.Connected {
+		return h.cli, nil
+	}
+	cli, ser := net.Pipe()
+	if !h.accept(ser) {
+		cli.Close()
+		return nil, msg.NewStatusError(msg.CONNECTION_ERROR, 0, nil)
+	}
+	c := client.NewClientWithConfig(cli, h.config.ClientConfig)
+	// The gateway only sends, so discard anything sent to it
+	c.OnRelay(func(msg.RelayIndication) {})
+	if h.config.Credentials != (msg.Credentials{}) {
+		if err := c.AuthenticateCtx(ctx, h.config.Credentials); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	h.cli = c
+	return c, nil
+}
+
+// Handle relaying a message
+func (h *Handler) handleRelay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		replyError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req relayRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			replyError(w, http.StatusRequestEntityTooLarge, "request too large")
+			return
+		}
+		replyError(w, http.StatusBadRequest, "invalid relay: "+err.Error())
+		return
+	}
+	message := req.Data
+	if req.Message != "" {
+		message = []byte(req.Message)
+	}
+	c, err := h.client(r.Context())
+	if err != nil {
+		replyStatusError(w, err)
+		return
+	}
+	var csm msg.ClientStatusMap
+	switch {
+	case req.Topic != "":
+		csm, err = c.PublishMessageCtx(r.Context(), req.Topic, message)
+	case req.Broadcast:
+		csm, err = c.BroadcastMessageCtx(r.Context(), message)
+	default:
+		_, csm, err = c.RelayMessageWithOptionsCtx(r.Context(), message, req.Dest, client.RelayOptions{ContentType: req.ContentType})
+	}
+	if err != nil {
+		replyStatusError(w, err)
+		return
+	}
+	rsp := relayResponse{Failures: make(map[string]string, len(csm))}
+	for cid, status := range csm {
+		rsp.Failures[strconv.FormatUint(uint64(cid), 10)] = status.String()
+	}
+	reply(w, rsp)
+}
+
+// Handle listing the clients connected to the hub
+func (h *Handler) handleClients(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		replyError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	c, err := h.client(r.Context())
+	if err != nil {
+		replyStatusError(w, err)
+		return
+	}
+	others, err := c.ListOtherClientsCtx(r.Context())
+	if err != nil {
+		replyStatusError(w, err)
+		return
+	}
+	if others == nil {
+		others = []msg.ClientId{}
+	}
+	reply(w, clientsResponse{Clients: others})
+}
+
+// Write a JSON response
+func reply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// Write a JSON error response
+func replyError(w http.ResponseWriter, code int, reason string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": reason})
+}
+
+// Write a JSON error response for an error from the client library, with the closest matching HTTP status
+func replyStatusError(w http.ResponseWriter, err error) {
+	var se *msg.StatusError
+	if !errors.As(err, &se) {
+		replyError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	var code int
+	switch se.Status {
+	case msg.TIMEOUT:
+		code = http.StatusGatewayTimeout
+	case msg.TOO_LONG, msg.SELF_RELAY, msg.INVALID_ID:
+		code = http.StatusBadRequest
+	case msg.UNAUTHENTICATED, msg.FORBIDDEN, msg.FILTERED:
+		code = http.StatusForbidden
+	case msg.NO_BUFFER, msg.BUSY, msg.QUOTA_EXCEEDED:
+		code = http.StatusTooManyRequests
+	case msg.CONNECTION_ERROR, msg.GOING_AWAY, msg.SERVER_FULL, msg.DRAINING, msg.INACTIVE, msg.SLOW_CONSUMER:
+		code = http.StatusServiceUnavailable
+	default:
+		code = http.StatusBadGateway
+	}
+	replyError(w, code, err.Error())
+}
@@ -0,0 +1,102 @@
+package httpgw
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/CiaranWoodward/broadcast_hub/client"
+	"github.com/CiaranWoodward/broadcast_hub/server"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+)
+
+// Make a request to the gateway, returning the response status and decoded JSON body
+func request(t *testing.T, h http.Handler, method, path, key, body string) (int, map[string]interface{}) {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	var rsp map[string]interface{}
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &rsp))
+	return rec.Code, rsp
+}
+
+func TestGateway(t *testing.T) {
+	// Test that HTTP requests can list the hub's clients and relay to them
+	defer goleak.VerifyNone(t)
+
+	hub := server.NewServer()
+	gw := NewHandler(hub.AddClientByConnection, Config{APIKeys: []string{"secret"}})
+
+	cli, ser := net.Pipe()
+	hub.AddClientByConnection(ser)
+	native := client.NewClientWithConfig(cli, client.ClientConfig{IdentifyOnConnect: true})
+
+	code, rsp := request(t, gw, http.MethodGet, "/clients", "secret", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []interface{}{float64(native.ID())}, rsp["clients"])
+
+	// Relay text to the native client, reporting failed destinations
+	code, rsp = request(t, gw, http.MethodPost, "/relay", "secret", fmt.Sprintf(`{"dest": [%d, 999], "message": "hi", "content_type": "text/plain"}`, native.ID()))
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]interface{}{"999": "INVALID_ID"}, rsp["failures"])
+	ind := <-native.Relays
+	assert.Equal(t, []byte("hi"), ind.Msg)
+	assert.Equal(t, "text/plain", ind.ContentType)
+
+	// And binary data, by broadcast
+	code, rsp = request(t, gw, http.MethodPost, "/relay", "secret", `{"broadcast": true, "data": "AAEC"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Empty(t, rsp["failures"])
+	ind = <-native.Relays
+	assert.Equal(t, []byte{0, 1, 2}, ind.Msg)
+
+	// The API key is required, either way it can be presented
+	code, rsp = request(t, gw, http.MethodGet, "/clients", "", "")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.NotEmpty(t, rsp["error"])
+	code, _ = request(t, gw, http.MethodGet, "/clients", "wrong", "")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	req := httptest.NewRequest(http.MethodGet, "/clients", nil)
+	req.Header.Set("X-API-Key", "secret")
+	rec := httptest.NewRecorder()
+	gw.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// Bad requests are rejected
+	code, _ = request(t, gw, http.MethodGet, "/relay", "secret", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+	code, _ = request(t, gw, http.MethodPost, "/relay", "secret", `{"dest": [1], "message": `)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = request(t, gw, http.MethodPost, "/relay", "secret", `{"dest": [1], "message": "`+strings.Repeat("x", 1500)+`"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// Closing the gateway disconnects its client, and it can't be used any more
+	gw.Close()
+	code, _ = request(t, gw, http.MethodGet, "/clients", "secret", "")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	native.Close()
+}
+
+func TestGatewayBodySize(t *testing.T) {
+	// Test that request bodies over the limit are rejected, without connecting to the hub
+	defer goleak.VerifyNone(t)
+
+	gw := NewHandler(func(con net.Conn) bool {
+		t.Error("Gateway connected to the hub")
+		con.Close()
+		return false
+	}, Config{MaxBodySize: 64})
+	defer gw.Close()
+
+	code, rsp := request(t, gw, http.MethodPost, "/relay", "", `{"dest": [1], "message": "`+strings.Repeat("x", 64)+`"}`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, code)
+	assert.Equal(t, "request too large", rsp["error"])
+}
@@ -0,0 +1,7 @@
+/*
+Package hubpb holds the protocol buffer messages and gRPC service of the broadcast_hub gRPC gateway, generated from
+hub.proto. The service is implemented by the grpcgw package.
+*/
+package hubpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative hub.proto
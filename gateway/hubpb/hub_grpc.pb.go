@@ -0,0 +1,298 @@
+// gRPC interface to a broadcast_hub server, for services that would rather not implement the CBOR wire protocol.
+// It's served by the grpcgw package.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             v4.25.3
+// source: hub.proto
+
+package hubpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Hub_Identify_FullMethodName = "/hubpb.Hub/Identify"
+	Hub_List_FullMethodName     = "/hubpb.Hub/List"
+	Hub_Relay_FullMethodName    = "/hubpb.Hub/Relay"
+	Hub_Relays_FullMethodName   = "/hubpb.Hub/Relays"
+	Hub_Close_FullMethodName    = "/hubpb.Hub/Close"
+)
+
+// HubClient is the client API for Hub service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type HubClient interface {
+	// Start a new session, which joins the hub as a new client
+	Identify(ctx context.Context, in *IdentifyRequest, opts ...grpc.CallOption) (*IdentifyResponse, error)
+	// List the IDs of the other clients connected to the hub
+	List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResponse, error)
+	// Relay a message to other clients
+	Relay(ctx context.Context, in *RelayRequest, opts ...grpc.CallOption) (*RelayResponse, error)
+	// Stream the relays sent to the session's client, until it disconnects or the call is cancelled
+	Relays(ctx context.Context, in *RelaysRequest, opts ...grpc.CallOption) (Hub_RelaysClient, error)
+	// End a session, disconnecting its client from the hub
+	Close(ctx context.Context, in *CloseRequest, opts ...grpc.CallOption) (*CloseResponse, error)
+}
+
+type hubClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewHubClient(cc grpc.ClientConnInterface) HubClient {
+	return &hubClient{cc}
+}
+
+func (c *hubClient) Identify(ctx context.Context, in *IdentifyRequest, opts ...grpc.CallOption) (*IdentifyResponse, error) {
+	out := new(IdentifyResponse)
+	err := c.cc.Invoke(ctx, Hub_Identify_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *hubClient) List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResponse, error) {
+	out := new(ListResponse)
+	err := c.cc.Invoke(ctx, Hub_List_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *hubClient) Relay(ctx context.Context, in *RelayRequest, opts ...grpc.CallOption) (*RelayResponse, error) {
+	out := new(RelayResponse)
+	err := c.cc.Invoke(ctx, Hub_Relay_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *hubClient) Relays(ctx context.Context, in *RelaysRequest, opts ...grpc.CallOption) (Hub_RelaysClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Hub_ServiceDesc.Streams[0], Hub_Relays_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &hubRelaysClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Hub_RelaysClient interface {
+	Recv() (*RelayIndication, error)
+	grpc.ClientStream
+}
+
+type hubRelaysClient struct {
+	grpc.ClientStream
+}
+
+func (x *hubRelaysClient) Recv() (*RelayIndication, error) {
+	m := new(RelayIndication)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *hubClient) Close(ctx context.Context, in *CloseRequest, opts ...grpc.CallOption) (*CloseResponse, error) {
+	out := new(CloseResponse)
+	err := c.cc.Invoke(ctx, Hub_Close_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// HubServer is the server API for Hub service.
+// All implementations must embed UnimplementedHubServer
+// for forward compatibility
+type HubServer interface {
+	// Start a new session, which joins the hub as a new client
+	Identify(context.Context, *IdentifyRequest) (*IdentifyResponse, error)
+	// List the IDs of the other clients connected to the hub
+	List(context.Context, *ListRequest) (*ListResponse, error)
+	// Relay a message to other clients
+	Relay(context.Context, *RelayRequest) (*RelayResponse, error)
+	// Stream the relays sent to the session's client, until it disconnects or the call is cancelled
+	Relays(*RelaysRequest, Hub_RelaysServer) error
+	// End a session, disconnecting its client from the hub
+	Close(context.Context, *CloseRequest) (*CloseResponse, error)
+	mustEmbedUnimplementedHubServer()
+}
+
+// UnimplementedHubServer must be embedded to have forward compatible implementations.
+type UnimplementedHubServer struct {
+}
+
+func (UnimplementedHubServer) Identify(context.Context, *IdentifyRequest) (*IdentifyResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Identify not implemented")
+}
+func (UnimplementedHubServer) List(context.Context, *ListRequest) (*ListResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method List not implemented")
+}
+func (UnimplementedHubServer) Relay(context.Context, *RelayRequest) (*RelayResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Relay not implemented")
+}
+func (UnimplementedHubServer) Relays(*RelaysRequest, Hub_RelaysServer) error {
+	return status.Errorf(codes.Unimplemented, "method Relays not implemented")
+}
+func (UnimplementedHubServer) Close(context.Context, *CloseRequest) (*CloseResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Close not implemented")
+}
+func (UnimplementedHubServer) mustEmbedUnimplementedHubServer() {}
+
+// UnsafeHubServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to HubServer will
+// result in compilation errors.
+type UnsafeHubServer interface {
+	mustEmbedUnimplementedHubServer()
+}
+
+func RegisterHubServer(s grpc.ServiceRegistrar, srv HubServer) {
+	s.RegisterService(&Hub_ServiceDesc, srv)
+}
+
+func _Hub_Identify_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(IdentifyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HubServer).Identify(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Hub_Identify_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HubServer).Identify(ctx, req.(*IdentifyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Hub_List_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HubServer).List(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Hub_List_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HubServer).List(ctx, req.(*ListRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Hub_Relay_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RelayRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HubServer).Relay(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Hub_Relay_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HubServer).Relay(ctx, req.(*RelayRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Hub_Relays_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(RelaysRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(HubServer).Relays(m, &hubRelaysServer{stream})
+}
+
+type Hub_RelaysServer interface {
+	Send(*RelayIndication) error
+	grpc.ServerStream
+}
+
+type hubRelaysServer struct {
+	grpc.ServerStream
+}
+
+func (x *hubRelaysServer) Send(m *RelayIndication) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Hub_Close_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CloseRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HubServer).Close(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Hub_Close_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HubServer).Close(ctx, req.(*CloseRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Hub_ServiceDesc is the grpc.ServiceDesc for Hub service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Hub_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "hubpb.Hub",
+	HandlerType: (*HubServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Identify",
+			Handler:    _Hub_Identify_Handler,
+		},
+		{
+			MethodName: "List",
+			Handler:    _Hub_List_Handler,
+		},
+		{
+			MethodName: "Relay",
+			Handler:    _Hub_Relay_Handler,
+		},
+		{
+			MethodName: "Close",
+			Handler:    _Hub_Close_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Relays",
+			Handler:       _Hub_Relays_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "hub.proto",
+}
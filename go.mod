@@ -1,14 +1,43 @@
 module github.com/CiaranWoodward/broadcast_hub
 
-go 1.16
+go 1.22
 
 require (
-	github.com/cpuguy83/go-md2man/v2 v2.0.0 // indirect
+	github.com/Microsoft/go-winio v0.6.2
+	github.com/alicebob/miniredis/v2 v2.31.1
+	github.com/eclipse/paho.mqtt.golang v1.4.3
 	github.com/fxamacker/cbor/v2 v2.2.0
-	github.com/russross/blackfriday/v2 v2.1.0 // indirect
+	github.com/klauspost/compress v1.18.0
+	github.com/nats-io/nats.go v1.11.0
+	github.com/redis/go-redis/v9 v9.7.0
 	github.com/stretchr/testify v1.7.0
-	github.com/urfave/cli/v2 v2.3.0 // indirect
-	go.uber.org/goleak v1.1.10 // indirect
+	github.com/urfave/cli/v2 v2.3.0
+	go.etcd.io/bbolt v1.3.5
+	go.uber.org/goleak v1.1.10
+	golang.org/x/net v0.22.0
+	golang.org/x/sys v0.18.0
+	google.golang.org/grpc v1.64.0
+	google.golang.org/protobuf v1.33.0
+)
+
+require (
+	github.com/alicebob/gopher-json v0.0.0-20200520072559-a9ecdc9d1d3a // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/cpuguy83/go-md2man/v2 v2.0.0 // indirect
+	github.com/davecgh/go-spew v1.1.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/gorilla/websocket v1.5.0 // indirect
+	github.com/nats-io/nkeys v0.3.0 // indirect
+	github.com/nats-io/nuid v1.0.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/russross/blackfriday/v2 v2.1.0 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
+	github.com/yuin/gopher-lua v1.1.0 // indirect
+	golang.org/x/crypto v0.21.0 // indirect
 	golang.org/x/lint v0.0.0-20201208152925-83fdc39ff7b5 // indirect
-	golang.org/x/tools v0.1.0 // indirect
+	golang.org/x/sync v0.6.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+	golang.org/x/tools v0.11.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240318140521-94a12d6c2237 // indirect
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
 )
@@ -0,0 +1,134 @@
+/*
+Package logging defines the Logger interface used by the broadcast_hub server and client, so that embedders can route
+and filter hub logs through their own logging stack.
+
+Adapters are provided for the standard library's 'log' and 'log/slog' packages, and for zap's SugaredLogger:
+
+	cfg := server.DefaultServerConfig()
+	cfg.Logger = logging.NewSlog(slog.Default())
+	ser := server.NewServerWithConfig(cfg)
+*/
+package logging
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Field is a key-value pair attached to a log entry
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F makes a Field
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Logger receives leveled log entries, each with a message and any number of fields.
+// Implementations must be safe to call from multiple goroutines.
+type Logger interface {
+	Debug(msg string, fields ...Field)
+	Info(msg string, fields ...Field)
+	Warn(msg string, fields ...Field)
+	Error(msg string, fields ...Field)
+}
+
+// Level is the severity of a log entry
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	default:
+		return fmt.Sprintf("[Unknown Level: %d]", int(l))
+	}
+}
+
+// ParseLevel gets the Level with the given name, as returned by 'Level.String', ignoring case
+func ParseLevel(name string) (l Level, ok bool) {
+	for _, l := range []Level{LevelDebug, LevelInfo, LevelWarn, LevelError} {
+		if strings.EqualFold(l.String(), name) {
+			return l, true
+		}
+	}
+	return LevelInfo, false
+}
+
+// Discard is a Logger that ignores everything
+var Discard Logger = discard{}
+
+type discard struct{}
+
+func (discard) Debug(string, ...Field) {}
+func (discard) Info(string, ...Field)  {}
+func (discard) Warn(string, ...Field)  {}
+func (discard) Error(string, ...Field) {}
+
+// Logger writing to a standard library *log.Logger
+type stdLogger struct {
+	l   *log.Logger
+	min Level
+}
+
+// NewStd gets a Logger which writes entries of at least level 'min' to 'l', formatted as the message followed by
+// key=value fields. A nil 'l' writes to the standard library's default logger.
+func NewStd(l *log.Logger, min Level) Logger {
+	return &stdLogger{l: l, min: min}
+}
+
+// Default gets the Logger used when none is configured, which writes Info and above to the standard library's
+// default logger
+func Default() Logger {
+	return NewStd(nil, LevelInfo)
+}
+
+func (s *stdLogger) Debug(msg string, fields ...Field) { s.log(LevelDebug, msg, fields) }
+func (s *stdLogger) Info(msg string, fields ...Field)  { s.log(LevelInfo, msg, fields) }
+func (s *stdLogger) Warn(msg string, fields ...Field)  { s.log(LevelWarn, msg, fields) }
+func (s *stdLogger) Error(msg string, fields ...Field) { s.log(LevelError, msg, fields) }
+
+func (s *stdLogger) log(level Level, msg string, fields []Field) {
+	if level < s.min {
+		return
+	}
+	line := Format(msg, fields...)
+	if level != LevelInfo {
+		line = level.String() + " " + line
+	}
+	if s.l == nil {
+		log.Output(3, line)
+	} else {
+		s.l.Output(3, line)
+	}
+}
+
+// Format an entry as the message followed by its key=value fields, quoting any values that contain spaces
+func Format(msg string, fields ...Field) string {
+	var sb strings.Builder
+	sb.WriteString(msg)
+	for _, f := range fields {
+		v := fmt.Sprint(f.Value)
+		if v == "" || strings.ContainsAny(v, " \t\r\n\"=") {
+			v = fmt.Sprintf("%q", v)
+		}
+		fmt.Fprintf(&sb, " %s=%s", f.Key, v)
+	}
+	return sb.String()
+}
@@ -0,0 +1,88 @@
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormat(t *testing.T) {
+	assert.Equal(t, "Added new Client", Format("Added new Client"))
+	assert.Equal(t, "Added new Client client=1 addr=127.0.0.1:80", Format("Added new Client", F("client", 1), F("addr", "127.0.0.1:80")))
+	assert.Equal(t, `Failed err="broken pipe" empty=""`, Format("Failed", F("err", fmt.Errorf("broken pipe")), F("empty", "")))
+}
+
+func TestStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewStd(log.New(&buf, "", 0), LevelInfo)
+	l.Debug("hidden", F("a", 1))
+	l.Info("shown", F("a", 1))
+	l.Warn("careful")
+	l.Error("broken", F("err", "eof"))
+	assert.Equal(t, "shown a=1\nWARN careful\nERROR broken err=eof\n", buf.String())
+}
+
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	h := slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		Level: slog.LevelInfo,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+	l := NewSlog(slog.New(h))
+	l.Debug("hidden")
+	l.Info("Added new Client", F("client", 3))
+	l.Error("broken", F("err", "eof"))
+	assert.Equal(t, "level=INFO msg=\"Added new Client\" client=3\nlevel=ERROR msg=broken err=eof\n", buf.String())
+}
+
+// Records calls in the shape of zap's SugaredLogger
+type fakeSugared struct {
+	lines []string
+}
+
+func (f *fakeSugared) record(level, msg string, kv []interface{}) {
+	f.lines = append(f.lines, strings.TrimSpace(fmt.Sprintln(append([]interface{}{level, msg}, kv...)...)))
+}
+
+func (f *fakeSugared) Debugw(msg string, kv ...interface{}) { f.record("debug", msg, kv) }
+func (f *fakeSugared) Infow(msg string, kv ...interface{})  { f.record("info", msg, kv) }
+func (f *fakeSugared) Warnw(msg string, kv ...interface{})  { f.record("warn", msg, kv) }
+func (f *fakeSugared) Errorw(msg string, kv ...interface{}) { f.record("error", msg, kv) }
+
+func TestZapLogger(t *testing.T) {
+	var f fakeSugared
+	l := NewZap(&f)
+	l.Debug("dbg")
+	l.Info("inf", F("client", 2))
+	l.Warn("wrn", F("a", "b"), F("c", 4))
+	l.Error("err")
+	assert.Equal(t, []string{"debug dbg", "info inf client 2", "warn wrn a b c 4", "error err"}, f.lines)
+}
+
+func TestDiscard(t *testing.T) {
+	// Mostly to check it satisfies the interface without panicking
+	Discard.Debug("a")
+	Discard.Info("b", F("c", 1))
+	Discard.Warn("d")
+	Discard.Error("e")
+}
+
+func TestParseLevel(t *testing.T) {
+	for _, l := range []Level{LevelDebug, LevelInfo, LevelWarn, LevelError} {
+		p, ok := ParseLevel(strings.ToLower(l.String()))
+		assert.True(t, ok)
+		assert.Equal(t, l, p)
+	}
+	_, ok := ParseLevel("loud")
+	assert.False(t, ok)
+}
@@ -0,0 +1,34 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Logger writing to a *slog.Logger
+type slogLogger struct {
+	l *slog.Logger
+}
+
+// NewSlog gets a Logger which writes to 'l', with each Field as an attribute.
+// Filtering by level is left to the slog.Handler.
+func NewSlog(l *slog.Logger) Logger {
+	return &slogLogger{l: l}
+}
+
+func (s *slogLogger) Debug(msg string, fields ...Field) { s.log(slog.LevelDebug, msg, fields) }
+func (s *slogLogger) Info(msg string, fields ...Field)  { s.log(slog.LevelInfo, msg, fields) }
+func (s *slogLogger) Warn(msg string, fields ...Field)  { s.log(slog.LevelWarn, msg, fields) }
+func (s *slogLogger) Error(msg string, fields ...Field) { s.log(slog.LevelError, msg, fields) }
+
+func (s *slogLogger) log(level slog.Level, msg string, fields []Field) {
+	ctx := context.Background()
+	if !s.l.Enabled(ctx, level) {
+		return
+	}
+	attrs := make([]slog.Attr, len(fields))
+	for i, f := range fields {
+		attrs[i] = slog.Any(f.Key, f.Value)
+	}
+	s.l.LogAttrs(ctx, level, msg, attrs...)
+}
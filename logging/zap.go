@@ -0,0 +1,35 @@
+package logging
+
+// SugaredLogger is the subset of zap's *zap.SugaredLogger used by NewZap.
+// It is declared here so that broadcast_hub doesn't depend on zap; any logger with these methods can be used.
+type SugaredLogger interface {
+	Debugw(msg string, keysAndValues ...interface{})
+	Infow(msg string, keysAndValues ...interface{})
+	Warnw(msg string, keysAndValues ...interface{})
+	Errorw(msg string, keysAndValues ...interface{})
+}
+
+// Logger writing to a zap SugaredLogger
+type zapLogger struct {
+	l SugaredLogger
+}
+
+// NewZap gets a Logger which writes to a zap SugaredLogger, with each Field as a key-value pair.
+// For a *zap.Logger, pass 'logger.Sugar()'.
+func NewZap(l SugaredLogger) Logger {
+	return &zapLogger{l: l}
+}
+
+func (z *zapLogger) Debug(msg string, fields ...Field) { z.l.Debugw(msg, keysAndValues(fields)...) }
+func (z *zapLogger) Info(msg string, fields ...Field)  { z.l.Infow(msg, keysAndValues(fields)...) }
+func (z *zapLogger) Warn(msg string, fields ...Field)  { z.l.Warnw(msg, keysAndValues(fields)...) }
+func (z *zapLogger) Error(msg string, fields ...Field) { z.l.Errorw(msg, keysAndValues(fields)...) }
+
+// Flatten fields into alternating keys and values
+func keysAndValues(fields []Field) []interface{} {
+	kv := make([]interface{}, 0, 2*len(fields))
+	for _, f := range fields {
+		kv = append(kv, f.Key, f.Value)
+	}
+	return kv
+}
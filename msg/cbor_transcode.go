@@ -1,6 +1,7 @@
 package msg
 
 import (
+	"errors"
 	"io"
 
 	"github.com/fxamacker/cbor/v2"
@@ -8,30 +9,82 @@ import (
 
 // CBOR Implementation of the Transcoder interface
 type CborTranscoder struct {
+	// Limits on the messages read by stream decoders. The zero value is unlimited.
+	Limits DecodeLimits
+	// Encode messages deterministically, so equal messages always encode to the same bytes, such as for signing or
+	// hashing them. This is the Core Deterministic Encoding of RFC 8949: map keys are sorted bytewise, and integers,
+	// lengths and floats take their shortest form. Decoding is unaffected.
+	Deterministic bool
 }
 
+// Encoding mode for deterministic encoding
+var deterministicCbor = func() cbor.EncMode {
+	em, err := cbor.CoreDetEncOptions().EncMode()
+	if err != nil {
+		panic(err)
+	}
+	return em
+}()
+
 type cborStreamDecoder struct {
-	dec *cbor.Decoder
+	dec    *cbor.Decoder
+	limits DecodeLimits
+}
+
+func (ct *CborTranscoder) Encode(msgin Message) (msgout []byte, err error) {
+	if ct.Deterministic {
+		msgout, err = deterministicCbor.Marshal(msgin)
+	} else {
+		msgout, err = cbor.Marshal(msgin)
+	}
+	return msgout, encodeError(msgin, err)
 }
 
-func (*CborTranscoder) Encode(msgin Message) (msgout []byte, ok bool) {
-	msgout, err := cbor.Marshal(msgin)
-	ok = (err == nil)
-	return
+func (*CborTranscoder) Decode(msgin []byte) (msgout Message, err error) {
+	err = cbor.Unmarshal(msgin, &msgout)
+	return msgout, decodeError(err)
 }
 
-func (*CborTranscoder) Decode(msgin []byte) (msgout Message, ok bool) {
-	err := cbor.Unmarshal(msgin, &msgout)
-	ok = (err == nil)
-	return
+func (ct *CborTranscoder) NewStreamDecoder(r io.Reader) StreamDecoder {
+	r, lr := ct.Limits.wrapReader(r)
+	cd := &cborStreamDecoder{dec: cbor.NewDecoder(r), limits: ct.Limits}
+	if lr != nil {
+		lr.consumed = func() int64 { return int64(cd.dec.NumBytesRead()) }
+	}
+	return cd
 }
 
-func (*CborTranscoder) NewStreamDecoder(r io.Reader) StreamDecoder {
-	return &cborStreamDecoder{dec: cbor.NewDecoder(r)}
+func (cd *cborStreamDecoder) DecodeNext() (msgout Message, err error) {
+	err = cd.dec.Decode(&msgout)
+	if err == nil {
+		return msgout, cd.limits.checkMessage(&msgout)
+	}
+	if errors.Is(err, errMessageTooLarge) {
+		return msgout, cd.limits.tooLarge()
+	}
+	var typeErr *cbor.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		// The whole message was read, but didn't fit the Message structure
+		return msgout, &DecodeError{Status: ENCODING_ERROR, Recoverable: true, Err: err}
+	}
+	if isMalformedCbor(err) {
+		// The decoder is stuck at the start of the malformed data
+		return msgout, &DecodeError{Status: ENCODING_ERROR, Err: err}
+	}
+	return msgout, err
 }
 
-func (cd *cborStreamDecoder) DecodeNext() (msgout Message, ok bool) {
-	err := cd.dec.Decode(&msgout)
-	ok = (err == nil)
-	return
+// Check whether an error from the CBOR decoder is because the data isn't well-formed CBOR, rather than from the reader
+func isMalformedCbor(err error) bool {
+	var (
+		syntaxErr    *cbor.SyntaxError
+		semanticErr  *cbor.SemanticError
+		nestedErr    *cbor.MaxNestedLevelError
+		arrayErr     *cbor.MaxArrayElementsError
+		mapErr       *cbor.MaxMapPairsError
+		indefiniteEr *cbor.IndefiniteLengthError
+		tagsErr      *cbor.TagsMdError
+	)
+	return errors.As(err, &syntaxErr) || errors.As(err, &semanticErr) || errors.As(err, &nestedErr) ||
+		errors.As(err, &arrayErr) || errors.As(err, &mapErr) || errors.As(err, &indefiniteEr) || errors.As(err, &tagsErr)
 }
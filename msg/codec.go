@@ -0,0 +1,92 @@
+package msg
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrUnknownCodec is returned by DetectCodec if a stream doesn't start like any of the supported codecs
+var ErrUnknownCodec = errors.New("unknown codec")
+
+// Codec identifies one of the supported message encodings
+type Codec int
+
+const (
+	// CBOR encoding, the default
+	CodecCBOR Codec = iota
+	// JSON encoding, which is human-readable
+	CodecJSON
+	// CBOR encoding in length-prefixed frames (See FramedTranscoder), which recovers from malformed messages
+	CodecFramedCBOR
+)
+
+// Get a new Transcoder for the codec
+func (c Codec) Transcoder() Transcoder {
+	return c.TranscoderWithLimits(DecodeLimits{})
+}
+
+// Get a new Transcoder for the codec, whose stream decoders enforce the limits
+func (c Codec) TranscoderWithLimits(limits DecodeLimits) Transcoder {
+	switch c {
+	case CodecJSON:
+		return &JsonTranscoder{Limits: limits}
+	case CodecFramedCBOR:
+		return &FramedTranscoder{Inner: &CborTranscoder{}, Limits: limits}
+	default:
+		return &CborTranscoder{Limits: limits}
+	}
+}
+
+func (c Codec) String() string {
+	switch c {
+	case CodecCBOR:
+		return "cbor"
+	case CodecJSON:
+		return "json"
+	case CodecFramedCBOR:
+		return "cbor-framed"
+	default:
+		return fmt.Sprintf("[Unknown Codec: %d]", int(c))
+	}
+}
+
+// ParseCodec gets the Codec with the given name, as returned by 'Codec.String'
+func ParseCodec(name string) (c Codec, ok bool) {
+	for _, c := range []Codec{CodecCBOR, CodecJSON, CodecFramedCBOR} {
+		if c.String() == name {
+			return c, true
+		}
+	}
+	return CodecCBOR, false
+}
+
+// DetectCodec works out which codec a stream of messages is encoded with, from the first byte of the first message.
+// Every message is a map, which starts with a byte from 0xa0 to 0xbf in CBOR, or '{' in JSON.
+// Whitespace is allowed before a JSON message, so is skipped. Framed messages start with a length prefix,
+// whose first byte is zero for any frame up to 16MiB.
+//
+// Returns a reader which replays the bytes that were peeked at, so must be used in place of 'r' afterwards.
+func DetectCodec(r io.Reader) (c Codec, rest io.Reader, err error) {
+	br := bufio.NewReader(r)
+	for {
+		var b []byte
+		b, err = br.Peek(1)
+		if err != nil {
+			return CodecCBOR, br, err
+		}
+		switch {
+		case b[0] >= 0xa0 && b[0] <= 0xbf:
+			return CodecCBOR, br, nil
+		case b[0] == '{':
+			return CodecJSON, br, nil
+		case b[0] == 0x00:
+			return CodecFramedCBOR, br, nil
+		case b[0] == ' ' || b[0] == '\t' || b[0] == '\r' || b[0] == '\n':
+			br.ReadByte()
+		default:
+			return CodecCBOR, br, fmt.Errorf("%w, starting with byte 0x%02x", ErrUnknownCodec, b[0])
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package msg
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Largest message a compressed relay may expand to
+const MaxDecompressedSize = 1 << 20
+
+// ErrUnsupportedCompression is returned when compressing or decompressing with a Compression this library can't handle
+var ErrUnsupportedCompression = errors.New("unsupported compression")
+
+// Compression of a relay's message. The sending client compresses the message, and the receiving client decompresses
+// it before delivering it. The hub passes the compressed message through untouched.
+type Compression int
+
+const (
+	// The message isn't compressed. The default, which is omitted from the encoding
+	CompressionNone Compression = 0
+	// The message is compressed with raw DEFLATE (RFC 1951)
+	CompressionDeflate Compression = 1
+	// The message is compressed with Zstandard (RFC 8878)
+	CompressionZstd Compression = 2
+)
+
+// Zstandard encoder and decoder, shared by every message and only created once needed.
+// Both are only used for whole messages, which is safe to do concurrently.
+var (
+	zstdEncoder = sync.OnceValues(func() (*zstd.Encoder, error) {
+		return zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBestCompression), zstd.WithEncoderConcurrency(1))
+	})
+	zstdDecoder = sync.OnceValues(func() (*zstd.Decoder, error) {
+		return zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(MaxDecompressedSize+1))
+	})
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionDeflate:
+		return "deflate"
+	case CompressionZstd:
+		return "zstd"
+	default:
+		return fmt.Sprintf("[Unknown Compression: %d]", int(c))
+	}
+}
+
+// ParseCompression gets the Compression with the given name, as returned by 'Compression.String'
+func ParseCompression(name string) (c Compression, ok bool) {
+	for _, c := range []Compression{CompressionNone, CompressionDeflate, CompressionZstd} {
+		if c.String() == name {
+			return c, true
+		}
+	}
+	return CompressionNone, false
+}
+
+// Compress a message. Returns ErrUnsupportedCompression for compressions this library can't produce.
+func (c Compression) Compress(data []byte) ([]byte, error) {
+	switch c {
+	case CompressionNone:
+		return data, nil
+	case CompressionDeflate:
+		var buf bytes.Buffer
+		w, err := flate.NewWriter(&buf, flate.BestCompression)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CompressionZstd:
+		enc, err := zstdEncoder()
+		if err != nil {
+			return nil, err
+		}
+		return enc.EncodeAll(data, nil), nil
+	default:
+		return nil, ErrUnsupportedCompression
+	}
+}
+
+// Decompress a message. Fails if it would expand to more than MaxDecompressedSize, and returns
+// ErrUnsupportedCompression for compressions this library can't read.
+func (c Compression) Decompress(data []byte) ([]byte, error) {
+	switch c {
+	case CompressionNone:
+		return data, nil
+	case CompressionDeflate:
+		r := flate.NewReader(bytes.NewReader(data))
+		defer r.Close()
+		out, err := io.ReadAll(io.LimitReader(r, MaxDecompressedSize+1))
+		if err != nil {
+			return nil, err
+		}
+		return checkDecompressed(out)
+	case CompressionZstd:
+		dec, err := zstdDecoder()
+		if err != nil {
+			return nil, err
+		}
+		out, err := dec.DecodeAll(data, nil)
+		if err != nil {
+			return nil, err
+		}
+		return checkDecompressed(out)
+	default:
+		return nil, ErrUnsupportedCompression
+	}
+}
+
+// Check that a decompressed message isn't larger than allowed
+func checkDecompressed(out []byte) ([]byte, error) {
+	if len(out) > MaxDecompressedSize {
+		return nil, fmt.Errorf("decompressed message is over %d bytes", MaxDecompressedSize)
+	}
+	return out, nil
+}
@@ -0,0 +1,115 @@
+package msg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Writer which can be pointed at a different writer for each message, so an encoder bound to it can be reused
+type swapWriter struct {
+	w io.Writer
+}
+
+func (sw *swapWriter) Write(p []byte) (int, error) {
+	return sw.w.Write(p)
+}
+
+// CBOR encoder, which keeps its encoding buffer between messages
+type cborEncoder struct {
+	out swapWriter
+	enc *cbor.Encoder
+}
+
+// JSON encoder, which keeps its encoding buffer between messages
+type jsonEncoder struct {
+	out swapWriter
+	enc *json.Encoder
+}
+
+var (
+	cborEncoders = sync.Pool{New: func() any {
+		ce := &cborEncoder{}
+		ce.enc = cbor.NewEncoder(&ce.out)
+		return ce
+	}}
+	jsonEncoders = sync.Pool{New: func() any {
+		je := &jsonEncoder{}
+		je.enc = json.NewEncoder(&je.out)
+		return je
+	}}
+	// Buffers holding a whole frame while it's encoded, before its length is known
+	frameBuffers = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+)
+
+// Largest buffer kept in a pool, so one huge message doesn't keep its memory around forever
+const maxPooledBuffer = 64 * 1024
+
+// Encode a value as CBOR to a writer, with a pooled encoder
+func encodeCbor(w io.Writer, v any) error {
+	ce := cborEncoders.Get().(*cborEncoder)
+	ce.out.w = w
+	err := ce.enc.Encode(v)
+	ce.out.w = nil
+	cborEncoders.Put(ce)
+	return err
+}
+
+// Encode a value as JSON to a writer, followed by a newline, with a pooled encoder
+func encodeJson(w io.Writer, v any) error {
+	je := jsonEncoders.Get().(*jsonEncoder)
+	je.out.w = w
+	err := je.enc.Encode(v)
+	je.out.w = nil
+	jsonEncoders.Put(je)
+	return err
+}
+
+// Write a frame to a writer, with the payload written to the buffer by 'encode'.
+// Nothing is written if the payload is larger than 'maxSize'.
+func encodeFrame(w io.Writer, maxSize int, encode func(buf *bytes.Buffer) error) error {
+	buf := frameBuffers.Get().(*bytes.Buffer)
+	defer func() {
+		if buf.Cap() <= maxPooledBuffer {
+			frameBuffers.Put(buf)
+		}
+	}()
+	// Leave room for the length prefix, which is filled in once the payload is encoded
+	buf.Reset()
+	buf.Write(make([]byte, FrameHeaderSize))
+	if err := encode(buf); err != nil {
+		return err
+	}
+	frame := buf.Bytes()
+	size := len(frame) - FrameHeaderSize
+	if size > maxSize {
+		return fmt.Errorf("message of %d bytes is over the frame size limit of %d", size, maxSize)
+	}
+	binary.BigEndian.PutUint32(frame, uint32(size))
+	_, err := w.Write(frame)
+	return err
+}
+
+func (ct *CborTranscoder) EncodeTo(w io.Writer, msgin Message) error {
+	if ct.Deterministic {
+		// Deterministic encoding is rare enough not to be worth pooling encoders for
+		return deterministicCbor.NewEncoder(w).Encode(&msgin)
+	}
+	return encodeCbor(w, &msgin)
+}
+
+// Each message is followed by a newline, as with a json.Encoder
+func (*JsonTranscoder) EncodeTo(w io.Writer, msgin Message) error {
+	return encodeJson(w, &msgin)
+}
+
+func (ft *FramedTranscoder) EncodeTo(w io.Writer, msgin Message) error {
+	return encodeFrame(w, ft.maxFrameSize(), func(buf *bytes.Buffer) error {
+		return ft.Inner.EncodeTo(buf, msgin)
+	})
+}
@@ -0,0 +1,149 @@
+package msg
+
+import (
+	"errors"
+	"fmt"
+)
+
+// StatusError is an error carrying a protocol Status, returned by the client API for anything other than SUCCESS.
+//
+// It matches its Status with errors.Is, for example 'errors.Is(err, msg.TIMEOUT)', as well as any underlying
+// cause such as a transport error or context.DeadlineExceeded.
+type StatusError struct {
+	// Status describing the failure
+	Status Status
+	// ID of the request message that failed, or zero if the request was never sent
+	MessageId uint32
+	// Underlying cause, if any
+	Err error
+}
+
+// NewStatusError creates a StatusError, or returns nil if the status is SUCCESS
+func NewStatusError(status Status, mid uint32, err error) error {
+	if status == SUCCESS {
+		return nil
+	}
+	return &StatusError{Status: status, MessageId: mid, Err: err}
+}
+
+func (e *StatusError) Error() string {
+	s := e.Status.String()
+	if e.MessageId != 0 {
+		s = fmt.Sprintf("%s (message %d)", s, e.MessageId)
+	}
+	if e.Err != nil {
+		s += ": " + e.Err.Error()
+	}
+	return s
+}
+
+// Unwrap gets the underlying cause of the error, if any
+func (e *StatusError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether the target is a Status (or StatusError) with the same Status as this error
+func (e *StatusError) Is(target error) bool {
+	switch t := target.(type) {
+	case Status:
+		return e.Status == t
+	case *StatusError:
+		return e.Status == t.Status
+	}
+	return false
+}
+
+// DecodeError is returned by StreamDecoder.DecodeNext for a message that couldn't be decoded.
+// The end of the stream isn't a DecodeError: io.EOF, or whatever error the underlying reader gave, is returned as it is.
+//
+// It matches its Status with errors.Is, like StatusError.
+type DecodeError struct {
+	// ENCODING_ERROR if the message was malformed, TOO_LONG if it was larger than allowed,
+	// or VERSION_MISMATCH if it was from a protocol version that isn't supported
+	Status Status
+	// Whether the decoder can carry on with the next message. If not, nothing more can be decoded from the stream.
+	Recoverable bool
+	// Underlying cause, if any
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	s := "failed to decode message: " + e.Status.String()
+	if e.Err != nil {
+		s += ": " + e.Err.Error()
+	}
+	return s
+}
+
+// Unwrap gets the underlying cause of the error, if any
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether the target is a Status (or DecodeError) with the same Status as this error
+func (e *DecodeError) Is(target error) bool {
+	switch t := target.(type) {
+	case Status:
+		return e.Status == t
+	case *DecodeError:
+		return e.Status == t.Status
+	}
+	return false
+}
+
+// Get the error for a message that 'Transcoder.Encode' couldn't encode, or nil if 'err' is nil
+func encodeError(m Message, err error) error {
+	if err == nil {
+		return nil
+	}
+	return NewStatusError(ENCODING_ERROR, m.MessageId, err)
+}
+
+// Get the error for a message that 'Transcoder.Decode' couldn't decode, or nil if 'err' is nil.
+// Decode is given the whole message, so nothing is left over to stop the next one being decoded.
+func decodeError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &DecodeError{Status: ENCODING_ERROR, Recoverable: true, Err: err}
+}
+
+// IsRecoverable reports whether a StreamDecoder can carry on decoding after returning 'err'
+func IsRecoverable(err error) bool {
+	var de *DecodeError
+	return errors.As(err, &de) && de.Recoverable
+}
+
+// Get the error for a decoded message, if it's from a protocol version that isn't supported
+func checkVersion(m *Message) error {
+	if m.Version.Supported() {
+		return nil
+	}
+	return &DecodeError{Status: VERSION_MISMATCH, Recoverable: true}
+}
+
+// Error allows a Status to be used as an error, mainly as the target of errors.Is
+func (s Status) Error() string {
+	return s.String()
+}
+
+// StatusOf gets the Status of an error returned by the client API, for code that works with Status values.
+// Returns SUCCESS for a nil error, and CONNECTION_ERROR for any error that doesn't carry a Status.
+func StatusOf(err error) Status {
+	if err == nil {
+		return SUCCESS
+	}
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.Status
+	}
+	var de *DecodeError
+	if errors.As(err, &de) {
+		return de.Status
+	}
+	var s Status
+	if errors.As(err, &s) {
+		return s
+	}
+	return CONNECTION_ERROR
+}
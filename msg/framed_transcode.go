@@ -0,0 +1,107 @@
+package msg
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Size of the length prefix at the start of each frame
+const FrameHeaderSize = 4
+
+// Largest encoded message a FramedTranscoder allows by default, if MaxFrameSize isn't set
+const DefaultMaxFrameSize = 1 << 20
+
+// Framing implementation of the Transcoder interface, wrapping another Transcoder.
+// Each encoded message is prefixed with its length as a 4-byte big-endian integer, so a stream decoder knows where
+// every message ends without relying on the inner codec. A frame which can't be decoded is a Recoverable DecodeError,
+// so the stream carries on with the next one.
+//
+// Messages larger than MaxFrameSize can't be encoded, so are rejected by the sender with ENCODING_ERROR.
+// A frame header claiming a larger message than that can't be trusted, so is a TOO_LONG DecodeError ending the stream.
+type FramedTranscoder struct {
+	// Codec of the messages in each frame
+	Inner Transcoder
+	// Largest encoded message allowed, excluding the length prefix. Zero uses DefaultMaxFrameSize.
+	MaxFrameSize int
+	// Limits on the messages read by stream decoders, as well as MaxFrameSize. The zero value is unlimited.
+	Limits DecodeLimits
+}
+
+type framedStreamDecoder struct {
+	r  *bufio.Reader
+	ft *FramedTranscoder
+}
+
+func (ft *FramedTranscoder) maxFrameSize() int {
+	if ft.MaxFrameSize <= 0 {
+		return DefaultMaxFrameSize
+	}
+	return ft.MaxFrameSize
+}
+
+// Get the largest frame a stream decoder accepts
+func (ft *FramedTranscoder) maxDecodeSize() int {
+	if ft.Limits.MaxMessageSize > 0 {
+		return min(ft.maxFrameSize(), ft.Limits.MaxMessageSize)
+	}
+	return ft.maxFrameSize()
+}
+
+func (ft *FramedTranscoder) Encode(msgin Message) (msgout []byte, err error) {
+	payload, err := ft.Inner.Encode(msgin)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) > ft.maxFrameSize() {
+		return nil, encodeError(msgin, fmt.Errorf("message of %d bytes is over the frame size limit of %d", len(payload), ft.maxFrameSize()))
+	}
+	msgout = make([]byte, FrameHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(msgout, uint32(len(payload)))
+	copy(msgout[FrameHeaderSize:], payload)
+	return msgout, nil
+}
+
+func (ft *FramedTranscoder) Decode(msgin []byte) (msgout Message, err error) {
+	if len(msgin) < FrameHeaderSize {
+		err = decodeError(fmt.Errorf("frame of %d bytes is too short for its header", len(msgin)))
+		return
+	}
+	size := binary.BigEndian.Uint32(msgin)
+	if uint64(size) > uint64(ft.maxFrameSize()) {
+		err = &DecodeError{Status: TOO_LONG, Recoverable: true, Err: fmt.Errorf("frame of %d bytes is over the limit of %d", size, ft.maxFrameSize())}
+		return
+	}
+	if int(size) != len(msgin)-FrameHeaderSize {
+		err = decodeError(fmt.Errorf("frame header gives %d bytes, but %d follow it", size, len(msgin)-FrameHeaderSize))
+		return
+	}
+	return ft.Inner.Decode(msgin[FrameHeaderSize:])
+}
+
+func (ft *FramedTranscoder) NewStreamDecoder(r io.Reader) StreamDecoder {
+	return &framedStreamDecoder{r: bufio.NewReader(r), ft: ft}
+}
+
+func (fd *framedStreamDecoder) DecodeNext() (msgout Message, err error) {
+	header := make([]byte, FrameHeaderSize)
+	if _, err = io.ReadFull(fd.r, header); err != nil {
+		return
+	}
+	size := binary.BigEndian.Uint32(header)
+	if limit := fd.ft.maxDecodeSize(); uint64(size) > uint64(limit) {
+		err = &DecodeError{Status: TOO_LONG, Err: fmt.Errorf("frame of %d bytes is over the limit of %d", size, limit)}
+		return
+	}
+	payload := make([]byte, size)
+	if _, err = io.ReadFull(fd.r, payload); err != nil {
+		return
+	}
+	// The next frame is known to start straight after, so a frame which doesn't decode can always be skipped
+	msgout, err = fd.ft.Inner.Decode(payload)
+	if err != nil {
+		return msgout, err
+	}
+	return msgout, fd.ft.Limits.checkMessage(&msgout)
+}
@@ -0,0 +1,88 @@
+package msg
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Add the encoding of every test vector to the corpus of a fuzz target
+func addSeeds(f *testing.F, tc Transcoder) {
+	for _, tv := range cborTestVec {
+		encoded, err := tc.Encode(tv.msg)
+		if err != nil {
+			f.Fatalf("Failed to encode %s: %v", tv.name, err)
+		}
+		f.Add(encoded)
+	}
+}
+
+// Decode everything in a stream with the default limits, checking the decoder never buffers more than allowed
+func fuzzStream(t *testing.T, tc Transcoder, data []byte) {
+	r := &endlessReader{prefix: data}
+	limits := DefaultDecodeLimits()
+	dec := tc.NewStreamDecoder(bytes.NewReader(data))
+	for i := 0; i < len(data); i++ {
+		if _, err := dec.DecodeNext(); err != nil && !IsRecoverable(err) {
+			break
+		}
+	}
+	// Nothing after the data either, so it's decoded or found to be too long
+	tc.NewStreamDecoder(r).DecodeNext()
+	assert.LessOrEqual(t, r.read, limits.MaxMessageSize+len(data)+4096)
+}
+
+// Check that a decoded message stays the same after being encoded and decoded again.
+// The first round trip can normalise the message, such as dropping empty optional fields, so it's compared to the second.
+func fuzzRoundTrip(t *testing.T, tc Transcoder, data []byte) {
+	m, err := tc.Decode(data)
+	if err != nil {
+		return
+	}
+	for i := 0; i < 2; i++ {
+		encoded, err := tc.Encode(m)
+		if !assert.Nil(t, err, "Failed to encode %+v", m) {
+			return
+		}
+		again, err := tc.Decode(encoded)
+		if !assert.Nil(t, err, "Failed to decode %s", hex.EncodeToString(encoded)) {
+			return
+		}
+		if i > 0 {
+			assert.Equal(t, m, again)
+		}
+		m = again
+	}
+}
+
+func FuzzCborDecode(f *testing.F) {
+	addSeeds(f, &CborTranscoder{})
+	f.Add([]byte{0xa1, 0x63, 'm', 's', 'g', 0x5b, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		tc := &CborTranscoder{Limits: DefaultDecodeLimits()}
+		fuzzRoundTrip(t, tc, data)
+		fuzzStream(t, tc, data)
+	})
+}
+
+func FuzzJsonDecode(f *testing.F) {
+	addSeeds(f, &JsonTranscoder{})
+	f.Add([]byte(`{"bhubver":1,"id":"one"}`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		tc := &JsonTranscoder{Limits: DefaultDecodeLimits()}
+		fuzzRoundTrip(t, tc, data)
+		fuzzStream(t, tc, data)
+	})
+}
+
+func FuzzFramedDecode(f *testing.F) {
+	addSeeds(f, CodecFramedCBOR.Transcoder())
+	f.Add([]byte{0x7f, 0xff, 0xff, 0xff})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		tc := CodecFramedCBOR.TranscoderWithLimits(DefaultDecodeLimits())
+		fuzzRoundTrip(t, tc, data)
+		fuzzStream(t, tc, data)
+	})
+}
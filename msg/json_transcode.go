@@ -1,36 +1,60 @@
 package msg
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"io"
 )
 
 // JSON Implementation of the Transcoder interface
 type JsonTranscoder struct {
+	// Limits on the messages read by stream decoders. The zero value is unlimited.
+	Limits DecodeLimits
 }
 
 type jsonDecoder struct {
-	dec *json.Decoder
+	dec    *json.Decoder
+	limits DecodeLimits
 }
 
-func (*JsonTranscoder) Encode(msgin Message) (msgout []byte, ok bool) {
-	msgout, err := json.Marshal(msgin)
-	ok = (err == nil)
-	return
+func (*JsonTranscoder) Encode(msgin Message) (msgout []byte, err error) {
+	msgout, err = json.Marshal(msgin)
+	return msgout, encodeError(msgin, err)
 }
 
-func (*JsonTranscoder) Decode(msgin []byte) (msgout Message, ok bool) {
-	err := json.Unmarshal(msgin, &msgout)
-	ok = (err == nil)
-	return
+func (*JsonTranscoder) Decode(msgin []byte) (msgout Message, err error) {
+	err = json.Unmarshal(msgin, &msgout)
+	return msgout, decodeError(err)
 }
 
-func (*JsonTranscoder) NewStreamDecoder(r io.Reader) StreamDecoder {
-	return &jsonDecoder{dec: json.NewDecoder(r)}
+func (jt *JsonTranscoder) NewStreamDecoder(r io.Reader) StreamDecoder {
+	r, lr := jt.Limits.wrapReader(r)
+	jd := &jsonDecoder{dec: json.NewDecoder(r), limits: jt.Limits}
+	if lr != nil {
+		lr.consumed = jd.dec.InputOffset
+	}
+	return jd
 }
 
-func (jd *jsonDecoder) DecodeNext() (msgout Message, ok bool) {
-	err := jd.dec.Decode(&msgout)
-	ok = (err == nil)
-	return
+func (jd *jsonDecoder) DecodeNext() (msgout Message, err error) {
+	err = jd.dec.Decode(&msgout)
+	if err == nil {
+		return msgout, jd.limits.checkMessage(&msgout)
+	}
+	if errors.Is(err, errMessageTooLarge) {
+		return msgout, jd.limits.tooLarge()
+	}
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var base64Err base64.CorruptInputError
+	switch {
+	case errors.As(err, &syntaxErr):
+		// The decoder gives up on the rest of the stream
+		return msgout, &DecodeError{Status: ENCODING_ERROR, Err: err}
+	case errors.As(err, &typeErr), errors.As(err, &base64Err):
+		// The whole message was read, but didn't fit the Message structure
+		return msgout, &DecodeError{Status: ENCODING_ERROR, Recoverable: true, Err: err}
+	}
+	return msgout, err
 }
@@ -0,0 +1,120 @@
+package msg
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Default limits used by DefaultDecodeLimits, matching the largest relays the server accepts
+const (
+	DefaultMaxMessageSize = 64 * 1024
+	DefaultMaxDests       = 255
+	DefaultMaxMsgLength   = 1024
+)
+
+// DecodeLimits bounds the messages a StreamDecoder will read, so a peer can't make it buffer or allocate arbitrarily
+// large messages. A message breaking a limit is a TOO_LONG DecodeError. Zero fields are unlimited.
+type DecodeLimits struct {
+	// Largest encoded message, in bytes. The decoder stops reading once a message gets larger than this, which loses
+	// its place in the stream, so the DecodeError isn't Recoverable.
+	MaxMessageSize int
+	// Most destinations in a Relay Request. The message has been read, so the DecodeError is Recoverable.
+	MaxDests int
+	// Longest message in a Relay Request or Relay Indication. The DecodeError is Recoverable.
+	MaxMsgLength int
+}
+
+// Get the DecodeLimits the server uses by default
+func DefaultDecodeLimits() DecodeLimits {
+	return DecodeLimits{
+		MaxMessageSize: DefaultMaxMessageSize,
+		MaxDests:       DefaultMaxDests,
+		MaxMsgLength:   DefaultMaxMsgLength,
+	}
+}
+
+// Returned by limitedReader once the message being decoded is too large
+var errMessageTooLarge = errors.New("message too large")
+
+// Get the error for a decoded message, if its contents break the limits
+func (l DecodeLimits) check(m *Message) error {
+	if m.RelayReq != nil {
+		if err := l.checkRelay(m.RelayReq); err != nil {
+			return err
+		}
+	}
+	if m.RelayBatReq != nil {
+		for i := range m.RelayBatReq.Relays {
+			if err := l.checkRelay(&m.RelayBatReq.Relays[i]); err != nil {
+				return err
+			}
+		}
+	}
+	if m.RelayInd != nil && l.MaxMsgLength > 0 && len(m.RelayInd.Msg) > l.MaxMsgLength {
+		return &DecodeError{Status: TOO_LONG, Recoverable: true,
+			Err: fmt.Errorf("message of %d bytes is over the limit of %d", len(m.RelayInd.Msg), l.MaxMsgLength)}
+	}
+	return nil
+}
+
+// Get the error for a Relay Request, if it breaks the limits
+func (l DecodeLimits) checkRelay(req *RelayRequest) error {
+	if l.MaxDests > 0 && len(req.Dest) > l.MaxDests {
+		return &DecodeError{Status: TOO_LONG, Recoverable: true,
+			Err: fmt.Errorf("%d destinations is over the limit of %d", len(req.Dest), l.MaxDests)}
+	}
+	if l.MaxMsgLength > 0 && len(req.Msg) > l.MaxMsgLength {
+		return &DecodeError{Status: TOO_LONG, Recoverable: true,
+			Err: fmt.Errorf("message of %d bytes is over the limit of %d", len(req.Msg), l.MaxMsgLength)}
+	}
+	return nil
+}
+
+// Get the error for a decoded message, if it's from an unsupported version or breaks the limits
+func (l DecodeLimits) checkMessage(m *Message) error {
+	if err := checkVersion(m); err != nil {
+		return err
+	}
+	return l.check(m)
+}
+
+// Reader for a stream decoder, which refuses to read more than 'max' bytes past the end of the last decoded message.
+// Stream decoders only read more once the data they have buffered doesn't hold a whole message, so this stops them
+// buffering a message larger than 'max', without having to parse it.
+type limitedReader struct {
+	r   io.Reader
+	max int
+	// Total bytes read from 'r'
+	read int64
+	// Gets the total bytes the decoder has decoded
+	consumed func() int64
+}
+
+// Wrap a reader for a stream decoder, if there is a limit on the message size
+func (l DecodeLimits) wrapReader(r io.Reader) (io.Reader, *limitedReader) {
+	if l.MaxMessageSize <= 0 {
+		return r, nil
+	}
+	lr := &limitedReader{r: r, max: l.MaxMessageSize}
+	return lr, lr
+}
+
+func (lr *limitedReader) Read(p []byte) (n int, err error) {
+	// Decoders only read more once they know the buffered message is incomplete, so a full buffer means it's too large
+	allowed := int64(lr.max) - (lr.read - lr.consumed())
+	if allowed <= 0 {
+		return 0, errMessageTooLarge
+	}
+	if int64(len(p)) > allowed {
+		p = p[:allowed]
+	}
+	n, err = lr.r.Read(p)
+	lr.read += int64(n)
+	return
+}
+
+// Get the error for a message that was too large to decode
+func (l DecodeLimits) tooLarge() error {
+	return &DecodeError{Status: TOO_LONG, Err: fmt.Errorf("message is over the limit of %d bytes", l.MaxMessageSize)}
+}
@@ -9,7 +9,10 @@ Every message contains:
    - Unique per command-response pair
    - Links response messages to requests (same ID)
  - Map containing the actual command type
-   - The underlying message structure supports combining multiple commands per message, but this is not currently used in the protocol.
+   - A message may combine several different commands, such as an Identify and a Subscribe Request. The hub handles
+     each of them, and answers with a single message containing the response to each (with the same Message ID).
+     Commands with no response add nothing to it, so a message of only those isn't answered. Several relays can be
+     sent together in a Relay Batch Request.
  - Additional fields as the 'map' values based on command ID
 
 Terminology:
@@ -23,23 +26,179 @@ Commands (with direction):
  - Identify Request (C->H)
  - Identify Response (C<-H)
     - Id: ClientId
+    - Session: Token for resuming the session after disconnection (Only if the hub stores messages)
  - List Request (C->H)
+    - Offset: Number of matching clients to skip, to get a later page (optional)
+    - Limit: Maximum number of clients to list (optional, zero for no limit)
+    - Filter: Only list clients whose name starts with this prefix (optional)
+    - Metadata: If set, include metadata about each client, if the hub allows it
  - List Response (H<-C)
+    - Status: Status Code (omitted on success)
     - Others: Array of ClientIds
+    - Next: Offset of the next page, or zero if this is the last page
+    - Metadata: Array of (ClientId, Name, Connected, Address) tuples, if requested and allowed by the hub
  - Relay Request (C->H)
     - Dest: Array of ClientIds
     - Message: Byte array
+    - Broadcast: If set, Dest is ignored and the message is relayed to all other clients
+    - Topic: If set, Dest is ignored and the message is relayed to all subscribers of the topic
+    - DestGroups: Array of group names, whose members are added to Dest (optional)
+    - Reliable: If set, relays to destinations with full buffers are retried, and failures reported with a Relay Failure Indication
+    - AckRequested: If set, each destination will acknowledge delivery with a Delivery Request
+    - ContentType: How the message should be interpreted, such as a MIME type (optional)
+    - Loopback: If set, the sender may be one of the destinations, and receives the message too
+    - MsgUUID: Unique ID of the relay chosen by the sender, so the hub can drop duplicates when it's retried (optional)
+    - Priority: High (1), normal (0, the default) or low (-1). Higher priority relays are sent to each destination first
+    - Verbosity: Failures only (0, the default) or all (1), for which destinations are listed in the Relay Response
+    - TTL: Milliseconds after which the hub discards the relay, for any destination it hasn't been sent to yet (optional)
+    - Compression: DEFLATE (1) or Zstandard (2) compression of the message (optional)
  - Relay Response (C<-H)
     - Array of (ClientId, Status) tuples
  - Relay Indication (C<-H)
     - Source: ClientId
     - Message: Byte array
+    - Topic: The topic the message was published to, if any
+    - AckRequested: If set, the client should acknowledge delivery with a Delivery Request
+    - RelayId: Message ID of the original Relay Request (only if AckRequested)
+    - ContentType: ContentType of the original Relay Request, if any
+    - Timestamp: Time the hub received the relay, in milliseconds since the Unix epoch
+    - Priority: Priority of the original Relay Request, if not normal
+    - TTL: TTL of the original Relay Request, if any
+    - Compression: Compression of the message, from the original Relay Request
+ - Subscribe Request (C->H)
+    - Topic: String
+ - Subscribe Response (C<-H)
+    - Status: Status
+ - Unsubscribe Request (C->H)
+    - Topic: String
+ - Unsubscribe Response (C<-H)
+    - Status: Status
+ - Ping Request (C->H or H->C)
+ - Ping Response (C<-H or H<-C)
+ - Delivery Request (C->H) (No response)
+    - Dest: ClientId of the original relay's source
+    - RelayId: Message ID of the original Relay Request
+ - Delivery Indication (C<-H)
+    - Source: ClientId which received the relay
+    - RelayId: Message ID of the original Relay Request
+ - Set Name Request (C->H)
+    - Name: String alias for the client (empty to clear)
+ - Set Name Response (C<-H)
+    - Status: Status
+ - Resolve Name Request (C->H)
+    - Name: String alias of another client
+ - Resolve Name Response (C<-H)
+    - Status: Status
+    - Id: ClientId
+ - Going Away Indication (C<-H)
+ - Disconnect Indication (C<-H)
+    - Reason: Status, why the hub is disconnecting the client
+ - Hello Request (C->H)
+    - MinVersion: Oldest Version supported by the client
+    - MaxVersion: Newest Version supported by the client
+ - Hello Response (C<-H)
+    - Status: Status
+    - Version: Version agreed for the rest of the connection
+    - MinVersion: Oldest Version supported by the hub
+    - MaxVersion: Newest Version supported by the hub
+ - Auth Request (C->H)
+    - Credentials: Token, or Username and Password
+ - Auth Response (C<-H)
+    - Status: Status
+    - Id: New ClientId of the client, if authenticating moved it onto its identity's ID (omitted otherwise)
+ - Resume Request (C->H)
+    - Id: ClientId of the previous session
+    - Session: Token of the previous session
+ - Resume Response (C<-H)
+    - Status: Status
+ - Presence Request (C->H)
+    - Subscribe: Whether to receive Presence Indications (false to stop)
+ - Presence Response (C<-H)
+    - Status: Status
+ - Presence Indication (C<-H)
+    - Id: ClientId of another client
+    - Online: True if the client connected, false if it disconnected
+ - Group Create Request (C->H)
+    - Group: Name of the new group, which the client joins
+ - Group Create Response (C<-H)
+    - Status: Status
+ - Group Join Request (C->H)
+    - Group: Name of an existing group
+ - Group Join Response (C<-H)
+    - Status: Status
+ - Group Leave Request (C->H)
+    - Group: Name of a group the client is a member of
+ - Group Leave Response (C<-H)
+    - Status: Status
+ - Group List Request (C->H)
+    - Group: Name of the group to list the members of (empty to list all groups)
+ - Group List Response (C<-H)
+    - Status: Status
+    - Groups: Array of group names (only if Group was empty)
+    - Members: Array of ClientIds in the group (only if Group was set)
+ - Relay Failure Indication (C<-H)
+    - Dest: ClientId the relay couldn't be delivered to
+    - RelayId: Message ID of the original Relay Request
+    - Status: Status
+ - History Request (C->H)
+    - Topic: Topic to get the recent relays of (empty for relays sent directly to the client)
+    - Limit: Maximum number of relays to get, keeping the newest (optional, zero for all the hub has kept)
+    - Since: Only get relays with a later Timestamp than this (optional)
+ - History Response (C<-H)
+    - Status: Status
+    - Relays: Array of Relay Indications, oldest first
+ - Server Full Indication (C<-H)
+ - Stats Request (C->H)
+ - Stats Response (C<-H)
+    - Status: Status
+    - Clients: Number of connected clients
+    - Uptime: Time since the hub started, in milliseconds
+    - RelayRate: Relay Requests from the client's namespace handled per second, averaged over the last few seconds
+    - BytesReceived: Bytes the hub has received from the client
+    - BytesSent: Bytes the hub has sent to the client
+    - RelaysExpired: Relays the hub has discarded because their TTL (or its own deadline) elapsed, for any destination
+ - Flow Update (C->H) (No response)
+    - Credits: Number of further Relay Indications the client is willing to receive
+ - Relay Batch Request (C->H)
+    - Relays: Array of Relay Requests, handled in order
+    - RelayIds: ID of each relay, used in place of the Message ID in its Delivery and Relay Failure Indications (optional)
+ - Relay Batch Response (C<-H)
+    - Status: Status of the batch as a whole
+    - Results: Array of Relay Responses, one for each relay in the batch
+ - Error Response (C<-H)
+    - Status: Status describing why the message couldn't be handled
+    - Text: Description of the problem (optional)
+
+Version negotiation:
+ Clients may send a Hello Request as their first message, to agree on the newest Version supported by both sides.
+ Until then (or if the client never sends one), version 1 is used. Both sides stamp every message they send with
+ the agreed Version. A hub receiving a message with a Version it doesn't support replies with a Hello Response
+ containing VERSION_MISMATCH and its supported range, and otherwise ignores the message.
+
+Authentication:
+ A hub may require clients to authenticate with an Auth Request before using it. Until then, only Identify, Hello,
+ Ping and Auth Requests and Flow Updates are accepted; any other message is ignored, and answered with an Auth Response containing
+ UNAUTHENTICATED, along with an Error Response. Clients that don't authenticate in time are disconnected.
+
+Errors:
+ A message the hub can't handle at all is answered with an Error Response, so the client doesn't wait for a response
+ that will never come. That includes a malformed message (if its Message ID can be made out), and a message with no
+ command the hub understands, which gets UNSUPPORTED. A hub too busy for a message's requests answers each of them with
+ BUSY in its usual response, as well as in an Error Response.
+
+Codecs:
+ Messages are encoded with CBOR by default, or JSON. Every message is a map, so the codec can be detected from the
+ first byte sent by the client: 0xa0 to 0xbf for CBOR, or '{' (after any whitespace) for JSON. A hub may accept
+ several codecs on the same port, and replies to each client with the codec it used.
 */
 package msg
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"time"
 )
 
 // ClientId type, unique id per client
@@ -63,28 +222,129 @@ const (
 	TIMEOUT
 	// One of the parameters is longer than the protocol allows
 	TOO_LONG
+	// Request was cancelled by the caller before response was received
+	CANCELLED
+	// Connection was closed because the other side stopped responding to pings
+	INACTIVE
+	// Name is already registered by another client
+	NAME_IN_USE
+	// Connection was closed because the server is shutting down
+	GOING_AWAY
+	// The other side doesn't support any of our protocol versions
+	VERSION_MISMATCH
+	// The client hasn't authenticated, or its credentials were rejected
+	UNAUTHENTICATED
+	// The server's policy doesn't allow the request
+	FORBIDDEN
+	// Connection was closed because the client stopped reading what it was sent
+	SLOW_CONSUMER
+	// The server has too many of the client's requests outstanding, so the request should be retried later
+	BUSY
+	// The client is a destination of its own relay, which the hub doesn't allow without Loopback
+	SELF_RELAY
+	// Connection was refused because the hub has too many clients, or too many from the same address
+	SERVER_FULL
+	// The relay was rejected by one of the hub's content filters
+	FILTERED
+	// The relay's TTL elapsed before it could be sent to the destination
+	EXPIRED
+	// The client has relayed as many bytes as its quota allows for now
+	QUOTA_EXCEEDED
+	// Connection was refused because the hub is draining its clients for maintenance, so another hub should be used
+	DRAINING
+	// The message didn't contain any request the hub understands
+	UNSUPPORTED
 )
 
-// Version type, only version 1 currently supported
+// Version type, for the protocol version of each message
 type Version int
 
+// Version used before any other has been negotiated with a Hello Request
 const MyVersion Version = 1
 
+// Range of protocol versions supported by this implementation.
+// Version 2 introduces the Hello handshake, otherwise message shapes are unchanged from version 1.
+const (
+	MinVersion Version = 1
+	MaxVersion Version = 2
+)
+
+// Check whether a version is supported by this implementation
+func (v Version) Supported() bool {
+	return v >= MinVersion && v <= MaxVersion
+}
+
+// NegotiateVersion finds the newest version in both this implementation's supported range, and the range [min, max].
+// 'ok' is false if the ranges don't overlap.
+func NegotiateVersion(min, max Version) (v Version, ok bool) {
+	v = max
+	if v > MaxVersion {
+		v = MaxVersion
+	}
+	if v < min || v < MinVersion {
+		return 0, false
+	}
+	return v, true
+}
+
 // ClientStatusMap is a map of clientIDs to their respective status
 type ClientStatusMap map[ClientId]Status
 
 // Message is the message that is actually sent over the transport, with
 // subfields to represent all of the other message types.
+// Trace optionally carries the trace context of the span that sent it, as a W3C traceparent.
 type Message struct {
-	Version   Version           `json:"bhubver"`
-	MessageId uint32            `json:"id"`
-	IdReq     *IdentifyRequest  `json:"ir,omitempty"`
-	IdRes     *IdentifyResponse `json:"IR,omitempty"`
-	ListReq   *ListRequest      `json:"lr,omitempty"`
-	ListRes   *ListResponse     `json:"LR,omitempty"`
-	RelayReq  *RelayRequest     `json:"rr,omitempty"`
-	RelayRes  *RelayResponse    `json:"RR,omitempty"`
-	RelayInd  *RelayIndication  `json:"RI,omitempty"`
+	Version      Version                 `json:"bhubver"`
+	MessageId    uint32                  `json:"id"`
+	Trace        string                  `json:"tc,omitempty"`
+	IdReq        *IdentifyRequest        `json:"ir,omitempty"`
+	IdRes        *IdentifyResponse       `json:"IR,omitempty"`
+	ListReq      *ListRequest            `json:"lr,omitempty"`
+	ListRes      *ListResponse           `json:"LR,omitempty"`
+	RelayReq     *RelayRequest           `json:"rr,omitempty"`
+	RelayRes     *RelayResponse          `json:"RR,omitempty"`
+	RelayInd     *RelayIndication        `json:"RI,omitempty"`
+	SubReq       *SubscribeRequest       `json:"sr,omitempty"`
+	SubRes       *SubscribeResponse      `json:"SR,omitempty"`
+	UnsubReq     *UnsubscribeRequest     `json:"ur,omitempty"`
+	UnsubRes     *UnsubscribeResponse    `json:"UR,omitempty"`
+	PingReq      *PingRequest            `json:"pr,omitempty"`
+	PingRes      *PingResponse           `json:"PR,omitempty"`
+	DelivReq     *DeliveryRequest        `json:"dr,omitempty"`
+	DelivInd     *DeliveryIndication     `json:"DI,omitempty"`
+	NameReq      *SetNameRequest         `json:"nr,omitempty"`
+	NameRes      *SetNameResponse        `json:"NR,omitempty"`
+	ResolvReq    *ResolveNameRequest     `json:"rn,omitempty"`
+	ResolvRes    *ResolveNameResponse    `json:"RN,omitempty"`
+	GoingAway    *GoingAwayIndication    `json:"GI,omitempty"`
+	HelloReq     *HelloRequest           `json:"hr,omitempty"`
+	HelloRes     *HelloResponse          `json:"HR,omitempty"`
+	AuthReq      *AuthRequest            `json:"ar,omitempty"`
+	AuthRes      *AuthResponse           `json:"AR,omitempty"`
+	ResumeReq    *ResumeRequest          `json:"rs,omitempty"`
+	ResumeRes    *ResumeResponse         `json:"RS,omitempty"`
+	PresReq      *PresenceRequest        `json:"ps,omitempty"`
+	PresRes      *PresenceResponse       `json:"PS,omitempty"`
+	PresInd      *PresenceIndication     `json:"PI,omitempty"`
+	GrpCreateReq *GroupCreateRequest     `json:"gc,omitempty"`
+	GrpCreateRes *GroupCreateResponse    `json:"GC,omitempty"`
+	GrpJoinReq   *GroupJoinRequest       `json:"gj,omitempty"`
+	GrpJoinRes   *GroupJoinResponse      `json:"GJ,omitempty"`
+	GrpLeaveReq  *GroupLeaveRequest      `json:"gl,omitempty"`
+	GrpLeaveRes  *GroupLeaveResponse     `json:"GL,omitempty"`
+	GrpListReq   *GroupListRequest       `json:"gs,omitempty"`
+	GrpListRes   *GroupListResponse      `json:"GS,omitempty"`
+	FailInd      *RelayFailureIndication `json:"FI,omitempty"`
+	HistReq      *HistoryRequest         `json:"hy,omitempty"`
+	HistRes      *HistoryResponse        `json:"HY,omitempty"`
+	ServerFull   *ServerFullIndication   `json:"SF,omitempty"`
+	StatsReq     *StatsRequest           `json:"st,omitempty"`
+	StatsRes     *StatsResponse          `json:"ST,omitempty"`
+	Disconnect   *DisconnectIndication   `json:"DX,omitempty"`
+	FlowUpd      *FlowUpdate             `json:"fu,omitempty"`
+	RelayBatReq  *RelayBatchRequest      `json:"rb,omitempty"`
+	RelayBatRes  *RelayBatchResponse     `json:"RB,omitempty"`
+	Error        *ErrorResponse          `json:"ER,omitempty"`
 }
 
 // IdentifyRequest is a identify message request from Client to Hub to get its client ID
@@ -93,49 +353,456 @@ type IdentifyRequest struct {
 
 // IdentifyResponse is the response to the IdentifyRequest, identifying the client
 type IdentifyResponse struct {
-	Id ClientId `json:"id"`
+	Id      ClientId `json:"id"`
+	Session string   `json:"ses,omitempty"`
 }
 
 // ListRequest is a request from client to hub to list all other client IDs connected to the hub
+// Clients are listed in order of ID, so a large list can be fetched a page at a time with Offset and Limit.
+// A zero Limit lists every matching client. If Filter is set, only clients with a name starting with it are listed.
 type ListRequest struct {
+	Offset   uint32 `json:"off,omitempty"`
+	Limit    uint32 `json:"lim,omitempty"`
+	Filter   string `json:"flt,omitempty"`
+	Metadata bool   `json:"md,omitempty"`
 }
 
-// ListResponse is the response to ListRequest, listing all other connected Clients by ID
+// ListResponse is the response to ListRequest, listing other connected Clients by ID.
+// If there are more clients to list, Next is the Offset to request the next page with.
+// Metadata has an entry for each client in Others, but only if it was requested, and the hub shares it.
+// Status is omitted on success, and BUSY if the hub rejected the request because too many were outstanding.
 type ListResponse struct {
-	Others []ClientId `json:"o"`
+	Status   Status           `json:"sta,omitempty"`
+	Others   []ClientId       `json:"o"`
+	Next     uint32           `json:"nxt,omitempty"`
+	Metadata []ClientMetadata `json:"md,omitempty"`
+}
+
+// ClientMetadata describes another connected client, in a ListResponse.
+// Address is only a category of the client's address ("loopback", "private", "public" or "other"), for privacy.
+type ClientMetadata struct {
+	Id        ClientId `json:"id"`
+	Name      string   `json:"n,omitempty"`
+	Connected int64    `json:"ct"`
+	Address   string   `json:"ad"`
 }
 
 // RelayRequest is a request from client to hub to request a message to be relayed to a list of other clients
+// If Broadcast is set, the Dest list is ignored and the message is relayed to every other connected client.
+// If Topic is set, the Dest list is ignored and the message is relayed to every other subscriber of that topic.
+// Otherwise, the members of every group in DestGroups are added to the Dest list (except the sender itself).
+// If AckRequested is set, each destination will send back a DeliveryIndication once the message is delivered.
+// If Reliable is set, destinations whose buffers are full don't fail straight away, but are retried by the hub
+// until its retry deadline. Any destination that still can't be reached is reported later with a RelayFailureIndication.
+// The sender is only relayed its own message if Loopback is set (or the hub allows it anyway), and otherwise it fails
+// with SELF_RELAY in the StatusMap.
+// If MsgUUID is set, the hub remembers it for a while, and a later relay from the same client with the same MsgUUID
+// isn't relayed again, but gets the same RelayResponse as the original. So a sender can safely retry a relay that timed out.
+// If Verbosity is VerbosityAll, the RelayResponse lists every destination, including those the relay was accepted for.
+// If TTL is set, the hub discards the relay for any destination it hasn't been sent to within TTL milliseconds, such as
+// one stuck behind a slow consumer. With AckRequested, the sender is told with a RelayFailureIndication.
+// If Compression is set, Msg is compressed with it. The hub relays it as it is, with the same Compression.
 type RelayRequest struct {
-	Dest []ClientId `json:"dst"`
-	Msg  []byte     `json:"msg"`
+	Dest         []ClientId  `json:"dst"`
+	Msg          []byte      `json:"msg"`
+	Broadcast    bool        `json:"bc,omitempty"`
+	Topic        string      `json:"tp,omitempty"`
+	AckRequested bool        `json:"ack,omitempty"`
+	ContentType  string      `json:"ct,omitempty"`
+	DestGroups   []string    `json:"dg,omitempty"`
+	Reliable     bool        `json:"rel,omitempty"`
+	Loopback     bool        `json:"lb,omitempty"`
+	MsgUUID      string      `json:"uid,omitempty"`
+	Priority     Priority    `json:"pri,omitempty"`
+	Verbosity    Verbosity   `json:"vb,omitempty"`
+	TTL          uint32      `json:"ttl,omitempty"`
+	Compression  Compression `json:"cmp,omitempty"`
 }
 
 // RelayResponse is the response to RelayRequest, containing a status for each client the message was relayed to
 // There is also an overall status field, for the case where the message was not relayed at all.
-// The StatusMap does not include successes, so if a Client ID is not present, it can be assumed to be successful.
+// The StatusMap does not include successes, so if a Client ID is not present, it can be assumed to be successful,
+// unless the request asked for VerbosityAll. Then every destination is listed, with SUCCESS once the relay has been
+// buffered for it (or stored or forwarded, if it isn't connected to this hub).
 type RelayResponse struct {
 	Status    Status          `json:"sta"`
 	StatusMap ClientStatusMap `json:"csm"`
 }
 
 // RelayIndication is a message from the hub to a client, containing the source of the message, and the message itself
+// Topic is only set if the message was published to a topic the client is subscribed to.
+// If AckRequested is set, the client should send a DeliveryRequest back to Src for RelayId, once the message is delivered.
+// If Compression is set, Msg was compressed by the sender, and should be decompressed before it's used.
 type RelayIndication struct {
-	Src ClientId `json:"src"`
-	Msg []byte   `json:"msg"`
+	Src          ClientId    `json:"src"`
+	Msg          []byte      `json:"msg"`
+	Topic        string      `json:"tp,omitempty"`
+	AckRequested bool        `json:"ack,omitempty"`
+	RelayId      uint32      `json:"rid,omitempty"`
+	ContentType  string      `json:"ct,omitempty"`
+	Timestamp    int64       `json:"ts,omitempty"`
+	Priority     Priority    `json:"pri,omitempty"`
+	TTL          uint32      `json:"ttl,omitempty"`
+	Compression  Compression `json:"cmp,omitempty"`
+}
+
+// Time gets the time the hub received the relay, from its Timestamp. Returns the zero time if it wasn't stamped.
+func (ind RelayIndication) Time() time.Time {
+	if ind.Timestamp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ind.Timestamp*int64(time.Millisecond))
+}
+
+// Expiry gets the time after which the hub discards the relay, from its Timestamp and TTL.
+// Returns the zero time if it has no TTL.
+func (ind RelayIndication) Expiry() time.Time {
+	if ind.TTL == 0 || ind.Timestamp == 0 {
+		return time.Time{}
+	}
+	return ind.Time().Add(time.Duration(ind.TTL) * time.Millisecond)
+}
+
+// Expired checks whether the relay's TTL has elapsed by 'now'
+func (ind RelayIndication) Expired(now time.Time) bool {
+	expiry := ind.Expiry()
+	return !expiry.IsZero() && !now.Before(expiry)
+}
+
+// Text gets the relayed message as a string, such as one sent with the client's RelayString
+func (ind RelayIndication) Text() string {
+	return string(ind.Msg)
+}
+
+// DecodeJSON unmarshals the relayed message into 'into' with 'json.Unmarshal', such as one sent with the client's
+// RelayJSON. The ContentType isn't checked, so any message holding JSON can be decoded.
+func (ind RelayIndication) DecodeJSON(into any) error {
+	return json.Unmarshal(ind.Msg, into)
+}
+
+// Get the Timestamp for a relay received by the hub at 't'
+func TimestampOf(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// SubscribeRequest is a request from client to hub to receive all relays published to a topic
+type SubscribeRequest struct {
+	Topic string `json:"tp"`
+}
+
+// SubscribeResponse is the response to SubscribeRequest
+type SubscribeResponse struct {
+	Status Status `json:"sta"`
+}
+
+// UnsubscribeRequest is a request from client to hub to stop receiving relays published to a topic
+type UnsubscribeRequest struct {
+	Topic string `json:"tp"`
+}
+
+// UnsubscribeResponse is the response to UnsubscribeRequest
+type UnsubscribeResponse struct {
+	Status Status `json:"sta"`
+}
+
+// PingRequest is a keepalive request, which can be sent by either the client or the hub.
+// The receiver should reply with a PingResponse with the same message ID.
+type PingRequest struct {
+}
+
+// PingResponse is the response to PingRequest
+type PingResponse struct {
+}
+
+// DeliveryRequest is an acknowledgement from client to hub, that a relay requesting acknowledgement has been delivered.
+// The hub forwards it to the original sender as a DeliveryIndication. There is no response.
+type DeliveryRequest struct {
+	Dest    ClientId `json:"dst"`
+	RelayId uint32   `json:"rid"`
+}
+
+// DeliveryIndication is a message from the hub to a client, that a relay it sent was delivered to Src.
+// RelayId is the message ID of the original RelayRequest.
+type DeliveryIndication struct {
+	Src     ClientId `json:"src"`
+	RelayId uint32   `json:"rid"`
+}
+
+// SetNameRequest is a request from client to hub to register a human-readable alias for the client.
+// Names are unique across the hub, and an empty name clears the client's current name.
+type SetNameRequest struct {
+	Name string `json:"n"`
+}
+
+// SetNameResponse is the response to SetNameRequest
+type SetNameResponse struct {
+	Status Status `json:"sta"`
+}
+
+// ResolveNameRequest is a request from client to hub to look up the ClientId registered with a name
+type ResolveNameRequest struct {
+	Name string `json:"n"`
+}
+
+// ResolveNameResponse is the response to ResolveNameRequest. Id is only valid if Status is SUCCESS.
+type ResolveNameResponse struct {
+	Status Status   `json:"sta"`
+	Id     ClientId `json:"id"`
+}
+
+// GoingAwayIndication is sent from hub to every client when the hub begins a graceful shutdown.
+// The hub flushes any responses and relays already queued for the client, then closes the connection.
+type GoingAwayIndication struct {
+}
+
+// HelloRequest is a request from client to hub to negotiate the protocol version, given the range the client supports
+type HelloRequest struct {
+	MinVersion Version `json:"min"`
+	MaxVersion Version `json:"max"`
+}
+
+// HelloResponse is the response to HelloRequest, or to any message with an unsupported Version.
+// Version is only valid if Status is SUCCESS, the hub's supported range is always included.
+type HelloResponse struct {
+	Status     Status  `json:"sta"`
+	Version    Version `json:"ver"`
+	MinVersion Version `json:"min"`
+	MaxVersion Version `json:"max"`
+}
+
+// Credentials presented by a client to authenticate with the hub.
+// Which fields are used depends on the hub's authenticator.
+type Credentials struct {
+	Token    string `json:"tok,omitempty"`
+	Username string `json:"usr,omitempty"`
+	Password string `json:"pwd,omitempty"`
+}
+
+// AuthRequest is a request from client to hub to authenticate the connection
+type AuthRequest struct {
+	Credentials Credentials `json:"cr"`
+}
+
+// AuthResponse is the response to AuthRequest, or to any message sent before authenticating with a hub that requires it.
+// Id is set if the hub gives the identity the client authenticated as a ClientId of its own, which the client now has.
+type AuthResponse struct {
+	Status Status   `json:"sta"`
+	Id     ClientId `json:"id,omitempty"`
+}
+
+// ResumeRequest is a request from client to hub to reclaim the ClientId of a previous connection, and receive
+// any relays stored for it while disconnected. The client's current ClientId, topics, groups and name are abandoned.
+type ResumeRequest struct {
+	Id      ClientId `json:"id"`
+	Session string   `json:"ses"`
+}
+
+// ResumeResponse is the response to ResumeRequest. Stored relays follow as Relay Indications if Status is SUCCESS.
+type ResumeResponse struct {
+	Status Status `json:"sta"`
+}
+
+// PresenceRequest is a request from the client to start (or stop) receiving a PresenceIndication
+// whenever another client connects or disconnects
+type PresenceRequest struct {
+	Subscribe bool `json:"sub"`
+}
+
+// PresenceResponse is the response to PresenceRequest
+type PresenceResponse struct {
+	Status Status `json:"sta"`
+}
+
+// PresenceIndication is a message from the hub to a client subscribed to presence, when another client connects or disconnects
+type PresenceIndication struct {
+	Id     ClientId `json:"id"`
+	Online bool     `json:"on"`
+}
+
+// GroupCreateRequest is a request from client to hub to create a new named group, which the client joins.
+// Groups are removed by the hub once their last member leaves or disconnects.
+type GroupCreateRequest struct {
+	Group string `json:"grp"`
+}
+
+// GroupCreateResponse is the response to GroupCreateRequest. Status is NAME_IN_USE if the group already exists.
+type GroupCreateResponse struct {
+	Status Status `json:"sta"`
+}
+
+// GroupJoinRequest is a request from client to hub to join an existing group, to receive relays sent to it
+type GroupJoinRequest struct {
+	Group string `json:"grp"`
+}
+
+// GroupJoinResponse is the response to GroupJoinRequest. Status is INVALID_ID if the group doesn't exist.
+type GroupJoinResponse struct {
+	Status Status `json:"sta"`
+}
+
+// GroupLeaveRequest is a request from client to hub to leave a group
+type GroupLeaveRequest struct {
+	Group string `json:"grp"`
+}
+
+// GroupLeaveResponse is the response to GroupLeaveRequest. Status is INVALID_ID if the client isn't a member.
+type GroupLeaveResponse struct {
+	Status Status `json:"sta"`
+}
+
+// GroupListRequest is a request from client to hub to list the members of a group, or all groups if Group is empty
+type GroupListRequest struct {
+	Group string `json:"grp,omitempty"`
+}
+
+// GroupListResponse is the response to GroupListRequest. Status is INVALID_ID if the group doesn't exist.
+type GroupListResponse struct {
+	Status  Status     `json:"sta"`
+	Groups  []string   `json:"grps,omitempty"`
+	Members []ClientId `json:"mem,omitempty"`
+}
+
+// RelayFailureIndication is a message from the hub to a client, that a Reliable relay it sent couldn't be delivered to Dest.
+// RelayId is the message ID of the original RelayRequest. Status is TIMEOUT if the retry deadline passed,
+// or CONNECTION_ERROR if the destination disconnected first.
+// Relays with a TTL and AckRequested (whether Reliable or not) are also reported with EXPIRED, once they're discarded
+// because the TTL elapsed before they could be sent to Dest.
+type RelayFailureIndication struct {
+	Dest    ClientId `json:"dst"`
+	RelayId uint32   `json:"rid"`
+	Status  Status   `json:"sta"`
+}
+
+// HistoryRequest is a request from client to hub to get recent relays that it may have missed, if the hub keeps a history.
+// With a Topic, the relays sent to that topic are listed, and otherwise those sent directly to the client (or its session).
+// Since is a relay Timestamp, in milliseconds since the Unix epoch.
+type HistoryRequest struct {
+	Topic string `json:"tp,omitempty"`
+	Limit uint32 `json:"lim,omitempty"`
+	Since int64  `json:"snc,omitempty"`
+}
+
+// HistoryResponse is the response to HistoryRequest, with the matching relays oldest first.
+// Status is FORBIDDEN if the hub doesn't keep a history.
+type HistoryResponse struct {
+	Status Status            `json:"sta"`
+	Relays []RelayIndication `json:"rel,omitempty"`
+}
+
+// ServerFullIndication is sent from hub to a new client it won't accept, because it already has as many clients as
+// it allows (in total, or from the client's address), or because Draining for maintenance. The hub closes the
+// connection straight after.
+type ServerFullIndication struct {
+	Draining bool `json:"drn,omitempty"`
+}
+
+// DisconnectIndication is sent from hub to a client it is disconnecting, with the reason, such as FORBIDDEN if the
+// client has been banned, or GOING_AWAY if it may reconnect once the hub has restarted. The hub closes the connection
+// straight after.
+type DisconnectIndication struct {
+	Reason Status `json:"rsn"`
+}
+
+// FlowUpdate is a message from client to hub, granting it credits for that many more Relay Indications.
+// Until a client sends its first FlowUpdate, relays are sent to it without limit. Afterwards, the hub uses up a
+// credit for each relay it queues for the client, and rejects relays with NO_BUFFER once it has none left.
+// There is no response.
+type FlowUpdate struct {
+	Credits uint32 `json:"crd"`
+}
+
+// MaxBatchRelays is the most relays a RelayBatchRequest can carry
+const MaxBatchRelays = 255
+
+// RelayBatchRequest is a request from client to hub to send several relays at once, saving a round trip for each.
+// The relays are handled in order, each as if it had been sent in a RelayRequest of its own, and answered together
+// with a RelayBatchResponse. RelayIds, if set, has an ID for each relay, which takes the place of the message ID as
+// the RelayId of its DeliveryIndications and RelayFailureIndications. Otherwise they all use the message ID.
+type RelayBatchRequest struct {
+	Relays   []RelayRequest `json:"rly"`
+	RelayIds []uint32       `json:"rid,omitempty"`
+}
+
+// RelayBatchResponse is the response to RelayBatchRequest. Results has the response to each relay in the batch, in
+// order, unless the batch as a whole failed with Status (eg. TOO_LONG, if it had more than MaxBatchRelays).
+type RelayBatchResponse struct {
+	Status  Status          `json:"sta"`
+	Results []RelayResponse `json:"res,omitempty"`
+}
+
+// ErrorResponse is sent from hub to client in place of the usual response, for a message it couldn't handle at all:
+// one that was malformed, had no request the hub understands (UNSUPPORTED), or wasn't allowed before authenticating
+// (UNAUTHENTICATED). The message ID is that of the offending message, or zero if it couldn't be made out.
+// Text describes the problem for people, and shouldn't be relied on by programs.
+type ErrorResponse struct {
+	Status Status `json:"sta"`
+	Text   string `json:"txt,omitempty"`
+}
+
+// Err gets the error described by the ErrorResponse, as a StatusError for the message with ID 'mid'
+func (e *ErrorResponse) Err(mid uint32) error {
+	var cause error
+	if e.Text != "" {
+		cause = errors.New(e.Text)
+	}
+	return NewStatusError(e.Status, mid, cause)
+}
+
+// StatsRequest is a request from client to hub for statistics about the hub, and the client's own connection
+type StatsRequest struct {
+}
+
+// StatsResponse is the response to StatsRequest. Uptime is in milliseconds, and RelayRate is the number of Relay
+// Requests from clients in the requester's namespace handled per second, averaged over the last few seconds. The
+// byte counts are for the requesting client's connection, from the hub's side. RelaysExpired counts every
+// destination that a relay was discarded for because its TTL, or the hub's own deadline for sending relays, elapsed.
+// Status is FORBIDDEN if the hub only shares statistics with admin clients.
+type StatsResponse struct {
+	Status        Status  `json:"sta"`
+	Clients       uint32  `json:"cl,omitempty"`
+	Uptime        int64   `json:"up,omitempty"`
+	RelayRate     float64 `json:"rps,omitempty"`
+	BytesReceived uint64  `json:"bi,omitempty"`
+	BytesSent     uint64  `json:"bo,omitempty"`
+	RelaysExpired uint64  `json:"rx,omitempty"`
 }
 
 // The transcoder interface serializes/deserializes messages to byte arrays.
 // This allows for flexibility in message format for development/testing, and decouples the message format from the transport
 type Transcoder interface {
-	Encode(msgin Message) (msgout []byte, ok bool)
-	Decode(msgin []byte) (msgout Message, ok bool)
+	// Encode a message. Returns an ENCODING_ERROR *StatusError, with the cause of the failure, if it can't be encoded.
+	Encode(msgin Message) (msgout []byte, err error)
+	// Encode a message straight to a writer, as one call to Write. Unlike Encode, the encoding doesn't need a new buffer
+	// allocated for each message, so this is preferred for sending messages at high rates.
+	EncodeTo(w io.Writer, msgin Message) error
+	// Decode a whole message. Returns a *DecodeError, with the cause of the failure, if it can't be decoded.
+	Decode(msgin []byte) (msgout Message, err error)
 	NewStreamDecoder(r io.Reader) StreamDecoder
 }
 
+// EncodeOk is 'Transcoder.Encode', only reporting whether the message could be encoded.
+//
+// Deprecated: Use Transcoder.Encode, whose error says what couldn't be encoded.
+func EncodeOk(tc Transcoder, msgin Message) (msgout []byte, ok bool) {
+	msgout, err := tc.Encode(msgin)
+	return msgout, err == nil
+}
+
+// DecodeOk is 'Transcoder.Decode', only reporting whether the message could be decoded.
+//
+// Deprecated: Use Transcoder.Decode, whose error says what couldn't be decoded.
+func DecodeOk(tc Transcoder, msgin []byte) (msgout Message, ok bool) {
+	msgout, err := tc.Decode(msgin)
+	return msgout, err == nil
+}
+
 // The StreamDecoder decodes and de-packetises messages from a stream
 type StreamDecoder interface {
-	DecodeNext() (msgout Message, ok bool)
+	// Decode the next message in the stream. Returns a *DecodeError if the message couldn't be decoded, which may be
+	// Recoverable, so the next message can still be decoded. Messages from an unsupported protocol version are returned
+	// along with a VERSION_MISMATCH DecodeError, so they can be answered. Otherwise the error is from the stream itself,
+	// such as io.EOF.
+	DecodeNext() (msgout Message, err error)
 }
 
 func (s Status) String() string {
@@ -154,6 +821,38 @@ func (s Status) String() string {
 		return "TIMEOUT"
 	case TOO_LONG:
 		return "TOO_LONG"
+	case CANCELLED:
+		return "CANCELLED"
+	case INACTIVE:
+		return "INACTIVE"
+	case NAME_IN_USE:
+		return "NAME_IN_USE"
+	case GOING_AWAY:
+		return "GOING_AWAY"
+	case VERSION_MISMATCH:
+		return "VERSION_MISMATCH"
+	case UNAUTHENTICATED:
+		return "UNAUTHENTICATED"
+	case FORBIDDEN:
+		return "FORBIDDEN"
+	case SLOW_CONSUMER:
+		return "SLOW_CONSUMER"
+	case BUSY:
+		return "BUSY"
+	case SELF_RELAY:
+		return "SELF_RELAY"
+	case SERVER_FULL:
+		return "SERVER_FULL"
+	case FILTERED:
+		return "FILTERED"
+	case EXPIRED:
+		return "EXPIRED"
+	case QUOTA_EXCEEDED:
+		return "QUOTA_EXCEEDED"
+	case DRAINING:
+		return "DRAINING"
+	case UNSUPPORTED:
+		return "UNSUPPORTED"
 	default:
 		return fmt.Sprintf("[Unknown Status: %d]", int(s))
 	}
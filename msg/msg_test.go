@@ -2,10 +2,16 @@ package msg
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/fxamacker/cbor/v2"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -15,6 +21,9 @@ type cborTestElement struct {
 	hexString string
 }
 
+// "hi hi hi hi", compressed with DEFLATE
+var deflatedHi = []byte{0xca, 0xc8, 0x54, 0x80, 0x21, 0xc0, 0x00}
+
 var cborTestVec = []cborTestElement{
 	{
 		"Identify Request",
@@ -23,7 +32,7 @@ var cborTestVec = []cborTestElement{
 	},
 	{
 		"Identify Response",
-		Message{Version: MyVersion, MessageId: 0x34, IdRes: &IdentifyResponse{1234}},
+		Message{Version: MyVersion, MessageId: 0x34, IdRes: &IdentifyResponse{Id: 1234}},
 		"a36762687562766572016269641834624952a16269641904d2",
 	},
 	{
@@ -41,6 +50,11 @@ var cborTestVec = []cborTestElement{
 		Message{Version: MyVersion, MessageId: 0x9A, RelayReq: &RelayRequest{Dest: []ClientId{1, 2, 3}, Msg: []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xAB}}},
 		"a3676268756276657201626964189a627272a26364737483010203636d7367460123456789ab",
 	},
+	{
+		"Broadcast Relay Request",
+		Message{Version: MyVersion, MessageId: 0x9B, RelayReq: &RelayRequest{Msg: []byte{0x01, 0x23}, Broadcast: true}},
+		"a3676268756276657201626964189b627272a363647374f6636d7367420123626263f5",
+	},
 	{
 		"Relay Response",
 		Message{Version: MyVersion, MessageId: 0xBC, RelayRes: &RelayResponse{Status: SUCCESS, StatusMap: ClientStatusMap{2: NO_BUFFER, 3: INVALID_ID}}},
@@ -51,6 +65,334 @@ var cborTestVec = []cborTestElement{
 		Message{Version: MyVersion, MessageId: 0xDE, RelayInd: &RelayIndication{Src: 1234, Msg: []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xAB}}},
 		"a367626875627665720162696418de625249a2637372631904d2636d7367460123456789ab",
 	},
+	{
+		"Topic Relay Request",
+		Message{Version: MyVersion, MessageId: 0x9C, RelayReq: &RelayRequest{Msg: []byte{0x01}, Topic: "news"}},
+		"a3676268756276657201626964189c627272a363647374f6636d73674101627470646e657773",
+	},
+	{
+		"Topic Relay Indication",
+		Message{Version: MyVersion, MessageId: 0xDF, RelayInd: &RelayIndication{Src: 1234, Msg: []byte{0x01}, Topic: "news"}},
+		"a367626875627665720162696418df625249a3637372631904d2636d73674101627470646e657773",
+	},
+	{
+		"Subscribe Request",
+		Message{Version: MyVersion, MessageId: 0x13, SubReq: &SubscribeRequest{Topic: "news"}},
+		"a367626875627665720162696413627372a1627470646e657773",
+	},
+	{
+		"Subscribe Response",
+		Message{Version: MyVersion, MessageId: 0x13, SubRes: &SubscribeResponse{Status: SUCCESS}},
+		"a367626875627665720162696413625352a16373746100",
+	},
+	{
+		"Unsubscribe Request",
+		Message{Version: MyVersion, MessageId: 0x14, UnsubReq: &UnsubscribeRequest{Topic: "news"}},
+		"a367626875627665720162696414627572a1627470646e657773",
+	},
+	{
+		"Unsubscribe Response",
+		Message{Version: MyVersion, MessageId: 0x14, UnsubRes: &UnsubscribeResponse{Status: TOO_LONG}},
+		"a367626875627665720162696414625552a16373746106",
+	},
+	{
+		"Ping Request",
+		Message{Version: MyVersion, MessageId: 0x15, PingReq: &PingRequest{}},
+		"a367626875627665720162696415627072a0",
+	},
+	{
+		"Ping Response",
+		Message{Version: MyVersion, MessageId: 0x15, PingRes: &PingResponse{}},
+		"a367626875627665720162696415625052a0",
+	},
+	{
+		"Typed Relay Request",
+		Message{Version: MyVersion, MessageId: 0x9E, RelayReq: &RelayRequest{Dest: []ClientId{1}, Msg: []byte("{}"), ContentType: "application/json"}},
+		"a3676268756276657201626964189e627272a3636473748101636d7367427b7d626374706170706c69636174696f6e2f6a736f6e",
+	},
+	{
+		"Typed Relay Indication",
+		Message{Version: MyVersion, MessageId: 0xE0, RelayInd: &RelayIndication{Src: 1234, Msg: []byte("{}"), ContentType: "application/json", Timestamp: 1617055283000}},
+		"a367626875627665720162696418e0625249a4637372631904d2636d7367427b7d626374706170706c69636174696f6e2f6a736f6e6274731b0000017880017738",
+	},
+	{
+		"Acked Relay Request",
+		Message{Version: MyVersion, MessageId: 0x9D, RelayReq: &RelayRequest{Dest: []ClientId{1}, Msg: []byte{0x01}, AckRequested: true}},
+		"a3676268756276657201626964189d627272a3636473748101636d736741016361636bf5",
+	},
+	{
+		"Acked Relay Indication",
+		Message{Version: MyVersion, MessageId: 0xE0, RelayInd: &RelayIndication{Src: 1234, Msg: []byte{0x01}, AckRequested: true, RelayId: 0x9D}},
+		"a367626875627665720162696418e0625249a4637372631904d2636d736741016361636bf563726964189d",
+	},
+	{
+		"Delivery Request",
+		Message{Version: MyVersion, MessageId: 0x16, DelivReq: &DeliveryRequest{Dest: 1234, RelayId: 0x9D}},
+		"a367626875627665720162696416626472a2636473741904d263726964189d",
+	},
+	{
+		"Delivery Indication",
+		Message{Version: MyVersion, MessageId: 0xE1, DelivInd: &DeliveryIndication{Src: 1, RelayId: 0x9D}},
+		"a367626875627665720162696418e1624449a2637372630163726964189d",
+	},
+	{
+		"Set Name Request",
+		Message{Version: MyVersion, MessageId: 0x17, NameReq: &SetNameRequest{Name: "alice"}},
+		"a367626875627665720162696417626e72a1616e65616c696365",
+	},
+	{
+		"Set Name Response",
+		Message{Version: MyVersion, MessageId: 0x17, NameRes: &SetNameResponse{Status: NAME_IN_USE}},
+		"a367626875627665720162696417624e52a16373746109",
+	},
+	{
+		"Resolve Name Request",
+		Message{Version: MyVersion, MessageId: 0x18, ResolvReq: &ResolveNameRequest{Name: "alice"}},
+		"a3676268756276657201626964181862726ea1616e65616c696365",
+	},
+	{
+		"Resolve Name Response",
+		Message{Version: MyVersion, MessageId: 0x18, ResolvRes: &ResolveNameResponse{Status: SUCCESS, Id: 1234}},
+		"a3676268756276657201626964181862524ea263737461006269641904d2",
+	},
+	{
+		"Going Away Indication",
+		Message{Version: MyVersion, MessageId: 0x19, GoingAway: &GoingAwayIndication{}},
+		"a36762687562766572016269641819624749a0",
+	},
+	{
+		"Hello Request",
+		Message{Version: MyVersion, MessageId: 0x1a, HelloReq: &HelloRequest{MinVersion: 1, MaxVersion: 2}},
+		"a3676268756276657201626964181a626872a2636d696e01636d617802",
+	},
+	{
+		"Hello Response",
+		Message{Version: 2, MessageId: 0x1a, HelloRes: &HelloResponse{Status: SUCCESS, Version: 2, MinVersion: 1, MaxVersion: 2}},
+		"a3676268756276657202626964181a624852a463737461006376657202636d696e01636d617802",
+	},
+	{
+		"Auth Request",
+		Message{Version: MyVersion, MessageId: 0x1b, AuthReq: &AuthRequest{Credentials: Credentials{Username: "alice", Password: "hunter2"}}},
+		"a3676268756276657201626964181b626172a1626372a26375737265616c696365637077646768756e74657232",
+	},
+	{
+		"Auth Response",
+		Message{Version: MyVersion, MessageId: 0x1b, AuthRes: &AuthResponse{Status: UNAUTHENTICATED}},
+		"a3676268756276657201626964181b624152a1637374610c",
+	},
+	{
+		"Identify Response With Session",
+		Message{Version: MyVersion, MessageId: 0x1c, IdRes: &IdentifyResponse{Id: 1234, Session: "0123abcd"}},
+		"a3676268756276657201626964181c624952a26269641904d263736573683031323361626364",
+	},
+	{
+		"Resume Request",
+		Message{Version: MyVersion, MessageId: 0x1d, ResumeReq: &ResumeRequest{Id: 1234, Session: "0123abcd"}},
+		"a3676268756276657201626964181d627273a26269641904d263736573683031323361626364",
+	},
+	{
+		"Resume Response",
+		Message{Version: MyVersion, MessageId: 0x1d, ResumeRes: &ResumeResponse{Status: INVALID_ID}},
+		"a3676268756276657201626964181d625253a16373746101",
+	},
+	{
+		"Presence Request",
+		Message{Version: MyVersion, MessageId: 0x1e, PresReq: &PresenceRequest{Subscribe: true}},
+		"a3676268756276657201626964181e627073a163737562f5",
+	},
+	{
+		"Presence Response",
+		Message{Version: MyVersion, MessageId: 0x1e, PresRes: &PresenceResponse{Status: SUCCESS}},
+		"a3676268756276657201626964181e625053a16373746100",
+	},
+	{
+		"Presence Indication",
+		Message{Version: MyVersion, MessageId: 0x1f, PresInd: &PresenceIndication{Id: 1234, Online: true}},
+		"a3676268756276657201626964181f625049a26269641904d2626f6ef5",
+	},
+	{
+		"Group Create Request",
+		Message{Version: MyVersion, MessageId: 0x20, GrpCreateReq: &GroupCreateRequest{Group: "team"}},
+		"a36762687562766572016269641820626763a163677270647465616d",
+	},
+	{
+		"Group Create Response",
+		Message{Version: MyVersion, MessageId: 0x20, GrpCreateRes: &GroupCreateResponse{Status: NAME_IN_USE}},
+		"a36762687562766572016269641820624743a16373746109",
+	},
+	{
+		"Group Join Request",
+		Message{Version: MyVersion, MessageId: 0x21, GrpJoinReq: &GroupJoinRequest{Group: "team"}},
+		"a3676268756276657201626964182162676aa163677270647465616d",
+	},
+	{
+		"Group Join Response",
+		Message{Version: MyVersion, MessageId: 0x21, GrpJoinRes: &GroupJoinResponse{Status: SUCCESS}},
+		"a3676268756276657201626964182162474aa16373746100",
+	},
+	{
+		"Group Leave Request",
+		Message{Version: MyVersion, MessageId: 0x22, GrpLeaveReq: &GroupLeaveRequest{Group: "team"}},
+		"a3676268756276657201626964182262676ca163677270647465616d",
+	},
+	{
+		"Group Leave Response",
+		Message{Version: MyVersion, MessageId: 0x22, GrpLeaveRes: &GroupLeaveResponse{Status: INVALID_ID}},
+		"a3676268756276657201626964182262474ca16373746101",
+	},
+	{
+		"Group List Request",
+		Message{Version: MyVersion, MessageId: 0x23, GrpListReq: &GroupListRequest{Group: "team"}},
+		"a36762687562766572016269641823626773a163677270647465616d",
+	},
+	{
+		"Group List Response",
+		Message{Version: MyVersion, MessageId: 0x23, GrpListRes: &GroupListResponse{Status: SUCCESS, Members: []ClientId{1, 2}}},
+		"a36762687562766572016269641823624753a26373746100636d656d820102",
+	},
+	{
+		"Group Relay Request",
+		Message{Version: MyVersion, MessageId: 0x24, RelayReq: &RelayRequest{Dest: []ClientId{5}, Msg: []byte("hi"), DestGroups: []string{"team"}}},
+		"a36762687562766572016269641824627272a3636473748105636d736742686962646781647465616d",
+	},
+	{
+		"Reliable Relay Request",
+		Message{Version: MyVersion, MessageId: 0x25, RelayReq: &RelayRequest{Dest: []ClientId{5}, Msg: []byte("hi"), Reliable: true}},
+		"a36762687562766572016269641825627272a3636473748105636d73674268696372656cf5",
+	},
+	{
+		"Relay Failure Indication",
+		Message{Version: MyVersion, MessageId: 0x26, FailInd: &RelayFailureIndication{Dest: 5, RelayId: 0x25, Status: TIMEOUT}},
+		"a36762687562766572016269641826624649a363647374056372696418256373746105",
+	},
+	{
+		"Paged List Request",
+		Message{Version: MyVersion, MessageId: 0x27, ListReq: &ListRequest{Offset: 10, Limit: 5, Filter: "bot-", Metadata: true}},
+		"a36762687562766572016269641827626c72a4636f66660a636c696d0563666c7464626f742d626d64f5",
+	},
+	{
+		"Paged List Response",
+		Message{Version: MyVersion, MessageId: 0x27, ListRes: &ListResponse{Others: []ClientId{11}, Next: 15,
+			Metadata: []ClientMetadata{{Id: 11, Name: "bot-1", Connected: 1617000000000, Address: "private"}}}},
+		"a36762687562766572016269641827624c52a3616f810b636e78740f626d6481a46269640b616e65626f742d316263741b000001787cb5ea006261646770726976617465",
+	},
+	{
+		"History Request",
+		Message{Version: MyVersion, MessageId: 0x28, HistReq: &HistoryRequest{Topic: "news", Limit: 10, Since: 1617000000000}},
+		"a36762687562766572016269641828626879a3627470646e657773636c696d0a63736e631b000001787cb5ea00",
+	},
+	{
+		"History Response",
+		Message{Version: MyVersion, MessageId: 0x28, HistRes: &HistoryResponse{Status: SUCCESS,
+			Relays: []RelayIndication{{Src: 3, Msg: []byte("hi"), Topic: "news", Timestamp: 1617000000001}}}},
+		"a36762687562766572016269641828624859a263737461006372656c81a46373726303636d7367426869627470646e6577736274731b000001787cb5ea01",
+	},
+	{
+		"Loopback Relay Request",
+		Message{Version: MyVersion, MessageId: 0x29, RelayReq: &RelayRequest{Dest: []ClientId{5}, Msg: []byte("hi"), Loopback: true}},
+		"a36762687562766572016269641829627272a3636473748105636d7367426869626c62f5",
+	},
+	{
+		"Server Full Indication",
+		Message{Version: MyVersion, MessageId: 0x2a, ServerFull: &ServerFullIndication{}},
+		"a3676268756276657201626964182a625346a0",
+	},
+	{
+		"Deduplicated Relay Request",
+		Message{Version: MyVersion, MessageId: 0x2b, RelayReq: &RelayRequest{Dest: []ClientId{5}, Msg: []byte("hi"), MsgUUID: "f47ac10b-58cc-4372-a567-0e02b2c3d479"}},
+		"a3676268756276657201626964182b627272a3636473748105636d736742686963756964782466343761633130622d353863632d343337322d613536372d306530326232633364343739",
+	},
+	{
+		"High Priority Relay Request",
+		Message{Version: MyVersion, MessageId: 0x2c, RelayReq: &RelayRequest{Dest: []ClientId{5}, Msg: []byte("hi"), Priority: PriorityHigh}},
+		"a3676268756276657201626964182c627272a3636473748105636d73674268696370726901",
+	},
+	{
+		"Low Priority Relay Indication",
+		Message{Version: MyVersion, MessageId: 0x2d, RelayInd: &RelayIndication{Src: 5, Msg: []byte("hi"), Priority: PriorityLow}},
+		"a3676268756276657201626964182d625249a36373726305636d73674268696370726920",
+	},
+	{
+		"Stats Request",
+		Message{Version: MyVersion, MessageId: 0x2e, StatsReq: &StatsRequest{}},
+		"a3676268756276657201626964182e627374a0",
+	},
+	{
+		"Stats Response",
+		Message{Version: MyVersion, MessageId: 0x2e, StatsRes: &StatsResponse{Status: SUCCESS, Clients: 3, Uptime: 90000, RelayRate: 2.5,
+			BytesReceived: 1024, BytesSent: 65536}},
+		"a3676268756276657201626964182e625354a6637374610062636c036275701a00015f9063727073fb400400000000000062626919040062626f1a00010000",
+	},
+	{
+		"Verbose Relay Request",
+		Message{Version: MyVersion, MessageId: 0x2f, RelayReq: &RelayRequest{Dest: []ClientId{5, 6}, Msg: []byte("hi"), Verbosity: VerbosityAll}},
+		"a3676268756276657201626964182f627272a363647374820506636d736742686962766201",
+	},
+	{
+		"Verbose Relay Response",
+		Message{Version: MyVersion, MessageId: 0x2f, RelayRes: &RelayResponse{Status: SUCCESS, StatusMap: ClientStatusMap{5: SUCCESS}}},
+		"a3676268756276657201626964182f625252a263737461006363736da10500",
+	},
+	{
+		"Relay Request With TTL",
+		Message{Version: MyVersion, MessageId: 0x30, RelayReq: &RelayRequest{Dest: []ClientId{5}, Msg: []byte("hi"), AckRequested: true, TTL: 250}},
+		"a36762687562766572016269641830627272a4636473748105636d73674268696361636bf56374746c18fa",
+	},
+	{
+		"Relay Indication With TTL",
+		Message{Version: MyVersion, MessageId: 0x30, RelayInd: &RelayIndication{Src: 1, Msg: []byte("hi"), Timestamp: 1600000000000, TTL: 250}},
+		"a36762687562766572016269641830625249a46373726301636d73674268696274731b00000174876e80006374746c18fa",
+	},
+	{
+		"Compressed Relay Request",
+		Message{Version: MyVersion, MessageId: 0x33, RelayReq: &RelayRequest{Dest: []ClientId{5}, Msg: deflatedHi, Compression: CompressionDeflate}},
+		"a36762687562766572016269641833627272a3636473748105636d736747cac8548021c00063636d7001",
+	},
+	{
+		"Compressed Relay Indication",
+		Message{Version: MyVersion, MessageId: 0x33, RelayInd: &RelayIndication{Src: 1, Msg: deflatedHi, Compression: CompressionDeflate}},
+		"a36762687562766572016269641833625249a36373726301636d736747cac8548021c00063636d7001",
+	},
+	{
+		"Disconnect Indication",
+		Message{Version: MyVersion, MessageId: 0x34, Disconnect: &DisconnectIndication{Reason: FORBIDDEN}},
+		"a36762687562766572016269641834624458a16372736e0d",
+	},
+	{
+		"Server Full Indication While Draining",
+		Message{Version: MyVersion, MessageId: 0x35, ServerFull: &ServerFullIndication{Draining: true}},
+		"a36762687562766572016269641835625346a16364726ef5",
+	},
+	{
+		"Relay Request With Trace Context",
+		Message{Version: MyVersion, MessageId: 0x36, Trace: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", RelayReq: &RelayRequest{Dest: []ClientId{5}, Msg: []byte("hi")}},
+		"a46762687562766572016269641836627463783730302d34626639326633353737623334646136613363653932396430653065343733362d303066303637616130626139303262372d3031627272a2636473748105636d7367426869",
+	},
+	{
+		"Relay Indication With Trace Context",
+		Message{Version: MyVersion, MessageId: 0x36, Trace: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", RelayInd: &RelayIndication{Src: 1, Msg: []byte("hi")}},
+		"a46762687562766572016269641836627463783730302d34626639326633353737623334646136613363653932396430653065343733362d303066303637616130626139303262372d3031625249a26373726301636d7367426869",
+	},
+	{
+		"Flow Update",
+		Message{Version: MyVersion, MessageId: 0x37, FlowUpd: &FlowUpdate{Credits: 100}},
+		"a36762687562766572016269641837626675a1636372641864",
+	},
+	{
+		"Relay Batch Request",
+		Message{Version: MyVersion, MessageId: 0x38, RelayBatReq: &RelayBatchRequest{Relays: []RelayRequest{{Dest: []ClientId{5}, Msg: []byte("hi")}, {Topic: "t", Msg: []byte("yo")}}, RelayIds: []uint32{0x38, 0x39}}},
+		"a36762687562766572016269641838627262a263726c7982a2636473748105636d7367426869a363647374f6636d736742796f6274706174637269648218381839",
+	},
+	{
+		"Relay Batch Response",
+		Message{Version: MyVersion, MessageId: 0x38, RelayBatRes: &RelayBatchResponse{Status: SUCCESS, Results: []RelayResponse{{Status: SUCCESS, StatusMap: ClientStatusMap{}}, {Status: SUCCESS, StatusMap: ClientStatusMap{6: NO_BUFFER}}}}},
+		"a36762687562766572016269641838625242a263737461006372657382a263737461006363736da0a263737461006363736da10602",
+	},
+	{
+		"Error Response",
+		Message{Version: MyVersion, MessageId: 0x39, Error: &ErrorResponse{Status: UNSUPPORTED, Text: "no"}},
+		"a36762687562766572016269641839624552a2637374611663747874626e6f",
+	},
 }
 
 // Simple CBOR loopback test to check everything can be decoded from its encoded form
@@ -60,8 +402,8 @@ func TestCborEncoder(t *testing.T) {
 		t.Run(testElem.name, func(t *testing.T) {
 			// Encode a command message
 			msg := testElem.msg
-			encoded, ok := tc.Encode(msg)
-			assert.True(t, ok)
+			encoded, err := tc.Encode(msg)
+			assert.Nil(t, err)
 
 			// Assert it is the correct byte sequence (If byte sequence is included in test vec)
 			fmt.Println(hex.EncodeToString(encoded))
@@ -71,19 +413,61 @@ func TestCborEncoder(t *testing.T) {
 			}
 
 			// Loop it back, and confirm it is the same as before
-			msgOut, ok := tc.Decode(encoded)
-			assert.True(t, ok)
+			msgOut, err := tc.Decode(encoded)
+			assert.Nil(t, err)
 			assert.Equal(t, testElem.msg, msgOut)
 
 			// And also with the stream decoder
 			sd := tc.NewStreamDecoder(bytes.NewReader(encoded))
-			msgOut2, ok := sd.DecodeNext()
-			assert.True(t, ok)
+			msgOut2, err := sd.DecodeNext()
+			assert.Nil(t, err)
 			assert.Equal(t, testElem.msg, msgOut2)
 		})
 	}
 }
 
+// Deterministic encodings, with map keys sorted bytewise and floats in their shortest form
+var cborDeterministicVec = []cborTestElement{
+	{
+		"Identify Request",
+		Message{Version: MyVersion, MessageId: 0x12, IdReq: &IdentifyRequest{}},
+		"a362696412626972a0676268756276657201",
+	},
+	{
+		"Relay Response With Several Statuses",
+		Message{Version: MyVersion, MessageId: 0x31, RelayRes: &RelayResponse{Status: SUCCESS, StatusMap: ClientStatusMap{300: NO_BUFFER, 5: SUCCESS, 2: INVALID_ID}}},
+		"a3625252a26363736da30201050019012c0263737461006269641831676268756276657201",
+	},
+	{
+		"Stats Response",
+		Message{Version: MyVersion, MessageId: 0x32, StatsRes: &StatsResponse{Status: SUCCESS, Clients: 3, Uptime: 60000, RelayRate: 2.5}},
+		"a3625354a462636c0362757019ea6063727073f9410063737461006269641832676268756276657201",
+	},
+}
+
+func TestCborDeterministic(t *testing.T) {
+	tc := CborTranscoder{Deterministic: true}
+	for _, testElem := range cborDeterministicVec {
+		t.Run(testElem.name, func(t *testing.T) {
+			exBytes, _ := hex.DecodeString(testElem.hexString)
+			// Maps with several entries are encoded in a random order otherwise, so encode them a few times
+			for i := 0; i < 10; i++ {
+				encoded, err := tc.Encode(testElem.msg)
+				assert.Nil(t, err)
+				assert.Equal(t, exBytes, encoded)
+				var buf bytes.Buffer
+				assert.Nil(t, tc.EncodeTo(&buf, testElem.msg))
+				assert.Equal(t, exBytes, buf.Bytes())
+			}
+
+			// Deterministic encodings decode as usual
+			msgOut, err := (&CborTranscoder{}).Decode(exBytes)
+			assert.Nil(t, err)
+			assert.Equal(t, testElem.msg, msgOut)
+		})
+	}
+}
+
 // Simple JSON loopback test to check everything can be decoded from its encoded form
 // This is based off the CBOR test vector, just doesn't check the encoded form matches
 // the expected binary value, as json is less predictable and is only included here for
@@ -94,21 +478,464 @@ func TestJsonEncoder(t *testing.T) {
 		t.Run(testElem.name, func(t *testing.T) {
 			// Encode a command message
 			msg := testElem.msg
-			encoded, ok := tc.Encode(msg)
-			assert.True(t, ok)
+			encoded, err := tc.Encode(msg)
+			assert.Nil(t, err)
 
 			fmt.Println(string(encoded))
 
 			// Loop it back, and confirm it is the same as before
-			msgOut, ok := tc.Decode(encoded)
-			assert.True(t, ok)
+			msgOut, err := tc.Decode(encoded)
+			assert.Nil(t, err)
 			assert.Equal(t, testElem.msg, msgOut)
 
 			// And also with the stream decoder
 			sd := tc.NewStreamDecoder(bytes.NewReader(encoded))
-			msgOut2, ok := sd.DecodeNext()
-			assert.True(t, ok)
+			msgOut2, err := sd.DecodeNext()
+			assert.Nil(t, err)
 			assert.Equal(t, testElem.msg, msgOut2)
 		})
 	}
 }
+
+func TestNegotiateVersion(t *testing.T) {
+	v, ok := NegotiateVersion(1, 1)
+	assert.True(t, ok)
+	assert.Equal(t, Version(1), v)
+	v, ok = NegotiateVersion(1, 5)
+	assert.True(t, ok)
+	assert.Equal(t, MaxVersion, v)
+	_, ok = NegotiateVersion(MaxVersion+1, MaxVersion+3)
+	assert.False(t, ok)
+	_, ok = NegotiateVersion(0, 0)
+	assert.False(t, ok)
+	assert.False(t, Version(0).Supported())
+	assert.True(t, MaxVersion.Supported())
+}
+
+func TestStatusError(t *testing.T) {
+	assert.Nil(t, NewStatusError(SUCCESS, 1, nil))
+
+	err := NewStatusError(TIMEOUT, 7, context.DeadlineExceeded)
+	assert.ErrorIs(t, err, TIMEOUT)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.False(t, errors.Is(err, CANCELLED))
+	assert.Equal(t, "TIMEOUT (message 7): context deadline exceeded", err.Error())
+
+	// Wrapped errors keep their status
+	wrapped := fmt.Errorf("getting id: %w", err)
+	var se *StatusError
+	assert.True(t, errors.As(wrapped, &se))
+	assert.Equal(t, uint32(7), se.MessageId)
+	assert.Equal(t, TIMEOUT, StatusOf(wrapped))
+
+	assert.Equal(t, SUCCESS, StatusOf(nil))
+	assert.Equal(t, NAME_IN_USE, StatusOf(NAME_IN_USE))
+	assert.Equal(t, CONNECTION_ERROR, StatusOf(errors.New("broken pipe")))
+	assert.Equal(t, "INVALID_ID", NewStatusError(INVALID_ID, 0, nil).Error())
+}
+
+func TestDetectCodec(t *testing.T) {
+	for _, codec := range []Codec{CodecCBOR, CodecJSON, CodecFramedCBOR} {
+		encoded, err := codec.Transcoder().Encode(Message{Version: MyVersion, MessageId: 5, PingReq: &PingRequest{}})
+		assert.Nil(t, err)
+		detected, rest, err := DetectCodec(bytes.NewReader(encoded))
+		assert.Nil(t, err)
+		assert.Equal(t, codec, detected)
+
+		// The detected codec can decode the whole message
+		m, err := detected.Transcoder().NewStreamDecoder(rest).DecodeNext()
+		assert.Nil(t, err)
+		assert.Equal(t, uint32(5), m.MessageId)
+
+		parsed, ok := ParseCodec(codec.String())
+		assert.True(t, ok)
+		assert.Equal(t, codec, parsed)
+	}
+
+	detected, _, err := DetectCodec(strings.NewReader("\r\n {}"))
+	assert.Nil(t, err)
+	assert.Equal(t, CodecJSON, detected)
+	_, _, err = DetectCodec(strings.NewReader("bhub"))
+	assert.ErrorIs(t, err, ErrUnknownCodec)
+	_, _, err = DetectCodec(strings.NewReader(""))
+	assert.ErrorIs(t, err, io.EOF)
+	_, ok := ParseCodec("xml")
+	assert.False(t, ok)
+}
+
+func TestPriority(t *testing.T) {
+	for _, p := range []Priority{PriorityLow, PriorityNormal, PriorityHigh} {
+		parsed, ok := ParsePriority(p.String())
+		assert.True(t, ok)
+		assert.Equal(t, p, parsed)
+		assert.Equal(t, p, p.Clamp())
+	}
+	_, ok := ParsePriority("urgent")
+	assert.False(t, ok)
+	assert.Equal(t, PriorityHigh, Priority(7).Clamp())
+	assert.Equal(t, PriorityLow, Priority(-3).Clamp())
+}
+
+func TestVerbosity(t *testing.T) {
+	for _, v := range []Verbosity{VerbosityFailures, VerbosityAll} {
+		parsed, ok := ParseVerbosity(v.String())
+		assert.True(t, ok)
+		assert.Equal(t, v, parsed)
+	}
+	_, ok := ParseVerbosity("loud")
+	assert.False(t, ok)
+
+	csm := ClientStatusMap{7: SUCCESS, 2: NO_BUFFER, 3: SUCCESS, 5: INVALID_ID}
+	assert.Equal(t, []ClientId{3, 7}, csm.Succeeded())
+	assert.Equal(t, []ClientId{2, 5}, csm.Failed())
+	assert.Empty(t, ClientStatusMap{}.Succeeded())
+}
+
+func TestCompression(t *testing.T) {
+	for _, c := range []Compression{CompressionNone, CompressionDeflate, CompressionZstd} {
+		parsed, ok := ParseCompression(c.String())
+		assert.True(t, ok)
+		assert.Equal(t, c, parsed)
+	}
+	_, ok := ParseCompression("lzma")
+	assert.False(t, ok)
+
+	// Round trip
+	data := bytes.Repeat([]byte("hello hub "), 100)
+	for _, c := range []Compression{CompressionNone, CompressionDeflate, CompressionZstd} {
+		compressed, err := c.Compress(data)
+		assert.Nil(t, err)
+		decompressed, err := c.Decompress(compressed)
+		assert.Nil(t, err)
+		assert.Equal(t, data, decompressed)
+	}
+	out, err := CompressionDeflate.Decompress(deflatedHi)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hi hi hi hi"), out)
+
+	// Unknown compressions aren't supported
+	_, err = Compression(3).Compress(data)
+	assert.ErrorIs(t, err, ErrUnsupportedCompression)
+	_, err = Compression(3).Decompress(data)
+	assert.ErrorIs(t, err, ErrUnsupportedCompression)
+
+	// Corrupt data, and data which expands too far, fail
+	for _, c := range []Compression{CompressionDeflate, CompressionZstd} {
+		_, err = c.Decompress([]byte{0xff, 0xff, 0xff})
+		assert.NotNil(t, err, c)
+		bomb, err := c.Compress(make([]byte, MaxDecompressedSize+1))
+		assert.Nil(t, err, c)
+		_, err = c.Decompress(bomb)
+		assert.NotNil(t, err, c)
+	}
+}
+
+func TestTranscoderErrors(t *testing.T) {
+	// Decode failures say what was wrong with the message
+	for _, codec := range []Codec{CodecCBOR, CodecJSON} {
+		_, err := codec.Transcoder().Decode([]byte{0xff, '{'})
+		assert.ErrorIs(t, err, ENCODING_ERROR, codec)
+		assert.NotNil(t, errors.Unwrap(err), codec)
+	}
+
+	// The bool wrappers only report whether it worked
+	ping := Message{Version: MyVersion, MessageId: 5, PingReq: &PingRequest{}}
+	encoded, ok := EncodeOk(&CborTranscoder{}, ping)
+	assert.True(t, ok)
+	decoded, ok := DecodeOk(&CborTranscoder{}, encoded)
+	assert.True(t, ok)
+	assert.Equal(t, ping, decoded)
+	_, ok = DecodeOk(&CborTranscoder{}, encoded[1:])
+	assert.False(t, ok)
+}
+
+func TestFramedTranscoder(t *testing.T) {
+	ft := &FramedTranscoder{Inner: &CborTranscoder{}, MaxFrameSize: 64}
+	ping := Message{Version: MyVersion, MessageId: 5, PingReq: &PingRequest{}}
+	encoded, err := ft.Encode(ping)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0, 0, 0, byte(len(encoded) - FrameHeaderSize)}, encoded[:FrameHeaderSize])
+	decoded, err := ft.Decode(encoded)
+	assert.Nil(t, err)
+	assert.Equal(t, ping, decoded)
+	_, err = ft.Decode(encoded[:len(encoded)-1])
+	assert.ErrorIs(t, err, ENCODING_ERROR)
+	assert.Contains(t, err.Error(), "frame header gives")
+
+	// Messages larger than the maximum can't be encoded
+	_, err = ft.Encode(Message{Version: MyVersion, MessageId: 6, RelayReq: &RelayRequest{Msg: make([]byte, 64)}})
+	assert.ErrorIs(t, err, ENCODING_ERROR)
+	assert.Equal(t, uint32(6), err.(*StatusError).MessageId)
+	assert.Contains(t, err.Error(), "over the frame size limit")
+
+	// A corrupted frame can be skipped, carrying on with the next
+	var stream bytes.Buffer
+	stream.Write(encoded)
+	stream.Write([]byte{0, 0, 0, 3, 0xff, 0xff, 0xff})
+	ping.MessageId = 7
+	encoded, _ = ft.Encode(ping)
+	stream.Write(encoded)
+	// An oversized frame ends the stream
+	stream.Write([]byte{0, 0, 1, 0})
+	stream.Write(make([]byte, 256))
+	stream.Write(encoded)
+
+	dec := ft.NewStreamDecoder(&stream)
+	decoded, err = dec.DecodeNext()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(5), decoded.MessageId)
+	_, err = dec.DecodeNext()
+	assert.ErrorIs(t, err, ENCODING_ERROR)
+	assert.True(t, IsRecoverable(err))
+	decoded, err = dec.DecodeNext()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(7), decoded.MessageId)
+	_, err = dec.DecodeNext()
+	assert.ErrorIs(t, err, TOO_LONG)
+	assert.False(t, IsRecoverable(err))
+}
+
+func TestEncodeTo(t *testing.T) {
+	// Encoding to a writer gives the same result as encoding to a new slice (apart from the order of map keys)
+	for _, codec := range []Codec{CodecCBOR, CodecJSON, CodecFramedCBOR} {
+		tc := codec.Transcoder()
+		var stream bytes.Buffer
+		for _, tv := range cborTestVec {
+			encoded, err := tc.Encode(tv.msg)
+			assert.Nil(t, err)
+			var buf bytes.Buffer
+			assert.Nil(t, tc.EncodeTo(&buf, tv.msg))
+			if codec == CodecJSON {
+				encoded = append(encoded, '\n')
+			}
+			assert.Equal(t, len(encoded), buf.Len(), "%s %s", codec, tv.name)
+			expected, _ := tc.Decode(encoded)
+			actual, _ := tc.Decode(buf.Bytes())
+			assert.Equal(t, expected, actual, "%s %s", codec, tv.name)
+			tc.EncodeTo(&stream, tv.msg)
+		}
+		// The messages can be decoded from the stream one after another
+		dec := tc.NewStreamDecoder(&stream)
+		for _, tv := range cborTestVec {
+			decoded, err := dec.DecodeNext()
+			if tv.msg.Version == MyVersion {
+				assert.Nil(t, err, "%s %s", codec, tv.name)
+			}
+			assert.Equal(t, tv.msg.MessageId, decoded.MessageId, "%s %s", codec, tv.name)
+		}
+	}
+
+	// Messages larger than the maximum frame can't be encoded, and nothing is written
+	ft := &FramedTranscoder{Inner: &CborTranscoder{}, MaxFrameSize: 64}
+	var buf bytes.Buffer
+	assert.NotNil(t, ft.EncodeTo(&buf, Message{Version: MyVersion, RelayReq: &RelayRequest{Msg: make([]byte, 64)}}))
+	assert.Zero(t, buf.Len())
+}
+
+func TestSharedRelay(t *testing.T) {
+	// A shared relay encodes exactly as a Relay Indication message would
+	for _, codec := range []Codec{CodecCBOR, CodecJSON, CodecFramedCBOR} {
+		tc := codec.Transcoder()
+		for _, tv := range cborTestVec {
+			if tv.msg.RelayInd == nil {
+				continue
+			}
+			sr := NewSharedRelay(*tv.msg.RelayInd)
+			sr.Trace = tv.msg.Trace
+			for _, mid := range []uint32{tv.msg.MessageId, 0, 1 << 31} {
+				m := Message{Version: tv.msg.Version, MessageId: mid, Trace: tv.msg.Trace, RelayInd: tv.msg.RelayInd}
+				var expected, actual bytes.Buffer
+				assert.Nil(t, tc.EncodeTo(&expected, m))
+				assert.Nil(t, sr.EncodeTo(&actual, codec, m.Version, mid))
+				assert.Equal(t, expected.Bytes(), actual.Bytes(), "%s %s", codec, tv.name)
+			}
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	// A message that doesn't fit can be skipped, but malformed data ends the stream
+	var stream bytes.Buffer
+	for _, m := range []map[string]interface{}{
+		{"bhubver": 1, "id": "one"},
+		{"bhubver": 1, "id": 2},
+		{"bhubver": 99, "id": 3},
+	} {
+		b, err := cbor.Marshal(m)
+		assert.Nil(t, err)
+		stream.Write(b)
+	}
+	stream.Write([]byte{0xff, 0xff})
+	dec := (&CborTranscoder{}).NewStreamDecoder(&stream)
+	_, err := dec.DecodeNext()
+	assert.ErrorIs(t, err, ENCODING_ERROR)
+	assert.True(t, IsRecoverable(err))
+	m, err := dec.DecodeNext()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(2), m.MessageId)
+	// Messages from unsupported versions are still returned, so they can be answered
+	m, err = dec.DecodeNext()
+	assert.ErrorIs(t, err, VERSION_MISMATCH)
+	assert.True(t, IsRecoverable(err))
+	assert.Equal(t, uint32(3), m.MessageId)
+	_, err = dec.DecodeNext()
+	assert.ErrorIs(t, err, ENCODING_ERROR)
+	assert.False(t, IsRecoverable(err))
+	assert.Equal(t, ENCODING_ERROR, StatusOf(err))
+
+	dec = (&JsonTranscoder{}).NewStreamDecoder(strings.NewReader(`{"bhubver":1,"id":"one"} {"bhubver":1,"id":2} {"bhubver":99,"id":3} {bad`))
+	_, err = dec.DecodeNext()
+	assert.ErrorIs(t, err, ENCODING_ERROR)
+	assert.True(t, IsRecoverable(err))
+	m, err = dec.DecodeNext()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(2), m.MessageId)
+	m, err = dec.DecodeNext()
+	assert.ErrorIs(t, err, VERSION_MISMATCH)
+	assert.Equal(t, uint32(3), m.MessageId)
+	_, err = dec.DecodeNext()
+	assert.ErrorIs(t, err, ENCODING_ERROR)
+	assert.False(t, IsRecoverable(err))
+
+	// The end of the stream isn't a DecodeError
+	_, err = (&CborTranscoder{}).NewStreamDecoder(&stream).DecodeNext()
+	assert.Equal(t, io.EOF, err)
+	_, err = (&JsonTranscoder{}).NewStreamDecoder(strings.NewReader("")).DecodeNext()
+	assert.Equal(t, io.EOF, err)
+	assert.False(t, IsRecoverable(err))
+}
+
+// Reader of a stream which never ends, counting how much has been read
+type endlessReader struct {
+	prefix []byte
+	read   int
+}
+
+func (er *endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		if er.read+i < len(er.prefix) {
+			p[i] = er.prefix[er.read+i]
+		} else {
+			p[i] = '0'
+		}
+	}
+	er.read += len(p)
+	return len(p), nil
+}
+
+func TestDecodeLimits(t *testing.T) {
+	limits := DecodeLimits{MaxMessageSize: 100, MaxDests: 2, MaxMsgLength: 4}
+	relay := func(mid uint32, dest []ClientId, mesg string) Message {
+		return Message{Version: MyVersion, MessageId: mid, RelayReq: &RelayRequest{Dest: dest, Msg: []byte(mesg)}}
+	}
+	for _, codec := range []Codec{CodecCBOR, CodecJSON, CodecFramedCBOR} {
+		// Relays breaking the limits are skipped, without losing the next message
+		var stream bytes.Buffer
+		for _, m := range []Message{relay(1, []ClientId{1, 2, 3}, "hi"), relay(2, []ClientId{1}, "hello"), relay(3, []ClientId{1, 2}, "hiya")} {
+			encoded, err := codec.Transcoder().Encode(m)
+			assert.Nil(t, err)
+			stream.Write(encoded)
+		}
+		dec := codec.TranscoderWithLimits(limits).NewStreamDecoder(&stream)
+		m, err := dec.DecodeNext()
+		assert.ErrorIs(t, err, TOO_LONG, codec)
+		assert.True(t, IsRecoverable(err), codec)
+		assert.Equal(t, uint32(1), m.MessageId, codec)
+		_, err = dec.DecodeNext()
+		assert.ErrorIs(t, err, TOO_LONG, codec)
+		m, err = dec.DecodeNext()
+		assert.Nil(t, err, codec)
+		assert.Equal(t, relay(3, []ClientId{1, 2}, "hiya"), m, codec)
+
+		// A message at the size limit is fine, but the decoder gives up on a larger one without reading it all
+		big, err := codec.Transcoder().Encode(Message{Version: MyVersion, MessageId: 4, RelayReq: &RelayRequest{Topic: "a"}})
+		assert.Nil(t, err)
+		sized := DecodeLimits{MaxMessageSize: len(big)}
+		if codec == CodecFramedCBOR {
+			sized.MaxMessageSize -= FrameHeaderSize
+		}
+		m, err = codec.TranscoderWithLimits(sized).NewStreamDecoder(bytes.NewReader(big)).DecodeNext()
+		assert.Nil(t, err, codec)
+		assert.Equal(t, uint32(4), m.MessageId, codec)
+		sized.MaxMessageSize--
+		_, err = codec.TranscoderWithLimits(sized).NewStreamDecoder(bytes.NewReader(big)).DecodeNext()
+		assert.ErrorIs(t, err, TOO_LONG, codec)
+		assert.False(t, IsRecoverable(err), codec)
+	}
+
+	// Endless messages
+	for codec, prefix := range map[Codec][]byte{
+		CodecCBOR:       {0xa1, 0x63, 'm', 's', 'g', 0x5b, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		CodecJSON:       []byte(`{"msg":"`),
+		CodecFramedCBOR: {0x7f, 0xff, 0xff, 0xff},
+	} {
+		r := &endlessReader{prefix: prefix}
+		_, err := codec.TranscoderWithLimits(limits).NewStreamDecoder(r).DecodeNext()
+		assert.ErrorIs(t, err, TOO_LONG, codec)
+		assert.LessOrEqual(t, r.read, 4096, codec)
+	}
+}
+
+func TestRelayTimestamp(t *testing.T) {
+	now := time.Unix(1617055283, 123456789)
+	ind := RelayIndication{Timestamp: TimestampOf(now)}
+	assert.Equal(t, int64(1617055283123), ind.Timestamp)
+	assert.True(t, ind.Time().Equal(now.Truncate(time.Millisecond)))
+	assert.True(t, RelayIndication{}.Time().IsZero())
+}
+
+func TestRelayExpiry(t *testing.T) {
+	now := time.Unix(1617055283, 0)
+	ind := RelayIndication{Timestamp: TimestampOf(now), TTL: 250}
+	assert.True(t, ind.Expiry().Equal(now.Add(250*time.Millisecond)))
+	assert.False(t, ind.Expired(now.Add(249*time.Millisecond)))
+	assert.True(t, ind.Expired(now.Add(250*time.Millisecond)))
+	// Without a TTL, relays never expire
+	ind.TTL = 0
+	assert.True(t, ind.Expiry().IsZero())
+	assert.False(t, ind.Expired(now.Add(24*time.Hour)))
+
+	// Shared relays also expire at their deadline
+	sr := NewSharedRelay(ind)
+	assert.False(t, sr.Expired(now.Add(24*time.Hour)))
+	sr.Deadline = now.Add(100 * time.Millisecond)
+	assert.False(t, sr.Expired(now.Add(99*time.Millisecond)))
+	assert.True(t, sr.Expired(now.Add(100*time.Millisecond)))
+	sr.Ind.TTL = 50
+	assert.True(t, sr.Expired(now.Add(50*time.Millisecond)))
+}
+
+// Encode a relay indication, as the server does for each destination of a relay
+func benchmarkEncode(b *testing.B, codec Codec, encodeTo bool) {
+	tc := codec.Transcoder()
+	m := Message{Version: MyVersion, MessageId: 1, RelayInd: &RelayIndication{Src: 2, Msg: make([]byte, 256)}}
+	var buf bytes.Buffer
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		if encodeTo {
+			tc.EncodeTo(&buf, m)
+		} else {
+			encoded, _ := tc.Encode(m)
+			buf.Write(encoded)
+		}
+	}
+}
+
+// Encode a relay indication for a wide fan-out, sharing its encoding between destinations
+func BenchmarkEncodeShared(b *testing.B) {
+	sr := NewSharedRelay(RelayIndication{Src: 2, Msg: make([]byte, 256)})
+	var buf bytes.Buffer
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		sr.EncodeTo(&buf, CodecCBOR, MyVersion, uint32(i))
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	for _, codec := range []Codec{CodecCBOR, CodecJSON, CodecFramedCBOR} {
+		b.Run(codec.String(), func(b *testing.B) { benchmarkEncode(b, codec, false) })
+		b.Run(codec.String()+"/EncodeTo", func(b *testing.B) { benchmarkEncode(b, codec, true) })
+	}
+}
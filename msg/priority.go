@@ -0,0 +1,44 @@
+package msg
+
+import "fmt"
+
+// Priority of a relay. The hub sends a client's waiting relays in priority order, so urgent messages aren't held up
+// behind bulk traffic. Relays of the same priority stay in order.
+type Priority int
+
+const (
+	// Sent once nothing of a higher priority is waiting
+	PriorityLow Priority = -1
+	// The default, which is omitted from the encoding
+	PriorityNormal Priority = 0
+	// Sent ahead of everything else waiting
+	PriorityHigh Priority = 1
+)
+
+// Get the nearest valid priority, so priorities from newer implementations are treated as the closest one known
+func (p Priority) Clamp() Priority {
+	return max(PriorityLow, min(p, PriorityHigh))
+}
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	default:
+		return fmt.Sprintf("[Unknown Priority: %d]", int(p))
+	}
+}
+
+// ParsePriority gets the Priority with the given name, as returned by 'Priority.String'
+func ParsePriority(name string) (p Priority, ok bool) {
+	for _, p := range []Priority{PriorityLow, PriorityNormal, PriorityHigh} {
+		if p.String() == name {
+			return p, true
+		}
+	}
+	return PriorityNormal, false
+}
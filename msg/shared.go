@@ -0,0 +1,97 @@
+package msg
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// SharedRelay is a Relay Indication being sent to many clients. The messages carrying it to each client only differ in
+// their message ID (and protocol version), so its contents are encoded once for each codec and reused by all of them.
+//
+// Every destination refers to the same indication, so neither it nor its Msg may be modified once it's shared.
+type SharedRelay struct {
+	Ind RelayIndication
+	// Trace context carried in the header of each message, to be set before the relay is shared
+	Trace string
+	// Time after which the relay is no longer worth sending, if set, as well as when it outlives its TTL.
+	// It isn't sent to the destinations, so is only for the server's use.
+	Deadline time.Time
+	// Encoding of the indication for each codec, once it has been needed
+	mutex   sync.Mutex
+	encoded map[Codec][]byte
+}
+
+// Relay Indication message, with the indication already encoded. The fields match the start of Message, which are
+// encoded first, and the rest of Message is omitted when empty, so the encoding is the same as Message's.
+type cborRelayMessage struct {
+	Version   Version         `json:"bhubver"`
+	MessageId uint32          `json:"id"`
+	Trace     string          `json:"tc,omitempty"`
+	RelayInd  cbor.RawMessage `json:"RI"`
+}
+
+// As cborRelayMessage, for JSON
+type jsonRelayMessage struct {
+	Version   Version         `json:"bhubver"`
+	MessageId uint32          `json:"id"`
+	Trace     string          `json:"tc,omitempty"`
+	RelayInd  json.RawMessage `json:"RI"`
+}
+
+// NewSharedRelay shares a Relay Indication, ready to be sent to many clients
+func NewSharedRelay(ind RelayIndication) *SharedRelay {
+	return &SharedRelay{Ind: ind}
+}
+
+// Expired checks whether the relay is too old to be sent at time 'now', because it has outlived its TTL or Deadline
+func (sr *SharedRelay) Expired(now time.Time) bool {
+	return sr.Ind.Expired(now) || (!sr.Deadline.IsZero() && !now.Before(sr.Deadline))
+}
+
+// Get the encoding of the indication with a codec, encoding it the first time
+func (sr *SharedRelay) encoding(codec Codec) ([]byte, error) {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+	if encoded, ok := sr.encoded[codec]; ok {
+		return encoded, nil
+	}
+	var encoded []byte
+	var err error
+	if codec == CodecJSON {
+		encoded, err = json.Marshal(&sr.Ind)
+	} else {
+		encoded, err = cbor.Marshal(&sr.Ind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if sr.encoded == nil {
+		sr.encoded = make(map[Codec][]byte)
+	}
+	sr.encoded[codec] = encoded
+	return encoded, nil
+}
+
+// EncodeTo encodes a Relay Indication message carrying the relay, as with 'Transcoder.EncodeTo' for the codec's
+// default Transcoder, but only encoding the indication itself the first time it's needed.
+func (sr *SharedRelay) EncodeTo(w io.Writer, codec Codec, version Version, mid uint32) error {
+	encoded, err := sr.encoding(codec)
+	if err != nil {
+		return err
+	}
+	switch codec {
+	case CodecJSON:
+		return encodeJson(w, &jsonRelayMessage{Version: version, MessageId: mid, Trace: sr.Trace, RelayInd: encoded})
+	case CodecFramedCBOR:
+		return encodeFrame(w, DefaultMaxFrameSize, func(buf *bytes.Buffer) error {
+			return encodeCbor(buf, &cborRelayMessage{Version: version, MessageId: mid, Trace: sr.Trace, RelayInd: encoded})
+		})
+	default:
+		return encodeCbor(w, &cborRelayMessage{Version: version, MessageId: mid, Trace: sr.Trace, RelayInd: encoded})
+	}
+}
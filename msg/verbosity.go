@@ -0,0 +1,59 @@
+package msg
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Verbosity of a RelayResponse's StatusMap, as requested by the sender of a relay
+type Verbosity int
+
+const (
+	// Only destinations the relay failed for are listed. The default, which is omitted from the encoding
+	VerbosityFailures Verbosity = 0
+	// Every destination is listed, including those the relay was accepted for with SUCCESS
+	VerbosityAll Verbosity = 1
+)
+
+func (v Verbosity) String() string {
+	switch v {
+	case VerbosityFailures:
+		return "failures"
+	case VerbosityAll:
+		return "all"
+	default:
+		return fmt.Sprintf("[Unknown Verbosity: %d]", int(v))
+	}
+}
+
+// ParseVerbosity gets the Verbosity with the given name, as returned by 'Verbosity.String'
+func ParseVerbosity(name string) (v Verbosity, ok bool) {
+	for _, v := range []Verbosity{VerbosityFailures, VerbosityAll} {
+		if v.String() == name {
+			return v, true
+		}
+	}
+	return VerbosityFailures, false
+}
+
+// Succeeded gets the clients listed with SUCCESS, in ascending order.
+// These are only listed if the relay was sent with VerbosityAll.
+func (csm ClientStatusMap) Succeeded() []ClientId {
+	return csm.filter(func(s Status) bool { return s == SUCCESS })
+}
+
+// Failed gets the clients listed with any status other than SUCCESS, in ascending order
+func (csm ClientStatusMap) Failed() []ClientId {
+	return csm.filter(func(s Status) bool { return s != SUCCESS })
+}
+
+func (csm ClientStatusMap) filter(match func(Status) bool) []ClientId {
+	cids := make([]ClientId, 0, len(csm))
+	for cid, status := range csm {
+		if match(status) {
+			cids = append(cids, cid)
+		}
+	}
+	sort.Slice(cids, func(i, j int) bool { return cids[i] < cids[j] })
+	return cids
+}
@@ -0,0 +1,410 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// Details of a connected client, as reported by the admin API
+type adminClient struct {
+	Id         msg.ClientId `json:"id"`
+	Name       string       `json:"name,omitempty"`
+	Namespace  string       `json:"namespace,omitempty"`
+	RemoteAddr string       `json:"remote_addr"`
+	Connected  time.Time    `json:"connected"`
+	AgeSeconds float64      `json:"age_seconds"`
+	Buffer     adminBuffer  `json:"buffer"`
+}
+
+// Buffer utilisation of a connected client, as reported by the admin API. Relays are totalled over every priority,
+// and the client is Full if the buffer for any priority is.
+type adminBuffer struct {
+	Relays          int  `json:"relays"`
+	RelayCapacity   int  `json:"relay_capacity"`
+	Full            bool `json:"full,omitempty"`
+	Control         int  `json:"control"`
+	ControlCapacity int  `json:"control_capacity"`
+}
+
+// Buffer utilisation of the whole server, as reported by the admin API
+type adminBuffers struct {
+	Clients       int                          `json:"clients"`
+	Relays        int                          `json:"relays"`
+	RelayCapacity int                          `json:"relay_capacity"`
+	Full          int                          `json:"full"`
+	PerClient     map[msg.ClientId]adminBuffer `json:"per_client"`
+}
+
+// Connection counts and limits of the whole server, as reported by the admin API
+type adminConnections struct {
+	Clients         int            `json:"clients"`
+	MaxTotalClients int            `json:"max_total_clients,omitempty"`
+	MaxConnsPerIP   int            `json:"max_conns_per_ip,omitempty"`
+	PerIP           map[string]int `json:"per_ip"`
+	Refused         uint64         `json:"refused"`
+}
+
+// Bytes relayed by a client, as reported by the admin API
+type adminUsage struct {
+	// Bytes relayed within the current quota period, and since the client connected
+	PeriodBytes uint64 `json:"period_bytes"`
+	TotalBytes  uint64 `json:"total_bytes"`
+	Exceeded    bool   `json:"exceeded,omitempty"`
+}
+
+// Bytes relayed by every client, and the quota, as reported by the admin API
+type adminQuotas struct {
+	// Quota for each client in bytes, with zero for unlimited, and the window they are counted over (zero for daily)
+	QuotaBytes    uint64                      `json:"quota_bytes"`
+	WindowSeconds float64                     `json:"window_seconds"`
+	PerClient     map[msg.ClientId]adminUsage `json:"per_client"`
+}
+
+// Health of the server, as reported by the admin API's health and readiness checks
+type adminHealth struct {
+	Ready     bool     `json:"ready"`
+	Listeners []string `json:"listeners"`
+	// Listeners which have stopped accepting connections because of an error
+	FailedListeners []string `json:"failed_listeners,omitempty"`
+	Clients         int      `json:"clients"`
+	ShuttingDown    bool     `json:"shutting_down"`
+	Full            bool     `json:"full,omitempty"`
+	Draining        bool     `json:"draining,omitempty"`
+}
+
+// Whether the server is draining, as reported and changed by the admin API
+type adminDraining struct {
+	Draining bool `json:"draining"`
+}
+
+// Get an http.Handler serving a JSON admin API for the server. It provides:
+//
+//	GET    /clients       List the connected clients, with their remote address, connection age and buffer utilisation
+//	GET    /clients/{id}  Get a single connected client
+//	DELETE /clients/{id}  Forcibly disconnect a client
+//	GET    /buffers       Get the buffer utilisation of every client, and totals for the whole server
+//	GET    /connections   Get the number of clients from each IP address, the limits, and how many have been refused
+//	GET    /ratelimit     Get the relay rate limit
+//	PUT    /ratelimit     Change the relay rate limit, with a JSON body such as {"rate": 10, "burst": 20}
+//	GET    /quotas        Get the bytes each client has relayed, in the current quota period and in total, and the quota
+//	GET    /draining      Get whether the server is draining, and refusing new clients (see 'Server.SetDraining')
+//	PUT    /draining      Start or stop draining, with a JSON body such as {"draining": true}
+//	GET    /config        Get the limits which can be changed while the server is running (see 'Limits')
+//	PUT    /config        Change some of the limits, with a JSON body such as {"idle_timeout_seconds": 30}. Any limits
+//	                      left out are unchanged.
+//	GET    /healthz       Check the server is alive, for liveness probes. Always succeeds, even while shutting down.
+//	GET    /readyz        Check the server is accepting clients, for readiness probes. Fails with 503 Service Unavailable
+//	                      once shutdown has begun, while the server is draining, or while it has MaxTotalClients connected.
+//
+// The client listings (GET /clients, /buffers and /quotas) can be narrowed to a single namespace with a query such as
+// "?namespace=tenant1". An empty namespace ("?namespace=") is the default namespace.
+//
+// The health and readiness checks both report the addresses being listened on, the number of connected clients, and
+// whether shutdown has begun.
+//
+// The admin API has no authentication of its own, so it should only be served to trusted networks,
+// or wrapped in a handler that authenticates requests.
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/clients", s.handleAdminClients)
+	mux.HandleFunc("/clients/", s.handleAdminClient)
+	mux.HandleFunc("/buffers", s.handleAdminBuffers)
+	mux.HandleFunc("/connections", s.handleAdminConnections)
+	mux.HandleFunc("/ratelimit", s.handleAdminRateLimit)
+	mux.HandleFunc("/config", s.handleAdminConfig)
+	mux.HandleFunc("/quotas", s.handleAdminQuotas)
+	mux.HandleFunc("/draining", s.handleAdminDraining)
+	s.addHealthHandlers(mux)
+	return mux
+}
+
+// Get an http.Handler serving only the health and readiness checks of the admin API (GET /healthz and GET /readyz).
+// They reveal nothing sensitive, so unlike the rest of the admin API, can be served to orchestration platforms such as
+// Docker or Kubernetes, which probe from outside the server's machine.
+func (s *Server) HealthHandler() http.Handler {
+	mux := http.NewServeMux()
+	s.addHealthHandlers(mux)
+	return mux
+}
+
+func (s *Server) addHealthHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) { s.handleAdminHealth(w, r, false) })
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) { s.handleAdminHealth(w, r, true) })
+}
+
+// Handle listing all connected clients
+func (s *Server) handleAdminClients(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		adminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	now := time.Now()
+	s.clients_mutex.RLock()
+	list := make([]adminClient, 0, len(s.clients))
+	for cid, sc := range s.clients {
+		if inAdminNamespace(r, &sc) {
+			list = append(list, sc.adminInfo(cid, now))
+		}
+	}
+	s.clients_mutex.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	s.addAdminNames(list)
+	adminReply(w, list)
+}
+
+// Handle inspecting or disconnecting a single client
+func (s *Server) handleAdminClient(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/clients/"), 10, 64)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, "invalid client id")
+		return
+	}
+	cid := msg.ClientId(id)
+	s.clients_mutex.RLock()
+	sc, ok := s.clients[cid]
+	s.clients_mutex.RUnlock()
+	if !ok {
+		adminError(w, http.StatusNotFound, "no such client")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		list := []adminClient{sc.adminInfo(cid, time.Now())}
+		s.addAdminNames(list)
+		adminReply(w, list[0])
+	case http.MethodDelete:
+		// The sender notices the closed connection, and removes the client as usual
+		sc.con.Close()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		adminError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// Handle inspecting the buffer utilisation of all clients
+func (s *Server) handleAdminBuffers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		adminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	bufs := adminBuffers{PerClient: make(map[msg.ClientId]adminBuffer)}
+	s.clients_mutex.RLock()
+	for cid, sc := range s.clients {
+		if !inAdminNamespace(r, &sc) {
+			continue
+		}
+		buf := sc.adminBuffer()
+		bufs.PerClient[cid] = buf
+		bufs.Relays += buf.Relays
+		bufs.RelayCapacity += buf.RelayCapacity
+		if buf.Full {
+			bufs.Full++
+		}
+	}
+	bufs.Clients = len(bufs.PerClient)
+	s.clients_mutex.RUnlock()
+	adminReply(w, bufs)
+}
+
+// Handle inspecting the connection counts and limits
+func (s *Server) handleAdminConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		adminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	conns := adminConnections{
+		MaxTotalClients: s.cfg().MaxTotalClients,
+		MaxConnsPerIP:   s.cfg().MaxConnsPerIP,
+		PerIP:           make(map[string]int),
+		Refused:         atomic.LoadUint64(&s.refused_conns),
+	}
+	s.clients_mutex.RLock()
+	for ip, n := range s.ip_conns {
+		conns.PerIP[ip] = n
+	}
+	conns.Clients = len(s.clients)
+	s.clients_mutex.RUnlock()
+	adminReply(w, conns)
+}
+
+// Handle getting or changing the relay rate limit
+func (s *Server) handleAdminRateLimit(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		var limit RateLimit
+		if err := json.NewDecoder(r.Body).Decode(&limit); err != nil {
+			adminError(w, http.StatusBadRequest, "invalid rate limit: "+err.Error())
+			return
+		}
+		if limit.Rate < 0 || limit.Burst < 0 {
+			adminError(w, http.StatusBadRequest, "rate limit can't be negative")
+			return
+		}
+		s.SetRelayRateLimit(limit)
+	default:
+		adminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	adminReply(w, s.RelayRateLimit())
+}
+
+// Handle getting or changing whether the server is draining
+func (s *Server) handleAdminDraining(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		var draining adminDraining
+		if err := json.NewDecoder(r.Body).Decode(&draining); err != nil {
+			adminError(w, http.StatusBadRequest, "invalid draining: "+err.Error())
+			return
+		}
+		s.SetDraining(draining.Draining)
+	default:
+		adminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	adminReply(w, adminDraining{Draining: s.Draining()})
+}
+
+// Handle inspecting the bytes relayed by each client, against the quota
+func (s *Server) handleAdminQuotas(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		adminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	q := s.cfg().ByteQuota
+	quotas := adminQuotas{
+		QuotaBytes:    q.Bytes,
+		WindowSeconds: q.Window.Seconds(),
+		PerClient:     make(map[msg.ClientId]adminUsage),
+	}
+	now := time.Now()
+	s.clients_mutex.RLock()
+	for cid, sc := range s.clients {
+		if !inAdminNamespace(r, &sc) {
+			continue
+		}
+		period, total := sc.relayed.used(q, now)
+		quotas.PerClient[cid] = adminUsage{
+			PeriodBytes: period,
+			TotalBytes:  total,
+			Exceeded:    q.Bytes > 0 && period >= q.Bytes,
+		}
+	}
+	s.clients_mutex.RUnlock()
+	adminReply(w, quotas)
+}
+
+// Handle getting or changing the limits
+func (s *Server) handleAdminConfig(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		cfg := s.Config()
+		limits := cfg.Limits()
+		if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+			adminError(w, http.StatusBadRequest, "invalid limits: "+err.Error())
+			return
+		}
+		s.UpdateConfig(cfg.WithLimits(limits))
+	default:
+		adminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	adminReply(w, s.Config().Limits())
+}
+
+// Handle a health check, or a readiness check which fails unless the server is ready for new clients
+func (s *Server) handleAdminHealth(w http.ResponseWriter, r *http.Request, readiness bool) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		adminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	health := adminHealth{Listeners: []string{}}
+	s.is_closed_mutex.RLock()
+	health.ShuttingDown = s.is_closed
+	s.is_closed_mutex.RUnlock()
+	s.listeners_mutex.Lock()
+	for _, sl := range s.listeners {
+		if sl.err != nil {
+			health.FailedListeners = append(health.FailedListeners, sl.l.Addr().String())
+		} else {
+			health.Listeners = append(health.Listeners, sl.l.Addr().String())
+		}
+	}
+	s.listeners_mutex.Unlock()
+	s.clients_mutex.RLock()
+	health.Clients = len(s.clients)
+	s.clients_mutex.RUnlock()
+	health.Full = s.cfg().MaxTotalClients > 0 && health.Clients >= s.cfg().MaxTotalClients
+	health.Draining = s.Draining()
+	health.Ready = !health.ShuttingDown && !health.Full && !health.Draining
+
+	if readiness && !health.Ready {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(health)
+		return
+	}
+	adminReply(w, health)
+}
+
+// Fill in the registered names of clients in the list
+func (s *Server) addAdminNames(list []adminClient) {
+	s.names_mutex.RLock()
+	for i := range list {
+		list[i].Name = s.client_names[list[i].Id].name
+	}
+	s.names_mutex.RUnlock()
+}
+
+// Check whether a client is in the namespace the admin request is narrowed to, if it is
+func inAdminNamespace(r *http.Request, sc *serverClient) bool {
+	q := r.URL.Query()
+	return !q.Has("namespace") || q.Get("namespace") == sc.ns()
+}
+
+// Get the admin API view of the client
+func (sc *serverClient) adminInfo(cid msg.ClientId, now time.Time) adminClient {
+	return adminClient{
+		Id:         cid,
+		Namespace:  sc.ns(),
+		RemoteAddr: sc.con.RemoteAddr().String(),
+		Connected:  sc.connected,
+		AgeSeconds: now.Sub(sc.connected).Seconds(),
+		Buffer:     sc.adminBuffer(),
+	}
+}
+
+// Get the admin API view of the client's buffers
+func (sc *serverClient) adminBuffer() adminBuffer {
+	return adminBuffer{
+		Relays:          sc.relayMsgs.len(),
+		RelayCapacity:   sc.relayMsgs.cap(),
+		Full:            sc.relayMsgs.full(),
+		Control:         len(sc.controlMsgs),
+		ControlCapacity: cap(sc.controlMsgs),
+	}
+}
+
+// Write a successful JSON response
+func adminReply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// Write a JSON error response
+func adminError(w http.ResponseWriter, code int, reason string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": reason})
+}
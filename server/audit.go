@@ -0,0 +1,199 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/CiaranWoodward/broadcast_hub/logging"
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// AuditRecord describes a relay request and what became of it, for the audit log
+type AuditRecord struct {
+	// When the relay was handled
+	Time time.Time `json:"time"`
+	// Client which sent the relay, and its namespace
+	Src       msg.ClientId `json:"src"`
+	Namespace string       `json:"ns,omitempty"`
+	// Destinations as requested by the sender. Topic, broadcast and group relays go to other clients too, which are
+	// listed in Statuses.
+	Dests      []msg.ClientId `json:"dests,omitempty"`
+	DestGroups []string       `json:"dest_groups,omitempty"`
+	Topic      string         `json:"topic,omitempty"`
+	Broadcast  bool           `json:"broadcast,omitempty"`
+	// Length of the message, as sent (so compressed, if the relay was)
+	Size int `json:"size"`
+	// Status of the relay as a whole, as in the Relay Response
+	Status msg.Status `json:"status"`
+	// Status of every destination the relay was sent to, including the successful ones.
+	// Empty if the relay was rejected, or was a duplicate of one already sent.
+	Statuses msg.ClientStatusMap `json:"statuses,omitempty"`
+	// The message itself, only with AuditPayloads set in the ServerConfig
+	Payload []byte `json:"payload,omitempty"`
+}
+
+// AuditSink receives a record of every relay, for deployments which have to keep an audit trail.
+// Records are passed synchronously from the goroutines handling the sender, so sinks should return quickly.
+// Implementations must be safe to call from multiple goroutines.
+type AuditSink interface {
+	// Audit records a relay. A failure is logged by the server, and doesn't affect the relay.
+	Audit(rec AuditRecord) error
+}
+
+// AuditFunc is an AuditSink calling a function with each record
+type AuditFunc func(rec AuditRecord) error
+
+func (f AuditFunc) Audit(rec AuditRecord) error {
+	return f(rec)
+}
+
+// AuditSink writing each record as a line of JSON
+type jsonAuditSink struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+// NewJSONAuditSink gets an AuditSink which writes each record to 'w' as a line of JSON, eg. to os.Stdout for a log
+// collector to pick up
+func NewJSONAuditSink(w io.Writer) AuditSink {
+	return &jsonAuditSink{w: w}
+}
+
+func (j *jsonAuditSink) Audit(rec AuditRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	_, err = j.w.Write(append(line, '\n'))
+	return err
+}
+
+// FileAuditSink is an AuditSink which appends each record to a file as a line of JSON, rotating the file once it
+// reaches a maximum size. The rotated files are kept as 'path.1' (the most recent) to 'path.N', and older ones are
+// removed.
+type FileAuditSink struct {
+	path     string
+	max_size int64
+	max_kept int
+	mutex    sync.Mutex
+	file     *os.File
+	size     int64
+}
+
+// OpenFileAuditSink opens the audit log at 'path' for appending, creating it if it doesn't exist.
+// It is rotated once writing a record would take it past 'maxSize' bytes, keeping 'maxFiles' rotated files.
+// A zero 'maxSize' never rotates it.
+func OpenFileAuditSink(path string, maxSize int64, maxFiles int) (*FileAuditSink, error) {
+	fs := &FileAuditSink{path: path, max_size: maxSize, max_kept: maxFiles}
+	if err := fs.open(); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// Open the current file, carrying on from its end
+func (fs *FileAuditSink) open() error {
+	file, err := os.OpenFile(fs.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	fs.file = file
+	fs.size = info.Size()
+	return nil
+}
+
+// Move the current file out of the way, and start a new one
+func (fs *FileAuditSink) rotate() error {
+	if err := fs.file.Close(); err != nil {
+		return err
+	}
+	fs.file = nil
+	if fs.max_kept <= 0 {
+		if err := os.Remove(fs.path); err != nil {
+			return err
+		}
+	} else {
+		for i := fs.max_kept - 1; i >= 1; i-- {
+			if err := os.Rename(fmt.Sprintf("%s.%d", fs.path, i), fmt.Sprintf("%s.%d", fs.path, i+1)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := os.Rename(fs.path, fs.path+".1"); err != nil {
+			return err
+		}
+	}
+	return fs.open()
+}
+
+func (fs *FileAuditSink) Audit(rec AuditRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if fs.file == nil {
+		// A previous rotation failed part way through, so try again to start a new file
+		if err := fs.open(); err != nil {
+			return err
+		}
+	}
+	if fs.max_size > 0 && fs.size > 0 && fs.size+int64(len(line)) > fs.max_size {
+		if err := fs.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := fs.file.Write(line)
+	fs.size += int64(n)
+	return err
+}
+
+// Close the audit log
+func (fs *FileAuditSink) Close() error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if fs.file == nil {
+		return nil
+	}
+	err := fs.file.Close()
+	fs.file = nil
+	return err
+}
+
+// Record a relay in the audit log, if there is one. 'statuses' has the status of every destination it was sent to.
+func (s *Server) auditRelay(sc *serverClient, req *msg.RelayRequest, now time.Time, rsp *msg.RelayResponse, statuses msg.ClientStatusMap) {
+	sink := s.cfg().Audit
+	if sink == nil {
+		return
+	}
+	rec := AuditRecord{
+		Time:       now,
+		Src:        sc.id(),
+		Namespace:  sc.ns(),
+		Dests:      req.Dest,
+		DestGroups: req.DestGroups,
+		Topic:      req.Topic,
+		Broadcast:  req.Broadcast,
+		Size:       len(req.Msg),
+		Status:     rsp.Status,
+		Statuses:   statuses,
+	}
+	if s.cfg().AuditPayloads {
+		rec.Payload = req.Msg
+	}
+	if err := sink.Audit(rec); err != nil {
+		s.cfg().Logger.Warn("Failed to audit relay", logging.F("client", rec.Src), logging.F("err", err))
+	}
+}
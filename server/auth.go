@@ -0,0 +1,151 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"sync/atomic"
+	"time"
+
+	"github.com/CiaranWoodward/broadcast_hub/logging"
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// Authenticator verifies the credentials presented by clients in an Auth Request.
+// It may be called concurrently for different clients.
+type Authenticator interface {
+	Authenticate(creds msg.Credentials) bool
+}
+
+// AuthenticatorFunc allows an ordinary function to be used as an Authenticator
+type AuthenticatorFunc func(creds msg.Credentials) bool
+
+// Authenticate calls f(creds)
+func (f AuthenticatorFunc) Authenticate(creds msg.Credentials) bool {
+	return f(creds)
+}
+
+// TokenAuthenticator accepts clients presenting any one of a static list of tokens
+type TokenAuthenticator struct {
+	tokens [][]byte
+}
+
+// Create a new TokenAuthenticator, accepting any of the given tokens
+func NewTokenAuthenticator(tokens ...string) *TokenAuthenticator {
+	a := &TokenAuthenticator{}
+	for _, t := range tokens {
+		a.tokens = append(a.tokens, []byte(t))
+	}
+	return a
+}
+
+// Authenticate checks the client's token against the list, in constant time
+func (a *TokenAuthenticator) Authenticate(creds msg.Credentials) bool {
+	tok := []byte(creds.Token)
+	ok := 0
+	for _, t := range a.tokens {
+		ok |= subtle.ConstantTimeCompare(t, tok)
+	}
+	return ok == 1 && len(tok) > 0
+}
+
+// HMACAuthenticator accepts clients whose password is the HMAC-SHA256 of their username under a shared key.
+// This allows credentials to be issued (with 'HMACPassword') without the server storing a list of users.
+type HMACAuthenticator struct {
+	Key []byte
+}
+
+// HMACPassword generates the password that an HMACAuthenticator with 'key' accepts for 'username'
+func HMACPassword(key []byte, username string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(username))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Authenticate checks the client's password against the HMAC of its username
+func (a *HMACAuthenticator) Authenticate(creds msg.Credentials) bool {
+	if creds.Username == "" {
+		return false
+	}
+	expected := HMACPassword(a.Key, creds.Username)
+	return hmac.Equal([]byte(expected), []byte(creds.Password))
+}
+
+// Handle an incoming Auth Request Message, returning the relays stored for the client's identity, if it has been moved
+// onto it
+func (s *Server) handleAuthRequest(sc *serverClient, mesg *msg.Message, rsp *msg.Message) backlog {
+	rsp.AuthRes = &msg.AuthResponse{
+		Status: msg.UNAUTHENTICATED,
+	}
+	var stored []msg.RelayIndication
+	if s.cfg().Authenticator == nil || s.cfg().Authenticator.Authenticate(mesg.AuthReq.Credentials) {
+		rsp.AuthRes.Status = msg.SUCCESS
+		ns := ""
+		if s.cfg().Namespacer != nil {
+			ns = s.cfg().Namespacer.Namespace(mesg.AuthReq.Credentials)
+		}
+		s.setNamespace(sc, ns)
+		// The client may have an ID of its own, once it's known who it is
+		rsp.AuthRes.Id, stored = s.assignIdentity(sc, mesg.AuthReq.Credentials)
+		if atomic.CompareAndSwapInt32(sc.authenticated, 0, 1) {
+			close(sc.auth_done)
+		}
+		if s.cfg().AdminAuthenticator != nil && s.cfg().AdminAuthenticator.Authenticate(mesg.AuthReq.Credentials) {
+			atomic.StoreInt32(sc.admin, 1)
+		}
+	} else {
+		s.cfg().Logger.Warn("Client failed authentication", logging.F("client", sc.id()))
+	}
+	return backlog{cid: rsp.AuthRes.Id, relays: stored}
+}
+
+// Reject a message from a client that must authenticate first
+func (s *Server) rejectUnauthenticated(sc *serverClient, mesg *msg.Message) {
+	sc.responseMsgs <- msg.Message{
+		Version:   msg.MyVersion,
+		MessageId: mesg.MessageId,
+		AuthRes: &msg.AuthResponse{
+			Status: msg.UNAUTHENTICATED,
+		},
+		Error: &msg.ErrorResponse{
+			Status: msg.UNAUTHENTICATED,
+			Text:   "not authenticated",
+		},
+	}
+}
+
+// Check whether a message may be handled for this client, based on whether it has authenticated
+func (sc *serverClient) isAllowed(mesg *msg.Message) bool {
+	if atomic.LoadInt32(sc.authenticated) != 0 {
+		return true
+	}
+	// Only the commands needed to connect and authenticate are allowed beforehand
+	allowed := msg.Message{
+		Version:   mesg.Version,
+		MessageId: mesg.MessageId,
+		Trace:     mesg.Trace,
+		IdReq:     mesg.IdReq,
+		PingReq:   mesg.PingReq,
+		PingRes:   mesg.PingRes,
+		HelloReq:  mesg.HelloReq,
+		AuthReq:   mesg.AuthReq,
+		FlowUpd:   mesg.FlowUpd,
+	}
+	return *mesg == allowed
+}
+
+// Disconnect the client if it doesn't authenticate before the timeout
+func (s *Server) startAuthTimer(sc serverClient) {
+	go func() {
+		timer := time.NewTimer(s.cfg().AuthTimeout)
+		defer timer.Stop()
+		select {
+		case <-sc.auth_done:
+		case <-sc.removed:
+		case <-timer.C:
+			s.cfg().Logger.Warn("Client did not authenticate in time, disconnecting", logging.F("client", sc.id()))
+			sc.disconnect(msg.UNAUTHENTICATED)
+		}
+	}()
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/CiaranWoodward/broadcast_hub/logging"
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// Backplane forwards relays between servers sharing it, so that several servers can run behind a load balancer, with
+// clients connected to any of them able to relay to each other. It may be called concurrently.
+//
+// Only relays sent directly to a client that isn't connected to this server are forwarded. Broadcasts, topics, groups
+// and client lists only include the clients of this server. The servers must give their clients IDs which are unique
+// across all of them, such as with a RandomAllocator.
+type Backplane interface {
+	// Start receiving relays forwarded to a client which has connected to this server, passing each to 'deliver'
+	Attach(cid msg.ClientId, deliver func(ind msg.RelayIndication)) error
+	// Stop receiving relays for a client which has disconnected from this server
+	Detach(cid msg.ClientId) error
+	// Forward a relay to a client connected to another server. Returns false if no server has the client.
+	Forward(dest msg.ClientId, ind msg.RelayIndication) (bool, error)
+}
+
+// MemoryBackplane is a Backplane connecting servers in the same process
+type MemoryBackplane struct {
+	clients       map[msg.ClientId]func(msg.RelayIndication)
+	clients_mutex sync.RWMutex
+}
+
+// Create a new MemoryBackplane, to be shared by each of the servers
+func NewMemoryBackplane() *MemoryBackplane {
+	return &MemoryBackplane{clients: make(map[msg.ClientId]func(msg.RelayIndication))}
+}
+
+// Attach starts passing relays forwarded to the client to 'deliver'
+func (b *MemoryBackplane) Attach(cid msg.ClientId, deliver func(ind msg.RelayIndication)) error {
+	b.clients_mutex.Lock()
+	b.clients[cid] = deliver
+	b.clients_mutex.Unlock()
+	return nil
+}
+
+// Detach stops passing relays forwarded to the client
+func (b *MemoryBackplane) Detach(cid msg.ClientId) error {
+	b.clients_mutex.Lock()
+	delete(b.clients, cid)
+	b.clients_mutex.Unlock()
+	return nil
+}
+
+// Forward delivers a relay to the server the client is attached to
+func (b *MemoryBackplane) Forward(dest msg.ClientId, ind msg.RelayIndication) (bool, error) {
+	b.clients_mutex.RLock()
+	deliver, ok := b.clients[dest]
+	b.clients_mutex.RUnlock()
+	if ok {
+		deliver(ind)
+	}
+	return ok, nil
+}
+
+// Start receiving relays from the backplane for a client that has connected, or moved onto a new ID
+func (s *Server) attachBackplane(cid msg.ClientId) {
+	if s.cfg().Backplane == nil {
+		return
+	}
+	err := s.cfg().Backplane.Attach(cid, func(ind msg.RelayIndication) {
+		s.deliverForwarded(cid, ind)
+	})
+	if err != nil {
+		s.cfg().Logger.Error("Failed to attach client to backplane", logging.F("client", cid), logging.F("err", err))
+	}
+}
+
+// Stop receiving relays from the backplane for a client that has disconnected, or moved off an ID
+func (s *Server) detachBackplane(cid msg.ClientId) {
+	if s.cfg().Backplane == nil {
+		return
+	}
+	if err := s.cfg().Backplane.Detach(cid); err != nil {
+		s.cfg().Logger.Error("Failed to detach client from backplane", logging.F("client", cid), logging.F("err", err))
+	}
+}
+
+// Forward a relay for a client that isn't connected to this server through the backplane.
+// Returns false if there's no backplane, or no other server has the client.
+func (s *Server) forwardRelay(dest msg.ClientId, ind msg.RelayIndication) bool {
+	if s.cfg().Backplane == nil {
+		return false
+	}
+	ok, err := s.cfg().Backplane.Forward(dest, ind)
+	if err != nil {
+		s.cfg().Logger.Error("Failed to forward relay", logging.F("client", dest), logging.F("err", err))
+		return false
+	}
+	return ok
+}
+
+// Deliver a relay forwarded from another server to one of this server's clients. There's nobody to report failures to,
+// so relays that can't be delivered or stored are dropped. Relays are only forwarded between clients in the default
+// namespace.
+func (s *Server) deliverForwarded(cid msg.ClientId, ind msg.RelayIndication) {
+	s.clients_mutex.RLock()
+	dest_client, ok := s.clients[cid]
+	s.clients_mutex.RUnlock()
+	var status msg.Status
+	if ok && (dest_client.ns() != "" || s.isHidden(&dest_client)) {
+		status = msg.INVALID_ID
+	} else if ok {
+		status = s.enqueueRelay(dest_client.relayMsgs.queue(ind.Priority), dest_client.credits, s.shareRelay(ind), time.Now().Add(s.cfg().BlockTimeout))
+	} else {
+		status = s.storeRelay(cid, "", ind)
+	}
+	if status != msg.SUCCESS {
+		s.cfg().Logger.Debug("Dropped forwarded relay", logging.F("client", cid), logging.F("status", status))
+	}
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"context"
+
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// Handle an incoming Relay Batch Request Message, by relaying each relay in turn as if it had been sent in a Relay
+// Request of its own, then answering them all in one response.
+// Each relay is rate limited separately, so a batch can't get round the client's RelayRateLimit.
+func (s *Server) handleRelayBatchRequest(ctx context.Context, sc *serverClient, mesg *msg.Message, rsp *msg.Message) {
+	req := mesg.RelayBatReq
+	res := &msg.RelayBatchResponse{Status: msg.SUCCESS}
+	if len(req.Relays) > msg.MaxBatchRelays {
+		res.Status = msg.TOO_LONG
+	} else if len(req.RelayIds) != 0 && len(req.RelayIds) != len(req.Relays) {
+		res.Status = msg.ENCODING_ERROR
+	} else {
+		res.Results = make([]msg.RelayResponse, 0, len(req.Relays))
+		for i := range req.Relays {
+			if !s.throttleRelay(sc) {
+				// The client has gone, so there's nobody to answer
+				return
+			}
+			// Relay it as a message of its own, identified by its own relay ID if it has one
+			single := msg.Message{
+				Version:   mesg.Version,
+				MessageId: mesg.MessageId,
+				Trace:     mesg.Trace,
+				RelayReq:  &req.Relays[i],
+			}
+			if len(req.RelayIds) != 0 {
+				single.MessageId = req.RelayIds[i]
+			}
+			res.Results = append(res.Results, *s.relay(ctx, sc, &single))
+		}
+	}
+	rsp.RelayBatRes = res
+}
@@ -0,0 +1,121 @@
+/*
+Package boltstore implements a server.MessageStore backed by a bbolt database file, so that large backlogs of
+stored relays don't take up the server's memory.
+
+Example, storing relays for disconnected clients in "relays.db":
+  store, err := boltstore.Open("relays.db", 100)
+  if err == nil {
+	  defer store.Close()
+	  ser := server.NewServerWithConfig(server.ServerConfig{MessageStore: store})
+  }
+*/
+package boltstore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+	"github.com/CiaranWoodward/broadcast_hub/server"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Store is a server.MessageStore which keeps each client's backlog in its own bucket of a bbolt database
+type Store struct {
+	db    *bolt.DB
+	limit int
+	tc    msg.Transcoder
+}
+
+var _ server.MessageStore = (*Store)(nil)
+
+// Open (or create) the database file at 'path', holding up to 'limit' relays per client (zero for no limit).
+// The file is locked while it is open, so can only be used by one server at a time.
+func Open(path string, limit int) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &Store{
+		db:    db,
+		limit: limit,
+		tc:    &msg.CborTranscoder{},
+	}, nil
+}
+
+// Close the database file
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Put appends a relay to the client's backlog, or returns server.ErrStoreFull
+func (s *Store) Put(cid msg.ClientId, ind msg.RelayIndication) error {
+	encoded, err := s.tc.Encode(msg.Message{Version: msg.MyVersion, RelayInd: &ind})
+	if err != nil {
+		return fmt.Errorf("failed to encode relay: %w", err)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(key(uint64(cid)))
+		if err != nil {
+			return err
+		}
+		if s.limit > 0 && b.Stats().KeyN >= s.limit {
+			return server.ErrStoreFull
+		}
+		// Sequence numbers keep the backlog in order
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		return b.Put(key(seq), encoded)
+	})
+}
+
+// Take removes and returns the client's backlog
+func (s *Store) Take(cid msg.ClientId) (backlog []msg.RelayIndication, err error) {
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(key(uint64(cid)))
+		if b == nil {
+			return nil
+		}
+		err := b.ForEach(func(_, v []byte) error {
+			m, err := s.tc.Decode(v)
+			if err != nil {
+				return fmt.Errorf("failed to decode stored relay: %w", err)
+			}
+			if m.RelayInd == nil {
+				return errors.New("failed to decode stored relay: not a Relay Indication")
+			}
+			backlog = append(backlog, *m.RelayInd)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.DeleteBucket(key(uint64(cid)))
+	})
+	if err != nil {
+		backlog = nil
+	}
+	return
+}
+
+// Drop discards the client's backlog
+func (s *Store) Drop(cid msg.ClientId) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket(key(uint64(cid)))
+		if err == bolt.ErrBucketNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+// Big-endian keys, so they sort numerically
+func key(n uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, n)
+	return b
+}
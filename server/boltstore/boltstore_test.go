@@ -0,0 +1,43 @@
+package boltstore
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+	"github.com/CiaranWoodward/broadcast_hub/server"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBoltStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "relays.db")
+	store, err := Open(path, 2)
+	assert.Nil(t, err)
+
+	assert.Nil(t, store.Put(1, msg.RelayIndication{Src: 2, Msg: []byte{0}}))
+	assert.Nil(t, store.Put(1, msg.RelayIndication{Src: 3, Msg: []byte{1}, AckRequested: true, RelayId: 7}))
+	assert.Equal(t, server.ErrStoreFull, store.Put(1, msg.RelayIndication{Src: 2, Msg: []byte{2}}))
+	assert.Nil(t, store.Put(4, msg.RelayIndication{Src: 2, Msg: []byte{3}}))
+
+	// Stored relays survive reopening the database
+	assert.Nil(t, store.Close())
+	store, err = Open(path, 2)
+	assert.Nil(t, err)
+
+	backlog, err := store.Take(1)
+	assert.Nil(t, err)
+	assert.Equal(t, []msg.RelayIndication{
+		{Src: 2, Msg: []byte{0}},
+		{Src: 3, Msg: []byte{1}, AckRequested: true, RelayId: 7},
+	}, backlog)
+	backlog, err = store.Take(1)
+	assert.Nil(t, err)
+	assert.Len(t, backlog, 0)
+
+	assert.Nil(t, store.Drop(4))
+	assert.Nil(t, store.Drop(4))
+	backlog, err = store.Take(4)
+	assert.Nil(t, err)
+	assert.Len(t, backlog, 0)
+	assert.Nil(t, store.Close())
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+
+	"github.com/CiaranWoodward/broadcast_hub/logging"
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// Most attempts to allocate a ClientId which isn't already in use, before giving up on the client
+const maxAllocateAttempts = 16
+
+// ClientIdAllocator chooses the ClientIds of clients. It may be called concurrently.
+type ClientIdAllocator interface {
+	// Get an ID for a client that has just connected. It must not be zero. The server tries again if the ID is
+	// already in use by another connected client.
+	NewClientId() msg.ClientId
+	// Get the ID for a client that has authenticated with the credentials, if they should always have the same ID.
+	// 'ok' is false to keep the ID the client connected with.
+	IdentityClientId(creds msg.Credentials) (cid msg.ClientId, ok bool)
+}
+
+// SequentialAllocator allocates ClientIds in order, starting from 1. This is the default.
+// IDs reveal the order clients connected in, and are reused after a restart.
+type SequentialAllocator struct {
+	last uint64
+}
+
+// NewClientId gets the next ID in sequence
+func (a *SequentialAllocator) NewClientId() msg.ClientId {
+	return msg.ClientId(atomic.AddUint64(&a.last, 1))
+}
+
+// IdentityClientId keeps the ID the client connected with
+func (a *SequentialAllocator) IdentityClientId(creds msg.Credentials) (msg.ClientId, bool) {
+	return 0, false
+}
+
+// RandomAllocator allocates random 64-bit ClientIds, which are hard to guess and unlikely to be reused after a restart
+type RandomAllocator struct{}
+
+// NewClientId gets a random, non-zero ID
+func (RandomAllocator) NewClientId() msg.ClientId {
+	var b [8]byte
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			panic(err)
+		}
+		if cid := msg.ClientId(binary.BigEndian.Uint64(b[:])); cid != 0 {
+			return cid
+		}
+	}
+}
+
+// IdentityClientId keeps the ID the client connected with
+func (RandomAllocator) IdentityClientId(creds msg.Credentials) (msg.ClientId, bool) {
+	return 0, false
+}
+
+// PersistentAllocator gives authenticated clients the same ClientId every time, even across restarts, so other clients
+// can keep relaying to them. The ID is derived from the client's username (or token, if it has no username) with an
+// HMAC under Key, so IDs can't be linked to identities without it. Identity IDs always have their top bit set.
+//
+// Clients get an ID from Anonymous when they connect (random IDs if nil), and move to their identity's ID
+// once they authenticate, unless another client connected with the same identity already has it.
+type PersistentAllocator struct {
+	Key       []byte
+	Anonymous ClientIdAllocator
+}
+
+// Create a new PersistentAllocator with the key, using a SequentialAllocator for clients before they authenticate
+func NewPersistentAllocator(key []byte) *PersistentAllocator {
+	return &PersistentAllocator{Key: key, Anonymous: &SequentialAllocator{}}
+}
+
+// NewClientId gets an ID from the Anonymous allocator
+func (a *PersistentAllocator) NewClientId() msg.ClientId {
+	if a.Anonymous == nil {
+		return RandomAllocator{}.NewClientId()
+	}
+	return a.Anonymous.NewClientId()
+}
+
+// IdentityClientId derives the ID of the identity the client authenticated as
+func (a *PersistentAllocator) IdentityClientId(creds msg.Credentials) (msg.ClientId, bool) {
+	mac := hmac.New(sha256.New, a.Key)
+	if creds.Username != "" {
+		mac.Write([]byte("user:" + creds.Username))
+	} else if creds.Token != "" {
+		mac.Write([]byte("token:" + creds.Token))
+	} else {
+		return 0, false
+	}
+	return msg.ClientId(binary.BigEndian.Uint64(mac.Sum(nil)) | 1<<63), true
+}
+
+// Allocate an ID for a new client, which no other connected client has. Must be called with the clients lock held.
+// Returns zero if no free ID could be found.
+func (s *Server) allocateClientId() msg.ClientId {
+	for i := 0; i < maxAllocateAttempts; i++ {
+		cid := s.cfg().ClientIdAllocator.NewClientId()
+		if _, taken := s.clients[cid]; cid != 0 && !taken {
+			return cid
+		}
+	}
+	s.cfg().Logger.Error("Failed to allocate a free client ID")
+	return 0
+}
+
+// Move a client that has authenticated onto its identity's ID, if the ClientIdAllocator gives it one.
+// A disconnected session with that ID is taken over, as if it had been resumed. Returns the new ID (or zero if it
+// hasn't changed), and the relays stored for the session.
+func (s *Server) assignIdentity(sc *serverClient, creds msg.Credentials) (msg.ClientId, []msg.RelayIndication) {
+	cid, ok := s.cfg().ClientIdAllocator.IdentityClientId(creds)
+	if !ok || cid == 0 || cid == sc.id() {
+		return 0, nil
+	}
+	s.sessions_mutex.Lock()
+	sess, has_session := s.sessions[cid]
+	if has_session && sess.offline_since.IsZero() {
+		s.sessions_mutex.Unlock()
+		s.cfg().Logger.Warn("Client identity is already connected", logging.F("client", sc.id()), logging.F("identity", cid))
+		return 0, nil
+	}
+	prev_cid, status := s.moveClient(sc, cid)
+	if status != msg.SUCCESS {
+		s.sessions_mutex.Unlock()
+		if status == msg.INVALID_ID {
+			s.cfg().Logger.Warn("Client identity is already connected", logging.F("client", sc.id()), logging.F("identity", cid))
+		}
+		return 0, nil
+	}
+	var backlog []msg.RelayIndication
+	if s.cfg().MessageStore != nil {
+		if has_session {
+			// Take over the disconnected session, and everything stored for it
+			sess.offline_since = time.Time{}
+			backlog = s.takeBacklog(cid)
+		} else {
+			s.sessions[cid] = s.sessions[prev_cid]
+		}
+		delete(s.sessions, prev_cid)
+	}
+	s.sessions_mutex.Unlock()
+
+	s.abandonClientId(sc, prev_cid, cid)
+	s.cfg().Logger.Info("Client authenticated as identity", logging.F("client", prev_cid), logging.F("identity", cid))
+	return cid, backlog
+}
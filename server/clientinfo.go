@@ -0,0 +1,82 @@
+package server
+
+import (
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// ClientInfo describes a connected client, as returned by 'Server.ClientInfo' and 'Server.Clients'
+type ClientInfo struct {
+	// Current ID of the client
+	Id msg.ClientId
+	// Name the client registered, if any
+	Name string
+	// Namespace the client authenticated into, or empty for the default namespace
+	Namespace string
+	// Address of the other end of the client's connection
+	RemoteAddr net.Addr
+	// When the client connected
+	Connected time.Time
+	// Codec the client is using. Until its first message has been received, this is the first of the
+	// ServerConfig.AllowedCodecs if only one is allowed, and CodecCBOR otherwise.
+	Codec msg.Codec
+	// Bytes received from and sent to the client
+	BytesIn  uint64
+	BytesOut uint64
+	// Relays and messages from the hub itself waiting to be sent to the client
+	Buffered int
+}
+
+// ClientInfo gets information about a connected client, so embedders can build their own dashboards.
+// 'ok' is false if there is no client connected with that ID.
+func (s *Server) ClientInfo(cid msg.ClientId) (info ClientInfo, ok bool) {
+	s.clients_mutex.RLock()
+	sc, ok := s.clients[cid]
+	s.clients_mutex.RUnlock()
+	if !ok {
+		return ClientInfo{}, false
+	}
+	list := []ClientInfo{sc.info(cid)}
+	s.addInfoNames(list)
+	return list[0], true
+}
+
+// Clients gets information about every connected client, in order of their IDs
+func (s *Server) Clients() []ClientInfo {
+	s.clients_mutex.RLock()
+	list := make([]ClientInfo, 0, len(s.clients))
+	for cid, sc := range s.clients {
+		list = append(list, sc.info(cid))
+	}
+	s.clients_mutex.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	s.addInfoNames(list)
+	return list
+}
+
+// Fill in the name of each client
+func (s *Server) addInfoNames(list []ClientInfo) {
+	s.names_mutex.RLock()
+	for i := range list {
+		list[i].Name = s.client_names[list[i].Id].name
+	}
+	s.names_mutex.RUnlock()
+}
+
+// Get the public view of the client
+func (sc *serverClient) info(cid msg.ClientId) ClientInfo {
+	return ClientInfo{
+		Id:         cid,
+		Namespace:  sc.ns(),
+		RemoteAddr: sc.con.RemoteAddr(),
+		Connected:  sc.connected,
+		Codec:      msg.Codec(atomic.LoadInt32(sc.codec)),
+		BytesIn:    atomic.LoadUint64(sc.bytes_in),
+		BytesOut:   atomic.LoadUint64(sc.bytes_out),
+		Buffered:   sc.relayMsgs.len() + len(sc.controlMsgs),
+	}
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+
+	"github.com/CiaranWoodward/broadcast_hub/logging"
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// Largest write buffer returned to the pool, so one huge burst doesn't keep its memory around forever
+const maxPooledWriteBuffer = 64 * 1024
+
+// Buffers for encoding messages into, shared between clients so idle ones don't hold on to any memory
+var writeBuffers = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+// Encoded messages waiting to be written to a client together, so a burst of them takes fewer writes to the connection.
+// Only used by the client's sender goroutine.
+type writeBuffer struct {
+	// Taken from the pool for the first message, and returned once it has been written
+	buf   *bytes.Buffer
+	count int
+	// Transcoder for the client's codec, reused for every message
+	codec msg.Codec
+	tc    msg.Transcoder
+}
+
+// Encode a message into the client's write buffer, writing the buffer out once it holds more than WriteBufferSize
+// bytes or FlushAfter messages. With a WriteBufferSize of zero, every message is written straight away.
+// Relay Indications are encoded from the shared relay, rather than 'm'.
+func (s *Server) bufferMessage(sc *serverClient, wb *writeBuffer, m msg.Message, relay *msg.SharedRelay) msg.Status {
+	codec := msg.Codec(atomic.LoadInt32(sc.codec))
+	if wb.tc == nil || wb.codec != codec {
+		wb.codec, wb.tc = codec, codec.Transcoder()
+	}
+	if wb.buf == nil {
+		wb.buf = writeBuffers.Get().(*bytes.Buffer)
+	}
+	start := wb.buf.Len()
+	var err error
+	if relay != nil {
+		err = relay.EncodeTo(wb.buf, codec, m.Version, m.MessageId)
+	} else {
+		err = wb.tc.EncodeTo(wb.buf, m)
+	}
+	if err != nil {
+		wb.buf.Truncate(start)
+		s.cfg().Logger.Error("Failed to encode message", logging.F("client", sc.id()), logging.F("mid", m.MessageId), logging.F("err", err))
+		return msg.ENCODING_ERROR
+	}
+	wb.count++
+	if wb.buf.Len() > s.cfg().WriteBufferSize || wb.count >= s.cfg().FlushAfter {
+		return s.flushMessages(sc, wb)
+	}
+	return msg.SUCCESS
+}
+
+// Write everything in the client's write buffer to the connection, and give the buffer back to the pool
+func (s *Server) flushMessages(sc *serverClient, wb *writeBuffer) msg.Status {
+	if wb.buf == nil {
+		return msg.SUCCESS
+	}
+	status := msg.SUCCESS
+	if wb.buf.Len() > 0 {
+		status = s.writeMessage(sc, wb.buf.Bytes())
+	}
+	wb.buf.Reset()
+	if wb.buf.Cap() <= maxPooledWriteBuffer {
+		writeBuffers.Put(wb.buf)
+	}
+	wb.buf = nil
+	wb.count = 0
+	return status
+}
+
+// Check whether the client's sender has anything else ready to send
+func (sc *serverClient) hasQueued() bool {
+	return len(sc.responseMsgs) > 0 || len(sc.controlMsgs) > 0 || sc.relayMsgs.len() > 0
+}
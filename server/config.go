@@ -0,0 +1,304 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/CiaranWoodward/broadcast_hub/logging"
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+	"github.com/CiaranWoodward/broadcast_hub/tracing"
+)
+
+// OverflowPolicy determines what happens to a relay when the destination client's buffer is full
+type OverflowPolicy int
+
+const (
+	// Reject the relay for that destination, reporting NO_BUFFER to the sender
+	OverflowReject OverflowPolicy = iota
+	// Discard the oldest buffered relay to make room for the new one
+	OverflowDropOldest
+	// Wait up to ServerConfig.BlockTimeout for buffer space, then reject with NO_BUFFER.
+	// The timeout applies to the relay request as a whole, not to each destination.
+	OverflowBlock
+)
+
+// Default values, used for any ServerConfig fields left as zero
+const (
+	defaultRelayBufferSize   = 3
+	defaultBlockTimeout      = 100 * time.Millisecond
+	defaultPingMissThreshold = 3
+	defaultAuthTimeout       = 10 * time.Second
+	defaultSessionTimeout    = 5 * time.Minute
+	defaultRelayRateBurst    = 10
+	defaultRetryQueueSize    = 16
+	defaultRetryTimeout      = 5 * time.Second
+	defaultSlowWriteLimit    = 3
+	defaultRequestWorkers    = 1
+	defaultMaxPending        = 32
+	defaultFanOutWorkers     = 1
+	defaultFlushAfter        = 16
+	defaultDedupWindow       = time.Minute
+	defaultDedupSize         = 65536
+)
+
+// ServerConfig holds the tunable parameters of a Server.
+// The zero value is valid, and any fields left as zero are replaced with their defaults.
+// Its Limits can be changed while the server is running, with 'Server.UpdateConfig'.
+type ServerConfig struct {
+	// Maximum buffered relay messages per destination client, for each relay priority
+	RelayBufferSize int
+	// What to do with relays when a destination client's buffer is full
+	OverflowPolicy OverflowPolicy
+	// How long the OverflowBlock policy waits for buffer space
+	BlockTimeout time.Duration
+	// Longest a relay can wait in a destination's buffer to be written. Relays still waiting after this are skipped, as
+	// with relays past their TTL, so clients that fall behind aren't sent stale data. Zero waits forever.
+	RelayDeadline time.Duration
+	// Interval between keepalive pings sent to each client. Zero disables keepalive.
+	PingInterval time.Duration
+	// Number of consecutive ping intervals without hearing anything from a client, before it is disconnected as INACTIVE
+	PingMissThreshold int
+	// How long a client can go without sending anything or being sent any relays, before it is disconnected as INACTIVE.
+	// With keepalive enabled, an idle client is pinged first, and kept if it answers within another IdleTimeout.
+	// Zero never disconnects idle clients.
+	IdleTimeout time.Duration
+	// Deadline for each write to a client's connection. Zero disables write deadlines, so a client that stops reading
+	// blocks its sender forever.
+	WriteTimeout time.Duration
+	// Number of consecutive writes to a client that can time out, before it is disconnected as a SLOW_CONSUMER
+	SlowWriteLimit int
+	// Bytes of messages to each client that can be buffered, and written to the connection together once the buffer holds
+	// more than this. Messages are only buffered while more are waiting to be sent, which cuts the number of writes for
+	// bursts of small messages. Zero writes each message separately.
+	WriteBufferSize int
+	// Most messages buffered for a client before they are written, with WriteBufferSize set
+	FlushAfter int
+	// Number of requests from each client that are handled concurrently. With one, each client's requests are handled
+	// in order, and a slow request delays the rest. With more, requests may complete in a different order to how they
+	// were sent, although requests setting up the connection (and pings) are still handled in order.
+	RequestWorkers int
+	// Maximum requests from each client waiting for, or being handled by, a request worker. Any more are rejected with
+	// BUSY. Only used with more than one RequestWorker, and never less than RequestWorkers.
+	MaxPendingRequests int
+	// Number of goroutines sharing the delivery of each relay with many destinations. With one, destinations are handled
+	// one after another by the goroutine handling the request.
+	FanOutWorkers int
+	// Maximum clients connected at once. Any more are sent a Server Full Indication and disconnected. Zero is unlimited.
+	MaxTotalClients int
+	// Maximum clients connected at once from the same IP address, as with MaxTotalClients. Zero is unlimited.
+	// Clients without an IP address, such as those connected over Unix domain sockets, aren't limited.
+	MaxConnsPerIP int
+	// Verifies client credentials. If set, clients must authenticate before doing anything except identify themselves.
+	// Nil allows all clients without authentication.
+	Authenticator Authenticator
+	// Verifies the credentials of admin clients. If set, only clients that authenticate with credentials it accepts
+	// may make administrative requests, such as Stats Requests, and others are answered with FORBIDDEN.
+	// Nil allows any client to make them.
+	AdminAuthenticator Authenticator
+	// How long clients have to authenticate before they are disconnected, if an Authenticator is set
+	AuthTimeout time.Duration
+	// Chooses the namespace each client joins when it authenticates. Clients can only see and relay to clients in their
+	// own namespace. Nil keeps every client in the default namespace.
+	Namespacer Namespacer
+	// Stores relays sent to clients while they are disconnected, so they can be delivered when the client resumes
+	// its session. Nil disables sessions, and relays to disconnected clients fail with INVALID_ID.
+	MessageStore MessageStore
+	// How long a disconnected client's session can be resumed, if a MessageStore is set
+	SessionTimeout time.Duration
+	// Limit on the bytes of relays each client can send in a day, or a rolling window. Unlimited if Bytes is zero.
+	ByteQuota ByteQuota
+	// Initial limit on how quickly each client can send relays. It can be changed later with 'Server.SetRelayRateLimit'
+	// or 'Server.UpdateConfig'.
+	RelayRateLimit RateLimit
+	// Callbacks for client and relay events
+	Hooks Hooks
+	// Content policy for relays, checked in order before each relay is sent on. The first filter to reject a relay
+	// rejects the whole relay with FILTERED. Empty allows every relay.
+	RelayFilters []RelayFilter
+	// Maximum Reliable relays waiting to be retried per destination client, once its relay buffer is full
+	RetryQueueSize int
+	// How long Reliable relays are retried for, before the failure is reported to the sender
+	RetryTimeout time.Duration
+	// Whether clients listing the other clients may see their name, connection time and address category.
+	// Addresses are only ever shared as a category, such as "private" or "public".
+	ShareClientMetadata bool
+	// Number of recent relays kept for each topic, and for each client (of those sent directly to it), so clients can
+	// fetch relays they missed with a History Request. Zero disables the history.
+	HistorySize int
+	// How long relays are kept in the history. Zero keeps them until they are replaced by newer relays, or until the
+	// client's session ends.
+	HistoryTTL time.Duration
+	// Whether clients may relay to themselves, for echo-style testing. Otherwise, a client listed as a destination of its
+	// own relay is rejected with SELF_RELAY, unless the relay has the Loopback flag.
+	AllowLoopback bool
+	// How long the MsgUUID of each relay is remembered. A relay with the same MsgUUID from the same client within the
+	// window is a duplicate (such as a retry after a timeout), so isn't relayed again, but answered as the original was.
+	DedupWindow time.Duration
+	// Maximum MsgUUIDs remembered across all clients. Once there are this many, the oldest are forgotten early.
+	DedupSize int
+	// Codecs that clients may use. Empty allows only CBOR.
+	// If several are allowed, each client's codec is detected from its first message, and nothing is sent to the client
+	// until then. Clients using a codec that isn't allowed are disconnected.
+	AllowedCodecs []msg.Codec
+	// Limits on the size of each client's messages, enforced while they are decoded. Zero fields use the value from
+	// msg.DefaultDecodeLimits. A message over MaxMessageSize disconnects the client, but relays breaking the other
+	// limits are rejected with TOO_LONG. Relays are always limited to 255 destinations and 1024 bytes, so MaxDests and
+	// MaxMsgLength can only be lowered.
+	DecodeLimits msg.DecodeLimits
+	// Chooses the ClientId of each client. Nil allocates them in sequence, starting from 1, or randomly with a Backplane.
+	ClientIdAllocator ClientIdAllocator
+	// Forwards relays to clients connected to other servers sharing the backplane. Nil only relays to this server's
+	// clients. The servers must allocate ClientIds that are unique across all of them.
+	Backplane Backplane
+	// Where the server's logs are written. Nil writes Info and above to the standard library's default logger.
+	Logger logging.Logger
+	// Records spans around the dispatch of each message and the fan-out of each relay, as children of the trace
+	// context carried by the message. Nil records nothing.
+	Tracer tracing.Tracer
+	// Records every relay request, with its source, destinations, size and the status of each destination, for
+	// deployments with compliance requirements. Nil keeps no audit log.
+	Audit AuditSink
+	// Also records the message of each relay in the audit log
+	AuditPayloads bool
+}
+
+// Get a ServerConfig with all fields set to their default values
+func DefaultServerConfig() ServerConfig {
+	return ServerConfig{
+		RelayBufferSize: defaultRelayBufferSize,
+		OverflowPolicy:  OverflowReject,
+		BlockTimeout:    defaultBlockTimeout,
+
+		PingMissThreshold: defaultPingMissThreshold,
+		SlowWriteLimit:    defaultSlowWriteLimit,
+		FlushAfter:        defaultFlushAfter,
+		AuthTimeout:       defaultAuthTimeout,
+		SessionTimeout:    defaultSessionTimeout,
+		RelayRateLimit:    RateLimit{Burst: defaultRelayRateBurst},
+		RetryQueueSize:    defaultRetryQueueSize,
+		RetryTimeout:      defaultRetryTimeout,
+		DedupWindow:       defaultDedupWindow,
+		DedupSize:         defaultDedupSize,
+		AllowedCodecs:     []msg.Codec{msg.CodecCBOR},
+		DecodeLimits:      msg.DefaultDecodeLimits(),
+		Logger:            logging.Default(),
+		Tracer:            tracing.Nop,
+		ClientIdAllocator: &SequentialAllocator{},
+
+		RequestWorkers:     defaultRequestWorkers,
+		MaxPendingRequests: defaultMaxPending,
+		FanOutWorkers:      defaultFanOutWorkers,
+	}
+}
+
+// Replace any unset fields with their defaults
+func (cfg ServerConfig) withDefaults() ServerConfig {
+	if cfg.RelayBufferSize <= 0 {
+		cfg.RelayBufferSize = defaultRelayBufferSize
+	}
+	if cfg.BlockTimeout <= 0 {
+		cfg.BlockTimeout = defaultBlockTimeout
+	}
+	if cfg.PingMissThreshold <= 0 {
+		cfg.PingMissThreshold = defaultPingMissThreshold
+	}
+	if cfg.SlowWriteLimit <= 0 {
+		cfg.SlowWriteLimit = defaultSlowWriteLimit
+	}
+	if cfg.FlushAfter <= 0 {
+		cfg.FlushAfter = defaultFlushAfter
+	}
+	if cfg.RequestWorkers <= 0 {
+		cfg.RequestWorkers = defaultRequestWorkers
+	}
+	if cfg.MaxPendingRequests <= 0 {
+		cfg.MaxPendingRequests = defaultMaxPending
+	}
+	if cfg.MaxPendingRequests < cfg.RequestWorkers {
+		cfg.MaxPendingRequests = cfg.RequestWorkers
+	}
+	if cfg.FanOutWorkers <= 0 {
+		cfg.FanOutWorkers = defaultFanOutWorkers
+	}
+	if cfg.AuthTimeout <= 0 {
+		cfg.AuthTimeout = defaultAuthTimeout
+	}
+	if cfg.SessionTimeout <= 0 {
+		cfg.SessionTimeout = defaultSessionTimeout
+	}
+	if cfg.RelayRateLimit.Burst <= 0 {
+		cfg.RelayRateLimit.Burst = defaultRelayRateBurst
+	}
+	if cfg.RetryQueueSize <= 0 {
+		cfg.RetryQueueSize = defaultRetryQueueSize
+	}
+	if cfg.RetryTimeout <= 0 {
+		cfg.RetryTimeout = defaultRetryTimeout
+	}
+	if cfg.DedupWindow <= 0 {
+		cfg.DedupWindow = defaultDedupWindow
+	}
+	if cfg.DedupSize <= 0 {
+		cfg.DedupSize = defaultDedupSize
+	}
+	if len(cfg.AllowedCodecs) == 0 {
+		cfg.AllowedCodecs = []msg.Codec{msg.CodecCBOR}
+	}
+	defaultLimits := msg.DefaultDecodeLimits()
+	if cfg.DecodeLimits.MaxMessageSize <= 0 {
+		cfg.DecodeLimits.MaxMessageSize = defaultLimits.MaxMessageSize
+	}
+	if cfg.DecodeLimits.MaxDests <= 0 {
+		cfg.DecodeLimits.MaxDests = defaultLimits.MaxDests
+	}
+	if cfg.DecodeLimits.MaxMsgLength <= 0 {
+		cfg.DecodeLimits.MaxMsgLength = defaultLimits.MaxMsgLength
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = logging.Default()
+	}
+	if cfg.Tracer == nil {
+		cfg.Tracer = tracing.Nop
+	}
+	if cfg.ClientIdAllocator == nil {
+		if cfg.Backplane != nil {
+			cfg.ClientIdAllocator = RandomAllocator{}
+		} else {
+			cfg.ClientIdAllocator = &SequentialAllocator{}
+		}
+	}
+	return cfg
+}
+
+// Check whether clients may use the codec
+func (cfg ServerConfig) allowsCodec(codec msg.Codec) bool {
+	for _, c := range cfg.AllowedCodecs {
+		if c == codec {
+			return true
+		}
+	}
+	return false
+}
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowReject:
+		return "reject"
+	case OverflowDropOldest:
+		return "drop-oldest"
+	case OverflowBlock:
+		return "block"
+	default:
+		return fmt.Sprintf("[Unknown OverflowPolicy: %d]", int(p))
+	}
+}
+
+// ParseOverflowPolicy gets the OverflowPolicy with the given name, as returned by 'OverflowPolicy.String'
+func ParseOverflowPolicy(name string) (p OverflowPolicy, ok bool) {
+	for _, p := range []OverflowPolicy{OverflowReject, OverflowDropOldest, OverflowBlock} {
+		if p.String() == name {
+			return p, true
+		}
+	}
+	return OverflowReject, false
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"time"
+
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// Maximum length of the MsgUUID of a relay
+const maxMsgUUIDLength = 64
+
+// Identifies a relay by its sender, and the MsgUUID the sender gave it
+type dedupKey struct {
+	cid  msg.ClientId
+	uuid string
+}
+
+// A relay remembered by its MsgUUID, and how the hub responded to it
+type dedupEntry struct {
+	key  dedupKey
+	seen time.Time
+	// Closed once the relay has been handled, and 'rsp' is set
+	done chan struct{}
+	rsp  msg.RelayResponse
+}
+
+// Claim the MsgUUID of a relay for its sender, unless it has already been seen within the DedupWindow.
+// Returns the entry to complete once the relay has been handled, or the entry of the original relay if this one is
+// a duplicate. Both are nil if the relay doesn't have a MsgUUID.
+func (s *Server) claimRelay(cid msg.ClientId, uuid string) (claimed, original *dedupEntry) {
+	if uuid == "" {
+		return nil, nil
+	}
+	key := dedupKey{cid: cid, uuid: uuid}
+	now := time.Now()
+	s.dedup_mutex.Lock()
+	defer s.dedup_mutex.Unlock()
+
+	// Forget relays older than the window, and the oldest if there are too many
+	for len(s.dedup_order) > 0 {
+		oldest := s.dedup_order[0]
+		if now.Sub(oldest.seen) <= s.cfg().DedupWindow && len(s.dedup_order) < s.cfg().DedupSize {
+			break
+		}
+		if s.dedup[oldest.key] == oldest {
+			delete(s.dedup, oldest.key)
+		}
+		s.dedup_order[0] = nil
+		s.dedup_order = s.dedup_order[1:]
+	}
+
+	if original, ok := s.dedup[key]; ok {
+		return nil, original
+	}
+	claimed = &dedupEntry{key: key, seen: now, done: make(chan struct{})}
+	s.dedup[key] = claimed
+	s.dedup_order = append(s.dedup_order, claimed)
+	return claimed, nil
+}
+
+// Record how the hub responded to a relay with a MsgUUID, for any duplicates of it. Does nothing for a nil entry.
+func (s *Server) completeRelay(claimed *dedupEntry, rsp *msg.RelayResponse) {
+	if claimed == nil {
+		return
+	}
+	claimed.rsp = *rsp
+	close(claimed.done)
+}
+
+// Get the response to the original relay, once it has been handled
+func (e *dedupEntry) response() msg.RelayResponse {
+	<-e.done
+	return e.rsp
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"net"
+	"sync/atomic"
+
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// Number of events buffered for the application, after which further events are dropped
+const eventBufferSize = 256
+
+// Event is something which happened on the server, received from the channel returned by 'Server.Events'.
+// It is one of ClientConnected, ClientDisconnected or RelayBlocked.
+type Event interface {
+	isEvent()
+}
+
+// ClientConnected is sent when a new client connects, before any of its requests are handled
+type ClientConnected struct {
+	// ID the client was given
+	CID msg.ClientId
+	// Address of the other end of the client's connection
+	RemoteAddr net.Addr
+}
+
+// ClientDisconnected is sent once a client has disconnected, and been removed from the server
+type ClientDisconnected struct {
+	// Current ID of the client (which may have changed since it connected, if it resumed a session)
+	CID msg.ClientId
+	// Why the client disconnected: CONNECTION_ERROR if it hung up or the connection failed, ENCODING_ERROR if it sent
+	// something that couldn't be decoded, INACTIVE or SLOW_CONSUMER if it was evicted, UNAUTHENTICATED if it didn't
+	// authenticate in time, GOING_AWAY if the server was shut down, or the reason given to 'DisconnectClient'.
+	Reason msg.Status
+}
+
+// RelayBlocked is sent when a relay couldn't be sent to a connected destination because its buffer was full
+// (and its retry queue too, for a Reliable relay), so the destination is reported as NO_BUFFER
+type RelayBlocked struct {
+	// ClientId the relay couldn't be sent to
+	Dest msg.ClientId
+}
+
+func (ClientConnected) isEvent()    {}
+func (ClientDisconnected) isEvent() {}
+func (RelayBlocked) isEvent()       {}
+
+// Events gets a channel of the events happening on the server, so that monitoring can observe the hub without
+// setting Hooks. Events are only recorded once this has been called, and every call returns the same channel.
+//
+// Events are sent without blocking, so the hub is never held up by the application. If the application falls behind
+// and the channel's buffer fills up, further events are dropped until there is room, and counted by 'DroppedEvents'.
+// The channel isn't closed when the server is.
+func (s *Server) Events() <-chan Event {
+	s.events_once.Do(func() {
+		events := make(chan Event, eventBufferSize)
+		s.events.Store(&events)
+	})
+	return *s.events.Load()
+}
+
+// DroppedEvents gets the number of events that were dropped because the application wasn't reading them quickly enough
+func (s *Server) DroppedEvents() uint64 {
+	return atomic.LoadUint64(&s.dropped_events)
+}
+
+// Send an event to the application, if it's listening
+func (s *Server) emit(ev Event) {
+	events := s.events.Load()
+	if events == nil {
+		return
+	}
+	select {
+	case *events <- ev:
+	default:
+		atomic.AddUint64(&s.dropped_events, 1)
+	}
+}
+
+// Record why the client is being disconnected, unless a reason has already been given
+func (sc *serverClient) setDisconnectReason(reason msg.Status) {
+	atomic.CompareAndSwapInt32(sc.disconnect_reason, int32(msg.SUCCESS), int32(reason))
+}
+
+// Get why the client was disconnected. Without any other reason, the connection must have been closed or failed.
+func (sc *serverClient) disconnectReason() msg.Status {
+	if reason := msg.Status(atomic.LoadInt32(sc.disconnect_reason)); reason != msg.SUCCESS {
+		return reason
+	}
+	return msg.CONNECTION_ERROR
+}
+
+// Disconnect the client, for the given reason
+func (sc *serverClient) disconnect(reason msg.Status) {
+	sc.setDisconnectReason(reason)
+	sc.con.Close()
+}
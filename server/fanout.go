@@ -0,0 +1,104 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// Fewest destinations handled by each fan-out worker, so small relays aren't split up when it costs more than it saves
+const fanOutShardSize = 32
+
+// A destination of a relay, and the queues of the client it was connected as when the relay was sent
+type relayTarget struct {
+	cid       msg.ClientId
+	connected bool
+	relayMsgs relayQueues
+	retries   chan pendingRelay
+	credits   *int64
+	// Namespace of the relay's sender, and whether the destination is connected in a different one
+	namespace string
+	foreign   bool
+}
+
+// Look up every destination of a relay from a client in namespace 'ns', under one read lock
+func (s *Server) lookupTargets(dests []msg.ClientId, ns string) []relayTarget {
+	targets := make([]relayTarget, len(dests))
+	s.clients_mutex.RLock()
+	for i, cid := range dests {
+		targets[i].cid = cid
+		targets[i].namespace = ns
+		if dest_client, ok := s.clients[cid]; ok && (dest_client.ns() != ns || s.isHidden(&dest_client)) {
+			targets[i].foreign = true
+		} else if ok {
+			targets[i].connected = true
+			targets[i].relayMsgs = dest_client.relayMsgs
+			targets[i].retries = dest_client.retries
+			targets[i].credits = dest_client.credits
+		}
+	}
+	s.clients_mutex.RUnlock()
+	return targets
+}
+
+// Split the destinations of a relay into shards, and deliver each shard on its own goroutine.
+// With FanOutWorkers set to one, or too few destinations to be worth splitting, they are delivered inline.
+// Each destination is only ever handled by one shard, so relays to it stay in order.
+func (s *Server) fanOut(targets []relayTarget, statuses []msg.Status, ind *msg.SharedRelay, retry *relayRetry, deadline time.Time) {
+	shards := min(s.cfg().FanOutWorkers, len(targets)/fanOutShardSize)
+	if shards <= 1 {
+		s.deliverRelays(targets, statuses, ind, retry, deadline)
+		return
+	}
+	size := (len(targets) + shards - 1) / shards
+	var wg sync.WaitGroup
+	for start := 0; start < len(targets); start += size {
+		end := min(start+size, len(targets))
+		wg.Add(1)
+		go func(targets []relayTarget, statuses []msg.Status) {
+			defer wg.Done()
+			s.deliverRelays(targets, statuses, ind, retry, deadline)
+		}(targets[start:end], statuses[start:end])
+	}
+	wg.Wait()
+}
+
+// Deliver a relay to each target, recording the status for each of them.
+// Connected targets all share the relay, so it's only encoded once for each codec.
+func (s *Server) deliverRelays(targets []relayTarget, statuses []msg.Status, ind *msg.SharedRelay, retry *relayRetry, deadline time.Time) {
+	for i, t := range targets {
+		if t.foreign {
+			// Clients in other namespaces (or not yet in any) can't be relayed to, or even seen
+			statuses[i] = msg.INVALID_ID
+			continue
+		}
+		if !t.connected {
+			// The client may be connected to another server (which only links the default namespace)
+			if t.namespace == "" && s.forwardRelay(t.cid, ind.Ind) {
+				statuses[i] = msg.SUCCESS
+				continue
+			}
+			// The client may be able to resume its session later
+			statuses[i] = s.storeRelay(t.cid, t.namespace, ind.Ind)
+			if statuses[i] != msg.INVALID_ID && ind.Ind.Topic == "" {
+				s.recordHistory(historyKey{cid: t.cid}, ind.Ind)
+			}
+			continue
+		}
+		// Topic relays are kept in the topic's history instead
+		if ind.Ind.Topic == "" {
+			s.recordHistory(historyKey{cid: t.cid}, ind.Ind)
+		}
+
+		// SUCCESS only means the relay was queued; the client receives it soon unless it disconnects first. Senders
+		// wanting more can request a Delivery Indication, or set Reliable to have full buffers retried.
+		statuses[i] = s.enqueueRelay(t.relayMsgs.queue(ind.Ind.Priority), t.credits, ind, deadline)
+		if statuses[i] == msg.NO_BUFFER && retry != nil {
+			statuses[i] = queueRetry(t.retries, ind, retry)
+		}
+		if statuses[i] == msg.NO_BUFFER {
+			s.emit(RelayBlocked{Dest: t.cid})
+		}
+	}
+}
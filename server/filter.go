@@ -0,0 +1,125 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"sync/atomic"
+
+	"github.com/CiaranWoodward/broadcast_hub/logging"
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// SenderClass is the kind of client sending a relay, so RelayFilters can apply different policies to each
+type SenderClass int
+
+const (
+	// Clients of a server that doesn't require authentication
+	SenderAnonymous SenderClass = iota
+	// Clients that have authenticated with the server's Authenticator
+	SenderAuthenticated
+	// Clients that have authenticated with credentials accepted by the server's AdminAuthenticator
+	SenderAdmin
+)
+
+func (c SenderClass) String() string {
+	switch c {
+	case SenderAnonymous:
+		return "anonymous"
+	case SenderAuthenticated:
+		return "authenticated"
+	case SenderAdmin:
+		return "admin"
+	default:
+		return fmt.Sprintf("[Unknown SenderClass: %d]", int(c))
+	}
+}
+
+// RelaySender describes the client sending a relay, for RelayFilters
+type RelaySender struct {
+	ClientMeta
+	Class SenderClass
+}
+
+// RelayFilter checks a relay against a content policy, before it is sent on to any destinations.
+// Returning an error rejects the whole relay with FILTERED. It may be called concurrently for different clients,
+// and must not modify the request.
+type RelayFilter interface {
+	FilterRelay(src RelaySender, req *msg.RelayRequest) error
+}
+
+// RelayFilterFunc allows an ordinary function to be used as a RelayFilter
+type RelayFilterFunc func(src RelaySender, req *msg.RelayRequest) error
+
+// FilterRelay calls f(src, req)
+func (f RelayFilterFunc) FilterRelay(src RelaySender, req *msg.RelayRequest) error {
+	return f(src, req)
+}
+
+// SizeLimitFilter rejects relays whose message is longer than the limit (in bytes) for the sender's class.
+// Senders of classes without a limit aren't limited, beyond the protocol's own limit.
+type SizeLimitFilter map[SenderClass]int
+
+// FilterRelay checks the length of the relay's message
+func (f SizeLimitFilter) FilterRelay(src RelaySender, req *msg.RelayRequest) error {
+	if limit, ok := f[src.Class]; ok && len(req.Msg) > limit {
+		return fmt.Errorf("message of %d bytes is over the limit of %d for %s senders", len(req.Msg), limit, src.Class)
+	}
+	return nil
+}
+
+// ContentTypeFilter only allows relays with one of the listed content types.
+// Relays without a content type are only allowed if the list includes "".
+type ContentTypeFilter []string
+
+// FilterRelay checks the relay's content type against the list
+func (f ContentTypeFilter) FilterRelay(src RelaySender, req *msg.RelayRequest) error {
+	for _, ct := range f {
+		if req.ContentType == ct {
+			return nil
+		}
+	}
+	return fmt.Errorf("content type %q is not allowed", req.ContentType)
+}
+
+// PatternFilter rejects relays whose message matches a regular expression
+type PatternFilter struct {
+	Pattern *regexp.Regexp
+}
+
+// FilterRelay checks the relay's message against the pattern
+func (f PatternFilter) FilterRelay(src RelaySender, req *msg.RelayRequest) error {
+	if f.Pattern.Match(req.Msg) {
+		return fmt.Errorf("message matches %s", f.Pattern)
+	}
+	return nil
+}
+
+// Get the class of the client, for RelayFilters
+func (s *Server) senderClass(sc *serverClient) SenderClass {
+	switch {
+	case atomic.LoadInt32(sc.admin) != 0:
+		return SenderAdmin
+	case s.cfg().Authenticator != nil:
+		// Clients can't relay anything until they have authenticated
+		return SenderAuthenticated
+	default:
+		return SenderAnonymous
+	}
+}
+
+// Check a relay against each of the RelayFilters in turn, calling OnRelayDenied if one rejects it.
+// Returns FILTERED if the relay was rejected, or SUCCESS if it may be sent.
+func (s *Server) filterRelay(sc *serverClient, mesg *msg.Message) msg.Status {
+	if len(s.cfg().RelayFilters) == 0 {
+		return msg.SUCCESS
+	}
+	src := RelaySender{ClientMeta: sc.meta(), Class: s.senderClass(sc)}
+	for _, f := range s.cfg().RelayFilters {
+		if err := f.FilterRelay(src, mesg.RelayReq); err != nil {
+			s.cfg().Logger.Debug("Filtered relay", logging.F("client", src.Id), logging.F("err", err))
+			s.hookRelayDenied(sc, mesg, msg.FILTERED, err)
+			return msg.FILTERED
+		}
+	}
+	return msg.SUCCESS
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"math"
+	"sync/atomic"
+
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// Credits of a client which hasn't sent a Flow Update, so is sent relays without limit
+const noFlowControl = math.MinInt64
+
+// Handle an incoming Flow Update Message, by adding the credits granted to the client's.
+// The first Flow Update turns on flow control for the client, starting from the credits it grants.
+func handleFlowUpdate(sc *serverClient, mesg *msg.Message) {
+	grant := int64(mesg.FlowUpd.Credits)
+	for {
+		credits := atomic.LoadInt64(sc.credits)
+		updated := credits + grant
+		if credits == noFlowControl {
+			updated = grant
+		}
+		if atomic.CompareAndSwapInt64(sc.credits, credits, updated) {
+			return
+		}
+	}
+}
+
+// Use up one of a client's credits for a relay. Returns false if the client is flow controlled and has none left.
+// A nil 'credits' is never flow controlled.
+func takeCredit(credits *int64) bool {
+	if credits == nil {
+		return true
+	}
+	for {
+		c := atomic.LoadInt64(credits)
+		if c == noFlowControl {
+			return true
+		}
+		if c <= 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(credits, c, c-1) {
+			return true
+		}
+	}
+}
+
+// Use up one of a client's credits for a relay which has to be sent regardless, such as one stored for its session.
+// This can leave the client owing credits, which its next Flow Update pays off first.
+func spendCredit(credits *int64) {
+	for {
+		c := atomic.LoadInt64(credits)
+		if c == noFlowControl || atomic.CompareAndSwapInt64(credits, c, c-1) {
+			return
+		}
+	}
+}
+
+// Give back a credit used up by a relay which was never sent to the client
+func returnCredit(credits *int64) {
+	if credits == nil {
+		return
+	}
+	for {
+		c := atomic.LoadInt64(credits)
+		if c == noFlowControl || atomic.CompareAndSwapInt64(credits, c, c+1) {
+			return
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"sort"
+
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// Maximum length of a group name, in bytes
+const maxGroupLength = 255
+
+// Set of clients that are members of a single group
+type groupMembers map[msg.ClientId]struct{}
+
+// Handle an incoming Group Create Request Message
+func (s *Server) handleGroupCreateRequest(sc *serverClient, mesg *msg.Message, rsp *msg.Message) {
+	status := checkGroup(mesg.GrpCreateReq.Group)
+	if status == msg.SUCCESS {
+		status = s.createGroup(sc.id(), scopedName{sc.ns(), mesg.GrpCreateReq.Group})
+	}
+	rsp.GrpCreateRes = &msg.GroupCreateResponse{
+		Status: status,
+	}
+}
+
+// Handle an incoming Group Join Request Message
+func (s *Server) handleGroupJoinRequest(sc *serverClient, mesg *msg.Message, rsp *msg.Message) {
+	status := checkGroup(mesg.GrpJoinReq.Group)
+	if status == msg.SUCCESS {
+		status = s.joinGroup(sc.id(), scopedName{sc.ns(), mesg.GrpJoinReq.Group})
+	}
+	rsp.GrpJoinRes = &msg.GroupJoinResponse{
+		Status: status,
+	}
+}
+
+// Handle an incoming Group Leave Request Message
+func (s *Server) handleGroupLeaveRequest(sc *serverClient, mesg *msg.Message, rsp *msg.Message) {
+	status := checkGroup(mesg.GrpLeaveReq.Group)
+	if status == msg.SUCCESS {
+		status = s.leaveGroup(sc.id(), scopedName{sc.ns(), mesg.GrpLeaveReq.Group})
+	}
+	rsp.GrpLeaveRes = &msg.GroupLeaveResponse{
+		Status: status,
+	}
+}
+
+// Handle an incoming Group List Request Message
+func (s *Server) handleGroupListRequest(sc *serverClient, mesg *msg.Message, rsp *msg.Message) {
+	rsp.GrpListRes = &msg.GroupListResponse{}
+	if mesg.GrpListReq.Group == "" {
+		rsp.GrpListRes.Groups = s.getGroupNames(sc.ns())
+	} else if members, ok := s.getGroupMembers(scopedName{sc.ns(), mesg.GrpListReq.Group}, 0); ok {
+		// Client IDs start from 1, so nobody is removed from the list
+		rsp.GrpListRes.Members = members
+	} else {
+		rsp.GrpListRes.Status = msg.INVALID_ID
+	}
+}
+
+// Check that a group name is valid for use in the protocol
+func checkGroup(group string) msg.Status {
+	if group == "" {
+		return msg.INVALID_ID
+	}
+	if len(group) > maxGroupLength {
+		return msg.TOO_LONG
+	}
+	return msg.SUCCESS
+}
+
+// Create a new group, with the client as its only member
+func (s *Server) createGroup(cid msg.ClientId, group scopedName) msg.Status {
+	s.groups_mutex.Lock()
+	defer s.groups_mutex.Unlock()
+	if _, ok := s.groups[group]; ok {
+		return msg.NAME_IN_USE
+	}
+	s.groups[group] = groupMembers{cid: struct{}{}}
+	return msg.SUCCESS
+}
+
+// Add a client to an existing group (no-op if already a member)
+func (s *Server) joinGroup(cid msg.ClientId, group scopedName) msg.Status {
+	s.groups_mutex.Lock()
+	defer s.groups_mutex.Unlock()
+	members, ok := s.groups[group]
+	if !ok {
+		return msg.INVALID_ID
+	}
+	members[cid] = struct{}{}
+	return msg.SUCCESS
+}
+
+// Remove a client from a group, cleaning up the group if it is now empty
+func (s *Server) leaveGroup(cid msg.ClientId, group scopedName) msg.Status {
+	s.groups_mutex.Lock()
+	defer s.groups_mutex.Unlock()
+	members, ok := s.groups[group]
+	if !ok {
+		return msg.INVALID_ID
+	}
+	if _, ok := members[cid]; !ok {
+		return msg.INVALID_ID
+	}
+	delete(members, cid)
+	if len(members) == 0 {
+		delete(s.groups, group)
+	}
+	return msg.SUCCESS
+}
+
+// Remove a client from every group it is a member of
+func (s *Server) leaveAllGroups(cid msg.ClientId) {
+	s.groups_mutex.Lock()
+	for group, members := range s.groups {
+		delete(members, cid)
+		if len(members) == 0 {
+			delete(s.groups, group)
+		}
+	}
+	s.groups_mutex.Unlock()
+}
+
+// Get a sorted slice of the names of all groups in a namespace
+func (s *Server) getGroupNames(ns string) []string {
+	s.groups_mutex.RLock()
+	names := make([]string, 0, len(s.groups))
+	for group := range s.groups {
+		if group.ns == ns {
+			names = append(names, group.name)
+		}
+	}
+	s.groups_mutex.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+// Get a sorted slice of the members of a group, removing the ID of the caller.
+// 'ok' is false if the group doesn't exist.
+func (s *Server) getGroupMembers(group scopedName, except_cid msg.ClientId) (cids []msg.ClientId, ok bool) {
+	s.groups_mutex.RLock()
+	members, ok := s.groups[group]
+	cids = make([]msg.ClientId, 0, len(members))
+	for k := range members {
+		if k != except_cid {
+			cids = append(cids, k)
+		}
+	}
+	s.groups_mutex.RUnlock()
+	sort.Slice(cids, func(i, j int) bool { return cids[i] < cids[j] })
+	return cids, ok
+}
+
+// Get the destinations of a relay, adding the members of each destination group in namespace 'ns' to the destination
+// list. Members already in the list, and the caller, are only included once (or not at all, for the caller).
+func (s *Server) resolveDestGroups(dests []msg.ClientId, groups []string, ns string, except_cid msg.ClientId) ([]msg.ClientId, msg.Status) {
+	// Copy the list, so the request isn't modified
+	dests = append([]msg.ClientId(nil), dests...)
+	seen := make(map[msg.ClientId]struct{}, len(dests))
+	for _, cid := range dests {
+		seen[cid] = struct{}{}
+	}
+	seen[except_cid] = struct{}{}
+	for _, group := range groups {
+		if status := checkGroup(group); status != msg.SUCCESS {
+			return nil, status
+		}
+		members, ok := s.getGroupMembers(scopedName{ns, group}, except_cid)
+		if !ok {
+			return nil, msg.INVALID_ID
+		}
+		for _, cid := range members {
+			if _, ok := seen[cid]; !ok {
+				seen[cid] = struct{}{}
+				dests = append(dests, cid)
+			}
+		}
+	}
+	return dests, msg.SUCCESS
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"time"
+
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// Identifies a relay history: either a topic's (within a namespace), or a client's for relays sent directly to it
+type historyKey struct {
+	ns    string
+	topic string
+	cid   msg.ClientId
+}
+
+// A relay kept in a history, with when it was kept
+type historyEntry struct {
+	ind  msg.RelayIndication
+	kept time.Time
+}
+
+// Ring buffer of the most recent relays sent to a topic or client.
+// The oldest entry is at 'start', and the newest overwrites it once the buffer is full.
+type historyRing struct {
+	entries []historyEntry
+	start   int
+	count   int
+}
+
+// Handle an incoming History Request Message
+func (s *Server) handleHistoryRequest(sc *serverClient, mesg *msg.Message, rsp *msg.Message) {
+	rsp.HistRes = &msg.HistoryResponse{
+		Status: msg.SUCCESS,
+	}
+	req := mesg.HistReq
+	if s.cfg().HistorySize <= 0 {
+		rsp.HistRes.Status = msg.FORBIDDEN
+	} else if len(req.Topic) > maxTopicLength {
+		rsp.HistRes.Status = msg.TOO_LONG
+	} else if req.Topic != "" {
+		rsp.HistRes.Relays = s.getHistory(historyKey{ns: sc.ns(), topic: req.Topic}, req.Since, req.Limit)
+	} else {
+		rsp.HistRes.Relays = s.getHistory(historyKey{cid: sc.id()}, req.Since, req.Limit)
+	}
+}
+
+// Keep a relay in a history, if histories are enabled
+func (s *Server) recordHistory(key historyKey, ind msg.RelayIndication) {
+	if s.cfg().HistorySize <= 0 {
+		return
+	}
+	// The relay was only acknowledged as it was first delivered
+	ind.AckRequested = false
+	now := time.Now()
+	s.history_mutex.Lock()
+	defer s.history_mutex.Unlock()
+	ring, ok := s.history[key]
+	if !ok {
+		ring = &historyRing{entries: make([]historyEntry, s.cfg().HistorySize)}
+		s.history[key] = ring
+	}
+	ring.expire(now, s.cfg().HistoryTTL)
+	ring.add(historyEntry{ind: ind, kept: now})
+}
+
+// Get up to 'limit' of the newest relays in a history with a Timestamp after 'since', oldest first.
+// A zero limit gets every matching relay.
+func (s *Server) getHistory(key historyKey, since int64, limit uint32) []msg.RelayIndication {
+	s.history_mutex.Lock()
+	defer s.history_mutex.Unlock()
+	ring, ok := s.history[key]
+	if !ok {
+		return nil
+	}
+	if ring.expire(time.Now(), s.cfg().HistoryTTL) == 0 {
+		delete(s.history, key)
+		return nil
+	}
+	relays := ring.since(since)
+	if limit > 0 && len(relays) > int(limit) {
+		relays = relays[len(relays)-int(limit):]
+	}
+	return relays
+}
+
+// Forget the history of relays sent directly to a client
+func (s *Server) dropHistory(cid msg.ClientId) {
+	s.history_mutex.Lock()
+	delete(s.history, historyKey{cid: cid})
+	s.history_mutex.Unlock()
+}
+
+// Add an entry, overwriting the oldest if the ring is full
+func (r *historyRing) add(e historyEntry) {
+	size := len(r.entries)
+	r.entries[(r.start+r.count)%size] = e
+	if r.count < size {
+		r.count++
+	} else {
+		r.start = (r.start + 1) % size
+	}
+}
+
+// Discard entries kept longer than 'ttl' ago (none if it's zero). Returns the number of entries left.
+func (r *historyRing) expire(now time.Time, ttl time.Duration) int {
+	if ttl <= 0 {
+		return r.count
+	}
+	for r.count > 0 && now.Sub(r.entries[r.start].kept) > ttl {
+		r.entries[r.start] = historyEntry{}
+		r.start = (r.start + 1) % len(r.entries)
+		r.count--
+	}
+	return r.count
+}
+
+// Get the relays with a Timestamp after 'since', oldest first
+func (r *historyRing) since(since int64) []msg.RelayIndication {
+	relays := make([]msg.RelayIndication, 0, r.count)
+	for i := 0; i < r.count; i++ {
+		ind := r.entries[(r.start+i)%len(r.entries)].ind
+		if ind.Timestamp > since {
+			relays = append(relays, ind)
+		}
+	}
+	return relays
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"net"
+	"time"
+
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// ClientMeta describes a connected client, for use by Hooks
+type ClientMeta struct {
+	// Current ID of the client
+	Id msg.ClientId
+	// Address of the other end of the client's connection
+	RemoteAddr net.Addr
+	// When the client connected
+	Connected time.Time
+}
+
+// Hooks are optional callbacks for server events, so embedders can implement auditing, access control or analytics.
+// Any hook left nil is ignored.
+//
+// Hooks are called synchronously from the goroutines handling the client, so they should return quickly,
+// and must not call back into the server for the same client.
+type Hooks struct {
+	// Called when a new client connects, before any of its requests are handled
+	OnClientConnect func(client ClientMeta)
+	// Called when a client has disconnected, after it has been removed from the server
+	OnClientDisconnect func(client ClientMeta)
+	// Called when the server disconnects a client because of how it is behaving, with the reason:
+	// INACTIVE if it stopped responding to pings, or SLOW_CONSUMER if it stopped reading.
+	// OnClientDisconnect is still called once the client has been removed.
+	OnClientEvicted func(client ClientMeta, reason msg.Status)
+	// Called before a relay is sent on to its destinations. Returning an error vetoes the whole relay,
+	// which is then rejected with FORBIDDEN. The request must not be modified.
+	OnRelay func(src ClientMeta, req *msg.RelayRequest) error
+	// Called when a relay is rejected, either by OnRelay, by one of the RelayFilters or because it is invalid.
+	// The error is a *msg.StatusError holding the status the sender receives, wrapping the error from OnRelay or the
+	// filter if any.
+	OnRelayDenied func(src ClientMeta, req *msg.RelayRequest, err error)
+}
+
+// Get the hook view of the client
+func (sc *serverClient) meta() ClientMeta {
+	return ClientMeta{
+		Id:         sc.id(),
+		RemoteAddr: sc.con.RemoteAddr(),
+		Connected:  sc.connected,
+	}
+}
+
+// Call the OnClientConnect hook, if set
+func (s *Server) hookConnect(sc *serverClient) {
+	if s.cfg().Hooks.OnClientConnect != nil {
+		s.cfg().Hooks.OnClientConnect(sc.meta())
+	}
+}
+
+// Call the OnClientDisconnect hook, if set
+func (s *Server) hookDisconnect(sc *serverClient) {
+	if s.cfg().Hooks.OnClientDisconnect != nil {
+		s.cfg().Hooks.OnClientDisconnect(sc.meta())
+	}
+}
+
+// Call the OnClientEvicted hook, if set
+func (s *Server) hookEvicted(sc *serverClient, reason msg.Status) {
+	if s.cfg().Hooks.OnClientEvicted != nil {
+		s.cfg().Hooks.OnClientEvicted(sc.meta(), reason)
+	}
+}
+
+// Check whether the OnRelay hook allows a relay, calling OnRelayDenied if it doesn't.
+// Returns the status to reject the relay with, or SUCCESS if it may be sent.
+func (s *Server) hookRelay(sc *serverClient, mesg *msg.Message) msg.Status {
+	if s.cfg().Hooks.OnRelay == nil {
+		return msg.SUCCESS
+	}
+	if err := s.cfg().Hooks.OnRelay(sc.meta(), mesg.RelayReq); err != nil {
+		s.hookRelayDenied(sc, mesg, msg.FORBIDDEN, err)
+		return msg.FORBIDDEN
+	}
+	return msg.SUCCESS
+}
+
+// Call the OnRelayDenied hook, if set
+func (s *Server) hookRelayDenied(sc *serverClient, mesg *msg.Message, status msg.Status, cause error) {
+	if s.cfg().Hooks.OnRelayDenied != nil {
+		s.cfg().Hooks.OnRelayDenied(sc.meta(), mesg.RelayReq, &msg.StatusError{Status: status, MessageId: mesg.MessageId, Err: cause})
+	}
+}
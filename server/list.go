@@ -0,0 +1,122 @@
+package server
+
+import (
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// Handle an incoming List Request Message (Unless the client sets a Limit, the response size is limited only by the number of connected clients.)
+func (s *Server) handleListRequest(sc *serverClient, mesg *msg.Message, rsp *msg.Message) {
+	cids := s.getClientIds(sc.ns(), sc.id())
+	sort.Slice(cids, func(i, j int) bool { return cids[i] < cids[j] })
+	if mesg.ListReq.Filter != "" {
+		cids = s.filterByName(cids, mesg.ListReq.Filter)
+	}
+
+	// Work out which page of the list was requested
+	start := len(cids)
+	if int(mesg.ListReq.Offset) < start {
+		start = int(mesg.ListReq.Offset)
+	}
+	end := len(cids)
+	next := uint32(0)
+	if mesg.ListReq.Limit > 0 && len(cids)-start > int(mesg.ListReq.Limit) {
+		end = start + int(mesg.ListReq.Limit)
+		next = uint32(end)
+	}
+
+	rsp.ListRes = &msg.ListResponse{
+		Others: cids[start:end],
+		Next:   next,
+	}
+	if mesg.ListReq.Metadata && s.cfg().ShareClientMetadata {
+		rsp.ListRes.Metadata = s.getClientMetadata(rsp.ListRes.Others)
+	}
+}
+
+// Get the clients from the list with a registered name starting with 'prefix'
+func (s *Server) filterByName(cids []msg.ClientId, prefix string) []msg.ClientId {
+	filtered := cids[:0]
+	s.names_mutex.RLock()
+	for _, cid := range cids {
+		if strings.HasPrefix(s.client_names[cid].name, prefix) {
+			filtered = append(filtered, cid)
+		}
+	}
+	s.names_mutex.RUnlock()
+	return filtered
+}
+
+// Get the metadata of each client in the list. Clients that have since disconnected only have their ID filled in.
+func (s *Server) getClientMetadata(cids []msg.ClientId) []msg.ClientMetadata {
+	meta := make([]msg.ClientMetadata, len(cids))
+	s.clients_mutex.RLock()
+	for i, cid := range cids {
+		meta[i].Id = cid
+		if sc, ok := s.clients[cid]; ok {
+			meta[i].Connected = msg.TimestampOf(sc.connected)
+			meta[i].Address = addressCategory(sc.con.RemoteAddr())
+		}
+	}
+	s.clients_mutex.RUnlock()
+	s.names_mutex.RLock()
+	for i := range meta {
+		meta[i].Name = s.client_names[meta[i].Id].name
+	}
+	s.names_mutex.RUnlock()
+	return meta
+}
+
+// Private IPv4 and IPv6 address ranges, which are reported as "private" rather than "public"
+var privateNets = []net.IPNet{
+	{IP: net.IP{10, 0, 0, 0}, Mask: net.CIDRMask(8, 32)},
+	{IP: net.IP{172, 16, 0, 0}, Mask: net.CIDRMask(12, 32)},
+	{IP: net.IP{192, 168, 0, 0}, Mask: net.CIDRMask(16, 32)},
+	{IP: net.IP{0xfc, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, Mask: net.CIDRMask(7, 128)},
+}
+
+// Get the IP address of a client, or nil if it doesn't have one
+func addressIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	case *net.UnixAddr:
+		return nil
+	}
+	// Other transports (like websockets) may still report an IP address
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return net.ParseIP(host)
+	}
+	return nil
+}
+
+// Get the category of a client's address, which is shared with other clients instead of the address itself
+func addressCategory(addr net.Addr) string {
+	if _, ok := addr.(*net.UnixAddr); ok {
+		// Unix domain sockets only connect processes on the same machine
+		return "loopback"
+	}
+	ip := addressIP(addr)
+	switch {
+	case ip == nil:
+		return "other"
+	case ip.IsLoopback():
+		return "loopback"
+	case ip.IsLinkLocalUnicast():
+		return "private"
+	}
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return "private"
+		}
+	}
+	if ip.IsGlobalUnicast() {
+		return "public"
+	}
+	return "other"
+}
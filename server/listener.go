@@ -0,0 +1,168 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/CiaranWoodward/broadcast_hub/logging"
+)
+
+// Backoff between retries of temporary errors accepting connections, doubling from the minimum each time
+const minAcceptBackoff = 5 * time.Millisecond
+
+// Default values, used for any ListenerConfig fields left as zero
+const defaultMaxAcceptBackoff = time.Second
+
+// ListenerConfig holds the tunable parameters of a listener added with 'AddListenerWithConfig'.
+// The zero value is valid, and any fields left as zero are replaced with their defaults.
+type ListenerConfig struct {
+	// Called with each error accepting a connection, and whether the listener will retry after it. Temporary errors,
+	// such as running out of file descriptors, are retried after a backoff, and any other error stops the listener
+	// until it's restarted with 'Server.RestartListener'. Nil only logs the errors.
+	OnError func(l net.Listener, err error, retrying bool)
+	// Longest backoff between retries of temporary errors
+	MaxBackoff time.Duration
+}
+
+// ListenerStatus describes one of the server's listeners
+type ListenerStatus struct {
+	Listener net.Listener
+	// Error which stopped the listener accepting connections, or nil while it is still accepting them
+	Err error
+}
+
+// Listener added to the server, and the state of its accept loop
+type serverListener struct {
+	l      net.Listener
+	config ListenerConfig
+	// Error which stopped the accept loop, or nil while it is running (guarded by listeners_mutex)
+	err error
+	// Closed when the server closes the listener, to cut short any backoff
+	closed     chan struct{}
+	close_once sync.Once
+}
+
+// Replace any unset fields with their defaults
+func (cfg ListenerConfig) withDefaults() ListenerConfig {
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = defaultMaxAcceptBackoff
+	}
+	return cfg
+}
+
+// Add a listener which will accept new incoming connections from clients automatically, as with 'AddListener',
+// using the provided configuration.
+func (s *Server) AddListenerWithConfig(l net.Listener, cfg ListenerConfig) (ok bool) {
+	// Shutdown catch
+	s.is_closed_mutex.RLock()
+	defer s.is_closed_mutex.RUnlock()
+	if s.is_closed {
+		return false
+	}
+	sl := &serverListener{l: l, config: cfg.withDefaults(), closed: make(chan struct{})}
+	s.listeners_mutex.Lock()
+	s.listeners = append(s.listeners, sl)
+	s.listeners_mutex.Unlock()
+	go s.acceptLoop(sl)
+	return true
+}
+
+// Listeners gets the status of each of the server's listeners, including any which have stopped accepting connections
+// because of an error. Listeners which have been closed are forgotten.
+func (s *Server) Listeners() []ListenerStatus {
+	s.listeners_mutex.Lock()
+	defer s.listeners_mutex.Unlock()
+	statuses := make([]ListenerStatus, len(s.listeners))
+	for i, sl := range s.listeners {
+		statuses[i] = ListenerStatus{Listener: sl.l, Err: sl.err}
+	}
+	return statuses
+}
+
+// RestartListener starts accepting connections again on a listener which stopped because of an error.
+// Returns false if the listener isn't one of the server's, is still accepting connections, or the server is closed.
+func (s *Server) RestartListener(l net.Listener) bool {
+	s.is_closed_mutex.RLock()
+	defer s.is_closed_mutex.RUnlock()
+	if s.is_closed {
+		return false
+	}
+	s.listeners_mutex.Lock()
+	defer s.listeners_mutex.Unlock()
+	for _, sl := range s.listeners {
+		if sl.l == l && sl.err != nil {
+			sl.err = nil
+			s.cfg().Logger.Info("Restarting listener", logging.F("addr", l.Addr()))
+			go s.acceptLoop(sl)
+			return true
+		}
+	}
+	return false
+}
+
+// Accept connections from a listener until it's closed, or fails with an error that isn't temporary
+func (s *Server) acceptLoop(sl *serverListener) {
+	var backoff time.Duration
+	for {
+		con, err := sl.l.Accept()
+		if err == nil {
+			backoff = 0
+			s.AddClientByConnection(con)
+			continue
+		}
+		if errors.Is(err, net.ErrClosed) {
+			s.cfg().Logger.Debug("Listener closed", logging.F("addr", sl.l.Addr()))
+			s.removeListener(sl)
+			return
+		}
+		retrying := isTemporary(err)
+		if sl.config.OnError != nil {
+			sl.config.OnError(sl.l, err, retrying)
+		}
+		if !retrying {
+			s.cfg().Logger.Error("Listener stopped accepting connections", logging.F("addr", sl.l.Addr()), logging.F("err", err))
+			s.listeners_mutex.Lock()
+			sl.err = err
+			s.listeners_mutex.Unlock()
+			return
+		}
+		backoff = min(max(backoff*2, minAcceptBackoff), sl.config.MaxBackoff)
+		s.cfg().Logger.Warn("Failed to accept connection, retrying", logging.F("addr", sl.l.Addr()), logging.F("err", err),
+			logging.F("backoff", backoff))
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-sl.closed:
+			timer.Stop()
+		}
+	}
+}
+
+// Close the listener, as the server is shutting down
+func (sl *serverListener) close() {
+	sl.close_once.Do(func() {
+		sl.l.Close()
+		close(sl.closed)
+	})
+}
+
+// Forget a listener that has been closed, so listeners can be closed and replaced while running
+func (s *Server) removeListener(sl *serverListener) {
+	s.listeners_mutex.Lock()
+	defer s.listeners_mutex.Unlock()
+	for i, other := range s.listeners {
+		if other == sl {
+			s.listeners = append(s.listeners[:i], s.listeners[i+1:]...)
+			break
+		}
+	}
+}
+
+// Check whether an error accepting a connection is temporary, such as running out of file descriptors, so accepting
+// can be tried again
+func isTemporary(err error) bool {
+	var ne interface{ Temporary() bool }
+	return errors.As(err, &ne) && ne.Temporary()
+}
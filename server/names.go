@@ -0,0 +1,74 @@
+package server
+
+import (
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// Maximum length of a client name, in bytes
+const maxNameLength = 64
+
+// Handle an incoming Set Name Request Message
+func (s *Server) handleSetNameRequest(sc *serverClient, mesg *msg.Message, rsp *msg.Message) {
+	rsp.NameRes = &msg.SetNameResponse{}
+	if len(mesg.NameReq.Name) > maxNameLength {
+		rsp.NameRes.Status = msg.TOO_LONG
+	} else {
+		rsp.NameRes.Status = s.setName(sc.id(), scopedName{sc.ns(), mesg.NameReq.Name})
+	}
+}
+
+// Handle an incoming Resolve Name Request Message
+func (s *Server) handleResolveNameRequest(sc *serverClient, mesg *msg.Message, rsp *msg.Message) {
+	rsp.ResolvRes = &msg.ResolveNameResponse{
+		Status: msg.INVALID_ID,
+	}
+	s.names_mutex.RLock()
+	if cid, ok := s.names[scopedName{sc.ns(), mesg.ResolvReq.Name}]; ok && mesg.ResolvReq.Name != "" {
+		rsp.ResolvRes.Status = msg.SUCCESS
+		rsp.ResolvRes.Id = cid
+	}
+	s.names_mutex.RUnlock()
+}
+
+// Register 'name' for a client, replacing any name it already has. An empty name just clears the current name.
+// Returns NAME_IN_USE if another client in the namespace already holds the name.
+func (s *Server) setName(cid msg.ClientId, name scopedName) msg.Status {
+	s.names_mutex.Lock()
+	defer s.names_mutex.Unlock()
+
+	if owner, ok := s.names[name]; ok {
+		if owner == cid {
+			return msg.SUCCESS
+		}
+		return msg.NAME_IN_USE
+	}
+
+	// The client may be in the process of being removed, in which case it must not be given a name.
+	// Checking under the names mutex guarantees removeClient's clearName runs after any registration here.
+	s.clients_mutex.RLock()
+	_, connected := s.clients[cid]
+	s.clients_mutex.RUnlock()
+	if !connected {
+		return msg.CONNECTION_ERROR
+	}
+
+	if old, ok := s.client_names[cid]; ok {
+		delete(s.names, old)
+		delete(s.client_names, cid)
+	}
+	if name.name != "" {
+		s.names[name] = cid
+		s.client_names[cid] = name
+	}
+	return msg.SUCCESS
+}
+
+// Release the name held by a client, if any
+func (s *Server) clearName(cid msg.ClientId) {
+	s.names_mutex.Lock()
+	if name, ok := s.client_names[cid]; ok {
+		delete(s.names, name)
+		delete(s.client_names, cid)
+	}
+	s.names_mutex.Unlock()
+}
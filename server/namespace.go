@@ -0,0 +1,94 @@
+package server
+
+import (
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// Namespacer chooses the namespace a client joins when it authenticates, so one server can host several applications
+// which can't see each other. Clients only see and relay to other clients in their own namespace, and topics, groups,
+// names and histories are all separate for each namespace.
+//
+// Clients are in the default namespace ("") until they authenticate, but aren't listed, announced to presence
+// subscribers or relayed to until then, so clients of other applications are never exposed to them.
+// It may be called concurrently for different clients.
+type Namespacer interface {
+	Namespace(creds msg.Credentials) string
+}
+
+// NamespacerFunc allows an ordinary function to be used as a Namespacer
+type NamespacerFunc func(creds msg.Credentials) string
+
+// Namespace calls f(creds)
+func (f NamespacerFunc) Namespace(creds msg.Credentials) string {
+	return f(creds)
+}
+
+// NamespaceMap puts clients into namespaces by their username (or token, if they have no username).
+// Clients that aren't in the map stay in the default namespace.
+type NamespaceMap map[string]string
+
+// Namespace looks up the client's username or token in the map
+func (m NamespaceMap) Namespace(creds msg.Credentials) string {
+	if creds.Username != "" {
+		return m[creds.Username]
+	}
+	if creds.Token != "" {
+		return m[creds.Token]
+	}
+	return ""
+}
+
+// A topic, group or client name, within the namespace it belongs to
+type scopedName struct {
+	ns   string
+	name string
+}
+
+// Get the namespace the client is in
+func (sc *serverClient) ns() string {
+	if ns := sc.namespace.Load(); ns != nil {
+		return *ns
+	}
+	return ""
+}
+
+// Move a client into the namespace it authenticated into. Its subscriptions, groups, name and history belong to the
+// namespace it's leaving, so they are dropped, and it goes offline in the old namespace's presence and online in the
+// new one. A client that was hidden until now was never online anywhere, so it only goes online in the new one.
+func (s *Server) setNamespace(sc *serverClient, ns string) {
+	was_hidden := s.isHidden(sc)
+	old := sc.ns()
+	sc.namespace.Store(&ns)
+	cid := sc.id()
+	if old != ns {
+		s.unsubscribeAll(cid)
+		s.leaveAllGroups(cid)
+		s.clearName(cid)
+		s.dropHistory(cid)
+		if !was_hidden {
+			s.notifyPresence(sc, cid, old, false)
+		}
+	}
+	if old != ns || was_hidden {
+		s.notifyPresence(sc, cid, ns, true)
+	}
+}
+
+// Check whether a client is kept out of listings and relays, because it hasn't yet authenticated into its namespace.
+// Only servers with an Authenticator or Namespacer hide clients, as they may be moved to another namespace.
+func (s *Server) isHidden(sc *serverClient) bool {
+	return (s.cfg().Authenticator != nil || s.cfg().Namespacer != nil) && sc.namespace.Load() == nil
+}
+
+// Count the connected clients in a namespace
+func (s *Server) countClients(ns string) int {
+	s.clients_mutex.RLock()
+	defer s.clients_mutex.RUnlock()
+	n := 0
+	for _, sc := range s.clients {
+		if sc.ns() == ns && !s.isHidden(&sc) {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"sync/atomic"
+
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// Handle an incoming Presence Request Message
+func (s *Server) handlePresenceRequest(sc *serverClient, mesg *msg.Message, rsp *msg.Message) {
+	if mesg.PresReq.Subscribe {
+		atomic.StoreInt32(sc.presence, 1)
+	} else {
+		atomic.StoreInt32(sc.presence, 0)
+	}
+	rsp.PresRes = &msg.PresenceResponse{
+		Status: msg.SUCCESS,
+	}
+}
+
+// Let every client in namespace 'ns' that is subscribed to presence know that client 'sc' has connected to or
+// disconnected from the namespace as 'cid'. Presence indications are best effort, and are dropped if the subscriber isn't
+// keeping up. Hidden clients are never announced, and aren't told about others.
+func (s *Server) notifyPresence(sc *serverClient, cid msg.ClientId, ns string, online bool) {
+	if s.isHidden(sc) {
+		return
+	}
+	ind := msg.Message{
+		Version: msg.MyVersion,
+		PresInd: &msg.PresenceIndication{
+			Id:     cid,
+			Online: online,
+		},
+	}
+	s.clients_mutex.RLock()
+	for other_cid, other := range s.clients {
+		if other_cid == cid || atomic.LoadInt32(other.presence) == 0 || other.ns() != ns || s.isHidden(&other) {
+			continue
+		}
+		select {
+		case other.controlMsgs <- ind:
+		default:
+		}
+	}
+	s.clients_mutex.RUnlock()
+}
@@ -0,0 +1,57 @@
+package server
+
+import "github.com/CiaranWoodward/broadcast_hub/msg"
+
+// A client's buffered relays, in a queue for each priority. Each queue holds up to RelayBufferSize relays.
+type relayQueues struct {
+	high   chan *msg.SharedRelay
+	normal chan *msg.SharedRelay
+	low    chan *msg.SharedRelay
+}
+
+func newRelayQueues(size int) relayQueues {
+	return relayQueues{
+		high:   make(chan *msg.SharedRelay, size),
+		normal: make(chan *msg.SharedRelay, size),
+		low:    make(chan *msg.SharedRelay, size),
+	}
+}
+
+// Get the queue for relays of a priority
+func (q relayQueues) queue(p msg.Priority) chan *msg.SharedRelay {
+	switch p.Clamp() {
+	case msg.PriorityHigh:
+		return q.high
+	case msg.PriorityLow:
+		return q.low
+	default:
+		return q.normal
+	}
+}
+
+// Get the waiting relay with the highest priority, without blocking. Returns nil if there isn't one.
+func (q relayQueues) poll() *msg.SharedRelay {
+	for _, c := range []chan *msg.SharedRelay{q.high, q.normal, q.low} {
+		select {
+		case relay := <-c:
+			return relay
+		default:
+		}
+	}
+	return nil
+}
+
+// Get the number of relays waiting in every queue
+func (q relayQueues) len() int {
+	return len(q.high) + len(q.normal) + len(q.low)
+}
+
+// Check whether the queue for any priority is full
+func (q relayQueues) full() bool {
+	return len(q.high) == cap(q.high) || len(q.normal) == cap(q.normal) || len(q.low) == cap(q.low)
+}
+
+// Get the number of relays every queue can hold
+func (q relayQueues) cap() int {
+	return cap(q.high) + cap(q.normal) + cap(q.low)
+}
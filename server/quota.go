@@ -0,0 +1,101 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// Number of buckets a rolling quota window is counted in
+const quotaBuckets = 60
+
+// ByteQuota limits how many bytes of relays each client can send in a period, such as to bill or limit the tenants of a
+// shared hub. Each relay counts the length of its message once for every destination it's sent to.
+type ByteQuota struct {
+	// Most bytes each client may relay in the period. Once it has relayed this many, its relays are rejected with
+	// QUOTA_EXCEEDED until the period moves on. Zero is unlimited.
+	Bytes uint64
+	// Length of the rolling window the bytes are counted over. Zero counts them over each calendar day (in UTC) instead,
+	// starting again at midnight.
+	Window time.Duration
+}
+
+// Counts the bytes a client has relayed, in total and within its quota period.
+// The period is counted in buckets, of a fraction of the rolling window, or a whole day.
+type byteMeter struct {
+	mutex sync.Mutex
+	total uint64
+	// Bytes counted in each bucket, and the number (since the Unix epoch) of the bucket each count is for
+	counts  [quotaBuckets]uint64
+	buckets [quotaBuckets]int64
+	// Length of each bucket, which changes if the quota does
+	width time.Duration
+}
+
+// Get the length of each bucket, and the number of them in the quota period
+func (q ByteQuota) buckets() (width time.Duration, n int64) {
+	if q.Window <= 0 {
+		return 24 * time.Hour, 1
+	}
+	return max(q.Window/quotaBuckets, 1), quotaBuckets
+}
+
+// Count bytes relayed at 'now'
+func (m *byteMeter) add(bytes uint64, q ByteQuota, now time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	cur := m.bucket(q, now)
+	i := cur % quotaBuckets
+	if m.buckets[i] != cur {
+		m.buckets[i] = cur
+		m.counts[i] = 0
+	}
+	m.counts[i] += bytes
+	m.total += bytes
+}
+
+// Get the bytes relayed within the quota period ending at 'now', and in total
+func (m *byteMeter) used(q ByteQuota, now time.Time) (period uint64, total uint64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	cur := m.bucket(q, now)
+	_, n := q.buckets()
+	for i, b := range m.buckets {
+		if b <= cur && b > cur-n {
+			period += m.counts[i]
+		}
+	}
+	return period, m.total
+}
+
+// Get the number of the bucket 'now' is in, forgetting what was counted with different buckets.
+// Must be called with the mutex held.
+func (m *byteMeter) bucket(q ByteQuota, now time.Time) int64 {
+	width, _ := q.buckets()
+	if width != m.width {
+		m.width = width
+		m.counts = [quotaBuckets]uint64{}
+		m.buckets = [quotaBuckets]int64{}
+	}
+	return now.UnixNano() / int64(width)
+}
+
+// Check whether the client may send another relay. Returns QUOTA_EXCEEDED once it has used up its ByteQuota.
+func (s *Server) checkQuota(sc *serverClient) msg.Status {
+	q := s.cfg().ByteQuota
+	if q.Bytes == 0 {
+		return msg.SUCCESS
+	}
+	if used, _ := sc.relayed.used(q, time.Now()); used >= q.Bytes {
+		return msg.QUOTA_EXCEEDED
+	}
+	return msg.SUCCESS
+}
+
+// Count the bytes of a relay towards the client's quota, for each destination it was sent to
+func (s *Server) chargeRelay(sc *serverClient, ind *msg.RelayIndication, sent int) {
+	if sent > 0 && len(ind.Msg) > 0 {
+		sc.relayed.add(uint64(len(ind.Msg))*uint64(sent), s.cfg().ByteQuota, time.Now())
+	}
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimit limits how quickly each client can send relay requests.
+// Requests over the limit aren't rejected, but the client's requests are handled more slowly,
+// so well-behaved clients see nothing more than extra latency.
+type RateLimit struct {
+	// Maximum sustained relay requests per second from each client. Zero for no limit.
+	Rate float64 `json:"rate"`
+	// Number of relay requests a client can send in a burst, before being slowed to 'Rate'
+	Burst int `json:"burst"`
+}
+
+// Token bucket tracking a single client's relay rate.
+// The zero value is a full bucket.
+type rateBucket struct {
+	mutex  sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// Get the current relay rate limit, which applies to every client
+func (s *Server) RelayRateLimit() RateLimit {
+	s.rate_limit_mutex.RLock()
+	defer s.rate_limit_mutex.RUnlock()
+	return s.rate_limit
+}
+
+// Change the relay rate limit for every client, including those already connected.
+// A zero Rate removes the limit, and a zero Burst uses the default.
+func (s *Server) SetRelayRateLimit(limit RateLimit) {
+	if limit.Rate < 0 {
+		limit.Rate = 0
+	}
+	if limit.Burst <= 0 {
+		limit.Burst = defaultRelayRateBurst
+	}
+	s.rate_limit_mutex.Lock()
+	s.rate_limit = limit
+	s.rate_limit_mutex.Unlock()
+}
+
+// Wait until the client is allowed to send another relay.
+// Returns false if the client is removed while waiting.
+func (s *Server) throttleRelay(sc *serverClient) bool {
+	delay := sc.relay_bucket.take(s.RelayRateLimit(), time.Now())
+	if delay <= 0 {
+		return true
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-sc.removed:
+		return false
+	}
+}
+
+// Take a token from the bucket, refilling it at the limit's rate.
+// Returns how long the caller must wait until the token it took is available.
+func (b *rateBucket) take(limit RateLimit, now time.Time) time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	burst := float64(limit.Burst)
+	if limit.Rate <= 0 {
+		// No limit, so keep the bucket full in case one is set later
+		b.tokens = burst
+		b.last = now
+		return 0
+	}
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * limit.Rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / limit.Rate * float64(time.Second))
+}
@@ -0,0 +1,133 @@
+/*
+Package redisbackplane implements a server.Backplane using Redis Pub/Sub, so several servers can run behind a load
+balancer, with clients connected to any of them able to relay to each other.
+
+Each server subscribes to a channel for each of its clients, named after the ClientId, and relays to clients of other
+servers are published to the destination's channel. Redis reports how many servers received each relay, so relays to
+clients that aren't connected anywhere still fail with INVALID_ID.
+
+Example, sharing a Redis server between servers:
+
+	rdb := redis.NewClient(&redis.Options{Addr: "localhost:6379"})
+	bp := redisbackplane.New(rdb, "bh")
+	defer bp.Close()
+	ser := server.NewServerWithConfig(server.ServerConfig{Backplane: bp})
+*/
+package redisbackplane
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+	"github.com/CiaranWoodward/broadcast_hub/server"
+	"github.com/redis/go-redis/v9"
+)
+
+// How long each request to Redis may take
+const requestTimeout = 5 * time.Second
+
+// Backplane is a server.Backplane which forwards relays through Redis Pub/Sub
+type Backplane struct {
+	rdb    redis.UniversalClient
+	prefix string
+	pubsub *redis.PubSub
+	tc     msg.Transcoder
+	// Functions delivering relays to each attached client, and a mutex protecting them
+	clients       map[msg.ClientId]func(msg.RelayIndication)
+	clients_mutex sync.RWMutex
+	done          chan struct{}
+}
+
+var _ server.Backplane = (*Backplane)(nil)
+
+// Create a new Backplane publishing through 'rdb', to channels named with 'prefix'.
+// Servers sharing the backplane must use the same prefix.
+func New(rdb redis.UniversalClient, prefix string) *Backplane {
+	b := &Backplane{
+		rdb:     rdb,
+		prefix:  prefix + ":client:",
+		pubsub:  rdb.Subscribe(context.Background()),
+		tc:      &msg.CborTranscoder{},
+		clients: make(map[msg.ClientId]func(msg.RelayIndication)),
+		done:    make(chan struct{}),
+	}
+	go b.receive(b.pubsub.Channel())
+	return b
+}
+
+// Close stops receiving relays. The Redis client is left open.
+func (b *Backplane) Close() error {
+	err := b.pubsub.Close()
+	<-b.done
+	return err
+}
+
+// Attach subscribes to the client's channel
+func (b *Backplane) Attach(cid msg.ClientId, deliver func(ind msg.RelayIndication)) error {
+	b.clients_mutex.Lock()
+	b.clients[cid] = deliver
+	b.clients_mutex.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	return b.pubsub.Subscribe(ctx, b.channel(cid))
+}
+
+// Detach unsubscribes from the client's channel. Redis may still count this server as receiving the client's relays
+// for a moment afterwards, so relays sent meanwhile are lost.
+func (b *Backplane) Detach(cid msg.ClientId) error {
+	b.clients_mutex.Lock()
+	delete(b.clients, cid)
+	b.clients_mutex.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	err := b.pubsub.Unsubscribe(ctx, b.channel(cid))
+	if errors.Is(err, redis.ErrClosed) {
+		// Nothing is subscribed once the backplane is closed
+		return nil
+	}
+	return err
+}
+
+// Forward publishes the relay to the client's channel
+func (b *Backplane) Forward(dest msg.ClientId, ind msg.RelayIndication) (bool, error) {
+	encoded, err := b.tc.Encode(msg.Message{Version: msg.MyVersion, RelayInd: &ind})
+	if err != nil {
+		return false, fmt.Errorf("failed to encode relay: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	receivers, err := b.rdb.Publish(ctx, b.channel(dest), encoded).Result()
+	return receivers > 0, err
+}
+
+// Deliver relays published to the attached clients' channels, until the subscription is closed
+func (b *Backplane) receive(ch <-chan *redis.Message) {
+	defer close(b.done)
+	for m := range ch {
+		cid, err := strconv.ParseUint(strings.TrimPrefix(m.Channel, b.prefix), 10, 64)
+		if err != nil {
+			continue
+		}
+		decoded, err := b.tc.Decode([]byte(m.Payload))
+		if err != nil || decoded.RelayInd == nil {
+			continue
+		}
+		b.clients_mutex.RLock()
+		deliver, ok := b.clients[msg.ClientId(cid)]
+		b.clients_mutex.RUnlock()
+		if ok {
+			deliver(*decoded.RelayInd)
+		}
+	}
+}
+
+// Get the name of a client's channel
+func (b *Backplane) channel(cid msg.ClientId) string {
+	return b.prefix + strconv.FormatUint(uint64(cid), 10)
+}
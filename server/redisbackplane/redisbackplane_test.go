@@ -0,0 +1,78 @@
+package redisbackplane
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/CiaranWoodward/broadcast_hub/client"
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+	"github.com/CiaranWoodward/broadcast_hub/server"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisBackplane(t *testing.T) {
+	mr := miniredis.RunT(t)
+	newBackplane := func() *Backplane {
+		return New(redis.NewClient(&redis.Options{Addr: mr.Addr()}), "bh")
+	}
+	first, second := newBackplane(), newBackplane()
+	defer first.Close()
+	defer second.Close()
+
+	// Relays are delivered to the backplane the client is attached to, and fail for unknown clients
+	delivered := make(chan msg.RelayIndication, 1)
+	assert.Nil(t, second.Attach(7, func(ind msg.RelayIndication) { delivered <- ind }))
+	ok, err := first.Forward(7, msg.RelayIndication{Src: 3, Msg: []byte("hello"), ContentType: "text/plain"})
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, msg.RelayIndication{Src: 3, Msg: []byte("hello"), ContentType: "text/plain"}, <-delivered)
+	ok, err = first.Forward(8, msg.RelayIndication{Src: 3, Msg: []byte("hello")})
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// Until it's detached
+	assert.Nil(t, second.Detach(7))
+	assert.Eventually(t, func() bool {
+		ok, err := first.Forward(7, msg.RelayIndication{Src: 3, Msg: []byte("hello")})
+		return err == nil && !ok
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestRedisBackplaneServers(t *testing.T) {
+	// Test relaying between clients of two servers sharing the backplane
+	mr := miniredis.RunT(t)
+	newServer := func() (*server.Server, *Backplane) {
+		bp := New(redis.NewClient(&redis.Options{Addr: mr.Addr()}), "bh")
+		return server.NewServerWithConfig(server.ServerConfig{Backplane: bp}), bp
+	}
+	first, first_bp := newServer()
+	second, second_bp := newServer()
+	newClient := func(ser *server.Server) *client.Client {
+		cli, con := net.Pipe()
+		ser.AddClientByConnection(con)
+		return client.NewClientWithConfig(cli, client.ClientConfig{IdentifyOnConnect: true})
+	}
+	a := newClient(first)
+	b := newClient(second)
+
+	csm, err := a.RelayMessage([]byte("hello"), []msg.ClientId{b.ID()})
+	assert.Nil(t, err)
+	assert.Len(t, csm, 0)
+	select {
+	case ind := <-b.Relays:
+		assert.Equal(t, a.ID(), ind.Src)
+		assert.Equal(t, []byte("hello"), ind.Msg)
+	case <-time.After(time.Second):
+		t.Error("Relay wasn't forwarded")
+	}
+
+	first.Close()
+	second.Close()
+	a.Close()
+	b.Close()
+	first_bp.Close()
+	second_bp.Close()
+}
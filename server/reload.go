@@ -0,0 +1,225 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/CiaranWoodward/broadcast_hub/logging"
+)
+
+// Limits holds the fields of a ServerConfig which can be changed while the server is running, with 'UpdateConfig'.
+//
+// Limits sizing a client's buffers (RelayBufferSize and MaxPendingRequests) and its keepalive (PingInterval) only apply
+// to clients connecting after the change. The rest apply to connected clients too, although lowering MaxTotalClients
+// or MaxConnsPerIP only refuses new connections, and never disconnects anyone.
+//
+// In JSON, such as in the admin API, durations are given in seconds, and the names are in snake_case
+// (eg. {"idle_timeout_seconds": 30, "max_total_clients": 100}).
+type Limits struct {
+	RelayBufferSize    int
+	OverflowPolicy     OverflowPolicy
+	BlockTimeout       time.Duration
+	RelayDeadline      time.Duration
+	PingInterval       time.Duration
+	PingMissThreshold  int
+	IdleTimeout        time.Duration
+	WriteTimeout       time.Duration
+	SlowWriteLimit     int
+	MaxPendingRequests int
+	MaxTotalClients    int
+	MaxConnsPerIP      int
+	AuthTimeout        time.Duration
+	SessionTimeout     time.Duration
+	RetryTimeout       time.Duration
+	HistoryTTL         time.Duration
+	RelayRateLimit     RateLimit
+	ByteQuota          ByteQuota
+}
+
+// Limits in JSON, with durations in seconds
+type limitsJSON struct {
+	RelayBufferSize    int       `json:"relay_buffer_size"`
+	OverflowPolicy     string    `json:"overflow_policy"`
+	BlockTimeout       float64   `json:"block_timeout_seconds"`
+	RelayDeadline      float64   `json:"relay_deadline_seconds"`
+	PingInterval       float64   `json:"ping_interval_seconds"`
+	PingMissThreshold  int       `json:"ping_miss_threshold"`
+	IdleTimeout        float64   `json:"idle_timeout_seconds"`
+	WriteTimeout       float64   `json:"write_timeout_seconds"`
+	SlowWriteLimit     int       `json:"slow_write_limit"`
+	MaxPendingRequests int       `json:"max_pending_requests"`
+	MaxTotalClients    int       `json:"max_total_clients"`
+	MaxConnsPerIP      int       `json:"max_conns_per_ip"`
+	AuthTimeout        float64   `json:"auth_timeout_seconds"`
+	SessionTimeout     float64   `json:"session_timeout_seconds"`
+	RetryTimeout       float64   `json:"retry_timeout_seconds"`
+	HistoryTTL         float64   `json:"history_ttl_seconds"`
+	RelayRateLimit     RateLimit `json:"relay_rate_limit"`
+	ByteQuota          uint64    `json:"byte_quota"`
+	ByteQuotaWindow    float64   `json:"byte_quota_window_seconds"`
+}
+
+// Get the limits from the configuration
+func (cfg ServerConfig) Limits() Limits {
+	return Limits{
+		RelayBufferSize:    cfg.RelayBufferSize,
+		OverflowPolicy:     cfg.OverflowPolicy,
+		BlockTimeout:       cfg.BlockTimeout,
+		RelayDeadline:      cfg.RelayDeadline,
+		PingInterval:       cfg.PingInterval,
+		PingMissThreshold:  cfg.PingMissThreshold,
+		IdleTimeout:        cfg.IdleTimeout,
+		WriteTimeout:       cfg.WriteTimeout,
+		SlowWriteLimit:     cfg.SlowWriteLimit,
+		MaxPendingRequests: cfg.MaxPendingRequests,
+		MaxTotalClients:    cfg.MaxTotalClients,
+		MaxConnsPerIP:      cfg.MaxConnsPerIP,
+		AuthTimeout:        cfg.AuthTimeout,
+		SessionTimeout:     cfg.SessionTimeout,
+		RetryTimeout:       cfg.RetryTimeout,
+		HistoryTTL:         cfg.HistoryTTL,
+		RelayRateLimit:     cfg.RelayRateLimit,
+		ByteQuota:          cfg.ByteQuota,
+	}
+}
+
+// Get a copy of the configuration, with its limits replaced
+func (cfg ServerConfig) WithLimits(l Limits) ServerConfig {
+	cfg.RelayBufferSize = l.RelayBufferSize
+	cfg.OverflowPolicy = l.OverflowPolicy
+	cfg.BlockTimeout = l.BlockTimeout
+	cfg.RelayDeadline = l.RelayDeadline
+	cfg.PingInterval = l.PingInterval
+	cfg.PingMissThreshold = l.PingMissThreshold
+	cfg.IdleTimeout = l.IdleTimeout
+	cfg.WriteTimeout = l.WriteTimeout
+	cfg.SlowWriteLimit = l.SlowWriteLimit
+	cfg.MaxPendingRequests = l.MaxPendingRequests
+	cfg.MaxTotalClients = l.MaxTotalClients
+	cfg.MaxConnsPerIP = l.MaxConnsPerIP
+	cfg.AuthTimeout = l.AuthTimeout
+	cfg.SessionTimeout = l.SessionTimeout
+	cfg.RetryTimeout = l.RetryTimeout
+	cfg.HistoryTTL = l.HistoryTTL
+	cfg.RelayRateLimit = l.RelayRateLimit
+	cfg.ByteQuota = l.ByteQuota
+	return cfg
+}
+
+func (l Limits) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.toJSON())
+}
+
+// Decode limits from JSON. Fields missing from the JSON are left unchanged, so a partial update can be decoded over
+// the current limits. Unknown fields and negative values are errors.
+func (l *Limits) UnmarshalJSON(data []byte) error {
+	lj := l.toJSON()
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&lj); err != nil {
+		return err
+	}
+	limits, err := lj.limits()
+	if err != nil {
+		return err
+	}
+	*l = limits
+	return nil
+}
+
+func (l Limits) toJSON() limitsJSON {
+	return limitsJSON{
+		RelayBufferSize:    l.RelayBufferSize,
+		OverflowPolicy:     l.OverflowPolicy.String(),
+		BlockTimeout:       l.BlockTimeout.Seconds(),
+		RelayDeadline:      l.RelayDeadline.Seconds(),
+		PingInterval:       l.PingInterval.Seconds(),
+		PingMissThreshold:  l.PingMissThreshold,
+		IdleTimeout:        l.IdleTimeout.Seconds(),
+		WriteTimeout:       l.WriteTimeout.Seconds(),
+		SlowWriteLimit:     l.SlowWriteLimit,
+		MaxPendingRequests: l.MaxPendingRequests,
+		MaxTotalClients:    l.MaxTotalClients,
+		MaxConnsPerIP:      l.MaxConnsPerIP,
+		AuthTimeout:        l.AuthTimeout.Seconds(),
+		SessionTimeout:     l.SessionTimeout.Seconds(),
+		RetryTimeout:       l.RetryTimeout.Seconds(),
+		HistoryTTL:         l.HistoryTTL.Seconds(),
+		RelayRateLimit:     l.RelayRateLimit,
+		ByteQuota:          l.ByteQuota.Bytes,
+		ByteQuotaWindow:    l.ByteQuota.Window.Seconds(),
+	}
+}
+
+func (lj limitsJSON) limits() (Limits, error) {
+	policy, ok := ParseOverflowPolicy(lj.OverflowPolicy)
+	if !ok {
+		return Limits{}, fmt.Errorf("unknown overflow policy: %q", lj.OverflowPolicy)
+	}
+	for _, n := range []float64{
+		float64(lj.RelayBufferSize), lj.BlockTimeout, lj.RelayDeadline, lj.PingInterval, float64(lj.PingMissThreshold),
+		lj.IdleTimeout, lj.WriteTimeout, float64(lj.SlowWriteLimit), float64(lj.MaxPendingRequests),
+		float64(lj.MaxTotalClients), float64(lj.MaxConnsPerIP), lj.AuthTimeout, lj.SessionTimeout, lj.RetryTimeout,
+		lj.HistoryTTL, lj.RelayRateLimit.Rate, float64(lj.RelayRateLimit.Burst), lj.ByteQuotaWindow,
+	} {
+		if n < 0 {
+			return Limits{}, fmt.Errorf("limits can't be negative")
+		}
+	}
+	return Limits{
+		RelayBufferSize:    lj.RelayBufferSize,
+		OverflowPolicy:     policy,
+		BlockTimeout:       seconds(lj.BlockTimeout),
+		RelayDeadline:      seconds(lj.RelayDeadline),
+		PingInterval:       seconds(lj.PingInterval),
+		PingMissThreshold:  lj.PingMissThreshold,
+		IdleTimeout:        seconds(lj.IdleTimeout),
+		WriteTimeout:       seconds(lj.WriteTimeout),
+		SlowWriteLimit:     lj.SlowWriteLimit,
+		MaxPendingRequests: lj.MaxPendingRequests,
+		MaxTotalClients:    lj.MaxTotalClients,
+		MaxConnsPerIP:      lj.MaxConnsPerIP,
+		AuthTimeout:        seconds(lj.AuthTimeout),
+		SessionTimeout:     seconds(lj.SessionTimeout),
+		RetryTimeout:       seconds(lj.RetryTimeout),
+		HistoryTTL:         seconds(lj.HistoryTTL),
+		RelayRateLimit:     lj.RelayRateLimit,
+		ByteQuota:          ByteQuota{Bytes: lj.ByteQuota, Window: seconds(lj.ByteQuotaWindow)},
+	}, nil
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// Get the server's current configuration, including any changes made since it was created
+func (s *Server) Config() ServerConfig {
+	cfg := *s.cfg()
+	cfg.RelayRateLimit = s.RelayRateLimit()
+	return cfg
+}
+
+// Change the limits of a running server, such as its buffer sizes, timeouts and connection limits, to those of the
+// configuration (see 'Limits' for which they are, and when they take effect). Zero limits use their defaults, as with
+// 'NewServerWithConfig', and the other fields of the configuration are ignored.
+//
+// The limits are replaced together, so the server never uses a mix of the old and new limits.
+func (s *Server) UpdateConfig(cfg ServerConfig) {
+	limits := cfg.withDefaults().Limits()
+	s.config_mutex.Lock()
+	next := s.cfg().WithLimits(limits)
+	if next.MaxPendingRequests < next.RequestWorkers {
+		next.MaxPendingRequests = next.RequestWorkers
+	}
+	s.config.Store(&next)
+	s.config_mutex.Unlock()
+	s.SetRelayRateLimit(limits.RelayRateLimit)
+	next.Logger.Info("Updated configuration", logging.F("limits", limits))
+}
+
+// Get the current configuration. It must not be modified, as it's shared by everything using it.
+func (s *Server) cfg() *ServerConfig {
+	return s.config.Load()
+}
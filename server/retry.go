@@ -0,0 +1,163 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/CiaranWoodward/broadcast_hub/logging"
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// Backoff between attempts to deliver a Reliable relay to a full buffer, doubling each time up to the maximum
+const (
+	retryMinBackoff = 5 * time.Millisecond
+	retryMaxBackoff = 500 * time.Millisecond
+)
+
+// Details of a Reliable relay request, needed to retry it and report any failure back to the sender
+type relayRetry struct {
+	src      msg.ClientId
+	relay_id uint32
+	deadline time.Time
+}
+
+// A Reliable relay waiting in a destination's retry queue
+type pendingRelay struct {
+	ind   *msg.SharedRelay
+	retry *relayRetry
+}
+
+// Get the retry details for a relay request, or nil if it isn't Reliable
+func (s *Server) newRelayRetry(sc *serverClient, mesg *msg.Message) *relayRetry {
+	if !mesg.RelayReq.Reliable {
+		return nil
+	}
+	return &relayRetry{
+		src:      sc.id(),
+		relay_id: mesg.MessageId,
+		deadline: time.Now().Add(s.cfg().RetryTimeout),
+	}
+}
+
+// Add a relay to a destination's retry queue. Returns NO_BUFFER if the retry queue is also full.
+func queueRetry(retries chan pendingRelay, ind *msg.SharedRelay, retry *relayRetry) msg.Status {
+	select {
+	case retries <- pendingRelay{ind: ind, retry: retry}:
+		return msg.SUCCESS
+	default:
+		return msg.NO_BUFFER
+	}
+}
+
+// Start the goroutine that retries the Reliable relays queued for a client, in order
+func (s *Server) startRetrier(sc serverClient) {
+	go func() {
+		for {
+			select {
+			case p := <-sc.retries:
+				if !s.retryRelay(&sc, p) {
+					s.abandonRetries(&sc)
+					return
+				}
+			case <-sc.removed:
+				s.abandonRetries(&sc)
+				return
+			}
+		}
+	}()
+}
+
+// Keep trying to add a relay to the client's buffer, backing off between attempts, until the relay's deadline.
+// Returns false if the client is removed first.
+func (s *Server) retryRelay(sc *serverClient, p pendingRelay) bool {
+	backoff := retryMinBackoff
+	for {
+		// Flow controlled clients may grant more credits later, so waiting for them is retried like a full buffer
+		if takeCredit(sc.credits) {
+			select {
+			case sc.relayMsgs.queue(p.ind.Ind.Priority) <- p.ind:
+				return true
+			default:
+				returnCredit(sc.credits)
+			}
+		}
+		if p.ind.Expired(time.Now()) {
+			s.expireRelay(sc.id(), &p.ind.Ind, p.retry)
+			return true
+		}
+		wait := time.Until(p.retry.deadline)
+		if wait <= 0 {
+			s.reportRelayFailure(sc.id(), p.retry, msg.TIMEOUT)
+			return true
+		}
+		if backoff < wait {
+			wait = backoff
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-sc.removed:
+			timer.Stop()
+			s.retryStored(sc, p)
+			return false
+		}
+		if backoff *= 2; backoff > retryMaxBackoff {
+			backoff = retryMaxBackoff
+		}
+	}
+}
+
+// Deal with every relay left in the retry queue of a removed client
+func (s *Server) abandonRetries(sc *serverClient) {
+	for {
+		select {
+		case p := <-sc.retries:
+			s.retryStored(sc, p)
+		default:
+			return
+		}
+	}
+}
+
+// Store a relay for a removed client, in case it resumes its session, or report the failure if it can't be stored
+func (s *Server) retryStored(sc *serverClient, p pendingRelay) {
+	if s.storeRelay(sc.id(), sc.ns(), p.ind.Ind) != msg.SUCCESS {
+		s.reportRelayFailure(sc.id(), p.retry, msg.CONNECTION_ERROR)
+	}
+}
+
+// Discard a relay for a destination, as its TTL (or the RelayDeadline) elapsed before it could be sent. The sender is
+// told if it asked for the relay to be acknowledged, or if it's Reliable and 'retry' is set.
+func (s *Server) expireRelay(dest msg.ClientId, ind *msg.RelayIndication, retry *relayRetry) {
+	atomic.AddUint64(&s.relays_expired, 1)
+	s.cfg().Logger.Debug("Discarded expired relay", logging.F("client", dest), logging.F("src", ind.Src))
+	if ind.AckRequested {
+		retry = &relayRetry{src: ind.Src, relay_id: ind.RelayId}
+	}
+	if retry != nil {
+		s.reportRelayFailure(dest, retry, msg.EXPIRED)
+	}
+}
+
+// Let the sender of a Reliable relay know that it couldn't be delivered to a destination.
+// Failure indications are best effort, and are dropped if the sender has gone or isn't keeping up.
+func (s *Server) reportRelayFailure(dest msg.ClientId, retry *relayRetry, status msg.Status) {
+	s.clients_mutex.RLock()
+	src_client, ok := s.clients[retry.src]
+	s.clients_mutex.RUnlock()
+	if !ok {
+		return
+	}
+	ind := msg.Message{
+		Version: msg.MyVersion,
+		FailInd: &msg.RelayFailureIndication{
+			Dest:    dest,
+			RelayId: retry.relay_id,
+			Status:  status,
+		},
+	}
+	select {
+	case src_client.controlMsgs <- ind:
+	default:
+	}
+}
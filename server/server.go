@@ -12,92 +12,194 @@ Example, creating a listening TCP server on port 2593:
 package server
 
 import (
-	"log"
+	"context"
+	"errors"
 	"net"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/CiaranWoodward/broadcast_hub/logging"
 	"github.com/CiaranWoodward/broadcast_hub/msg"
+	"github.com/CiaranWoodward/broadcast_hub/tracing"
 )
 
-// Maximum buffered messages per destination
-const maxBufferedMessages = 3
+// Maximum buffered control messages (pings, delivery acknowledgements) per client
+const controlBufferSize = 16
+
+// Maximum length of a relay's content type, in bytes
+const maxContentTypeLength = 255
+
+// How long a refused connection is given to read its Server Full Indication, before it's closed anyway
+const serverFullTimeout = time.Second
+
+// How long a client is given to be sent its Disconnect Indication, before it's disconnected anyway
+const disconnectTimeout = time.Second
+
+// How often a draining client is checked for outstanding requests during a graceful shutdown
+const drainPollInterval = 10 * time.Millisecond
 
 // server representation of a connected client
 type serverClient struct {
-	// Client Id
-	cid msg.ClientId
-	// Relayed message stream (buffered)
-	relayMsgs chan msg.RelayIndication
+	// Client Id (changes if the client resumes a previous session)
+	cid *uint64
+	// Relayed message streams, for each priority (buffered)
+	relayMsgs relayQueues
 	// Response messages channel (non-buffered) (only for dispatcher to send to)
 	responseMsgs chan msg.Message
-	// Message stream decoder
-	tc msg.Transcoder
-	dc msg.StreamDecoder
+	// Messages originating from the hub itself, like keepalive pings and delivery acknowledgements (buffered)
+	controlMsgs chan msg.Message
+	// Reliable relays waiting to be retried, because the relay buffer was full (buffered)
+	retries chan pendingRelay
+	// Requests waiting for one of the client's request workers (buffered), or nil if it only has one
+	requests chan msg.Message
+	// Number of keepalive pings sent since anything was last received from the client
+	pings_missed *int32
+	// When the client last sent anything or was sent a relay, in Unix nanoseconds
+	last_active *int64
+	// Number of received requests which are still being handled
+	inflight *int32
+	// Relays the client is still willing to receive, as granted by its Flow Updates, or -1 if it hasn't sent any
+	credits *int64
+	// Number of consecutive writes to the client which have timed out
+	write_timeouts *int32
+	// Protocol version agreed with the client, used for every message sent to it
+	version *int32
+	// Non-zero if the client has subscribed to presence indications
+	presence *int32
+	// Non-zero once the client has authenticated (or if no authentication is required), and closed at the same time
+	authenticated *int32
+	auth_done     chan struct{}
+	// Non-zero once the client has authenticated with credentials accepted by the AdminAuthenticator
+	admin *int32
+	// Bytes received from and sent to the client
+	bytes_in  *uint64
+	bytes_out *uint64
+	// Closed once the client has been removed from the server
+	removed chan struct{}
+	// Tracks how quickly the client is sending relays
+	relay_bucket *rateBucket
+	// Bytes the client has relayed, for its ByteQuota
+	relayed *byteMeter
+	// Namespace the client authenticated into, or nil if it hasn't authenticated, leaving it in the default namespace
+	namespace *atomic.Pointer[string]
+	// Why the server disconnected the client, or SUCCESS if it hasn't
+	disconnect_reason *int32
+	// When the client connected
+	connected time.Time
+	// IP address the client connected from, or empty if it doesn't have one
+	ip string
+	// Codec the client is using, which is detected from its first message. 'codec_known' is closed once it's detected.
+	codec       *int32
+	codec_known chan struct{}
 	// Internal connection state
 	con net.Conn
 }
 
 // Server class representing all of the state of a broadcast_hub server.
 type Server struct {
-	// Internal client ID counter (for unique IDs)
-	cid msg.ClientId
+	// Tunable parameters, replaced as a whole when they're changed with 'UpdateConfig'
+	config       atomic.Pointer[ServerConfig]
+	config_mutex sync.Mutex
 	// Map of all connected clients
 	clients       map[msg.ClientId]serverClient
 	clients_mutex sync.RWMutex
+	// Number of connected clients from each IP address (guarded by clients_mutex)
+	ip_conns map[string]int
+	// Number of connections refused because the server was full (or draining)
+	refused_conns uint64
+	// Number of relays discarded because their TTL elapsed before they could be sent
+	relays_expired uint64
+	// When the server was created, and how often it's handling relays in each namespace
+	started           time.Time
+	relay_rates       map[string]*rateMeter
+	relay_rates_mutex sync.Mutex
+	// Map of topic names to the clients subscribed to them
+	topics       map[scopedName]topicMembers
+	topics_mutex sync.RWMutex
+	// Map of group names to their members
+	groups       map[scopedName]groupMembers
+	groups_mutex sync.RWMutex
+	// Registered client names, in both directions
+	names        map[scopedName]msg.ClientId
+	client_names map[msg.ClientId]scopedName
+	names_mutex  sync.RWMutex
+	// Resumable client sessions, if a MessageStore is configured
+	sessions       map[msg.ClientId]*session
+	sessions_mutex sync.Mutex
+	// Recent relays sent to each topic and client, if HistorySize is set
+	history       map[historyKey]*historyRing
+	history_mutex sync.Mutex
+	// Relays remembered by their MsgUUID, so duplicates within the DedupWindow can be dropped. Oldest first in 'dedup_order'.
+	dedup       map[dedupKey]*dedupEntry
+	dedup_order []*dedupEntry
+	dedup_mutex sync.Mutex
+	// Relay rate limit for every client, which can be changed at runtime
+	rate_limit       RateLimit
+	rate_limit_mutex sync.RWMutex
 	// Slice of all listeners
-	listeners       []net.Listener
+	listeners       []*serverListener
 	listeners_mutex sync.Mutex
 	// Shutdown tracker, preventing corrupted state during shutdown
 	is_closed       bool
 	is_closed_mutex sync.RWMutex
+	// Closed to start a graceful shutdown, and tracking of the senders that must flush before it completes
+	going_away      chan struct{}
+	going_away_once sync.Once
+	senders         sync.WaitGroup
+	// Events for the application, once it has asked for them with 'Events', and the number it didn't keep up with
+	events         atomic.Pointer[chan Event]
+	events_once    sync.Once
+	dropped_events uint64
+	// Non-zero while the server is refusing new clients for maintenance
+	draining int32
 }
 
 // Create a new server, that will act as a hub and allow connected clients to communicate.
 // The server does nothing by itself, and must be either configured to accept new connections
 // with the 'AddListener' function, or individual connections added with the 'AddClientByConnection'
 // function.
+//
+// The server uses the default configuration, see 'NewServerWithConfig' to tune it.
 func NewServer() *Server {
-	return &Server{
+	return NewServerWithConfig(DefaultServerConfig())
+}
+
+// Create a new server, as with 'NewServer', using the provided configuration.
+// Any fields of the configuration left as zero will use their default values.
+func NewServerWithConfig(cfg ServerConfig) *Server {
+	cfg = cfg.withDefaults()
+	s := &Server{
 		clients:   make(map[msg.ClientId]serverClient),
-		listeners: make([]net.Listener, 0),
+		ip_conns:  make(map[string]int),
+		topics:    make(map[scopedName]topicMembers),
+		groups:    make(map[scopedName]groupMembers),
+		listeners: make([]*serverListener, 0),
+
+		names:        make(map[scopedName]msg.ClientId),
+		client_names: make(map[msg.ClientId]scopedName),
+		going_away:   make(chan struct{}),
+		sessions:     make(map[msg.ClientId]*session),
+		history:      make(map[historyKey]*historyRing),
+		dedup:        make(map[dedupKey]*dedupEntry),
+		relay_rates:  make(map[string]*rateMeter),
+		rate_limit:   cfg.RelayRateLimit,
+		started:      time.Now(),
 	}
+	s.config.Store(&cfg)
+	return s
 }
 
 // Add a listener which will accept new incoming connections from clients automatically.
 // The server will handle closing the listener when it shuts down.
 // 'ok' return value will be true unless server is closed
 func (s *Server) AddListener(l net.Listener) (ok bool) {
-	// Shutdown catch
-	ok = true
-	s.is_closed_mutex.RLock()
-	defer s.is_closed_mutex.RUnlock()
-	if s.is_closed {
-		ok = false
-		return
-	}
-	// Add listener to internal list
-	s.listeners_mutex.Lock()
-	s.listeners = append(s.listeners, l)
-	s.listeners_mutex.Unlock()
-	// Actual listening goroutine
-	go func() {
-		for {
-			con, err := l.Accept()
-			if err != nil {
-				log.Printf("Error: %s\n", err.Error())
-				break
-			}
-			s.AddClientByConnection(con)
-		}
-	}()
-	return
+	return s.AddListenerWithConfig(l, ListenerConfig{})
 }
 
 // Add a new client connection. This is mainly for testing and allowing dual client-server programs.
 // The server will handle closing the connection when it shuts down.
-// 'ok' return value will be true unless server is closed
+// 'ok' return value will be true unless server is closed, or the connection was refused because the server is full
 func (s *Server) AddClientByConnection(c net.Conn) (ok bool) {
 	// Shutdown catch
 	ok = true
@@ -107,26 +209,168 @@ func (s *Server) AddClientByConnection(c net.Conn) (ok bool) {
 		ok = false
 		return
 	}
-	// Generate CID, add it to the map, start the dispatcher for it
-	new_cid := msg.ClientId(atomic.AddUint64((*uint64)(&s.cid), 1))
-	tc := &msg.CborTranscoder{}
+	// Allocate a CID, add it to the map, start the dispatcher for it
 	new_sc := serverClient{
-		cid:          new_cid,
-		relayMsgs:    make(chan msg.RelayIndication, maxBufferedMessages),
-		responseMsgs: make(chan msg.Message),
-		tc:           tc,
-		dc:           tc.NewStreamDecoder(c),
-		con:          c,
+		cid:               new(uint64),
+		relayMsgs:         newRelayQueues(s.cfg().RelayBufferSize),
+		responseMsgs:      make(chan msg.Message),
+		controlMsgs:       make(chan msg.Message, controlBufferSize),
+		retries:           make(chan pendingRelay, s.cfg().RetryQueueSize),
+		pings_missed:      new(int32),
+		last_active:       new(int64),
+		inflight:          new(int32),
+		credits:           new(int64),
+		write_timeouts:    new(int32),
+		version:           new(int32),
+		presence:          new(int32),
+		authenticated:     new(int32),
+		auth_done:         make(chan struct{}),
+		admin:             new(int32),
+		bytes_in:          new(uint64),
+		bytes_out:         new(uint64),
+		removed:           make(chan struct{}),
+		relay_bucket:      &rateBucket{},
+		relayed:           &byteMeter{},
+		namespace:         &atomic.Pointer[string]{},
+		disconnect_reason: new(int32),
+		connected:         time.Now(),
+		codec:             new(int32),
+		codec_known:       make(chan struct{}),
+		con:               c,
+	}
+	*new_sc.credits = noFlowControl
+	if ip := addressIP(c.RemoteAddr()); ip != nil {
+		new_sc.ip = ip.String()
+	}
+	new_sc.markActive()
+	if s.cfg().RequestWorkers > 1 {
+		new_sc.requests = make(chan msg.Message, s.cfg().MaxPendingRequests)
+	}
+	if len(s.cfg().AllowedCodecs) == 1 {
+		// With only one codec allowed, there's nothing to detect and the client can be sent messages straight away
+		atomic.StoreInt32(new_sc.codec, int32(s.cfg().AllowedCodecs[0]))
+		close(new_sc.codec_known)
+	}
+	atomic.StoreInt32(new_sc.version, int32(msg.MyVersion))
+	if s.cfg().Authenticator == nil {
+		atomic.StoreInt32(new_sc.authenticated, 1)
+		close(new_sc.auth_done)
 	}
 	s.clients_mutex.Lock()
+	new_cid := s.allocateClientId()
+	atomic.StoreUint64(new_sc.cid, uint64(new_cid))
+	admitted := msg.SERVER_FULL
+	if new_cid != 0 {
+		admitted = s.admitClient(&new_sc)
+	}
+	if admitted != msg.SUCCESS {
+		s.clients_mutex.Unlock()
+		s.refuseClient(&new_sc, admitted)
+		return false
+	}
 	s.clients[new_cid] = new_sc
 	s.clients_mutex.Unlock()
+	if s.cfg().MessageStore != nil {
+		s.newSession(new_cid)
+	}
+	s.notifyPresence(&new_sc, new_cid, "", true)
+	s.attachBackplane(new_cid)
+	s.hookConnect(&new_sc)
+	s.emit(ClientConnected{CID: new_cid, RemoteAddr: c.RemoteAddr()})
+	s.senders.Add(1)
 	s.startDispatcher(new_sc)
 	s.startSender(new_sc)
-	log.Printf("Added new Client %d\n", new_cid)
+	s.startRetrier(new_sc)
+	if s.cfg().PingInterval > 0 {
+		s.startPinger(new_sc)
+	}
+	if s.cfg().IdleTimeout > 0 {
+		s.startIdleTimer(new_sc)
+	}
+	if s.cfg().Authenticator != nil {
+		s.startAuthTimer(new_sc)
+	}
+	s.cfg().Logger.Info("Added new Client", logging.F("client", new_cid), logging.F("remote_addr", new_sc.con.RemoteAddr()))
 	return
 }
 
+// Check whether there's room for another client, counting it against its address if so.
+// Returns SERVER_FULL if there isn't, or DRAINING if the server isn't taking new clients at all.
+// The caller must hold clients_mutex for writing.
+func (s *Server) admitClient(sc *serverClient) msg.Status {
+	if s.Draining() {
+		return msg.DRAINING
+	}
+	if s.cfg().MaxTotalClients > 0 && len(s.clients) >= s.cfg().MaxTotalClients {
+		return msg.SERVER_FULL
+	}
+	if sc.ip == "" {
+		return msg.SUCCESS
+	}
+	if s.cfg().MaxConnsPerIP > 0 && s.ip_conns[sc.ip] >= s.cfg().MaxConnsPerIP {
+		return msg.SERVER_FULL
+	}
+	s.ip_conns[sc.ip]++
+	return msg.SUCCESS
+}
+
+// Stop counting a removed client against its address. The caller must hold clients_mutex for writing.
+func (s *Server) releaseAddress(ip string) {
+	if ip == "" {
+		return
+	}
+	if s.ip_conns[ip] <= 1 {
+		delete(s.ip_conns, ip)
+	} else {
+		s.ip_conns[ip]--
+	}
+}
+
+// Refuse a client that wasn't admitted, telling it the server is full (or draining) if its codec is known, and close
+// its connection
+func (s *Server) refuseClient(sc *serverClient, reason msg.Status) {
+	atomic.AddUint64(&s.refused_conns, 1)
+	s.cfg().Logger.Warn("Refused connection", logging.F("remote_addr", sc.con.RemoteAddr()), logging.F("reason", reason))
+	if len(s.cfg().AllowedCodecs) > 1 {
+		// Nothing can be sent until the client's codec is detected, which isn't worth waiting for
+		sc.con.Close()
+		return
+	}
+	encoded_msg, err := s.cfg().AllowedCodecs[0].Transcoder().Encode(msg.Message{
+		Version:    msg.MyVersion,
+		ServerFull: &msg.ServerFullIndication{Draining: reason == msg.DRAINING},
+	})
+	if err != nil {
+		s.cfg().Logger.Error("Failed to encode Server Full Indication", logging.F("err", err))
+		sc.con.Close()
+		return
+	}
+	// Don't hold up accepting other connections while the client reads it
+	go func() {
+		sc.con.SetWriteDeadline(time.Now().Add(serverFullTimeout))
+		sc.con.Write(encoded_msg)
+		sc.con.Close()
+	}()
+}
+
+// SetDraining starts or stops draining the server for maintenance. While draining, new clients are refused with a
+// ServerFullIndication marked Draining (which the client library reports as DRAINING), and the readiness check fails,
+// so a load balancer stops sending clients to the server. Clients which are already connected are served as usual.
+func (s *Server) SetDraining(draining bool) {
+	var value int32
+	if draining {
+		value = 1
+	}
+	if atomic.SwapInt32(&s.draining, value) != value {
+		s.cfg().Logger.Info("Draining changed", logging.F("draining", draining))
+	}
+}
+
+// Draining gets whether the server is draining, and refusing new clients (see 'SetDraining')
+func (s *Server) Draining() bool {
+	return atomic.LoadInt32(&s.draining) != 0
+}
+
 // Close the server, and all associated resources and connections
 func (s *Server) Close() {
 	// Disable all public functions
@@ -138,60 +382,319 @@ func (s *Server) Close() {
 	s.closeAllClients()
 }
 
+// Shutdown gracefully shuts down the server. New connections are refused, and every client is sent a
+// GoingAwayIndication. Each connection is then closed once any requests in progress have been responded to,
+// and the relays already buffered for the client have been sent.
+//
+// If the context is done before every connection has been flushed, the remaining connections are closed
+// immediately (as with 'Close') and the context's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.is_closed_mutex.Lock()
+	s.is_closed = true
+	s.closeAllListeners()
+	s.going_away_once.Do(func() { close(s.going_away) })
+	s.is_closed_mutex.Unlock()
+
+	flushed := make(chan struct{})
+	go func() {
+		s.senders.Wait()
+		close(flushed)
+	}()
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		s.closeAllClients()
+		return ctx.Err()
+	}
+}
+
+// DisconnectClient disconnects a client, sending it a DisconnectIndication with the reason first, so it can tell
+// whether to reconnect. For example, GOING_AWAY if it may reconnect once the server has restarted, or FORBIDDEN if it
+// has been banned. The indication is sent ahead of any relays still buffered for the client.
+// 'ok' is false if there is no client connected with that ID.
+func (s *Server) DisconnectClient(cid msg.ClientId, reason msg.Status) (ok bool) {
+	s.clients_mutex.RLock()
+	sc, ok := s.clients[cid]
+	s.clients_mutex.RUnlock()
+	if !ok {
+		return false
+	}
+	sc.setDisconnectReason(reason)
+	s.cfg().Logger.Info("Disconnecting Client", logging.F("client", cid), logging.F("reason", reason))
+	select {
+	case sc.controlMsgs <- msg.Message{Version: msg.MyVersion, Disconnect: &msg.DisconnectIndication{Reason: reason}}:
+	default:
+		// The client isn't keeping up, so there's no point waiting for it to be sent the reason
+		sc.con.Close()
+		return true
+	}
+	// The sender closes the connection once the indication is sent, unless it's stuck
+	go func() {
+		timer := time.NewTimer(disconnectTimeout)
+		defer timer.Stop()
+		select {
+		case <-sc.removed:
+		case <-timer.C:
+			sc.con.Close()
+		}
+	}()
+	return true
+}
+
 // Start the dispatcher that will handle each received message
 func (s *Server) startDispatcher(sc serverClient) {
 	go func() {
-		// Read messages from the transport, and dispatch them to the relevant handler
-		// Currently the server will only handle a single request per connected client (A fair restriction for a low-bandwidth protocol like this)
-		for {
-			msgout, ok := sc.dc.DecodeNext()
-			if ok {
-				if msgout.IdReq != nil {
-					s.handleIdRequest(&sc, &msgout)
+		// Read messages from the transport, and dispatch them to the relevant handler.
+		// Requests are handled one at a time, in order, unless the client has request workers to share them with.
+		var workers sync.WaitGroup
+		if sc.requests != nil {
+			s.startWorkers(sc, &workers)
+		}
+		dc := s.detectCodec(&sc)
+		// If the codec couldn't be detected, there's nothing to decode
+		for dc != nil {
+			msgout, err := dc.DecodeNext()
+			if err == nil || msg.IsRecoverable(err) {
+				// Any message at all shows the client is still alive
+				atomic.StoreInt32(sc.pings_missed, 0)
+				sc.markActive()
+				outstanding := atomic.AddInt32(sc.inflight, 1)
+				if errors.Is(err, msg.VERSION_MISMATCH) {
+					// Don't try to interpret a message from a protocol version we don't know
+					s.rejectVersion(&sc, &msgout)
+					atomic.AddInt32(sc.inflight, -1)
+					continue
+				}
+				if err != nil {
+					// Skip the malformed message, answering it if its ID could be made out
+					s.cfg().Logger.Warn("Skipped malformed message", logging.F("client", sc.id()), logging.F("err", err))
+					if msgout.MessageId != 0 {
+						s.rejectRequests(&sc, &msgout, msg.StatusOf(err), err.Error())
+					}
+					atomic.AddInt32(sc.inflight, -1)
+					continue
 				}
-				if msgout.ListReq != nil {
-					s.handleListRequest(&sc, &msgout)
+				if !sc.isAllowed(&msgout) {
+					s.rejectUnauthenticated(&sc, &msgout)
+					atomic.AddInt32(sc.inflight, -1)
+					continue
 				}
-				if msgout.RelayReq != nil {
-					s.handleRelayRequest(&sc, &msgout)
+				if sc.requests != nil && isPoolable(&msgout) {
+					// The limit may have been lowered since the queue was made, but never raised past its capacity
+					if outstanding > int32(min(s.cfg().MaxPendingRequests, cap(sc.requests))) {
+						s.rejectRequests(&sc, &msgout, msg.BUSY, "too many requests outstanding")
+						atomic.AddInt32(sc.inflight, -1)
+					} else {
+						// Never blocks, as the queue has room for every outstanding request
+						sc.requests <- msgout
+					}
+					continue
 				}
+				s.handleMessage(&sc, &msgout)
+				atomic.AddInt32(sc.inflight, -1)
 			} else {
+				var de *msg.DecodeError
+				if errors.As(err, &de) {
+					s.cfg().Logger.Warn("Failed to decode message, disconnecting", logging.F("client", sc.id()), logging.F("err", err))
+					sc.setDisconnectReason(msg.ENCODING_ERROR)
+				}
 				break
 			}
 		}
 		// Close connection - this will trigger sender to shut down and clean up
 		sc.con.Close()
+		if sc.requests != nil {
+			close(sc.requests)
+			workers.Wait()
+		}
 		close(sc.responseMsgs)
 	}()
 }
 
+// Pass a message from the client to the handler for each request it contains, and answer them all in one message.
+// A message may combine several requests, which are handled in the order below, and each gets its response in
+// the matching field of the reply. Requests which have no response (such as Delivery Requests) add nothing to it.
+func (s *Server) handleMessage(sc *serverClient, mesg *msg.Message) {
+	tracer := s.cfg().Tracer
+	ctx, span := tracer.Start(tracer.Extract(context.Background(), mesg.Trace), "broadcast_hub.server.dispatch",
+		tracing.A("client", sc.id()), tracing.A("mid", mesg.MessageId))
+	defer span.End()
+	rsp := msg.Message{
+		Version:   msg.MyVersion,
+		MessageId: mesg.MessageId,
+	}
+	// Relays stored for a session taken over by the message, which follow the response
+	var backlogs []backlog
+	if mesg.AuthReq != nil {
+		backlogs = append(backlogs, s.handleAuthRequest(sc, mesg, &rsp))
+	}
+	if mesg.ResumeReq != nil {
+		backlogs = append(backlogs, s.handleResumeRequest(sc, mesg, &rsp))
+	}
+	if mesg.HelloReq != nil {
+		s.handleHelloRequest(sc, mesg, &rsp)
+	}
+	if mesg.PingReq != nil {
+		s.handlePingRequest(sc, mesg, &rsp)
+	}
+	if mesg.IdReq != nil {
+		s.handleIdRequest(sc, mesg, &rsp)
+	}
+	if mesg.ListReq != nil {
+		s.handleListRequest(sc, mesg, &rsp)
+	}
+	if mesg.RelayReq != nil && s.throttleRelay(sc) {
+		s.handleRelayRequest(ctx, sc, mesg, &rsp)
+	}
+	if mesg.RelayBatReq != nil {
+		s.handleRelayBatchRequest(ctx, sc, mesg, &rsp)
+	}
+	if mesg.SubReq != nil {
+		s.handleSubscribeRequest(sc, mesg, &rsp)
+	}
+	if mesg.UnsubReq != nil {
+		s.handleUnsubscribeRequest(sc, mesg, &rsp)
+	}
+	if mesg.DelivReq != nil {
+		s.handleDeliveryRequest(sc, mesg)
+	}
+	if mesg.FlowUpd != nil {
+		handleFlowUpdate(sc, mesg)
+	}
+	if mesg.NameReq != nil {
+		s.handleSetNameRequest(sc, mesg, &rsp)
+	}
+	if mesg.ResolvReq != nil {
+		s.handleResolveNameRequest(sc, mesg, &rsp)
+	}
+	if mesg.PresReq != nil {
+		s.handlePresenceRequest(sc, mesg, &rsp)
+	}
+	if mesg.GrpCreateReq != nil {
+		s.handleGroupCreateRequest(sc, mesg, &rsp)
+	}
+	if mesg.GrpJoinReq != nil {
+		s.handleGroupJoinRequest(sc, mesg, &rsp)
+	}
+	if mesg.GrpLeaveReq != nil {
+		s.handleGroupLeaveRequest(sc, mesg, &rsp)
+	}
+	if mesg.GrpListReq != nil {
+		s.handleGroupListRequest(sc, mesg, &rsp)
+	}
+	if mesg.HistReq != nil {
+		s.handleHistoryRequest(sc, mesg, &rsp)
+	}
+	if mesg.StatsReq != nil {
+		s.handleStatsRequest(sc, mesg, &rsp)
+	}
+
+	if rsp != (msg.Message{Version: rsp.Version, MessageId: rsp.MessageId}) {
+		sc.responseMsgs <- rsp
+	} else if !isUnderstood(mesg) {
+		// Nothing in the message was understood (or it only held messages meant for clients, such as Relay
+		// Indications), so tell the client rather than leaving it waiting
+		rsp.Error = &msg.ErrorResponse{Status: msg.UNSUPPORTED, Text: "no supported request in message"}
+		sc.responseMsgs <- rsp
+	}
+	for _, b := range backlogs {
+		s.deliverBacklog(sc, b.cid, b.relays)
+	}
+}
+
+// Check whether a message holds anything the hub expects from a client: any of the requests handled by
+// 'handleMessage', even one without a response, or a Ping Response to one of the hub's keepalives
+func isUnderstood(mesg *msg.Message) bool {
+	return mesg.PingRes != nil ||
+		mesg.AuthReq != nil || mesg.ResumeReq != nil || mesg.HelloReq != nil || mesg.PingReq != nil ||
+		mesg.IdReq != nil || mesg.ListReq != nil || mesg.RelayReq != nil || mesg.RelayBatReq != nil ||
+		mesg.SubReq != nil || mesg.UnsubReq != nil || mesg.DelivReq != nil || mesg.FlowUpd != nil ||
+		mesg.NameReq != nil || mesg.ResolvReq != nil || mesg.PresReq != nil || mesg.GrpCreateReq != nil ||
+		mesg.GrpJoinReq != nil || mesg.GrpLeaveReq != nil || mesg.GrpListReq != nil || mesg.HistReq != nil ||
+		mesg.StatsReq != nil
+}
+
 func (s *Server) startSender(sc serverClient) {
 	// Write messages to the transport, prioritising responses over relayed messages
 	go func() {
 		// Counter for unique MIDs in indications
 		relay_mid := uint32(0)
+		// Messages waiting to be written together
+		out := writeBuffer{}
+		// Once the server is going away, keep sending until everything outstanding has been flushed
+		going_away := s.going_away
+		draining := false
+		// Nothing can be encoded until the client's codec is known
+		select {
+		case <-sc.codec_known:
+		case <-going_away:
+			// The client hasn't sent anything yet, so flush what's queued for it using the default codec
+		}
 		for {
+			var drain_poll <-chan time.Time
+			if draining {
+				if sc.isIdle() {
+					break
+				}
+				drain_poll = time.After(drainPollInterval)
+			}
 			mesg := msg.Message{}
-			// Nested select for prioritization.
+			// Relays are sent with their shared encoding, rather than in 'mesg'
+			var relayed *msg.SharedRelay
+			// Nested select for prioritization, then relays in priority order
 			select {
 			case mesg = <-sc.responseMsgs:
+			case mesg = <-sc.controlMsgs:
 			default:
+				if relayed = sc.relayMsgs.poll(); relayed != nil {
+					break
+				}
 				select {
 				case mesg = <-sc.responseMsgs:
-				case relayed := <-sc.relayMsgs:
+				case mesg = <-sc.controlMsgs:
+				case relayed = <-sc.relayMsgs.high:
+				case relayed = <-sc.relayMsgs.normal:
+				case relayed = <-sc.relayMsgs.low:
+				case <-going_away:
+					going_away = nil
+					draining = true
+					sc.setDisconnectReason(msg.GOING_AWAY)
+					mesg.Version = msg.MyVersion
+					mesg.GoingAway = &msg.GoingAwayIndication{}
+				case <-drain_poll:
+					continue
+				}
+			}
+			status := msg.SUCCESS
+			if relayed != nil && relayed.Expired(time.Now()) {
+				// Stale, so it's better not sent at all, and the client can have its credit back
+				returnCredit(sc.credits)
+				s.expireRelay(sc.id(), &relayed.Ind, nil)
+			} else {
+				if relayed != nil {
 					mesg.Version = msg.MyVersion
 					mesg.MessageId = relay_mid
-					mesg.RelayInd = &relayed
 					relay_mid++
+					sc.markActive()
 				}
+				// Actually send the message
+				status = s.sendMessage(&sc, &out, mesg, relayed)
+			}
+			if status != msg.CONNECTION_ERROR && status != msg.SLOW_CONSUMER && (mesg.Disconnect != nil || !sc.hasQueued()) {
+				// Nothing else is ready to send (or nothing else will be), so don't keep what has been buffered waiting
+				status = s.flushMessages(&sc, &out)
 			}
-			// Actually send the message
-			if sc.sendMessage(mesg) == msg.CONNECTION_ERROR {
+			if status == msg.CONNECTION_ERROR || status == msg.SLOW_CONSUMER || mesg.Disconnect != nil {
 				break
 			}
 		}
 		// Cleanup
-		s.removeClient(sc.cid)
+		s.removeClient(&sc)
+		close(sc.removed)
+		s.hookDisconnect(&sc)
+		s.emit(ClientDisconnected{CID: sc.id(), Reason: sc.disconnectReason()})
+		s.senders.Done()
 		// Wait for dispatcher to shut down
 	shutdown_loop:
 		for {
@@ -204,91 +707,356 @@ func (s *Server) startSender(sc serverClient) {
 				panic("Failed to clean up serverClient!")
 			}
 		}
-		log.Printf("Removed Client %d\n", sc.cid)
+		s.cfg().Logger.Info("Removed Client", logging.F("client", sc.id()))
 	}()
 }
 
-// Handle an incoming ID Request Message
-func (s *Server) handleIdRequest(sc *serverClient, mesg *msg.Message) {
-	rsp := msg.Message{
-		Version:   msg.MyVersion,
-		MessageId: mesg.MessageId,
-		IdRes: &msg.IdentifyResponse{
-			Id: sc.cid,
-		},
+// Work out which codec the client is using, from the start of its first message.
+// Returns a decoder for the client's messages, or nil if the codec couldn't be detected or isn't allowed.
+func (s *Server) detectCodec(sc *serverClient) msg.StreamDecoder {
+	if len(s.cfg().AllowedCodecs) > 1 {
+		// The sender waits for the codec to be detected, unless there was only one to choose from
+		defer close(sc.codec_known)
+	}
+	codec, rest, err := msg.DetectCodec(countingReader{r: sc.con, count: sc.bytes_in})
+	if err != nil {
+		if errors.Is(err, msg.ErrUnknownCodec) {
+			s.cfg().Logger.Warn("Failed to detect codec", logging.F("client", sc.id()), logging.F("err", err))
+		}
+		return nil
+	}
+	if !s.cfg().allowsCodec(codec) {
+		s.cfg().Logger.Warn("Codec not allowed", logging.F("client", sc.id()), logging.F("codec", codec))
+		return nil
 	}
-	sc.responseMsgs <- rsp
+	atomic.StoreInt32(sc.codec, int32(codec))
+	return codec.TranscoderWithLimits(s.cfg().DecodeLimits).NewStreamDecoder(rest)
 }
 
-// Handle an incoming List Request Message (This has a potentially unbounded response size. Limited by number of connected clients.)
-func (s *Server) handleListRequest(sc *serverClient, mesg *msg.Message) {
-	rsp := msg.Message{
-		Version:   msg.MyVersion,
-		MessageId: mesg.MessageId,
-		ListRes: &msg.ListResponse{
-			Others: s.getClientIds(sc.cid),
-		},
+// Send keepalive pings to the client, and disconnect it if it stops responding
+func (s *Server) startPinger(sc serverClient) {
+	go func() {
+		ticker := time.NewTicker(s.cfg().PingInterval)
+		defer ticker.Stop()
+		// Counter for unique MIDs in pings
+		ping_mid := uint32(0)
+		for {
+			select {
+			case <-sc.removed:
+				return
+			case <-ticker.C:
+			}
+			if atomic.AddInt32(sc.pings_missed, 1) > int32(s.cfg().PingMissThreshold) {
+				s.cfg().Logger.Warn("Disconnecting Client", logging.F("client", sc.id()), logging.F("reason", msg.INACTIVE))
+				s.hookEvicted(&sc, msg.INACTIVE)
+				sc.disconnect(msg.INACTIVE)
+				return
+			}
+			ping := msg.Message{
+				Version:   msg.MyVersion,
+				MessageId: ping_mid,
+				PingReq:   &msg.PingRequest{},
+			}
+			ping_mid++
+			// If the control messages aren't being sent, there's no point queueing another ping
+			select {
+			case sc.controlMsgs <- ping:
+			default:
+			}
+		}
+	}()
+}
+
+// Disconnect the client once it has been idle for the IdleTimeout, neither sending anything nor being sent any relays.
+// With keepalive enabled, an idle client is pinged first, and is only disconnected if it doesn't answer within another
+// IdleTimeout.
+func (s *Server) startIdleTimer(sc serverClient) {
+	go func() {
+		timer := time.NewTimer(s.cfg().IdleTimeout)
+		defer timer.Stop()
+		// When the client was last pinged for being idle
+		var pinged time.Time
+		for {
+			select {
+			case <-sc.removed:
+				return
+			case <-timer.C:
+			}
+			active := time.Unix(0, atomic.LoadInt64(sc.last_active))
+			idle := time.Since(active)
+			if idle < s.cfg().IdleTimeout {
+				timer.Reset(s.cfg().IdleTimeout - idle)
+				continue
+			}
+			if s.cfg().PingInterval > 0 && (pinged.IsZero() || active.After(pinged)) {
+				// Idle, but it hasn't been pinged since it was last active
+				pinged = time.Now()
+				select {
+				case sc.controlMsgs <- msg.Message{Version: msg.MyVersion, PingReq: &msg.PingRequest{}}:
+				default:
+				}
+				timer.Reset(s.cfg().IdleTimeout)
+				continue
+			}
+			s.cfg().Logger.Warn("Disconnecting idle Client", logging.F("client", sc.id()), logging.F("idle", idle.Round(time.Millisecond)))
+			s.hookEvicted(&sc, msg.INACTIVE)
+			sc.disconnect(msg.INACTIVE)
+			return
+		}
+	}()
+}
+
+// Record that the client has just been active
+func (sc *serverClient) markActive() {
+	atomic.StoreInt64(sc.last_active, time.Now().UnixNano())
+}
+
+// Handle an incoming Ping Request Message
+func (s *Server) handlePingRequest(sc *serverClient, mesg *msg.Message, rsp *msg.Message) {
+	rsp.PingRes = &msg.PingResponse{}
+}
+
+// Handle an incoming ID Request Message
+func (s *Server) handleIdRequest(sc *serverClient, mesg *msg.Message, rsp *msg.Message) {
+	rsp.IdRes = &msg.IdentifyResponse{
+		Id:      sc.id(),
+		Session: s.sessionToken(sc.id()),
 	}
-	sc.responseMsgs <- rsp
 }
 
 // Handle an incoming Relay Request Message
-func (s *Server) handleRelayRequest(sc *serverClient, mesg *msg.Message) {
+func (s *Server) handleRelayRequest(ctx context.Context, sc *serverClient, mesg *msg.Message, rsp *msg.Message) {
+	rsp.RelayRes = s.relay(ctx, sc, mesg)
+}
+
+// Relay the Relay Request in a message, returning the response to it.
+// The message ID identifies the relay, in its acknowledgements and failures.
+func (s *Server) relay(ctx context.Context, sc *serverClient, mesg *msg.Message) *msg.RelayResponse {
 	// Iterate through all clients' buffered channels, and send the message to each of them,
 	// if it can be done without blocking. Otherwise, fail with NO_BUFFER.
-	rsp := msg.Message{
-		Version:   msg.MyVersion,
-		MessageId: mesg.MessageId,
-		RelayRes: &msg.RelayResponse{
-			Status:    msg.SUCCESS,
-			StatusMap: make(msg.ClientStatusMap),
-		},
+	rsp := &msg.RelayResponse{
+		Status:    msg.SUCCESS,
+		StatusMap: make(msg.ClientStatusMap),
 	}
-	if len(mesg.RelayReq.Dest) > 255 || len(mesg.RelayReq.Msg) > 1024 {
-		rsp.RelayRes.Status = msg.TOO_LONG
+	now := time.Now()
+	s.relayRate(sc.ns()).record(now)
+	ind := msg.RelayIndication{
+		Src:         sc.id(),
+		Msg:         mesg.RelayReq.Msg,
+		ContentType: mesg.RelayReq.ContentType,
+		Timestamp:   msg.TimestampOf(now),
+		Priority:    mesg.RelayReq.Priority.Clamp(),
+		TTL:         mesg.RelayReq.TTL,
+		Compression: mesg.RelayReq.Compression,
+	}
+	retry := s.newRelayRetry(sc, mesg)
+	if mesg.RelayReq.AckRequested {
+		ind.AckRequested = true
+		ind.RelayId = mesg.MessageId
+	}
+	var claimed, original *dedupEntry
+	// Status of every destination the relay was sent to
+	var statuses msg.ClientStatusMap
+	if len(mesg.RelayReq.Dest) > 255 || len(mesg.RelayReq.Msg) > 1024 || len(mesg.RelayReq.Topic) > maxTopicLength ||
+		len(mesg.RelayReq.ContentType) > maxContentTypeLength || len(mesg.RelayReq.DestGroups) > 255 ||
+		len(mesg.RelayReq.MsgUUID) > maxMsgUUIDLength {
+		rsp.Status = msg.TOO_LONG
+		s.hookRelayDenied(sc, mesg, msg.TOO_LONG, nil)
+	} else if claimed, original = s.claimRelay(sc.id(), mesg.RelayReq.MsgUUID); original != nil {
+		// A retry of a relay that has already been sent, so answer it the same way without relaying it again
+		*rsp = original.response()
+		s.cfg().Logger.Debug("Dropped duplicate relay", logging.F("client", sc.id()), logging.F("uuid", mesg.RelayReq.MsgUUID))
+	} else if status := s.checkQuota(sc); status != msg.SUCCESS {
+		rsp.Status = status
+		s.hookRelayDenied(sc, mesg, status, nil)
+	} else if status := s.hookRelay(sc, mesg); status != msg.SUCCESS {
+		rsp.Status = status
+	} else if status := s.filterRelay(sc, mesg); status != msg.SUCCESS {
+		rsp.Status = status
+	} else if mesg.RelayReq.Topic != "" {
+		// Topic relays ignore the destination list, and go to all other subscribers
+		ind.Topic = mesg.RelayReq.Topic
+		s.recordHistory(historyKey{ns: sc.ns(), topic: ind.Topic}, ind)
+		statuses = s.sendRelays(ctx, s.getTopicMembers(sc.ns(), ind.Topic, sc.id()), sc.ns(), ind, retry)
+	} else if mesg.RelayReq.Broadcast {
+		// Broadcasts ignore the destination list, and go to everybody except the sender
+		statuses = s.sendRelays(ctx, s.getClientIds(sc.ns(), sc.id()), sc.ns(), ind, retry)
+	} else if len(mesg.RelayReq.DestGroups) > 0 {
+		// Group relays go to the destination list, and every other member of the groups
+		dests, status := s.resolveDestGroups(mesg.RelayReq.Dest, mesg.RelayReq.DestGroups, sc.ns(), sc.id())
+		if status == msg.SUCCESS {
+			dests, self := s.checkSelfRelay(dests, ind.Src, mesg.RelayReq)
+			statuses = s.sendRelays(ctx, dests, sc.ns(), ind, retry)
+			if self {
+				statuses[ind.Src] = msg.SELF_RELAY
+			}
+		} else {
+			rsp.Status = status
+			s.hookRelayDenied(sc, mesg, status, nil)
+		}
 	} else {
-		rsp.RelayRes.StatusMap = s.sendRelays(sc, mesg)
+		dests, self := s.checkSelfRelay(mesg.RelayReq.Dest, ind.Src, mesg.RelayReq)
+		statuses = s.sendRelays(ctx, dests, sc.ns(), ind, retry)
+		if self {
+			statuses[ind.Src] = msg.SELF_RELAY
+		}
+	}
+	// Number of destinations the relay was sent to
+	sent := 0
+	if statuses != nil {
+		rsp.StatusMap, sent = reportStatuses(statuses, mesg.RelayReq.Verbosity)
 	}
-	sc.responseMsgs <- rsp
+	s.chargeRelay(sc, &ind, sent)
+	s.completeRelay(claimed, rsp)
+	s.auditRelay(sc, mesg.RelayReq, now, rsp, statuses)
+	return rsp
 }
 
-// Handle forwarding the relay messages to each individual destination
-func (s *Server) sendRelays(sc *serverClient, request *msg.Message) msg.ClientStatusMap {
-	statusMap := make(msg.ClientStatusMap)
-	ind := msg.RelayIndication{
-		Src: sc.cid,
-		Msg: request.RelayReq.Msg,
-	}
-	for _, cid := range request.RelayReq.Dest {
-		s.clients_mutex.RLock()
-		dest_client, ok := s.clients[cid]
-		if !ok {
-			statusMap[cid] = msg.INVALID_ID
-			s.clients_mutex.RUnlock()
-			continue
+// Handle an incoming Delivery Request Message, by forwarding it to the original relay's source.
+// Delivery acknowledgements are best effort, and are dropped if the destination isn't keeping up.
+func (s *Server) handleDeliveryRequest(sc *serverClient, mesg *msg.Message) {
+	s.clients_mutex.RLock()
+	dest_client, ok := s.clients[mesg.DelivReq.Dest]
+	s.clients_mutex.RUnlock()
+	if !ok || dest_client.ns() != sc.ns() {
+		return
+	}
+	ind := msg.Message{
+		Version: msg.MyVersion,
+		DelivInd: &msg.DeliveryIndication{
+			Src:     sc.id(),
+			RelayId: mesg.DelivReq.RelayId,
+		},
+	}
+	select {
+	case dest_client.controlMsgs <- ind:
+	default:
+	}
+}
+
+// Remove the sender from a relay's destinations, unless loopback is allowed by the server or the request.
+// Returns the destinations left, and whether the sender had to be removed.
+func (s *Server) checkSelfRelay(dests []msg.ClientId, src msg.ClientId, req *msg.RelayRequest) ([]msg.ClientId, bool) {
+	if s.cfg().AllowLoopback || req.Loopback {
+		return dests, false
+	}
+	others := make([]msg.ClientId, 0, len(dests))
+	for _, cid := range dests {
+		if cid != src {
+			others = append(others, cid)
+		}
+	}
+	return others, len(others) != len(dests)
+}
+
+// Handle forwarding the relay indication to each individual destination, from a client in namespace 'ns'.
+// If 'retry' is set, destinations with full buffers are queued to be retried instead of failing.
+// Returns the status of every destination, including the successful ones.
+// The relay carries the trace context of the fan-out's span, which is a child of the span in 'ctx'.
+func (s *Server) sendRelays(ctx context.Context, dests []msg.ClientId, ns string, ind msg.RelayIndication, retry *relayRetry) msg.ClientStatusMap {
+	targets := s.lookupTargets(dests, ns)
+	statuses := make([]msg.Status, len(targets))
+	// Deadline for the OverflowBlock policy, shared by all destinations
+	deadline := time.Now().Add(s.cfg().BlockTimeout)
+	ctx, span := s.cfg().Tracer.Start(ctx, "broadcast_hub.server.fanout", tracing.A("destinations", len(targets)))
+	defer span.End()
+	relay := s.shareRelay(ind)
+	relay.Trace = s.cfg().Tracer.Inject(ctx)
+	s.fanOut(targets, statuses, relay, retry, deadline)
+
+	statusMap := make(msg.ClientStatusMap, len(targets))
+	sent := 0
+	for i, status := range statuses {
+		if status == msg.SUCCESS {
+			sent++
+		}
+		statusMap[targets[i].cid] = status
+	}
+	span.SetAttributes(tracing.A("sent", sent))
+	return statusMap
+}
+
+// Share a relay indication to be buffered for its destinations, with a deadline for sending it if the server has a
+// RelayDeadline
+func (s *Server) shareRelay(ind msg.RelayIndication) *msg.SharedRelay {
+	relay := msg.NewSharedRelay(ind)
+	if deadline := s.cfg().RelayDeadline; deadline > 0 {
+		relay.Deadline = time.Now().Add(deadline)
+	}
+	return relay
+}
+
+// Get the statuses to report to the sender of a relay, from the status of every destination: only the failures,
+// unless it asked for VerbosityAll. Also returns how many destinations the relay was sent to.
+func reportStatuses(statuses msg.ClientStatusMap, verbosity msg.Verbosity) (msg.ClientStatusMap, int) {
+	reported := statuses
+	if verbosity != msg.VerbosityAll {
+		reported = make(msg.ClientStatusMap)
+	}
+	sent := 0
+	for cid, status := range statuses {
+		if status == msg.SUCCESS {
+			sent++
+		} else if verbosity != msg.VerbosityAll {
+			reported[cid] = status
+		}
+	}
+	return reported, sent
+}
+
+// Add a relay indication to a destination's buffered channel, following the configured overflow policy.
+// 'credits' are the destination's flow control credits, one of which is used up if the relay is added.
+func (s *Server) enqueueRelay(dest_chan chan *msg.SharedRelay, credits *int64, ind *msg.SharedRelay, deadline time.Time) (status msg.Status) {
+	if !takeCredit(credits) {
+		return msg.NO_BUFFER
+	}
+	defer func() {
+		if status != msg.SUCCESS {
+			returnCredit(credits)
 		}
-		dest_chan := dest_client.relayMsgs
-		s.clients_mutex.RUnlock()
+	}()
+
+	//Nonblocking send to buffered channel
+	select {
+	case dest_chan <- ind:
+		return msg.SUCCESS
+	default:
+	}
 
-		//Nonblocking send to buffered channel
+	switch s.cfg().OverflowPolicy {
+	case OverflowDropOldest:
+		// Make room by discarding the oldest relay. The sender may be draining the channel concurrently,
+		// and other dispatchers filling it, so only try a bounded number of times.
+		for i := 0; i < cap(dest_chan)+1; i++ {
+			select {
+			case <-dest_chan:
+				// The discarded relay's credit goes to the new one
+				returnCredit(credits)
+			default:
+			}
+			select {
+			case dest_chan <- ind:
+				return msg.SUCCESS
+			default:
+			}
+		}
+	case OverflowBlock:
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
 		select {
 		case dest_chan <- ind:
-			// Success! (We don't report successes in the response)
-			// The client will receive the relay indication soon, unless it disconnects first. (best effort relay)
-			// TODO: Do we want a better delivery guarantee?
-		default:
-			statusMap[cid] = msg.NO_BUFFER
-			continue
+			return msg.SUCCESS
+		case <-timer.C:
 		}
 	}
-	return statusMap
+	return msg.NO_BUFFER
 }
 
 // Close all listeners
 func (s *Server) closeAllListeners() {
 	s.listeners_mutex.Lock()
-	for _, l := range s.listeners {
-		l.Close()
+	for _, sl := range s.listeners {
+		sl.close()
 	}
 	s.listeners_mutex.Unlock()
 }
@@ -297,47 +1065,98 @@ func (s *Server) closeAllListeners() {
 func (s *Server) closeAllClients() {
 	s.clients_mutex.RLock()
 	for _, cli := range s.clients {
-		cli.con.Close()
+		cli.disconnect(msg.GOING_AWAY)
 	}
 	s.clients_mutex.RUnlock()
 }
 
-// Remove a client from server mapping, and close its connection.
+// Remove a client from server mapping, all topics and groups, and its name, and close its connection.
+// Its session is kept, so it can be resumed later.
 // This should only be called by the sender goroutine.
-func (s *Server) removeClient(cid msg.ClientId) {
+func (s *Server) removeClient(sc *serverClient) {
 	s.clients_mutex.Lock()
+	// Read the ID under the lock, as it may be changed by a resume
+	cid := sc.id()
 	cli, ok := s.clients[cid]
 	if ok {
 		cli.con.Close()
+		s.releaseAddress(cli.ip)
 	}
 	delete(s.clients, cid)
 	s.clients_mutex.Unlock()
+	if ok {
+		s.notifyPresence(sc, cid, sc.ns(), false)
+		s.detachBackplane(cid)
+	}
+	s.unsubscribeAll(cid)
+	s.leaveAllGroups(cid)
+	s.clearName(cid)
+	if s.cfg().MessageStore != nil {
+		s.suspendSession(cid, sc.ns())
+	} else {
+		s.dropHistory(cid)
+	}
 }
 
-// Get a new slice of all client IDs, removing the ID of the caller
-func (s *Server) getClientIds(except_cid msg.ClientId) []msg.ClientId {
+// Get a new slice of the IDs of all clients in a namespace, removing the ID of the caller
+func (s *Server) getClientIds(ns string, except_cid msg.ClientId) []msg.ClientId {
 	s.clients_mutex.RLock()
-	cids := make([]msg.ClientId, len(s.clients)-1)
-	i := 0
-	for k := range s.clients {
-		if k != except_cid {
-			cids[i] = k
-			i++
+	// The caller may already have been removed from the map, so don't assume its presence
+	cids := make([]msg.ClientId, 0, len(s.clients))
+	for k, sc := range s.clients {
+		if k != except_cid && sc.ns() == ns && !s.isHidden(&sc) {
+			cids = append(cids, k)
 		}
 	}
 	s.clients_mutex.RUnlock()
 	return cids
 }
 
-// Encode and send a message over the transport to the client
-func (sc *serverClient) sendMessage(m msg.Message) msg.Status {
-	encoded_msg, ok := sc.tc.Encode(m)
-	if !ok {
-		return msg.ENCODING_ERROR
-	}
-	n, err := sc.con.Write(encoded_msg)
-	if (err != nil) || (n != len(encoded_msg)) {
-		return msg.CONNECTION_ERROR
+// Get the client's current ID
+func (sc *serverClient) id() msg.ClientId {
+	return msg.ClientId(atomic.LoadUint64(sc.cid))
+}
+
+// Check whether there is nothing left to send to the client: no requests being handled, and nothing buffered
+func (sc *serverClient) isIdle() bool {
+	return atomic.LoadInt32(sc.inflight) == 0 && len(sc.controlMsgs) == 0 && sc.relayMsgs.len() == 0
+}
+
+// Encode and send a message over the transport to the client, using the protocol version agreed with it.
+// If 'relay' is set, the message is a Relay Indication carrying it, with the message ID from 'm'.
+// The message may be held in the write buffer, to be written along with the messages after it.
+// This should only be called by the sender goroutine.
+func (s *Server) sendMessage(sc *serverClient, wb *writeBuffer, m msg.Message, relay *msg.SharedRelay) msg.Status {
+	m.Version = msg.Version(atomic.LoadInt32(sc.version))
+	return s.bufferMessage(sc, wb, m, relay)
+}
+
+// Write an encoded message to the client, with a deadline for each write if a WriteTimeout is configured.
+// A write that times out is retried from where it left off, until SlowWriteLimit writes in a row have timed out,
+// at which point the client is disconnected as a SLOW_CONSUMER.
+func (s *Server) writeMessage(sc *serverClient, b []byte) msg.Status {
+	// Counted before writing, so the client can't see a message that hasn't been counted yet
+	atomic.AddUint64(sc.bytes_out, uint64(len(b)))
+	for len(b) > 0 {
+		if s.cfg().WriteTimeout > 0 {
+			sc.con.SetWriteDeadline(time.Now().Add(s.cfg().WriteTimeout))
+		}
+		n, err := sc.con.Write(b)
+		b = b[n:]
+		var net_err net.Error
+		if errors.As(err, &net_err) && net_err.Timeout() {
+			if atomic.AddInt32(sc.write_timeouts, 1) >= int32(s.cfg().SlowWriteLimit) {
+				s.cfg().Logger.Warn("Disconnecting Client", logging.F("client", sc.id()), logging.F("reason", msg.SLOW_CONSUMER))
+				s.hookEvicted(sc, msg.SLOW_CONSUMER)
+				sc.disconnect(msg.SLOW_CONSUMER)
+				return msg.SLOW_CONSUMER
+			}
+			continue
+		}
+		if err != nil {
+			return msg.CONNECTION_ERROR
+		}
+		atomic.StoreInt32(sc.write_timeouts, 0)
 	}
 	return msg.SUCCESS
 }
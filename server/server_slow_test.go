@@ -8,41 +8,13 @@ import (
 
 	"github.com/CiaranWoodward/broadcast_hub/client"
 	"github.com/CiaranWoodward/broadcast_hub/msg"
+	"github.com/CiaranWoodward/broadcast_hub/testutil"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/goleak"
 )
 
-const (
-	byte_time_1kbps = time.Millisecond
-)
-
-// Make a connection slow, to simulate real-ish connection behaviour
-func makeSlow(con net.Conn, byte_time time.Duration) net.Conn {
-	in, out := net.Pipe()
-
-	forwarder := func(in, out net.Conn) {
-		for {
-			buffer := make([]byte, 10)
-			n, err := in.Read(buffer)
-			if err != nil {
-				out.Close()
-				break
-			}
-			buffer = buffer[:n]
-			<-time.After(time.Millisecond * time.Duration(n))
-			n2, err := out.Write(buffer)
-			if n2 != n || err != nil {
-				in.Close()
-				break
-			}
-		}
-	}
-
-	go forwarder(con, in)
-	go forwarder(in, con)
-
-	return out
-}
+// Roughly a 1kbps connection, in each direction
+var slow_1kbps = testutil.Faults{Bandwidth: 1000, ChunkSize: 10}
 
 func TestSlowClient(t *testing.T) {
 	// Test that a slow client won't be overloaded by fast neighbors
@@ -55,16 +27,16 @@ func TestSlowClient(t *testing.T) {
 	cli, ser := net.Pipe()
 	client_fast := client.NewClient(cli)
 	server.AddClientByConnection(ser)
-	fast_cid, status := client_fast.GetClientId()
-	assert.Equal(t, msg.SUCCESS, status)
+	fast_cid, err := client_fast.GetClientId()
+	assert.Nil(t, err)
 
 	// Create the slow client
 	cli, ser = net.Pipe()
-	cli = makeSlow(cli, byte_time_1kbps)
+	cli = testutil.Wrap(cli, slow_1kbps, slow_1kbps)
 	client_slow := client.NewClient(cli)
 	server.AddClientByConnection(ser)
-	slow_cid, status := client_slow.GetClientId()
-	assert.Equal(t, msg.SUCCESS, status)
+	slow_cid, err := client_slow.GetClientId()
+	assert.Nil(t, err)
 
 	// Make a long message to send
 	longMessage := make([]byte, 1000)
@@ -85,19 +57,19 @@ func TestSlowClient(t *testing.T) {
 	go receiver(client_slow)
 
 	// Send a message in each direction to check that works
-	csm, status := client_fast.RelayMessage(longMessage, []msg.ClientId{slow_cid})
+	csm, err := client_fast.RelayMessage(longMessage, []msg.ClientId{slow_cid})
 	assert.Len(t, csm, 0)
-	assert.Equal(t, msg.SUCCESS, status)
-	csm, status = client_slow.RelayMessage(longMessage, []msg.ClientId{fast_cid})
+	assert.Nil(t, err)
+	csm, err = client_slow.RelayMessage(longMessage, []msg.ClientId{fast_cid})
 	assert.Len(t, csm, 0)
-	assert.Equal(t, msg.SUCCESS, status)
+	assert.Nil(t, err)
 
 	// Send 15 messages from fast to slow with 1ms spacing, record statuses
 	n_messages := 15
 	statuses := make([]msg.Status, n_messages)
 	for i := 0; i < n_messages; i++ {
-		csm, status := client_fast.RelayMessage(longMessage, []msg.ClientId{slow_cid})
-		assert.Equal(t, msg.SUCCESS, status)
+		csm, err := client_fast.RelayMessage(longMessage, []msg.ClientId{slow_cid})
+		assert.Nil(t, err)
 		status, ok := csm[slow_cid]
 		if ok {
 			statuses[i] = status
@@ -128,3 +100,36 @@ func TestSlowClient(t *testing.T) {
 	assert.True(t, recovered)
 	server.Close()
 }
+
+func TestChaoticClient(t *testing.T) {
+	// Test that a client disconnecting part way through a message doesn't upset anyone else
+	defer goleak.VerifyNone(t)
+
+	server := NewServer()
+
+	cli, ser := net.Pipe()
+	client_good := client.NewClient(cli)
+	server.AddClientByConnection(ser)
+	good_cid, err := client_good.GetClientId()
+	assert.Nil(t, err)
+
+	// The chaotic client's connection drops after its first message, and part of the second
+	cli, ser = net.Pipe()
+	cli = testutil.Wrap(cli, testutil.Faults{DisconnectAfter: 30, ChunkSize: 1}, testutil.Faults{})
+	client_chaos := client.NewClient(cli)
+	server.AddClientByConnection(ser)
+	_, err = client_chaos.GetClientId()
+	assert.Nil(t, err)
+	_, err = client_chaos.RelayMessage([]byte("Hello there, this message won't make it"), []msg.ClientId{good_cid})
+	assert.NotNil(t, err)
+
+	// The server drops the chaotic client, and carries on serving the good one
+	assert.Eventually(t, func() bool {
+		cids, err := client_good.ListOtherClients()
+		return err == nil && len(cids) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	client_chaos.Close()
+	client_good.Close()
+	server.Close()
+}
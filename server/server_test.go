@@ -1,12 +1,26 @@
 package server
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/CiaranWoodward/broadcast_hub/client"
+	"github.com/CiaranWoodward/broadcast_hub/logging"
 	"github.com/CiaranWoodward/broadcast_hub/msg"
+	"github.com/CiaranWoodward/broadcast_hub/tracing"
+	"github.com/CiaranWoodward/broadcast_hub/transport/ws"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/goleak"
 )
@@ -30,8 +44,8 @@ func TestServerAndClient(t *testing.T) {
 			cli, ser := net.Pipe()
 			server.AddClientByConnection(ser)
 			tc := client.NewClient(cli)
-			cid, status := tc.GetClientId()
-			assert.Equal(t, msg.SUCCESS, status)
+			cid, err := tc.GetClientId()
+			assert.Nil(t, err)
 			// Output the cid that was obtained for uniqueness checking
 			cid_chan <- cid
 
@@ -53,8 +67,8 @@ func TestServerAndClient(t *testing.T) {
 	cli, ser := net.Pipe()
 	server.AddClientByConnection(ser)
 	tc := client.NewClient(cli)
-	cids, status := tc.ListOtherClients()
-	assert.Equal(t, msg.SUCCESS, status)
+	cids, err := tc.ListOtherClients()
+	assert.Nil(t, err)
 
 	for _, cid := range cids {
 		_, exists := cid_set[cid]
@@ -65,8 +79,8 @@ func TestServerAndClient(t *testing.T) {
 	//Verify that it is correctly relayed to the non-invalid IDs
 	invalid_id := msg.ClientId(0x7621a3c5418eb972)
 	cids = append(cids, invalid_id)
-	csm, status := tc.RelayMessage([]byte{1, 2, 3, 4, 5}, cids)
-	assert.Equal(t, msg.SUCCESS, status)
+	csm, err := tc.RelayMessage([]byte{1, 2, 3, 4, 5}, cids)
+	assert.Nil(t, err)
 	assert.Equal(t, len(csm), 1)
 	assert.Equal(t, msg.INVALID_ID, csm[invalid_id])
 
@@ -98,8 +112,8 @@ func TestServerListener(t *testing.T) {
 			tc := client.NewClient(conn)
 
 			// Verify connection
-			_, status := tc.GetClientId()
-			assert.Equal(t, status, msg.SUCCESS)
+			_, err = tc.GetClientId()
+			assert.Nil(t, err)
 
 			wg_setup.Done()
 
@@ -117,13 +131,3689 @@ func TestServerListener(t *testing.T) {
 	conn, err := net.Dial("tcp", serverAddr)
 	assert.Nil(t, err)
 	tc := client.NewClient(conn)
-	cids, status := tc.ListOtherClients()
-	assert.Equal(t, msg.SUCCESS, status)
-	csm, status := tc.RelayMessage([]byte{255, 0}, cids)
-	assert.Equal(t, msg.SUCCESS, status)
+	cids, err := tc.ListOtherClients()
+	assert.Nil(t, err)
+	csm, err := tc.RelayMessage([]byte{255, 0}, cids)
+	assert.Nil(t, err)
 	assert.Equal(t, 0, len(csm))
 
 	// Wait for all of the clients to exit
 	wg_done.Wait()
+
+	// A listener closed while the server is running is forgotten, but its clients stay connected
+	listener.Close()
+	assert.Eventually(t, func() bool {
+		server.listeners_mutex.Lock()
+		defer server.listeners_mutex.Unlock()
+		return len(server.listeners) == 0
+	}, time.Second, time.Millisecond)
+	_, err = tc.Ping()
+	assert.Nil(t, err)
+	tc.Close()
+	server.Close()
+}
+
+func TestServerBroadcast(t *testing.T) {
+	// Test that a broadcast reaches every other client, but not the sender
+	defer goleak.VerifyNone(t)
+
+	server := NewServer()
+
+	n_clients := 10
+	clients := make([]*client.Client, n_clients)
+	for i := range clients {
+		cli, ser := net.Pipe()
+		server.AddClientByConnection(ser)
+		clients[i] = client.NewClient(cli)
+		_, err := clients[i].GetClientId()
+		assert.Nil(t, err)
+	}
+
+	// Broadcast from the first client
+	sender := clients[0]
+	sender_cid, _ := sender.GetClientId()
+	csm, err := sender.BroadcastMessage([]byte{9, 8, 7})
+	assert.Nil(t, err)
+	assert.Len(t, csm, 0)
+
+	for _, cli := range clients[1:] {
+		ind := <-cli.Relays
+		assert.Equal(t, sender_cid, ind.Src)
+		assert.Equal(t, []byte{9, 8, 7}, ind.Msg)
+	}
+
+	// The sender should not have received its own broadcast
+	select {
+	case <-sender.Relays:
+		t.Error("Sender received its own broadcast")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	server.Close()
+	for _, cli := range clients {
+		cli.Close()
+	}
+}
+
+func TestServerFanOut(t *testing.T) {
+	// Test that a relay shared between fan-out workers reaches every destination, with a status for each failure
+	defer goleak.VerifyNone(t)
+
+	cfg := DefaultServerConfig()
+	cfg.FanOutWorkers = 4
+	server := NewServerWithConfig(cfg)
+
+	n_clients := 100
+	clients := make([]*client.Client, n_clients)
+	dests := []msg.ClientId{}
+	for i := range clients {
+		cli, ser := net.Pipe()
+		server.AddClientByConnection(ser)
+		clients[i] = client.NewClient(cli)
+		cid, err := clients[i].GetClientId()
+		assert.Nil(t, err)
+		if i > 0 {
+			dests = append(dests, cid)
+		}
+	}
+	dests = append(dests, 9999)
+
+	sender := clients[0]
+	csm, err := sender.RelayMessage([]byte{1}, dests)
+	assert.Nil(t, err)
+	assert.Equal(t, msg.ClientStatusMap{9999: msg.INVALID_ID}, csm)
+
+	csm, err = sender.RelayMessage([]byte{2}, dests[:n_clients-1])
+	assert.Nil(t, err)
+	assert.Len(t, csm, 0)
+
+	// Each destination is only handled by one worker, so still gets the relays in order
+	for _, cli := range clients[1:] {
+		ind := <-cli.Relays
+		assert.Equal(t, []byte{1}, ind.Msg)
+		ind = <-cli.Relays
+		assert.Equal(t, []byte{2}, ind.Msg)
+	}
+
+	server.Close()
+	for _, cli := range clients {
+		cli.Close()
+	}
+}
+
+func TestServerTopics(t *testing.T) {
+	// Test that topic relays are only received by subscribers
+	defer goleak.VerifyNone(t)
+
+	server := NewServer()
+
+	newClient := func() *client.Client {
+		cli, ser := net.Pipe()
+		server.AddClientByConnection(ser)
+		return client.NewClient(cli)
+	}
+	publisher := newClient()
+	subscriber := newClient()
+	bystander := newClient()
+	pub_cid, _ := publisher.GetClientId()
+
+	relays, err := subscriber.Subscribe("news")
+	assert.Nil(t, err)
+
+	csm, err := publisher.PublishMessage("news", []byte{4, 2})
+	assert.Nil(t, err)
+	assert.Len(t, csm, 0)
+
+	ind := <-relays
+	assert.Equal(t, pub_cid, ind.Src)
+	assert.Equal(t, "news", ind.Topic)
+	assert.Equal(t, []byte{4, 2}, ind.Msg)
+
+	select {
+	case <-bystander.Relays:
+		t.Error("Non-subscriber received a topic relay")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// After unsubscribing, there is nobody left to publish to
+	assert.Nil(t, subscriber.Unsubscribe("news"))
+	_, ok := <-relays
+	assert.False(t, ok)
+	publisher.PublishMessage("news", []byte{4, 2})
+	select {
+	case <-subscriber.Relays:
+		t.Error("Unsubscribed client received a topic relay")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	server.Close()
+	publisher.Close()
+	subscriber.Close()
+	bystander.Close()
+}
+
+func TestServerOverflowPolicy(t *testing.T) {
+	// Test each overflow policy directly against a full destination buffer
+	defer goleak.VerifyNone(t)
+
+	fill := func(server *Server) chan *msg.SharedRelay {
+		dest := make(chan *msg.SharedRelay, server.cfg().RelayBufferSize)
+		for i := 0; i < server.cfg().RelayBufferSize; i++ {
+			dest <- msg.NewSharedRelay(msg.RelayIndication{Msg: []byte{byte(i)}})
+		}
+		return dest
+	}
+	newest := msg.NewSharedRelay(msg.RelayIndication{Msg: []byte{0xFF}})
+
+	t.Run("Reject", func(t *testing.T) {
+		server := NewServerWithConfig(ServerConfig{RelayBufferSize: 2})
+		dest := fill(server)
+		assert.Equal(t, msg.NO_BUFFER, server.enqueueRelay(dest, nil, newest, time.Now()))
+		assert.Equal(t, []byte{0}, (<-dest).Ind.Msg)
+	})
+
+	t.Run("DropOldest", func(t *testing.T) {
+		server := NewServerWithConfig(ServerConfig{RelayBufferSize: 2, OverflowPolicy: OverflowDropOldest})
+		dest := fill(server)
+		assert.Equal(t, msg.SUCCESS, server.enqueueRelay(dest, nil, newest, time.Now()))
+		assert.Equal(t, []byte{1}, (<-dest).Ind.Msg)
+		assert.Equal(t, []byte{0xFF}, (<-dest).Ind.Msg)
+	})
+
+	t.Run("BlockTimeout", func(t *testing.T) {
+		server := NewServerWithConfig(ServerConfig{RelayBufferSize: 2, OverflowPolicy: OverflowBlock, BlockTimeout: 50 * time.Millisecond})
+		dest := fill(server)
+		start := time.Now()
+		assert.Equal(t, msg.NO_BUFFER, server.enqueueRelay(dest, nil, newest, start.Add(server.cfg().BlockTimeout)))
+		assert.GreaterOrEqual(t, int64(time.Since(start)), int64(server.cfg().BlockTimeout))
+	})
+
+	t.Run("BlockSuccess", func(t *testing.T) {
+		server := NewServerWithConfig(ServerConfig{RelayBufferSize: 2, OverflowPolicy: OverflowBlock, BlockTimeout: time.Second})
+		dest := fill(server)
+		go func() {
+			<-time.After(20 * time.Millisecond)
+			<-dest
+		}()
+		assert.Equal(t, msg.SUCCESS, server.enqueueRelay(dest, nil, newest, time.Now().Add(server.cfg().BlockTimeout)))
+	})
+}
+
+func TestServerConfigDefaults(t *testing.T) {
+	server := NewServerWithConfig(ServerConfig{})
+	assert.Equal(t, DefaultServerConfig(), *server.cfg())
+}
+
+func TestServerKeepalive(t *testing.T) {
+	// Test that clients which respond to pings stay connected, and those that don't are evicted
+	defer goleak.VerifyNone(t)
+
+	server := NewServerWithConfig(ServerConfig{PingInterval: 10 * time.Millisecond, PingMissThreshold: 2})
+
+	// A real client, which responds automatically
+	cli, ser := net.Pipe()
+	server.AddClientByConnection(ser)
+	tc := client.NewClient(cli)
+	_, err := tc.Ping()
+	assert.Nil(t, err)
+
+	// A dead client, which reads but never responds
+	dead, ser := net.Pipe()
+	server.AddClientByConnection(ser)
+	evicted := make(chan struct{})
+	go func() {
+		sd := (&msg.CborTranscoder{}).NewStreamDecoder(dead)
+		for {
+			if _, err := sd.DecodeNext(); err != nil {
+				break
+			}
+		}
+		close(evicted)
+	}()
+
+	select {
+	case <-evicted:
+	case <-time.After(time.Second):
+		t.Error("Dead client was not evicted")
+	}
+
+	// The real client should still be connected, and the dead one gone
+	assert.Eventually(t, func() bool {
+		cids, err := tc.ListOtherClients()
+		return err == nil && len(cids) == 0
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, msg.SUCCESS, tc.DisconnectReason())
+
+	server.Close()
+	tc.Close()
+	dead.Close()
+}
+
+func TestServerKeepaliveRequests(t *testing.T) {
+	// Test that answering the server's keepalive pings doesn't disturb the client's own requests, whose message IDs
+	// overlap those of the pings
+	defer goleak.VerifyNone(t)
+
+	server := NewServerWithConfig(ServerConfig{
+		AllowedCodecs:     []msg.Codec{msg.CodecJSON},
+		PingInterval:      5 * time.Millisecond,
+		PingMissThreshold: 1000,
+	})
+	cli, ser := net.Pipe()
+	server.AddClientByConnection(ser)
+	dec := msg.CodecJSON.Transcoder().NewStreamDecoder(cli)
+	// Answer each ping along with a request using the same message ID, and start another request with a different
+	// one, so requests are always in flight while the pings are answered
+	outstanding := map[uint32]bool{100: true}
+	next_mid := uint32(101)
+	go cli.Write([]byte(`{"bhubver":1,"id":100,"ir":{}}`))
+	for pings := 0; pings < 5 || len(outstanding) > 0; {
+		rsp, err := dec.DecodeNext()
+		if !assert.Nil(t, err) {
+			break
+		}
+		if rsp.PingReq != nil {
+			pings++
+			outstanding[rsp.MessageId] = true
+			out := fmt.Sprintf(`{"bhubver":1,"id":%d,"PR":{}}{"bhubver":1,"id":%d,"ir":{}}`, rsp.MessageId, rsp.MessageId)
+			if pings < 5 {
+				outstanding[next_mid] = true
+				out += fmt.Sprintf(`{"bhubver":1,"id":%d,"ir":{}}`, next_mid)
+				next_mid++
+			}
+			go cli.Write([]byte(out))
+			continue
+		}
+		assert.Nil(t, rsp.Error)
+		assert.NotNil(t, rsp.IdRes)
+		assert.True(t, outstanding[rsp.MessageId])
+		delete(outstanding, rsp.MessageId)
+	}
+
+	cli.Close()
+	server.Close()
+}
+
+func TestServerIdleTimeout(t *testing.T) {
+	// Test that idle clients are disconnected, unless they answer a ping when keepalive is enabled
+	defer goleak.VerifyNone(t)
+
+	server := NewServerWithConfig(ServerConfig{IdleTimeout: 50 * time.Millisecond})
+	cli, ser := net.Pipe()
+	server.AddClientByConnection(ser)
+	idle := client.NewClient(cli)
+	cli, ser = net.Pipe()
+	server.AddClientByConnection(ser)
+	busy := client.NewClient(cli)
+	_, err := busy.GetClientId()
+	assert.Nil(t, err)
+	cli, ser = net.Pipe()
+	server.AddClientByConnection(ser)
+	receiver := client.NewClient(cli)
+	receiver_cid, err := receiver.GetClientId()
+	assert.Nil(t, err)
+
+	// The busy client keeps sending relays to the receiver, so neither is idle
+	for i := 0; i < 10; i++ {
+		_, err = busy.RelayMessage([]byte{byte(i)}, []msg.ClientId{receiver_cid})
+		assert.Nil(t, err)
+		<-receiver.Relays
+		time.Sleep(10 * time.Millisecond)
+	}
+	_, ok := <-idle.Relays
+	assert.False(t, ok)
+	cids, err := busy.ListOtherClients()
+	assert.Nil(t, err)
+	assert.Equal(t, []msg.ClientId{receiver_cid}, cids)
+	idle.Close()
+	busy.Close()
+	receiver.Close()
+	server.Close()
+
+	// With keepalive, idle clients that answer the ping stay connected
+	server = NewServerWithConfig(ServerConfig{IdleTimeout: 20 * time.Millisecond, PingInterval: time.Hour})
+	cli, ser = net.Pipe()
+	server.AddClientByConnection(ser)
+	answers := client.NewClient(cli)
+	dead, ser := net.Pipe()
+	server.AddClientByConnection(ser)
+	evicted := make(chan struct{})
+	go func() {
+		sd := (&msg.CborTranscoder{}).NewStreamDecoder(dead)
+		for {
+			if _, err := sd.DecodeNext(); err != nil {
+				break
+			}
+		}
+		close(evicted)
+	}()
+	select {
+	case <-evicted:
+	case <-time.After(time.Second):
+		t.Error("Dead client was not evicted")
+	}
+	time.Sleep(50 * time.Millisecond)
+	_, err = answers.GetClientId()
+	assert.Nil(t, err)
+	assert.Equal(t, msg.SUCCESS, answers.DisconnectReason())
+	answers.Close()
+	dead.Close()
+	server.Close()
+}
+
+func TestServerWebSocket(t *testing.T) {
+	// Test clients connecting over websockets can talk to clients connected directly
+	defer goleak.VerifyNone(t)
+
+	server := NewServer()
+	httpServer := httptest.NewServer(server.WebSocketHandler())
+	wsUrl := "ws" + strings.TrimPrefix(httpServer.URL, "http")
+
+	con, err := ws.Dial(wsUrl, httpServer.URL)
+	assert.Nil(t, err)
+	wsClient := client.NewClient(con)
+	ws_cid, err := wsClient.GetClientId()
+	assert.Nil(t, err)
+
+	cli, ser := net.Pipe()
+	server.AddClientByConnection(ser)
+	pipeClient := client.NewClient(cli)
+	pipe_cid, err := pipeClient.GetClientId()
+	assert.Nil(t, err)
+
+	// Relay in both directions
+	csm, err := pipeClient.RelayMessage([]byte("to ws"), []msg.ClientId{ws_cid})
+	assert.Nil(t, err)
+	assert.Len(t, csm, 0)
+	assert.Equal(t, []byte("to ws"), (<-wsClient.Relays).Msg)
+
+	csm, err = wsClient.RelayMessage([]byte("from ws"), []msg.ClientId{pipe_cid})
+	assert.Nil(t, err)
+	assert.Len(t, csm, 0)
+	assert.Equal(t, []byte("from ws"), (<-pipeClient.Relays).Msg)
+
+	// Closing the server should also end the websocket request
+	server.Close()
+	wsClient.Close()
+	pipeClient.Close()
+	httpServer.Close()
+}
+
+func TestServerDeliveryAck(t *testing.T) {
+	// Test that delivery acknowledgements make it back to the original sender
+	defer goleak.VerifyNone(t)
+
+	server := NewServer()
+	newClient := func() (*client.Client, msg.ClientId) {
+		cli, ser := net.Pipe()
+		server.AddClientByConnection(ser)
+		c := client.NewClient(cli)
+		cid, err := c.GetClientId()
+		assert.Nil(t, err)
+		return c, cid
+	}
+	sender, _ := newClient()
+	dest1, cid1 := newClient()
+	dest2, cid2 := newClient()
+
+	relayId, csm, err := sender.RelayMessageWithAck([]byte{1, 2}, []msg.ClientId{cid1, cid2})
+	assert.Nil(t, err)
+	assert.Len(t, csm, 0)
+	assert.Equal(t, []byte{1, 2}, (<-dest1.Relays).Msg)
+	assert.Equal(t, []byte{1, 2}, (<-dest2.Relays).Msg)
+
+	acked := make(map[msg.ClientId]bool)
+	for i := 0; i < 2; i++ {
+		ack := <-sender.Acks
+		assert.Equal(t, relayId, ack.RelayId)
+		acked[ack.Src] = true
+	}
+	assert.Equal(t, map[msg.ClientId]bool{cid1: true, cid2: true}, acked)
+
+	server.Close()
+	sender.Close()
+	dest1.Close()
+	dest2.Close()
+}
+
+func TestServerNames(t *testing.T) {
+	// Test registering, resolving and releasing client names
+	defer goleak.VerifyNone(t)
+
+	server := NewServer()
+	newClient := func() (*client.Client, msg.ClientId) {
+		cli, ser := net.Pipe()
+		server.AddClientByConnection(ser)
+		c := client.NewClient(cli)
+		cid, err := c.GetClientId()
+		assert.Nil(t, err)
+		return c, cid
+	}
+	alice, alice_cid := newClient()
+	bob, bob_cid := newClient()
+
+	assert.Nil(t, alice.SetName("alice"))
+	assert.Nil(t, alice.SetName("alice"))
+	assert.ErrorIs(t, bob.SetName("alice"), msg.NAME_IN_USE)
+	assert.Nil(t, bob.SetName("bob"))
+
+	cid, err := bob.ResolveName("alice")
+	assert.Nil(t, err)
+	assert.Equal(t, alice_cid, cid)
+	cid, err = alice.ResolveName("bob")
+	assert.Nil(t, err)
+	assert.Equal(t, bob_cid, cid)
+	_, err = alice.ResolveName("carol")
+	assert.ErrorIs(t, err, msg.INVALID_ID)
+
+	// Renaming releases the old name
+	assert.Nil(t, bob.SetName("robert"))
+	_, err = alice.ResolveName("bob")
+	assert.ErrorIs(t, err, msg.INVALID_ID)
+	assert.Nil(t, alice.SetName("bob"))
+	assert.Nil(t, alice.SetName(""))
+	_, err = bob.ResolveName("bob")
+	assert.ErrorIs(t, err, msg.INVALID_ID)
+
+	// Disconnecting releases the name
+	bob.Close()
+	carol, _ := newClient()
+	assert.Eventually(t, func() bool {
+		return carol.SetName("robert") == nil
+	}, time.Second, 10*time.Millisecond)
+
+	server.Close()
+	alice.Close()
+	carol.Close()
+}
+
+func TestServerShutdown(t *testing.T) {
+	// Test that a graceful shutdown flushes buffered relays before closing connections
+	defer goleak.VerifyNone(t)
+
+	server := NewServer()
+	cli, ser := net.Pipe()
+	server.AddClientByConnection(ser)
+	sender := client.NewClient(cli)
+
+	// The destination is a raw connection, which isn't read until the shutdown has started
+	raw, ser := net.Pipe()
+	server.AddClientByConnection(ser)
+	_, err := sender.GetClientId()
+	assert.Nil(t, err)
+	others, err := sender.ListOtherClients()
+	assert.Nil(t, err)
+	assert.Len(t, others, 1)
+	for i := byte(0); i < 2; i++ {
+		csm, err := sender.RelayMessage([]byte{i}, others)
+		assert.Nil(t, err)
+		assert.Len(t, csm, 0)
+	}
+
+	shutdown_err := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		shutdown_err <- server.Shutdown(ctx)
+	}()
+
+	// Everything that was queued arrives, along with the going away indication, before the connection closes
+	sd := (&msg.CborTranscoder{}).NewStreamDecoder(raw)
+	relays := 0
+	going_away := false
+	for {
+		m, err := sd.DecodeNext()
+		if err != nil {
+			break
+		}
+		if m.RelayInd != nil {
+			assert.Equal(t, []byte{byte(relays)}, m.RelayInd.Msg)
+			relays++
+		}
+		if m.GoingAway != nil {
+			going_away = true
+		}
+	}
+	assert.Equal(t, 2, relays)
+	assert.True(t, going_away)
+	assert.Nil(t, <-shutdown_err)
+
+	// The other client is told why it was disconnected
+	_, ok := <-sender.Relays
+	assert.False(t, ok)
+	assert.Equal(t, msg.GOING_AWAY, sender.DisconnectReason())
+	assert.False(t, server.AddClientByConnection(nil))
+
+	raw.Close()
+	sender.Close()
+}
+
+func TestServerShutdownDeadline(t *testing.T) {
+	// Test that connections are closed anyway if they can't be flushed before the deadline
+	defer goleak.VerifyNone(t)
+
+	server := NewServer()
+	raw, ser := net.Pipe()
+	server.AddClientByConnection(ser)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, server.Shutdown(ctx))
+
+	// The connection is closed without anything being sent
+	_, err := raw.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+	raw.Close()
+}
+
+func TestServerVersionNegotiation(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	server := NewServer()
+	cli, ser := net.Pipe()
+	server.AddClientByConnection(ser)
+	c := client.NewClient(cli)
+	v, err := c.Hello()
+	assert.Nil(t, err)
+	assert.Equal(t, msg.MaxVersion, v)
+	_, err = c.GetClientId()
+	assert.Nil(t, err)
+
+	// A raw client that only speaks versions from the future
+	raw, ser := net.Pipe()
+	server.AddClientByConnection(ser)
+	en := msg.CborTranscoder{}
+	sd := en.NewStreamDecoder(raw)
+	go func() {
+		b, _ := en.Encode(msg.Message{Version: msg.MyVersion, MessageId: 1, HelloReq: &msg.HelloRequest{MinVersion: msg.MaxVersion + 1, MaxVersion: msg.MaxVersion + 2}})
+		raw.Write(b)
+		b, _ = en.Encode(msg.Message{Version: msg.MaxVersion + 1, MessageId: 2, IdReq: &msg.IdentifyRequest{}})
+		raw.Write(b)
+		b, _ = en.Encode(msg.Message{Version: msg.MyVersion, MessageId: 3, IdReq: &msg.IdentifyRequest{}})
+		raw.Write(b)
+	}()
+	expected := &msg.HelloResponse{Status: msg.VERSION_MISMATCH, MinVersion: msg.MinVersion, MaxVersion: msg.MaxVersion}
+	m, err := sd.DecodeNext()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), m.MessageId)
+	assert.Equal(t, expected, m.HelloRes)
+	m, err = sd.DecodeNext()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(2), m.MessageId)
+	assert.Equal(t, expected, m.HelloRes)
+	assert.Nil(t, m.IdRes)
+
+	// The connection is still usable with a supported version
+	m, err = sd.DecodeNext()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(3), m.MessageId)
+	assert.Equal(t, msg.MyVersion, m.Version)
+	assert.NotNil(t, m.IdRes)
+
+	server.Close()
+	c.Close()
+	raw.Close()
+}
+
+func TestServerTracedSetup(t *testing.T) {
+	// Test that traced requests setting up the connection are allowed before authenticating, and not pooled
+	defer goleak.VerifyNone(t)
+
+	trace := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	assert.False(t, isPoolable(&msg.Message{Version: msg.MyVersion, MessageId: 1, Trace: trace, AuthReq: &msg.AuthRequest{}}))
+	assert.False(t, isPoolable(&msg.Message{Version: msg.MyVersion, MessageId: 2, Trace: trace, HelloReq: &msg.HelloRequest{}}))
+	assert.True(t, isPoolable(&msg.Message{Version: msg.MyVersion, MessageId: 3, Trace: trace, ListReq: &msg.ListRequest{}}))
+
+	rec := tracing.NewRecorder()
+	server := NewServerWithConfig(ServerConfig{
+		Authenticator:      NewTokenAuthenticator("secret"),
+		RequestWorkers:     2,
+		MaxPendingRequests: 1,
+		Tracer:             rec,
+	})
+	cli, ser := net.Pipe()
+	server.AddClientByConnection(ser)
+	c := client.NewClientWithConfig(cli, client.ClientConfig{Tracer: rec})
+	_, err := c.Hello()
+	assert.Nil(t, err)
+	_, err = c.GetClientId()
+	assert.Nil(t, err)
+	assert.Nil(t, c.Authenticate(msg.Credentials{Token: "secret"}))
+	_, err = c.ListOtherClients()
+	assert.Nil(t, err)
+	c.Close()
+	server.Close()
+}
+
+func TestServerAuth(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	server := NewServerWithConfig(ServerConfig{
+		Authenticator: NewTokenAuthenticator("secret", "other"),
+		AuthTimeout:   100 * time.Millisecond,
+	})
+	newClient := func() *client.Client {
+		cli, ser := net.Pipe()
+		server.AddClientByConnection(ser)
+		return client.NewClient(cli)
+	}
+
+	// Clients can identify themselves, but nothing else until authenticated
+	c := newClient()
+	_, err := c.GetClientId()
+	assert.Nil(t, err)
+	_, err = c.ListOtherClients()
+	assert.ErrorIs(t, err, msg.UNAUTHENTICATED)
+	assert.ErrorIs(t, c.Authenticate(msg.Credentials{Token: "wrong"}), msg.UNAUTHENTICATED)
+	assert.ErrorIs(t, c.Authenticate(msg.Credentials{}), msg.UNAUTHENTICATED)
+	assert.Nil(t, c.Authenticate(msg.Credentials{Token: "secret"}))
+	_, err = c.ListOtherClients()
+	assert.Nil(t, err)
+
+	// Clients that don't authenticate in time are disconnected
+	d := newClient()
+	select {
+	case _, ok := <-d.Relays:
+		assert.False(t, ok)
+	case <-time.After(time.Second):
+		t.Error("Client was not disconnected")
+	}
+
+	// Authenticated clients are not
+	time.Sleep(150 * time.Millisecond)
+	_, err = c.ListOtherClients()
+	assert.Nil(t, err)
+
+	server.Close()
+	c.Close()
+	d.Close()
+}
+
+func TestServerAuthenticators(t *testing.T) {
+	hmacAuth := &HMACAuthenticator{Key: []byte("key")}
+	password := HMACPassword(hmacAuth.Key, "alice")
+	assert.True(t, hmacAuth.Authenticate(msg.Credentials{Username: "alice", Password: password}))
+	assert.False(t, hmacAuth.Authenticate(msg.Credentials{Username: "bob", Password: password}))
+	assert.False(t, hmacAuth.Authenticate(msg.Credentials{Username: "", Password: HMACPassword(hmacAuth.Key, "")}))
+
+	funcAuth := AuthenticatorFunc(func(creds msg.Credentials) bool {
+		return creds.Username == "root"
+	})
+	assert.True(t, funcAuth.Authenticate(msg.Credentials{Username: "root"}))
+	assert.False(t, funcAuth.Authenticate(msg.Credentials{Username: "alice"}))
+
+	assert.False(t, NewTokenAuthenticator().Authenticate(msg.Credentials{}))
+	assert.False(t, NewTokenAuthenticator("").Authenticate(msg.Credentials{}))
+	assert.True(t, NewTokenAuthenticator("a", "b").Authenticate(msg.Credentials{Token: "b"}))
+}
+
+func TestServerNamespaceUnauthenticated(t *testing.T) {
+	// Test that clients which haven't authenticated into their namespace yet can't be seen or relayed to
+	defer goleak.VerifyNone(t)
+
+	server := NewServerWithConfig(ServerConfig{Namespacer: NamespaceMap{"a": "tenant-a"}})
+	newClient := func() (*client.Client, msg.ClientId) {
+		cli, ser := net.Pipe()
+		server.AddClientByConnection(ser)
+		c := client.NewClient(cli)
+		cid, err := c.GetClientId()
+		assert.Nil(t, err)
+		return c, cid
+	}
+	sender, _ := newClient()
+	assert.Nil(t, sender.Authenticate(msg.Credentials{Token: "default"}))
+	pending, pending_cid := newClient()
+
+	others, err := sender.ListOtherClients()
+	assert.Nil(t, err)
+	assert.Len(t, others, 0)
+	csm, err := sender.BroadcastMessage([]byte("all"))
+	assert.Nil(t, err)
+	assert.Len(t, csm, 0)
+	csm, err = sender.RelayMessage([]byte("hi"), []msg.ClientId{pending_cid})
+	assert.Nil(t, err)
+	assert.Equal(t, msg.ClientStatusMap{pending_cid: msg.INVALID_ID}, csm)
+	select {
+	case ind := <-pending.Relays:
+		assert.Fail(t, "Unexpected relay", "%v", ind)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Once it has authenticated, even into the default namespace, it's like any other client
+	assert.Nil(t, pending.Authenticate(msg.Credentials{Token: "default"}))
+	others, err = sender.ListOtherClients()
+	assert.Nil(t, err)
+	assert.Equal(t, []msg.ClientId{pending_cid}, others)
+	_, err = sender.RelayMessage([]byte("hi"), []msg.ClientId{pending_cid})
+	assert.Nil(t, err)
+	assert.Equal(t, "hi", string((<-pending.Relays).Msg))
+
+	// The relay rate is only for the namespace's own relays
+	later := time.Now().Add(time.Second)
+	assert.Greater(t, server.relayRate("").rate(later), 0.0)
+	assert.Equal(t, 0.0, server.relayRate("tenant-a").rate(later))
+
+	sender.Close()
+	pending.Close()
+	server.Close()
+}
+
+func TestServerNamespacePresence(t *testing.T) {
+	// Test that clients are only announced once they're in a namespace, and only to that namespace
+	defer goleak.VerifyNone(t)
+
+	server := NewServerWithConfig(ServerConfig{
+		Authenticator: NewTokenAuthenticator("a", "default"),
+		Namespacer:    NamespaceMap{"a": "tenant-a"},
+	})
+	newClient := func(token string) (*client.Client, msg.ClientId) {
+		cli, ser := net.Pipe()
+		server.AddClientByConnection(ser)
+		c := client.NewClient(cli)
+		assert.Nil(t, c.Authenticate(msg.Credentials{Token: token}))
+		cid, err := c.GetClientId()
+		assert.Nil(t, err)
+		return c, cid
+	}
+	watcher, _ := newClient("default")
+	assert.Nil(t, watcher.SubscribePresence())
+
+	// A client of the other tenant never shows up, whether connecting or disconnecting
+	other, _ := newClient("a")
+	other.Close()
+	assert.Eventually(t, func() bool { return server.countClients("tenant-a") == 0 }, time.Second, time.Millisecond)
+
+	// The next indication is for a client of the default namespace, once it has authenticated
+	joined, joined_cid := newClient("default")
+	select {
+	case ind := <-watcher.Presence:
+		assert.Equal(t, msg.PresenceIndication{Id: joined_cid, Online: true}, ind)
+	case <-time.After(time.Second):
+		assert.Fail(t, "No presence indication")
+	}
+	select {
+	case ind := <-watcher.Presence:
+		assert.Fail(t, "Unexpected presence indication", "%v", ind)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	joined.Close()
+	watcher.Close()
+	server.Close()
+}
+
+func TestServerNamespaces(t *testing.T) {
+	// Test that clients in different namespaces can't see or relay to each other
+	defer goleak.VerifyNone(t)
+
+	server := NewServerWithConfig(ServerConfig{
+		Authenticator: NewTokenAuthenticator("a", "b", "default"),
+		Namespacer:    NamespaceMap{"a": "tenant-a", "b": "tenant-b"},
+	})
+	admin := server.AdminHandler()
+	tokens := []string{"a", "a", "b", "default"}
+	clients := make([]*client.Client, len(tokens))
+	cids := make([]msg.ClientId, len(tokens))
+	for i, tok := range tokens {
+		cli, ser := net.Pipe()
+		server.AddClientByConnection(ser)
+		clients[i] = client.NewClient(cli)
+		assert.Nil(t, clients[i].Authenticate(msg.Credentials{Token: tok}))
+		cid, err := clients[i].GetClientId()
+		assert.Nil(t, err)
+		cids[i] = cid
+	}
+
+	// Each client only sees the others in its namespace
+	others, err := clients[0].ListOtherClients()
+	assert.Nil(t, err)
+	assert.Equal(t, []msg.ClientId{cids[1]}, others)
+	others, err = clients[2].ListOtherClients()
+	assert.Nil(t, err)
+	assert.Len(t, others, 0)
+
+	// Relays can't cross namespaces, and broadcasts stay within them
+	csm, err := clients[2].RelayMessage([]byte("hi"), []msg.ClientId{cids[0]})
+	assert.Nil(t, err)
+	assert.Equal(t, msg.ClientStatusMap{cids[0]: msg.INVALID_ID}, csm)
+	_, err = clients[0].BroadcastMessage([]byte("all"))
+	assert.Nil(t, err)
+	ind := <-clients[1].Relays
+	assert.Equal(t, []byte("all"), ind.Msg)
+
+	// Names, topics and groups are separate in each namespace
+	assert.Nil(t, clients[0].SetName("alice"))
+	assert.Nil(t, clients[2].SetName("alice"))
+	_, err = clients[3].ResolveName("alice")
+	assert.ErrorIs(t, err, msg.INVALID_ID)
+	cid, err := clients[1].ResolveName("alice")
+	assert.Nil(t, err)
+	assert.Equal(t, cids[0], cid)
+	news_a, err := clients[1].Subscribe("news")
+	assert.Nil(t, err)
+	news_b, err := clients[2].Subscribe("news")
+	assert.Nil(t, err)
+	_, err = clients[0].PublishMessage("news", []byte("a"))
+	assert.Nil(t, err)
+	ind = <-news_a
+	assert.Equal(t, []byte("a"), ind.Msg)
+	select {
+	case ind := <-news_b:
+		assert.Fail(t, "Unexpected topic relay", "%v", ind)
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Nil(t, clients[0].CreateGroup("team"))
+	assert.Nil(t, clients[2].CreateGroup("team"))
+	groups, err := clients[3].ListGroups()
+	assert.Nil(t, err)
+	assert.Len(t, groups, 0)
+
+	// Stats only count the clients in the same namespace
+	stats, err := clients[1].Stats()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, stats.Clients)
+
+	// The admin API sees every namespace, or just one
+	var list []adminClient
+	rec := httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest("GET", "/clients?namespace=tenant-a", nil))
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&list))
+	assert.Len(t, list, 2)
+	assert.Equal(t, "tenant-a", list[0].Namespace)
+	rec = httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest("GET", "/clients?namespace=", nil))
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&list))
+	assert.Len(t, list, 1)
+	assert.Equal(t, cids[3], list[0].Id)
+
+	for _, i := range []int{0, 2, 3} {
+		select {
+		case ind := <-clients[i].Relays:
+			assert.Fail(t, "Unexpected relay", "%v", ind)
+		default:
+		}
+	}
+	for _, c := range clients {
+		c.Close()
+	}
+	server.Close()
+}
+
+func TestServerStoreAndForward(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	server := NewServerWithConfig(ServerConfig{MessageStore: NewMemoryStore(2)})
+	newClient := func() *client.Client {
+		cli, ser := net.Pipe()
+		server.AddClientByConnection(ser)
+		return client.NewClient(cli)
+	}
+	sender := newClient()
+	_, err := sender.GetClientId()
+	assert.Nil(t, err)
+
+	first := newClient()
+	cid, token, err := first.GetSession()
+	assert.Nil(t, err)
+	assert.NotEqual(t, "", token)
+	first.Close()
+	assert.Eventually(t, func() bool {
+		others, err := sender.ListOtherClients()
+		return err == nil && len(others) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	// Relays to the disconnected client are stored, up to the store's limit
+	csm, err := sender.RelayMessage([]byte{0}, []msg.ClientId{cid})
+	assert.Nil(t, err)
+	assert.Len(t, csm, 0)
+	csm, err = sender.RelayMessage([]byte{1}, []msg.ClientId{cid})
+	assert.Nil(t, err)
+	assert.Len(t, csm, 0)
+	csm, err = sender.RelayMessage([]byte{2}, []msg.ClientId{cid})
+	assert.Nil(t, err)
+	assert.Equal(t, msg.ClientStatusMap{cid: msg.NO_BUFFER}, csm)
+
+	// Reconnect and resume, receiving the backlog
+	second := newClient()
+	assert.ErrorIs(t, second.Resume(cid, "wrong"), msg.INVALID_ID)
+	assert.Nil(t, second.Resume(cid, token))
+	assert.Equal(t, cid, second.ID())
+	assert.Equal(t, []byte{0}, (<-second.Relays).Msg)
+	assert.Equal(t, []byte{1}, (<-second.Relays).Msg)
+	resumed_cid, err := second.GetClientId()
+	assert.Nil(t, err)
+	assert.Equal(t, cid, resumed_cid)
+
+	// The resumed client receives relays as normal, and its session can't be taken while it is connected
+	csm, err = sender.RelayMessage([]byte{3}, []msg.ClientId{cid})
+	assert.Nil(t, err)
+	assert.Len(t, csm, 0)
+	assert.Equal(t, []byte{3}, (<-second.Relays).Msg)
+	third := newClient()
+	assert.ErrorIs(t, third.Resume(cid, token), msg.INVALID_ID)
+	others, err := sender.ListOtherClients()
+	assert.Nil(t, err)
+	assert.Len(t, others, 2)
+
+	server.Close()
+	sender.Close()
+	second.Close()
+	third.Close()
+}
+
+func TestServerSessionReconnect(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	server := NewServerWithConfig(ServerConfig{MessageStore: NewMemoryStore(0)})
+	dial := func() (net.Conn, error) {
+		cli, ser := net.Pipe()
+		server.AddClientByConnection(ser)
+		return cli, nil
+	}
+	con, _ := dial()
+	sender := client.NewClient(con)
+	con, _ = dial()
+	first := client.NewClientWithConfig(con, client.ClientConfig{IdentifyOnConnect: true})
+	cid := first.ID()
+	assert.NotZero(t, cid)
+
+	// Clients that weren't dialled need to be told how to reconnect
+	_, err := first.Reconnect(context.Background())
+	assert.ErrorIs(t, err, client.ErrCannotRedial)
+
+	// Relays sent while the client was away are delivered once it reconnects, and resumes its session automatically
+	first.Close()
+	assert.Eventually(t, func() bool {
+		others, err := sender.ListOtherClients()
+		return err == nil && len(others) == 0
+	}, time.Second, 10*time.Millisecond)
+	csm, err := sender.RelayMessage([]byte{0}, []msg.ClientId{cid})
+	assert.Nil(t, err)
+	assert.Len(t, csm, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	second, err := first.ReconnectWith(ctx, dial)
+	assert.Nil(t, err)
+	assert.Equal(t, cid, second.ID())
+	assert.Equal(t, []byte{0}, (<-second.Relays).Msg)
+
+	// Failed dials are retried until the context is done
+	second.Close()
+	attempts := 0
+	_, err = second.ReconnectWith(ctx, func() (net.Conn, error) {
+		attempts++
+		if attempts == 3 {
+			cancel()
+		}
+		return nil, errors.New("refused")
+	})
+	assert.ErrorIs(t, err, msg.CANCELLED)
+	assert.Equal(t, 3, attempts)
+
+	server.Close()
+	sender.Close()
+}
+
+func TestServerSessionAutoReconnect(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	server := NewServerWithConfig(ServerConfig{MessageStore: NewMemoryStore(0)})
+	var refuse atomic.Bool
+	dial := func() (net.Conn, error) {
+		if refuse.Load() {
+			return nil, errors.New("refused")
+		}
+		cli, ser := net.Pipe()
+		server.AddClientByConnection(ser)
+		return cli, nil
+	}
+	con, _ := dial()
+	sender := client.NewClient(con)
+	reconnected := make(chan *client.Client, 1)
+	cfg := client.ClientConfig{
+		IdentifyOnConnect: true,
+		AutoReconnect: client.ReconnectPolicy{
+			Enabled:     true,
+			Timeout:     100 * time.Millisecond,
+			OnReconnect: func(c *client.Client) { reconnected <- c },
+		},
+	}
+	con, _ = dial()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	first, err := client.NewClientWithConfig(con, cfg).ReconnectWith(ctx, dial)
+	if !assert.Nil(t, err) {
+		return
+	}
+	cid := first.ID()
+
+	// A client whose connection is ended by the server reconnects by itself, and resumes its session
+	assert.True(t, server.DisconnectClient(cid, msg.INACTIVE))
+	var second *client.Client
+	select {
+	case second = <-reconnected:
+	case <-time.After(time.Second):
+		assert.Fail(t, "Client didn't reconnect")
+		return
+	}
+	assert.Equal(t, msg.INACTIVE, first.DisconnectReason())
+	assert.Equal(t, cid, second.ID())
+	_, err = sender.RelayMessage([]byte{1}, []msg.ClientId{cid})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{1}, (<-second.Relays).Msg)
+
+	// It gives up after the policy's timeout, if the server can't be reached
+	refuse.Store(true)
+	assert.True(t, server.DisconnectClient(cid, msg.INACTIVE))
+	select {
+	case c := <-reconnected:
+		assert.Fail(t, "Client reconnected", "%v", c.ID())
+	case <-time.After(300 * time.Millisecond):
+	}
+	refuse.Store(false)
+
+	// Clients that are closed on purpose stay closed
+	con, _ = dial()
+	third, err := client.NewClientWithConfig(con, cfg).ReconnectWith(ctx, dial)
+	assert.Nil(t, err)
+	third.Close()
+	select {
+	case c := <-reconnected:
+		assert.Fail(t, "Client reconnected", "%v", c.ID())
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	server.Close()
+	sender.Close()
+}
+
+func TestServerSessionTimeout(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	server := NewServerWithConfig(ServerConfig{MessageStore: NewMemoryStore(0), SessionTimeout: 50 * time.Millisecond})
+	newClient := func() *client.Client {
+		cli, ser := net.Pipe()
+		server.AddClientByConnection(ser)
+		return client.NewClient(cli)
+	}
+	sender := newClient()
+	first := newClient()
+	cid, token, err := first.GetSession()
+	assert.Nil(t, err)
+	first.Close()
+
+	// Once the session has expired, relays are rejected and it can't be resumed
+	time.Sleep(100 * time.Millisecond)
+	csm, err := sender.RelayMessage([]byte{0}, []msg.ClientId{cid})
+	assert.Nil(t, err)
+	assert.Equal(t, msg.ClientStatusMap{cid: msg.INVALID_ID}, csm)
+	second := newClient()
+	assert.ErrorIs(t, second.Resume(cid, token), msg.INVALID_ID)
+
+	server.Close()
+	sender.Close()
+	second.Close()
+}
+
+func TestServerAdmin(t *testing.T) {
+	// Test the admin HTTP API
+	defer goleak.VerifyNone(t)
+
+	server := NewServer()
+	admin := server.AdminHandler()
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+
+	clients := make([]*client.Client, 2)
+	cids := make([]msg.ClientId, 2)
+	for i := range clients {
+		cli, ser := net.Pipe()
+		server.AddClientByConnection(ser)
+		clients[i] = client.NewClient(cli)
+		cid, err := clients[i].GetClientId()
+		assert.Nil(t, err)
+		cids[i] = cid
+	}
+	assert.Nil(t, clients[0].SetName("alice"))
+
+	// Relay to the second client without reading it, so its buffer has something in it
+	csm, err := clients[0].RelayMessage([]byte{1}, []msg.ClientId{cids[1]})
+	assert.Nil(t, err)
+	assert.Len(t, csm, 0)
+
+	var list []adminClient
+	rec := do("GET", "/clients", "")
+	assert.Equal(t, 200, rec.Code)
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&list))
+	assert.Len(t, list, 2)
+	assert.Equal(t, cids[0], list[0].Id)
+	assert.Equal(t, "alice", list[0].Name)
+	assert.Equal(t, "pipe", list[0].RemoteAddr)
+	assert.GreaterOrEqual(t, list[0].AgeSeconds, 0.0)
+	// Each priority has its own buffer
+	assert.Equal(t, 3*server.cfg().RelayBufferSize, list[1].Buffer.RelayCapacity)
+
+	var bufs adminBuffers
+	rec = do("GET", "/buffers", "")
+	assert.Equal(t, 200, rec.Code)
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&bufs))
+	assert.Equal(t, 2, bufs.Clients)
+	assert.Equal(t, 6*server.cfg().RelayBufferSize, bufs.RelayCapacity)
+
+	// Change the rate limit
+	var limit RateLimit
+	rec = do("PUT", "/ratelimit", `{"rate": 5, "burst": 2}`)
+	assert.Equal(t, 200, rec.Code)
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&limit))
+	assert.Equal(t, RateLimit{Rate: 5, Burst: 2}, limit)
+	assert.Equal(t, limit, server.RelayRateLimit())
+	assert.Equal(t, 400, do("PUT", "/ratelimit", `{"rate": -1}`).Code)
+	assert.Equal(t, 405, do("DELETE", "/ratelimit", "").Code)
+
+	// Disconnect a client
+	assert.Equal(t, 404, do("GET", "/clients/999", "").Code)
+	assert.Equal(t, 400, do("DELETE", "/clients/bob", "").Code)
+	assert.Equal(t, 204, do("DELETE", fmt.Sprintf("/clients/%d", cids[1]), "").Code)
+	assert.Eventually(t, func() bool {
+		return do("GET", fmt.Sprintf("/clients/%d", cids[1]), "").Code == 404
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 200, do("GET", fmt.Sprintf("/clients/%d", cids[0]), "").Code)
+
+	for _, c := range clients {
+		c.Close()
+	}
+	server.Close()
+}
+
+func TestServerUpdateConfig(t *testing.T) {
+	// Test changing the limits of a running server
+	defer goleak.VerifyNone(t)
+
+	store := NewMemoryStore(0)
+	server := NewServerWithConfig(ServerConfig{MaxTotalClients: 1, MessageStore: store})
+	newClient := func() (*client.Client, bool) {
+		cli, ser := net.Pipe()
+		return client.NewClient(cli), server.AddClientByConnection(ser)
+	}
+	first, ok := newClient()
+	assert.True(t, ok)
+	_, err := first.GetClientId()
+	assert.Nil(t, err)
+	second, ok := newClient()
+	assert.False(t, ok)
+	second.Close()
+
+	// Raising the limit lets more clients connect, and other fields of the configuration are ignored
+	server.UpdateConfig(ServerConfig{MaxTotalClients: 2, IdleTimeout: time.Minute, HistorySize: 10})
+	third, ok := newClient()
+	assert.True(t, ok)
+	cfg := server.Config()
+	assert.Equal(t, 2, cfg.MaxTotalClients)
+	assert.Equal(t, time.Minute, cfg.IdleTimeout)
+	assert.Equal(t, 0, cfg.HistorySize)
+	assert.Equal(t, MessageStore(store), cfg.MessageStore)
+	// Zero limits use their defaults
+	assert.Equal(t, defaultRelayBufferSize, cfg.RelayBufferSize)
+	assert.Equal(t, RateLimit{Burst: defaultRelayRateBurst}, server.RelayRateLimit())
+
+	// The admin API changes only the limits given
+	admin := server.AdminHandler()
+	do := func(method, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, httptest.NewRequest(method, "/config", strings.NewReader(body)))
+		return rec
+	}
+	rec := do("PUT", `{"idle_timeout_seconds": 0.5, "relay_rate_limit": {"rate": 5, "burst": 2}}`)
+	assert.Equal(t, 200, rec.Code)
+	var limits Limits
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&limits))
+	assert.Equal(t, 500*time.Millisecond, limits.IdleTimeout)
+	assert.Equal(t, 2, limits.MaxTotalClients)
+	assert.Equal(t, RateLimit{Rate: 5, Burst: 2}, server.RelayRateLimit())
+	assert.Equal(t, server.Config().Limits(), limits)
+	assert.Equal(t, 400, do("PUT", `{"max_total_clients": -1}`).Code)
+	assert.Equal(t, 400, do("PUT", `{"max_clients": 3}`).Code)
+	assert.Equal(t, 400, do("PUT", `{"overflow_policy": "explode"}`).Code)
+	assert.Equal(t, 405, do("DELETE", "").Code)
+	assert.Equal(t, 2, server.Config().MaxTotalClients)
+
+	first.Close()
+	third.Close()
+	server.Close()
+}
+
+func TestServerHealth(t *testing.T) {
+	// Test the health and readiness checks of the admin API
+	defer goleak.VerifyNone(t)
+
+	server := NewServerWithConfig(ServerConfig{MaxTotalClients: 1})
+	admin := server.AdminHandler()
+	get := func(method, path string) (int, adminHealth) {
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		var health adminHealth
+		json.NewDecoder(rec.Body).Decode(&health)
+		return rec.Code, health
+	}
+	check := func(path string, code int) adminHealth {
+		actual, health := get("GET", path)
+		assert.Equal(t, code, actual, path)
+		return health
+	}
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Nil(t, err)
+	server.AddListener(listener)
+
+	health := check("/readyz", 200)
+	assert.True(t, health.Ready)
+	assert.Equal(t, []string{listener.Addr().String()}, health.Listeners)
+	assert.Zero(t, health.Clients)
+
+	// A full server isn't ready for more clients, but is still healthy
+	cli, ser := net.Pipe()
+	server.AddClientByConnection(ser)
+	tc := client.NewClient(cli)
+	health = check("/readyz", 503)
+	assert.True(t, health.Full)
+	assert.Equal(t, 1, health.Clients)
+	check("/healthz", 200)
+	tc.Close()
+	assert.Eventually(t, func() bool {
+		code, _ := get("GET", "/readyz")
+		return code == 200
+	}, time.Second, time.Millisecond)
+
+	// Once shutting down, the server is no longer ready
+	assert.Nil(t, server.Shutdown(context.Background()))
+	health = check("/readyz", 503)
+	assert.True(t, health.ShuttingDown)
+	assert.False(t, check("/healthz", 200).Ready)
+	code, _ := get("POST", "/healthz")
+	assert.Equal(t, 405, code)
+}
+
+func TestServerDraining(t *testing.T) {
+	// Test that a draining server refuses new clients, but keeps serving those already connected
+	defer goleak.VerifyNone(t)
+
+	server := NewServer()
+	admin := server.AdminHandler()
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+	cli, ser := net.Pipe()
+	assert.True(t, server.AddClientByConnection(ser))
+	connected := client.NewClient(cli)
+	cid, err := connected.GetClientId()
+	assert.Nil(t, err)
+
+	draining := func(rec *httptest.ResponseRecorder) bool {
+		var d adminDraining
+		assert.Nil(t, json.NewDecoder(rec.Body).Decode(&d))
+		return d.Draining
+	}
+	assert.True(t, draining(do("PUT", "/draining", `{"draining": true}`)))
+	assert.True(t, server.Draining())
+	assert.Equal(t, 503, do("GET", "/readyz", "").Code)
+	assert.Equal(t, 200, do("GET", "/healthz", "").Code)
+
+	// New clients are told the server is draining
+	cli, ser = net.Pipe()
+	assert.False(t, server.AddClientByConnection(ser))
+	refused := client.NewClient(cli)
+	assert.Eventually(t, func() bool {
+		return refused.DisconnectReason() == msg.DRAINING
+	}, time.Second, 10*time.Millisecond)
+	refused.Close()
+
+	// Existing clients carry on as usual
+	others, err := connected.ListOtherClients()
+	assert.Nil(t, err)
+	assert.Empty(t, others)
+	id, err := connected.GetClientId()
+	assert.Nil(t, err)
+	assert.Equal(t, cid, id)
+
+	server.SetDraining(false)
+	assert.False(t, draining(do("GET", "/draining", "")))
+	assert.Equal(t, 200, do("GET", "/readyz", "").Code)
+	assert.Equal(t, 400, do("PUT", "/draining", "yes").Code)
+	cli, ser = net.Pipe()
+	assert.True(t, server.AddClientByConnection(ser))
+	other := client.NewClient(cli)
+	_, err = other.GetClientId()
+	assert.Nil(t, err)
+
+	other.Close()
+	connected.Close()
+	server.Close()
+}
+
+func TestServerTracing(t *testing.T) {
+	// Test that a relay's spans form one trace, from the sender, through the server, to the recipient
+	defer goleak.VerifyNone(t)
+
+	rec := tracing.NewRecorder()
+	server := NewServerWithConfig(ServerConfig{Tracer: rec})
+	cli, ser := net.Pipe()
+	server.AddClientByConnection(ser)
+	sender := client.NewClientWithConfig(cli, client.ClientConfig{Tracer: rec})
+	cli, ser = net.Pipe()
+	server.AddClientByConnection(ser)
+	receiver := client.NewClientWithConfig(cli, client.ClientConfig{Tracer: rec})
+	receiver_cid, err := receiver.GetClientId()
+	assert.Nil(t, err)
+
+	_, err = sender.RelayMessage([]byte("traced"), []msg.ClientId{receiver_cid})
+	assert.Nil(t, err)
+	assert.Equal(t, "traced", string((<-receiver.Relays).Msg))
+
+	span := func(name string) (found tracing.RecordedSpan) {
+		assert.Eventually(t, func() bool {
+			for _, sp := range rec.Spans() {
+				if sp.Name == name && (name != "broadcast_hub.server.dispatch" || sp.Attributes["client"] != receiver_cid) {
+					found = sp
+					return true
+				}
+			}
+			return false
+		}, time.Second, time.Millisecond, name)
+		return
+	}
+	request := span("broadcast_hub.client.relay")
+	dispatch := span("broadcast_hub.server.dispatch")
+	fanout := span("broadcast_hub.server.fanout")
+	receive := span("broadcast_hub.client.receive")
+	assert.False(t, request.Parent.Valid())
+	assert.Equal(t, request.SpanContext, dispatch.Parent)
+	assert.Equal(t, dispatch.SpanContext, fanout.Parent)
+	assert.Equal(t, fanout.SpanContext, receive.Parent)
+	assert.Equal(t, 1, fanout.Attributes["sent"])
+	assert.Nil(t, request.Err)
+
+	sender.Close()
+	receiver.Close()
+	server.Close()
+}
+
+func TestServerRelayRateLimit(t *testing.T) {
+	// Test that relays over the rate limit are slowed down, and that the limit can be changed at runtime
+	defer goleak.VerifyNone(t)
+
+	server := NewServerWithConfig(ServerConfig{RelayRateLimit: RateLimit{Rate: 20, Burst: 2}})
+	cli, ser := net.Pipe()
+	server.AddClientByConnection(ser)
+	sender := client.NewClient(cli)
+
+	// The burst is sent straight away, then the rest are limited to 20 per second
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		_, err := sender.BroadcastMessage([]byte{byte(i)})
+		assert.Nil(t, err)
+	}
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(150*time.Millisecond))
+
+	// Without a limit, there's no delay
+	server.SetRelayRateLimit(RateLimit{})
+	assert.Equal(t, RateLimit{Burst: defaultRelayRateBurst}, server.RelayRateLimit())
+	start = time.Now()
+	for i := 0; i < 20; i++ {
+		_, err := sender.BroadcastMessage([]byte{byte(i)})
+		assert.Nil(t, err)
+	}
+	assert.Less(t, int64(time.Since(start)), int64(150*time.Millisecond))
+
+	sender.Close()
+	server.Close()
+}
+
+func TestServerHooks(t *testing.T) {
+	// Test that hooks are called for client and relay events, and can veto relays
+	defer goleak.VerifyNone(t)
+
+	var mutex sync.Mutex
+	connected := []msg.ClientId{}
+	disconnected := []msg.ClientId{}
+	denied := []error{}
+	cfg := ServerConfig{Hooks: Hooks{
+		OnClientConnect: func(c ClientMeta) {
+			mutex.Lock()
+			connected = append(connected, c.Id)
+			mutex.Unlock()
+		},
+		OnClientDisconnect: func(c ClientMeta) {
+			mutex.Lock()
+			disconnected = append(disconnected, c.Id)
+			mutex.Unlock()
+		},
+		OnRelay: func(src ClientMeta, req *msg.RelayRequest) error {
+			if string(req.Msg) == "forbidden" {
+				return fmt.Errorf("client %d said the magic word", src.Id)
+			}
+			return nil
+		},
+		OnRelayDenied: func(src ClientMeta, req *msg.RelayRequest, err error) {
+			mutex.Lock()
+			denied = append(denied, err)
+			mutex.Unlock()
+		},
+	}}
+	server := NewServerWithConfig(cfg)
+
+	cli, ser := net.Pipe()
+	server.AddClientByConnection(ser)
+	sender := client.NewClient(cli)
+	cli, ser = net.Pipe()
+	server.AddClientByConnection(ser)
+	receiver := client.NewClient(cli)
+	sender_cid, err := sender.GetClientId()
+	assert.Nil(t, err)
+	receiver_cid, err := receiver.GetClientId()
+	assert.Nil(t, err)
+	mutex.Lock()
+	assert.Equal(t, []msg.ClientId{sender_cid, receiver_cid}, connected)
+	mutex.Unlock()
+
+	// Allowed relays get through
+	csm, err := sender.RelayMessage([]byte("hello"), []msg.ClientId{receiver_cid})
+	assert.Nil(t, err)
+	assert.Len(t, csm, 0)
+	assert.Equal(t, []byte("hello"), (<-receiver.Relays).Msg)
+
+	// Vetoed relays are rejected with FORBIDDEN, and don't reach the destination
+	_, err = sender.RelayMessage([]byte("forbidden"), []msg.ClientId{receiver_cid})
+	assert.ErrorIs(t, err, msg.FORBIDDEN)
+	_, err = sender.BroadcastMessage([]byte("forbidden"))
+	assert.ErrorIs(t, err, msg.FORBIDDEN)
+	select {
+	case <-receiver.Relays:
+		assert.Fail(t, "Vetoed relay was delivered")
+	case <-time.After(50 * time.Millisecond):
+	}
+	mutex.Lock()
+	assert.Len(t, denied, 2)
+	assert.ErrorIs(t, denied[0], msg.FORBIDDEN)
+	assert.Contains(t, denied[0].Error(), "magic word")
+	mutex.Unlock()
+
+	receiver.Close()
+	assert.Eventually(t, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(disconnected) == 1 && disconnected[0] == receiver_cid
+	}, time.Second, 10*time.Millisecond)
+
+	sender.Close()
+	server.Close()
+}
+
+func TestServerAudit(t *testing.T) {
+	// Test that every relay is recorded in the audit log, with its payload only if asked for
+	defer goleak.VerifyNone(t)
+
+	records := make(chan AuditRecord, 10)
+	audit := AuditFunc(func(rec AuditRecord) error {
+		records <- rec
+		return nil
+	})
+	for _, payloads := range []bool{false, true} {
+		server := NewServerWithConfig(ServerConfig{Audit: audit, AuditPayloads: payloads, Hooks: Hooks{
+			OnRelay: func(src ClientMeta, req *msg.RelayRequest) error {
+				if string(req.Msg) == "forbidden" {
+					return fmt.Errorf("forbidden")
+				}
+				return nil
+			},
+		}})
+		cli, ser := net.Pipe()
+		server.AddClientByConnection(ser)
+		sender := client.NewClient(cli)
+		sender_cid, err := sender.GetClientId()
+		assert.Nil(t, err)
+		cli, ser = net.Pipe()
+		server.AddClientByConnection(ser)
+		receiver := client.NewClient(cli)
+		receiver_cid, err := receiver.GetClientId()
+		assert.Nil(t, err)
+
+		// Successful destinations are recorded, even though the sender isn't told about them
+		before := time.Now()
+		csm, err := sender.RelayMessage([]byte("audited"), []msg.ClientId{receiver_cid, 99})
+		assert.Nil(t, err)
+		assert.Equal(t, msg.ClientStatusMap{99: msg.INVALID_ID}, csm)
+		rec := <-records
+		assert.False(t, rec.Time.Before(before))
+		expected := AuditRecord{
+			Time:     rec.Time,
+			Src:      sender_cid,
+			Dests:    []msg.ClientId{receiver_cid, 99},
+			Size:     7,
+			Status:   msg.SUCCESS,
+			Statuses: msg.ClientStatusMap{receiver_cid: msg.SUCCESS, 99: msg.INVALID_ID},
+		}
+		if payloads {
+			expected.Payload = []byte("audited")
+		}
+		assert.Equal(t, expected, rec)
+		<-receiver.Relays
+
+		// So are relays that are rejected
+		_, err = sender.BroadcastMessage([]byte("forbidden"))
+		assert.True(t, errors.Is(err, msg.FORBIDDEN))
+		rec = <-records
+		assert.Equal(t, msg.FORBIDDEN, rec.Status)
+		assert.True(t, rec.Broadcast)
+		assert.Equal(t, 9, rec.Size)
+		assert.Empty(t, rec.Statuses)
+
+		sender.Close()
+		receiver.Close()
+		server.Close()
+	}
+}
+
+func TestAuditSinks(t *testing.T) {
+	// Test the JSON and rotating file audit sinks
+	rec := AuditRecord{
+		Time:     time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Src:      1,
+		Dests:    []msg.ClientId{2},
+		Size:     2,
+		Statuses: msg.ClientStatusMap{2: msg.SUCCESS},
+		Payload:  []byte("hi"),
+	}
+	var buf strings.Builder
+	assert.Nil(t, NewJSONAuditSink(&buf).Audit(rec))
+	assert.Equal(t, `{"time":"2024-01-02T03:04:05Z","src":1,"dests":[2],"size":2,"status":0,"statuses":{"2":0},"payload":"aGk="}`+"\n", buf.String())
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	line := int64(buf.Len())
+	sink, err := OpenFileAuditSink(path, 2*line, 2)
+	assert.Nil(t, err)
+	for i := 0; i < 7; i++ {
+		assert.Nil(t, sink.Audit(rec))
+	}
+	assert.Nil(t, sink.Close())
+	// Two records fit in each file, and only two rotated files are kept
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(name)
+		assert.Nil(t, err)
+		if name == path {
+			assert.Equal(t, line, info.Size())
+		} else {
+			assert.Equal(t, 2*line, info.Size())
+		}
+	}
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+
+	// Reopening carries on from the end of the current file
+	sink, err = OpenFileAuditSink(path, 2*line, 2)
+	assert.Nil(t, err)
+	assert.Nil(t, sink.Audit(rec))
+	assert.Nil(t, sink.Close())
+	contents, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, buf.String()+buf.String(), string(contents))
+}
+
+func TestServerEvents(t *testing.T) {
+	// Test that connections, disconnections and blocked relays are sent on the event stream
+	defer goleak.VerifyNone(t)
+
+	server := NewServerWithConfig(ServerConfig{RelayBufferSize: 1})
+	events := server.Events()
+	assert.Equal(t, events, server.Events())
+
+	// A stalled destination, which doesn't read anything
+	stalled, ser := net.Pipe()
+	server.AddClientByConnection(ser)
+	connected, ok := (<-events).(ClientConnected)
+	assert.True(t, ok)
+	assert.Equal(t, ser.RemoteAddr(), connected.RemoteAddr)
+	stalled_cid := connected.CID
+
+	cli, ser := net.Pipe()
+	server.AddClientByConnection(ser)
+	sender := client.NewClient(cli)
+	sender_cid, err := sender.GetClientId()
+	assert.Nil(t, err)
+	assert.Equal(t, ClientConnected{CID: sender_cid, RemoteAddr: ser.RemoteAddr()}, <-events)
+
+	// Fill the destination's buffer
+	assert.Eventually(t, func() bool {
+		csm, err := sender.RelayMessage([]byte{0}, []msg.ClientId{stalled_cid})
+		return err == nil && csm[stalled_cid] == msg.NO_BUFFER
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, RelayBlocked{Dest: stalled_cid}, <-events)
+
+	// Hanging up is reported as a connection error, and closing the server as going away
+	stalled.Close()
+	assert.Equal(t, ClientDisconnected{CID: stalled_cid, Reason: msg.CONNECTION_ERROR}, <-events)
+	server.Close()
+	assert.Equal(t, ClientDisconnected{CID: sender_cid, Reason: msg.GOING_AWAY}, <-events)
+	sender.Close()
+	assert.Zero(t, server.DroppedEvents())
+}
+
+func TestServerDisconnectClient(t *testing.T) {
+	// Test that a disconnected client is told why
+	defer goleak.VerifyNone(t)
+
+	server := NewServer()
+	events := server.Events()
+	cli, ser := net.Pipe()
+	server.AddClientByConnection(ser)
+	banned := client.NewClient(cli)
+	banned_cid, err := banned.GetClientId()
+	assert.Nil(t, err)
+	<-events
+
+	assert.True(t, server.DisconnectClient(banned_cid, msg.FORBIDDEN))
+	_, ok := <-banned.Relays
+	assert.False(t, ok)
+	assert.Equal(t, msg.FORBIDDEN, banned.DisconnectReason())
+	assert.Equal(t, ClientDisconnected{CID: banned_cid, Reason: msg.FORBIDDEN}, <-events)
+
+	// Unknown clients can't be disconnected
+	assert.False(t, server.DisconnectClient(banned_cid, msg.FORBIDDEN))
+
+	banned.Close()
+	server.Close()
+}
+
+func TestServerClientInfo(t *testing.T) {
+	// Test that embedders can get information about each connected client
+	defer goleak.VerifyNone(t)
+
+	server := NewServerWithConfig(ServerConfig{AllowedCodecs: []msg.Codec{msg.CodecCBOR, msg.CodecJSON}})
+	clients := []*client.Client{}
+	cids := []msg.ClientId{}
+	for _, codec := range []msg.Codec{msg.CodecCBOR, msg.CodecJSON} {
+		cli, ser := net.Pipe()
+		server.AddClientByConnection(ser)
+		cfg := client.DefaultClientConfig()
+		cfg.Codec = codec
+		c := client.NewClientWithConfig(cli, cfg)
+		cid, err := c.GetClientId()
+		assert.Nil(t, err)
+		clients = append(clients, c)
+		cids = append(cids, cid)
+	}
+	assert.Nil(t, clients[1].SetName("json"))
+
+	info, ok := server.ClientInfo(cids[1])
+	assert.True(t, ok)
+	assert.Equal(t, cids[1], info.Id)
+	assert.Equal(t, "json", info.Name)
+	assert.Equal(t, msg.CodecJSON, info.Codec)
+	assert.NotNil(t, info.RemoteAddr)
+	assert.Less(t, time.Since(info.Connected), time.Second)
+	assert.NotZero(t, info.BytesIn)
+	assert.NotZero(t, info.BytesOut)
+	assert.Zero(t, info.Buffered)
+
+	list := server.Clients()
+	assert.Len(t, list, 2)
+	assert.Equal(t, cids[0], list[0].Id)
+	assert.Equal(t, msg.CodecCBOR, list[0].Codec)
+	assert.Equal(t, "", list[0].Name)
+	assert.Equal(t, info.Id, list[1].Id)
+
+	clients[1].Close()
+	assert.Eventually(t, func() bool {
+		_, ok := server.ClientInfo(cids[1])
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+	assert.Len(t, server.Clients(), 1)
+
+	clients[0].Close()
+	server.Close()
+}
+
+func TestServerRelayFilters(t *testing.T) {
+	// Test that relays are checked against the filter chain, with filtered relays rejected and reported to the hook
+	defer goleak.VerifyNone(t)
+
+	var mutex sync.Mutex
+	denied := []error{}
+	server := NewServerWithConfig(ServerConfig{
+		Authenticator:      NewTokenAuthenticator("user", "admin"),
+		AdminAuthenticator: NewTokenAuthenticator("admin"),
+		RelayFilters: []RelayFilter{
+			SizeLimitFilter{SenderAuthenticated: 4},
+			ContentTypeFilter{"", "text/plain"},
+			PatternFilter{Pattern: regexp.MustCompile(`secret`)},
+			RelayFilterFunc(func(src RelaySender, req *msg.RelayRequest) error {
+				if req.Broadcast && src.Class != SenderAdmin {
+					return errors.New("only admins may broadcast")
+				}
+				return nil
+			}),
+		},
+		Hooks: Hooks{OnRelayDenied: func(src ClientMeta, req *msg.RelayRequest, err error) {
+			mutex.Lock()
+			denied = append(denied, err)
+			mutex.Unlock()
+		}},
+	})
+	newClient := func(token string) *client.Client {
+		cli, ser := net.Pipe()
+		server.AddClientByConnection(ser)
+		c := client.NewClient(cli)
+		assert.Nil(t, c.Authenticate(msg.Credentials{Token: token}))
+		return c
+	}
+	user := newClient("user")
+	admin := newClient("admin")
+	admin_cid, err := admin.GetClientId()
+	assert.Nil(t, err)
+	user_cid, err := user.GetClientId()
+	assert.Nil(t, err)
+
+	// Relays passing every filter get through
+	_, _, err = user.RelayMessageWithOptions([]byte("hi"), []msg.ClientId{admin_cid}, client.RelayOptions{ContentType: "text/plain"})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hi"), (<-admin.Relays).Msg)
+
+	// Each filter can reject a relay, which doesn't reach the destination
+	_, err = user.RelayMessage([]byte("too long"), []msg.ClientId{admin_cid})
+	assert.ErrorIs(t, err, msg.FILTERED)
+	_, _, err = user.RelayMessageWithOptions([]byte("hi"), []msg.ClientId{admin_cid}, client.RelayOptions{ContentType: "image/png"})
+	assert.ErrorIs(t, err, msg.FILTERED)
+	_, err = admin.RelayMessage([]byte("my secret"), []msg.ClientId{user_cid})
+	assert.ErrorIs(t, err, msg.FILTERED)
+	_, err = user.BroadcastMessage([]byte("all"))
+	assert.ErrorIs(t, err, msg.FILTERED)
+	select {
+	case <-admin.Relays:
+		assert.Fail(t, "Filtered relay was delivered")
+	case <-time.After(50 * time.Millisecond):
+	}
+	mutex.Lock()
+	assert.Len(t, denied, 4)
+	assert.ErrorIs(t, denied[0], msg.FILTERED)
+	assert.Contains(t, denied[0].Error(), "limit of 4 for authenticated senders")
+	assert.Contains(t, denied[3].Error(), "only admins")
+	mutex.Unlock()
+
+	// Admins are a class of their own, so aren't held to the size limit of other senders
+	_, err = admin.BroadcastMessage([]byte("all of you"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("all of you"), (<-user.Relays).Msg)
+
+	user.Close()
+	admin.Close()
+	server.Close()
+}
+
+func TestServerCodecs(t *testing.T) {
+	// Test that CBOR and JSON clients can use the same server, and relay to each other
+	defer goleak.VerifyNone(t)
+
+	server := NewServerWithConfig(ServerConfig{AllowedCodecs: []msg.Codec{msg.CodecCBOR, msg.CodecJSON}})
+	cli, ser := net.Pipe()
+	server.AddClientByConnection(ser)
+	cborClient := client.NewClientWithConfig(cli, client.ClientConfig{Codec: msg.CodecCBOR})
+	cli, ser = net.Pipe()
+	server.AddClientByConnection(ser)
+	jsonClient := client.NewClientWithConfig(cli, client.ClientConfig{Codec: msg.CodecJSON})
+
+	cbor_cid, err := cborClient.GetClientId()
+	assert.Nil(t, err)
+	json_cid, err := jsonClient.GetClientId()
+	assert.Nil(t, err)
+
+	csm, err := cborClient.RelayMessage([]byte("to json"), []msg.ClientId{json_cid})
+	assert.Nil(t, err)
+	assert.Len(t, csm, 0)
+	assert.Equal(t, []byte("to json"), (<-jsonClient.Relays).Msg)
+	csm, err = jsonClient.RelayMessage([]byte("to cbor"), []msg.ClientId{cbor_cid})
+	assert.Nil(t, err)
+	assert.Len(t, csm, 0)
+	assert.Equal(t, []byte("to cbor"), (<-cborClient.Relays).Msg)
+
+	cborClient.Close()
+	jsonClient.Close()
+	server.Close()
+
+	// Clients using a codec that isn't allowed are disconnected
+	server = NewServer()
+	cli, ser = net.Pipe()
+	server.AddClientByConnection(ser)
+	jsonClient = client.NewClientWithConfig(cli, client.ClientConfig{Codec: msg.CodecJSON})
+	_, err = jsonClient.GetClientId()
+	assert.ErrorIs(t, err, msg.CONNECTION_ERROR)
+	jsonClient.Close()
+	server.Close()
+}
+
+func TestServerCodecBroadcast(t *testing.T) {
+	// Test that a broadcast is re-encoded for each destination's codec
+	defer goleak.VerifyNone(t)
+
+	server := NewServerWithConfig(ServerConfig{AllowedCodecs: []msg.Codec{msg.CodecCBOR, msg.CodecJSON, msg.CodecFramedCBOR}})
+	clients := []*client.Client{}
+	for _, codec := range []msg.Codec{msg.CodecFramedCBOR, msg.CodecCBOR, msg.CodecJSON} {
+		cli, ser := net.Pipe()
+		server.AddClientByConnection(ser)
+		clients = append(clients, client.NewClientWithConfig(cli, client.ClientConfig{Codec: codec, IdentifyOnConnect: true}))
+	}
+
+	csm, err := clients[0].BroadcastMessage([]byte("to everyone"))
+	assert.Nil(t, err)
+	assert.Len(t, csm, 0)
+	for _, c := range clients[1:] {
+		ind := <-c.Relays
+		assert.Equal(t, clients[0].ID(), ind.Src)
+		assert.Equal(t, []byte("to everyone"), ind.Msg)
+	}
+
+	for _, c := range clients {
+		c.Close()
+	}
+	server.Close()
+}
+
+func TestServerFramedCodec(t *testing.T) {
+	// Test that a corrupted frame from a client using the framed codec is skipped, without dropping the client
+	defer goleak.VerifyNone(t)
+
+	server := NewServerWithConfig(ServerConfig{AllowedCodecs: []msg.Codec{msg.CodecCBOR, msg.CodecFramedCBOR}})
+	cli, ser := net.Pipe()
+	server.AddClientByConnection(ser)
+
+	tc := msg.CodecFramedCBOR.Transcoder()
+	first, _ := tc.Encode(msg.Message{Version: msg.MyVersion, MessageId: 1, IdReq: &msg.IdentifyRequest{}})
+	second, _ := tc.Encode(msg.Message{Version: msg.MyVersion, MessageId: 2, IdReq: &msg.IdentifyRequest{}})
+	go func() {
+		cli.Write(first)
+		cli.Write([]byte{0, 0, 0, 2, 0xff, 0xff})
+		cli.Write(second)
+	}()
+	dec := tc.NewStreamDecoder(cli)
+	rsp, err := dec.DecodeNext()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), rsp.MessageId)
+	rsp, err = dec.DecodeNext()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(2), rsp.MessageId)
+	assert.NotNil(t, rsp.IdRes)
+	cli.Close()
+	server.Close()
+}
+
+func TestServerMalformedMessage(t *testing.T) {
+	// Test that a message which doesn't fit is skipped and answered, but malformed data disconnects the client
+	defer goleak.VerifyNone(t)
+
+	server := NewServerWithConfig(ServerConfig{AllowedCodecs: []msg.Codec{msg.CodecJSON}})
+	cli, ser := net.Pipe()
+	server.AddClientByConnection(ser)
+	dec := msg.CodecJSON.Transcoder().NewStreamDecoder(cli)
+	go cli.Write([]byte(`{"bhubver":2,"id":5,"ir":"who am i?"}`))
+	rsp, err := dec.DecodeNext()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(5), rsp.MessageId)
+	assert.Nil(t, rsp.IdRes)
+	if assert.NotNil(t, rsp.Error) {
+		assert.Equal(t, msg.ENCODING_ERROR, rsp.Error.Status)
+		assert.NotEmpty(t, rsp.Error.Text)
+	}
+	go cli.Write([]byte(`{"bhubver":2,"id":6,"ir":{}}`))
+	rsp, err = dec.DecodeNext()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(6), rsp.MessageId)
+	assert.NotNil(t, rsp.IdRes)
+	go cli.Write([]byte(`{"bhubver":2,"id":7,"ir":}`))
+	_, err = dec.DecodeNext()
+	assert.NotNil(t, err)
+	assert.False(t, msg.IsRecoverable(err))
+	cli.Close()
+	server.Close()
+}
+
+func TestServerErrorResponse(t *testing.T) {
+	// Test that messages without any supported request, or sent before authenticating, are answered with an error
+	defer goleak.VerifyNone(t)
+
+	server := NewServerWithConfig(ServerConfig{
+		AllowedCodecs: []msg.Codec{msg.CodecJSON},
+		Authenticator: NewTokenAuthenticator("secret"),
+	})
+	cli, ser := net.Pipe()
+	server.AddClientByConnection(ser)
+	dec := msg.CodecJSON.Transcoder().NewStreamDecoder(cli)
+	go cli.Write([]byte(`{"bhubver":1,"id":3,"zz":{}}`))
+	rsp, err := dec.DecodeNext()
+	assert.Nil(t, err)
+	assert.Equal(t, msg.Message{Version: msg.MyVersion, MessageId: 3,
+		Error: &msg.ErrorResponse{Status: msg.UNSUPPORTED, Text: "no supported request in message"}}, rsp)
+	go cli.Write([]byte(`{"bhubver":1,"id":4,"lr":{}}`))
+	rsp, err = dec.DecodeNext()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(4), rsp.MessageId)
+	assert.Equal(t, msg.UNAUTHENTICATED, rsp.AuthRes.Status)
+	if assert.NotNil(t, rsp.Error) {
+		assert.Equal(t, msg.UNAUTHENTICATED, rsp.Error.Status)
+	}
+	// Messages with nothing to answer, such as Flow Updates, still aren't answered
+	go cli.Write([]byte(`{"bhubver":1,"id":5,"fu":{"crd":5}}{"bhubver":1,"id":6,"ir":{}}`))
+	rsp, err = dec.DecodeNext()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(6), rsp.MessageId)
+	assert.NotNil(t, rsp.IdRes)
+	cli.Close()
+	server.Close()
+}
+
+func TestServerErrorResponseHubFields(t *testing.T) {
+	// Test that messages only holding what the hub sends to clients, such as Relay Indications, are answered with an error
+	defer goleak.VerifyNone(t)
+
+	server := NewServerWithConfig(ServerConfig{AllowedCodecs: []msg.Codec{msg.CodecJSON}})
+	cli, ser := net.Pipe()
+	server.AddClientByConnection(ser)
+	dec := msg.CodecJSON.Transcoder().NewStreamDecoder(cli)
+	for i, fields := range []string{
+		`"RI":{"src":1,"msg":"aGk="}`,
+		`"RR":{"sta":0}`,
+		`"RI":{"src":1},"RR":{"sta":0},"IR":{"id":1}`,
+	} {
+		mid := uint32(i + 3)
+		go cli.Write([]byte(fmt.Sprintf(`{"bhubver":1,"id":%d,%s}`, mid, fields)))
+		rsp, err := dec.DecodeNext()
+		assert.Nil(t, err)
+		assert.Equal(t, msg.Message{Version: msg.MyVersion, MessageId: mid,
+			Error: &msg.ErrorResponse{Status: msg.UNSUPPORTED, Text: "no supported request in message"}}, rsp)
+	}
+	// A request alongside them is still handled as usual
+	go cli.Write([]byte(`{"bhubver":1,"id":6,"RI":{"src":1},"ir":{}}`))
+	rsp, err := dec.DecodeNext()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(6), rsp.MessageId)
+	assert.NotNil(t, rsp.IdRes)
+	assert.Nil(t, rsp.Error)
+	cli.Close()
+	server.Close()
+}
+
+func TestServerDecodeLimits(t *testing.T) {
+	// Test that relays over the decode limits are rejected, and oversized messages disconnect the client
+	defer goleak.VerifyNone(t)
+
+	server := NewServerWithConfig(ServerConfig{DecodeLimits: msg.DecodeLimits{MaxMessageSize: 512, MaxDests: 2}})
+	cli, ser := net.Pipe()
+	server.AddClientByConnection(ser)
+	c := client.NewClient(cli)
+	_, err := c.RelayMessage([]byte("hi"), []msg.ClientId{1, 2, 3})
+	assert.ErrorIs(t, err, msg.TOO_LONG)
+	_, err = c.GetClientId()
+	assert.Nil(t, err)
+	_, err = c.PublishMessage(strings.Repeat("a", 255), []byte("hi"))
+	assert.Nil(t, err)
+
+	// Too large to decode, even without the relay limits
+	_, err = c.PublishMessage("news", make([]byte, 600))
+	assert.ErrorIs(t, err, msg.CONNECTION_ERROR)
+	c.Close()
+	server.Close()
+}
+
+// Connection which appears to come from a different remote address
+type remoteConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (rc remoteConn) RemoteAddr() net.Addr {
+	return rc.addr
+}
+
+func TestServerConnectionLimits(t *testing.T) {
+	// Test that clients over the total or per-address limits are refused
+	defer goleak.VerifyNone(t)
+
+	server := NewServerWithConfig(ServerConfig{MaxTotalClients: 3, MaxConnsPerIP: 2})
+	connect := func(ip string) (*client.Client, bool) {
+		cli, ser := net.Pipe()
+		ok := server.AddClientByConnection(remoteConn{ser, &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}})
+		return client.NewClient(cli), ok
+	}
+	first, ok := connect("10.0.0.1")
+	assert.True(t, ok)
+	second, ok := connect("10.0.0.1")
+	assert.True(t, ok)
+
+	// A third from the same address is told the server is full, then disconnected
+	refused, ok := connect("10.0.0.1")
+	assert.False(t, ok)
+	_, err := refused.GetClientId()
+	assert.NotNil(t, err)
+	assert.Eventually(t, func() bool {
+		return refused.DisconnectReason() == msg.SERVER_FULL
+	}, time.Second, 10*time.Millisecond)
+	refused.Close()
+
+	// Other addresses are fine, until the total is reached
+	other, ok := connect("10.0.0.2")
+	assert.True(t, ok)
+	_, err = other.GetClientId()
+	assert.Nil(t, err)
+	refused, ok = connect("10.0.0.3")
+	assert.False(t, ok)
+	refused.Close()
+
+	var conns adminConnections
+	rec := httptest.NewRecorder()
+	server.AdminHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/connections", nil))
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&conns))
+	assert.Equal(t, adminConnections{Clients: 3, MaxTotalClients: 3, MaxConnsPerIP: 2,
+		PerIP: map[string]int{"10.0.0.1": 2, "10.0.0.2": 1}, Refused: 2}, conns)
+
+	// Disconnecting makes room again
+	second.Close()
+	assert.Eventually(t, func() bool {
+		c, ok := connect("10.0.0.1")
+		c.Close()
+		return ok
+	}, time.Second, 10*time.Millisecond)
+
+	first.Close()
+	other.Close()
+	server.Close()
+}
+
+func TestServerPresence(t *testing.T) {
+	// Test that clients subscribed to presence are told when others connect and disconnect
+	defer goleak.VerifyNone(t)
+
+	server := NewServer()
+	cli, ser := net.Pipe()
+	server.AddClientByConnection(ser)
+	watcher := client.NewClient(cli)
+	cli, ser = net.Pipe()
+	server.AddClientByConnection(ser)
+	early := client.NewClient(cli)
+	_, err := early.GetClientId()
+	assert.Nil(t, err)
+
+	// Nothing is sent until the watcher subscribes
+	assert.Nil(t, watcher.SubscribePresence())
+	cli, ser = net.Pipe()
+	server.AddClientByConnection(ser)
+	late := client.NewClient(cli)
+	late_cid, err := late.GetClientId()
+	assert.Nil(t, err)
+	assert.Equal(t, msg.PresenceIndication{Id: late_cid, Online: true}, <-watcher.Presence)
+
+	late.Close()
+	assert.Equal(t, msg.PresenceIndication{Id: late_cid, Online: false}, <-watcher.Presence)
+
+	// Unsubscribed watchers aren't told any more
+	assert.Nil(t, watcher.UnsubscribePresence())
+	early.Close()
+	select {
+	case ind := <-watcher.Presence:
+		assert.Fail(t, "Unexpected presence indication", "%v", ind)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	watcher.Close()
+	server.Close()
+}
+
+func TestServerRelayMetadata(t *testing.T) {
+	// Test that relays carry their content type, and are timestamped by the server
+	defer goleak.VerifyNone(t)
+
+	server := NewServer()
+	cli, ser := net.Pipe()
+	server.AddClientByConnection(ser)
+	sender := client.NewClient(cli)
+	cli, ser = net.Pipe()
+	server.AddClientByConnection(ser)
+	receiver := client.NewClient(cli)
+	receiver_cid, err := receiver.GetClientId()
+	assert.Nil(t, err)
+
+	before := time.Now().Truncate(time.Millisecond)
+	_, csm, err := sender.RelayMessageWithOptions([]byte(`{"a":1}`), []msg.ClientId{receiver_cid}, client.RelayOptions{ContentType: "application/json"})
+	assert.Nil(t, err)
+	assert.Len(t, csm, 0)
+	ind := <-receiver.Relays
+	assert.Equal(t, "application/json", ind.ContentType)
+	assert.False(t, ind.Time().Before(before))
+	assert.False(t, ind.Time().After(time.Now()))
+
+	// Plain relays are still timestamped
+	_, err = sender.RelayMessage([]byte{1}, []msg.ClientId{receiver_cid})
+	assert.Nil(t, err)
+	ind = <-receiver.Relays
+	assert.Equal(t, "", ind.ContentType)
+	assert.NotZero(t, ind.Timestamp)
+
+	_, _, err = sender.RelayMessageWithOptions([]byte{1}, []msg.ClientId{receiver_cid}, client.RelayOptions{ContentType: strings.Repeat("a", 256)})
+	assert.ErrorIs(t, err, msg.TOO_LONG)
+
+	sender.Close()
+	receiver.Close()
+	server.Close()
+}
+
+func TestServerRelayPayloads(t *testing.T) {
+	// Test that text and JSON relays are sent with their content type, and can be read back by the destination
+	defer goleak.VerifyNone(t)
+
+	server := NewServer()
+	cli, ser := net.Pipe()
+	server.AddClientByConnection(ser)
+	sender := client.NewClient(cli)
+	cli, ser = net.Pipe()
+	server.AddClientByConnection(ser)
+	receiver := client.NewClient(cli)
+	receiver_cid, err := receiver.GetClientId()
+	assert.Nil(t, err)
+
+	_, err = sender.RelayString("hello", []msg.ClientId{receiver_cid})
+	assert.Nil(t, err)
+	ind := <-receiver.Relays
+	assert.Equal(t, client.TextContentType, ind.ContentType)
+	assert.Equal(t, "hello", ind.Text())
+
+	type reading struct {
+		Sensor string  `json:"sensor"`
+		Value  float64 `json:"value"`
+	}
+	_, err = sender.RelayJSON(reading{"temp", 21.5}, []msg.ClientId{receiver_cid})
+	assert.Nil(t, err)
+	ind = <-receiver.Relays
+	assert.Equal(t, client.JSONContentType, ind.ContentType)
+	var got reading
+	assert.Nil(t, ind.DecodeJSON(&got))
+	assert.Equal(t, reading{"temp", 21.5}, got)
+
+	_, err = sender.RelayJSON(make(chan int), []msg.ClientId{receiver_cid})
+	assert.ErrorIs(t, err, msg.ENCODING_ERROR)
+	_, err = sender.RelayString(strings.Repeat("a", 1025), []msg.ClientId{receiver_cid})
+	assert.ErrorIs(t, err, msg.TOO_LONG)
+
+	sender.Close()
+	receiver.Close()
+	server.Close()
+}
+
+func TestServerGroups(t *testing.T) {
+	// Test that clients can form groups, relay to them, and are removed from them when they disconnect
+	defer goleak.VerifyNone(t)
+
+	server := NewServer()
+	clients := make([]*client.Client, 4)
+	cids := make([]msg.ClientId, 4)
+	for i := range clients {
+		cli, ser := net.Pipe()
+		server.AddClientByConnection(ser)
+		clients[i] = client.NewClient(cli)
+		cid, err := clients[i].GetClientId()
+		assert.Nil(t, err)
+		cids[i] = cid
+	}
+
+	// Groups must be created before they can be joined
+	assert.ErrorIs(t, clients[1].JoinGroup("team"), msg.INVALID_ID)
+	assert.Nil(t, clients[0].CreateGroup("team"))
+	assert.ErrorIs(t, clients[1].CreateGroup("team"), msg.NAME_IN_USE)
+	assert.Nil(t, clients[1].JoinGroup("team"))
+	assert.Nil(t, clients[2].JoinGroup("team"))
+	assert.ErrorIs(t, clients[3].LeaveGroup("team"), msg.INVALID_ID)
+
+	groups, err := clients[3].ListGroups()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"team"}, groups)
+	members, err := clients[3].ListGroupMembers("team")
+	assert.Nil(t, err)
+	assert.Equal(t, cids[:3], members)
+	_, err = clients[3].ListGroupMembers("nobody")
+	assert.ErrorIs(t, err, msg.INVALID_ID)
+
+	// Group relays go to every other member
+	csm, err := clients[0].RelayToGroup("team", []byte("hi"))
+	assert.Nil(t, err)
+	assert.Len(t, csm, 0)
+	for _, i := range []int{1, 2} {
+		ind := <-clients[i].Relays
+		assert.Equal(t, cids[0], ind.Src)
+		assert.Equal(t, []byte("hi"), ind.Msg)
+	}
+
+	// Groups and individual destinations are combined, without duplicates
+	_, csm, err = clients[3].RelayMessageWithOptions([]byte("all"), []msg.ClientId{cids[1]}, client.RelayOptions{DestGroups: []string{"team"}})
+	assert.Nil(t, err)
+	assert.Len(t, csm, 0)
+	for i := 0; i < 3; i++ {
+		ind := <-clients[i].Relays
+		assert.Equal(t, []byte("all"), ind.Msg)
+	}
+	_, err = clients[3].RelayToGroup("nobody", []byte("hi"))
+	assert.ErrorIs(t, err, msg.INVALID_ID)
+
+	// Members leave explicitly or by disconnecting, and the group goes away with its last member
+	assert.Nil(t, clients[1].LeaveGroup("team"))
+	clients[2].Close()
+	assert.Eventually(t, func() bool {
+		members, err := clients[3].ListGroupMembers("team")
+		return err == nil && len(members) == 1 && members[0] == cids[0]
+	}, time.Second, 10*time.Millisecond)
+	clients[0].Close()
+	assert.Eventually(t, func() bool {
+		groups, err := clients[3].ListGroups()
+		return err == nil && len(groups) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	for _, i := range []int{1, 3} {
+		select {
+		case ind := <-clients[i].Relays:
+			assert.Fail(t, "Unexpected relay", "%v", ind)
+		default:
+		}
+	}
+	clients[1].Close()
+	clients[3].Close()
+	server.Close()
+}
+
+func TestServerReliableRelay(t *testing.T) {
+	// Test that Reliable relays are retried when the destination's buffer is full, and failures are reported
+	defer goleak.VerifyNone(t)
+
+	server := NewServerWithConfig(ServerConfig{RelayBufferSize: 1, RetryTimeout: 100 * time.Millisecond})
+	// A stalled destination, which doesn't read anything until later
+	stalled, ser := net.Pipe()
+	server.AddClientByConnection(ser)
+	cli, ser := net.Pipe()
+	server.AddClientByConnection(ser)
+	sender := client.NewClient(cli)
+	sender_cid, err := sender.GetClientId()
+	assert.Nil(t, err)
+	dest := server.getClientIds("", sender_cid)
+	assert.Len(t, dest, 1)
+
+	// Fill the destination's buffer, so ordinary relays fail
+	assert.Eventually(t, func() bool {
+		csm, err := sender.RelayMessage([]byte{0}, dest)
+		return err == nil && csm[dest[0]] == msg.NO_BUFFER
+	}, time.Second, time.Millisecond)
+
+	// Reliable relays are accepted, but fail once the retry deadline passes
+	relayId, csm, err := sender.RelayMessageWithOptions([]byte{1}, dest, client.RelayOptions{Reliable: true})
+	assert.Nil(t, err)
+	assert.Len(t, csm, 0)
+	assert.Equal(t, msg.RelayFailureIndication{Dest: dest[0], RelayId: relayId, Status: msg.TIMEOUT}, <-sender.Failures)
+
+	// Reliable relays are delivered once the destination catches up
+	_, csm, err = sender.RelayMessageWithOptions([]byte{2}, dest, client.RelayOptions{Reliable: true})
+	assert.Nil(t, err)
+	assert.Len(t, csm, 0)
+	sd := (&msg.CborTranscoder{}).NewStreamDecoder(stalled)
+	for {
+		m, err := sd.DecodeNext()
+		assert.Nil(t, err)
+		if m.RelayInd != nil && m.RelayInd.Msg[0] == 2 {
+			break
+		}
+	}
+	select {
+	case ind := <-sender.Failures:
+		assert.Fail(t, "Unexpected relay failure", "%v", ind)
+	default:
+	}
+
+	stalled.Close()
+	sender.Close()
+	server.Close()
+}
+
+func TestServerRelayTTL(t *testing.T) {
+	// Test that relays are discarded once their TTL elapses, rather than being sent late to a slow destination
+	defer goleak.VerifyNone(t)
+
+	server := NewServer()
+	stalled, ser := net.Pipe()
+	server.AddClientByConnection(ser)
+	cli, ser := net.Pipe()
+	server.AddClientByConnection(ser)
+	sender := client.NewClient(cli)
+	sender_cid, err := sender.GetClientId()
+	assert.Nil(t, err)
+	dest := server.getClientIds("", sender_cid)
+	assert.Len(t, dest, 1)
+
+	// The first relay is stuck being written, so the rest wait in the buffer until they expire
+	_, err = sender.RelayMessage([]byte{1}, dest)
+	assert.Nil(t, err)
+	opts := client.RelayOptions{TTL: 50 * time.Millisecond, AckRequested: true}
+	relayId, csm, err := sender.RelayMessageWithOptions([]byte{2}, dest, opts)
+	assert.Nil(t, err)
+	assert.Len(t, csm, 0)
+	opts.AckRequested = false
+	_, _, err = sender.RelayMessageWithOptions([]byte{3}, dest, opts)
+	assert.Nil(t, err)
+	time.Sleep(100 * time.Millisecond)
+	_, err = sender.RelayMessage([]byte{4}, dest)
+	assert.Nil(t, err)
+
+	sd := (&msg.CborTranscoder{}).NewStreamDecoder(stalled)
+	var received []byte
+	for len(received) < 2 {
+		m, err := sd.DecodeNext()
+		assert.Nil(t, err)
+		if m.RelayInd != nil {
+			received = append(received, m.RelayInd.Msg[0])
+		}
+	}
+	assert.Equal(t, []byte{1, 4}, received)
+	// Only the relay asking for an acknowledgement is reported
+	assert.Equal(t, msg.RelayFailureIndication{Dest: dest[0], RelayId: relayId, Status: msg.EXPIRED}, <-sender.Failures)
+	stats, err := sender.Stats()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), stats.RelaysExpired)
+
+	stalled.Close()
+	sender.Close()
+	server.Close()
+}
+
+func TestServerRelayDeadline(t *testing.T) {
+	// Test that relays waiting in a buffer past the server's deadline are discarded, whatever their TTL
+	defer goleak.VerifyNone(t)
+
+	server := NewServerWithConfig(ServerConfig{RelayDeadline: 50 * time.Millisecond})
+	stalled, ser := net.Pipe()
+	server.AddClientByConnection(ser)
+	cli, ser := net.Pipe()
+	server.AddClientByConnection(ser)
+	sender := client.NewClient(cli)
+	sender_cid, err := sender.GetClientId()
+	assert.Nil(t, err)
+	dest := server.getClientIds("", sender_cid)
+	assert.Len(t, dest, 1)
+
+	// The first relay is stuck being written, so the rest wait in the buffer until the deadline
+	_, err = sender.RelayMessage([]byte{1}, dest)
+	assert.Nil(t, err)
+	relayId, _, err := sender.RelayMessageWithOptions([]byte{2}, dest, client.RelayOptions{AckRequested: true})
+	assert.Nil(t, err)
+	_, _, err = sender.RelayMessageWithOptions([]byte{3}, dest, client.RelayOptions{TTL: time.Hour})
+	assert.Nil(t, err)
+	time.Sleep(100 * time.Millisecond)
+	_, err = sender.RelayMessage([]byte{4}, dest)
+	assert.Nil(t, err)
+
+	sd := (&msg.CborTranscoder{}).NewStreamDecoder(stalled)
+	var received []byte
+	for len(received) < 2 {
+		m, err := sd.DecodeNext()
+		assert.Nil(t, err)
+		if m.RelayInd != nil {
+			received = append(received, m.RelayInd.Msg[0])
+		}
+	}
+	assert.Equal(t, []byte{1, 4}, received)
+	assert.Equal(t, msg.RelayFailureIndication{Dest: dest[0], RelayId: relayId, Status: msg.EXPIRED}, <-sender.Failures)
+	stats, err := sender.Stats()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), stats.RelaysExpired)
+
+	stalled.Close()
+	sender.Close()
+	server.Close()
+}
+
+func TestServerListPages(t *testing.T) {
+	// Test that clients can be listed a page at a time, filtered by name, and with metadata if the server shares it
+	defer goleak.VerifyNone(t)
+
+	for _, share := range []bool{false, true} {
+		t.Run(fmt.Sprintf("Share=%v", share), func(t *testing.T) {
+			server := NewServerWithConfig(ServerConfig{ShareClientMetadata: share})
+			clients := make([]*client.Client, 6)
+			cids := make([]msg.ClientId, len(clients))
+			for i := range clients {
+				cli, ser := net.Pipe()
+				server.AddClientByConnection(ser)
+				clients[i] = client.NewClient(cli)
+				cid, err := clients[i].GetClientId()
+				assert.Nil(t, err)
+				cids[i] = cid
+			}
+			assert.Nil(t, clients[1].SetName("bot-1"))
+			assert.Nil(t, clients[2].SetName("human"))
+			assert.Nil(t, clients[4].SetName("bot-4"))
+
+			// Page through everybody else, in order
+			var listed []msg.ClientId
+			opts := client.ListOptions{Limit: 2}
+			for {
+				page, err := clients[0].ListOtherClientsPage(opts)
+				assert.Nil(t, err)
+				assert.LessOrEqual(t, len(page.Ids), 2)
+				assert.Nil(t, page.Metadata)
+				listed = append(listed, page.Ids...)
+				if page.Next == 0 {
+					break
+				}
+				opts.Offset = page.Next
+			}
+			assert.Equal(t, cids[1:], listed)
+
+			// Filter by name, with metadata
+			page, err := clients[0].ListOtherClientsPage(client.ListOptions{Filter: "bot-", Metadata: true})
+			assert.Nil(t, err)
+			assert.Equal(t, []msg.ClientId{cids[1], cids[4]}, page.Ids)
+			assert.Zero(t, page.Next)
+			if share {
+				assert.Len(t, page.Metadata, 2)
+				assert.Equal(t, msg.ClientMetadata{Id: cids[4], Name: "bot-4", Connected: page.Metadata[1].Connected, Address: "other"}, page.Metadata[1])
+				assert.NotZero(t, page.Metadata[1].Connected)
+			} else {
+				assert.Nil(t, page.Metadata)
+			}
+
+			// Offsets past the end give an empty page
+			page, err = clients[0].ListOtherClientsPage(client.ListOptions{Offset: 100})
+			assert.Nil(t, err)
+			assert.Len(t, page.Ids, 0)
+			assert.Zero(t, page.Next)
+
+			for _, c := range clients {
+				c.Close()
+			}
+			server.Close()
+		})
+	}
+}
+
+func TestAddressCategory(t *testing.T) {
+	for addr, category := range map[string]string{
+		"127.0.0.1:3030":   "loopback",
+		"[::1]:3030":       "loopback",
+		"10.1.2.3:3030":    "private",
+		"172.20.0.1:3030":  "private",
+		"192.168.1.1:3030": "private",
+		"[fd00::1]:3030":   "private",
+		"8.8.8.8:3030":     "public",
+		"[2001:db8::1]:80": "public",
+	} {
+		tcp, err := net.ResolveTCPAddr("tcp", addr)
+		assert.Nil(t, err)
+		assert.Equal(t, category, addressCategory(tcp), addr)
+	}
+	pipe, other := net.Pipe()
+	assert.Equal(t, "other", addressCategory(pipe.RemoteAddr()))
+	pipe.Close()
+	other.Close()
+}
+
+func TestServerEncryptedRelay(t *testing.T) {
+	// Test that clients can exchange keys and relay encrypted messages, which the hub can't read
+	defer goleak.VerifyNone(t)
+
+	var intercepted []byte
+	server := NewServerWithConfig(ServerConfig{Hooks: Hooks{
+		OnRelay: func(src ClientMeta, req *msg.RelayRequest) error {
+			if req.ContentType == client.EncryptedContentType {
+				intercepted = append([]byte(nil), req.Msg...)
+			}
+			return nil
+		},
+	}})
+	clients := make([]*client.Client, 3)
+	cids := make([]msg.ClientId, len(clients))
+	errs := make(chan error, 10)
+	for i := range clients {
+		cli, ser := net.Pipe()
+		server.AddClientByConnection(ser)
+		clients[i] = client.NewClient(cli)
+		cid, err := clients[i].GetClientId()
+		assert.Nil(t, err)
+		cids[i] = cid
+		assert.Nil(t, clients[i].EnableEncryption(client.EncryptionConfig{
+			OnError: func(peer msg.ClientId, err error) { errs <- err },
+		}))
+	}
+	alice, bob, mallory := clients[0], clients[1], clients[2]
+
+	// Nothing can be encrypted for a peer until its key is known
+	_, err := alice.RelayEncrypted([]byte("secret"), []msg.ClientId{cids[1]})
+	assert.ErrorIs(t, err, client.ErrUnknownPeerKey)
+	assert.ErrorIs(t, err, msg.INVALID_ID)
+
+	// Announcing a key gets a reply, so both sides learn each other's key
+	_, err = alice.AnnounceKey([]msg.ClientId{cids[1]})
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		_, ok := alice.PeerKey(cids[1])
+		return ok
+	}, time.Second, time.Millisecond)
+	key, ok := bob.PeerKey(cids[0])
+	assert.True(t, ok)
+	assert.True(t, key.Equal(alice.PublicKey()))
+
+	csm, err := alice.RelayEncrypted([]byte("secret"), []msg.ClientId{cids[1]})
+	assert.Nil(t, err)
+	assert.Len(t, csm, 0)
+	ind := <-bob.Relays
+	assert.Equal(t, []byte("secret"), ind.Msg)
+	assert.Equal(t, client.EncryptedContentType, ind.ContentType)
+	assert.NotContains(t, string(intercepted), "secret")
+
+	// Once pinned, a peer's key can't be replaced by somebody else announcing it
+	bob.PinKey(cids[2], alice.PublicKey())
+	_, err = mallory.AnnounceKey([]msg.ClientId{cids[1]})
+	assert.Nil(t, err)
+	assert.ErrorIs(t, <-errs, client.ErrKeyMismatch)
+
+	// Relays encrypted with the wrong key are dropped
+	_, _, err = mallory.RelayMessageWithOptions([]byte("not encrypted properly"), []msg.ClientId{cids[1]}, client.RelayOptions{ContentType: client.EncryptedContentType})
+	assert.Nil(t, err)
+	assert.ErrorIs(t, <-errs, client.ErrDecrypt)
+	select {
+	case ind := <-bob.Relays:
+		assert.Fail(t, "Unexpected relay", "%v", ind)
+	default:
+	}
+
+	for _, c := range clients {
+		c.Close()
+	}
+	server.Close()
+}
+
+func TestServerSlowConsumer(t *testing.T) {
+	// Test that clients which stop reading are disconnected once their writes repeatedly time out
+	defer goleak.VerifyNone(t)
+
+	evicted := make(chan msg.Status, 1)
+	disconnected := make(chan msg.ClientId, 1)
+	server := NewServerWithConfig(ServerConfig{WriteTimeout: 10 * time.Millisecond, SlowWriteLimit: 2, Hooks: Hooks{
+		OnClientEvicted:    func(client ClientMeta, reason msg.Status) { evicted <- reason },
+		OnClientDisconnect: func(client ClientMeta) { disconnected <- client.Id },
+	}})
+
+	// A real client keeps up, so stays connected
+	cli, ser := net.Pipe()
+	server.AddClientByConnection(ser)
+	tc := client.NewClient(cli)
+	_, err := tc.Ping()
+	assert.Nil(t, err)
+
+	// A stalled client sends a request, but never reads the response
+	stalled, ser := net.Pipe()
+	server.AddClientByConnection(ser)
+	b, _ := (&msg.CborTranscoder{}).Encode(msg.Message{Version: msg.MyVersion, MessageId: 1, PingReq: &msg.PingRequest{}})
+	_, err = stalled.Write(b)
+	assert.Nil(t, err)
+
+	select {
+	case reason := <-evicted:
+		assert.Equal(t, msg.SLOW_CONSUMER, reason)
+	case <-time.After(time.Second):
+		assert.Fail(t, "Stalled client wasn't evicted")
+	}
+	<-disconnected
+	_, err = tc.Ping()
+	assert.Nil(t, err)
+
+	stalled.Close()
+	tc.Close()
+	server.Close()
+}
+
+// Connection which counts its writes, and can hold them until released
+type gatedConn struct {
+	net.Conn
+	writes *int32
+	gate   chan struct{}
+}
+
+func (gc gatedConn) Write(b []byte) (int, error) {
+	atomic.AddInt32(gc.writes, 1)
+	<-gc.gate
+	return gc.Conn.Write(b)
+}
+
+func TestServerWriteBuffer(t *testing.T) {
+	// Test that messages queued for a client are written to it together, and still arrive in order
+	defer goleak.VerifyNone(t)
+
+	server := NewServerWithConfig(ServerConfig{WriteBufferSize: 4096, RelayBufferSize: 16})
+	sender_cli, ser := net.Pipe()
+	server.AddClientByConnection(ser)
+	sender := client.NewClient(sender_cli)
+
+	writes := int32(0)
+	gate := make(chan struct{}, 100)
+	gate <- struct{}{}
+	cli, ser := net.Pipe()
+	server.AddClientByConnection(gatedConn{Conn: ser, writes: &writes, gate: gate})
+	receiver := client.NewClient(cli)
+	cid, err := receiver.GetClientId()
+	assert.Nil(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&writes))
+
+	// The first relay holds up the sender, so the rest are queued behind it
+	_, err = sender.RelayMessage([]byte{0}, []msg.ClientId{cid})
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&writes) == 2 }, time.Second, time.Millisecond)
+	for i := 1; i < 10; i++ {
+		_, err = sender.RelayMessage([]byte{byte(i)}, []msg.ClientId{cid})
+		assert.Nil(t, err)
+	}
+	gate <- struct{}{}
+	gate <- struct{}{}
+	for i := 0; i < 10; i++ {
+		ind := <-receiver.Relays
+		assert.Equal(t, []byte{byte(i)}, ind.Msg)
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&writes))
+
+	close(gate)
+	sender.Close()
+	receiver.Close()
+	server.Close()
+}
+
+func TestServerUnixSocket(t *testing.T) {
+	// Test that clients can connect over a Unix domain socket, and the socket file is cleaned up
+	defer goleak.VerifyNone(t)
+
+	path := filepath.Join(t.TempDir(), "bhub.sock")
+
+	// Leave a stale socket file behind, as if a previous server had crashed
+	stale, err := net.Listen("unix", path)
+	assert.Nil(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	server := NewServer()
+	l, err := ListenUnix(path)
+	assert.Nil(t, err)
+	server.AddListener(l)
+
+	// A socket that's in use isn't replaced
+	_, err = ListenUnix(path)
+	assert.NotNil(t, err)
+
+	tc, err := client.DialUnix(path, client.DefaultClientConfig())
+	assert.Nil(t, err)
+	_, err = tc.GetClientId()
+	assert.Nil(t, err)
+
+	tc.Close()
+	server.Close()
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+// Logger recording the message and fields of each entry
+type recordingLogger struct {
+	mutex   sync.Mutex
+	entries []string
+}
+
+func (r *recordingLogger) record(level, m string, fields []logging.Field) {
+	r.mutex.Lock()
+	r.entries = append(r.entries, level+" "+logging.Format(m, fields...))
+	r.mutex.Unlock()
+}
+
+func (r *recordingLogger) Debug(m string, fields ...logging.Field) { r.record("DEBUG", m, fields) }
+func (r *recordingLogger) Info(m string, fields ...logging.Field)  { r.record("INFO", m, fields) }
+func (r *recordingLogger) Warn(m string, fields ...logging.Field)  { r.record("WARN", m, fields) }
+func (r *recordingLogger) Error(m string, fields ...logging.Field) { r.record("ERROR", m, fields) }
+
+func (r *recordingLogger) has(entry string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, e := range r.entries {
+		if strings.HasPrefix(e, entry) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestServerLogger(t *testing.T) {
+	// Test that the server's logs go to the configured Logger
+	defer goleak.VerifyNone(t)
+
+	logger := &recordingLogger{}
+	server := NewServerWithConfig(ServerConfig{Logger: logger, Authenticator: NewTokenAuthenticator("secret")})
+	cli, ser := net.Pipe()
+	server.AddClientByConnection(ser)
+	c := client.NewClient(cli)
+	cid, err := c.GetClientId()
+	assert.Nil(t, err)
+	assert.True(t, logger.has(fmt.Sprintf("INFO Added new Client client=%d", cid)))
+
+	assert.ErrorIs(t, c.Authenticate(msg.Credentials{Token: "wrong"}), msg.UNAUTHENTICATED)
+	assert.True(t, logger.has(fmt.Sprintf("WARN Client failed authentication client=%d", cid)))
+
+	c.Close()
+	assert.Eventually(t, func() bool { return logger.has(fmt.Sprintf("INFO Removed Client client=%d", cid)) }, time.Second, time.Millisecond)
+	server.Close()
+}
+
+func TestServerRequestWorkers(t *testing.T) {
+	// Test that a client's requests are handled concurrently by its workers, and rejected as BUSY once too many are outstanding
+	defer goleak.VerifyNone(t)
+
+	release := make(chan struct{})
+	cfg := ServerConfig{RequestWorkers: 2, MaxPendingRequests: 3, Hooks: Hooks{
+		OnRelay: func(src ClientMeta, req *msg.RelayRequest) error {
+			<-release
+			return nil
+		},
+	}}
+	server := NewServerWithConfig(cfg)
+	cli, ser := net.Pipe()
+	server.AddClientByConnection(ser)
+	c := client.NewClient(cli)
+	cid, err := c.GetClientId()
+	assert.Nil(t, err)
+	server.clients_mutex.RLock()
+	sc := server.clients[cid]
+	server.clients_mutex.RUnlock()
+
+	// A slow relay doesn't hold up the next request
+	var relays sync.WaitGroup
+	relay := func() {
+		defer relays.Done()
+		_, err := c.BroadcastMessage([]byte("slow"))
+		assert.Nil(t, err)
+	}
+	relays.Add(1)
+	go relay()
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(sc.inflight) == 1 }, time.Second, time.Millisecond)
+	_, err = c.ListOtherClients()
+	assert.Nil(t, err)
+
+	// With both workers busy and another relay queued, further requests are rejected
+	relays.Add(2)
+	go relay()
+	go relay()
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(sc.inflight) == 3 }, time.Second, time.Millisecond)
+	_, err = c.ListOtherClients()
+	assert.ErrorIs(t, err, msg.BUSY)
+	_, err = c.BroadcastMessage([]byte("rejected"))
+	assert.ErrorIs(t, err, msg.BUSY)
+	// Pings are handled by the dispatcher, so still get through
+	_, err = c.Ping()
+	assert.Nil(t, err)
+
+	close(release)
+	relays.Wait()
+	_, err = c.ListOtherClients()
+	assert.Nil(t, err)
+
+	c.Close()
+	server.Close()
+}
+
+func TestServerHistory(t *testing.T) {
+	// Test that clients can fetch the recent relays sent to a topic or to themselves
+	defer goleak.VerifyNone(t)
+
+	server := NewServerWithConfig(ServerConfig{HistorySize: 2})
+	newClient := func() *client.Client {
+		cli, ser := net.Pipe()
+		server.AddClientByConnection(ser)
+		return client.NewClient(cli)
+	}
+	sender := newClient()
+	receiver := newClient()
+	receiver_cid, err := receiver.GetClientId()
+	assert.Nil(t, err)
+
+	// Topics keep a history even without subscribers, and only the newest relays are kept
+	for _, m := range []string{"one", "two", "three"} {
+		_, err = sender.PublishMessage("news", []byte(m))
+		assert.Nil(t, err)
+		_, err = sender.RelayMessage([]byte("direct "+m), []msg.ClientId{receiver_cid})
+		assert.Nil(t, err)
+	}
+	contents := func(relays []msg.RelayIndication) (out []string) {
+		for _, ind := range relays {
+			out = append(out, string(ind.Msg))
+		}
+		return
+	}
+	relays, err := receiver.History(client.HistoryOptions{Topic: "news"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"two", "three"}, contents(relays))
+	assert.Equal(t, "news", relays[0].Topic)
+	relays, err = receiver.History(client.HistoryOptions{Topic: "news", Limit: 1})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"three"}, contents(relays))
+
+	// Relays sent directly to a client are only in its own history
+	relays, err = receiver.History(client.HistoryOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"direct two", "direct three"}, contents(relays))
+	relays, err = receiver.History(client.HistoryOptions{Since: relays[1].Time()})
+	assert.Nil(t, err)
+	assert.Len(t, relays, 0)
+	relays, err = sender.History(client.HistoryOptions{})
+	assert.Nil(t, err)
+	assert.Len(t, relays, 0)
+
+	// The history is dropped when the client disconnects, as it can't resume its session
+	receiver.Close()
+	assert.Eventually(t, func() bool {
+		server.history_mutex.Lock()
+		defer server.history_mutex.Unlock()
+		_, ok := server.history[historyKey{cid: receiver_cid}]
+		return !ok
+	}, time.Second, time.Millisecond)
+
+	sender.Close()
+	server.Close()
+
+	// Without a history, the request is refused
+	server = NewServer()
+	cli, ser := net.Pipe()
+	server.AddClientByConnection(ser)
+	c := client.NewClient(cli)
+	_, err = c.History(client.HistoryOptions{})
+	assert.ErrorIs(t, err, msg.FORBIDDEN)
+	c.Close()
+	server.Close()
+}
+
+func TestHistoryRing(t *testing.T) {
+	ring := historyRing{entries: make([]historyEntry, 3)}
+	start := time.Now()
+	for i := 1; i <= 4; i++ {
+		ring.add(historyEntry{ind: msg.RelayIndication{Timestamp: int64(i)}, kept: start.Add(time.Duration(i) * time.Second)})
+	}
+	timestamps := func(relays []msg.RelayIndication) (out []int64) {
+		for _, ind := range relays {
+			out = append(out, ind.Timestamp)
+		}
+		return
+	}
+	assert.Equal(t, []int64{2, 3, 4}, timestamps(ring.since(0)))
+	assert.Equal(t, []int64{4}, timestamps(ring.since(3)))
+
+	// Entries are expired oldest first, and a zero TTL keeps everything
+	assert.Equal(t, 3, ring.expire(start.Add(time.Hour), 0))
+	assert.Equal(t, 2, ring.expire(start.Add(5*time.Second), 2500*time.Millisecond))
+	assert.Equal(t, []int64{3, 4}, timestamps(ring.since(0)))
+	ring.add(historyEntry{ind: msg.RelayIndication{Timestamp: 5}, kept: start.Add(5 * time.Second)})
+	assert.Equal(t, []int64{3, 4, 5}, timestamps(ring.since(0)))
+	assert.Equal(t, 0, ring.expire(start.Add(time.Hour), time.Second))
+}
+
+func TestServerSelfRelay(t *testing.T) {
+	// Test that clients can only relay to themselves with loopback
+	defer goleak.VerifyNone(t)
+
+	for _, allow := range []bool{false, true} {
+		server := NewServerWithConfig(ServerConfig{AllowLoopback: allow})
+		newClient := func() *client.Client {
+			cli, ser := net.Pipe()
+			server.AddClientByConnection(ser)
+			return client.NewClient(cli)
+		}
+		sender := newClient()
+		other := newClient()
+		sender_cid, _ := sender.GetClientId()
+		other_cid, _ := other.GetClientId()
+
+		csm, err := sender.RelayMessage([]byte("echo"), []msg.ClientId{sender_cid, other_cid})
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("echo"), (<-other.Relays).Msg)
+		if allow {
+			assert.Len(t, csm, 0)
+			assert.Equal(t, []byte("echo"), (<-sender.Relays).Msg)
+		} else {
+			assert.Equal(t, msg.ClientStatusMap{sender_cid: msg.SELF_RELAY}, csm)
+		}
+
+		// The Loopback flag allows it for a single relay
+		_, csm, err = sender.RelayMessageWithOptions([]byte("flagged"), []msg.ClientId{sender_cid}, client.RelayOptions{Loopback: true})
+		assert.Nil(t, err)
+		assert.Len(t, csm, 0)
+		assert.Equal(t, []byte("flagged"), (<-sender.Relays).Msg)
+
+		select {
+		case <-sender.Relays:
+			t.Error("Received an unexpected relay")
+		case <-time.After(20 * time.Millisecond):
+		}
+		sender.Close()
+		other.Close()
+		server.Close()
+	}
+}
+
+// Relay bursts of small messages between two clients over TCP, with and without a write buffer
+func BenchmarkServerRelayBurst(b *testing.B) {
+	for _, bufsize := range []int{0, 16 * 1024} {
+		b.Run(fmt.Sprintf("WriteBufferSize=%d", bufsize), func(b *testing.B) {
+			server := NewServerWithConfig(ServerConfig{WriteBufferSize: bufsize, RelayBufferSize: 1024, Logger: logging.Discard})
+			listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				b.Fatal(err)
+			}
+			server.AddListener(listener)
+			sender, err := client.Dial(listener.Addr().String(), client.ClientConfig{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			receiver, err := client.Dial(listener.Addr().String(), client.ClientConfig{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			cid, _ := receiver.GetClientId()
+			received := make(chan struct{})
+			go func() {
+				for i := 0; i < b.N; i++ {
+					<-receiver.Relays
+				}
+				close(received)
+			}()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			const burst = 64
+			results := make([]<-chan client.RelayResult, 0, burst)
+			for sent := 0; sent < b.N; sent += burst {
+				for i := sent; i < min(sent+burst, b.N); i++ {
+					results = append(results, sender.RelayMessageAsync([]byte("burst"), []msg.ClientId{cid}))
+				}
+				for _, res := range results {
+					if r := <-res; r.Err != nil || len(r.StatusMap) > 0 {
+						b.Fatal(r.Err, r.StatusMap)
+					}
+				}
+				results = results[:0]
+			}
+			<-received
+			b.StopTimer()
+
+			sender.Close()
+			receiver.Close()
+			server.Close()
+		})
+	}
+}
+
+func TestServerRelayDedup(t *testing.T) {
+	// Test that a relay repeated with the same MsgUUID is only delivered once
+	defer goleak.VerifyNone(t)
+
+	server := NewServerWithConfig(ServerConfig{DedupWindow: 100 * time.Millisecond})
+	newClient := func() *client.Client {
+		cli, ser := net.Pipe()
+		server.AddClientByConnection(ser)
+		return client.NewClient(cli)
+	}
+	sender := newClient()
+	other := newClient()
+	other_cid, _ := other.GetClientId()
+	noRelay := func() {
+		select {
+		case <-other.Relays:
+			t.Error("Received an unexpected relay")
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+
+	id := client.NewMsgUUID()
+	_, csm, err := sender.RelayMessageWithOptions([]byte("once"), []msg.ClientId{other_cid, 999}, client.RelayOptions{MsgUUID: id})
+	assert.Nil(t, err)
+	assert.Equal(t, msg.ClientStatusMap{999: msg.INVALID_ID}, csm)
+	assert.Equal(t, []byte("once"), (<-other.Relays).Msg)
+
+	// The retry gets the original response, but isn't delivered again
+	_, retry_csm, err := sender.RelayMessageWithOptions([]byte("once"), []msg.ClientId{other_cid, 999}, client.RelayOptions{MsgUUID: id})
+	assert.Nil(t, err)
+	assert.Equal(t, csm, retry_csm)
+	noRelay()
+
+	// Another MsgUUID, or none, is delivered
+	_, _, err = sender.RelayMessageWithOptions([]byte("other"), []msg.ClientId{other_cid}, client.RelayOptions{MsgUUID: client.NewMsgUUID()})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("other"), (<-other.Relays).Msg)
+	_, err = sender.RelayMessage([]byte("none"), []msg.ClientId{other_cid})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("none"), (<-other.Relays).Msg)
+
+	// Once the window has passed, the MsgUUID is forgotten
+	time.Sleep(150 * time.Millisecond)
+	_, _, err = sender.RelayMessageWithOptions([]byte("again"), []msg.ClientId{other_cid}, client.RelayOptions{MsgUUID: id})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("again"), (<-other.Relays).Msg)
+
+	// Overly long MsgUUIDs are rejected
+	_, _, err = sender.RelayMessageWithOptions([]byte("long"), []msg.ClientId{other_cid}, client.RelayOptions{MsgUUID: strings.Repeat("x", 65)})
+	assert.ErrorIs(t, err, msg.TOO_LONG)
+	noRelay()
+
+	sender.Close()
+	other.Close()
+	server.Close()
+}
+
+func TestServerRelayPriority(t *testing.T) {
+	// Test that waiting relays are sent in priority order, and in order within each priority
+	defer goleak.VerifyNone(t)
+
+	server := NewServerWithConfig(ServerConfig{RelayBufferSize: 4})
+	cli, ser := net.Pipe()
+	server.AddClientByConnection(ser)
+	sender := client.NewClient(cli)
+
+	// A client which doesn't read until everything has been relayed to it
+	stalled, ser := net.Pipe()
+	server.AddClientByConnection(ser)
+	cids, err := sender.ListOtherClients()
+	assert.Nil(t, err)
+	assert.Len(t, cids, 1)
+	relay := func(text string, p msg.Priority) {
+		_, csm, err := sender.RelayMessageWithOptions([]byte(text), cids, client.RelayOptions{Priority: p})
+		assert.Nil(t, err)
+		assert.Len(t, csm, 0)
+	}
+
+	// The first relay is taken by the sender straight away, which is then stuck writing it
+	relay("first", msg.PriorityLow)
+	server.clients_mutex.RLock()
+	queues := server.clients[cids[0]].relayMsgs
+	server.clients_mutex.RUnlock()
+	assert.Eventually(t, func() bool { return queues.len() == 0 }, time.Second, time.Millisecond)
+	relay("low1", msg.PriorityLow)
+	relay("normal1", msg.PriorityNormal)
+	relay("low2", msg.PriorityLow)
+	relay("high", msg.PriorityHigh)
+	relay("normal2", msg.PriorityNormal)
+	// Unknown priorities are treated as the nearest known one
+	relay("urgent", msg.Priority(5))
+
+	sd := (&msg.CborTranscoder{}).NewStreamDecoder(stalled)
+	var received []string
+	var priorities []msg.Priority
+	for len(received) < 7 {
+		m, err := sd.DecodeNext()
+		if !assert.Nil(t, err) {
+			break
+		}
+		if m.RelayInd != nil {
+			received = append(received, string(m.RelayInd.Msg))
+			priorities = append(priorities, m.RelayInd.Priority)
+		}
+	}
+	assert.Equal(t, []string{"first", "high", "urgent", "normal1", "normal2", "low1", "low2"}, received)
+	assert.Equal(t, []msg.Priority{msg.PriorityLow, msg.PriorityHigh, msg.PriorityHigh, msg.PriorityNormal,
+		msg.PriorityNormal, msg.PriorityLow, msg.PriorityLow}, priorities)
+
+	sender.Close()
+	stalled.Close()
+	server.Close()
+}
+
+func TestServerRelayVerbosity(t *testing.T) {
+	// Test that successful destinations are only listed in the relay response if the sender asks for them
+	defer goleak.VerifyNone(t)
+
+	server := NewServer()
+	newClient := func() *client.Client {
+		cli, ser := net.Pipe()
+		server.AddClientByConnection(ser)
+		return client.NewClient(cli)
+	}
+	sender := newClient()
+	other := newClient()
+	other_cid, _ := other.GetClientId()
+	sender_cid, _ := sender.GetClientId()
+	dests := []msg.ClientId{other_cid, sender_cid, 999}
+
+	_, csm, err := sender.RelayMessageWithOptions([]byte("terse"), dests, client.RelayOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, msg.ClientStatusMap{sender_cid: msg.SELF_RELAY, 999: msg.INVALID_ID}, csm)
+	assert.Empty(t, csm.Succeeded())
+	assert.Equal(t, []byte("terse"), (<-other.Relays).Msg)
+
+	_, csm, err = sender.RelayMessageWithOptions([]byte("verbose"), dests, client.RelayOptions{Verbosity: msg.VerbosityAll})
+	assert.Nil(t, err)
+	assert.Equal(t, msg.ClientStatusMap{other_cid: msg.SUCCESS, sender_cid: msg.SELF_RELAY, 999: msg.INVALID_ID}, csm)
+	assert.Equal(t, []msg.ClientId{other_cid}, csm.Succeeded())
+	assert.Equal(t, []byte("verbose"), (<-other.Relays).Msg)
+
+	sender.Close()
+	other.Close()
+	server.Close()
+}
+
+func TestServerStats(t *testing.T) {
+	// Test that clients can get the hub's statistics, unless they are only shared with admin clients
+	defer goleak.VerifyNone(t)
+
+	begin := time.Now()
+	server := NewServerWithConfig(ServerConfig{AdminAuthenticator: NewTokenAuthenticator("admin")})
+	newClient := func() *client.Client {
+		cli, ser := net.Pipe()
+		server.AddClientByConnection(ser)
+		return client.NewClient(cli)
+	}
+	admin := newClient()
+	other := newClient()
+	other_cid, _ := other.GetClientId()
+
+	_, err := admin.Stats()
+	assert.ErrorIs(t, err, msg.FORBIDDEN)
+	assert.Nil(t, other.Authenticate(msg.Credentials{Token: "user"}))
+	_, err = other.Stats()
+	assert.ErrorIs(t, err, msg.FORBIDDEN)
+
+	assert.Nil(t, admin.Authenticate(msg.Credentials{Token: "admin"}))
+	_, err = admin.RelayMessage([]byte("hello"), []msg.ClientId{other_cid})
+	assert.Nil(t, err)
+	<-other.Relays
+	stats, err := admin.Stats()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, stats.Clients)
+	assert.LessOrEqual(t, stats.Uptime, time.Since(begin))
+	// Every request so far, and every response but the last
+	assert.Greater(t, stats.BytesReceived, uint64(0))
+	assert.Greater(t, stats.BytesSent, uint64(0))
+	later, err := admin.Stats()
+	assert.Nil(t, err)
+	assert.Greater(t, later.BytesReceived, stats.BytesReceived)
+	assert.Greater(t, later.BytesSent, stats.BytesSent)
+
+	admin.Close()
+	other.Close()
+	server.Close()
+
+	// Relays are averaged over the last whole seconds
+	var m rateMeter
+	start := time.Unix(1000, 0)
+	for i := 0; i < 10; i++ {
+		m.record(start)
+	}
+	m.record(start.Add(1500 * time.Millisecond))
+	assert.Equal(t, 0.0, m.rate(start.Add(500*time.Millisecond)))
+	assert.Equal(t, 2.0, m.rate(start.Add(time.Second)))
+	assert.Equal(t, 2.2, m.rate(start.Add(2*time.Second)))
+	assert.Equal(t, 0.2, m.rate(start.Add(6*time.Second)))
+	assert.Equal(t, 0.0, m.rate(start.Add(7*time.Second)))
+}
+
+func TestServerByteQuota(t *testing.T) {
+	// Test that clients' relays are rejected once they have relayed their quota of bytes, counting each destination
+	defer goleak.VerifyNone(t)
+
+	server := NewServerWithConfig(ServerConfig{ByteQuota: ByteQuota{Bytes: 10, Window: time.Hour}})
+	newClient := func() *client.Client {
+		cli, ser := net.Pipe()
+		server.AddClientByConnection(ser)
+		return client.NewClient(cli)
+	}
+	sender := newClient()
+	dests := make([]msg.ClientId, 2)
+	for i := range dests {
+		c := newClient()
+		defer c.Close()
+		dests[i], _ = c.GetClientId()
+	}
+	sender_cid, _ := sender.GetClientId()
+
+	// Sent to two destinations, so counts 8 bytes. The quota isn't used up until the next relay goes over it.
+	_, err := sender.RelayMessage([]byte("four"), dests)
+	assert.Nil(t, err)
+	_, err = sender.RelayMessage([]byte("four"), dests[:1])
+	assert.Nil(t, err)
+	_, err = sender.RelayMessage([]byte("four"), dests[:1])
+	assert.ErrorIs(t, err, msg.QUOTA_EXCEEDED)
+
+	rec := httptest.NewRecorder()
+	server.AdminHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/quotas", nil))
+	assert.Equal(t, 200, rec.Code)
+	var quotas adminQuotas
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&quotas))
+	assert.Equal(t, uint64(10), quotas.QuotaBytes)
+	assert.Equal(t, 3600.0, quotas.WindowSeconds)
+	assert.Equal(t, adminUsage{PeriodBytes: 12, TotalBytes: 12, Exceeded: true}, quotas.PerClient[sender_cid])
+	assert.Equal(t, adminUsage{}, quotas.PerClient[dests[0]])
+
+	// Raising the quota lets the client relay again
+	server.UpdateConfig(ServerConfig{ByteQuota: ByteQuota{Bytes: 100, Window: time.Hour}})
+	_, err = sender.RelayMessage([]byte("four"), dests[:1])
+	assert.Nil(t, err)
+
+	sender.Close()
+	server.Close()
+
+	// Bytes are counted over a rolling window, or each day
+	var m byteMeter
+	hourly := ByteQuota{Window: time.Hour}
+	start := time.Date(2021, 4, 1, 23, 0, 0, 0, time.UTC)
+	m.add(5, hourly, start)
+	m.add(7, hourly, start.Add(30*time.Minute))
+	period, total := m.used(hourly, start.Add(59*time.Minute))
+	assert.Equal(t, uint64(12), period)
+	assert.Equal(t, uint64(12), total)
+	period, _ = m.used(hourly, start.Add(61*time.Minute))
+	assert.Equal(t, uint64(7), period)
+	period, _ = m.used(hourly, start.Add(2*time.Hour))
+	assert.Equal(t, uint64(0), period)
+
+	var daily byteMeter
+	daily.add(5, ByteQuota{}, start)
+	daily.add(7, ByteQuota{}, start.Add(30*time.Minute))
+	period, _ = daily.used(ByteQuota{}, start.Add(59*time.Minute))
+	assert.Equal(t, uint64(12), period)
+	// A new day starts at midnight
+	period, total = daily.used(ByteQuota{}, start.Add(61*time.Minute))
+	assert.Equal(t, uint64(0), period)
+	assert.Equal(t, uint64(12), total)
+}
+
+func TestServerClientIdAllocators(t *testing.T) {
+	// Test that clients get IDs from the configured allocator, and authenticated identities keep theirs
+	defer goleak.VerifyNone(t)
+
+	var random RandomAllocator
+	first, second := random.NewClientId(), random.NewClientId()
+	assert.NotEqual(t, msg.ClientId(0), first)
+	assert.NotEqual(t, first, second)
+	_, ok := random.IdentityClientId(msg.Credentials{Username: "alice"})
+	assert.False(t, ok)
+
+	persistent := NewPersistentAllocator([]byte("key"))
+	alice, ok := persistent.IdentityClientId(msg.Credentials{Username: "alice"})
+	assert.True(t, ok)
+	again, _ := NewPersistentAllocator([]byte("key")).IdentityClientId(msg.Credentials{Username: "alice"})
+	assert.Equal(t, alice, again)
+	other_key, _ := NewPersistentAllocator([]byte("other")).IdentityClientId(msg.Credentials{Username: "alice"})
+	assert.NotEqual(t, alice, other_key)
+	bob, _ := persistent.IdentityClientId(msg.Credentials{Username: "bob"})
+	assert.NotEqual(t, alice, bob)
+	_, ok = persistent.IdentityClientId(msg.Credentials{})
+	assert.False(t, ok)
+
+	server := NewServerWithConfig(ServerConfig{
+		Authenticator:     AuthenticatorFunc(func(creds msg.Credentials) bool { return creds.Username != "" }),
+		ClientIdAllocator: persistent,
+		MessageStore:      NewMemoryStore(0),
+	})
+	newClient := func() *client.Client {
+		cli, ser := net.Pipe()
+		server.AddClientByConnection(ser)
+		return client.NewClient(cli)
+	}
+	sender := newClient()
+	assert.Nil(t, sender.Authenticate(msg.Credentials{Username: "sender"}))
+
+	// Authenticating moves the client onto its identity's ID
+	a := newClient()
+	anon_cid, err := a.GetClientId()
+	assert.Nil(t, err)
+	assert.NotEqual(t, alice, anon_cid)
+	assert.Nil(t, a.Authenticate(msg.Credentials{Username: "alice"}))
+	assert.Equal(t, alice, a.ID())
+	cid, err := a.GetClientId()
+	assert.Nil(t, err)
+	assert.Equal(t, alice, cid)
+
+	// A second connection with the same identity keeps its own ID
+	b := newClient()
+	b_cid, _ := b.GetClientId()
+	assert.Nil(t, b.Authenticate(msg.Credentials{Username: "alice"}))
+	assert.Equal(t, b_cid, b.ID())
+
+	// Relays to the identity are stored while it is disconnected, and delivered when it authenticates again
+	a.Close()
+	assert.Eventually(t, func() bool {
+		others, err := sender.ListOtherClients()
+		return err == nil && len(others) == 1
+	}, time.Second, 10*time.Millisecond)
+	csm, err := sender.RelayMessage([]byte("hello"), []msg.ClientId{alice})
+	assert.Nil(t, err)
+	assert.Len(t, csm, 0)
+	c := newClient()
+	assert.Nil(t, c.Authenticate(msg.Credentials{Username: "alice"}))
+	assert.Equal(t, alice, c.ID())
+	assert.Equal(t, []byte("hello"), (<-c.Relays).Msg)
+
+	server.Close()
+	sender.Close()
+	b.Close()
+	c.Close()
+}
+
+func TestServerBackplane(t *testing.T) {
+	// Test that relays to clients of another server sharing the backplane are forwarded to them
+	defer goleak.VerifyNone(t)
+
+	bp := NewMemoryBackplane()
+	first := NewServerWithConfig(ServerConfig{Backplane: bp})
+	second := NewServerWithConfig(ServerConfig{Backplane: bp})
+	newClient := func(server *Server) *client.Client {
+		cli, ser := net.Pipe()
+		server.AddClientByConnection(ser)
+		return client.NewClientWithConfig(cli, client.ClientConfig{IdentifyOnConnect: true})
+	}
+	a := newClient(first)
+	b := newClient(second)
+	local := newClient(first)
+
+	// Relays go to clients of either server, and only unknown clients fail
+	csm, err := a.RelayMessage([]byte("hello"), []msg.ClientId{b.ID(), local.ID(), 999})
+	assert.Nil(t, err)
+	assert.Equal(t, msg.ClientStatusMap{999: msg.INVALID_ID}, csm)
+	ind := <-b.Relays
+	assert.Equal(t, a.ID(), ind.Src)
+	assert.Equal(t, []byte("hello"), ind.Msg)
+	assert.Equal(t, []byte("hello"), (<-local.Relays).Msg)
+	csm, err = b.RelayMessage([]byte("back"), []msg.ClientId{a.ID()})
+	assert.Nil(t, err)
+	assert.Len(t, csm, 0)
+	assert.Equal(t, []byte("back"), (<-a.Relays).Msg)
+
+	// Client lists and broadcasts only include the server's own clients
+	others, err := a.ListOtherClients()
+	assert.Nil(t, err)
+	assert.Equal(t, []msg.ClientId{local.ID()}, others)
+
+	// Clients that disconnect are detached from the backplane
+	b_cid := b.ID()
+	b.Close()
+	assert.Eventually(t, func() bool {
+		csm, err := a.RelayMessage([]byte("gone"), []msg.ClientId{b_cid})
+		return err == nil && csm[b_cid] == msg.INVALID_ID
+	}, time.Second, 10*time.Millisecond)
+
+	first.Close()
+	second.Close()
+	a.Close()
+	local.Close()
+}
+
+// Error accepting a connection, which may be temporary
+type acceptError struct{ temporary bool }
+
+func (e acceptError) Error() string   { return "accept failed" }
+func (e acceptError) Timeout() bool   { return false }
+func (e acceptError) Temporary() bool { return e.temporary }
+
+// Listener accepting the connections and errors sent to it, until it's closed
+type scriptedListener struct {
+	accepts chan interface{}
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func (l *scriptedListener) Accept() (net.Conn, error) {
+	select {
+	case a := <-l.accepts:
+		if err, ok := a.(error); ok {
+			return nil, err
+		}
+		return a.(net.Conn), nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *scriptedListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *scriptedListener) Addr() net.Addr { return &net.TCPAddr{} }
+
+func TestServerListenerErrors(t *testing.T) {
+	// Test that listeners retry temporary errors, and stop on others until they're restarted
+	defer goleak.VerifyNone(t)
+
+	server := NewServer()
+	l := &scriptedListener{accepts: make(chan interface{}), closed: make(chan struct{})}
+	type listenerError struct {
+		err      error
+		retrying bool
+	}
+	errs := make(chan listenerError, 4)
+	assert.True(t, server.AddListenerWithConfig(l, ListenerConfig{
+		OnError: func(el net.Listener, err error, retrying bool) {
+			assert.Equal(t, l, el)
+			errs <- listenerError{err, retrying}
+		},
+		MaxBackoff: time.Millisecond,
+	}))
+	accept := func() *client.Client {
+		cli, ser := net.Pipe()
+		l.accepts <- ser
+		return client.NewClient(cli)
+	}
+
+	// Temporary errors are retried
+	l.accepts <- acceptError{temporary: true}
+	assert.Equal(t, listenerError{acceptError{true}, true}, <-errs)
+	a := accept()
+	_, err := a.GetClientId()
+	assert.Nil(t, err)
+	assert.Equal(t, []ListenerStatus{{Listener: l}}, server.Listeners())
+
+	// Others stop the listener
+	l.accepts <- acceptError{temporary: false}
+	assert.Equal(t, listenerError{acceptError{false}, false}, <-errs)
+	assert.Eventually(t, func() bool {
+		statuses := server.Listeners()
+		return len(statuses) == 1 && statuses[0].Err == acceptError{false}
+	}, time.Second, time.Millisecond)
+	select {
+	case l.accepts <- acceptError{temporary: true}:
+		t.Error("Stopped listener is still accepting")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// Until it's restarted
+	assert.True(t, server.RestartListener(l))
+	assert.False(t, server.RestartListener(l))
+	b := accept()
+	_, err = b.GetClientId()
+	assert.Nil(t, err)
+	assert.Equal(t, []ListenerStatus{{Listener: l}}, server.Listeners())
+
+	// Closed listeners are forgotten
+	l.Close()
+	assert.Eventually(t, func() bool { return len(server.Listeners()) == 0 }, time.Second, time.Millisecond)
+	assert.False(t, server.RestartListener(l))
+
+	server.Close()
+	a.Close()
+	b.Close()
+}
+
+func TestServerFlowControl(t *testing.T) {
+	// Test that flow controlled clients are only sent as many relays as they have granted credits for
+	defer goleak.VerifyNone(t)
+
+	server := NewServer()
+	newClient := func(cfg client.ClientConfig) (*client.Client, msg.ClientId) {
+		cli, ser := net.Pipe()
+		server.AddClientByConnection(ser)
+		c := client.NewClientWithConfig(cli, cfg)
+		cid, err := c.GetClientId()
+		assert.Nil(t, err)
+		return c, cid
+	}
+	sender, _ := newClient(client.ClientConfig{})
+	receiver, receiver_cid := newClient(client.ClientConfig{})
+	dest := []msg.ClientId{receiver_cid}
+
+	// Flow Updates have no response, so a ping makes sure each has been handled
+	assert.Nil(t, receiver.GrantCredits(2))
+	_, err := receiver.Ping()
+	assert.Nil(t, err)
+	for i := byte(0); i < 2; i++ {
+		csm, err := sender.RelayMessage([]byte{i}, dest)
+		assert.Nil(t, err)
+		assert.Len(t, csm, 0)
+	}
+	csm, err := sender.RelayMessage([]byte{2}, dest)
+	assert.Nil(t, err)
+	assert.Equal(t, msg.ClientStatusMap{receiver_cid: msg.NO_BUFFER}, csm)
+	assert.Equal(t, []byte{0}, (<-receiver.Relays).Msg)
+	assert.Equal(t, []byte{1}, (<-receiver.Relays).Msg)
+
+	assert.Nil(t, receiver.GrantCredits(1))
+	_, err = receiver.Ping()
+	assert.Nil(t, err)
+	csm, err = sender.RelayMessage([]byte{3}, dest)
+	assert.Nil(t, err)
+	assert.Len(t, csm, 0)
+	assert.Equal(t, []byte{3}, (<-receiver.Relays).Msg)
+
+	// Clients with FlowCredits keep granting more as they receive relays
+	auto, auto_cid := newClient(client.ClientConfig{FlowCredits: 4})
+	for i := byte(0); i < 10; i++ {
+		assert.Eventually(t, func() bool {
+			csm, err := sender.RelayMessage([]byte{i}, []msg.ClientId{auto_cid})
+			return err == nil && len(csm) == 0
+		}, time.Second, 10*time.Millisecond)
+		assert.Equal(t, []byte{i}, (<-auto.Relays).Msg)
+	}
+
+	auto.Close()
+	receiver.Close()
+	sender.Close()
+	server.Close()
+}
+
+func TestServerRelayBatch(t *testing.T) {
+	// Test that each relay in a batch is handled as if it was sent alone, and answered in one response
+	defer goleak.VerifyNone(t)
+
+	server := NewServer()
+	clients := make([]*client.Client, 3)
+	cids := make([]msg.ClientId, len(clients))
+	for i := range clients {
+		cli, ser := net.Pipe()
+		server.AddClientByConnection(ser)
+		clients[i] = client.NewClient(cli)
+		cid, err := clients[i].GetClientId()
+		assert.Nil(t, err)
+		cids[i] = cid
+	}
+	sender, a, b := clients[0], clients[1], clients[2]
+	news, err := b.Subscribe("news")
+	assert.Nil(t, err)
+
+	results, err := sender.RelayBatch([]client.Relay{
+		{Message: []byte{1}, Dest: []msg.ClientId{cids[1]}},
+		{Message: []byte{2}, Dest: []msg.ClientId{cids[2]}, Options: client.RelayOptions{AckRequested: true}},
+		{Message: []byte{3}, Dest: []msg.ClientId{cids[1], 999}},
+		{Message: []byte{4}, Topic: "news"},
+		{Message: []byte{5}, Dest: []msg.ClientId{cids[0]}},
+	})
+	assert.Nil(t, err)
+	if !assert.Len(t, results, 5) {
+		return
+	}
+	assert.Equal(t, msg.ClientStatusMap{}, results[0].StatusMap)
+	assert.Equal(t, msg.ClientStatusMap{999: msg.INVALID_ID}, results[2].StatusMap)
+	assert.Equal(t, msg.ClientStatusMap{cids[0]: msg.SELF_RELAY}, results[4].StatusMap)
+	ids := map[uint32]bool{}
+	for _, res := range results {
+		assert.Nil(t, res.Err)
+		ids[res.RelayId] = true
+	}
+	assert.Len(t, ids, len(results))
+
+	assert.Equal(t, []byte{1}, (<-a.Relays).Msg)
+	assert.Equal(t, []byte{3}, (<-a.Relays).Msg)
+	ind := <-b.Relays
+	assert.Equal(t, []byte{2}, ind.Msg)
+	assert.Equal(t, results[1].RelayId, ind.RelayId)
+	assert.Equal(t, msg.DeliveryIndication{Src: cids[2], RelayId: results[1].RelayId}, <-sender.Acks)
+	assert.Equal(t, []byte{4}, (<-news).Msg)
+
+	for _, c := range clients {
+		c.Close()
+	}
+	server.Close()
+}
+
+func TestServerMixedMessage(t *testing.T) {
+	// Test that every request in a message is handled, and answered together in one response
+	defer goleak.VerifyNone(t)
+
+	server := NewServer()
+	raw, ser := net.Pipe()
+	server.AddClientByConnection(ser)
+	en := msg.CborTranscoder{}
+	sd := en.NewStreamDecoder(raw)
+	send := func(m msg.Message) {
+		m.Version = msg.MyVersion
+		b, _ := en.Encode(m)
+		go raw.Write(b)
+	}
+	receive := func() msg.Message {
+		m, err := sd.DecodeNext()
+		assert.Nil(t, err)
+		return m
+	}
+
+	send(msg.Message{MessageId: 1, IdReq: &msg.IdentifyRequest{}, PingReq: &msg.PingRequest{}, ListReq: &msg.ListRequest{},
+		SubReq: &msg.SubscribeRequest{Topic: "news"}, NameReq: &msg.SetNameRequest{Name: "mixed"}})
+	m := receive()
+	assert.Equal(t, uint32(1), m.MessageId)
+	if !assert.NotNil(t, m.IdRes) {
+		return
+	}
+	cid := m.IdRes.Id
+	assert.Equal(t, &msg.PingResponse{}, m.PingRes)
+	assert.Equal(t, &msg.ListResponse{Others: []msg.ClientId{}}, m.ListRes)
+	assert.Equal(t, &msg.SubscribeResponse{Status: msg.SUCCESS}, m.SubRes)
+	assert.Equal(t, &msg.SetNameResponse{Status: msg.SUCCESS}, m.NameRes)
+
+	// Requests without a response add nothing, and a message of only those isn't answered at all
+	send(msg.Message{MessageId: 2, ResolvReq: &msg.ResolveNameRequest{Name: "mixed"}, DelivReq: &msg.DeliveryRequest{Dest: 99, RelayId: 1}})
+	m = receive()
+	assert.Equal(t, msg.Message{Version: msg.MyVersion, MessageId: 2,
+		ResolvRes: &msg.ResolveNameResponse{Status: msg.SUCCESS, Id: cid}}, m)
+	send(msg.Message{MessageId: 3, FlowUpd: &msg.FlowUpdate{Credits: 10}})
+	send(msg.Message{MessageId: 4, PingReq: &msg.PingRequest{}})
+	m = receive()
+	assert.Equal(t, uint32(4), m.MessageId)
+
+	// Relays are combined with other requests too
+	send(msg.Message{MessageId: 5, RelayReq: &msg.RelayRequest{Dest: []msg.ClientId{cid}, Msg: []byte{1}, Loopback: true},
+		UnsubReq: &msg.UnsubscribeRequest{Topic: "news"}})
+	var rsp, ind msg.Message
+	for i := 0; i < 2; i++ {
+		if m = receive(); m.RelayInd != nil {
+			ind = m
+		} else {
+			rsp = m
+		}
+	}
+	assert.Equal(t, uint32(5), rsp.MessageId)
+	assert.Equal(t, &msg.RelayResponse{Status: msg.SUCCESS, StatusMap: msg.ClientStatusMap{}}, rsp.RelayRes)
+	assert.Equal(t, &msg.UnsubscribeResponse{Status: msg.SUCCESS}, rsp.UnsubRes)
+	if assert.NotNil(t, ind.RelayInd) {
+		assert.Equal(t, []byte{1}, ind.RelayInd.Msg)
+	}
+
+	raw.Close()
 	server.Close()
 }
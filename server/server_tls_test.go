@@ -0,0 +1,103 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/CiaranWoodward/broadcast_hub/client"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+)
+
+// Generate a self-signed certificate for 127.0.0.1, and write it to PEM files in dir
+func writeTestCert(t *testing.T, dir string, serial int64) (certFile, keyFile string, cert *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "bhub test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	cert, err = x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	assert.Nil(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.Nil(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return
+}
+
+func TestServerTLSListener(t *testing.T) {
+	// Test the TLS listener, including reloading the certificate without restarting
+	defer goleak.VerifyNone(t)
+
+	dir := t.TempDir()
+	certFile, keyFile, cert1 := writeTestCert(t, dir, 1)
+	reloader, err := NewCertificateReloader(certFile, keyFile)
+	assert.Nil(t, err)
+
+	server := NewServer()
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Nil(t, err)
+	serverAddr := listener.Addr().String()
+	assert.True(t, server.AddTLSListener(listener, &tls.Config{GetCertificate: reloader.GetCertificate}))
+
+	// Connect, trusting only the first certificate
+	roots := x509.NewCertPool()
+	roots.AddCert(cert1)
+	tc, err := client.DialTLS(serverAddr, &tls.Config{RootCAs: roots}, client.ClientConfig{})
+	assert.Nil(t, err)
+	_, err = tc.GetClientId()
+	assert.Nil(t, err)
+
+	// Swap the certificate on disk and reload
+	_, _, cert2 := writeTestCert(t, dir, 2)
+	assert.Nil(t, reloader.Reload())
+
+	// Clients trusting only the old certificate are now rejected, but the existing connection is unaffected
+	_, err = client.DialTLS(serverAddr, &tls.Config{RootCAs: roots}, client.ClientConfig{})
+	assert.NotNil(t, err)
+	_, err = tc.GetClientId()
+	assert.Nil(t, err)
+
+	roots2 := x509.NewCertPool()
+	roots2.AddCert(cert2)
+	tc2, err := client.DialTLS(serverAddr, &tls.Config{RootCAs: roots2}, client.ClientConfig{})
+	assert.Nil(t, err)
+	_, err = tc2.GetClientId()
+	assert.Nil(t, err)
+
+	// A failed reload keeps the current certificate
+	assert.Nil(t, os.Remove(keyFile))
+	assert.NotNil(t, reloader.Reload())
+	current, err := reloader.GetCertificate(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, cert2.Raw, current.Certificate[0])
+
+	tc.Close()
+	tc2.Close()
+	server.Close()
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// Number of whole seconds the relay rate is averaged over
+const relayRateWindow = 5
+
+// Counts relay requests in one second buckets, to work out how many are handled per second
+type rateMeter struct {
+	mutex sync.Mutex
+	// Count for each of the last few seconds, and the Unix second each count is for
+	counts  [relayRateWindow + 1]uint64
+	seconds [relayRateWindow + 1]int64
+}
+
+// Count an event happening at 'now'
+func (m *rateMeter) record(now time.Time) {
+	sec := now.Unix()
+	i := sec % int64(len(m.counts))
+	m.mutex.Lock()
+	if m.seconds[i] != sec {
+		m.seconds[i] = sec
+		m.counts[i] = 0
+	}
+	m.counts[i]++
+	m.mutex.Unlock()
+}
+
+// Get the average number of events per second over the last whole seconds before 'now'
+func (m *rateMeter) rate(now time.Time) float64 {
+	sec := now.Unix()
+	total := uint64(0)
+	m.mutex.Lock()
+	for i, s := range m.seconds {
+		if s < sec && s >= sec-relayRateWindow {
+			total += m.counts[i]
+		}
+	}
+	m.mutex.Unlock()
+	return float64(total) / relayRateWindow
+}
+
+// Get the meter counting the relays sent by clients in a namespace
+func (s *Server) relayRate(ns string) *rateMeter {
+	s.relay_rates_mutex.Lock()
+	defer s.relay_rates_mutex.Unlock()
+	m, ok := s.relay_rates[ns]
+	if !ok {
+		m = &rateMeter{}
+		s.relay_rates[ns] = m
+	}
+	return m
+}
+
+// Reader which counts the bytes read through it
+type countingReader struct {
+	r     io.Reader
+	count *uint64
+}
+
+func (cr countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	atomic.AddUint64(cr.count, uint64(n))
+	return n, err
+}
+
+// Handle an incoming Stats Request Message
+func (s *Server) handleStatsRequest(sc *serverClient, mesg *msg.Message, rsp *msg.Message) {
+	rsp.StatsRes = &msg.StatsResponse{
+		Status: msg.SUCCESS,
+	}
+	if s.cfg().AdminAuthenticator != nil && atomic.LoadInt32(sc.admin) == 0 {
+		rsp.StatsRes.Status = msg.FORBIDDEN
+	} else {
+		now := time.Now()
+		// Only the clients the requester can see are counted
+		rsp.StatsRes.Clients = uint32(s.countClients(sc.ns()))
+		rsp.StatsRes.Uptime = now.Sub(s.started).Milliseconds()
+		rsp.StatsRes.RelayRate = s.relayRate(sc.ns()).rate(now)
+		rsp.StatsRes.BytesReceived = atomic.LoadUint64(sc.bytes_in)
+		rsp.StatsRes.BytesSent = atomic.LoadUint64(sc.bytes_out)
+		rsp.StatsRes.RelaysExpired = atomic.LoadUint64(&s.relays_expired)
+	}
+}
@@ -0,0 +1,267 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/CiaranWoodward/broadcast_hub/logging"
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// ErrStoreFull is returned by a MessageStore when a client's backlog has reached its limit
+var ErrStoreFull = errors.New("message store full")
+
+// MessageStore holds relays for clients that have recently disconnected, until they resume their session.
+// Only relays sent directly to the client are stored, not broadcasts or topic relays.
+// It may be called concurrently for different clients.
+type MessageStore interface {
+	// Append a relay to the client's backlog
+	Put(cid msg.ClientId, ind msg.RelayIndication) error
+	// Remove and return the client's whole backlog, oldest first
+	Take(cid msg.ClientId) ([]msg.RelayIndication, error)
+	// Discard the client's backlog
+	Drop(cid msg.ClientId) error
+}
+
+// MemoryStore is a MessageStore which keeps backlogs in memory
+type MemoryStore struct {
+	limit          int
+	backlogs       map[msg.ClientId][]msg.RelayIndication
+	backlogs_mutex sync.Mutex
+}
+
+// Create a new MemoryStore, holding up to 'limit' relays per client (zero for no limit)
+func NewMemoryStore(limit int) *MemoryStore {
+	return &MemoryStore{
+		limit:    limit,
+		backlogs: make(map[msg.ClientId][]msg.RelayIndication),
+	}
+}
+
+// Put appends a relay to the client's backlog, or returns ErrStoreFull
+func (m *MemoryStore) Put(cid msg.ClientId, ind msg.RelayIndication) error {
+	m.backlogs_mutex.Lock()
+	defer m.backlogs_mutex.Unlock()
+	if m.limit > 0 && len(m.backlogs[cid]) >= m.limit {
+		return ErrStoreFull
+	}
+	m.backlogs[cid] = append(m.backlogs[cid], ind)
+	return nil
+}
+
+// Take removes and returns the client's backlog
+func (m *MemoryStore) Take(cid msg.ClientId) ([]msg.RelayIndication, error) {
+	m.backlogs_mutex.Lock()
+	defer m.backlogs_mutex.Unlock()
+	backlog := m.backlogs[cid]
+	delete(m.backlogs, cid)
+	return backlog, nil
+}
+
+// Drop discards the client's backlog
+func (m *MemoryStore) Drop(cid msg.ClientId) error {
+	m.backlogs_mutex.Lock()
+	delete(m.backlogs, cid)
+	m.backlogs_mutex.Unlock()
+	return nil
+}
+
+// Resumable session of a client, which outlives its connection while a MessageStore is configured
+type session struct {
+	token string
+	// Time the client disconnected, or zero while it is connected
+	offline_since time.Time
+	// Namespace the client was in when it disconnected. Only clients in the same namespace can relay to it or resume it.
+	namespace string
+}
+
+// Handle an incoming Resume Request Message, returning the relays stored for the session
+func (s *Server) handleResumeRequest(sc *serverClient, mesg *msg.Message, rsp *msg.Message) backlog {
+	status, stored := s.resumeSession(sc, mesg.ResumeReq.Id, mesg.ResumeReq.Session)
+	rsp.ResumeRes = &msg.ResumeResponse{
+		Status: status,
+	}
+	return backlog{cid: mesg.ResumeReq.Id, relays: stored}
+}
+
+// Relays stored for a session, to be delivered once the client has been sent the response taking it over
+type backlog struct {
+	cid    msg.ClientId
+	relays []msg.RelayIndication
+}
+
+// Deliver the relays stored for a session to the client that has taken it over.
+// The backlog may be larger than the relay buffer, so this waits for the sender to make room.
+// It is sent even if the client is out of flow control credits, as it has nowhere else to go.
+func (s *Server) deliverBacklog(sc *serverClient, cid msg.ClientId, backlog []msg.RelayIndication) {
+	for i, ind := range backlog {
+		select {
+		case sc.relayMsgs.queue(ind.Priority) <- msg.NewSharedRelay(ind):
+			spendCredit(sc.credits)
+		case <-sc.removed:
+			// Disconnected again, so keep the rest for next time
+			for _, rest := range backlog[i:] {
+				s.cfg().MessageStore.Put(cid, rest)
+			}
+			return
+		}
+	}
+}
+
+// Create a new session for a client, returning its token
+func (s *Server) newSession(cid msg.ClientId) string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	token := hex.EncodeToString(b)
+	s.sessions_mutex.Lock()
+	s.sessions[cid] = &session{token: token}
+	s.sessions_mutex.Unlock()
+	return token
+}
+
+// Get the token of a connected client's session, or "" if sessions aren't enabled
+func (s *Server) sessionToken(cid msg.ClientId) string {
+	s.sessions_mutex.Lock()
+	defer s.sessions_mutex.Unlock()
+	if sess, ok := s.sessions[cid]; ok {
+		return sess.token
+	}
+	return ""
+}
+
+// Mark a disconnected client's session as resumable, and clean up any sessions which have expired
+func (s *Server) suspendSession(cid msg.ClientId, ns string) {
+	s.sessions_mutex.Lock()
+	defer s.sessions_mutex.Unlock()
+	if sess, ok := s.sessions[cid]; ok {
+		sess.offline_since = time.Now()
+		sess.namespace = ns
+	}
+	for cid, sess := range s.sessions {
+		if s.isExpired(sess) {
+			s.dropSession(cid)
+		}
+	}
+}
+
+// Store a relay from a client in namespace 'ns' for a disconnected client, if it can still resume its session
+func (s *Server) storeRelay(cid msg.ClientId, ns string, ind msg.RelayIndication) msg.Status {
+	if s.cfg().MessageStore == nil {
+		return msg.INVALID_ID
+	}
+	s.sessions_mutex.Lock()
+	defer s.sessions_mutex.Unlock()
+	sess, ok := s.sessions[cid]
+	if !ok || sess.offline_since.IsZero() || sess.namespace != ns {
+		return msg.INVALID_ID
+	}
+	if s.isExpired(sess) {
+		s.dropSession(cid)
+		return msg.INVALID_ID
+	}
+	if err := s.cfg().MessageStore.Put(cid, ind); err != nil {
+		if err != ErrStoreFull {
+			s.cfg().Logger.Error("Failed to store relay", logging.F("client", cid), logging.F("err", err))
+		}
+		return msg.NO_BUFFER
+	}
+	return msg.SUCCESS
+}
+
+// Move a client onto a previous session's ID, if the token matches. Returns the relays stored for the session.
+func (s *Server) resumeSession(sc *serverClient, cid msg.ClientId, token string) (msg.Status, []msg.RelayIndication) {
+	if s.cfg().MessageStore == nil {
+		return msg.INVALID_ID, nil
+	}
+	s.sessions_mutex.Lock()
+	sess, ok := s.sessions[cid]
+	if !ok || sess.offline_since.IsZero() || sess.namespace != sc.ns() ||
+		subtle.ConstantTimeCompare([]byte(sess.token), []byte(token)) != 1 {
+		s.sessions_mutex.Unlock()
+		return msg.INVALID_ID, nil
+	}
+	if s.isExpired(sess) {
+		s.dropSession(cid)
+		s.sessions_mutex.Unlock()
+		return msg.INVALID_ID, nil
+	}
+
+	// Swap the client over to its old ID, abandoning the current one
+	prev_cid, status := s.moveClient(sc, cid)
+	if status != msg.SUCCESS {
+		s.sessions_mutex.Unlock()
+		return status, nil
+	}
+	delete(s.sessions, prev_cid)
+	sess.offline_since = time.Time{}
+	backlog := s.takeBacklog(cid)
+	s.sessions_mutex.Unlock()
+
+	s.abandonClientId(sc, prev_cid, cid)
+	s.cfg().Logger.Info("Resumed session", logging.F("client", prev_cid), logging.F("session", cid))
+	return msg.SUCCESS, backlog
+}
+
+// Move a connected client onto another ID. Returns its previous ID, and INVALID_ID if another connected client has the
+// new ID, or CONNECTION_ERROR if the client has already disconnected.
+func (s *Server) moveClient(sc *serverClient, cid msg.ClientId) (msg.ClientId, msg.Status) {
+	s.clients_mutex.Lock()
+	defer s.clients_mutex.Unlock()
+	prev_cid := sc.id()
+	if _, ok := s.clients[prev_cid]; !ok {
+		// Already disconnected
+		return prev_cid, msg.CONNECTION_ERROR
+	}
+	if _, taken := s.clients[cid]; taken {
+		return prev_cid, msg.INVALID_ID
+	}
+	delete(s.clients, prev_cid)
+	atomic.StoreUint64(sc.cid, uint64(cid))
+	s.clients[cid] = *sc
+	return prev_cid, msg.SUCCESS
+}
+
+// Take the relays stored for a session, for the client taking it over. Must be called with the session lock held,
+// as relays can't be stored meanwhile, so the whole backlog is collected here.
+func (s *Server) takeBacklog(cid msg.ClientId) []msg.RelayIndication {
+	backlog, err := s.cfg().MessageStore.Take(cid)
+	if err != nil {
+		s.cfg().Logger.Error("Failed to load stored relays", logging.F("client", cid), logging.F("err", err))
+	}
+	return backlog
+}
+
+// Clean up after a client has moved from one ID to another, abandoning the subscriptions, groups, history and name of
+// the previous ID
+func (s *Server) abandonClientId(sc *serverClient, prev_cid, cid msg.ClientId) {
+	ns := sc.ns()
+	s.unsubscribeAll(prev_cid)
+	s.leaveAllGroups(prev_cid)
+	s.dropHistory(prev_cid)
+	s.clearName(prev_cid)
+	s.notifyPresence(sc, prev_cid, ns, false)
+	s.notifyPresence(sc, cid, ns, true)
+	s.detachBackplane(prev_cid)
+	s.attachBackplane(cid)
+}
+
+// Check whether a disconnected session can no longer be resumed. Must be called with the session lock held.
+func (s *Server) isExpired(sess *session) bool {
+	return !sess.offline_since.IsZero() && time.Since(sess.offline_since) > s.cfg().SessionTimeout
+}
+
+// Forget a session and its stored relays. Must be called with the session lock held.
+func (s *Server) dropSession(cid msg.ClientId) {
+	delete(s.sessions, cid)
+	s.dropHistory(cid)
+	if err := s.cfg().MessageStore.Drop(cid); err != nil {
+		s.cfg().Logger.Error("Failed to drop stored relays", logging.F("client", cid), logging.F("err", err))
+	}
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+)
+
+// Add a listener which will accept new incoming TLS connections from clients automatically.
+// The raw listener 'l' is wrapped so that every accepted connection performs a TLS handshake using 'cfg'.
+// The server will handle closing the listener when it shuts down.
+// 'ok' return value will be true unless server is closed
+func (s *Server) AddTLSListener(l net.Listener, cfg *tls.Config) (ok bool) {
+	return s.AddListener(tls.NewListener(l, cfg))
+}
+
+// CertificateReloader holds a TLS certificate loaded from a pair of PEM files, which can be
+// reloaded at any time without restarting the server, for example when the certificate is renewed.
+//
+// Use it by setting the 'GetCertificate' field of a tls.Config to the reloader's GetCertificate method.
+type CertificateReloader struct {
+	certFile string
+	keyFile  string
+	// Currently active certificate, and a mutex protecting it
+	cert       *tls.Certificate
+	cert_mutex sync.RWMutex
+}
+
+// Create a new CertificateReloader, performing the initial load of the certificate and key files.
+func NewCertificateReloader(certFile, keyFile string) (*CertificateReloader, error) {
+	r := &CertificateReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload the certificate and key from their files. New TLS handshakes will use the new certificate,
+// existing connections are unaffected. If loading fails, the previous certificate remains in use.
+func (r *CertificateReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert_mutex.Lock()
+	r.cert = &cert
+	r.cert_mutex.Unlock()
+	return nil
+}
+
+// GetCertificate returns the currently loaded certificate, for use as tls.Config.GetCertificate
+func (r *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.cert_mutex.RLock()
+	defer r.cert_mutex.RUnlock()
+	return r.cert, nil
+}
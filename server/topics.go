@@ -0,0 +1,92 @@
+package server
+
+import (
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// Maximum length of a topic name, in bytes
+const maxTopicLength = 255
+
+// Set of clients subscribed to a single topic
+type topicMembers map[msg.ClientId]struct{}
+
+// Handle an incoming Subscribe Request Message
+func (s *Server) handleSubscribeRequest(sc *serverClient, mesg *msg.Message, rsp *msg.Message) {
+	rsp.SubRes = &msg.SubscribeResponse{
+		Status: checkTopic(mesg.SubReq.Topic),
+	}
+	if rsp.SubRes.Status == msg.SUCCESS {
+		s.subscribe(sc.id(), scopedName{sc.ns(), mesg.SubReq.Topic})
+	}
+}
+
+// Handle an incoming Unsubscribe Request Message
+func (s *Server) handleUnsubscribeRequest(sc *serverClient, mesg *msg.Message, rsp *msg.Message) {
+	rsp.UnsubRes = &msg.UnsubscribeResponse{
+		Status: checkTopic(mesg.UnsubReq.Topic),
+	}
+	if rsp.UnsubRes.Status == msg.SUCCESS {
+		s.unsubscribe(sc.id(), scopedName{sc.ns(), mesg.UnsubReq.Topic})
+	}
+}
+
+// Check that a topic name is valid for use in the protocol
+func checkTopic(topic string) msg.Status {
+	if topic == "" {
+		return msg.INVALID_ID
+	}
+	if len(topic) > maxTopicLength {
+		return msg.TOO_LONG
+	}
+	return msg.SUCCESS
+}
+
+// Add a client to a topic (no-op if already subscribed)
+func (s *Server) subscribe(cid msg.ClientId, topic scopedName) {
+	s.topics_mutex.Lock()
+	members, ok := s.topics[topic]
+	if !ok {
+		members = make(topicMembers)
+		s.topics[topic] = members
+	}
+	members[cid] = struct{}{}
+	s.topics_mutex.Unlock()
+}
+
+// Remove a client from a topic, cleaning up the topic if it is now empty
+func (s *Server) unsubscribe(cid msg.ClientId, topic scopedName) {
+	s.topics_mutex.Lock()
+	if members, ok := s.topics[topic]; ok {
+		delete(members, cid)
+		if len(members) == 0 {
+			delete(s.topics, topic)
+		}
+	}
+	s.topics_mutex.Unlock()
+}
+
+// Remove a client from every topic it is subscribed to
+func (s *Server) unsubscribeAll(cid msg.ClientId) {
+	s.topics_mutex.Lock()
+	for topic, members := range s.topics {
+		delete(members, cid)
+		if len(members) == 0 {
+			delete(s.topics, topic)
+		}
+	}
+	s.topics_mutex.Unlock()
+}
+
+// Get a new slice of all client IDs subscribed to a topic in a namespace, removing the ID of the caller
+func (s *Server) getTopicMembers(ns string, topic string, except_cid msg.ClientId) []msg.ClientId {
+	s.topics_mutex.RLock()
+	members := s.topics[scopedName{ns, topic}]
+	cids := make([]msg.ClientId, 0, len(members))
+	for k := range members {
+		if k != except_cid {
+			cids = append(cids, k)
+		}
+	}
+	s.topics_mutex.RUnlock()
+	return cids
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// ListenUnix listens for incoming connections on a Unix domain socket at 'path', for use with 'AddListener'.
+// This lets clients on the same machine use the hub without the overhead of TCP.
+//
+// A socket file left behind by a server that didn't shut down cleanly is replaced, but not one that another
+// server is still listening on. The socket file is removed when the listener is closed (such as by 'Server.Close').
+func ListenUnix(path string) (net.Listener, error) {
+	l, err := net.Listen("unix", path)
+	if err == nil || !isStaleSocket(path) {
+		return l, err
+	}
+	if err := os.Remove(path); err != nil {
+		return nil, err
+	}
+	return net.Listen("unix", path)
+}
+
+// Check whether 'path' is a Unix domain socket that nothing is listening on
+func isStaleSocket(path string) bool {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return false
+	}
+	con, err := net.Dial("unix", path)
+	if err == nil {
+		con.Close()
+		return false
+	}
+	return !errors.Is(err, os.ErrPermission)
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"sync/atomic"
+
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// Handle an incoming Hello Request Message, agreeing on the protocol version for the rest of the connection
+func (s *Server) handleHelloRequest(sc *serverClient, mesg *msg.Message, rsp *msg.Message) {
+	rsp.HelloRes = &msg.HelloResponse{
+		Status:     msg.VERSION_MISMATCH,
+		MinVersion: msg.MinVersion,
+		MaxVersion: msg.MaxVersion,
+	}
+	if v, ok := msg.NegotiateVersion(mesg.HelloReq.MinVersion, mesg.HelloReq.MaxVersion); ok {
+		rsp.HelloRes.Status = msg.SUCCESS
+		rsp.HelloRes.Version = v
+		atomic.StoreInt32(sc.version, int32(v))
+	}
+}
+
+// Reject a message with an unsupported version, telling the client which versions are supported
+func (s *Server) rejectVersion(sc *serverClient, mesg *msg.Message) {
+	sc.responseMsgs <- msg.Message{
+		Version:   msg.MyVersion,
+		MessageId: mesg.MessageId,
+		HelloRes: &msg.HelloResponse{
+			Status:     msg.VERSION_MISMATCH,
+			MinVersion: msg.MinVersion,
+			MaxVersion: msg.MaxVersion,
+		},
+	}
+}
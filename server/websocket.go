@@ -0,0 +1,15 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/CiaranWoodward/broadcast_hub/transport/ws"
+)
+
+// Get an http.Handler which accepts websocket connections from clients (such as browsers), and adds them to the server.
+// The handler can be served alongside any other listeners, for example:
+//
+//	http.Handle("/bhub", ser.WebSocketHandler())
+func (s *Server) WebSocketHandler() http.Handler {
+	return ws.Handler(s.AddClientByConnection)
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/CiaranWoodward/broadcast_hub/msg"
+)
+
+// Start the client's request workers, which handle queued requests concurrently until the queue is closed
+func (s *Server) startWorkers(sc serverClient, workers *sync.WaitGroup) {
+	workers.Add(s.cfg().RequestWorkers)
+	for i := 0; i < s.cfg().RequestWorkers; i++ {
+		go func() {
+			defer workers.Done()
+			for mesg := range sc.requests {
+				s.handleMessage(&sc, &mesg)
+				atomic.AddInt32(sc.inflight, -1)
+			}
+		}()
+	}
+}
+
+// Check whether a message can be handed to a request worker.
+// Messages setting up the connection are always handled in order by the dispatcher, as are cheap requests
+// which have no Status to reject them as BUSY with.
+func isPoolable(mesg *msg.Message) bool {
+	inline := msg.Message{
+		Version:   mesg.Version,
+		MessageId: mesg.MessageId,
+		Trace:     mesg.Trace,
+		IdReq:     mesg.IdReq,
+		PingReq:   mesg.PingReq,
+		PingRes:   mesg.PingRes,
+		DelivReq:  mesg.DelivReq,
+		FlowUpd:   mesg.FlowUpd,
+		HelloReq:  mesg.HelloReq,
+		AuthReq:   mesg.AuthReq,
+		ResumeReq: mesg.ResumeReq,
+	}
+	return inline == msg.Message{Version: mesg.Version, MessageId: mesg.MessageId, Trace: mesg.Trace} && *mesg != inline
+}
+
+// Reject every request in a message with the status, such as BUSY if the client has too many outstanding.
+// An Error Response goes with them, with 'text' describing why.
+func (s *Server) rejectRequests(sc *serverClient, mesg *msg.Message, status msg.Status, text string) {
+	rsp := msg.Message{
+		Version:   msg.MyVersion,
+		MessageId: mesg.MessageId,
+		Error:     &msg.ErrorResponse{Status: status, Text: text},
+	}
+	if mesg.ListReq != nil {
+		rsp.ListRes = &msg.ListResponse{Status: status}
+	}
+	if mesg.RelayReq != nil {
+		rsp.RelayRes = &msg.RelayResponse{Status: status}
+	}
+	if mesg.RelayBatReq != nil {
+		rsp.RelayBatRes = &msg.RelayBatchResponse{Status: status}
+	}
+	if mesg.SubReq != nil {
+		rsp.SubRes = &msg.SubscribeResponse{Status: status}
+	}
+	if mesg.UnsubReq != nil {
+		rsp.UnsubRes = &msg.UnsubscribeResponse{Status: status}
+	}
+	if mesg.NameReq != nil {
+		rsp.NameRes = &msg.SetNameResponse{Status: status}
+	}
+	if mesg.ResolvReq != nil {
+		rsp.ResolvRes = &msg.ResolveNameResponse{Status: status}
+	}
+	if mesg.PresReq != nil {
+		rsp.PresRes = &msg.PresenceResponse{Status: status}
+	}
+	if mesg.GrpCreateReq != nil {
+		rsp.GrpCreateRes = &msg.GroupCreateResponse{Status: status}
+	}
+	if mesg.GrpJoinReq != nil {
+		rsp.GrpJoinRes = &msg.GroupJoinResponse{Status: status}
+	}
+	if mesg.GrpLeaveReq != nil {
+		rsp.GrpLeaveRes = &msg.GroupLeaveResponse{Status: status}
+	}
+	if mesg.GrpListReq != nil {
+		rsp.GrpListRes = &msg.GroupListResponse{Status: status}
+	}
+	if mesg.HistReq != nil {
+		rsp.HistRes = &msg.HistoryResponse{Status: status}
+	}
+	if mesg.StatsReq != nil {
+		rsp.StatsRes = &msg.StatsResponse{Status: status}
+	}
+	sc.responseMsgs <- rsp
+}
@@ -0,0 +1,127 @@
+/*
+Package testutil contains helpers for testing broadcast_hub clients and servers against misbehaving networks.
+
+Wrap injects faults into a connection, separately for each direction:
+
+	con = testutil.Wrap(con, testutil.Faults{Latency: 50 * time.Millisecond}, testutil.Faults{Bandwidth: 1000})
+*/
+package testutil
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Default size of the chunks data is forwarded in, if Faults.ChunkSize isn't set
+const defaultChunkSize = 512
+
+// Maximum number of chunks in flight in each direction, waiting out their latency
+const maxInFlight = 1024
+
+// Faults to inject into one direction of a wrapped connection. The zero value forwards data unchanged.
+type Faults struct {
+	// Delay every chunk of data by this long, without limiting the throughput
+	Latency time.Duration
+	// Add a random delay of up to this long to the Latency of each chunk. Chunks are never reordered.
+	Jitter time.Duration
+	// Limit the throughput to this many bytes per second. Zero for no limit.
+	Bandwidth int
+	// Probability of silently dropping each chunk, from 0 to 1, corrupting the stream
+	DropRate float64
+	// Close the connection once this many bytes have been forwarded, which is usually in the middle of a message.
+	// Zero never closes it.
+	DisconnectAfter int
+	// Forward data in chunks of up to this many bytes, which is the granularity of the other faults.
+	// Zero uses 512 bytes.
+	ChunkSize int
+	// Seed for the random jitter and drops, so runs can be repeated. Zero uses a different seed each time.
+	Seed int64
+}
+
+// A chunk of data in flight, and when it's due to arrive
+type chunk struct {
+	data []byte
+	due  time.Time
+}
+
+// Wrap a connection, injecting faults into the data written to it ('write') and the data read from it ('read').
+// The returned connection is closed when the wrapped one is, and vice versa.
+func Wrap(con net.Conn, write, read Faults) net.Conn {
+	in, out := net.Pipe()
+	closeBoth := sync.OnceFunc(func() {
+		con.Close()
+		in.Close()
+	})
+	go forward(con, in, read, closeBoth)
+	go forward(in, con, write, closeBoth)
+	return out
+}
+
+// Forward data from 'src' to 'dst' until either fails, injecting the faults.
+func forward(src, dst net.Conn, f Faults, closeBoth func()) {
+	chunkSize := f.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+	seed := f.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	rng := rand.New(rand.NewSource(seed))
+
+	// Read chunks as soon as the bandwidth allows, so the latency doesn't limit the throughput.
+	// Without latency nothing is held in flight, so a slow reader at the destination slows down reading the source.
+	inFlight := make(chan chunk)
+	if f.Latency > 0 || f.Jitter > 0 {
+		inFlight = make(chan chunk, maxInFlight)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(inFlight)
+		var last time.Time
+		for {
+			buffer := make([]byte, chunkSize)
+			n, err := src.Read(buffer)
+			if err != nil {
+				return
+			}
+			if f.Bandwidth > 0 {
+				time.Sleep(time.Duration(n) * time.Second / time.Duration(f.Bandwidth))
+			}
+			if f.DropRate > 0 && rng.Float64() < f.DropRate {
+				continue
+			}
+			due := time.Now().Add(f.Latency)
+			if f.Jitter > 0 {
+				due = due.Add(time.Duration(rng.Int63n(int64(f.Jitter))))
+			}
+			// Keep the chunks in order
+			if due.Before(last) {
+				due = last
+			}
+			last = due
+			select {
+			case inFlight <- chunk{data: buffer[:n], due: due}:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	defer closeBoth()
+	forwarded := 0
+	for c := range inFlight {
+		time.Sleep(time.Until(c.due))
+		if f.DisconnectAfter > 0 && forwarded+len(c.data) >= f.DisconnectAfter {
+			dst.Write(c.data[:f.DisconnectAfter-forwarded])
+			return
+		}
+		if _, err := dst.Write(c.data); err != nil {
+			return
+		}
+		forwarded += len(c.data)
+	}
+}
@@ -0,0 +1,95 @@
+package testutil
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+)
+
+// Write to one end of a connection, and read everything until it's closed from the other
+func sendAll(t *testing.T, from, to net.Conn, data []byte) []byte {
+	go func() {
+		from.Write(data)
+		from.Close()
+	}()
+	received, err := io.ReadAll(to)
+	assert.Nil(t, err)
+	to.Close()
+	return received
+}
+
+func TestWrapForwards(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	// Write through the wrapper
+	con, peer := net.Pipe()
+	wrapped := Wrap(con, Faults{ChunkSize: 3}, Faults{})
+	assert.Equal(t, []byte("Hello there!"), sendAll(t, wrapped, peer, []byte("Hello there!")))
+
+	// Read through the wrapper
+	con, peer = net.Pipe()
+	wrapped = Wrap(con, Faults{}, Faults{ChunkSize: 3})
+	assert.Equal(t, []byte("General Kenobi"), sendAll(t, peer, wrapped, []byte("General Kenobi")))
+}
+
+func TestWrapLatency(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	con, peer := net.Pipe()
+	wrapped := Wrap(con, Faults{Latency: 50 * time.Millisecond, Jitter: 10 * time.Millisecond}, Faults{})
+	start := time.Now()
+	assert.Equal(t, []byte("Hello"), sendAll(t, wrapped, peer, []byte("Hello")))
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+}
+
+func TestWrapBandwidth(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	// 1000 bytes at 10kB/s takes 100ms
+	data := bytes.Repeat([]byte{0x55}, 1000)
+	con, peer := net.Pipe()
+	wrapped := Wrap(con, Faults{}, Faults{Bandwidth: 10000, ChunkSize: 100})
+	start := time.Now()
+	assert.Equal(t, data, sendAll(t, peer, wrapped, data))
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+}
+
+func TestWrapDrop(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	// Everything dropped
+	con, peer := net.Pipe()
+	wrapped := Wrap(con, Faults{DropRate: 1}, Faults{})
+	assert.Empty(t, sendAll(t, wrapped, peer, []byte("Hello")))
+
+	// Some dropped, one byte at a time
+	data := bytes.Repeat([]byte{0x55}, 1000)
+	con, peer = net.Pipe()
+	wrapped = Wrap(con, Faults{DropRate: 0.5, ChunkSize: 1, Seed: 1}, Faults{})
+	received := sendAll(t, wrapped, peer, data)
+	assert.Greater(t, len(received), 0)
+	assert.Less(t, len(received), len(data))
+}
+
+func TestWrapDisconnect(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	con, peer := net.Pipe()
+	wrapped := Wrap(con, Faults{}, Faults{DisconnectAfter: 7, ChunkSize: 5})
+	received := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(wrapped)
+		received <- data
+	}()
+	go peer.Write([]byte("General Kenobi"))
+	assert.Equal(t, []byte("General"), <-received)
+	// The other end is closed too
+	_, err := peer.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	wrapped.Close()
+}
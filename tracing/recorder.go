@@ -0,0 +1,150 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// SpanContext identifies a span within its trace, as carried in a W3C traceparent
+type SpanContext struct {
+	TraceID string
+	SpanID  string
+}
+
+// Valid checks whether the SpanContext identifies a span
+func (sc SpanContext) Valid() bool {
+	return len(sc.TraceID) == 32 && len(sc.SpanID) == 16 && isHex(sc.TraceID) && isHex(sc.SpanID) &&
+		strings.Trim(sc.TraceID, "0") != "" && strings.Trim(sc.SpanID, "0") != ""
+}
+
+// Traceparent formats the SpanContext as a W3C traceparent, for a sampled span
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-01", sc.TraceID, sc.SpanID)
+}
+
+// ParseTraceparent gets the SpanContext from a W3C traceparent
+func ParseTraceparent(traceparent string) (sc SpanContext, ok bool) {
+	parts := strings.Split(traceparent, "-")
+	if len(parts) != 4 || len(parts[0]) != 2 || len(parts[3]) != 2 || parts[0] == "ff" {
+		return SpanContext{}, false
+	}
+	sc = SpanContext{TraceID: parts[1], SpanID: parts[2]}
+	if !sc.Valid() {
+		return SpanContext{}, false
+	}
+	return sc, true
+}
+
+func isHex(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil && strings.ToLower(s) == s
+}
+
+// RecordedSpan is a span which has ended, as recorded by a Recorder
+type RecordedSpan struct {
+	Name string
+	SpanContext
+	// Span this is a child of, which may be in another process. Invalid for the root span of a trace.
+	Parent     SpanContext
+	Attributes map[string]interface{}
+	Err        error
+}
+
+// Recorder is a Tracer which keeps every span in memory once it has ended, with W3C traceparents as the trace
+// context. It is intended for tests and debugging, rather than for tracing a production hub.
+type Recorder struct {
+	mutex sync.Mutex
+	spans []RecordedSpan
+}
+
+// Key for the current span in a context
+type spanKey struct{}
+
+// NewRecorder gets an empty Recorder
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+// Spans gets the spans which have ended, in the order they ended
+func (r *Recorder) Spans() []RecordedSpan {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]RecordedSpan(nil), r.spans...)
+}
+
+func (r *Recorder) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	parent, _ := ctx.Value(spanKey{}).(SpanContext)
+	span := &recorderSpan{r: r, rec: RecordedSpan{
+		Name:        name,
+		SpanContext: SpanContext{TraceID: parent.TraceID, SpanID: randomHex(8)},
+		Parent:      parent,
+		Attributes:  make(map[string]interface{}),
+	}}
+	if !parent.Valid() {
+		span.rec.TraceID = randomHex(16)
+	}
+	span.SetAttributes(attrs...)
+	return context.WithValue(ctx, spanKey{}, span.rec.SpanContext), span
+}
+
+func (r *Recorder) Inject(ctx context.Context) string {
+	if sc, ok := ctx.Value(spanKey{}).(SpanContext); ok && sc.Valid() {
+		return sc.Traceparent()
+	}
+	return ""
+}
+
+func (r *Recorder) Extract(ctx context.Context, traceparent string) context.Context {
+	if sc, ok := ParseTraceparent(traceparent); ok {
+		return context.WithValue(ctx, spanKey{}, sc)
+	}
+	return ctx
+}
+
+// Span started by a Recorder
+type recorderSpan struct {
+	r     *Recorder
+	mutex sync.Mutex
+	rec   RecordedSpan
+	ended bool
+}
+
+func (s *recorderSpan) SetAttributes(attrs ...Attribute) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, a := range attrs {
+		s.rec.Attributes[a.Key] = a.Value
+	}
+}
+
+func (s *recorderSpan) RecordError(err error) {
+	if err == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.rec.Err = err
+}
+
+func (s *recorderSpan) End() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.ended {
+		return
+	}
+	s.ended = true
+	s.r.mutex.Lock()
+	s.r.spans = append(s.r.spans, s.rec)
+	s.r.mutex.Unlock()
+}
+
+// Random lowercase hex string of 'n' bytes
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
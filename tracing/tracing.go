@@ -0,0 +1,85 @@
+/*
+Package tracing defines the Tracer interface used by the broadcast_hub server and client to record spans, so that
+embedders can trace requests and relays with their own tracing stack, such as OpenTelemetry.
+
+The client records a span around each request it sends, the server around the dispatch of each message it receives and
+the fan-out of each relay, and the client again around the delivery of each relay it receives. The trace context is
+carried between them in the optional Trace field of each message, so a relay can be followed from its sender, through
+the hub, to every recipient.
+
+broadcast_hub doesn't depend on OpenTelemetry, but an OTel trace.Tracer can be adapted with a few lines, using the W3C
+TraceContext propagator for Inject and Extract:
+
+	type otelTracer struct{ t trace.Tracer }
+
+	func (o otelTracer) Start(ctx context.Context, name string, attrs ...tracing.Attribute) (context.Context, tracing.Span) {
+		ctx, span := o.t.Start(ctx, name)
+		s := otelSpan{span}
+		s.SetAttributes(attrs...)
+		return ctx, s
+	}
+
+	func (o otelTracer) Inject(ctx context.Context) string {
+		carrier := propagation.MapCarrier{}
+		propagation.TraceContext{}.Inject(ctx, carrier)
+		return carrier.Get("traceparent")
+	}
+
+	func (o otelTracer) Extract(ctx context.Context, traceparent string) context.Context {
+		return propagation.TraceContext{}.Extract(ctx, propagation.MapCarrier{"traceparent": traceparent})
+	}
+
+with otelSpan converting each Attribute to an attribute.KeyValue with 'attribute.String(a.Key, fmt.Sprint(a.Value))'.
+*/
+package tracing
+
+import (
+	"context"
+)
+
+// Attribute is a key-value pair describing a span
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// A makes an Attribute
+func A(key string, value interface{}) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Tracer starts spans, and carries their trace context between processes.
+// Implementations must be safe to call from multiple goroutines.
+type Tracer interface {
+	// Start a span named 'name', as a child of the span in 'ctx' if there is one.
+	// Returns a context containing the new span, for starting its children.
+	Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span)
+	// Inject gets the trace context of the span in 'ctx', to be carried in a message's Trace field.
+	// Returns "" if there is no span, so nothing is added to the message.
+	Inject(ctx context.Context) string
+	// Extract gets a context containing the trace context carried in a message's Trace field, so the spans started
+	// from it are children of the remote span. An empty or invalid trace context returns 'ctx' unchanged.
+	Extract(ctx context.Context, traceparent string) context.Context
+}
+
+// Span is an operation being traced, which is recorded once it has ended
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	// RecordError records that the operation failed. A nil error is ignored.
+	RecordError(err error)
+	End()
+}
+
+// Nop is a Tracer that records nothing, and never carries any trace context
+var Nop Tracer = nop{}
+
+type nop struct{}
+
+func (nop) Start(ctx context.Context, _ string, _ ...Attribute) (context.Context, Span) {
+	return ctx, nop{}
+}
+func (nop) Inject(context.Context) string                         { return "" }
+func (nop) Extract(ctx context.Context, _ string) context.Context { return ctx }
+func (nop) SetAttributes(...Attribute)                            {}
+func (nop) RecordError(error)                                     {}
+func (nop) End()                                                  {}
@@ -0,0 +1,73 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTraceparent(t *testing.T) {
+	sc, ok := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	assert.True(t, ok)
+	assert.Equal(t, SpanContext{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7"}, sc)
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", sc.Traceparent())
+
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01",
+	} {
+		_, ok := ParseTraceparent(invalid)
+		assert.False(t, ok, invalid)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	r := NewRecorder()
+	assert.Equal(t, "", r.Inject(context.Background()))
+
+	ctx, root := r.Start(context.Background(), "root", A("a", 1))
+	traceparent := r.Inject(ctx)
+	_, child := r.Start(r.Extract(context.Background(), traceparent), "child")
+	child.SetAttributes(A("b", "two"))
+	child.RecordError(nil)
+	child.RecordError(errors.New("failed"))
+	child.End()
+	child.End()
+	root.End()
+
+	spans := r.Spans()
+	assert.Len(t, spans, 2)
+	assert.Equal(t, "child", spans[0].Name)
+	assert.Equal(t, "root", spans[1].Name)
+	assert.Equal(t, spans[1].Traceparent(), traceparent)
+	assert.Equal(t, spans[1].SpanContext, spans[0].Parent)
+	assert.Equal(t, spans[1].TraceID, spans[0].TraceID)
+	assert.NotEqual(t, spans[1].SpanID, spans[0].SpanID)
+	assert.False(t, spans[1].Parent.Valid())
+	assert.Equal(t, map[string]interface{}{"a": 1}, spans[1].Attributes)
+	assert.Equal(t, map[string]interface{}{"b": "two"}, spans[0].Attributes)
+	assert.Equal(t, errors.New("failed"), spans[0].Err)
+	assert.Nil(t, spans[1].Err)
+
+	// An invalid trace context starts a new trace
+	_, other := r.Start(r.Extract(context.Background(), "garbage"), "other")
+	other.End()
+	assert.NotEqual(t, spans[1].TraceID, r.Spans()[2].TraceID)
+	assert.False(t, r.Spans()[2].Parent.Valid())
+}
+
+func TestNop(t *testing.T) {
+	ctx, span := Nop.Start(context.Background(), "span", A("a", 1))
+	span.SetAttributes(A("b", 2))
+	span.RecordError(errors.New("failed"))
+	span.End()
+	assert.Equal(t, "", Nop.Inject(ctx))
+	assert.Equal(t, ctx, Nop.Extract(ctx, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"))
+}
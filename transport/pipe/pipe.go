@@ -0,0 +1,69 @@
+/*
+Package pipe implements a Windows named pipe transport for broadcast_hub, for local clients on Windows hosts where
+Unix domain sockets aren't available.
+
+Pipes are named like "bhub", which is the pipe \\.\pipe\bhub. A full pipe path can be given instead.
+On other platforms, Listen and Dial fail with ErrUnsupported.
+
+Example, serving clients on a named pipe:
+  l, err := pipe.Listen("bhub")
+  if err == nil {
+	  ser.AddListener(l)
+  }
+
+And connecting to it:
+  cli, err := client.DialPipe("bhub", client.DefaultClientConfig())
+*/
+package pipe
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/CiaranWoodward/broadcast_hub/transport"
+)
+
+// Prefix of the path of every local named pipe
+const pathPrefix = `\\.\pipe\`
+
+// Network name of named pipes, as used by Dialer
+const Network = "pipe"
+
+// ErrUnsupported is returned on platforms without named pipes
+var ErrUnsupported = errors.New("named pipes are only supported on Windows")
+
+// Path gets the full path of the named pipe, unless 'name' is already a path
+func Path(name string) string {
+	if strings.HasPrefix(name, `\\`) {
+		return name
+	}
+	return pathPrefix + name
+}
+
+// Dialer connects to named pipes, as a 'transport.Dialer'. The network must be "pipe", or empty.
+type Dialer struct {
+	// How long to wait for the pipe to be free, if the server isn't ready to accept another client. Zero waits forever.
+	Timeout time.Duration
+}
+
+var _ transport.Dialer = Dialer{}
+
+func (d Dialer) Dial(network, name string) (net.Conn, error) {
+	if network != Network && network != "" {
+		return nil, net.UnknownNetworkError(network)
+	}
+	return dial(Path(name), d.Timeout)
+}
+
+// Dial connects to the named pipe, waiting as long as it takes for the pipe to be free
+func Dial(name string) (net.Conn, error) {
+	return Dialer{}.Dial(Network, name)
+}
+
+// Listen creates the named pipe, and accepts connections on it until the listener is closed.
+// The pipe has the default security descriptor for the user running the server.
+func Listen(name string) (net.Listener, error) {
+	return listen(Path(name))
+}
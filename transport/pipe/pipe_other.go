@@ -0,0 +1,22 @@
+//go:build !windows
+
+package pipe
+
+import (
+	"net"
+	"time"
+)
+
+func dial(path string, timeout time.Duration) (net.Conn, error) {
+	return nil, &net.OpError{Op: "dial", Net: Network, Addr: pipeAddr(path), Err: ErrUnsupported}
+}
+
+func listen(path string) (net.Listener, error) {
+	return nil, &net.OpError{Op: "listen", Net: Network, Addr: pipeAddr(path), Err: ErrUnsupported}
+}
+
+// Address of a named pipe, for errors
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return Network }
+func (a pipeAddr) String() string  { return string(a) }
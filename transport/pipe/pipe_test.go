@@ -0,0 +1,54 @@
+package pipe
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPath(t *testing.T) {
+	assert.Equal(t, `\\.\pipe\bhub`, Path("bhub"))
+	assert.Equal(t, `\\server\pipe\bhub`, Path(`\\server\pipe\bhub`))
+}
+
+func TestPipe(t *testing.T) {
+	name := fmt.Sprintf("bhub-test-%d", os.Getpid())
+	l, err := Listen(name)
+	if runtime.GOOS != "windows" {
+		assert.ErrorIs(t, err, ErrUnsupported)
+		_, err = Dial(name)
+		assert.ErrorIs(t, err, ErrUnsupported)
+		return
+	}
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer l.Close()
+
+	go func() {
+		con, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer con.Close()
+		buf := make([]byte, 5)
+		n, _ := con.Read(buf)
+		con.Write(buf[:n])
+	}()
+	con, err := Dialer{}.Dial(Network, name)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer con.Close()
+	con.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	n, err := con.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(buf[:n]))
+
+	_, err = Dialer{}.Dial("tcp", name)
+	assert.NotNil(t, err)
+}
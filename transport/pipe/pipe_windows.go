@@ -0,0 +1,19 @@
+package pipe
+
+import (
+	"net"
+	"time"
+
+	"github.com/Microsoft/go-winio"
+)
+
+func dial(path string, timeout time.Duration) (net.Conn, error) {
+	if timeout <= 0 {
+		return winio.DialPipe(path, nil)
+	}
+	return winio.DialPipe(path, &timeout)
+}
+
+func listen(path string) (net.Listener, error) {
+	return winio.ListenPipe(path, nil)
+}
@@ -0,0 +1,34 @@
+/*
+Package transport describes how broadcast_hub clients and servers are connected, whatever the underlying transport.
+
+A server accepts clients from any Listener (with 'Server.AddListener'), and a client dials the server with any Dialer
+(with 'ClientConfig.Dialer'). The transports available are:
+  - TCP, optionally with TLS, from the net and crypto/tls packages
+  - Unix domain sockets, with 'server.ListenUnix' and 'client.DialUnix'
+  - Websockets, from the transport/ws package
+  - Windows named pipes, from the transport/pipe package, for local clients where Unix domain sockets aren't available
+
+Example, listening on a named pipe on Windows and a Unix domain socket elsewhere:
+  var l transport.Listener
+  if runtime.GOOS == "windows" {
+	  l, err = pipe.Listen("bhub")
+  } else {
+	  l, err = server.ListenUnix("/run/bhub.sock")
+  }
+  if err == nil {
+	  ser.AddListener(l)
+  }
+*/
+package transport
+
+import "net"
+
+// Listener accepts connections from clients for a server. Every listener used by broadcast_hub is a net.Listener,
+// so this is only an alias for documentation.
+type Listener = net.Listener
+
+// Dialer connects to a server. It's satisfied by *net.Dialer, the dialers from golang.org/x/net/proxy and pipe.Dialer,
+// and can be used as the 'ClientConfig.Dialer' of a client.
+type Dialer interface {
+	Dial(network, address string) (net.Conn, error)
+}
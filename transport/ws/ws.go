@@ -0,0 +1,133 @@
+/*
+Package ws implements a websocket transport for broadcast_hub, so that browser-based clients can join the hub.
+
+Each protocol message is sent as a single binary websocket frame, containing exactly the same encoding
+as is used over TCP. Received frames are treated as a continuous stream, so the framing of incoming messages
+does not matter.
+
+Example, serving websocket clients on port 8080 alongside the TCP listener:
+  ser := server.NewServer()
+  http.Handle("/bhub", ser.WebSocketHandler())
+  go http.ListenAndServe(":8080", nil)
+
+And connecting to it:
+  con, err := ws.Dial("ws://localhost:8080/bhub", "http://localhost/")
+  if err == nil {
+	  cli := client.NewClient(con)
+  }
+*/
+package ws
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"golang.org/x/net/proxy"
+	"golang.org/x/net/websocket"
+)
+
+// Handler returns an http.Handler which upgrades each request to a websocket, and passes the resulting
+// connection to 'accept' (For example 'Server.AddClientByConnection').
+// The handler keeps the HTTP request open until the connection is closed by its new owner.
+// If 'accept' returns false, the connection is closed immediately.
+//
+// Cross-origin requests are accepted; wrap the handler if the origin needs to be checked.
+func Handler(accept func(con net.Conn) bool) http.Handler {
+	return websocket.Server{
+		Handler: func(wsc *websocket.Conn) {
+			con := wrap(wsc)
+			if !accept(con) {
+				con.Close()
+			}
+			// The websocket is closed as soon as this function returns, so wait for the owner to finish with it
+			<-con.closed
+		},
+	}
+}
+
+// Dial connects to a websocket server at 'url' (ws:// or wss://), sending 'origin' as the request's origin.
+// The returned connection can be passed directly to 'client.NewClient'.
+func Dial(url, origin string) (net.Conn, error) {
+	wsc, err := websocket.Dial(url, "", origin)
+	if err != nil {
+		return nil, err
+	}
+	return wrap(wsc), nil
+}
+
+// DialVia is Dial, but makes the underlying connection to the server with 'dialer', eg. through a SOCKS5 proxy from
+// 'proxy.SOCKS5' or 'proxy.FromURL'.
+func DialVia(url, origin string, dialer proxy.Dialer) (net.Conn, error) {
+	config, err := websocket.NewConfig(url, origin)
+	if err != nil {
+		return nil, err
+	}
+	address := config.Location.Host
+	if config.Location.Port() == "" {
+		switch config.Location.Scheme {
+		case "ws":
+			address = net.JoinHostPort(address, "80")
+		case "wss":
+			address = net.JoinHostPort(address, "443")
+		default:
+			return nil, fmt.Errorf("unsupported websocket scheme %q", config.Location.Scheme)
+		}
+	}
+	raw, err := dialer.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	con := raw
+	if config.Location.Scheme == "wss" {
+		tlsCon := tls.Client(raw, &tls.Config{ServerName: config.Location.Hostname()})
+		if err = tlsCon.Handshake(); err != nil {
+			raw.Close()
+			return nil, err
+		}
+		con = tlsCon
+	}
+	wsc, err := websocket.NewClient(config, con)
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	return wrap(wsc), nil
+}
+
+// Websocket connection, which sends binary frames and tracks when it has been closed
+type conn struct {
+	*websocket.Conn
+	closed     chan struct{}
+	close_once sync.Once
+}
+
+func wrap(wsc *websocket.Conn) *conn {
+	wsc.PayloadType = websocket.BinaryFrame
+	return &conn{
+		Conn:   wsc,
+		closed: make(chan struct{}),
+	}
+}
+
+// Close the websocket connection. Safe to call multiple times.
+func (c *conn) Close() (err error) {
+	c.close_once.Do(func() {
+		err = c.Conn.Close()
+		close(c.closed)
+	})
+	return
+}
+
+// RemoteAddr gets the address of the other end. Accepted connections report the client's TCP address, rather than
+// the websocket origin, so the server can tell where its clients are connecting from.
+func (c *conn) RemoteAddr() net.Addr {
+	if req := c.Conn.Request(); req != nil {
+		if addr, err := net.ResolveTCPAddr("tcp", req.RemoteAddr); err == nil {
+			return addr
+		}
+	}
+	return c.Conn.RemoteAddr()
+}